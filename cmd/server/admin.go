@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/config"
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_controller "github.com/boxboxjason/jukebox/internal/controller"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	gorm_logger "gorm.io/gorm/logger"
+)
+
+const ADMIN_USAGE = `Usage: jukebox <user|ban|token|stats> <command> [flags] [arguments]
+
+Commands:
+  user list                           list the users (--role to list the users of a role only)
+  user create <username> <email>      create a user with a verified email, the password is read from stdin (--role to give it a role)
+  user role <user> <role>             assign a role to the user: owner, admin, moderator or user (the last owner can not be demoted)
+  user reset-password <user>          replace the password of the user, read from stdin, and revoke its tokens
+  user verify <user>                  mark the email of the user as verified, allowing it to post
+  user reset-2fa <user>               disable the two-factor authentication of the user, when it lost its authenticator
+  user unlock <user>                  forget the failed logins of the user, lifting its lockout
+  ban list [user]                     list the active bans and mutes (of the user if provided)
+  ban add <user> --duration <d>       ban the user (--type=mute to mute it)
+  ban lift <user>                     lift the active bans and mutes of the user (--type to lift only one kind)
+  token revoke <user>                 revoke every token of the user, logging it out of every session
+  token purge                         delete every expired token
+  stats                               print the statistics of the instance
+
+A user is designated by its ID, its username or its email.
+
+The commands write to the database without going through the running servers. When they sign the access tokens
+(auth.signed_access_tokens), the servers keep accepting the tokens signed before a change of the user (role, ban, verified
+email, password, two-factor, revoked tokens) until these expire, after auth.signed_access_token_expiration at most: the
+deny-list refusing them is kept in memory by each server. Use the API to apply such a change to the open sessions at once.
+
+Flags:
+  --json              print the result as JSON
+  --role <role>       role of the created user, or of the listed users
+  --as <user>         moderator, admin or owner the action is attributed to in the audit log
+                      (the bans are issued by the first owner or admin by default)
+  --reason <text>     reason of the ban, recorded in the audit log
+  --duration <d>      duration of the ban (e.g. 30m, 24h)
+  --type <ban|mute>   type of the ban`
+
+// ADMIN_COMMANDS are the commands run by runAdminCommand
+var ADMIN_COMMANDS = map[string]bool{"user": true, "ban": true, "token": true, "stats": true}
+
+// adminOptions are the flags of the administrative commands
+type adminOptions struct {
+	json     bool
+	role     string
+	as       string
+	reason   string
+	duration time.Duration
+	ban_type string
+}
+
+// adminUser is a user as printed by the administrative commands, with its email
+type adminUser struct {
+	ID            int       `json:"id"`
+	Username      string    `json:"username"`
+	Email         string    `json:"email"`
+	VerifiedEmail bool      `json:"verified_email"`
+	Role          string    `json:"role"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// adminAction is the outcome of a command that does not return a record
+type adminAction struct {
+	Action string     `json:"action"`
+	User   *adminUser `json:"user,omitempty"`
+	Count  *int       `json:"count,omitempty"`
+}
+
+// adminCommand runs an administrative command and returns its result
+type adminCommand func(store *db_model.Store, options *adminOptions, args []string) (any, error)
+
+// parseAdminFlags takes the flags of the administrative commands out of the arguments
+// The remaining arguments are left to the configuration, whose flags may be mixed with them
+func parseAdminFlags(args []string) (*adminOptions, []string, error) {
+	options := &adminOptions{}
+	flags := flag.NewFlagSet("jukebox", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.BoolVar(&options.json, "json", false, "")
+	flags.StringVar(&options.role, "role", "", "")
+	flags.StringVar(&options.as, "as", "", "")
+	flags.StringVar(&options.reason, "reason", "", "")
+	flags.DurationVar(&options.duration, "duration", 0, "")
+	flags.StringVar(&options.ban_type, "type", "", "")
+
+	admin_args, other_args := []string{}, []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			other_args = append(other_args, args[i:]...)
+			break
+		}
+		name, has_value := "", false
+		if strings.HasPrefix(arg, "-") {
+			name, _, has_value = strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		}
+		admin_flag := flags.Lookup(name)
+		if admin_flag == nil {
+			other_args = append(other_args, arg)
+			continue
+		}
+		admin_args = append(admin_args, arg)
+
+		// The value of a non boolean flag may be the next argument
+		bool_flag, ok := admin_flag.Value.(interface{ IsBoolFlag() bool })
+		if !has_value && !(ok && bool_flag.IsBoolFlag()) && i+1 < len(args) {
+			i++
+			admin_args = append(admin_args, args[i])
+		}
+	}
+
+	err := flags.Parse(admin_args)
+	if err != nil {
+		return nil, nil, err
+	}
+	return options, other_args, nil
+}
+
+// runAdminCommand runs an administrative command against the configured database and returns the process exit code
+func runAdminCommand(cfg *config.Config, command string, options *adminOptions, args []string) int {
+	commands := map[string]adminCommand{
+		"user list":           listUsersCommand,
+		"user create":         createUserCommand,
+		"user role":           setRoleCommand,
+		"user reset-password": resetPasswordCommand,
+		"user verify":         verifyEmailCommand,
+		"user reset-2fa":      resetTwoFactorCommand,
+		"user unlock":         unlockUserCommand,
+		"ban list":            listBansCommand,
+		"ban add":             addBanCommand,
+		"ban lift":            liftBansCommand,
+		"token revoke":        revokeTokensCommand,
+		"token purge":         purgeTokensCommand,
+		"stats":               statsCommand,
+	}
+	if command != "stats" {
+		if len(args) == 0 {
+			fmt.Fprintln(os.Stderr, ADMIN_USAGE)
+			return 2
+		}
+		command, args = command+" "+args[0], args[1:]
+	}
+	run, ok := commands[command]
+	if !ok {
+		fmt.Fprintln(os.Stderr, ADMIN_USAGE)
+		return 2
+	}
+
+	// Open the database and bring its schema up to date, as the server does
+	db, err := db_model.OpenDatabase(cfg.DatabaseOptions())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to open the database:", err)
+		return 1
+	}
+	defer db_model.CloseDatabase(db)
+	db.Logger = gorm_logger.Default.LogMode(gorm_logger.Silent)
+	err = db_model.CheckSchema(db)
+	if err == nil {
+		_, err = db_model.MigrateUp(db, 0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to use the database schema:", err)
+		return 1
+	}
+
+	result, err := run(db_model.NewGormStore(db), options, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	err = printAdminResult(os.Stdout, result, options.json)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to print the result:", err)
+		return 1
+	}
+	return 0
+}
+
+// ================= Users =================
+
+func listUsersCommand(store *db_model.Store, options *adminOptions, args []string) (any, error) {
+	if len(args) != 0 {
+		return nil, errors.New("usage: jukebox user list")
+	}
+	query_params := &db_model.UsersGetRequestParams{Order: "id asc"}
+	if options.role != "" {
+		query_params.Role = []string{options.role}
+	}
+	users, err := db_controller.GetUsers(store, query_params)
+	if err != nil {
+		return nil, err
+	}
+
+	admin_users := []*adminUser{}
+	for _, user := range users {
+		if !db_controller.IsDeletedUser(user) {
+			admin_users = append(admin_users, newAdminUser(user))
+		}
+	}
+	return admin_users, nil
+}
+
+func createUserCommand(store *db_model.Store, options *adminOptions, args []string) (any, error) {
+	if len(args) != 2 {
+		return nil, errors.New("usage: jukebox user create <username> <email> [--role <role>]")
+	}
+	password, err := readPassword()
+	if err != nil {
+		return nil, err
+	}
+
+	audit, err := newAdminAuditContext(store, options)
+	if err != nil {
+		return nil, err
+	}
+
+	// The email is vouched for by the operator
+	user, err := db_controller.CreateUser(store, &db_model.UsersPostRequestParams{Username: args[0], Email: args[1], Password: password})
+	if err != nil {
+		return nil, err
+	}
+	err = db_controller.VerifyUserEmail(store, audit, user)
+	if err != nil {
+		return nil, err
+	}
+	if options.role != "" {
+		err = db_controller.SetUserRole(store, audit, user, options.role)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newAdminUser(user), nil
+}
+
+func setRoleCommand(store *db_model.Store, options *adminOptions, args []string) (any, error) {
+	if len(args) != 2 {
+		return nil, errors.New("usage: jukebox user role <user> <role>")
+	}
+	user, audit, err := retrieveCommandUser(store, options, args[:1])
+	if err != nil {
+		return nil, err
+	}
+	err = db_controller.SetUserRole(store, audit, user, args[1])
+	if err != nil {
+		return nil, err
+	}
+	return newAdminUser(user), nil
+}
+
+func resetPasswordCommand(store *db_model.Store, options *adminOptions, args []string) (any, error) {
+	user, audit, err := retrieveCommandUser(store, options, args)
+	if err != nil {
+		return nil, err
+	}
+	password, err := readPassword()
+	if err != nil {
+		return nil, err
+	}
+
+	err = db_controller.ResetUserPassword(store, audit, user, password)
+	if err != nil {
+		return nil, err
+	}
+	return &adminAction{Action: "password reset, tokens revoked", User: newAdminUser(user)}, nil
+}
+
+func verifyEmailCommand(store *db_model.Store, options *adminOptions, args []string) (any, error) {
+	user, audit, err := retrieveCommandUser(store, options, args)
+	if err != nil {
+		return nil, err
+	}
+	err = db_controller.VerifyUserEmail(store, audit, user)
+	if err != nil {
+		return nil, err
+	}
+	return newAdminUser(user), nil
+}
+
+func resetTwoFactorCommand(store *db_model.Store, options *adminOptions, args []string) (any, error) {
+	user, audit, err := retrieveCommandUser(store, options, args)
+	if err != nil {
+		return nil, err
+	}
+	err = db_controller.ResetTwoFactor(store, audit, user)
+	if err != nil {
+		return nil, err
+	}
+	return &adminAction{Action: "two-factor authentication disabled", User: newAdminUser(user)}, nil
+}
+
+func unlockUserCommand(store *db_model.Store, options *adminOptions, args []string) (any, error) {
+	user, audit, err := retrieveCommandUser(store, options, args)
+	if err != nil {
+		return nil, err
+	}
+	err = db_controller.UnlockUser(store, audit, user)
+	if err != nil {
+		return nil, err
+	}
+	return &adminAction{Action: "failed logins forgotten, lockout lifted", User: newAdminUser(user)}, nil
+}
+
+// ================= Bans =================
+
+func listBansCommand(store *db_model.Store, options *adminOptions, args []string) (any, error) {
+	if len(args) > 1 {
+		return nil, errors.New("usage: jukebox ban list [user]")
+	}
+	query_params := &db_model.BansGetRequestParams{EndsAfter: time.Now(), Order: "ends_at desc"}
+	if len(args) == 1 {
+		user, err := retrieveUser(store, args[0])
+		if err != nil {
+			return nil, err
+		}
+		query_params.TargetID = []int{user.ID}
+	}
+	if options.ban_type != "" {
+		query_params.Type = []string{options.ban_type}
+	}
+	return db_controller.GetBans(store, query_params)
+}
+
+func addBanCommand(store *db_model.Store, options *adminOptions, args []string) (any, error) {
+	user, audit, err := retrieveCommandUser(store, options, args)
+	if err != nil {
+		return nil, err
+	}
+	if options.duration < time.Second {
+		return nil, errors.New("--duration must be at least 1s")
+	}
+	ban_type := options.ban_type
+	if ban_type == "" {
+		ban_type = constants.BAN_TYPE
+	} else if ban_type != constants.BAN_TYPE && ban_type != constants.MUTE_TYPE {
+		return nil, fmt.Errorf("--type must be %s or %s", constants.BAN_TYPE, constants.MUTE_TYPE)
+	}
+
+	// The bans need an issuer, the user the action is attributed to or the first owner or admin
+	issuer := audit.Actor
+	if issuer == nil {
+		issuer, err = firstAdmin(store)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return db_controller.BanUsers(store, audit, &db_model.BansPostRequestParams{
+		Target:   []*db_model.User{user},
+		Issuer:   issuer,
+		Reason:   options.reason,
+		Duration: int(options.duration / time.Second),
+		Type:     ban_type,
+	})
+}
+
+func liftBansCommand(store *db_model.Store, options *adminOptions, args []string) (any, error) {
+	user, audit, err := retrieveCommandUser(store, options, args)
+	if err != nil {
+		return nil, err
+	}
+	query_params := &db_model.BansGetRequestParams{EndsAfter: time.Now(), TargetID: []int{user.ID}}
+	if options.ban_type != "" {
+		query_params.Type = []string{options.ban_type}
+	}
+	bans, err := db_controller.GetBans(store, query_params)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, len(bans))
+	for i, ban := range bans {
+		ids[i] = ban.ID
+	}
+	if len(ids) > 0 {
+		err = db_controller.DeleteBans(store, audit, &db_model.BansDeleteRequestParams{ID: ids})
+		if err != nil {
+			return nil, err
+		}
+	}
+	count := len(ids)
+	return &adminAction{Action: "bans lifted", User: newAdminUser(user), Count: &count}, nil
+}
+
+// ================= Tokens =================
+
+func revokeTokensCommand(store *db_model.Store, options *adminOptions, args []string) (any, error) {
+	user, audit, err := retrieveCommandUser(store, options, args)
+	if err != nil {
+		return nil, err
+	}
+	err = db_controller.RevokeUserTokens(store, audit, user)
+	if err != nil {
+		return nil, err
+	}
+	return &adminAction{Action: "tokens revoked", User: newAdminUser(user)}, nil
+}
+
+func purgeTokensCommand(store *db_model.Store, options *adminOptions, args []string) (any, error) {
+	if len(args) != 0 {
+		return nil, errors.New("usage: jukebox token purge")
+	}
+	err := db_controller.DeleteExpiredTokens(store)
+	if err != nil {
+		return nil, err
+	}
+	return &adminAction{Action: "expired tokens purged"}, nil
+}
+
+// ================= Stats =================
+
+func statsCommand(store *db_model.Store, options *adminOptions, args []string) (any, error) {
+	if len(args) != 0 {
+		return nil, errors.New("usage: jukebox stats")
+	}
+	return db_controller.GetInstanceStats(store)
+}
+
+// ================= Helpers =================
+
+// newAdminUser returns the printed view of a user
+func newAdminUser(user *db_model.User) *adminUser {
+	return &adminUser{ID: user.ID, Username: user.Username, Email: user.Email, VerifiedEmail: user.VerifiedEmail, Role: user.Role, CreatedAt: user.CreatedAt}
+}
+
+// retrieveUser retrieves a user by ID, username or email
+func retrieveUser(store *db_model.Store, designation string) (*db_model.User, error) {
+	var user *db_model.User
+	id, err := strconv.Atoi(designation)
+	if err == nil {
+		user, err = store.Users.GetByID(id)
+	} else {
+		user, err = store.Users.GetByUsernameOrEmail(designation)
+	}
+	if err != nil || db_controller.IsDeletedUser(user) {
+		return nil, fmt.Errorf("user %s not found", designation)
+	}
+	return user, nil
+}
+
+// retrieveCommandUser retrieves the user targeted by a command, its only argument, and the audit context of the command
+func retrieveCommandUser(store *db_model.Store, options *adminOptions, args []string) (*db_model.User, *db_controller.AuditContext, error) {
+	if len(args) != 1 {
+		return nil, nil, errors.New("expected a single user (ID, username or email), run jukebox user for the usage")
+	}
+	user, err := retrieveUser(store, args[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	audit, err := newAdminAuditContext(store, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, audit, nil
+}
+
+// newAdminAuditContext returns the audit context of a command, attributed to the moderator, admin or owner given with --as if any
+// The permissions of the role of that user are checked, the commands run without --as are allowed everything
+func newAdminAuditContext(store *db_model.Store, options *adminOptions) (*db_controller.AuditContext, error) {
+	audit := &db_controller.AuditContext{Reason: options.reason}
+	if options.as != "" {
+		actor, err := retrieveUser(store, options.as)
+		if err != nil {
+			return nil, err
+		}
+		if db_model.RoleRank(actor.Role) < db_model.RoleRank(constants.ROLE_MODERATOR) {
+			return nil, fmt.Errorf("--as: user %s is not a moderator, an admin or an owner", options.as)
+		}
+		audit.Actor = actor
+	}
+	return audit, nil
+}
+
+// firstAdmin retrieves the oldest owner or admin of the instance
+func firstAdmin(store *db_model.Store) (*db_model.User, error) {
+	admins, err := store.Users.List(&db_model.UsersGetRequestParams{Role: []string{constants.ROLE_OWNER, constants.ROLE_ADMIN}, Order: "id asc", Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(admins) == 0 {
+		return nil, errors.New("no owner or admin to attribute the action to, assign a role to a user first")
+	}
+	return admins[0], nil
+}
+
+// readPassword reads a password from the first line of stdin, prompting for it when stdin is a terminal
+func readPassword() (string, error) {
+	stat, err := os.Stdin.Stat()
+	if err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "Password: ")
+	}
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return "", errors.New("no password read from stdin")
+	}
+	return password, nil
+}
+
+// printAdminResult prints the result of a command as JSON, or as a table
+func printAdminResult(w io.Writer, result any, as_json bool) error {
+	if as_json {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+
+	writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	switch result := result.(type) {
+	case *adminUser:
+		printUsers(writer, []*adminUser{result})
+	case []*adminUser:
+		printUsers(writer, result)
+	case []*db_model.Ban:
+		fmt.Fprintln(writer, "ID\tTYPE\tTARGET\tISSUER\tENDS AT\tREASON")
+		for _, ban := range result {
+			fmt.Fprintf(writer, "%d\t%s\t%d\t%d\t%s\t%s\n", ban.ID, ban.Type, ban.TargetID, ban.IssuerID, ban.EndsAt.Local().Format(time.DateTime), ban.Reason)
+		}
+	case *db_controller.InstanceStats:
+		fmt.Fprintf(writer, "Users\t%d\nAdmins\t%d\nModerators\t%d\nPending deletions\t%d\n", result.Users, result.Admins, result.Moderators, result.PendingDeletions)
+		fmt.Fprintf(writer, "Messages\t%d\nFlagged messages\t%d\nRemoved messages\t%d\n", result.Messages, result.FlaggedMessages, result.RemovedMessages)
+		fmt.Fprintf(writer, "Active bans\t%d\nActive mutes\t%d\n", result.ActiveBans, result.ActiveMutes)
+	case *adminAction:
+		line := result.Action
+		if result.Count != nil {
+			line = fmt.Sprintf("%s: %d", line, *result.Count)
+		}
+		if result.User != nil {
+			line = fmt.Sprintf("%s (user %d %s)", line, result.User.ID, result.User.Username)
+		}
+		fmt.Fprintln(writer, line)
+	}
+	return writer.Flush()
+}
+
+// printUsers writes the users as a table
+func printUsers(writer io.Writer, users []*adminUser) {
+	fmt.Fprintln(writer, "ID\tUSERNAME\tEMAIL\tVERIFIED\tROLE\tCREATED AT")
+	for _, user := range users {
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%t\t%s\t%s\n", user.ID, user.Username, user.Email, user.VerifiedEmail, user.Role, user.CreatedAt.Local().Format(time.DateTime))
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/boxboxjason/jukebox/internal/config"
+)
+
+const CONFIG_USAGE = `Usage: jukebox config <command> [flags]
+
+Commands:
+  print  print the effective value of every setting and where it comes from, with the secrets redacted`
+
+// runConfigCommand runs the config subcommand and returns the process exit code
+// An invalid configuration is still printed, followed by the invalid settings
+func runConfigCommand(cfg *config.Config, args []string) int {
+	if len(args) != 1 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, CONFIG_USAGE)
+		return 2
+	}
+
+	err := cfg.Print(os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "\ninvalid configuration:")
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
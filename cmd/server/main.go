@@ -1,64 +1,259 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/boxboxjason/jukebox/internal/api"
+	"github.com/boxboxjason/jukebox/internal/config"
 	"github.com/boxboxjason/jukebox/internal/constants"
+	db_controller "github.com/boxboxjason/jukebox/internal/controller"
 	"github.com/boxboxjason/jukebox/internal/jobs"
 	"github.com/boxboxjason/jukebox/internal/middlewares"
 	db_model "github.com/boxboxjason/jukebox/internal/model"
 	"github.com/boxboxjason/jukebox/internal/websocket"
 	"github.com/boxboxjason/jukebox/pkg/logger"
+	"github.com/boxboxjason/jukebox/pkg/utils/tlsutils"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
 )
 
+const USAGE = `Usage: jukebox [command] [flags] [arguments]
+
+Commands:
+  serve    start the JukeBox server (default)
+  migrate  manage the database schema migrations
+  config   inspect the configuration
+  user     manage the users (create, assign roles, reset passwords, verify emails, reset two-factor authentication, unlock)
+  ban      issue and lift bans and mutes
+  token    revoke the tokens of a user, purge the expired tokens
+  stats    print the statistics of the instance
+
+Every setting is read from the flags, then the environment, then the configuration file, then the defaults.
+Flags:`
+
 func main() {
-	// Setup the logger
-	logger.SetupLogger(constants.LOG_DIR, "DEBUG")
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	if command == "help" {
+		printUsage(os.Stdout)
+		os.Exit(0)
+	}
+
+	// The administrative commands have flags of their own, mixed with the configuration flags
+	admin_options := &adminOptions{}
+	if ADMIN_COMMANDS[command] {
+		var err error
+		admin_options, args, err = parseAdminFlags(args)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, ADMIN_USAGE)
+			os.Exit(2)
+		}
+	}
+
+	// Load the configuration
+	cfg, args, err := config.Load(args, os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		printUsage(os.Stdout)
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		os.Exit(2)
+	}
+
+	// The configuration can be printed even if it is invalid, to find out why
+	if command == "config" {
+		os.Exit(runConfigCommand(cfg, args))
+	}
+	err = cfg.Validate()
+	if err == nil {
+		err = cfg.Apply()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		os.Exit(2)
+	}
+
+	// Setup the logger, the administrative commands keep stdout for their results
+	if ADMIN_COMMANDS[command] {
+		logger.SetConsole(os.Stderr)
+	}
+	logger.SetupLogger(cfg.Paths.LogDir, cfg.Log.Level)
+
+	switch command {
+	case "serve":
+		serve(cfg)
+		exit(0)
+	case "migrate":
+		exit(runMigrateCommand(cfg, args))
+	case "user", "ban", "token", "stats":
+		exit(runAdminCommand(cfg, command, admin_options, args))
+	default:
+		fmt.Fprintln(os.Stderr, "unknown command:", command)
+		printUsage(os.Stderr)
+		exit(2)
+	}
+}
+
+// printUsage writes the commands and the flags accepted by every command
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, USAGE)
+	config.PrintFlags(w)
+}
 
-	// Create the tables in the database
-	db_model.CreateTables()
+// exit flushes the logs then exits with the given code
+func exit(code int) {
+	logger.ShutdownLogger()
+	os.Exit(code)
+}
+
+// serve starts the JukeBox server
+func serve(cfg *config.Config) {
+	// Open the shared database handle
+	db, err := db_model.OpenDatabase(cfg.DatabaseOptions())
+	if err != nil {
+		logger.Fatal("Failed to open the database connection", err)
+	}
+	defer db_model.CloseDatabase(db)
+
+	// Refuse to boot on a dirty schema, then apply the pending migrations
+	err = db_model.CheckSchema(db)
+	if err != nil {
+		logger.Fatal("Unable to use the database schema:", err)
+	}
+	_, err = db_model.MigrateUp(db, 0)
+	if err != nil {
+		logger.Fatal("Failed to migrate the database:", err)
+	}
+
+	// Build the data stores on top of the database handle
+	store := db_model.NewGormStore(db)
+
+	// Send the mails with the configured transport
+	mailer := cfg.Mailer()
+	if cfg.Mail.Transport == constants.MAIL_TRANSPORT_OUTBOX {
+		logger.Info("Mails are written to", cfg.Mail.OutboxDir, "(outbox transport)")
+	}
 
 	// Create new main router
 	main_router := chi.NewRouter()
 
 	// Setup middlewares
-	main_router.Use(middleware.Logger)         // Log every HTTP request
-	main_router.Use(middleware.Recoverer)      // Recover from panics
-	main_router.Use(middleware.RealIP)         // Get the real IP address of the client
-	main_router.Use(middleware.RequestID)      // Generate a request ID for every request
-	main_router.Use(cors.Handler(cors.Options{ // Setup CORS
-		AllowedOrigins: []string{"*"},
+	main_router.Use(middleware.Logger)                    // Log every HTTP request
+	main_router.Use(middleware.Recoverer)                 // Recover from panics
+	main_router.Use(middleware.RealIP)                    // Get the real IP address of the client
+	main_router.Use(middleware.RequestID)                 // Generate a request ID for every request
+	main_router.Use(middlewares.DatabaseMiddleware(db))   // Share the database handle with every request
+	main_router.Use(middlewares.StoreMiddleware(store))   // Share the data stores with every request
+	main_router.Use(middlewares.MailerMiddleware(mailer)) // Share the mailer with every request
+	main_router.Use(cors.Handler(cors.Options{            // Setup CORS
+		AllowedOrigins: cfg.Server.AllowedOrigins,
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
-		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token",
+		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", constants.CSRF_TOKEN_HEADER,
 			"Sec-WebSocket-Key", "Sec-WebSocket-Version", "Upgrade", "Connection", "Cookie"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
 	}))
 
+	// Let the users sign in with the OpenID Connect provider, if configured
+	oidc_client := cfg.OIDCClient()
+	if oidc_client != nil {
+		api.SetupOIDC(oidc_client, cfg.OIDC.Name)
+		logger.Info("OpenID Connect login enabled with", cfg.OIDC.Issuer)
+	}
+
 	// Serve the API
 	api_router := api.ApiRouter()
-	main_router.Mount("/api", api_router)
+	main_router.Mount(api.API_PREFIX, api_router)
 	logger.Info("Serving API at /api")
 
-	// Setup WebSocket connection route (with authentication)
+	// Setup WebSocket connection route (with authentication, open to the API tokens with the messages:read scope)
+	// The pages of the other origins may only open it if their origin is allowed explicitly, not by the wildcard
+	websocket.SetupAllowedOrigins(cfg.Server.AllowedOrigins)
 	main_router.Group(func(r chi.Router) {
-		r.Use(middlewares.AuthMiddleware)
+		r.Use(middlewares.RequireScope(constants.SCOPE_MESSAGES_READ), middlewares.AuthMiddleware)
 		r.HandleFunc("/chat/ws", websocket.EstablishConnection)
 	})
 	logger.Info("Serving Chat WebSocket at /chat/ws")
 
+	// Issue signed access tokens, checked without the database, if enabled
+	signing_key_ring, err := cfg.SigningKeyRing()
+	if err != nil {
+		logger.Fatal("Unable to load the signing keys", err)
+	}
+	if signing_key_ring != nil {
+		middlewares.SetupSignedAccessTokens(signing_key_ring)
+		logger.Info("Signed access tokens enabled, signing with key", signing_key_ring.Current().ID, "from", cfg.Auth.SigningKeysDir)
+	}
+
+	// Close the websockets of the revoked sessions
+	db_controller.SetSessionsRevokedHandler(websocket.CloseSessions)
+
+	// Send the chat messages to the music generator
+	websocket.SetupPromptQueue(cfg.Chat.MusicGeneratorURL, cfg.Chat.PromptInterval, cfg.Chat.PromptThreshold)
+
 	// Start jobs
-	jobs.SetupJobs()
+	jobs.SetupJobs(db, store)
 	logger.Info("Jobs started")
 
-	// Start the server (attempt to use TLS first)
-	logger.Info("Starting JukeBox server at http://localhost:3000")
-	err := http.ListenAndServe(":3000", main_router)
-	if err != nil {
+	// Serve until SIGINT or SIGTERM
+	stop_ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Start the server, over TLS when a certificate is configured
+	server := &http.Server{Addr: cfg.ListenAddress(), Handler: main_router}
+	servers := []*http.Server{server}
+	server_errors := make(chan error, 2)
+	if cfg.TLSEnabled() {
+		reloader, err := tlsutils.NewCertificateReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			logger.Fatal("Unable to load the TLS certificate: ", err)
+		}
+		server.TLSConfig, err = newTLSConfig(cfg, reloader)
+		if err != nil {
+			logger.Fatal("Invalid TLS configuration: ", err)
+		}
+		go watchCertificate(stop_ctx, cfg, reloader)
+
+		// Redirect the plain HTTP requests to HTTPS
+		if cfg.TLS.RedirectPort != 0 {
+			redirect_server := &http.Server{Addr: cfg.RedirectAddress(), Handler: redirectToHTTPS(cfg.Server.Port)}
+			servers = append(servers, redirect_server)
+			logger.Info("Redirecting HTTP to HTTPS at", cfg.RedirectAddress())
+			go func() {
+				server_errors <- redirect_server.ListenAndServe()
+			}()
+		}
+
+		logger.Info("Starting JukeBox server at https://" + cfg.ListenAddress())
+		go func() {
+			server_errors <- server.ListenAndServeTLS("", "")
+		}()
+	} else {
+		logger.Info("Starting JukeBox server at http://" + cfg.ListenAddress())
+		go func() {
+			server_errors <- server.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err = <-server_errors:
 		logger.Fatal("Unable to start the server: ", err)
+	case <-stop_ctx.Done():
+		stop()
 	}
+	shutdown(cfg.Server.ShutdownTimeout, servers)
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/boxboxjason/jukebox/internal/config"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+)
+
+const MIGRATE_USAGE = `Usage: jukebox migrate <command>
+
+Commands:
+  up [version]     apply the pending migrations (up to version if provided)
+  down [steps]     roll back the last applied migrations (1 by default)
+  status           print the state of every migration
+  force <version>  mark the schema as clean at version, without running any migration`
+
+// runMigrateCommand runs the migrate subcommand and returns the process exit code
+func runMigrateCommand(cfg *config.Config, args []string) int {
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, MIGRATE_USAGE)
+		return 2
+	}
+
+	// Optional / required integer argument of the subcommands
+	argument := 0
+	if len(args) == 2 {
+		var err error
+		argument, err = strconv.Atoi(args[1])
+		if err != nil || argument < 0 {
+			fmt.Fprintln(os.Stderr, "invalid argument:", args[1])
+			return 2
+		}
+	}
+
+	db, err := db_model.OpenDatabase(cfg.DatabaseOptions())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to open the database:", err)
+		return 1
+	}
+	defer db_model.CloseDatabase(db)
+
+	switch args[0] {
+	case "up":
+		applied, err := db_model.MigrateUp(db, argument)
+		for _, migration := range applied {
+			fmt.Printf("applied %d %s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("no pending migration")
+		}
+	case "down":
+		steps := 1
+		if len(args) == 2 {
+			steps = argument
+		}
+		rolled_back, err := db_model.MigrateDown(db, steps)
+		for _, migration := range rolled_back {
+			fmt.Printf("rolled back %d %s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	case "status":
+		statuses, err := db_model.GetMigrationsStatus(db)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "VERSION\tNAME\tSTATE\tAPPLIED AT")
+		for _, status := range statuses {
+			applied_at := "-"
+			if status.AppliedAt != nil {
+				applied_at = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(writer, "%d\t%s\t%s\t%s\n", status.Version, status.Name, migrationState(status), applied_at)
+		}
+		writer.Flush()
+	case "force":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, MIGRATE_USAGE)
+			return 2
+		}
+		err = db_model.ForceMigrationVersion(db, argument)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println("schema forced to version", argument)
+	default:
+		fmt.Fprintln(os.Stderr, MIGRATE_USAGE)
+		return 2
+	}
+
+	return 0
+}
+
+// migrationState returns the human readable state of a migration
+func migrationState(status *db_model.MigrationStatus) string {
+	switch {
+	case status.Dirty:
+		return "dirty"
+	case !status.Known:
+		return "unknown"
+	case status.Applied:
+		return "applied"
+	default:
+		return "pending"
+	}
+}
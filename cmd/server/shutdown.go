@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/jobs"
+	"github.com/boxboxjason/jukebox/internal/websocket"
+	"github.com/boxboxjason/jukebox/pkg/logger"
+)
+
+// shutdown stops the server gracefully, every step shares the same deadline:
+//   - stop accepting connections and finish the running requests
+//   - warn the chat clients that the server is restarting, then close their websocket
+//   - send the pending chat messages to the music generator, or persist them for the next start
+//   - stop the jobs, waiting for the running ones
+//
+// The logs are flushed by the caller, once the database is closed
+func shutdown(timeout time.Duration, servers []*http.Server) {
+	logger.Info("Shutting down the JukeBox server, within", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Stop accepting connections, the websockets are hijacked and left to the next step
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			logger.Error("Failed to finish the running requests", err)
+		}
+	}
+
+	err := websocket.Shutdown(ctx)
+	if err != nil {
+		logger.Error("Failed to close the chat connections", err)
+	}
+
+	err = websocket.FlushPrompts(ctx)
+	if err != nil {
+		logger.Error("Failed to flush the pending chat messages", err)
+	}
+
+	err = jobs.StopJobs(ctx)
+	if err != nil {
+		logger.Error("Failed to wait for the running jobs", err)
+	}
+
+	logger.Info("JukeBox server stopped")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/boxboxjason/jukebox/internal/config"
+	"github.com/boxboxjason/jukebox/pkg/logger"
+	"github.com/boxboxjason/jukebox/pkg/utils/tlsutils"
+)
+
+// newTLSConfig builds the TLS configuration of the server, serving the certificate of the reloader
+func newTLSConfig(cfg *config.Config, reloader *tlsutils.CertificateReloader) (*tls.Config, error) {
+	min_version, err := tlsutils.ParseTLSVersion(cfg.TLS.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cipher_suites, err := tlsutils.ParseCipherSuites(cfg.TLS.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:     min_version,
+		CipherSuites:   cipher_suites,
+		GetCertificate: reloader.GetCertificate,
+	}, nil
+}
+
+// watchCertificate reloads the certificate on SIGHUP, and when its files change if the reload interval is set
+// Only the new connections use the reloaded certificate, the open ones (websockets included) are kept
+func watchCertificate(ctx context.Context, cfg *config.Config, reloader *tlsutils.CertificateReloader) {
+	if cfg.TLS.ReloadInterval > 0 {
+		go reloader.Watch(ctx, cfg.TLS.ReloadInterval, func(err error) {
+			logger.Error("Failed to reload the TLS certificate, keeping the current one", err)
+		})
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			err := reloader.Reload()
+			if err != nil {
+				logger.Error("Failed to reload the TLS certificate, keeping the current one", err)
+			} else {
+				logger.Info("TLS certificate reloaded")
+			}
+		}
+	}
+}
+
+// redirectToHTTPS redirects every request to the same URL on the HTTPS server
+func redirectToHTTPS(https_port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if https_port != 443 {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(https_port))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -1,6 +1,8 @@
 export const WEBSOCKET_MESSAGE_TYPES = {
   // Display message (sent by the server to all clients)
   DISPLAY: 'display',
+  // Notice message (sent by the server, e.g. to all clients before a restart, or to the sender of a refused message)
+  NOTICE: 'notice',
   // Raw incoming message (sent to the server as is)
   RAW_INCOMING_MESSAGE: 'raw_incoming_message',
 }
@@ -14,7 +16,7 @@ export type WebsocketDisplayMessage = {
     username: string,
     avatar: string,
     subscriber_tier: number,
-    admin: boolean,
+    role: string,
   }
   created_at: Date | string,
   modified_at: Date | string,
@@ -39,7 +41,7 @@ export type APIMessage = {
 }
 
 export type APIUser = {
-  admin: boolean,
+  role: string,
   avatar: string,
   created_at: string,
   modified_at: string,
@@ -49,4 +51,6 @@ export type APIUser = {
   subscriber_tier: number,
   total_contributions: number,
   username: string,
+  verified_email: boolean,
+  two_factor_enabled: boolean,
 }
@@ -1,4 +1,5 @@
 import { LOCAL_STORAGE_KEYS } from "@/constants/storage";
+import { csrfHeaders } from "@/functions/csrf";
 
 /**
  * Checks if the user is already logged in,
@@ -38,6 +39,7 @@ export async function loginFromRefreshToken(): Promise<boolean> {
   const response = await fetch("/api/auth/refresh", {
     method: "POST",
     credentials: "include",
+    headers: await csrfHeaders(),
   });
 
   if (response.ok) {
@@ -61,6 +63,7 @@ export async function loginFromAccessToken(): Promise<boolean> {
   const response = await fetch("/api/auth/login", {
     method: "POST",
     credentials: "include",
+    headers: await csrfHeaders(),
   });
 
   if (response.ok) {
@@ -98,6 +101,7 @@ export async function fullLogout(): Promise<boolean> {
   const response = await fetch("/api/auth/logout", {
     method: "POST",
     credentials: "include",
+    headers: await csrfHeaders(),
   });
 
   if (response.ok) {
@@ -10,7 +10,7 @@ export function apiMessageToWebsocketMessage(apiMessage: APIMessage): WebsocketD
       username: apiMessage.sender.username,
       avatar: apiMessage.sender.avatar,
       subscriber_tier: apiMessage.sender.subscriber_tier,
-      admin: apiMessage.sender.admin,
+      role: apiMessage.sender.role,
     },
     created_at: new Date(apiMessage.created_at),
     modified_at: new Date(apiMessage.modified_at),
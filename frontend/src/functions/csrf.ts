@@ -0,0 +1,35 @@
+const CSRF_COOKIE_NAME = "csrfToken";
+const CSRF_HEADER_NAME = "X-CSRF-Token";
+
+/**
+ * Retrieves the CSRF token of the browser from its cookie, or from the server the first time.
+ * The server refuses the state-changing requests made with the auth cookies without it.
+ *
+ * @returns {Promise<string>} The CSRF token, empty if the server could not hand one out.
+ */
+export async function getCSRFToken(): Promise<string> {
+  const cookie = document.cookie
+    .split("; ")
+    .find((cookie) => cookie.startsWith(CSRF_COOKIE_NAME + "="));
+  if (cookie) {
+    return cookie.substring(CSRF_COOKIE_NAME.length + 1);
+  }
+
+  const response = await fetch("/api/auth/csrf", {
+    credentials: "include",
+  });
+  if (!response.ok) {
+    return "";
+  }
+  const data = await response.json();
+  return data[CSRF_COOKIE_NAME];
+}
+
+/**
+ * Returns the headers carrying the CSRF token, to send along with every POST, PUT, PATCH or DELETE request.
+ *
+ * @returns {Promise<Record<string, string>>} The CSRF header.
+ */
+export async function csrfHeaders(): Promise<Record<string, string>> {
+  return { [CSRF_HEADER_NAME]: await getCSRFToken() };
+}
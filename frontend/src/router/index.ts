@@ -32,6 +32,22 @@ const routes: Array<RouteRecordRaw> = [
       title: 'JukeBox | Help'
     } as CustomRouteMeta
   },
+  {
+    path: '/reset-password',
+    name: 'reset-password',
+    component: () => import('../views/ResetPasswordView.vue'),
+    meta: {
+      title: 'JukeBox | Reset Password'
+    } as CustomRouteMeta
+  },
+  {
+    path: '/verify-email',
+    name: 'verify-email',
+    component: () => import('../views/VerifyEmailView.vue'),
+    meta: {
+      title: 'JukeBox | Verify Email'
+    } as CustomRouteMeta
+  },
   // Add this route to redirect /swagger to /swagger/index.html
   {
     path: '/swagger',
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_controller "github.com/boxboxjason/jukebox/internal/controller"
+	"github.com/boxboxjason/jukebox/internal/middlewares"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	AUDIT_PREFIX = "/audit"
+)
+
+func SetupAuditRoutes(r chi.Router) {
+	audit_subrouter := chi.NewRouter()
+
+	// Admin routes
+	audit_subrouter.Group(func(admin_router chi.Router) {
+		admin_router.Use(middlewares.AuthMiddleware, middlewares.RequirePermission(constants.PERMISSION_AUDIT_READ))
+		admin_router.Get("/", GetAuditEvents)
+	})
+
+	r.Mount(AUDIT_PREFIX, audit_subrouter)
+}
+
+// ==================== Read ====================
+
+// GetAuditEvents retrieves the audit events matching the request parameters, most recent first by default
+func GetAuditEvents(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the actor ids from the query parameters
+	actor_ids, err := httputils.RetrieveIntListValueParameter(r, constants.ACTOR_ID_PARAMETER, true)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the actions from the query parameters
+	actions, err := httputils.RetrieveStringListValueParameter(r, constants.ACTION_PARAMETER, true)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the target types from the query parameters
+	target_types, err := httputils.RetrieveStringListValueParameter(r, constants.TARGET_TYPE_PARAMETER, true)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the target ids from the query parameters
+	target_ids, err := httputils.RetrieveIntListValueParameter(r, constants.TARGET_ID_PARAMETER, true)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the request id from the query parameters
+	request_id, err := httputils.RetrieveStringParameter(r, constants.REQUEST_ID_PARAMETER, true)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the time range from the query parameters
+	since, err := httputils.RetrieveTimeStampParameter(r, constants.SINCE_PARAMETER, true)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	until, err := httputils.RetrieveTimeStampParameter(r, constants.UNTIL_PARAMETER, true)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the base parameters for the request
+	order, limit, page, offset := retrieveBaseParams(r)
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the audit events
+	events, err := db_controller.GetAuditEvents(store, &db_model.AuditGetRequestParams{
+		ActorID:    actor_ids,
+		Action:     actions,
+		TargetType: target_types,
+		TargetID:   target_ids,
+		RequestID:  request_id,
+		Since:      since,
+		Until:      until,
+		Order:      order,
+		Limit:      limit,
+		Page:       page,
+		Offset:     offset,
+	})
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendJSONResponse(w, events)
+}
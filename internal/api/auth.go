@@ -1,26 +1,57 @@
 package api
 
 import (
+	"encoding/base64"
+	"errors"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/boxboxjason/jukebox/internal/constants"
 	db_controller "github.com/boxboxjason/jukebox/internal/controller"
 	"github.com/boxboxjason/jukebox/internal/middlewares"
 	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
+	"github.com/boxboxjason/jukebox/pkg/utils/cryptutils"
 	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+	"github.com/boxboxjason/jukebox/pkg/utils/oidcutils"
 	"github.com/go-chi/chi/v5"
 )
 
 const (
-	AUTH_PREFIX = "/auth"
+	AUTH_PREFIX       = "/auth"
+	TWO_FACTOR_PREFIX = "/2fa"
+	OIDC_PREFIX       = "/oidc"
+	LOCKOUTS_PREFIX   = "/lockouts"
 )
 
+var (
+	// oidcClient is the client of the OpenID Connect provider, nil if the social login is disabled
+	oidcClient *oidcutils.Client
+	// oidcName is the name of the provider shown on the sign in button
+	oidcName string
+)
+
+// SetupOIDC enables the login with the OpenID Connect provider of the client, it must be called before serving the API
+func SetupOIDC(client *oidcutils.Client, name string) {
+	oidcClient = client
+	oidcName = name
+}
+
 func SetupAuthRoutes(r chi.Router) {
 	auth_subrouter := chi.NewRouter()
 
 	// Unauthenticated routes
 	auth_subrouter.Post("/login", Login)
+	auth_subrouter.Post("/login"+TWO_FACTOR_PREFIX, LoginFromTwoFactor)
 	auth_subrouter.Post("/refresh", Refresh)
+	auth_subrouter.Get("/csrf", GetCSRFToken)
+	auth_subrouter.Post("/reset-password", RequestPasswordReset)
+	auth_subrouter.Post("/reset-password/confirm", ConfirmPasswordReset)
+	auth_subrouter.Post("/verify-email", ConfirmEmailVerification)
+	auth_subrouter.Get(OIDC_PREFIX, GetOIDCProvider)
+	auth_subrouter.Get(OIDC_PREFIX+"/login", StartOIDCLogin)
+	auth_subrouter.Get(OIDC_PREFIX+"/callback", CompleteOIDCLogin)
 
 	// Authenticated routes
 	auth_subrouter.Group(func(auth_router chi.Router) {
@@ -28,6 +59,21 @@ func SetupAuthRoutes(r chi.Router) {
 		auth_router.Post("/logout", Logout)
 	})
 
+	// Authenticated routes updating the user, which needs the stored user
+	auth_subrouter.Group(func(auth_router chi.Router) {
+		auth_router.Use(middlewares.AuthMiddleware, middlewares.LoadStoredUser)
+		auth_router.Post(TWO_FACTOR_PREFIX+"/setup", SetupTwoFactor)
+		auth_router.Post(TWO_FACTOR_PREFIX+"/enable", EnableTwoFactor)
+		auth_router.Post(TWO_FACTOR_PREFIX+"/disable", DisableTwoFactor)
+		auth_router.Post(TWO_FACTOR_PREFIX+"/recovery-codes", RegenerateRecoveryCodes)
+	})
+
+	// Admin routes
+	auth_subrouter.Group(func(admin_router chi.Router) {
+		admin_router.Use(middlewares.AuthMiddleware, middlewares.RequirePermission(constants.PERMISSION_USER_UPDATE))
+		admin_router.Delete(LOCKOUTS_PREFIX+"/{"+constants.IP_PARAMETER+"}", UnlockIP)
+	})
+
 	r.Mount(AUTH_PREFIX, auth_subrouter)
 }
 
@@ -52,32 +98,30 @@ func Login(w http.ResponseWriter, r *http.Request) {
 
 func LoginFromToken(w http.ResponseWriter, r *http.Request) (bool, error) {
 	success := false
-	// Attempt to retrieve the access token from the request cookies
-	identity_bearer, err := httputils.ReadCookie(r, constants.ACCESS_TOKEN_COOKIE_NAME)
-	if err != nil {
-		identity_bearer, err = httputils.RetrieveAuthorizationToken(r, constants.AUTH_SCHEME+" ")
-	}
+	// Attempt to retrieve the access token from the Authorization header, or else from the request cookies
+	identity_bearer, _ := retrieveIdentityBearer(r, constants.ACCESS_TOKEN_COOKIE_NAME)
 
 	if identity_bearer != "" {
+		// Retrieve the data stores
+		store, err := middlewares.RetrieveStore(r)
+		if err != nil {
+			return success, err
+		}
+
 		// Attempt to login from the token
-		user_id, access_token, err := middlewares.DecodeIdentityBearerToUserAndToken(identity_bearer)
+		user_id, username, access_token, refresh_token, err := db_controller.LoginFromToken(store, retrieveClientContext(r), identity_bearer)
 		if err != nil {
+			httputils.SendErrorToClient(w, err)
 			return success, err
 		} else {
-			user_id, username, access_token, refresh_token, err := db_controller.LoginFromToken(user_id, access_token)
-			if err != nil {
-				httputils.SendErrorToClient(w, err)
-				return success, err
-			} else {
-				setAuthCookies(w, access_token, "")
-				httputils.SendJSONResponse(w, map[string]interface{}{
-					"username":                          username,
-					"user_id":                           user_id,
-					constants.ACCESS_TOKEN_COOKIE_NAME:  access_token,
-					constants.REFRESH_TOKEN_COOKIE_NAME: refresh_token,
-				})
-				return true, nil
-			}
+			setAuthCookies(w, access_token, "")
+			httputils.SendJSONResponse(w, map[string]interface{}{
+				"username":                          username,
+				"user_id":                           user_id,
+				constants.ACCESS_TOKEN_COOKIE_NAME:  access_token,
+				constants.REFRESH_TOKEN_COOKIE_NAME: refresh_token,
+			})
+			return true, nil
 		}
 	}
 	return false, nil
@@ -94,11 +138,26 @@ func LoginFromPassword(w http.ResponseWriter, r *http.Request) (bool, error) {
 		return false, err
 	}
 
-	user_id, username, access_token, refresh_token, err := db_controller.LoginUserFromPassword(username_or_email, password)
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
 	if err != nil {
 		return false, err
 	}
 
+	user_id, username, access_token, refresh_token, err := db_controller.LoginUserFromPassword(store, retrieveClientContext(r), username_or_email, password)
+	if err != nil {
+		// The password is correct but a two-factor code is still required, the client sends it with the challenge
+		var two_factor_required *db_controller.TwoFactorRequiredError
+		if errors.As(err, &two_factor_required) {
+			httputils.SendJSONResponseWithStatus(w, http.StatusAccepted, map[string]interface{}{
+				"two_factor_required":         true,
+				constants.CHALLENGE_PARAMETER: two_factor_required.Challenge,
+			})
+			return true, nil
+		}
+		return false, err
+	}
+
 	setAuthCookies(w, access_token, refresh_token)
 	httputils.SendJSONResponse(w, map[string]interface{}{
 		"username":                          username,
@@ -110,6 +169,43 @@ func LoginFromPassword(w http.ResponseWriter, r *http.Request) (bool, error) {
 	return true, nil
 }
 
+// LoginFromTwoFactor completes the login of a user with two-factor authentication, from the challenge
+// returned by the password login and a code of its authenticator or a recovery code
+func LoginFromTwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the challenge and the code from the request body
+	challenge, err := httputils.RetrievePostFormStringParameter(r, constants.CHALLENGE_PARAMETER, false)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	code, err := httputils.RetrievePostFormStringParameter(r, constants.CODE_PARAMETER, false)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	user_id, username, access_token, refresh_token, err := db_controller.LoginUserFromTwoFactor(store, retrieveClientContext(r), challenge, code)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	setAuthCookies(w, access_token, refresh_token)
+	httputils.SendJSONResponse(w, map[string]interface{}{
+		"username":                          username,
+		"user_id":                           user_id,
+		constants.ACCESS_TOKEN_COOKIE_NAME:  access_token,
+		constants.REFRESH_TOKEN_COOKIE_NAME: refresh_token,
+	})
+}
+
 // Logout logs out a user by deleting the access token
 func Logout(w http.ResponseWriter, r *http.Request) {
 	access_token, ok := r.Context().Value(constants.ACCESS_TOKEN_CONTEXT_KEY).(*db_model.AuthToken)
@@ -118,7 +214,14 @@ func Logout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := db_controller.DeleteToken(nil, access_token)
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	err = db_controller.DeleteToken(store, access_token)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
@@ -128,18 +231,58 @@ func Logout(w http.ResponseWriter, r *http.Request) {
 	httputils.SendSuccessResponse(w, "")
 }
 
+// UnlockIP forgets the failed logins from a locked out IP address, for the users with the user.update permission
+func UnlockIP(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the IP address from the request parameters
+	ip, err := httputils.RetrieveChiStringArgument(r, constants.IP_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	err = db_controller.UnlockIP(store, audit, ip)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendSuccessResponse(w, "IP address unlocked")
+}
+
 func Refresh(w http.ResponseWriter, r *http.Request) {
-	// Retrieve the refresh token
-	identity_bearer, err := httputils.ReadCookie(r, constants.REFRESH_TOKEN_COOKIE_NAME)
+	// Retrieve the refresh token, from the Authorization header or else from its cookie
+	identity_bearer, err := retrieveIdentityBearer(r, constants.REFRESH_TOKEN_COOKIE_NAME)
 	if err != nil {
-		identity_bearer, err = httputils.RetrieveAuthorizationToken(r, constants.AUTH_SCHEME+" ")
-		if err != nil {
-			httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("refresh token not found"))
-			return
-		}
+		httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("refresh token not found"))
+		return
+	}
+
+	// Retrieve the data stores and the mailer
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	mailer, err := middlewares.RetrieveMailer(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
 	}
 
-	user_id, username, access_token, new_refresh_token, err := db_controller.RefreshTokens(identity_bearer)
+	user_id, username, access_token, new_refresh_token, err := db_controller.RefreshTokens(store, mailer, retrieveClientContext(r), identity_bearer)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
@@ -154,12 +297,393 @@ func Refresh(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// ==================== CSRF ====================
+
+// GetCSRFToken hands out the CSRF token of the browser, issued on the first call then kept in a cookie readable by the frontend
+// The browser clients send it back in the CSRF header of their state-changing requests authenticated with the auth cookies
+func GetCSRFToken(w http.ResponseWriter, r *http.Request) {
+	csrf_token, err := httputils.ReadCookie(r, constants.CSRF_TOKEN_COOKIE_NAME)
+	if err != nil || !isCSRFToken(csrf_token) {
+		csrf_token, err = cryptutils.GenerateURLSafeToken(constants.CSRF_TOKEN_SIZE)
+		if err != nil {
+			httputils.SendErrorToClient(w, err)
+			return
+		}
+	}
+
+	httputils.SetReadableCookie(w, constants.CSRF_TOKEN_COOKIE_NAME, csrf_token, constants.CSRF_TOKEN_COOKIE_PATH, constants.TOKEN_EXPIRATION_MAP[constants.REFRESH_TOKEN])
+	httputils.SendJSONResponse(w, map[string]interface{}{
+		constants.CSRF_TOKEN_COOKIE_NAME: csrf_token,
+	})
+}
+
+// isCSRFToken tells whether the value of a CSRF cookie looks like a token issued by GetCSRFToken
+func isCSRFToken(csrf_token string) bool {
+	decoded_token, err := base64.RawURLEncoding.DecodeString(csrf_token)
+	return err == nil && len(decoded_token) == constants.CSRF_TOKEN_SIZE
+}
+
+// ==================== Password reset ====================
+
+// RequestPasswordReset mails a password reset link to the user owning the email
+// The response is the same whether the email is registered or not
+func RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the email from the request body
+	email, err := httputils.RetrievePostFormStringParameter(r, constants.EMAIL_PARAMETER, false)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores and the mailer
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	mailer, err := middlewares.RetrieveMailer(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Send the link in the background, so that the response time does not tell whether the email is registered
+	go func() {
+		err := db_controller.RequestPasswordReset(store, mailer, email)
+		if err != nil {
+			logger.Error("Unable to process the password reset request", err)
+		}
+	}()
+
+	httputils.SendJSONResponseWithStatus(w, http.StatusAccepted, map[string]interface{}{
+		"message": "If the email belongs to an account, a password reset link was sent to it",
+	})
+}
+
+// ConfirmPasswordReset sets a new password with the token of a password reset link, then logs out every session
+func ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the reset token and the new password from the request body
+	token, err := httputils.RetrievePostFormStringParameter(r, constants.TOKEN_PARAMETER, false)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	password, err := httputils.RetrievePostFormStringParameter(r, constants.PASSWORD_PARAMETER, false)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	err = db_controller.ConfirmPasswordReset(store, token, password)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Every session was revoked, including the one of this client if any
+	deleteAuthCookies(w)
+	httputils.SendJSONResponse(w, map[string]interface{}{
+		"message": "Password reset, log in with the new password",
+	})
+}
+
+// ==================== Email verification ====================
+
+// ConfirmEmailVerification verifies the email of a user with the token of an email verification link
+// The link may be opened on another device than the one logged in, so the token is enough
+func ConfirmEmailVerification(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the verification token from the request body
+	token, err := httputils.RetrievePostFormStringParameter(r, constants.TOKEN_PARAMETER, false)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	_, err = db_controller.ConfirmEmailVerification(store, token)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	httputils.SendJSONResponse(w, map[string]interface{}{
+		"message": "Email verified, you can now post in the chat",
+	})
+}
+
+// ==================== Two-factor authentication ====================
+
+// SetupTwoFactor generates a new TOTP secret for the authenticated user, along with its provisioning URI to show as a QR code
+func SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user from the context
+	user, ok := r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
+	if !ok {
+		httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("user not found"))
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	setup, err := db_controller.SetupTwoFactor(store, user)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendJSONResponse(w, setup)
+}
+
+// EnableTwoFactor enables the two-factor authentication of the authenticated user with a code generated from the pending secret
+// The recovery codes are only returned by this response
+func EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the code from the request body
+	code, err := httputils.RetrievePostFormStringParameter(r, constants.CODE_PARAMETER, false)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	recovery_codes, err := db_controller.EnableTwoFactor(store, audit, audit.Actor, code)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendJSONResponse(w, map[string]interface{}{
+		"recovery_codes": recovery_codes,
+	})
+}
+
+// DisableTwoFactor disables the two-factor authentication of the authenticated user with a code or a recovery code
+func DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the code from the request body
+	code, err := httputils.RetrievePostFormStringParameter(r, constants.CODE_PARAMETER, false)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	err = db_controller.DisableTwoFactor(store, audit, audit.Actor, code)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendSuccessResponse(w, "two-factor authentication disabled")
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the authenticated user with a code or a recovery code
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user from the context
+	user, ok := r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
+	if !ok {
+		httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("user not found"))
+		return
+	}
+
+	// Retrieve the code from the request body
+	code, err := httputils.RetrievePostFormStringParameter(r, constants.CODE_PARAMETER, false)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	recovery_codes, err := db_controller.RegenerateRecoveryCodes(store, user, code)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendJSONResponse(w, map[string]interface{}{
+		"recovery_codes": recovery_codes,
+	})
+}
+
+// ==================== OpenID Connect ====================
+
+// GetOIDCProvider describes the OpenID Connect provider the users can sign in with, for the sign in page
+func GetOIDCProvider(w http.ResponseWriter, r *http.Request) {
+	if oidcClient == nil {
+		httputils.SendErrorToClient(w, httputils.NewNotImplementedError("OpenID Connect login is not configured"))
+		return
+	}
+	httputils.SendJSONResponse(w, map[string]interface{}{
+		"name":      oidcName,
+		"login_url": API_PREFIX + AUTH_PREFIX + OIDC_PREFIX + "/login",
+	})
+}
+
+// StartOIDCLogin redirects the browser to the provider, the state, the nonce and the PKCE code verifier
+// of the request are kept in a cookie restricted to the callback
+func StartOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if oidcClient == nil {
+		httputils.SendErrorToClient(w, httputils.NewNotImplementedError("OpenID Connect login is not configured"))
+		return
+	}
+
+	// Create the authorization request
+	request, err := oidcClient.NewAuthRequest(r.Context())
+	if err != nil {
+		logger.Error("Unable to create the OpenID Connect authorization request", err)
+		httputils.SendErrorToClient(w, httputils.NewServiceUnavailableError("the identity provider is unavailable"))
+		return
+	}
+
+	// Keep its secrets until the callback, they are URL-safe so the dots separate them
+	cookie_value := strings.Join([]string{request.State, request.Nonce, request.CodeVerifier}, ".")
+	httputils.SetSecureCookie(w, constants.OIDC_REQUEST_COOKIE_NAME, cookie_value, constants.OIDC_REQUEST_COOKIE_PATH, constants.OIDC_REQUEST_EXPIRATION)
+	http.Redirect(w, r, request.URL, http.StatusFound)
+}
+
+// CompleteOIDCLogin is the callback of the provider: it redeems the code, verifies the ID token, logs in the linked user
+// (created on first login) and sends the browser back to the frontend with the auth cookies
+// The users with two-factor authentication are sent back with a challenge instead, the errors with a message
+func CompleteOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if oidcClient == nil {
+		httputils.SendErrorToClient(w, httputils.NewNotImplementedError("OpenID Connect login is not configured"))
+		return
+	}
+
+	// The request cookie can only be used once
+	cookie_value, _ := httputils.ReadCookie(r, constants.OIDC_REQUEST_COOKIE_NAME)
+	httputils.SetSecureCookie(w, constants.OIDC_REQUEST_COOKIE_NAME, "", constants.OIDC_REQUEST_COOKIE_PATH, -1)
+
+	// Check that the callback answers the request of this browser
+	secrets := strings.Split(cookie_value, ".")
+	if len(secrets) != 3 || !oidcutils.CheckState(secrets[0], r.URL.Query().Get(constants.STATE_PARAMETER)) {
+		redirectOIDCError(w, r, "The sign in request is invalid or expired, please try again")
+		return
+	}
+	provider_error := r.URL.Query().Get(constants.ERROR_PARAMETER)
+	if provider_error != "" {
+		logger.Info("OpenID Connect login refused by the provider:", provider_error)
+		redirectOIDCError(w, r, "The sign in was cancelled or refused by the provider")
+		return
+	}
+	nonce, code_verifier := secrets[1], secrets[2]
+
+	// Redeem the code and verify the ID token
+	tokens, err := oidcClient.Exchange(r.Context(), r.URL.Query().Get(constants.CODE_PARAMETER), code_verifier)
+	if err != nil {
+		logger.Error("Unable to complete the OpenID Connect login", err)
+		redirectOIDCError(w, r, "The provider refused the sign in, please try again")
+		return
+	}
+	claims, err := oidcClient.VerifyIDToken(r.Context(), tokens.IDToken, nonce)
+	if err != nil {
+		logger.Error("Invalid ID token returned by the OpenID Connect provider", err)
+		redirectOIDCError(w, r, "The provider returned an invalid identity")
+		return
+	}
+
+	// Retrieve the data stores and the mailer
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	mailer, err := middlewares.RetrieveMailer(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the linked user, or create it
+	user, created, err := db_controller.GetOrCreateUserFromOIDC(store, oidcClient.Issuer, claims)
+	if err != nil {
+		redirectOIDCError(w, r, err.Error())
+		return
+	}
+	if created && !user.VerifiedEmail {
+		sendEmailVerification(store, mailer, user)
+	}
+
+	// Log the user in
+	_, _, access_token, refresh_token, err := db_controller.LoginUser(store, retrieveClientContext(r), user)
+	if err != nil {
+		var two_factor_required *db_controller.TwoFactorRequiredError
+		if errors.As(err, &two_factor_required) {
+			http.Redirect(w, r, constants.PUBLIC_URL+"/?"+url.Values{constants.CHALLENGE_PARAMETER: {two_factor_required.Challenge}}.Encode(), http.StatusFound)
+			return
+		}
+		redirectOIDCError(w, r, err.Error())
+		return
+	}
+	setAuthCookies(w, access_token, refresh_token)
+	http.Redirect(w, r, constants.PUBLIC_URL+"/", http.StatusFound)
+}
+
+// redirectOIDCError sends the browser back to the frontend with the message of a failed OpenID Connect login
+func redirectOIDCError(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, constants.PUBLIC_URL+"/?"+url.Values{constants.OIDC_ERROR_PARAMETER: {message}}.Encode(), http.StatusFound)
+}
+
 func setAuthCookies(w http.ResponseWriter, access_token string, refresh_token string) {
-	httputils.SetSecureCookie(w, constants.ACCESS_TOKEN_COOKIE_NAME, access_token, constants.ACCESS_TOKEN_COOKIE_PATH, constants.ACCESS_TOKEN_EXPIRATION)
-	httputils.SetSecureCookie(w, constants.REFRESH_TOKEN_COOKIE_NAME, refresh_token, constants.REFRESH_TOKEN_COOKIE_PATH, constants.REFRESH_TOKEN_EXPIRATION)
+	httputils.SetSecureCookie(w, constants.ACCESS_TOKEN_COOKIE_NAME, access_token, constants.ACCESS_TOKEN_COOKIE_PATH, constants.TOKEN_EXPIRATION_MAP[constants.ACCESS_TOKEN])
+	httputils.SetSecureCookie(w, constants.REFRESH_TOKEN_COOKIE_NAME, refresh_token, constants.REFRESH_TOKEN_COOKIE_PATH, constants.TOKEN_EXPIRATION_MAP[constants.REFRESH_TOKEN])
+}
+
+// retrieveIdentityBearer retrieves an identity bearer with the Bearer scheme, or else from the given cookie
+// The requests authenticated with the cookies are checked by the CSRF middleware, unlike the ones with an Authorization header
+func retrieveIdentityBearer(r *http.Request, cookie_name string) (string, error) {
+	if r.Header.Get("Authorization") != "" {
+		return httputils.RetrieveAuthorizationToken(r, constants.AUTH_SCHEME+" ")
+	}
+	return httputils.ReadCookie(r, cookie_name)
 }
 
+// deleteAuthCookies deletes the auth cookies and the CSRF cookie, the next session of the browser gets a new CSRF token
 func deleteAuthCookies(w http.ResponseWriter) {
 	httputils.SetSecureCookie(w, constants.ACCESS_TOKEN_COOKIE_NAME, "", constants.ACCESS_TOKEN_COOKIE_PATH, -1)
 	httputils.SetSecureCookie(w, constants.REFRESH_TOKEN_COOKIE_NAME, "", constants.REFRESH_TOKEN_COOKIE_PATH, -1)
+	httputils.SetReadableCookie(w, constants.CSRF_TOKEN_COOKIE_NAME, "", constants.CSRF_TOKEN_COOKIE_PATH, -1)
 }
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_controller "github.com/boxboxjason/jukebox/internal/controller"
+	"github.com/boxboxjason/jukebox/internal/middlewares"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	BACKUPS_PREFIX         = "/backups"
+	NAME_PARAM_ENDPOINT    = "/{" + constants.NAME_PARAMETER + "}"
+	BACKUP_RESTORE_SUFFIX  = "/restore"
+	BACKUP_CONTENT_TYPE    = "application/zip"
+	CONTENT_DISPOSITION    = "Content-Disposition"
+	CONTENT_TYPE           = "Content-Type"
+	ATTACHMENT_DISPOSITION = "attachment; filename="
+)
+
+func SetupBackupsRoutes(r chi.Router) {
+	backups_subrouter := chi.NewRouter()
+
+	// Admin routes
+	backups_subrouter.Group(func(admin_router chi.Router) {
+		admin_router.Use(middlewares.AuthMiddleware, middlewares.RequirePermission(constants.PERMISSION_BACKUP_MANAGE))
+		admin_router.Get("/", GetBackups)
+		admin_router.Post("/", PostBackup)
+		admin_router.Get(NAME_PARAM_ENDPOINT, DownloadBackup)
+		admin_router.Post(NAME_PARAM_ENDPOINT+BACKUP_RESTORE_SUFFIX, RestoreBackup)
+	})
+
+	r.Mount(BACKUPS_PREFIX, backups_subrouter)
+}
+
+// ==================== Create ====================
+
+// PostBackup triggers a backup of the database and of the avatars
+func PostBackup(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the shared database handle
+	db, err := middlewares.RetrieveDatabase(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Create the backup
+	backup, err := db_controller.CreateBackup(db)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	db_controller.RecordAuditEvent(store, audit, constants.AUDIT_BACKUP_CREATE, constants.AUDIT_TARGET_BACKUP, 0, nil, backup)
+
+	// Send the backup back to the client
+	httputils.SendJSONResponse(w, backup)
+}
+
+// ==================== Read ====================
+
+// GetBackups lists the available backups, most recent first
+func GetBackups(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the backups
+	backups, err := db_controller.ListBackups()
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Send the backups back to the client
+	httputils.SendJSONResponse(w, backups)
+}
+
+// DownloadBackup sends a backup archive to the client
+func DownloadBackup(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the backup name from the request parameters
+	name, err := httputils.RetrieveChiStringArgument(r, constants.NAME_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the backup archive
+	backup_path, err := db_controller.GetBackupPath(name)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Send the archive to the client
+	w.Header().Set(CONTENT_TYPE, BACKUP_CONTENT_TYPE)
+	w.Header().Set(CONTENT_DISPOSITION, ATTACHMENT_DISPOSITION+name)
+	http.ServeFile(w, r, backup_path)
+}
+
+// ==================== Restore ====================
+
+// RestoreBackup replaces the database and the avatars with the content of a backup
+// The state before the restore is saved as a new backup, which is sent back to the client
+func RestoreBackup(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the backup name from the request parameters
+	name, err := httputils.RetrieveChiStringArgument(r, constants.NAME_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the shared database handle
+	db, err := middlewares.RetrieveDatabase(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Restore the backup
+	safety_backup, err := db_controller.RestoreBackup(db, name)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// The event is recorded in the restored database, the previous audit log lives on in the safety backup
+	db_controller.RecordAuditEvent(store, audit, constants.AUDIT_BACKUP_RESTORE, constants.AUDIT_TARGET_BACKUP, 0, safety_backup, map[string]string{"restored": name})
+
+	// Send the backup of the previous state back to the client
+	httputils.SendJSONResponse(w, map[string]interface{}{
+		"restored":        name,
+		"previous_backup": safety_backup,
+	})
+}
@@ -18,15 +18,20 @@ const (
 func SetupBansRoutes(r chi.Router) {
 	bans_subrouter := chi.NewRouter()
 
-	// Authenticated routes
+	// Authenticated routes guarded by the ban permissions, open to the API tokens with the bans:read scope
 	bans_subrouter.Group(func(auth_router chi.Router) {
-		auth_router.Use(middlewares.AdminAuthMiddleware)
-		auth_router.Post("/", PostBan)
-		auth_router.Get("/", GetBans)
-		auth_router.Get(ID_PARAM_ENDPOINT, GetBan)
-		auth_router.Patch(ID_PARAM_ENDPOINT, PatchBan)
-		auth_router.Delete(ID_PARAM_ENDPOINT, DeleteBan)
-		auth_router.Delete("/", DeleteBans)
+		auth_router.Use(middlewares.RequireScope(constants.SCOPE_BANS_READ), middlewares.AuthMiddleware)
+		auth_router.With(middlewares.RequirePermission(constants.PERMISSION_BAN_READ)).Get("/", GetBans)
+		auth_router.With(middlewares.RequirePermission(constants.PERMISSION_BAN_READ)).Get(ID_PARAM_ENDPOINT, GetBan)
+	})
+
+	// Authenticated routes guarded by the ban permissions, open to the API tokens with the bans:write scope
+	bans_subrouter.Group(func(auth_router chi.Router) {
+		auth_router.Use(middlewares.RequireScope(constants.SCOPE_BANS_WRITE), middlewares.AuthMiddleware)
+		auth_router.With(middlewares.RequirePermission(constants.PERMISSION_BAN_CREATE)).Post("/", PostBan)
+		auth_router.With(middlewares.RequirePermission(constants.PERMISSION_BAN_UPDATE)).Patch(ID_PARAM_ENDPOINT, PatchBan)
+		auth_router.With(middlewares.RequirePermission(constants.PERMISSION_BAN_DELETE)).Delete(ID_PARAM_ENDPOINT, DeleteBan)
+		auth_router.With(middlewares.RequirePermission(constants.PERMISSION_BAN_DELETE)).Delete("/", DeleteBans)
 	})
 
 	r.Mount(BANS_PREFIX, bans_subrouter)
@@ -73,23 +78,29 @@ func PostBan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Open db connection
-	db, err := db_model.OpenConnection()
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
 	}
-	defer db_model.CloseConnection(db)
 
 	// Retrieve the targets from the database
-	targets, err := db_model.GetUsersByFilters(db, &db_model.UsersGetRequestParams{ID: target_ids})
+	targets, err := db_controller.GetUsers(store, &db_model.UsersGetRequestParams{ID: target_ids})
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
 	}
 
 	// Ban the targets
-	bans, err := db_controller.BanUsers(db, &db_model.BansPostRequestParams{
+	bans, err := db_controller.BanUsers(store, audit, &db_model.BansPostRequestParams{
 		Target:   targets,
 		Issuer:   issuer,
 		Reason:   reason,
@@ -115,8 +126,15 @@ func GetBan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
 	// Retrieve the ban from the database
-	ban, err := db_controller.GetBanByID(nil, ban_id)
+	ban, err := db_controller.GetBanByID(store, ban_id)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
@@ -171,8 +189,15 @@ func GetBans(w http.ResponseWriter, r *http.Request) {
 	// Retrieve the base parameters for the request
 	order, limit, page, offset := retrieveBaseParams(r)
 
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
 	// Retrieve the bans from the database
-	bans, err := db_controller.GetBans(nil, &db_model.BansGetRequestParams{
+	bans, err := db_controller.GetBans(store, &db_model.BansGetRequestParams{
 		ID:        ids,
 		TargetID:  target_ids,
 		IssuerID:  issuer_ids,
@@ -216,16 +241,22 @@ func PatchBan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Open db connection
-	db, err := db_model.OpenConnection()
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
 	}
-	defer db_model.CloseConnection(db)
 
 	// Update the ban
-	ban, err := db_controller.UpdateBan(db, &db_model.BansPatchRequestParams{
+	ban, err := db_controller.UpdateBan(store, audit, &db_model.BansPatchRequestParams{
 		ID:       ban_id,
 		Duration: new_duration,
 		Reason:   new_reason,
@@ -248,16 +279,22 @@ func DeleteBan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Open db connection
-	db, err := db_model.OpenConnection()
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
 	}
-	defer db_model.CloseConnection(db)
 
 	// Delete the ban
-	err = db_controller.DeleteBan(db, ban_id)
+	err = db_controller.DeleteBan(store, audit, ban_id)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
@@ -298,15 +335,21 @@ func DeleteBans(w http.ResponseWriter, r *http.Request) {
 	// Retrieve the base parameters for the request
 	order, limit, page, offset := retrieveBaseParams(r)
 
-	// Open db connection
-	db, err := db_model.OpenConnection()
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
 	}
-	defer db_model.CloseConnection(db)
 
-	err = db_controller.DeleteBans(db, &db_model.BansDeleteRequestParams{
+	err = db_controller.DeleteBans(store, audit, &db_model.BansDeleteRequestParams{
 		ID:       ban_ids,
 		IssuerID: issuer_ids,
 		Type:     types,
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_controller "github.com/boxboxjason/jukebox/internal/controller"
+	"github.com/boxboxjason/jukebox/internal/middlewares"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+)
+
+// userExportResponse is an export as sent to the client, with its download link once it is ready
+type userExportResponse struct {
+	*db_controller.UserExport
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+// newUserExportResponse adds the download link to a ready export
+func newUserExportResponse(export *db_controller.UserExport) *userExportResponse {
+	response := &userExportResponse{UserExport: export}
+	if export.Status == db_controller.EXPORT_READY {
+		response.DownloadURL = API_PREFIX + USERS_PREFIX + "/" + strconv.Itoa(export.UserID) + EXPORT_SUFFIX + "/" + export.ID + EXPORT_DOWNLOAD_SUFFIX +
+			"?" + url.Values{constants.TOKEN_PARAMETER: []string{export.Token}}.Encode()
+	}
+	return response
+}
+
+// ==================== Create ====================
+
+// PostUserExport starts an export of the data of a user
+// The export is sent back with 201 when it is ready, or with 202 when it is built in the background
+func PostUserExport(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user id from the request parameters
+	user_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Start the export
+	export, err := db_controller.ExportUser(store, audit, user_id)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Send the export back to the client
+	status_code := http.StatusCreated
+	if export.Status == db_controller.EXPORT_PENDING {
+		status_code = http.StatusAccepted
+	}
+	httputils.SendJSONResponseWithStatus(w, status_code, newUserExportResponse(export))
+}
+
+// ==================== Read ====================
+
+// GetUserExport retrieves the status of an export, with its download link once it is ready
+func GetUserExport(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user from the context
+	requester, ok := r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
+	if !ok {
+		httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("user not found"))
+		return
+	}
+
+	// Retrieve the user id from the request parameters
+	user_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the export id from the request parameters
+	export_id, err := httputils.RetrieveChiStringArgument(r, constants.EXPORT_ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the export
+	export, err := db_controller.GetUserExport(requester, user_id, export_id)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Send the export to the client
+	httputils.SendJSONResponse(w, newUserExportResponse(export))
+}
+
+// DownloadUserExport sends the archive of a ready export, the token of the download link is the only credential
+func DownloadUserExport(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user id from the request parameters
+	user_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the export id from the request parameters
+	export_id, err := httputils.RetrieveChiStringArgument(r, constants.EXPORT_ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the download token from the request
+	token, err := httputils.RetrieveStringParameter(r, constants.TOKEN_PARAMETER, false)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the export archive
+	archive_path, file_name, err := db_controller.GetUserExportArchive(user_id, export_id, token)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Send the archive to the client
+	w.Header().Set(CONTENT_TYPE, BACKUP_CONTENT_TYPE)
+	w.Header().Set(CONTENT_DISPOSITION, ATTACHMENT_DISPOSITION+file_name)
+	http.ServeFile(w, r, archive_path)
+}
@@ -14,6 +14,7 @@ import (
 
 const (
 	MESSAGES_PREFIX = "/messages"
+	SEARCH_ENDPOINT = "/search"
 )
 
 func SetupMessagesRoutes(r chi.Router) {
@@ -21,20 +22,21 @@ func SetupMessagesRoutes(r chi.Router) {
 
 	// Unauthenticated routes
 	messages_subrouter.Get("/", GetMessages)
+	messages_subrouter.Get(SEARCH_ENDPOINT, SearchMessages)
 	messages_subrouter.Get(ID_PARAM_ENDPOINT, GetMessage)
 
-	// Authenticated routes
+	// Authenticated routes, open to the API tokens with the messages:write scope
 	messages_subrouter.Group(func(auth_router chi.Router) {
-		auth_router.Use(middlewares.AuthMiddleware)
+		auth_router.Use(middlewares.RequireScope(constants.SCOPE_MESSAGES_WRITE), middlewares.AuthMiddleware)
 		auth_router.Post("/", CreateMessage)
 		auth_router.Patch(ID_PARAM_ENDPOINT, UpdateMessage)
 	})
 
-	// Admin routes
-	messages_subrouter.Group(func(admin_router chi.Router) {
-		admin_router.Use(middlewares.AdminAuthMiddleware)
-		admin_router.Delete(ID_PARAM_ENDPOINT, DeleteMessage)
-		admin_router.Delete("/", DeleteMessages)
+	// Moderation routes, open to the API tokens with the messages:write scope
+	messages_subrouter.Group(func(moderation_router chi.Router) {
+		moderation_router.Use(middlewares.RequireScope(constants.SCOPE_MESSAGES_WRITE), middlewares.AuthMiddleware, middlewares.RequirePermission(constants.PERMISSION_MESSAGE_REMOVE))
+		moderation_router.Delete(ID_PARAM_ENDPOINT, DeleteMessage)
+		moderation_router.Delete("/", DeleteMessages)
 	})
 
 	r.Mount(MESSAGES_PREFIX, messages_subrouter)
@@ -60,14 +62,21 @@ func CreateMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
 	// Create the message
-	message, err := db_controller.CreateMessage(nil, &db_model.MessagesPostRequestParams{
+	message, err := db_controller.CreateMessage(store, &db_model.MessagesPostRequestParams{
 		Sender:  user,
 		Message: message_content,
 	})
 	if err != nil {
 		logger.Error("Failed to create message", err)
-		httputils.SendErrorToClient(w, httputils.NewInternalServerError("Failed to create message"))
+		httputils.SendErrorToClient(w, err)
 		return
 	}
 
@@ -124,8 +133,15 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 	// Retrieve the base parameters for the request
 	order, limit, page, offset := retrieveBaseParams(r)
 
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
 	// Retrieve the messages
-	messages, err := db_controller.GetMessages(nil, &db_model.MessagesGetRequestParams{
+	messages, err := db_controller.GetMessages(store, &db_model.MessagesGetRequestParams{
 		ID:       ids,
 		SenderID: sender_ids,
 		Flagged:  flagged,
@@ -146,6 +162,66 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 	httputils.SendJSONResponse(w, messages)
 }
 
+// SearchMessages retrieves the messages matching a full text search query, most relevant first
+// The query supports "quoted phrases" and prefix* terms, every term must match
+func SearchMessages(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the search query from the query parameters
+	query, err := httputils.RetrieveStringParameter(r, constants.QUERY_PARAMETER, false)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the sender IDs from the query parameters
+	sender_ids, err := httputils.RetrieveIntListValueParameter(r, constants.SENDER_ID_PARAMETER, true)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the flagged status from the query parameters
+	flagged, err := httputils.RetrieveBoolParameter(r, constants.FLAGGED_PARAMETER, true)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the removed status from the query parameters
+	removed, err := httputils.RetrieveBoolParameter(r, constants.REMOVED_PARAMETER, true)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the base parameters for the request (results are always ordered by relevance)
+	_, limit, page, offset := retrieveBaseParams(r)
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Search the messages
+	results, err := db_controller.SearchMessages(store, &db_model.MessagesSearchRequestParams{
+		Query:    query,
+		SenderID: sender_ids,
+		Flagged:  flagged,
+		Removed:  removed,
+		Limit:    limit,
+		Page:     page,
+		Offset:   offset,
+	})
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Send the results to the client
+	httputils.SendJSONResponse(w, results)
+}
+
 // GetMessage retrieves a message by its ID
 func GetMessage(w http.ResponseWriter, r *http.Request) {
 	// Retrieve the message ID from the query parameters
@@ -155,17 +231,15 @@ func GetMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Open db connection
-	db, err := db_model.OpenConnection()
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
 	if err != nil {
-		logger.Error("Failed to open database connection", err)
-		httputils.SendErrorToClient(w, httputils.NewInternalServerError("Failed to open database connection"))
+		httputils.SendErrorToClient(w, err)
 		return
 	}
-	defer db_model.CloseConnection(db)
 
 	// Retrieve the message
-	message, err := db_model.GetMessageByID(db, message_id)
+	message, err := db_controller.GetMessage(store, message_id)
 	if err != nil {
 		logger.Error("Failed to retrieve message", err)
 		httputils.SendErrorToClient(w, httputils.NewNotFoundError("Message not found"))
@@ -222,21 +296,22 @@ func UpdateMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if (len(censored) > 0 || len(flagged) > 0 || len(removed) > 0) && !user.Admin {
-		httputils.SendErrorToClient(w, httputils.NewForbiddenError("only admins can update the censor, flagged and removed status"))
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
 		return
 	}
 
-	// Open db connection
-	db, err := db_model.OpenConnection()
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
 	}
-	defer db_model.CloseConnection(db)
 
 	// Retrieve the message
-	message, err := db_controller.GetMessage(message_id)
+	message, err := db_controller.GetMessage(store, message_id)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
@@ -249,7 +324,7 @@ func UpdateMessage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Update the message
-	err = db_controller.UpdateExistingMessage(db, message, &db_model.MessagesPatchRequestParams{
+	err = db_controller.UpdateExistingMessage(store, audit, message, &db_model.MessagesPatchRequestParams{
 		ID:       message_id,
 		Message:  message_content,
 		Censored: censored,
@@ -277,17 +352,22 @@ func DeleteMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Open db connection
-	db, err := db_model.OpenConnection()
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
 	if err != nil {
-		logger.Error("Failed to open database connection", err)
-		httputils.SendErrorToClient(w, httputils.NewInternalServerError("Failed to open database connection"))
+		httputils.SendErrorToClient(w, err)
 		return
 	}
-	defer db_model.CloseConnection(db)
 
 	// Delete the message
-	err = db_model.DeleteMessage(db, message_id)
+	err = db_controller.DeleteMessage(store, audit, message_id)
 	if err != nil {
 		httputils.SendErrorToClient(w, httputils.NewInternalServerError("Failed to delete message"))
 		return
@@ -344,8 +424,22 @@ func DeleteMessages(w http.ResponseWriter, r *http.Request) {
 	// Retrieve the base parameters for the request
 	order, limit, page, offset := retrieveBaseParams(r)
 
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
 	// Delete the messages
-	err = db_controller.DeleteMessages(nil, &db_model.MessagesDeleteRequestParams{
+	err = db_controller.DeleteMessages(store, audit, &db_model.MessagesDeleteRequestParams{
 		ID:       ids,
 		SenderID: sender_ids,
 		Flagged:  flagged,
@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/boxboxjason/jukebox/internal/constants"
+	"github.com/boxboxjason/jukebox/internal/middlewares"
 	db_model "github.com/boxboxjason/jukebox/internal/model"
 	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
 	"github.com/go-chi/chi/v5"
@@ -18,7 +19,10 @@ func SetupMiscRoutes(r chi.Router) {
 // HealthCheck is the handler for the health check route
 // Returns the status of the API, of the database, and of the services
 func HealthCheck(w http.ResponseWriter, r *http.Request) {
-	err := db_model.CheckDatabase()
+	db, err := middlewares.RetrieveDatabase(r)
+	if err == nil {
+		err = db_model.CheckDatabase(db)
+	}
 	if err != nil {
 		httputils.SendJSONResponse(w, map[string]string{
 			"database": "unhealthy",
@@ -35,12 +39,44 @@ func HealthCheck(w http.ResponseWriter, r *http.Request) {
 }
 
 func Version(w http.ResponseWriter, r *http.Request) {
+	db, err := middlewares.RetrieveDatabase(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
 	httputils.SendJSONResponse(w, map[string]string{
 		"version":  constants.JUKEBOX_VERSION,
-		"database": db_model.DatabaseVersion(),
+		"database": db_model.DatabaseVersion(db),
 	})
 }
 
+// Metrics is the handler for the metrics route
+// Returns the statistics of the database connection pool
 func Metrics(w http.ResponseWriter, r *http.Request) {
-	httputils.SendErrorToClient(w, httputils.NewNotImplementedError("route not implemented yet"))
+	db, err := middlewares.RetrieveDatabase(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	stats, err := db_model.DatabaseStats(db)
+	if err != nil {
+		httputils.SendErrorToClient(w, httputils.NewDatabaseError("unable to retrieve the database statistics"))
+		return
+	}
+
+	httputils.SendJSONResponse(w, map[string]interface{}{
+		"database": map[string]interface{}{
+			"max_open_connections": stats.MaxOpenConnections,
+			"open_connections":     stats.OpenConnections,
+			"in_use":               stats.InUse,
+			"idle":                 stats.Idle,
+			"wait_count":           stats.WaitCount,
+			"wait_duration_ms":     stats.WaitDuration.Milliseconds(),
+			"max_idle_closed":      stats.MaxIdleClosed,
+			"max_idle_time_closed": stats.MaxIdleTimeClosed,
+			"max_lifetime_closed":  stats.MaxLifetimeClosed,
+		},
+	})
 }
@@ -2,10 +2,12 @@ package api
 
 import (
 	"github.com/boxboxjason/jukebox/internal/constants"
+	"github.com/boxboxjason/jukebox/internal/middlewares"
 	"github.com/go-chi/chi/v5"
 )
 
 const (
+	API_PREFIX        = "/api"
 	ID_PARAM_ENDPOINT = "/{" + constants.ID_PARAMETER + "}"
 )
 
@@ -13,12 +15,17 @@ const (
 func ApiRouter() chi.Router {
 	api_router := chi.NewRouter()
 
+	// Refuse the cross-site requests made with the auth cookies of the browser
+	api_router.Use(middlewares.CSRFMiddleware)
+
 	// Setup the subrouters
 	SetupMessagesRoutes(api_router)
 	SetUsersRoutes(api_router)
 	SetupMiscRoutes(api_router)
 	SetupAuthRoutes(api_router)
 	SetupBansRoutes(api_router)
+	SetupBackupsRoutes(api_router)
+	SetupAuditRoutes(api_router)
 
 	return api_router
 }
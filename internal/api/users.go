@@ -3,6 +3,7 @@ package api
 import (
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/boxboxjason/jukebox/internal/constants"
 	db_controller "github.com/boxboxjason/jukebox/internal/controller"
@@ -13,7 +14,19 @@ import (
 )
 
 const (
-	USERS_PREFIX = "/users"
+	USERS_PREFIX              = "/users"
+	EXPORT_SUFFIX             = "/export"
+	EXPORT_ID_PARAM_ENDPOINT  = "/{" + constants.EXPORT_ID_PARAMETER + "}"
+	EXPORT_DOWNLOAD_SUFFIX    = "/download"
+	DELETION_SUFFIX           = "/deletion"
+	VERIFICATION_SUFFIX       = "/verification"
+	TWO_FACTOR_SUFFIX         = "/two-factor"
+	SESSIONS_SUFFIX           = "/sessions"
+	SESSION_ID_PARAM_ENDPOINT = "/{" + constants.SESSION_ID_PARAMETER + "}"
+	TOKENS_SUFFIX             = "/tokens"
+	TOKEN_ID_PARAM_ENDPOINT   = "/{" + constants.TOKEN_ID_PARAMETER + "}"
+	ROLE_SUFFIX               = "/role"
+	LOCKOUT_SUFFIX            = "/lockout"
 )
 
 func SetUsersRoutes(r chi.Router) {
@@ -21,24 +34,57 @@ func SetUsersRoutes(r chi.Router) {
 
 	// Unauthenticated routes
 	users_subrouter.Post("/", CreateUser)
+	// The download link of an export carries its own token
+	users_subrouter.Get(ID_PARAM_ENDPOINT+EXPORT_SUFFIX+EXPORT_ID_PARAM_ENDPOINT+EXPORT_DOWNLOAD_SUFFIX, DownloadUserExport)
 
 	// Authenticated routes
 	users_subrouter.Group(func(auth_router chi.Router) {
 		auth_router.Use(middlewares.AuthMiddleware)
 		auth_router.Get("/", GetUsers)
 		auth_router.Get(ID_PARAM_ENDPOINT, GetUser)
+		auth_router.Get(ID_PARAM_ENDPOINT+BANS_PREFIX, GetUserBans)
+		auth_router.Get(ID_PARAM_ENDPOINT+EXPORT_SUFFIX+EXPORT_ID_PARAM_ENDPOINT, GetUserExport)
+		auth_router.Get(ID_PARAM_ENDPOINT+DELETION_SUFFIX, GetUserDeletion)
+		auth_router.Get(ID_PARAM_ENDPOINT+SESSIONS_SUFFIX, GetUserSessions)
+		auth_router.Get(ID_PARAM_ENDPOINT+TOKENS_SUFFIX, GetUserAPITokens)
+	})
+
+	// Authenticated routes writing the users, with the stored user rather than the one described by a signed access token
+	users_subrouter.Group(func(auth_router chi.Router) {
+		auth_router.Use(middlewares.AuthMiddleware, middlewares.LoadStoredUser)
 		auth_router.Put(ID_PARAM_ENDPOINT, UpdateUser)
 		auth_router.Delete(ID_PARAM_ENDPOINT, DeleteUser)
 		auth_router.Delete("/", DeleteUsers)
 		auth_router.Patch(ID_PARAM_ENDPOINT, UpdateUser)
-		auth_router.Get(ID_PARAM_ENDPOINT+BANS_PREFIX, GetUserBans)
+		auth_router.Post(ID_PARAM_ENDPOINT+EXPORT_SUFFIX, PostUserExport)
+		auth_router.Delete(ID_PARAM_ENDPOINT+DELETION_SUFFIX, CancelUserDeletion)
+		auth_router.Post(ID_PARAM_ENDPOINT+VERIFICATION_SUFFIX, ResendEmailVerification)
+		auth_router.Delete(ID_PARAM_ENDPOINT+SESSIONS_SUFFIX, RevokeUserSessions)
+		auth_router.Delete(ID_PARAM_ENDPOINT+SESSIONS_SUFFIX+SESSION_ID_PARAM_ENDPOINT, RevokeUserSession)
+		auth_router.Post(ID_PARAM_ENDPOINT+TOKENS_SUFFIX, PostUserAPIToken)
+		auth_router.Delete(ID_PARAM_ENDPOINT+TOKENS_SUFFIX+TOKEN_ID_PARAM_ENDPOINT, RevokeUserAPIToken)
+	})
+
+	// Authenticated routes, open to the API tokens with the messages:read scope
+	users_subrouter.Group(func(auth_router chi.Router) {
+		auth_router.Use(middlewares.RequireScope(constants.SCOPE_MESSAGES_READ), middlewares.AuthMiddleware)
 		auth_router.Get(ID_PARAM_ENDPOINT+MESSAGES_PREFIX, GetUserMessages)
 	})
 
-	// Admin routes
+	// Moderation routes, open to the API tokens with the bans:write scope
+	users_subrouter.Group(func(moderation_router chi.Router) {
+		moderation_router.Use(middlewares.RequireScope(constants.SCOPE_BANS_WRITE), middlewares.AuthMiddleware, middlewares.RequirePermission(constants.PERMISSION_BAN_CREATE))
+		moderation_router.Post(ID_PARAM_ENDPOINT+"/ban", CreateUserBan)
+	})
+
+	// Admin routes, with the stored user like the other routes writing the users
 	users_subrouter.Group(func(admin_router chi.Router) {
-		admin_router.Use(middlewares.AdminAuthMiddleware)
-		admin_router.Post(ID_PARAM_ENDPOINT+"/ban", CreateUserBan)
+		admin_router.Use(middlewares.AuthMiddleware, middlewares.LoadStoredUser)
+		admin_router.With(middlewares.RequirePermission(constants.PERMISSION_USER_UPDATE)).Put(ID_PARAM_ENDPOINT+VERIFICATION_SUFFIX, VerifyUserEmail)
+		admin_router.With(middlewares.RequirePermission(constants.PERMISSION_USER_UPDATE)).Delete(ID_PARAM_ENDPOINT+TWO_FACTOR_SUFFIX, ResetUserTwoFactor)
+		admin_router.With(middlewares.RequirePermission(constants.PERMISSION_ROLE_ASSIGN)).Put(ID_PARAM_ENDPOINT+ROLE_SUFFIX, UpdateUserRole)
+		admin_router.With(middlewares.RequirePermission(constants.PERMISSION_USER_READ)).Get(ID_PARAM_ENDPOINT+LOCKOUT_SUFFIX, GetUserLockout)
+		admin_router.With(middlewares.RequirePermission(constants.PERMISSION_USER_UPDATE)).Delete(ID_PARAM_ENDPOINT+LOCKOUT_SUFFIX, UnlockUser)
 	})
 
 	r.Mount(USERS_PREFIX, users_subrouter)
@@ -71,8 +117,20 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Retrieve the data stores and the mailer
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	mailer, err := middlewares.RetrieveMailer(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
 	// Create the user
-	db_user, err := db_controller.CreateUser(nil, &db_model.UsersPostRequestParams{
+	db_user, err := db_controller.CreateUser(store, &db_model.UsersPostRequestParams{
 		Username: username,
 		Email:    email,
 		Password: password,
@@ -82,6 +140,9 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The user can post once the email is verified
+	sendEmailVerification(store, mailer, db_user)
+
 	// Send the user back to the client
 	httputils.SendJSONResponse(w, db_user)
 }
@@ -123,21 +184,27 @@ func CreateUserBan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Open db connection
-	db, err := db_model.OpenConnection()
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
 	}
-	defer db_model.CloseConnection(db)
 
-	user_to_ban, err := db_controller.GetUser(db, user_id)
+	user_to_ban, err := db_controller.GetUser(store, user_id)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
 	}
 
-	ban, err := db_controller.BanUsers(db, &db_model.BansPostRequestParams{
+	ban, err := db_controller.BanUsers(store, audit, &db_model.BansPostRequestParams{
 		Issuer:   issuer,
 		Target:   []*db_model.User{user_to_ban},
 		Type:     ban_type,
@@ -180,8 +247,8 @@ func GetUsers(w http.ResponseWriter, r *http.Request) {
 		httputils.SendErrorToClient(w, err)
 	}
 
-	// Retrieve the admin parameter from the request
-	admin, err := httputils.RetrieveBoolParameter(r, constants.ADMIN_PARAMETER, true)
+	// Retrieve the roles from the request
+	roles, err := httputils.RetrieveStringListValueParameter(r, constants.ROLE_PARAMETER, true)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 	}
@@ -189,12 +256,19 @@ func GetUsers(w http.ResponseWriter, r *http.Request) {
 	// Retrieve the base parameters for the request
 	order, limit, page, offset := retrieveBaseParams(r)
 
-	users, err := db_controller.GetUsers(nil, &db_model.UsersGetRequestParams{
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	users, err := db_controller.GetUsers(store, &db_model.UsersGetRequestParams{
 		Username:        usernames,
 		PartialUsername: partial_username,
 		ID:              ids,
 		SubscriberTier:  minimum_subscriber_tier,
-		Admin:           admin,
+		Role:            roles,
 		Order:           order,
 		Limit:           limit,
 		Page:            page,
@@ -217,8 +291,15 @@ func GetUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
 	// Retrieve the user from the database
-	user, err := db_controller.GetUser(nil, user_id)
+	user, err := db_controller.GetUser(store, user_id)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
@@ -228,6 +309,47 @@ func GetUser(w http.ResponseWriter, r *http.Request) {
 	httputils.SendJSONResponse(w, user)
 }
 
+// GetUserDeletion retrieves the requested deletion of a user
+func GetUserDeletion(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user from the context
+	requester, ok := r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
+	if !ok {
+		httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("user not found"))
+		return
+	}
+
+	// Retrieve the user id from the request parameters
+	user_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the user from the database
+	user, err := db_controller.GetUser(store, user_id)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the requested deletion
+	deletion, err := db_controller.GetUserDeletion(requester, user)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Send the deletion to the client
+	httputils.SendJSONResponse(w, deletion)
+}
+
 // GetUserBans retrieves bans for a user from the database based on the request parameters
 func GetUserBans(w http.ResponseWriter, r *http.Request) {
 	// Retrieve the user id from the request parameters
@@ -261,8 +383,15 @@ func GetUserBans(w http.ResponseWriter, r *http.Request) {
 	// Retrieve the base parameters for the request
 	order, limit, page, offset := retrieveBaseParams(r)
 
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
 	// Retrieve the bans from the database
-	bans, err := db_controller.GetBans(nil, &db_model.BansGetRequestParams{
+	bans, err := db_controller.GetBans(store, &db_model.BansGetRequestParams{
 		TargetID:  []int{user_id},
 		EndsAfter: ends_after,
 		Type:      ban_types,
@@ -320,8 +449,15 @@ func GetUserMessages(w http.ResponseWriter, r *http.Request) {
 	// Retrieve the base parameters for the request
 	order, limit, page, offset := retrieveBaseParams(r)
 
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
 	// Retrieve the messages
-	messages, err := db_controller.GetMessages(nil, &db_model.MessagesGetRequestParams{
+	messages, err := db_controller.GetMessages(store, &db_model.MessagesGetRequestParams{
 		SenderID: []int{id},
 		Flagged:  flagged,
 		Censored: censored,
@@ -358,7 +494,7 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if the user has permission to update the user
-	if user.ID != user_id && !user.Admin {
+	if user.ID != user_id && !user.HasPermission(constants.PERMISSION_USER_UPDATE) {
 		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to update user"))
 		return
 	}
@@ -381,49 +517,50 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Admin reserved fields
-	admin, err := httputils.RetrievePostFormBoolParameter(r, constants.ADMIN_PARAMETER, true)
+	// Shared fields
+	username, err := httputils.RetrievePostFormStringParameter(r, constants.USERNAME_PARAMETER, true)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
-	} else if len(admin) > 0 && !user.Admin {
-		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to update admin status for user: "+strconv.Itoa(user_id)))
-		return
 	}
 
-	// Shared fields
-	username, err := httputils.RetrievePostFormStringParameter(r, constants.USERNAME_PARAMETER, true)
+	// Retrieve the data stores and the mailer
+	store, err := middlewares.RetrieveStore(r)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
 	}
-
-	// Open db connection
-	db, err := db_model.OpenConnection()
+	mailer, err := middlewares.RetrieveMailer(r)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
 	}
-	defer db_model.CloseConnection(db)
 
-	user_to_update, err := db_controller.GetUser(db, user_id)
+	user_to_update, err := db_controller.GetUser(store, user_id)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
 	}
 
+	// The user.update permission only reaches the users below in the roles hierarchy
+	if !db_controller.UserHasPermissionToUpdateUser(user, user_to_update) {
+		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to update user"))
+		return
+	}
+
+	previous_email := user_to_update.Email
+
 	avatar_file, _, err := httputils.RetrieveImageFile(r, constants.AVATAR_PARAMETER, true)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
 	}
 
-	user_to_update, err = db_controller.UpdateUser(db, user_to_update, &db_model.UsersRawPatchRequestParams{
+	user_to_update, err = db_controller.UpdateUser(store, user_to_update, &db_model.UsersRawPatchRequestParams{
 		ID:       user_id,
 		Username: username,
 		Email:    email,
 		Password: password,
-		Admin:    admin,
 		Avatar:   avatar_file,
 	})
 	if err != nil {
@@ -431,11 +568,16 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A new email has to be verified again
+	if user_to_update.Email != previous_email {
+		sendEmailVerification(store, mailer, user_to_update)
+	}
+
 	httputils.SendJSONResponse(w, user_to_update)
 }
 
-// ==================== Delete ====================
-func DeleteUser(w http.ResponseWriter, r *http.Request) {
+// ResendEmailVerification mails a new email verification link to a user, for the user itself or an admin
+func ResendEmailVerification(w http.ResponseWriter, r *http.Request) {
 	// Retrieve the user from the context
 	user, ok := r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
 	if !ok {
@@ -444,92 +586,816 @@ func DeleteUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Retrieve the user id from the request parameters
-	user_to_delete_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
+	user_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
 	}
 
-	// Open db connection
-	db, err := db_model.OpenConnection()
+	// Check if the user has permission to resend the link
+	if user.ID != user_id && !user.HasPermission(constants.PERMISSION_USER_UPDATE) {
+		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to resend the email verification of user"))
+		return
+	}
+
+	// Retrieve the data stores and the mailer
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	mailer, err := middlewares.RetrieveMailer(r)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
 	}
-	defer db_model.CloseConnection(db)
 
-	// Retrieve the user to delete
-	user_to_delete, err := db_controller.GetUser(db, user_to_delete_id)
+	// Retrieve the user to verify
+	user_to_verify, err := db_controller.GetUser(store, user_id)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
 	}
 
-	// Check if the user has permission to delete the user
-	if !db_controller.UserHasPermissionToDeleteUser(user, user_to_delete) {
-		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to delete user"))
+	// The user.update permission only reaches the users below in the roles hierarchy
+	if !db_controller.UserHasPermissionToUpdateUser(user, user_to_verify) {
+		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to resend the email verification of user"))
 		return
 	}
 
-	// Delete the user
-	err = db_controller.DeleteUser(db, user_to_delete)
+	// Send the link, the errors of the mail transport are reported to the client
+	err = db_controller.SendEmailVerification(store, mailer, user_to_verify)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
 	}
-	httputils.SendSuccessResponse(w, "user deleted")
+	httputils.SendSuccessResponse(w, "email verification link sent")
 }
 
-// DeleteUsers deletes users from the database based on the request parameters
-func DeleteUsers(w http.ResponseWriter, r *http.Request) {
-	// Retrieve the user from the context
-	requester, ok := r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
-	if !ok {
-		httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("user not found"))
+// VerifyUserEmail marks the email of a user as verified without any mail, for the users with the user.update permission
+func VerifyUserEmail(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user id from the request parameters
+	user_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
 		return
 	}
 
-	// Retrieve the usernames from the request
-	usernames, err := httputils.RetrieveStringListValueParameter(r, constants.USERNAME_PARAMETER, true)
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
+		return
 	}
 
-	// Retrieve the ids from the request
-	ids, err := httputils.RetrieveIntListValueParameter(r, constants.ID_PARAMETER, true)
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
+		return
 	}
 
-	// Retrieve the emails from the request
-	emails, err := httputils.RetrieveStringListValueParameter(r, constants.EMAIL_PARAMETER, true)
+	// Retrieve the user to verify
+	user_to_verify, err := db_controller.GetUser(store, user_id)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
+		return
 	}
 
-	// Retrieve the reason from the request
-	reason, err := httputils.RetrieveStringParameter(r, constants.REASON_PARAMETER, false)
+	err = db_controller.VerifyUserEmail(store, audit, user_to_verify)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendJSONResponse(w, user_to_verify)
+}
+
+// ResetUserTwoFactor disables the two-factor authentication of a user that lost its authenticator, for the users with the user.update permission
+func ResetUserTwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user id from the request parameters
+	user_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
+		return
 	}
 
-	// Retrieve the base parameters for the request
-	order, limit, page, offset := retrieveBaseParams(r)
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
 
-	// Delete the users
-	err = db_controller.DeleteUsers(nil, requester, &db_model.UsersDeleteRequestParams{
-		Username: usernames,
-		ID:       ids,
-		Email:    emails,
-		Reason:   reason,
-		Order:    order,
-		Limit:    limit,
-		Page:     page,
-		Offset:   offset,
-	})
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
 	if err != nil {
 		httputils.SendErrorToClient(w, err)
 		return
 	}
-	httputils.SendSuccessResponse(w, "users deleted")
+
+	// Retrieve the user to reset
+	user_to_reset, err := db_controller.GetUser(store, user_id)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	err = db_controller.ResetTwoFactor(store, audit, user_to_reset)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendJSONResponse(w, user_to_reset)
+}
+
+// UpdateUserRole assigns a role to a user, the users with the role.assign permission can only grant the roles below theirs
+func UpdateUserRole(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user id from the request parameters
+	user_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the role from the request
+	role, err := httputils.RetrievePostFormStringParameter(r, constants.ROLE_PARAMETER, false)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the user to update
+	user_to_update, err := db_controller.GetUser(store, user_id)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	err = db_controller.SetUserRole(store, audit, user_to_update, role)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendJSONResponse(w, user_to_update)
+}
+
+// GetUserLockout retrieves the failed logins of a user and the end of its lockout, for the users with the user.read permission
+func GetUserLockout(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user id from the request parameters
+	user_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the user
+	user, err := db_controller.GetUser(store, user_id)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	lockout, err := db_controller.GetUserLockout(audit, user)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendJSONResponse(w, lockout)
+}
+
+// UnlockUser forgets the failed logins of a locked out user, for the users with the user.update permission
+func UnlockUser(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user id from the request parameters
+	user_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the user to unlock
+	user_to_unlock, err := db_controller.GetUser(store, user_id)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	err = db_controller.UnlockUser(store, audit, user_to_unlock)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendSuccessResponse(w, "User unlocked")
+}
+
+// ==================== Delete ====================
+
+// DeleteUser requests the deletion of a user, which is finalized at the end of the grace period
+// Admins can delete a user right away with the immediate parameter
+func DeleteUser(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user from the context
+	user, ok := r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
+	if !ok {
+		httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("user not found"))
+		return
+	}
+
+	// Retrieve the user id from the request parameters
+	user_to_delete_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the deletion mode from the request
+	mode, err := httputils.RetrieveStringParameter(r, constants.MODE_PARAMETER, true)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the immediate parameter from the request
+	immediate, err := httputils.RetrieveBoolParameter(r, constants.IMMEDIATE_PARAMETER, true)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	} else if len(immediate) > 0 && immediate[0] && !user.HasPermission(constants.PERMISSION_USER_DELETE) {
+		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to skip the deletion grace period"))
+		return
+	}
+
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the user to delete
+	user_to_delete, err := db_controller.GetUser(store, user_to_delete_id)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Check if the user has permission to delete the user
+	if !db_controller.UserHasPermissionToDeleteUser(user, user_to_delete) {
+		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to delete user"))
+		return
+	}
+
+	// Delete the user right away
+	if len(immediate) > 0 && immediate[0] {
+		err = db_controller.DeleteUser(store, audit, user_to_delete, mode)
+		if err != nil {
+			httputils.SendErrorToClient(w, err)
+			return
+		}
+		httputils.SendSuccessResponse(w, "user deleted")
+		return
+	}
+
+	// Request the deletion
+	deletion, err := db_controller.RequestUserDeletion(store, audit, user_to_delete, mode)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendJSONResponseWithStatus(w, http.StatusAccepted, deletion)
+}
+
+// CancelUserDeletion cancels the requested deletion of a user during its grace period
+func CancelUserDeletion(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user from the context
+	user, ok := r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
+	if !ok {
+		httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("user not found"))
+		return
+	}
+
+	// Retrieve the user id from the request parameters
+	user_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Check if the user has permission to cancel the deletion
+	if user.ID != user_id && !user.HasPermission(constants.PERMISSION_USER_UPDATE) {
+		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to cancel the deletion of user"))
+		return
+	}
+
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the user whose deletion is cancelled
+	user_to_keep, err := db_controller.GetUser(store, user_id)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// The user.update permission only reaches the users below in the roles hierarchy
+	if !db_controller.UserHasPermissionToUpdateUser(user, user_to_keep) {
+		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to cancel the deletion of user"))
+		return
+	}
+
+	// Cancel the deletion
+	err = db_controller.CancelUserDeletion(store, audit, user_to_keep)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendSuccessResponse(w, "user deletion cancelled")
+}
+
+// DeleteUsers deletes users from the database based on the request parameters
+func DeleteUsers(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the usernames from the request
+	usernames, err := httputils.RetrieveStringListValueParameter(r, constants.USERNAME_PARAMETER, true)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+	}
+
+	// Retrieve the ids from the request
+	ids, err := httputils.RetrieveIntListValueParameter(r, constants.ID_PARAMETER, true)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+	}
+
+	// Retrieve the emails from the request
+	emails, err := httputils.RetrieveStringListValueParameter(r, constants.EMAIL_PARAMETER, true)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+	}
+
+	// Retrieve the reason from the request
+	reason, err := httputils.RetrieveStringParameter(r, constants.REASON_PARAMETER, false)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+	}
+
+	// Retrieve the deletion mode from the request
+	mode, err := httputils.RetrieveStringParameter(r, constants.MODE_PARAMETER, true)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the base parameters for the request
+	order, limit, page, offset := retrieveBaseParams(r)
+
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Delete the users
+	err = db_controller.DeleteUsers(store, audit, &db_model.UsersDeleteRequestParams{
+		Username: usernames,
+		ID:       ids,
+		Email:    emails,
+		Mode:     mode,
+		Reason:   reason,
+		Order:    order,
+		Limit:    limit,
+		Page:     page,
+		Offset:   offset,
+	})
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendSuccessResponse(w, "users deleted")
+}
+
+// ================= Sessions =================
+
+// GetUserSessions lists the active sessions of a user, for the user itself or an admin
+func GetUserSessions(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user and its access token from the context
+	requester, ok := r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
+	if !ok {
+		httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("user not found"))
+		return
+	}
+	access_token, ok := r.Context().Value(constants.ACCESS_TOKEN_CONTEXT_KEY).(*db_model.AuthToken)
+	if !ok {
+		httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("access token not found"))
+		return
+	}
+
+	// Retrieve the user id from the request parameters
+	user_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Check if the user has permission to see the sessions
+	if requester.ID != user_id && !requester.HasPermission(constants.PERMISSION_USER_READ) {
+		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to see the sessions of user"))
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the user whose sessions are listed
+	user, err := db_controller.GetUser(store, user_id)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// List the sessions, flagging the one of the requester
+	sessions, err := db_controller.ListUserSessions(store, user, access_token)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendJSONResponse(w, sessions)
+}
+
+// RevokeUserSession logs a user out of one of its sessions, and closes its websocket
+func RevokeUserSession(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user from the context
+	requester, ok := r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
+	if !ok {
+		httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("user not found"))
+		return
+	}
+
+	// Retrieve the user id and the session id from the request parameters
+	user_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	session_id, err := httputils.RetrieveChiIntArgument(r, constants.SESSION_ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Check if the user has permission to revoke the session
+	if requester.ID != user_id && !requester.HasPermission(constants.PERMISSION_USER_UPDATE) {
+		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to revoke the sessions of user"))
+		return
+	}
+
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the user whose session is revoked
+	user, err := db_controller.GetUser(store, user_id)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// The user.update permission only reaches the users below in the roles hierarchy
+	if !db_controller.UserHasPermissionToUpdateUser(requester, user) {
+		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to revoke the sessions of user"))
+		return
+	}
+
+	// Revoke the session
+	err = db_controller.RevokeSession(store, audit, user, session_id)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendSuccessResponse(w, "session revoked")
+}
+
+// RevokeUserSessions logs a user out of all its sessions but the one of the request
+// When an admin targets another user, every session of the user is revoked
+func RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user and its access token from the context
+	requester, ok := r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
+	if !ok {
+		httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("user not found"))
+		return
+	}
+	access_token, ok := r.Context().Value(constants.ACCESS_TOKEN_CONTEXT_KEY).(*db_model.AuthToken)
+	if !ok {
+		httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("access token not found"))
+		return
+	}
+
+	// Retrieve the user id from the request parameters
+	user_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Check if the user has permission to revoke the sessions
+	if requester.ID != user_id && !requester.HasPermission(constants.PERMISSION_USER_UPDATE) {
+		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to revoke the sessions of user"))
+		return
+	}
+
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the user whose sessions are revoked
+	user, err := db_controller.GetUser(store, user_id)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// The user.update permission only reaches the users below in the roles hierarchy
+	if !db_controller.UserHasPermissionToUpdateUser(requester, user) {
+		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to revoke the sessions of user"))
+		return
+	}
+
+	// Keep the session of the request when the user logs out its other sessions
+	var current *db_model.AuthToken
+	if requester.ID == user.ID {
+		current = access_token
+	}
+	revoked, err := db_controller.RevokeOtherSessions(store, audit, user, current)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendJSONResponse(w, map[string]interface{}{
+		"message": strconv.Itoa(revoked) + " sessions revoked",
+		"revoked": revoked,
+	})
+}
+
+// ================= API tokens =================
+
+// GetUserAPITokens lists the API tokens of a user, for the user itself or an admin
+func GetUserAPITokens(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user from the context
+	requester, ok := r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
+	if !ok {
+		httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("user not found"))
+		return
+	}
+
+	// Retrieve the user id from the request parameters
+	user_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Check if the user has permission to see the API tokens
+	if requester.ID != user_id && !requester.HasPermission(constants.PERMISSION_USER_READ) {
+		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to see the API tokens of user"))
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the user whose API tokens are listed
+	user, err := db_controller.GetUser(store, user_id)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// List the API tokens
+	api_tokens, err := db_controller.ListAPITokens(store, user)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendJSONResponse(w, api_tokens)
+}
+
+// PostUserAPIToken creates an API token for the authenticated user, its value is only sent in this response
+func PostUserAPIToken(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user from the context
+	user, ok := r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
+	if !ok {
+		httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("user not found"))
+		return
+	}
+
+	// Retrieve the user id from the request parameters
+	user_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// The API tokens act on behalf of their user, nobody else can create them
+	if user.ID != user_id {
+		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to create API tokens for user"))
+		return
+	}
+
+	// Retrieve the name, the scopes and the lifetime (in days) of the token from the request
+	name, err := httputils.RetrievePostFormStringParameter(r, constants.NAME_PARAMETER, false)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	scopes, err := httputils.RetrievePostFormStringListValueParameter(r, constants.SCOPES_PARAMETER, false)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	expires_in, err := httputils.RetrievePostFormIntParameter(r, constants.EXPIRES_IN_PARAMETER, true)
+	if err != nil {
+		httputils.SendErrorToClient(w, httputils.NewBadRequestError("Invalid fields: expires_in"))
+		return
+	}
+
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Create the API token
+	api_token, raw_token, err := db_controller.CreateAPIToken(store, audit, user, name, scopes, time.Duration(expires_in)*24*time.Hour)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendJSONResponseWithStatus(w, http.StatusCreated, map[string]interface{}{
+		"api_token": api_token,
+		"token":     raw_token,
+	})
+}
+
+// RevokeUserAPIToken deletes an API token of a user, for the user itself or an admin
+func RevokeUserAPIToken(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the user from the context
+	requester, ok := r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
+	if !ok {
+		httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("user not found"))
+		return
+	}
+
+	// Retrieve the user id and the token id from the request parameters
+	user_id, err := httputils.RetrieveChiIntArgument(r, constants.ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	api_token_id, err := httputils.RetrieveChiIntArgument(r, constants.TOKEN_ID_PARAMETER)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Check if the user has permission to revoke the API token
+	if requester.ID != user_id && !requester.HasPermission(constants.PERMISSION_USER_UPDATE) {
+		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to revoke the API tokens of user"))
+		return
+	}
+
+	// Retrieve the audit context (actor, IP and request ID)
+	audit, err := retrieveAuditContext(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the data stores
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// Retrieve the user whose API token is revoked
+	user, err := db_controller.GetUser(store, user_id)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// The user.update permission only reaches the users below in the roles hierarchy
+	if !db_controller.UserHasPermissionToUpdateUser(requester, user) {
+		httputils.SendErrorToClient(w, httputils.NewForbiddenError("user does not have permission to revoke the API tokens of user"))
+		return
+	}
+
+	// Revoke the API token
+	err = db_controller.RevokeAPIToken(store, audit, user, api_token_id)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+	httputils.SendSuccessResponse(w, "API token revoked")
 }
@@ -4,7 +4,12 @@ import (
 	"net/http"
 
 	"github.com/boxboxjason/jukebox/internal/constants"
+	db_controller "github.com/boxboxjason/jukebox/internal/controller"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
 	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+	"github.com/boxboxjason/jukebox/pkg/utils/mailutils"
+	"github.com/go-chi/chi/v5/middleware"
 )
 
 // retrieveBaseParams retrieves the base parameters for the request
@@ -17,3 +22,40 @@ func retrieveBaseParams(r *http.Request) (string, int, int, int) {
 
 	return order, limit, page, offset
 }
+
+// retrieveAuditContext retrieves the authenticated user, the client IP, the request ID
+// and the optional reason of the request, recorded along with the privileged actions
+func retrieveAuditContext(r *http.Request) (*db_controller.AuditContext, error) {
+	actor, ok := r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
+	if !ok {
+		return nil, httputils.NewUnauthorizedError("user not found")
+	}
+
+	reason, _ := httputils.RetrieveStringParameter(r, constants.REASON_PARAMETER, true)
+
+	return &db_controller.AuditContext{
+		Actor:     actor,
+		IP:        httputils.RetrieveClientIP(r),
+		RequestID: middleware.GetReqID(r.Context()),
+		Reason:    reason,
+	}, nil
+}
+
+// retrieveClientContext retrieves the IP and the user agent of the client, recorded on the sessions it opens or uses
+func retrieveClientContext(r *http.Request) *db_controller.ClientContext {
+	return &db_controller.ClientContext{
+		IP:        httputils.RetrieveClientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+}
+
+// sendEmailVerification mails the email verification link of the user in the background, so that slow mail servers
+// do not delay the response
+func sendEmailVerification(store *db_model.Store, mailer mailutils.Mailer, user *db_model.User) {
+	go func() {
+		err := db_controller.SendEmailVerification(store, mailer, user)
+		if err != nil {
+			logger.Error("Unable to send the email verification link of user", user.ID, err)
+		}
+	}()
+}
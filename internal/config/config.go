@@ -0,0 +1,467 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
+	"github.com/boxboxjason/jukebox/pkg/utils/jwtutils"
+	"github.com/boxboxjason/jukebox/pkg/utils/mailutils"
+	"github.com/boxboxjason/jukebox/pkg/utils/oidcutils"
+	"github.com/boxboxjason/jukebox/pkg/utils/tlsutils"
+)
+
+// Config is the configuration of the JukeBox server
+// Every setting is read, by order of precedence, from the command line flags, the environment variables,
+// the configuration file and the defaults (see Load)
+//
+// The tags of the settings:
+//   - config: name of the setting in the configuration file, and of its command line flag (prefixed by the section)
+//   - env: name of the environment variable, JUKEBOX_<SECTION>_<NAME> by default
+//   - secret: "true" to hide the setting when printing the configuration, "url" to only hide the credentials in it
+//   - help: description of the setting
+type Config struct {
+	Server   ServerConfig   `config:"server"`
+	TLS      TLSConfig      `config:"tls"`
+	Log      LogConfig      `config:"log"`
+	Paths    PathsConfig    `config:"paths"`
+	Database DatabaseConfig `config:"database"`
+	Auth     AuthConfig     `config:"auth"`
+	Chat     ChatConfig     `config:"chat"`
+	Mail     MailConfig     `config:"mail"`
+	OIDC     OIDCConfig     `config:"oidc"`
+
+	// sources holds where each setting was read from, by key
+	sources map[string]string
+}
+
+type ServerConfig struct {
+	Address         string        `config:"address" help:"address the server listens on (all interfaces if empty)"`
+	Port            int           `config:"port" help:"port the server listens on"`
+	AllowedOrigins  []string      `config:"allowed_origins" help:"origins allowed to call the API (CORS) and, unless it is *, to open the chat websocket"`
+	ShutdownTimeout time.Duration `config:"shutdown_timeout" help:"maximum time given to the server to shut down gracefully"`
+	PublicURL       string        `config:"public_url" help:"URL the users reach JukeBox at, used in the links of the mails (http(s)://localhost:<port> if empty)"`
+}
+
+type TLSConfig struct {
+	CertFile       string        `config:"cert_file" help:"certificate file (PEM), HTTPS is served when it is set with the key file"`
+	KeyFile        string        `config:"key_file" help:"private key file (PEM) of the certificate"`
+	MinVersion     string        `config:"min_version" help:"minimum TLS version (1.2 or 1.3)"`
+	CipherSuites   []string      `config:"cipher_suites" help:"TLS 1.2 cipher suites offered (Go names)"`
+	RedirectPort   int           `config:"redirect_port" help:"port of the HTTP listener redirecting to HTTPS (disabled if 0)"`
+	ReloadInterval time.Duration `config:"reload_interval" help:"interval between two checks of the certificate files (disabled if 0), SIGHUP also reloads them"`
+}
+
+type LogConfig struct {
+	Level string `config:"level" help:"log level (DEBUG, INFO, ERROR, CRITICAL or FATAL)"`
+}
+
+type PathsConfig struct {
+	DataDir string `config:"data_dir" help:"directory of the JukeBox data (database, images, backups, exports)"`
+	LogDir  string `config:"log_dir" help:"directory of the logs (<data_dir>/logs if empty)"`
+}
+
+type DatabaseConfig struct {
+	DSN             string        `config:"dsn" env:"JUKEBOX_DB_DSN" secret:"url" help:"database DSN, sqlite://<path> or postgres://... (<data_dir>/db/jukebox.db if empty)"`
+	MaxOpenConns    int           `config:"max_open_conns" env:"JUKEBOX_DB_MAX_OPEN_CONNS" help:"maximum number of open connections (0 for unlimited)"`
+	MaxIdleConns    int           `config:"max_idle_conns" env:"JUKEBOX_DB_MAX_IDLE_CONNS" help:"maximum number of idle connections"`
+	ConnMaxLifetime time.Duration `config:"conn_max_lifetime" env:"JUKEBOX_DB_CONN_MAX_LIFETIME" help:"maximum time a connection is reused (0 for forever)"`
+	ConnMaxIdleTime time.Duration `config:"conn_max_idle_time" env:"JUKEBOX_DB_CONN_MAX_IDLE_TIME" help:"maximum time a connection stays idle (0 for forever)"`
+	BusyTimeout     time.Duration `config:"busy_timeout" env:"JUKEBOX_DB_BUSY_TIMEOUT" help:"time a connection waits for a locked SQLite database"`
+}
+
+type AuthConfig struct {
+	AccessTokenExpiration       time.Duration `config:"access_token_expiration" help:"lifetime of the access tokens"`
+	RefreshTokenExpiration      time.Duration `config:"refresh_token_expiration" help:"lifetime of the refresh tokens"`
+	PasswordResetExpiration     time.Duration `config:"password_reset_expiration" help:"lifetime of the password reset links sent by mail"`
+	EmailVerificationExpiration time.Duration `config:"email_verification_expiration" help:"lifetime of the email verification links sent by mail"`
+	RequireAdminTwoFactor       bool          `config:"require_admin_two_factor" help:"refuse the permissions of their role to the moderators, admins and owners without two-factor authentication"`
+	LoginMaxFailures            int           `config:"login_max_failures" help:"failed logins of an account before it is locked out (no lockout if 0)"`
+	LoginMaxFailuresPerIP       int           `config:"login_max_failures_per_ip" help:"failed logins from an IP address before it is locked out (no lockout if 0)"`
+	LoginFailureDelay           time.Duration `config:"login_failure_delay" help:"delay imposed on an account after its second failed login in a row, doubled by every other failure until the lockout"`
+	LoginLockoutDuration        time.Duration `config:"login_lockout_duration" help:"time an account or an IP address stays locked out, its failed logins are forgotten after as long without any"`
+	RefreshReuseMail            bool          `config:"refresh_reuse_mail" help:"mail the users whose session is revoked because one of its old refresh tokens was used again"`
+	SignedAccessTokens          bool          `config:"signed_access_tokens" help:"issue access tokens signed with Ed25519 (JWT), checked without the database and revoked by an in-memory deny-list"`
+	SignedAccessTokenExpiration time.Duration `config:"signed_access_token_expiration" help:"lifetime of the signed access tokens, replacing access_token_expiration when they are enabled"`
+	SigningKeysDir              string        `config:"signing_keys_dir" help:"directory of the keys signing the access tokens, shared by the instances (<data_dir>/keys if empty)"`
+	SigningKeyRotation          time.Duration `config:"signing_key_rotation" help:"age at which the key signing the access tokens is replaced"`
+}
+
+type ChatConfig struct {
+	MusicGeneratorURL string        `config:"music_generator_url" env:"MUSIC_GENERATOR_URL" secret:"url" help:"URL the chat prompts are sent to"`
+	PromptInterval    time.Duration `config:"prompt_interval" help:"maximum time a chat message waits before being sent"`
+	PromptThreshold   int           `config:"prompt_threshold" help:"number of pending chat messages sent right away"`
+}
+
+type MailConfig struct {
+	Transport    string `config:"transport" help:"mail transport: outbox (write the mails to outbox_dir) or smtp"`
+	From         string `config:"from" help:"sender of the mails"`
+	OutboxDir    string `config:"outbox_dir" help:"directory the mails are written to by the outbox transport (<data_dir>/outbox if empty)"`
+	SMTPHost     string `config:"smtp_host" help:"SMTP server host"`
+	SMTPPort     int    `config:"smtp_port" help:"SMTP server port (465 for TLS, STARTTLS is used on the other ports when offered)"`
+	SMTPUsername string `config:"smtp_username" help:"SMTP username (no authentication if empty)"`
+	SMTPPassword string `config:"smtp_password" secret:"true" help:"SMTP password"`
+}
+
+type OIDCConfig struct {
+	Issuer       string   `config:"issuer" help:"issuer URL of the OpenID Connect provider the users can sign in with (disabled if empty)"`
+	Name         string   `config:"name" help:"name of the provider shown on the sign in button"`
+	ClientID     string   `config:"client_id" help:"client ID of JukeBox at the provider"`
+	ClientSecret string   `config:"client_secret" secret:"true" help:"client secret of JukeBox at the provider (public client with PKCE only if empty)"`
+	Scopes       []string `config:"scopes" help:"scopes requested to the provider (openid is always requested)"`
+	RedirectURL  string   `config:"redirect_url" help:"callback URL registered at the provider (<public_url>/api/auth/oidc/callback if empty)"`
+}
+
+// Default returns the default configuration, built from the constants
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:            constants.SERVER_PORT,
+			AllowedOrigins:  []string{"*"},
+			ShutdownTimeout: constants.SHUTDOWN_TIMEOUT,
+		},
+		TLS: TLSConfig{
+			MinVersion:     constants.TLS_MIN_VERSION,
+			CipherSuites:   append([]string{}, tlsutils.DEFAULT_CIPHER_SUITES...),
+			ReloadInterval: constants.TLS_RELOAD_INTERVAL,
+		},
+		Log: LogConfig{
+			Level: constants.LOG_LEVEL,
+		},
+		Paths: PathsConfig{
+			DataDir: constants.JUKEBOX_PATH,
+		},
+		Database: DatabaseConfig{
+			MaxOpenConns:    constants.DB_MAX_OPEN_CONNECTIONS,
+			MaxIdleConns:    constants.DB_MAX_IDLE_CONNECTIONS,
+			ConnMaxLifetime: constants.DB_CONNECTION_MAX_LIFETIME,
+			ConnMaxIdleTime: constants.DB_CONNECTION_MAX_IDLE_TIME,
+			BusyTimeout:     constants.DB_BUSY_TIMEOUT,
+		},
+		Auth: AuthConfig{
+			AccessTokenExpiration:       constants.ACCESS_TOKEN_EXPIRATION,
+			RefreshTokenExpiration:      constants.REFRESH_TOKEN_EXPIRATION,
+			PasswordResetExpiration:     constants.PASSWORD_RESET_EXPIRATION,
+			EmailVerificationExpiration: constants.EMAIL_VERIFICATION_EXPIRATION,
+			LoginMaxFailures:            constants.LOGIN_MAX_FAILURES,
+			LoginMaxFailuresPerIP:       constants.LOGIN_MAX_FAILURES_PER_IP,
+			LoginFailureDelay:           constants.LOGIN_FAILURE_DELAY,
+			LoginLockoutDuration:        constants.LOGIN_LOCKOUT_DURATION,
+			RefreshReuseMail:            constants.REFRESH_REUSE_NOTIFICATION,
+			SignedAccessTokenExpiration: constants.SIGNED_ACCESS_TOKEN_EXPIRATION,
+			SigningKeyRotation:          constants.SIGNING_KEY_ROTATION_INTERVAL,
+		},
+		Chat: ChatConfig{
+			PromptInterval:  constants.PROMPT_INTERVAL,
+			PromptThreshold: constants.PROMPT_THRESHOLD,
+		},
+		Mail: MailConfig{
+			Transport: constants.MAIL_TRANSPORT_OUTBOX,
+			From:      constants.MAIL_FROM,
+			SMTPPort:  constants.SMTP_PORT,
+		},
+		OIDC: OIDCConfig{
+			Name:   constants.OIDC_NAME,
+			Scopes: []string{"openid", "profile", "email"},
+		},
+		sources: map[string]string{},
+	}
+}
+
+// resolve fills the settings whose default depends on another setting
+func (config *Config) resolve() {
+	if config.Paths.LogDir == "" {
+		config.Paths.LogDir = filepath.Join(config.Paths.DataDir, "logs")
+	}
+	if config.Database.DSN == "" {
+		config.Database.DSN = db_model.SQLITE_DRIVER + "://" + filepath.Join(config.Paths.DataDir, "db", "jukebox.db")
+	}
+	if config.Server.PublicURL == "" {
+		scheme := "http"
+		if config.TLSEnabled() {
+			scheme = "https"
+		}
+		config.Server.PublicURL = scheme + "://" + net.JoinHostPort("localhost", strconv.Itoa(config.Server.Port))
+	}
+	if config.Mail.OutboxDir == "" {
+		config.Mail.OutboxDir = filepath.Join(config.Paths.DataDir, "outbox")
+	}
+	if config.Auth.SigningKeysDir == "" {
+		config.Auth.SigningKeysDir = filepath.Join(config.Paths.DataDir, "keys")
+	}
+	if config.OIDC.RedirectURL == "" {
+		config.OIDC.RedirectURL = strings.TrimSuffix(config.Server.PublicURL, "/") + "/api/auth/oidc/callback"
+	}
+}
+
+// ================ Validate ================
+
+// Validate checks every setting and returns all the invalid ones at once
+func (config *Config) Validate() error {
+	errs := []error{}
+	invalid := func(key string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: "+format, append([]any{key}, args...)...))
+	}
+
+	// Server
+	if config.Server.Port < 1 || config.Server.Port > 65535 {
+		invalid("server.port", "must be between 1 and 65535, got %d", config.Server.Port)
+	}
+	if len(config.Server.AllowedOrigins) == 0 {
+		invalid("server.allowed_origins", "must contain at least one origin")
+	}
+	for _, origin := range config.Server.AllowedOrigins {
+		if origin == "" {
+			invalid("server.allowed_origins", "must not contain an empty origin")
+		}
+	}
+	if config.Server.ShutdownTimeout <= 0 {
+		invalid("server.shutdown_timeout", "must be positive")
+	}
+	if !isHTTPURL(config.Server.PublicURL) {
+		invalid("server.public_url", "must be an http or https URL")
+	}
+
+	// TLS
+	if (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+		invalid("tls", "cert_file and key_file must be set together")
+	}
+	_, err := tlsutils.ParseTLSVersion(config.TLS.MinVersion)
+	if err != nil {
+		invalid("tls.min_version", "%v", err)
+	}
+	_, err = tlsutils.ParseCipherSuites(config.TLS.CipherSuites)
+	if err != nil {
+		invalid("tls.cipher_suites", "%v", err)
+	}
+	if config.TLS.RedirectPort != 0 {
+		if !config.TLSEnabled() {
+			invalid("tls.redirect_port", "requires tls.cert_file and tls.key_file")
+		}
+		if config.TLS.RedirectPort < 0 || config.TLS.RedirectPort > 65535 || config.TLS.RedirectPort == config.Server.Port {
+			invalid("tls.redirect_port", "must be between 1 and 65535 and differ from server.port, got %d", config.TLS.RedirectPort)
+		}
+	}
+	if config.TLS.ReloadInterval < 0 {
+		invalid("tls.reload_interval", "must not be negative")
+	}
+
+	// Log
+	if !logger.IsValidLevel(config.Log.Level) {
+		invalid("log.level", "must be DEBUG, INFO, ERROR, CRITICAL or FATAL, got %q", config.Log.Level)
+	}
+
+	// Paths
+	if config.Paths.DataDir == "" {
+		invalid("paths.data_dir", "must not be empty")
+	}
+
+	// Database
+	_, _, err = db_model.ParseDatabaseDSN(config.Database.DSN)
+	if err != nil {
+		invalid("database.dsn", "%v", err)
+	}
+	if config.Database.MaxOpenConns < 0 {
+		invalid("database.max_open_conns", "must not be negative")
+	}
+	if config.Database.MaxIdleConns < 0 {
+		invalid("database.max_idle_conns", "must not be negative")
+	}
+	if config.Database.ConnMaxLifetime < 0 {
+		invalid("database.conn_max_lifetime", "must not be negative")
+	}
+	if config.Database.ConnMaxIdleTime < 0 {
+		invalid("database.conn_max_idle_time", "must not be negative")
+	}
+	if config.Database.BusyTimeout < 0 {
+		invalid("database.busy_timeout", "must not be negative")
+	}
+
+	// Auth
+	if config.Auth.AccessTokenExpiration <= 0 {
+		invalid("auth.access_token_expiration", "must be positive")
+	}
+	if config.Auth.RefreshTokenExpiration < config.Auth.AccessTokenExpiration {
+		invalid("auth.refresh_token_expiration", "must not be shorter than auth.access_token_expiration")
+	}
+	if config.Auth.PasswordResetExpiration <= 0 {
+		invalid("auth.password_reset_expiration", "must be positive")
+	}
+	if config.Auth.EmailVerificationExpiration <= 0 {
+		invalid("auth.email_verification_expiration", "must be positive")
+	}
+	if config.Auth.LoginMaxFailures < 0 {
+		invalid("auth.login_max_failures", "must not be negative")
+	}
+	if config.Auth.LoginMaxFailuresPerIP < 0 {
+		invalid("auth.login_max_failures_per_ip", "must not be negative")
+	}
+	if config.Auth.LoginFailureDelay < 0 {
+		invalid("auth.login_failure_delay", "must not be negative")
+	}
+	if config.Auth.LoginLockoutDuration <= 0 {
+		invalid("auth.login_lockout_duration", "must be positive")
+	}
+	if config.Auth.SignedAccessTokens {
+		if config.Auth.SignedAccessTokenExpiration <= 0 {
+			invalid("auth.signed_access_token_expiration", "must be positive")
+		} else if config.Auth.RefreshTokenExpiration < config.Auth.SignedAccessTokenExpiration {
+			invalid("auth.refresh_token_expiration", "must not be shorter than auth.signed_access_token_expiration")
+		}
+		if config.Auth.SigningKeyRotation <= 0 {
+			invalid("auth.signing_key_rotation", "must be positive")
+		}
+		if config.Auth.SigningKeysDir == "" {
+			invalid("auth.signing_keys_dir", "must not be empty")
+		}
+	}
+
+	// Chat
+	if config.Chat.MusicGeneratorURL != "" && !isHTTPURL(config.Chat.MusicGeneratorURL) {
+		invalid("chat.music_generator_url", "must be an http or https URL")
+	}
+	if config.Chat.PromptInterval <= 0 {
+		invalid("chat.prompt_interval", "must be positive")
+	}
+	if config.Chat.PromptThreshold < 1 {
+		invalid("chat.prompt_threshold", "must be at least 1")
+	}
+
+	// Mail
+	switch config.Mail.Transport {
+	case constants.MAIL_TRANSPORT_OUTBOX:
+		if config.Mail.OutboxDir == "" {
+			invalid("mail.outbox_dir", "must not be empty")
+		}
+	case constants.MAIL_TRANSPORT_SMTP:
+		if config.Mail.SMTPHost == "" {
+			invalid("mail.smtp_host", "must be set for the smtp transport")
+		}
+		if config.Mail.SMTPPort < 1 || config.Mail.SMTPPort > 65535 {
+			invalid("mail.smtp_port", "must be between 1 and 65535, got %d", config.Mail.SMTPPort)
+		}
+	default:
+		invalid("mail.transport", "must be %s or %s, got %q", constants.MAIL_TRANSPORT_OUTBOX, constants.MAIL_TRANSPORT_SMTP, config.Mail.Transport)
+	}
+	_, err = mail.ParseAddress(config.Mail.From)
+	if err != nil {
+		invalid("mail.from", "must be a mail address: %v", err)
+	}
+
+	// OpenID Connect
+	if config.OIDC.Issuer != "" {
+		if !isHTTPURL(config.OIDC.Issuer) {
+			invalid("oidc.issuer", "must be an http(s) URL, got %q", config.OIDC.Issuer)
+		}
+		if config.OIDC.ClientID == "" {
+			invalid("oidc.client_id", "must be set when the issuer is set")
+		}
+		if !isHTTPURL(config.OIDC.RedirectURL) {
+			invalid("oidc.redirect_url", "must be an http(s) URL, got %q", config.OIDC.RedirectURL)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// isHTTPURL checks if raw_url is an absolute http or https URL
+func isHTTPURL(raw_url string) bool {
+	parsed_url, err := url.Parse(raw_url)
+	return err == nil && (parsed_url.Scheme == "http" || parsed_url.Scheme == "https") && parsed_url.Host != ""
+}
+
+// ================ Apply ================
+
+// DatabaseOptions returns the options to open the database with
+func (config *Config) DatabaseOptions() *db_model.DatabaseOptions {
+	return &db_model.DatabaseOptions{
+		DSN:             config.Database.DSN,
+		MaxOpenConns:    config.Database.MaxOpenConns,
+		MaxIdleConns:    config.Database.MaxIdleConns,
+		ConnMaxLifetime: config.Database.ConnMaxLifetime,
+		ConnMaxIdleTime: config.Database.ConnMaxIdleTime,
+		BusyTimeout:     config.Database.BusyTimeout,
+	}
+}
+
+// Mailer returns the mailer of the configured transport
+func (config *Config) Mailer() mailutils.Mailer {
+	if config.Mail.Transport == constants.MAIL_TRANSPORT_SMTP {
+		return &mailutils.SMTPMailer{
+			Host:     config.Mail.SMTPHost,
+			Port:     config.Mail.SMTPPort,
+			Username: config.Mail.SMTPUsername,
+			Password: config.Mail.SMTPPassword,
+			From:     config.Mail.From,
+		}
+	}
+	return &mailutils.OutboxMailer{Dir: config.Mail.OutboxDir, From: config.Mail.From}
+}
+
+// OIDCClient returns the client of the OpenID Connect provider, nil if it is disabled
+func (config *Config) OIDCClient() *oidcutils.Client {
+	if config.OIDC.Issuer == "" {
+		return nil
+	}
+	return oidcutils.NewClient(config.OIDC.Issuer, config.OIDC.ClientID, config.OIDC.ClientSecret, config.OIDC.RedirectURL, config.OIDC.Scopes)
+}
+
+// SigningKeyRing loads the keys signing the access tokens, creating the first one if there is none, nil if the access tokens are not signed
+func (config *Config) SigningKeyRing() (*jwtutils.KeyRing, error) {
+	if !config.Auth.SignedAccessTokens {
+		return nil, nil
+	}
+	ring, err := jwtutils.LoadKeyRing(config.Auth.SigningKeysDir)
+	if err != nil {
+		return nil, err
+	}
+	_, err = ring.RotateIfOlder(config.Auth.SigningKeyRotation, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// Apply moves the Jukebox directories and sets the token lifetimes, the public URL, the admins requirements and the login throttling
+func (config *Config) Apply() error {
+	err := constants.SetJukeboxPath(config.Paths.DataDir)
+	if err != nil {
+		return err
+	}
+	constants.LOG_DIR = config.Paths.LogDir
+	access_expiration := config.Auth.AccessTokenExpiration
+	if config.Auth.SignedAccessTokens {
+		access_expiration = config.Auth.SignedAccessTokenExpiration
+	}
+	constants.SetTokenExpirations(access_expiration, config.Auth.RefreshTokenExpiration, config.Auth.PasswordResetExpiration, config.Auth.EmailVerificationExpiration)
+	constants.PUBLIC_URL = strings.TrimSuffix(config.Server.PublicURL, "/")
+	constants.REQUIRE_ADMIN_TWO_FACTOR = config.Auth.RequireAdminTwoFactor
+	constants.SetLoginThrottling(config.Auth.LoginMaxFailures, config.Auth.LoginMaxFailuresPerIP, config.Auth.LoginFailureDelay, config.Auth.LoginLockoutDuration)
+	constants.NOTIFY_REFRESH_REUSE = config.Auth.RefreshReuseMail
+	constants.SIGNING_KEY_ROTATION = config.Auth.SigningKeyRotation
+	return nil
+}
+
+// TLSEnabled checks if the server serves HTTPS
+func (config *Config) TLSEnabled() bool {
+	return config.TLS.CertFile != "" && config.TLS.KeyFile != ""
+}
+
+// ListenAddress returns the address the server listens on
+func (config *Config) ListenAddress() string {
+	return net.JoinHostPort(config.Server.Address, strconv.Itoa(config.Server.Port))
+}
+
+// RedirectAddress returns the address the HTTP to HTTPS redirect listens on
+func (config *Config) RedirectAddress() string {
+	return net.JoinHostPort(config.Server.Address, strconv.Itoa(config.TLS.RedirectPort))
+}
@@ -0,0 +1,295 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Sources of the settings, by increasing precedence
+	SOURCE_DEFAULT = "default"
+	SOURCE_FILE    = "file"
+	SOURCE_ENV     = "env"
+	SOURCE_FLAG    = "flag"
+	// Command line flag and environment variable holding the path of the configuration file
+	CONFIG_FLAG = "config"
+	CONFIG_ENV  = "JUKEBOX_CONFIG"
+	// Prefix of the default environment variables names
+	ENV_PREFIX = "JUKEBOX_"
+)
+
+// setting is a single value of the configuration, as described by the tags of its field
+type setting struct {
+	key    string
+	env    string
+	secret string
+	help   string
+	value  reflect.Value
+}
+
+var duration_type = reflect.TypeOf(time.Duration(0))
+
+// settings lists the settings of the configuration, in the order of the fields
+func (config *Config) settings() []*setting {
+	settings := []*setting{}
+	sections := reflect.ValueOf(config).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section_name := sections.Type().Field(i).Tag.Get("config")
+		if section_name == "" {
+			continue
+		}
+
+		section := sections.Field(i)
+		for j := 0; j < section.NumField(); j++ {
+			field := section.Type().Field(j)
+			name := field.Tag.Get("config")
+			env := field.Tag.Get("env")
+			if env == "" {
+				env = ENV_PREFIX + strings.ToUpper(section_name+"_"+name)
+			}
+			settings = append(settings, &setting{
+				key:    section_name + "." + name,
+				env:    env,
+				secret: field.Tag.Get("secret"),
+				help:   field.Tag.Get("help"),
+				value:  section.Field(j),
+			})
+		}
+	}
+	return settings
+}
+
+// ================ Load ================
+
+// Load builds the configuration from the defaults, overridden by the configuration file, the environment variables
+// and the command line flags, in that order. The configuration file is the one of the --config flag, or of JUKEBOX_CONFIG
+// The arguments left after the flags are returned with the configuration, which still has to be validated
+func Load(args []string, lookup_env func(string) (string, bool)) (*Config, []string, error) {
+	config := Default()
+	settings := config.settings()
+
+	// Parse the command line flags, they are applied last
+	// The flags may come before or after the arguments of the command
+	flags, config_path, flag_values := newFlagSet(settings)
+	arguments := []string{}
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return nil, nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		arguments = append(arguments, args[0])
+		args = args[1:]
+	}
+
+	// Apply the configuration file
+	if *config_path == "" {
+		*config_path, _ = lookup_env(CONFIG_ENV)
+	}
+	if *config_path != "" {
+		file_values, err := readConfigFile(*config_path)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = config.applyValues(settings, file_values, SOURCE_FILE)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", *config_path, err)
+		}
+	}
+
+	// Apply the environment variables
+	env_values := map[string]any{}
+	for _, setting := range settings {
+		if value, ok := lookup_env(setting.env); ok && value != "" {
+			env_values[setting.key] = value
+		}
+	}
+	err := config.applyValues(settings, env_values, SOURCE_ENV)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Apply the command line flags
+	err = config.applyValues(settings, flag_values, SOURCE_FLAG)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config.resolve()
+	return config, arguments, nil
+}
+
+// PrintFlags writes the description of the command line flags accepted by Load
+func PrintFlags(w io.Writer) {
+	flags, _, _ := newFlagSet(Default().settings())
+	flags.SetOutput(w)
+	flags.PrintDefaults()
+}
+
+// newFlagSet returns a flag for the configuration file and one per setting, whose values are collected by key
+func newFlagSet(settings []*setting) (*flag.FlagSet, *string, map[string]any) {
+	flags := flag.NewFlagSet("jukebox", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	config_path := flags.String(CONFIG_FLAG, "", "path of the YAML or TOML configuration file (env "+CONFIG_ENV+")")
+
+	flag_values := map[string]any{}
+	for _, setting := range settings {
+		key := setting.key
+		flags.Func(key, setting.help+" (env "+setting.env+")", func(value string) error {
+			flag_values[key] = value
+			return nil
+		})
+	}
+	return flags, config_path, flag_values
+}
+
+// readConfigFile reads the settings of a YAML or TOML configuration file, by key
+func readConfigFile(path string) (map[string]any, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	document := map[string]any{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &document)
+	case ".toml":
+		err = toml.Unmarshal(content, &document)
+	default:
+		return nil, fmt.Errorf("%s: unsupported configuration file format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := map[string]any{}
+	flattenValues("", document, values)
+	return values, nil
+}
+
+// flattenValues flattens the sections of a configuration document into values keyed by "<section>.<name>"
+// The empty values (such as a section whose settings are all commented out) are left to the defaults
+func flattenValues(prefix string, document map[string]any, values map[string]any) {
+	for name, value := range document {
+		if section, ok := value.(map[string]any); ok {
+			flattenValues(prefix+name+".", section, values)
+		} else if value != nil {
+			values[prefix+name] = value
+		}
+	}
+}
+
+// applyValues sets the settings to the values read from source, the unknown keys are refused
+func (config *Config) applyValues(settings []*setting, values map[string]any, source string) error {
+	errs := []error{}
+	known := map[string]bool{}
+	for _, setting := range settings {
+		known[setting.key] = true
+		value, ok := values[setting.key]
+		if !ok {
+			continue
+		}
+		err := setting.set(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid %s value: %w", setting.key, source, err))
+			continue
+		}
+		config.sources[setting.key] = source
+	}
+
+	unknown := []string{}
+	for key := range values {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		errs = append(errs, fmt.Errorf("%s: unknown setting", key))
+	}
+	return errors.Join(errs...)
+}
+
+// set parses the value and assigns it to the setting
+// The values come as strings from the environment and the flags, lists are then separated by commas
+func (setting *setting) set(value any) error {
+	if setting.value.Kind() == reflect.Slice {
+		items := []string{}
+		switch value := value.(type) {
+		case []any:
+			for _, item := range value {
+				text, err := scalarString(item)
+				if err != nil {
+					return err
+				}
+				items = append(items, text)
+			}
+		case string:
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+		default:
+			return fmt.Errorf("expected a list, got %v", value)
+		}
+		setting.value.Set(reflect.ValueOf(items))
+		return nil
+	}
+
+	text, err := scalarString(value)
+	if err != nil {
+		return err
+	}
+	switch {
+	case setting.value.Type() == duration_type:
+		duration, err := time.ParseDuration(text)
+		if err != nil {
+			return fmt.Errorf("expected a duration such as 30s or 4h, got %q", text)
+		}
+		setting.value.SetInt(int64(duration))
+	case setting.value.Kind() == reflect.Int:
+		number, err := strconv.Atoi(text)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", text)
+		}
+		setting.value.SetInt(int64(number))
+	case setting.value.Kind() == reflect.Bool:
+		boolean, err := strconv.ParseBool(text)
+		if err != nil {
+			return fmt.Errorf("expected a boolean, got %q", text)
+		}
+		setting.value.SetBool(boolean)
+	default:
+		setting.value.SetString(text)
+	}
+	return nil
+}
+
+// scalarString returns the text of a single value read from a configuration file
+func scalarString(value any) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case int, int64, uint64, float64, bool:
+		return fmt.Sprint(value), nil
+	default:
+		return "", fmt.Errorf("expected a single value, got %v", value)
+	}
+}
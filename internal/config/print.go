@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+)
+
+// REDACTED replaces the secrets when printing the configuration (like the passwords of net/url)
+const REDACTED = "xxxxx"
+
+// password_parameter matches the password of a key=value DSN
+var password_parameter = regexp.MustCompile(`(?i)(password=)[^\s&]*`)
+
+// Print writes every setting with its effective value and where it was read from, the secrets are redacted
+func (config *Config) Print(w io.Writer) error {
+	writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "SETTING\tVALUE\tSOURCE")
+	for _, setting := range config.settings() {
+		source, ok := config.sources[setting.key]
+		if !ok {
+			source = SOURCE_DEFAULT
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", setting.key, setting.display(), source)
+	}
+	return writer.Flush()
+}
+
+// display returns the value of the setting as printed, with the secrets redacted
+func (setting *setting) display() string {
+	var text string
+	if setting.value.Kind() == reflect.Slice {
+		text = strings.Join(setting.value.Interface().([]string), ",")
+	} else {
+		text = fmt.Sprint(setting.value.Interface())
+	}
+	if text == "" {
+		return `""`
+	}
+
+	switch setting.secret {
+	case "true":
+		return REDACTED
+	case "url":
+		return redactURL(text)
+	default:
+		return text
+	}
+}
+
+// redactURL hides the password of a URL or of a key=value DSN
+func redactURL(text string) string {
+	parsed, err := url.Parse(text)
+	if err == nil {
+		text = parsed.Redacted()
+	}
+	return password_parameter.ReplaceAllString(text, "${1}"+REDACTED)
+}
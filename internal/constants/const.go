@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"time"
 )
 
 type contextKey string
@@ -23,16 +24,106 @@ var (
 	DB_FILE = path.Join(DB_DIR, "jukebox.db")
 	// Path to the Jukebox db backup directory
 	DB_BACKUP_DIR = path.Join(DB_DIR, "backup")
+	// Path to the users data exports directory
+	EXPORTS_DIR = path.Join(JUKEBOX_PATH, "exports")
 	// Path to the Jukebox logs directory
 	LOG_DIR = path.Join(JUKEBOX_PATH, "logs")
+	// Path to the chat messages not sent to the music generator before the last shutdown
+	PROMPTS_FILE = path.Join(JUKEBOX_PATH, "prompts.json")
+	// URL the users reach JukeBox at, used in the links of the mails
+	PUBLIC_URL = "http://localhost:3000"
+	// Refuse the permissions of their role to the moderators, admins and owners without two-factor authentication
+	REQUIRE_ADMIN_TWO_FACTOR = false
+	// Failed logins of an account, and of an IP address, before it is locked out (no lockout if 0)
+	LOGIN_LOCKOUT_THRESHOLD    = LOGIN_MAX_FAILURES
+	LOGIN_IP_LOCKOUT_THRESHOLD = LOGIN_MAX_FAILURES_PER_IP
+	// Delay imposed on an account after its second failed login in a row, doubled by every other failure until the lockout
+	LOGIN_DELAY = LOGIN_FAILURE_DELAY
+	// Time an account or an IP address stays locked out
+	LOGIN_LOCKOUT = LOGIN_LOCKOUT_DURATION
+	// Warn the users by mail when a session is revoked because one of its old refresh tokens was used again
+	NOTIFY_REFRESH_REUSE = REFRESH_REUSE_NOTIFICATION
+	// Age at which the key signing the access tokens is replaced, when the access tokens are signed
+	SIGNING_KEY_ROTATION = SIGNING_KEY_ROTATION_INTERVAL
+	// Roles of the users, from the least to the most privileged
+	ROLES = []string{ROLE_USER, ROLE_MODERATOR, ROLE_ADMIN, ROLE_OWNER}
+	// Permissions granted by each role
+	ROLE_PERMISSIONS = map[string][]string{
+		ROLE_USER:      {},
+		ROLE_MODERATOR: {PERMISSION_BAN_CREATE, PERMISSION_BAN_READ, PERMISSION_BAN_UPDATE, PERMISSION_BAN_DELETE, PERMISSION_MESSAGE_MODERATE, PERMISSION_MESSAGE_REMOVE},
+		ROLE_ADMIN: {PERMISSION_BAN_CREATE, PERMISSION_BAN_READ, PERMISSION_BAN_UPDATE, PERMISSION_BAN_DELETE, PERMISSION_MESSAGE_MODERATE, PERMISSION_MESSAGE_REMOVE,
+			PERMISSION_USER_READ, PERMISSION_USER_UPDATE, PERMISSION_USER_DELETE, PERMISSION_ROLE_ASSIGN, PERMISSION_AUDIT_READ, PERMISSION_BACKUP_MANAGE},
+		ROLE_OWNER: {PERMISSION_BAN_CREATE, PERMISSION_BAN_READ, PERMISSION_BAN_UPDATE, PERMISSION_BAN_DELETE, PERMISSION_MESSAGE_MODERATE, PERMISSION_MESSAGE_REMOVE,
+			PERMISSION_USER_READ, PERMISSION_USER_UPDATE, PERMISSION_USER_DELETE, PERMISSION_ROLE_ASSIGN, PERMISSION_AUDIT_READ, PERMISSION_BACKUP_MANAGE},
+	}
 	// Auth Token expiration map
-	TOKEN_EXPIRATION_MAP = map[string]int64{
-		ACCESS_TOKEN:  ACCESS_TOKEN_EXPIRATION,
-		REFRESH_TOKEN: REFRESH_TOKEN_EXPIRATION,
+	TOKEN_EXPIRATION_MAP = map[string]time.Duration{
+		ACCESS_TOKEN:             ACCESS_TOKEN_EXPIRATION,
+		REFRESH_TOKEN:            REFRESH_TOKEN_EXPIRATION,
+		PASSWORD_RESET_TOKEN:     PASSWORD_RESET_EXPIRATION,
+		EMAIL_VERIFICATION_TOKEN: EMAIL_VERIFICATION_EXPIRATION,
+		TWO_FACTOR_TOKEN:         TWO_FACTOR_EXPIRATION,
 	}
 )
 
 const (
+	// ==================== SERVER ====================
+	// Default port the server listens on
+	SERVER_PORT = 3000
+	// Default log level
+	LOG_LEVEL = "DEBUG"
+	// Default minimum TLS version
+	TLS_MIN_VERSION = "1.2"
+	// Interval between two checks of the TLS certificate files
+	TLS_RELOAD_INTERVAL = 30 * time.Second
+	// Maximum time given to the server to shut down gracefully
+	SHUTDOWN_TIMEOUT = 15 * time.Second
+	// ==================== DATABASE ====================
+	// Maximum number of open connections in the database pool
+	DB_MAX_OPEN_CONNECTIONS = 10
+	// Maximum number of idle connections kept in the database pool
+	DB_MAX_IDLE_CONNECTIONS = 5
+	// Maximum amount of time a database connection may be reused
+	DB_CONNECTION_MAX_LIFETIME = 1 * time.Hour
+	// Maximum amount of time a database connection may stay idle
+	DB_CONNECTION_MAX_IDLE_TIME = 15 * time.Minute
+	// Time a connection waits for a locked database before failing
+	DB_BUSY_TIMEOUT = 5 * time.Second
+	// Database context key (used to store/retrieve the shared database handle from the context)
+	DATABASE_CONTEXT_KEY contextKey = "database"
+	// Store context key (used to store/retrieve the data stores from the context)
+	STORE_CONTEXT_KEY contextKey = "store"
+	// ==================== BACKUP ====================
+	// Interval between two scheduled backups
+	DB_BACKUP_INTERVAL = 24 * time.Hour
+	// Number of most recent backups always kept
+	DB_BACKUP_KEEP_LAST = 3
+	// Number of days for which the most recent backup of the day is kept
+	DB_BACKUP_KEEP_DAILY = 7
+	// Number of weeks for which the most recent backup of the week is kept
+	DB_BACKUP_KEEP_WEEKLY = 4
+	// ==================== EXPORT ====================
+	// Number of messages above which a user export is built in the background
+	EXPORT_SYNC_MAX_MESSAGES = 1000
+	// Number of messages read at once while building a user export
+	EXPORT_BATCH_SIZE = 500
+	// Time during which a finished user export can be downloaded
+	EXPORT_EXPIRATION = 24 * time.Hour
+	// Interval between two cleanups of the expired user exports
+	EXPORT_CLEANUP_INTERVAL = 1 * time.Hour
+	// ==================== USER DELETION ====================
+	// Time during which a user can cancel the deletion of its account
+	USER_DELETION_GRACE_PERIOD = 7 * 24 * time.Hour
+	// Interval between two runs of the job finalizing the due deletions
+	USER_DELETION_CHECK_INTERVAL = 1 * time.Hour
+	// Deletion modes: delete the messages and the bans of the user, or give them to the deleted user
+	USER_DELETION_DELETE    = "delete"
+	USER_DELETION_ANONYMIZE = "anonymize"
+	// Tombstone identity owning the messages and the bans of the anonymized users
+	// Neither is a valid username or email, so no one can register as the deleted user
+	DELETED_USER_USERNAME = "[deleted]"
+	DELETED_USER_EMAIL    = "[deleted]"
+	// ==================== AUTH ====================
 	// Auth token scheme
 	AUTH_SCHEME = "Bearer"
 	// ==================== ACCESS TOKEN ====================
@@ -42,8 +133,8 @@ const (
 	ACCESS_TOKEN_COOKIE_NAME = "accessToken"
 	// Access token cookie path
 	ACCESS_TOKEN_COOKIE_PATH = "/"
-	// Access token expiration in hours
-	ACCESS_TOKEN_EXPIRATION = 4
+	// Access token default lifetime
+	ACCESS_TOKEN_EXPIRATION = 4 * time.Hour
 	// Access token context key (used to store/retrieve the token from the context)
 	ACCESS_TOKEN_CONTEXT_KEY contextKey = "accessToken"
 	// Refresh token Type constant
@@ -53,14 +144,172 @@ const (
 	REFRESH_TOKEN_COOKIE_NAME = "refreshToken"
 	// Refresh token cookie path
 	REFRESH_TOKEN_COOKIE_PATH = "/api/auth"
-	// Refresh token expiration in hours
-	REFRESH_TOKEN_EXPIRATION = 7 * 24
+	// Refresh token default lifetime
+	REFRESH_TOKEN_EXPIRATION = 7 * 24 * time.Hour
+	// Time during which a replaced refresh token used again is taken for a concurrent refresh of the same client, and gets
+	// the session that replaced it instead of revoking it
+	REFRESH_TOKEN_REUSE_GRACE = 10 * time.Second
 	// User context key (used to store/retrieve the user from the context)
 	USER_CONTEXT_KEY contextKey = "user"
+	// Minimum time between two records of the last use of a session token, unless its client changed
+	SESSION_TOUCH_INTERVAL = time.Minute
+	// Maximum number of tokens issued before the selectors whose bcrypt hash is checked against a legacy bearer, the matched
+	// token is given a selector and leaves the scan
+	LEGACY_TOKENS_SCAN_LIMIT = 5
+	// ==================== CSRF TOKEN ====================
+	// CSRF token cookie name, the cookie is readable by the scripts of the frontend which send its value back in the CSRF header
+	CSRF_TOKEN_COOKIE_NAME = "csrfToken"
+	// CSRF token cookie path
+	CSRF_TOKEN_COOKIE_PATH = "/"
+	// Header carrying the CSRF token on the state-changing requests authenticated with the auth cookies
+	CSRF_TOKEN_HEADER = "X-CSRF-Token"
+	// Size in bytes of the CSRF tokens
+	CSRF_TOKEN_SIZE = 32
+	// Route handing out the CSRF token of the browser
+	CSRF_TOKEN_ROUTE = "/api/auth/csrf"
+	// ==================== SIGNED ACCESS TOKENS ====================
+	// Default lifetime of the signed access tokens, which are checked without the database and only revoked by the deny-list of the instance
+	SIGNED_ACCESS_TOKEN_EXPIRATION = 10 * time.Minute
+	// Default age at which the key signing the access tokens is replaced
+	SIGNING_KEY_ROTATION_INTERVAL = 24 * time.Hour
+	// Interval between two checks of the signing keys: rotation, pruning and reload of the keys rotated by the other instances
+	SIGNING_KEYS_CHECK_INTERVAL = 5 * time.Minute
+	// Signed access token claims context key (used to tell the users rebuilt from the claims from the stored ones)
+	ACCESS_CLAIMS_CONTEXT_KEY contextKey = "accessClaims"
+	// ==================== PASSWORD RESET TOKEN ====================
+	// Password reset token Type constant, the token is sent by mail and can only be used once
+	PASSWORD_RESET_TOKEN = "password_reset"
+	// Password reset token default lifetime
+	PASSWORD_RESET_EXPIRATION = 1 * time.Hour
+	// Path of the frontend page the password reset links point to
+	PASSWORD_RESET_PATH = "/reset-password"
+	// ==================== EMAIL VERIFICATION TOKEN ====================
+	// Email verification token Type constant, the token is sent by mail to the new addresses and can only be used once
+	EMAIL_VERIFICATION_TOKEN = "email_verification"
+	// Email verification token default lifetime
+	EMAIL_VERIFICATION_EXPIRATION = 48 * time.Hour
+	// Path of the frontend page the email verification links point to
+	EMAIL_VERIFICATION_PATH = "/verify-email"
+	// ==================== TWO-FACTOR AUTHENTICATION ====================
+	// Two-factor challenge token Type constant, issued once the password is checked and exchanged for the auth tokens with a code
+	TWO_FACTOR_TOKEN = "two_factor"
+	// Time given to enter the two-factor code after the password
+	TWO_FACTOR_EXPIRATION = 5 * time.Minute
+	// Issuer shown by the authenticator apps
+	TOTP_ISSUER = "JukeBox"
+	// Number of one-time recovery codes generated when two-factor authentication is enabled
+	RECOVERY_CODES_COUNT = 10
+	// ==================== LOGIN THROTTLING ====================
+	// Default failed logins of an account before it is locked out
+	LOGIN_MAX_FAILURES = 5
+	// Default failed logins from an IP address (on any account) before it is locked out
+	LOGIN_MAX_FAILURES_PER_IP = 20
+	// Default delay imposed on an account after its second failed login in a row
+	LOGIN_FAILURE_DELAY = 1 * time.Second
+	// Default time an account or an IP address stays locked out, the failures are forgotten after as long without any
+	LOGIN_LOCKOUT_DURATION = 15 * time.Minute
+	// Default for mailing the users whose session is revoked because one of its old refresh tokens was used again
+	REFRESH_REUSE_NOTIFICATION = true
+	// ==================== OPENID CONNECT ====================
+	// Default name of the OpenID Connect provider, shown on the sign in button
+	OIDC_NAME = "OpenID Connect"
+	// Time given to sign in at the provider before the authorization request expires
+	OIDC_REQUEST_EXPIRATION = 10 * time.Minute
+	// Cookie keeping the state, the nonce and the PKCE code verifier of the authorization request until the callback
+	OIDC_REQUEST_COOKIE_NAME = "oidcRequest"
+	OIDC_REQUEST_COOKIE_PATH = "/api/auth/oidc"
+	// ==================== API TOKENS ====================
+	// Prefix of the API tokens, telling them apart from the identity bearers of the sessions
+	API_TOKEN_PREFIX = "jbpat_"
+	// Maximum length of the name of an API token
+	API_TOKEN_NAME_MAX_LENGTH = 64
+	// Scopes of the API tokens: reading the chat, posting and editing messages, reading and managing the bans
+	SCOPE_MESSAGES_READ  = "messages:read"
+	SCOPE_MESSAGES_WRITE = "messages:write"
+	SCOPE_BANS_READ      = "bans:read"
+	SCOPE_BANS_WRITE     = "bans:write"
+	// API token context key (used to store/retrieve the API token from the context)
+	API_TOKEN_CONTEXT_KEY contextKey = "apiToken"
+	// Scope context key (used to store/retrieve the scope an API token needs to use the route)
+	SCOPE_CONTEXT_KEY contextKey = "scope"
+	// ==================== ROLES ====================
+	ROLE_OWNER     = "owner"
+	ROLE_ADMIN     = "admin"
+	ROLE_MODERATOR = "moderator"
+	ROLE_USER      = "user"
+	// Permissions granted by the roles, named "<resource>.<verb>"
+	PERMISSION_BAN_CREATE       = "ban.create"
+	PERMISSION_BAN_READ         = "ban.read"
+	PERMISSION_BAN_UPDATE       = "ban.update"
+	PERMISSION_BAN_DELETE       = "ban.delete"
+	PERMISSION_MESSAGE_MODERATE = "message.moderate"
+	PERMISSION_MESSAGE_REMOVE   = "message.remove"
+	PERMISSION_USER_READ        = "user.read"
+	PERMISSION_USER_UPDATE      = "user.update"
+	PERMISSION_USER_DELETE      = "user.delete"
+	PERMISSION_ROLE_ASSIGN      = "role.assign"
+	PERMISSION_AUDIT_READ       = "audit.read"
+	PERMISSION_BACKUP_MANAGE    = "backup.manage"
+	// ==================== MAIL ====================
+	// Mail transports: write the mails to the outbox directory (default), or send them through an SMTP server
+	MAIL_TRANSPORT_OUTBOX = "outbox"
+	MAIL_TRANSPORT_SMTP   = "smtp"
+	// Default sender of the mails
+	MAIL_FROM = "JukeBox <jukebox@localhost>"
+	// Default port of the SMTP server (submission, with STARTTLS)
+	SMTP_PORT = 587
+	// Mailer context key (used to store/retrieve the mailer from the context)
+	MAILER_CONTEXT_KEY contextKey = "mailer"
 	// ==================== BAN ====================
 	// Ban Type constant
 	BAN_TYPE  = "ban"
 	MUTE_TYPE = "mute"
+	// ==================== CHAT ====================
+	// Maximum time a chat message waits before the pending messages are sent to the music generator
+	PROMPT_INTERVAL = 30 * time.Second
+	// Number of pending chat messages that triggers a prompt right away
+	PROMPT_THRESHOLD = 10
+	// ==================== SEARCH ====================
+	// Maximum number of search results returned at once
+	SEARCH_MAX_LIMIT = 50
+	// ==================== AUDIT ====================
+	// Maximum number of audit events returned at once
+	AUDIT_MAX_LIMIT = 100
+	// Audited actions, named "<target type>.<verb>"
+	AUDIT_BAN_CREATE     = "ban.create"
+	AUDIT_BAN_UPDATE     = "ban.update"
+	AUDIT_BAN_DELETE     = "ban.delete"
+	AUDIT_MUTE_CREATE    = "mute.create"
+	AUDIT_MUTE_UPDATE    = "mute.update"
+	AUDIT_MUTE_DELETE    = "mute.delete"
+	AUDIT_MESSAGE_UPDATE = "message.update"
+	AUDIT_MESSAGE_DELETE = "message.delete"
+	AUDIT_USER_DELETE    = "user.delete"
+	AUDIT_USER_EXPORT    = "user.export"
+	AUDIT_USER_ANONYMIZE = "user.anonymize"
+	AUDIT_USER_SCHEDULE  = "user.schedule_deletion"
+	AUDIT_USER_CANCEL    = "user.cancel_deletion"
+	AUDIT_USER_PROMOTE   = "user.promote"
+	AUDIT_USER_DEMOTE    = "user.demote"
+	AUDIT_USER_PASSWORD  = "user.reset_password"
+	AUDIT_USER_LOGOUT    = "user.revoke_tokens"
+	AUDIT_USER_SESSION   = "user.revoke_session"
+	AUDIT_USER_VERIFY    = "user.verify_email"
+	AUDIT_USER_2FA_ON    = "user.enable_two_factor"
+	AUDIT_USER_2FA_OFF   = "user.disable_two_factor"
+	AUDIT_USER_LOCK      = "user.lock"
+	AUDIT_USER_UNLOCK    = "user.unlock"
+	AUDIT_IP_UNLOCK      = "ip.unlock"
+	AUDIT_USER_REUSE     = "user.refresh_token_reuse"
+	AUDIT_TOKEN_CREATE   = "api_token.create"
+	AUDIT_TOKEN_REVOKE   = "api_token.revoke"
+	AUDIT_BACKUP_CREATE  = "backup.create"
+	AUDIT_BACKUP_RESTORE = "backup.restore"
+	AUDIT_TARGET_USER    = "user"
+	AUDIT_TARGET_MESSAGE = "message"
+	AUDIT_TARGET_BACKUP  = "backup"
+	AUDIT_TARGET_TOKEN   = "api_token"
+	AUDIT_TARGET_IP      = "ip"
 	// ==================== REQUESTS PARAMETERS ====================
 	ID_PARAMETER               = "id"
 	USERNAME_PARAMETER         = "username"
@@ -69,7 +318,7 @@ const (
 	EMAIL_PARAMETER            = "email"
 	PASSWORD_PARAMETER         = "password"
 	SUBSCRIBER_TIER_PARAMETER  = "subscriber_tier"
-	ADMIN_PARAMETER            = "admin"
+	ROLE_PARAMETER             = "role"
 	REASON_PARAMETER           = "reason"
 	AVATAR_PARAMETER           = "avatar"
 	TARGET_ID_PARAMETER        = "target_id"
@@ -86,6 +335,28 @@ const (
 	LIMIT_PARAMETER            = "limit"
 	PAGE_PARAMETER             = "page"
 	OFFSET_PARAMETER           = "offset"
+	NAME_PARAMETER             = "name"
+	QUERY_PARAMETER            = "q"
+	ACTOR_ID_PARAMETER         = "actor_id"
+	ACTION_PARAMETER           = "action"
+	TARGET_TYPE_PARAMETER      = "target_type"
+	REQUEST_ID_PARAMETER       = "request_id"
+	SINCE_PARAMETER            = "since"
+	UNTIL_PARAMETER            = "until"
+	EXPORT_ID_PARAMETER        = "export_id"
+	TOKEN_PARAMETER            = "token"
+	MODE_PARAMETER             = "mode"
+	IMMEDIATE_PARAMETER        = "immediate"
+	CODE_PARAMETER             = "code"
+	CHALLENGE_PARAMETER        = "challenge"
+	SESSION_ID_PARAMETER       = "session_id"
+	TOKEN_ID_PARAMETER         = "token_id"
+	IP_PARAMETER               = "ip"
+	SCOPES_PARAMETER           = "scopes"
+	EXPIRES_IN_PARAMETER       = "expires_in"
+	STATE_PARAMETER            = "state"
+	ERROR_PARAMETER            = "error"
+	OIDC_ERROR_PARAMETER       = "oidc_error"
 )
 
 func init() {
@@ -95,3 +366,39 @@ func init() {
 		os.Exit(1)
 	}
 }
+
+// SetJukeboxPath moves the Jukebox directory, and every directory inside of it, to jukebox_path
+func SetJukeboxPath(jukebox_path string) error {
+	err := os.MkdirAll(jukebox_path, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	JUKEBOX_PATH = jukebox_path
+	IMAGES_DIR = path.Join(JUKEBOX_PATH, "images")
+	AVATARS_DIR = path.Join(IMAGES_DIR, "avatars")
+	DB_DIR = path.Join(JUKEBOX_PATH, "db")
+	DB_FILE = path.Join(DB_DIR, "jukebox.db")
+	DB_BACKUP_DIR = path.Join(DB_DIR, "backup")
+	EXPORTS_DIR = path.Join(JUKEBOX_PATH, "exports")
+	LOG_DIR = path.Join(JUKEBOX_PATH, "logs")
+	PROMPTS_FILE = path.Join(JUKEBOX_PATH, "prompts.json")
+	return nil
+}
+
+// SetTokenExpirations sets the lifetime of the access, refresh, password reset and email verification tokens
+func SetTokenExpirations(access_expiration time.Duration, refresh_expiration time.Duration, reset_expiration time.Duration, verification_expiration time.Duration) {
+	TOKEN_EXPIRATION_MAP[ACCESS_TOKEN] = access_expiration
+	TOKEN_EXPIRATION_MAP[REFRESH_TOKEN] = refresh_expiration
+	TOKEN_EXPIRATION_MAP[PASSWORD_RESET_TOKEN] = reset_expiration
+	TOKEN_EXPIRATION_MAP[EMAIL_VERIFICATION_TOKEN] = verification_expiration
+}
+
+// SetLoginThrottling sets the failed logins before the lockout of an account and of an IP address, the delay imposed on the
+// accounts that keep failing and the duration of the lockouts
+func SetLoginThrottling(max_failures int, max_failures_per_ip int, delay time.Duration, lockout time.Duration) {
+	LOGIN_LOCKOUT_THRESHOLD = max_failures
+	LOGIN_IP_LOCKOUT_THRESHOLD = max_failures_per_ip
+	LOGIN_DELAY = delay
+	LOGIN_LOCKOUT = lockout
+}
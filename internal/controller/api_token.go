@@ -0,0 +1,118 @@
+package db_controller
+
+import (
+	"slices"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	"github.com/boxboxjason/jukebox/internal/middlewares"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
+	"github.com/boxboxjason/jukebox/pkg/utils/cryptutils"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+)
+
+// API_TOKEN_SCOPES lists the scopes an API token may carry
+var API_TOKEN_SCOPES = []string{constants.SCOPE_MESSAGES_READ, constants.SCOPE_MESSAGES_WRITE, constants.SCOPE_BANS_READ, constants.SCOPE_BANS_WRITE}
+
+// ================= Create =================
+
+// CreateAPIToken creates an API token of the user with the scopes, expiring after expires_in if it is not zero
+// Returns the token along with its raw value, which is only known at creation
+func CreateAPIToken(store *db_model.Store, audit *AuditContext, user *db_model.User, name string, scopes []string, expires_in time.Duration) (*db_model.APIToken, string, error) {
+	// Check the fields
+	if name == "" || len(name) > constants.API_TOKEN_NAME_MAX_LENGTH {
+		return nil, "", httputils.NewBadRequestError("Invalid fields: name")
+	}
+	if expires_in < 0 {
+		return nil, "", httputils.NewBadRequestError("Invalid fields: expires_in")
+	}
+	scopes, err := validateAPITokenScopes(user, scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	if IsDeletedUser(user) {
+		return nil, "", httputils.NewForbiddenError("the deleted user can not create API tokens")
+	}
+
+	// Generate the token
+	selector, verifier, hashed_verifier, err := cryptutils.GenerateSplitToken()
+	if err != nil {
+		return nil, "", err
+	}
+	api_token := &db_model.APIToken{
+		Selector:     &selector,
+		UserID:       user.ID,
+		Name:         name,
+		Hashed_Token: hashed_verifier,
+		Scopes:       scopes,
+	}
+	if expires_in > 0 {
+		expires_at := time.Now().Add(expires_in)
+		api_token.ExpiresAt = &expires_at
+	}
+	err = store.APITokens.Create(api_token)
+	if err != nil {
+		logger.Error("Unable to create the API token of user", user.ID, err)
+		return nil, "", httputils.NewDatabaseError("unable to create the API token")
+	}
+
+	logger.Info("API token", api_token.ID, "created for user", user.Username)
+	recordAuditEvents(store, newAuditEvent(audit, constants.AUDIT_TOKEN_CREATE, constants.AUDIT_TARGET_TOKEN, api_token.ID, nil, api_token, audit.Reason))
+	return api_token, middlewares.EncodeAPIToken(selector, verifier), nil
+}
+
+// validateAPITokenScopes checks that the scopes are known and that the user may grant them, and drops the duplicates
+// Reading the bans requires the ban.read permission, managing them the ban.create permission
+func validateAPITokenScopes(user *db_model.User, scopes []string) ([]string, error) {
+	valid_scopes := []string{}
+	for _, scope := range scopes {
+		if !slices.Contains(API_TOKEN_SCOPES, scope) {
+			return nil, httputils.NewBadRequestError("Invalid scope: " + scope)
+		}
+		if scope == constants.SCOPE_BANS_READ && !user.HasPermission(constants.PERMISSION_BAN_READ) {
+			return nil, httputils.NewForbiddenError("Only the users with the " + constants.PERMISSION_BAN_READ + " permission can grant the " + scope + " scope")
+		} else if scope == constants.SCOPE_BANS_WRITE && !user.HasPermission(constants.PERMISSION_BAN_CREATE) {
+			return nil, httputils.NewForbiddenError("Only the users with the " + constants.PERMISSION_BAN_CREATE + " permission can grant the " + scope + " scope")
+		}
+		if !slices.Contains(valid_scopes, scope) {
+			valid_scopes = append(valid_scopes, scope)
+		}
+	}
+	if len(valid_scopes) == 0 {
+		return nil, httputils.NewBadRequestError("Invalid fields: scopes")
+	}
+	return valid_scopes, nil
+}
+
+// ================= Read =================
+
+// ListAPITokens lists the API tokens of the user, oldest first
+func ListAPITokens(store *db_model.Store, user *db_model.User) ([]*db_model.APIToken, error) {
+	api_tokens, err := store.APITokens.ListUserAPITokens(user.ID)
+	if err != nil {
+		logger.Error("Unable to list the API tokens of user", user.ID, err)
+		return nil, httputils.NewDatabaseError("unable to list the API tokens")
+	}
+	return api_tokens, nil
+}
+
+// ================= Delete =================
+
+// RevokeAPIToken deletes an API token of the user
+func RevokeAPIToken(store *db_model.Store, audit *AuditContext, user *db_model.User, api_token_id int) error {
+	api_token, err := store.APITokens.GetByID(api_token_id)
+	if err != nil || api_token.UserID != user.ID {
+		return httputils.NewNotFoundError("API token not found")
+	}
+
+	err = store.APITokens.Delete(api_token)
+	if err != nil {
+		logger.Error("Unable to delete the API token", api_token.ID, err)
+		return httputils.NewDatabaseError("unable to revoke the API token")
+	}
+
+	logger.Info("API token", api_token.ID, "of user", user.Username, "revoked")
+	recordAuditEvents(store, newAuditEvent(audit, constants.AUDIT_TOKEN_REVOKE, constants.AUDIT_TARGET_TOKEN, api_token.ID, api_token, nil, audit.Reason))
+	return nil
+}
@@ -0,0 +1,95 @@
+package db_controller
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	"github.com/boxboxjason/jukebox/internal/middlewares"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/utils/cryptutils"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+)
+
+func TestAPITokens(t *testing.T) {
+	store, admin, user := createAuditTestUsers(t)
+	audit := &AuditContext{Actor: user, IP: "192.0.2.1"}
+
+	// The scopes are validated, and only the moderators can grant the bans scopes
+	invalid := []struct {
+		user   *db_model.User
+		name   string
+		scopes []string
+		status int
+	}{
+		{user, "bot", []string{}, http.StatusBadRequest},
+		{user, "bot", []string{"messages:delete"}, http.StatusBadRequest},
+		{user, "", []string{constants.SCOPE_MESSAGES_READ}, http.StatusBadRequest},
+		{user, strings.Repeat("a", constants.API_TOKEN_NAME_MAX_LENGTH+1), []string{constants.SCOPE_MESSAGES_READ}, http.StatusBadRequest},
+		{user, "bot", []string{constants.SCOPE_BANS_READ}, http.StatusForbidden},
+		{user, "bot", []string{constants.SCOPE_BANS_WRITE}, http.StatusForbidden},
+	}
+	for _, test := range invalid {
+		_, _, err := CreateAPIToken(store, audit, test.user, test.name, test.scopes, 0)
+		var http_error httputils.HTTPError
+		if !errors.As(err, &http_error) || http_error.StatusCode() != test.status {
+			t.Errorf("Error creating API token %q with scopes %v: expected status %d, got %v", test.name, test.scopes, test.status, err)
+		}
+	}
+
+	// The raw token is only returned at creation, the hash of its verifier is stored
+	api_token, raw_token, err := CreateAPIToken(store, audit, user, "bot", []string{constants.SCOPE_MESSAGES_READ, constants.SCOPE_MESSAGES_READ, constants.SCOPE_MESSAGES_WRITE}, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating API token: %v", err)
+	}
+	if len(api_token.Scopes) != 2 || api_token.ExpiresAt == nil || api_token.IsExpired() {
+		t.Errorf("Error creating API token: unexpected token %+v", api_token)
+	}
+	selector, verifier, err := middlewares.DecodeAPIToken(raw_token)
+	if err != nil || api_token.Selector == nil || *api_token.Selector != selector || !cryptutils.CompareHashAndVerifier(api_token.Hashed_Token, verifier) {
+		t.Errorf("Error creating API token: the token %q does not match its hash (%v)", raw_token, err)
+	}
+	moderation_token, _, err := CreateAPIToken(store, &AuditContext{Actor: admin}, admin, "moderation", []string{constants.SCOPE_BANS_WRITE}, 0)
+	if err != nil {
+		t.Fatalf("Error creating admin API token: %v", err)
+	}
+	if !moderation_token.HasScope(constants.SCOPE_BANS_READ) || moderation_token.HasScope(constants.SCOPE_MESSAGES_READ) {
+		t.Errorf("Error creating admin API token: expected bans:write to cover bans:read only, got %v", moderation_token.Scopes)
+	}
+	audit_token, _, err := CreateAPIToken(store, &AuditContext{Actor: admin}, admin, "audit", []string{constants.SCOPE_BANS_READ}, 0)
+	if err != nil {
+		t.Fatalf("Error creating admin API token: %v", err)
+	}
+	if audit_token.HasScope(constants.SCOPE_BANS_WRITE) {
+		t.Errorf("Error creating admin API token: expected bans:read not to cover bans:write")
+	}
+
+	api_tokens, err := ListAPITokens(store, user)
+	if err != nil || len(api_tokens) != 1 || api_tokens[0].ID != api_token.ID {
+		t.Errorf("Error listing API tokens: expected the bot token, got %v (%v)", api_tokens, err)
+	}
+
+	// A token is only revoked by its owner
+	admin_tokens, _ := ListAPITokens(store, admin)
+	err = RevokeAPIToken(store, audit, user, admin_tokens[0].ID)
+	if err == nil {
+		t.Errorf("Error revoking API token: the token of another user was revoked")
+	}
+	err = RevokeAPIToken(store, audit, user, api_token.ID)
+	if err != nil {
+		t.Fatalf("Error revoking API token: %v", err)
+	}
+	api_tokens, _ = ListAPITokens(store, user)
+	if len(api_tokens) != 0 {
+		t.Errorf("Error revoking API token: %d tokens left", len(api_tokens))
+	}
+
+	// The creation and the revocation are audited
+	events, err := GetAuditEvents(store, &db_model.AuditGetRequestParams{TargetType: []string{constants.AUDIT_TARGET_TOKEN}, TargetID: []int{api_token.ID}})
+	if err != nil || len(events) != 2 {
+		t.Errorf("Error auditing API tokens: expected 2 events, got %d (%v)", len(events), err)
+	}
+}
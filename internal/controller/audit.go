@@ -0,0 +1,104 @@
+package db_controller
+
+import (
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+)
+
+// AuditContext describes who performs a privileged action and from where, it is recorded along with the action
+// Reason is the optional justification given by the actor, used when the action has no reason of its own
+type AuditContext struct {
+	Actor     *db_model.User
+	IP        string
+	RequestID string
+	Reason    string
+}
+
+// ================= Create =================
+
+// newAuditEvent builds the audit event of an action performed in the audit context
+// The snapshots are taken when the event is built, before and after can be nil
+func newAuditEvent(audit *AuditContext, action string, target_type string, target_id int, before any, after any, reason string) *db_model.AuditEvent {
+	event := &db_model.AuditEvent{
+		Action:     action,
+		TargetType: target_type,
+		TargetID:   target_id,
+		Reason:     reason,
+		IP:         audit.IP,
+		RequestID:  audit.RequestID,
+	}
+	if audit.Actor != nil {
+		event.ActorID = audit.Actor.ID
+		event.ActorUsername = audit.Actor.Username
+	}
+
+	var err error
+	event.Before, err = db_model.NewAuditSnapshot(before)
+	if err != nil {
+		logger.Error("Unable to snapshot the audited record", err)
+	}
+	event.After, err = db_model.NewAuditSnapshot(after)
+	if err != nil {
+		logger.Error("Unable to snapshot the audited record", err)
+	}
+	return event
+}
+
+// recordAuditEvents stores the audit events of an action that already happened
+// The action can not be rolled back anymore, so a failure is logged instead of being returned
+func recordAuditEvents(store *db_model.Store, events ...*db_model.AuditEvent) {
+	err := store.Audit.CreateMany(events)
+	if err != nil {
+		logger.Critical("Unable to record", len(events), "audit events", err)
+	}
+}
+
+// RecordAuditEvent records a privileged action that is not performed through the data stores (backups)
+func RecordAuditEvent(store *db_model.Store, audit *AuditContext, action string, target_type string, target_id int, before any, after any) {
+	recordAuditEvents(store, newAuditEvent(audit, action, target_type, target_id, before, after, audit.Reason))
+}
+
+// banAuditAction returns the audited action on a ban depending on its type (ban or mute)
+func banAuditAction(ban *db_model.Ban, ban_action string, mute_action string) string {
+	if ban.Type == constants.MUTE_TYPE {
+		return mute_action
+	}
+	return ban_action
+}
+
+// ================= Read =================
+
+// GetAuditEvents retrieves the audit events matching the filters, most recent first unless another order is given
+func GetAuditEvents(store *db_model.Store, query_params *db_model.AuditGetRequestParams) ([]*db_model.AuditEvent, error) {
+	// Sanity checks
+	for _, id := range query_params.ActorID {
+		if id < 0 {
+			return nil, httputils.NewBadRequestError("actor_id must be a positive integer")
+		}
+	}
+	for _, id := range query_params.TargetID {
+		if id < 0 {
+			return nil, httputils.NewBadRequestError("target_id must be a positive integer")
+		}
+	}
+	if !query_params.Since.IsZero() && !query_params.Until.IsZero() && query_params.Until.Before(query_params.Since) {
+		return nil, httputils.NewBadRequestError("until must be after since")
+	}
+
+	// The audit log is always paginated, most recent first by default
+	if query_params.Limit <= 0 || query_params.Limit > constants.AUDIT_MAX_LIMIT {
+		query_params.Limit = constants.AUDIT_MAX_LIMIT
+	}
+	if query_params.Order == "" {
+		query_params.Order = "created_at desc, id desc"
+	}
+
+	events, err := store.Audit.List(query_params)
+	if err != nil {
+		logger.Error("Unable to retrieve the audit events", err)
+		return nil, httputils.NewDatabaseError("unable to retrieve the audit events")
+	}
+	return events, nil
+}
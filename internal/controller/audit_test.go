@@ -0,0 +1,128 @@
+package db_controller
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+)
+
+// createAuditTestUsers creates an admin and a regular user, both with a verified email, in a fresh in-memory store
+func createAuditTestUsers(t *testing.T) (*db_model.Store, *db_model.User, *db_model.User) {
+	store := db_model.NewMemoryStore()
+	admin, err := CreateUser(store, &db_model.UsersPostRequestParams{Username: "test_admin", Email: "test_admin@test.com", Password: "password"})
+	if err == nil {
+		err = setUserEmailVerified(store, admin)
+	}
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	admin.Role = constants.ROLE_ADMIN
+	user, err := CreateUser(store, &db_model.UsersPostRequestParams{Username: "test_user", Email: "test_user@test.com", Password: "password"})
+	if err == nil {
+		err = setUserEmailVerified(store, user)
+	}
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	return store, admin, user
+}
+
+func TestBanLifecycleIsAudited(t *testing.T) {
+	store, admin, user := createAuditTestUsers(t)
+	audit := &AuditContext{Actor: admin, IP: "192.0.2.1", RequestID: "request-1"}
+
+	bans, err := BanUsers(store, audit, &db_model.BansPostRequestParams{Issuer: admin, Target: []*db_model.User{user}, Type: constants.MUTE_TYPE, Duration: 60, Reason: "Spam"})
+	if err != nil {
+		t.Fatalf("Error banning user: %v", err)
+	}
+	_, err = UpdateBan(store, audit, &db_model.BansPatchRequestParams{ID: bans[0].ID, Duration: 120, Reason: "More spam"})
+	if err != nil {
+		t.Fatalf("Error updating ban: %v", err)
+	}
+	err = DeleteBan(store, audit, bans[0].ID)
+	if err != nil {
+		t.Fatalf("Error deleting ban: %v", err)
+	}
+
+	events, err := GetAuditEvents(store, &db_model.AuditGetRequestParams{TargetType: []string{constants.AUDIT_TARGET_USER}, TargetID: []int{user.ID}})
+	if err != nil {
+		t.Fatalf("Error retrieving audit events: %v", err)
+	}
+	expected_actions := []string{constants.AUDIT_MUTE_DELETE, constants.AUDIT_MUTE_UPDATE, constants.AUDIT_MUTE_CREATE}
+	if len(events) != len(expected_actions) {
+		t.Fatalf("Error auditing bans: expected %d events, got %d", len(expected_actions), len(events))
+	}
+	for i, event := range events {
+		if event.Action != expected_actions[i] {
+			t.Errorf("Error auditing bans: expected action %s, got %s", expected_actions[i], event.Action)
+		}
+		if event.ActorID != admin.ID || event.ActorUsername != admin.Username || event.IP != "192.0.2.1" || event.RequestID != "request-1" {
+			t.Errorf("Error auditing bans: actor, IP or request ID not recorded: %+v", event)
+		}
+	}
+
+	// The update keeps both snapshots
+	before := &db_model.Ban{}
+	after := &db_model.Ban{}
+	if json.Unmarshal([]byte(events[1].Before), before) != nil || json.Unmarshal([]byte(events[1].After), after) != nil {
+		t.Fatalf("Error auditing ban update: invalid snapshots")
+	}
+	if before.Reason != "Spam" || after.Reason != "More spam" || events[1].Reason != "More spam" {
+		t.Errorf("Error auditing ban update: expected reason Spam then More spam, got %s then %s", before.Reason, after.Reason)
+	}
+	if events[0].After != "" {
+		t.Errorf("Error auditing ban deletion: unexpected after snapshot")
+	}
+}
+
+func TestMessageModerationIsAudited(t *testing.T) {
+	store, admin, user := createAuditTestUsers(t)
+
+	message, err := CreateMessage(store, &db_model.MessagesPostRequestParams{Sender: user, Message: "Hello"})
+	if err != nil {
+		t.Fatalf("Error creating message: %v", err)
+	}
+
+	// The sender editing their own message is not a privileged action
+	err = UpdateExistingMessage(store, &AuditContext{Actor: user}, message, &db_model.MessagesPatchRequestParams{Message: "Hello there"})
+	if err != nil {
+		t.Fatalf("Error updating message: %v", err)
+	}
+	// Censoring it is
+	err = UpdateExistingMessage(store, &AuditContext{Actor: admin, Reason: "Rude"}, message, &db_model.MessagesPatchRequestParams{Censored: []bool{true}})
+	if err != nil {
+		t.Fatalf("Error updating message: %v", err)
+	}
+	err = DeleteMessage(store, &AuditContext{Actor: admin}, message.ID)
+	if err != nil {
+		t.Fatalf("Error deleting message: %v", err)
+	}
+
+	events, err := GetAuditEvents(store, &db_model.AuditGetRequestParams{TargetType: []string{constants.AUDIT_TARGET_MESSAGE}})
+	if err != nil {
+		t.Fatalf("Error retrieving audit events: %v", err)
+	}
+	if len(events) != 2 || events[0].Action != constants.AUDIT_MESSAGE_DELETE || events[1].Action != constants.AUDIT_MESSAGE_UPDATE {
+		t.Fatalf("Error auditing messages: expected a deletion and an update, got %d events", len(events))
+	}
+	if events[1].Reason != "Rude" || events[1].TargetID != message.ID {
+		t.Errorf("Error auditing message update: reason or target not recorded: %+v", events[1])
+	}
+}
+
+func TestGetAuditEventsValidation(t *testing.T) {
+	store := db_model.NewMemoryStore()
+
+	_, err := GetAuditEvents(store, &db_model.AuditGetRequestParams{ActorID: []int{-1}})
+	if err == nil {
+		t.Errorf("Error retrieving audit events: negative actor ID accepted")
+	}
+
+	query_params := &db_model.AuditGetRequestParams{Limit: 1000}
+	_, err = GetAuditEvents(store, query_params)
+	if err != nil || query_params.Limit != constants.AUDIT_MAX_LIMIT {
+		t.Errorf("Error retrieving audit events: limit not capped (%d, %v)", query_params.Limit, err)
+	}
+}
@@ -1,73 +1,158 @@
 package db_controller
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
 	"github.com/boxboxjason/jukebox/internal/constants"
 	"github.com/boxboxjason/jukebox/internal/middlewares"
 	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
 	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+	"github.com/boxboxjason/jukebox/pkg/utils/mailutils"
 )
 
 // LoginUserFromPassword logs in a user by checking the validity of the input fields
 // And the correctness of the username and password
-func LoginUserFromPassword(username_or_email string, password string) (int, string, string, string, error) {
-	// Open db connection
-	db, err := db_model.OpenConnection()
+// The attempts are throttled by account and by IP address, every failure delays the next attempt until the lockout
+func LoginUserFromPassword(store *db_model.Store, client *ClientContext, username_or_email string, password string) (int, string, string, string, error) {
+	// Refuse the addresses locked out before looking the user up
+	now := time.Now()
+	err := checkLoginThrottling(client, nil, now)
 	if err != nil {
 		return -1, "", "", "", err
 	}
-	defer db_model.CloseConnection(db)
 
 	// Retrieve the user (if it exists)
-	user, err := db_model.GetUserByUsernameOREmail(db, username_or_email)
+	user, err := store.Users.GetByUsernameOrEmail(username_or_email)
 	if err != nil {
+		recordLoginFailure(store, client, nil, now)
 		return -1, "", "", "", httputils.NewUnauthorizedError("Invalid credentials combination")
 	}
+	err = checkLoginThrottling(nil, user, now)
+	if err != nil {
+		return -1, "", "", "", err
+	}
 
 	// Check if the password matches
 	if !user.CheckPasswordMatches(password) {
+		recordLoginFailure(store, client, user, now)
 		return -1, "", "", "", httputils.NewUnauthorizedError("Invalid credentials combination")
 	}
 
+	// The concurrent attempts checked the password meanwhile, their failures may have locked the account out since
+	stored_user, err := store.Users.GetByID(user.ID)
+	if err != nil {
+		return -1, "", "", "", httputils.NewUnauthorizedError("Invalid credentials combination")
+	}
+	err = checkLoginThrottling(nil, stored_user, time.Now())
+	if err != nil {
+		return -1, "", "", "", err
+	}
+
+	return LoginUser(store, client, stored_user)
+}
+
+// LoginUser logs in a user whose first factor (password or external identity) is checked
+// The users with two-factor authentication receive a challenge to send back with their code instead of the tokens
+func LoginUser(store *db_model.Store, client *ClientContext, user *db_model.User) (int, string, string, string, error) {
+	if user.TOTPEnabled {
+		_, challenge, err := newUserToken(store, nil, user, constants.TWO_FACTOR_TOKEN)
+		if err != nil {
+			return -1, "", "", "", err
+		}
+		return -1, "", "", "", &TwoFactorRequiredError{Challenge: challenge}
+	}
+
 	// Generate the user's auth token
-	access_token, refresh_token, err := GenerateUserAuthTokens(db, user)
+	access_token, refresh_token, err := GenerateUserAuthTokens(store, client, user)
 	if err != nil {
 		return -1, "", "", "", err
 	}
+	recordLoginSuccess(store, user)
 
 	return user.ID, user.Username, access_token, refresh_token, nil
 }
 
-// LoginFromToken logs in a user by checking the validity of the token
-// Refreshing the access token if it is valid and returning the new access token
-// Returns the user id, username, and the new access token
-func LoginFromToken(user_id int, token_string string) (int, string, string, string, error) {
-	// Open db connection
-	db, err := db_model.OpenConnection()
+// LoginUserFromTwoFactor completes the login of a user with two-factor authentication, from the challenge
+// issued by LoginUserFromPassword and a code of its authenticator or a recovery code
+// The challenge is consumed by the first attempt, so that every guess of the code requires the password
+func LoginUserFromTwoFactor(store *db_model.Store, client *ClientContext, challenge string, code string) (int, string, string, string, error) {
+	token, err := matchLinkToken(store, challenge, constants.TWO_FACTOR_TOKEN)
+	if err != nil {
+		return -1, "", "", "", httputils.NewUnauthorizedError("Invalid or expired two-factor challenge")
+	}
+	err = store.Tokens.Delete(token)
+	if err != nil {
+		logger.Error("Unable to consume the two-factor challenge of user", token.User.ID, err)
+		return -1, "", "", "", httputils.NewDatabaseError("unable to consume the two-factor challenge")
+	}
+
+	// Check the code
+	user := token.User
+	if !user.TOTPEnabled {
+		return -1, "", "", "", httputils.NewUnauthorizedError("Invalid or expired two-factor challenge")
+	}
+	ok, err := verifyTwoFactorCode(store, user, code)
 	if err != nil {
 		return -1, "", "", "", err
+	} else if !ok {
+		// The invalid codes count as failed logins, or the codes could be guessed with the password
+		logger.Info("Invalid two-factor code for user", user.Username)
+		recordLoginFailure(store, client, user, time.Now())
+		return -1, "", "", "", httputils.NewUnauthorizedError("Invalid two-factor code")
 	}
-	defer db_model.CloseConnection(db)
 
-	// Retrieve the user
-	user, err := db_model.GetUserByID(db.Preload("AuthToken"), user_id)
+	// Generate the user's auth token
+	access_token, refresh_token, err := GenerateUserAuthTokens(store, client, user)
 	if err != nil {
-		return -1, "", "", "", httputils.NewUnauthorizedError("Invalid token")
+		return -1, "", "", "", err
 	}
+	recordLoginSuccess(store, user)
 
+	return user.ID, user.Username, access_token, refresh_token, nil
+}
+
+// LoginFromToken logs in a user by checking the validity of the token
+// Refreshing the access token if it is valid and returning the new access token
+// Returns the user id, username, and the new access token
+func LoginFromToken(store *db_model.Store, client *ClientContext, identity_bearer string) (int, string, string, string, error) {
 	// Check if the token matches
-	access_token, err := user.CheckAuthTokenMatchesByType(db, token_string, constants.ACCESS_TOKEN)
+	access_token, err := middlewares.MatchAccessBearer(store, identity_bearer)
 	if err != nil {
 		return -1, "", "", "", err
 	}
+	user := access_token.User
+	if user == nil {
+		return -1, "", "", "", httputils.NewUnauthorizedError("Invalid token")
+	}
 
 	// Refresh the access token
-	access_token_string, err := RefreshToken(db, access_token)
+	access_token_string, err := RefreshToken(store, access_token)
 	if err != nil {
 		return -1, "", "", "", err
 	}
+	touchSessionToken(store, client, access_token)
 
-	// Generate a refresh token
-	_, refresh_token_string, err := createUserToken(db, user, constants.REFRESH_TOKEN)
+	// Replace the refresh token of the session, or generate one
+	var refresh_token_string string
+	refresh_token, err := store.Tokens.GetLinkedToken(access_token)
+	if err == nil {
+		refresh_token.User = user
+		refresh_token, refresh_token_string, err = rotateRefreshToken(store, client, refresh_token)
+	} else {
+		refresh_token, refresh_token_string, err = newUserToken(store, client, user, constants.REFRESH_TOKEN)
+	}
+	if err != nil {
+		return -1, "", "", "", err
+	}
+	err = linkSessionTokens(store, access_token, refresh_token)
+	if err != nil {
+		return -1, "", "", "", err
+	}
+	access_token_string, err = issueAccessBearer(store, access_token, user, access_token_string)
 	if err != nil {
 		return -1, "", "", "", err
 	}
@@ -75,55 +160,274 @@ func LoginFromToken(user_id int, token_string string) (int, string, string, stri
 	return user.ID, user.Username, access_token_string, refresh_token_string, nil
 }
 
-// RefreshTokens refreshes the access token and the refresh token
+// RefreshTokens replaces the refresh token by a new one of its session family, and refreshes the access token
+// Using a replaced refresh token again revokes the whole session family past a short grace period, see refreshRotatedToken
 // Returns the user id, username, access token and refresh token
-func RefreshTokens(identity_bearer string) (int, string, string, string, error) {
-	// Check if the identity bearer is valid
-	user_id, token_string, err := middlewares.DecodeIdentityBearerToUserAndToken(identity_bearer)
+func RefreshTokens(store *db_model.Store, mailer mailutils.Mailer, client *ClientContext, identity_bearer string) (int, string, string, string, error) {
+	// Check if the token matches
+	refresh_token, err := middlewares.MatchIdentityBearer(store, identity_bearer, constants.REFRESH_TOKEN)
 	if err != nil {
 		return -1, "", "", "", err
 	}
+	user := refresh_token.User
+	if user == nil {
+		return -1, "", "", "", httputils.NewUnauthorizedError("Invalid token")
+	}
 
-	// Open db connection
-	db, err := db_model.OpenConnection()
+	// A replaced refresh token was used again
+	if refresh_token.IsRotated() {
+		return refreshRotatedToken(store, mailer, client, refresh_token)
+	}
+
+	// Retrieve the linked access token before the refresh token is replaced
+	access_token, access_err := store.Tokens.GetLinkedToken(refresh_token)
+
+	// Replace the refresh token, unless a concurrent refresh did first
+	rotated_token := refresh_token
+	new_refresh_token, refresh_token_string, err := rotateRefreshToken(store, client, refresh_token)
 	if err != nil {
 		return -1, "", "", "", err
 	}
-	defer db_model.CloseConnection(db)
+	if new_refresh_token == nil {
+		rotated_token, err = store.Tokens.GetByID(rotated_token.ID)
+		if err != nil || !rotated_token.IsRotated() {
+			return -1, "", "", "", httputils.NewUnauthorizedError("Invalid token")
+		}
+		rotated_token.User = user
+		return refreshRotatedToken(store, mailer, client, rotated_token)
+	}
+	refresh_token = new_refresh_token
+	touchSessionToken(store, client, refresh_token)
 
-	// Retrieve the user
-	user, err := db_model.GetUserByID(db, user_id)
+	// Refresh the linked access token if it exists OR create it
+	var access_token_string string
+	if access_err == nil {
+		access_token.User = user
+		access_token_string, err = RefreshToken(store, access_token)
+	} else {
+		access_token, access_token_string, err = newUserToken(store, client, user, constants.ACCESS_TOKEN)
+	}
 	if err != nil {
-		return -1, "", "", "", httputils.NewUnauthorizedError("Invalid token")
+		return -1, "", "", "", err
 	}
-
-	// Check if the token matches
-	refresh_token, err := user.CheckAuthTokenMatchesByType(db, token_string, constants.REFRESH_TOKEN)
+	err = linkSessionTokens(store, access_token, refresh_token)
 	if err != nil {
 		return -1, "", "", "", err
 	}
-
-	// Update the refresh token
-	refresh_token_string, err := RefreshToken(db, refresh_token)
+	access_token_string, err = issueAccessBearer(store, access_token, user, access_token_string)
 	if err != nil {
 		return -1, "", "", "", err
 	}
 
-	// Retrieve the linked access token if it exists OR create it
-	var access_token_string string
-	access_token, err := refresh_token.GetLinkedToken(db)
+	rememberRotatedSession(rotated_token, &rotatedSession{user_id: user.ID, username: user.Username, access_bearer: access_token_string, refresh_bearer: refresh_token_string})
+	return user.ID, user.Username, access_token_string, refresh_token_string, nil
+}
+
+// refreshRotatedToken answers the use of a replaced refresh token
+// During the reuse grace period, it is taken for a concurrent refresh of the same client, which gets the session that replaced
+// the token, or is told to retry if it is not known yet. Past it, the session may have been stolen and is revoked
+func refreshRotatedToken(store *db_model.Store, mailer mailutils.Mailer, client *ClientContext, refresh_token *db_model.AuthToken) (int, string, string, string, error) {
+	if time.Since(*refresh_token.RotatedAt) < constants.REFRESH_TOKEN_REUSE_GRACE {
+		session, found := getRotatedSession(refresh_token)
+		if !found {
+			return -1, "", "", "", httputils.NewUnauthorizedError("Refresh token already used, retry with the new one")
+		}
+		return session.user_id, session.username, session.access_bearer, session.refresh_bearer, nil
+	}
+
+	revokeReusedSession(store, mailer, client, refresh_token)
+	return -1, "", "", "", httputils.NewUnauthorizedError("Refresh token already used, the session was revoked")
+}
+
+// ================= Password reset =================
+
+// RequestPasswordReset mails a single-use password reset link to the user owning the email, if there is one
+// The outcome is the same whether the email is registered or not, so that the registered emails can not be guessed
+// Requesting a new link invalidates the previous ones
+func RequestPasswordReset(store *db_model.Store, mailer mailutils.Mailer, email string) error {
+	user, err := store.Users.GetByEmail(email)
+	if err != nil || IsDeletedUser(user) {
+		return nil
+	}
+
+	err = deleteUserTokensOfType(store, user.ID, constants.PASSWORD_RESET_TOKEN)
+	if err != nil {
+		return err
+	}
+	_, link_token, err := newUserToken(store, nil, user, constants.PASSWORD_RESET_TOKEN)
+	if err != nil {
+		return err
+	}
+
+	link := newMailLink(constants.PASSWORD_RESET_PATH, link_token)
+	err = mailer.Send(&mailutils.Mail{
+		To:      user.Email,
+		Subject: "Reset your JukeBox password",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"Someone asked to reset the password of your JukeBox account.\n"+
+			"Open the link below within %d minutes to choose a new password, it can only be used once:\n\n"+
+			"%s\n\n"+
+			"If you did not ask for it, ignore this mail: your password is unchanged.\n",
+			user.Username, int(constants.TOKEN_EXPIRATION_MAP[constants.PASSWORD_RESET_TOKEN].Minutes()), link),
+	})
+	if err != nil {
+		logger.Error("Unable to send the password reset mail to user", user.ID, err)
+		return err
+	}
+
+	logger.Info("Password reset link sent to user", user.Username)
+	return nil
+}
+
+// ConfirmPasswordReset sets the password of the user the reset token was sent to
+// The token is consumed along with every other token of the user, so that every session has to log in again
+func ConfirmPasswordReset(store *db_model.Store, link_token string, password string) error {
+	token, err := matchLinkToken(store, link_token, constants.PASSWORD_RESET_TOKEN)
+	if err != nil {
+		return httputils.NewBadRequestError("Invalid or expired password reset token")
+	}
+
+	// The token stays valid until the new password is accepted
+	return setUserPassword(store, token.User, password)
+}
+
+// ================= Email verification =================
+
+// SendEmailVerification mails a single-use verification link to the email of the user
+// Sending a new link invalidates the previous ones
+func SendEmailVerification(store *db_model.Store, mailer mailutils.Mailer, user *db_model.User) error {
+	if user.VerifiedEmail {
+		return httputils.NewConflictError("the email of the user is already verified")
+	}
+	if IsDeletedUser(user) {
+		return httputils.NewForbiddenError("the deleted user has no email to verify")
+	}
+
+	err := deleteUserTokensOfType(store, user.ID, constants.EMAIL_VERIFICATION_TOKEN)
+	if err != nil {
+		return err
+	}
+	_, link_token, err := newUserToken(store, nil, user, constants.EMAIL_VERIFICATION_TOKEN)
+	if err != nil {
+		return err
+	}
+
+	link := newMailLink(constants.EMAIL_VERIFICATION_PATH, link_token)
+	err = mailer.Send(&mailutils.Mail{
+		To:      user.Email,
+		Subject: "Verify your JukeBox email address",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"Open the link below within %d hours to verify the email address of your JukeBox account,\n"+
+			"you can post in the chat once it is verified:\n\n"+
+			"%s\n\n"+
+			"If you did not sign up to JukeBox, ignore this mail.\n",
+			user.Username, int(constants.TOKEN_EXPIRATION_MAP[constants.EMAIL_VERIFICATION_TOKEN].Hours()), link),
+	})
+	if err != nil {
+		logger.Error("Unable to send the email verification mail to user", user.ID, err)
+		return err
+	}
+
+	logger.Info("Email verification link sent to user", user.Username)
+	return nil
+}
+
+// ConfirmEmailVerification verifies the email of the user the verification token was sent to, and consumes the token
+func ConfirmEmailVerification(store *db_model.Store, link_token string) (*db_model.User, error) {
+	token, err := matchLinkToken(store, link_token, constants.EMAIL_VERIFICATION_TOKEN)
+	if err != nil {
+		return nil, httputils.NewBadRequestError("Invalid or expired email verification token")
+	}
+
+	user := token.User
+	err = setUserEmailVerified(store, user)
 	if err != nil {
-		access_token, access_token_string, err = createUserToken(db, refresh_token.User, constants.ACCESS_TOKEN)
+		return nil, err
+	}
+	logger.Info("Email of user", user.Username, "verified")
+	return user, nil
+}
+
+// VerifyUserEmail marks the email of a user as verified without any mail, for the admins
+func VerifyUserEmail(store *db_model.Store, audit *AuditContext, user *db_model.User) error {
+	if user.VerifiedEmail {
+		return nil
+	}
+	if IsDeletedUser(user) {
+		return httputils.NewForbiddenError("the deleted user has no email to verify")
+	}
+	err := checkSelfOrOutranks(audit, user)
+	if err != nil {
+		return err
+	}
+
+	err = setUserEmailVerified(store, user)
+	if err != nil {
+		return err
+	}
+	logger.Info("Email of user", user.Username, "verified by an admin")
+	recordAuditEvents(store, newAuditEvent(audit, constants.AUDIT_USER_VERIFY, constants.AUDIT_TARGET_USER, user.ID, nil, nil, audit.Reason))
+	return nil
+}
+
+// setUserEmailVerified marks the email of the user as verified and deletes its pending verification links
+func setUserEmailVerified(store *db_model.Store, user *db_model.User) error {
+	user.VerifiedEmail = true
+	err := store.Users.Update(user)
+	if err != nil {
+		logger.Error("Unable to verify the email of user", user.ID, err)
+		return httputils.NewDatabaseError("unable to verify the email")
+	}
+	middlewares.DenyUserAccessTokens(user.ID)
+	return deleteUserTokensOfType(store, user.ID, constants.EMAIL_VERIFICATION_TOKEN)
+}
+
+// ================= Mail links =================
+
+// newMailLink returns the link to the frontend page at path, carrying a single-use token of the user
+func newMailLink(path string, link_token string) string {
+	return constants.PUBLIC_URL + path + "?" + url.Values{constants.TOKEN_PARAMETER: {link_token}}.Encode()
+}
+
+// matchLinkToken retrieves the unexpired token of the given type carried by a mail link
+// An expired token is deleted on the way
+func matchLinkToken(store *db_model.Store, link_token string, token_type string) (*db_model.AuthToken, error) {
+	selector, verifier, err := middlewares.DecodeIdentityBearer(link_token)
+	if err != nil {
+		return nil, err
+	}
+	token, err := store.Tokens.MatchToken(selector, verifier, token_type)
+	if err != nil {
+		return nil, err
+	}
+	if token.User == nil {
+		return nil, errors.New("token without user")
+	}
+	if token.IsExpired() {
+		err = store.Tokens.Delete(token)
 		if err != nil {
-			return -1, "", "", "", err
+			logger.Error("Unable to delete the expired", token_type, "token of user", token.UserID, err)
 		}
-		refresh_token.LinkedToken = access_token
-	} else {
-		access_token_string, err = RefreshToken(db, access_token)
+		return nil, errors.New("expired token")
+	}
+	return token, nil
+}
+
+// deleteUserTokensOfType deletes the tokens of a user that have the given type
+func deleteUserTokensOfType(store *db_model.Store, user_id int, token_type string) error {
+	tokens, err := store.Tokens.ListUserTokens(user_id)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if token.Type != token_type {
+			continue
+		}
+		err = store.Tokens.Delete(token)
 		if err != nil {
-			return -1, "", "", "", err
+			logger.Error("Unable to delete the", token_type, "token of user", user_id, err)
+			return err
 		}
 	}
-
-	return user.ID, user.Username, access_token_string, refresh_token_string, nil
+	return nil
 }
@@ -0,0 +1,450 @@
+package db_controller
+
+import (
+	"encoding/base64"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	"github.com/boxboxjason/jukebox/internal/middlewares"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/utils/cryptutils"
+	"github.com/boxboxjason/jukebox/pkg/utils/jwtutils"
+	"github.com/boxboxjason/jukebox/pkg/utils/mailutils"
+)
+
+// recordingMailer keeps the sent mails instead of sending them
+type recordingMailer struct {
+	mails []*mailutils.Mail
+}
+
+func (mailer *recordingMailer) Send(mail *mailutils.Mail) error {
+	mailer.mails = append(mailer.mails, mail)
+	return nil
+}
+
+// tokenFromMail extracts the token of the link to path of a mail
+func tokenFromMail(t *testing.T, mail *mailutils.Mail, path string) string {
+	link := regexp.MustCompile(`https?://\S+`).FindString(mail.Body)
+	parsed_link, err := url.Parse(link)
+	if err != nil || parsed_link.Path != path {
+		t.Fatalf("Error reading mail: no link to %s in %q", path, mail.Body)
+	}
+	return parsed_link.Query().Get(constants.TOKEN_PARAMETER)
+}
+
+func TestPasswordReset(t *testing.T) {
+	store, _, user := createAuditTestUsers(t)
+	mailer := &recordingMailer{}
+	_, _, err := GenerateUserAuthTokens(store, nil, user)
+	if err != nil {
+		t.Fatalf("Error generating tokens: %v", err)
+	}
+
+	// Unknown emails are silently ignored
+	err = RequestPasswordReset(store, mailer, "unknown@test.com")
+	if err != nil || len(mailer.mails) != 0 {
+		t.Fatalf("Error requesting password reset: expected no mail and no error, got %d mails (%v)", len(mailer.mails), err)
+	}
+
+	// Only the latest link is valid
+	for range 2 {
+		err = RequestPasswordReset(store, mailer, user.Email)
+		if err != nil {
+			t.Fatalf("Error requesting password reset: %v", err)
+		}
+	}
+	if len(mailer.mails) != 2 || mailer.mails[1].To != user.Email {
+		t.Fatalf("Error requesting password reset: expected 2 mails to %s, got %d", user.Email, len(mailer.mails))
+	}
+	old_token, token := tokenFromMail(t, mailer.mails[0], constants.PASSWORD_RESET_PATH), tokenFromMail(t, mailer.mails[1], constants.PASSWORD_RESET_PATH)
+	err = ConfirmPasswordReset(store, old_token, "new_password")
+	if err == nil {
+		t.Errorf("Error confirming password reset: superseded token accepted")
+	}
+
+	// An invalid password does not consume the token
+	err = ConfirmPasswordReset(store, token, "short")
+	if err == nil {
+		t.Errorf("Error confirming password reset: invalid password accepted")
+	}
+	err = ConfirmPasswordReset(store, token, "new_password")
+	if err != nil {
+		t.Fatalf("Error confirming password reset: %v", err)
+	}
+
+	// The token is single-use and every session is revoked
+	err = ConfirmPasswordReset(store, token, "other_password")
+	if err == nil {
+		t.Errorf("Error confirming password reset: token used twice")
+	}
+	tokens, err := store.Tokens.ListUserTokens(user.ID)
+	if err != nil || len(tokens) != 0 {
+		t.Errorf("Error confirming password reset: expected every token to be revoked, got %d (%v)", len(tokens), err)
+	}
+	_, _, _, _, err = LoginUserFromPassword(store, nil, user.Username, "new_password")
+	if err != nil {
+		t.Errorf("Error confirming password reset: new password refused: %v", err)
+	}
+}
+
+func TestPasswordResetExpiration(t *testing.T) {
+	store, _, user := createAuditTestUsers(t)
+	mailer := &recordingMailer{}
+
+	expiration := constants.TOKEN_EXPIRATION_MAP[constants.PASSWORD_RESET_TOKEN]
+	constants.TOKEN_EXPIRATION_MAP[constants.PASSWORD_RESET_TOKEN] = -time.Hour
+	defer func() { constants.TOKEN_EXPIRATION_MAP[constants.PASSWORD_RESET_TOKEN] = expiration }()
+
+	err := RequestPasswordReset(store, mailer, user.Email)
+	if err != nil || len(mailer.mails) != 1 {
+		t.Fatalf("Error requesting password reset: %v", err)
+	}
+	err = ConfirmPasswordReset(store, tokenFromMail(t, mailer.mails[0], constants.PASSWORD_RESET_PATH), "new_password")
+	if err == nil {
+		t.Errorf("Error confirming password reset: expired token accepted")
+	}
+	err = ConfirmPasswordReset(store, "1.invalid%%", "new_password")
+	if err == nil {
+		t.Errorf("Error confirming password reset: malformed token accepted")
+	}
+}
+
+// endReuseGrace moves the rotation of the replaced refresh tokens of the user before the reuse grace period
+func endReuseGrace(t *testing.T, store *db_model.Store, user *db_model.User) {
+	tokens, err := store.Tokens.ListUserTokens(user.ID)
+	if err != nil {
+		t.Fatalf("Error listing tokens: %v", err)
+	}
+	rotated_at := time.Now().Add(-2 * constants.REFRESH_TOKEN_REUSE_GRACE)
+	for _, token := range tokens {
+		if token.IsRotated() {
+			token.RotatedAt = &rotated_at
+			err = store.Tokens.Update(token)
+			if err != nil {
+				t.Fatalf("Error updating token: %v", err)
+			}
+		}
+	}
+}
+
+func TestRefreshTokensMigratesLegacySession(t *testing.T) {
+	store, _, user := createAuditTestUsers(t)
+
+	// A session opened before the selectors, its bearers encode the user ID and the raw token
+	raw_tokens := map[string]string{}
+	session_tokens := map[string]*db_model.AuthToken{}
+	for _, token_type := range []string{constants.ACCESS_TOKEN, constants.REFRESH_TOKEN} {
+		raw_token, hashed_token, err := cryptutils.GenerateHashedToken()
+		if err != nil {
+			t.Fatalf("Error generating token: %v", err)
+		}
+		token := &db_model.AuthToken{User: user, Hashed_Token: hashed_token, Type: token_type, Expiration: calculateExpirationTime(token_type)}
+		err = store.Tokens.Create(token)
+		if err != nil {
+			t.Fatalf("Error creating token: %v", err)
+		}
+		raw_tokens[token_type], session_tokens[token_type] = raw_token, token
+	}
+	err := linkSessionTokens(store, session_tokens[constants.ACCESS_TOKEN], session_tokens[constants.REFRESH_TOKEN])
+	if err != nil {
+		t.Fatalf("Error linking tokens: %v", err)
+	}
+	legacy_bearer := base64.StdEncoding.EncodeToString([]byte(strconv.Itoa(user.ID) + ":" + raw_tokens[constants.REFRESH_TOKEN]))
+
+	// Refreshing the session moves its live tokens to the selectors, the legacy refresh token is rotated
+	_, _, access_bearer, refresh_bearer, err := RefreshTokens(store, nil, nil, legacy_bearer)
+	if err != nil {
+		t.Fatalf("Error refreshing legacy session: %v", err)
+	}
+	tokens, err := store.Tokens.ListUserTokens(user.ID)
+	if err != nil || len(tokens) != 3 || tokens[0].Selector == nil || !tokens[1].IsRotated() || tokens[2].Selector == nil {
+		t.Errorf("Error refreshing legacy session: expected the rotated token and 2 tokens with a selector, got %+v (%v)", tokens, err)
+	}
+	access_token, err := middlewares.MatchIdentityBearer(store, access_bearer, constants.ACCESS_TOKEN)
+	if err != nil || access_token.ID != session_tokens[constants.ACCESS_TOKEN].ID {
+		t.Errorf("Error matching the refreshed access token: %v", err)
+	}
+	_, _, _, _, err = RefreshTokens(store, nil, nil, refresh_bearer)
+	if err != nil {
+		t.Errorf("Error refreshing migrated session: %v", err)
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	store, _, user := createAuditTestUsers(t)
+	mailer := &recordingMailer{}
+	client := &ClientContext{IP: "192.0.2.1", UserAgent: "curl/8.0"}
+	_, other_refresh_bearer, err := GenerateUserAuthTokens(store, nil, user)
+	if err != nil {
+		t.Fatalf("Error generating tokens: %v", err)
+	}
+	_, refresh_bearer, err := GenerateUserAuthTokens(store, nil, user)
+	if err != nil {
+		t.Fatalf("Error generating tokens: %v", err)
+	}
+
+	// Every refresh replaces the refresh token, in the same session
+	sessions, _ := ListUserSessions(store, user, nil)
+	_, _, new_access_bearer, _, err := RefreshTokens(store, mailer, client, refresh_bearer)
+	if err != nil {
+		t.Fatalf("Error refreshing tokens: %v", err)
+	}
+	_, _, new_access_bearer, _, err = LoginFromToken(store, client, new_access_bearer)
+	if err != nil {
+		t.Fatalf("Error logging in from token: %v", err)
+	}
+	refreshed_sessions, _ := ListUserSessions(store, user, nil)
+	if len(sessions) != 2 || len(refreshed_sessions) != 2 || refreshed_sessions[1].ID != sessions[1].ID {
+		t.Errorf("Error refreshing tokens: expected the same 2 sessions, got %+v then %+v", sessions, refreshed_sessions)
+	}
+	if len(mailer.mails) != 0 {
+		t.Errorf("Error refreshing tokens: expected no mail, got %d", len(mailer.mails))
+	}
+
+	// The reuse of a replaced refresh token revokes its session, and only its session
+	endReuseGrace(t, store, user)
+	_, _, _, _, err = RefreshTokens(store, mailer, client, refresh_bearer)
+	if err == nil {
+		t.Errorf("Error refreshing tokens: replaced refresh token accepted")
+	}
+	_, err = middlewares.MatchIdentityBearer(store, new_access_bearer, constants.ACCESS_TOKEN)
+	if err == nil {
+		t.Errorf("Error revoking the session: access token still valid")
+	}
+	sessions, _ = ListUserSessions(store, user, nil)
+	if len(sessions) != 1 {
+		t.Errorf("Error revoking the session: expected 1 session left, got %d", len(sessions))
+	}
+	_, _, _, _, err = RefreshTokens(store, mailer, client, other_refresh_bearer)
+	if err != nil {
+		t.Errorf("Error refreshing the other session: %v", err)
+	}
+
+	// The reuse is audited and the user is warned
+	events, err := store.Audit.List(&db_model.AuditGetRequestParams{Action: []string{constants.AUDIT_USER_REUSE}})
+	if err != nil || len(events) != 1 || events[0].TargetID != user.ID || events[0].IP != client.IP {
+		t.Errorf("Error auditing the reuse: got %+v (%v)", events, err)
+	}
+	if len(mailer.mails) != 1 || mailer.mails[0].To != user.Email {
+		t.Errorf("Error warning the user: expected 1 mail to %s, got %d", user.Email, len(mailer.mails))
+	}
+}
+
+func TestRefreshTokenReuseGrace(t *testing.T) {
+	store, _, user := createAuditTestUsers(t)
+	mailer := &recordingMailer{}
+	_, refresh_bearer, err := GenerateUserAuthTokens(store, nil, user)
+	if err != nil {
+		t.Fatalf("Error generating tokens: %v", err)
+	}
+
+	// The concurrent refreshes with the same token rotate it once, and all get the same session
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	new_refresh_bearers := map[string]int{}
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _, new_refresh_bearer, err := RefreshTokens(store, mailer, nil, refresh_bearer)
+			if err == nil {
+				mutex.Lock()
+				new_refresh_bearers[new_refresh_bearer]++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(new_refresh_bearers) != 1 {
+		t.Fatalf("Error refreshing tokens concurrently: expected a single new refresh token, got %d", len(new_refresh_bearers))
+	}
+	tokens, _ := store.Tokens.ListUserTokens(user.ID)
+	if len(tokens) != 3 {
+		t.Errorf("Error refreshing tokens concurrently: expected the rotated token and 2 tokens of the session, got %d", len(tokens))
+	}
+
+	// Within the grace period, the replaced token gets the same session instead of revoking it
+	var new_refresh_bearer string
+	for bearer := range new_refresh_bearers {
+		new_refresh_bearer = bearer
+	}
+	_, _, _, reused_refresh_bearer, err := RefreshTokens(store, mailer, nil, refresh_bearer)
+	if err != nil || reused_refresh_bearer != new_refresh_bearer {
+		t.Errorf("Error reusing the replaced refresh token within the grace period: %v", err)
+	}
+	events, err := store.Audit.List(&db_model.AuditGetRequestParams{Action: []string{constants.AUDIT_USER_REUSE}})
+	if err != nil || len(events) != 0 || len(mailer.mails) != 0 {
+		t.Errorf("Error reusing the replaced refresh token within the grace period: session revoked, got %+v (%v)", events, err)
+	}
+	_, _, _, _, err = RefreshTokens(store, mailer, nil, new_refresh_bearer)
+	if err != nil {
+		t.Errorf("Error refreshing with the new refresh token: %v", err)
+	}
+
+	// Past the grace period, the reuse revokes the session
+	endReuseGrace(t, store, user)
+	_, _, _, _, err = RefreshTokens(store, mailer, nil, refresh_bearer)
+	if err == nil {
+		t.Errorf("Error reusing the replaced refresh token past the grace period: token accepted")
+	}
+	sessions, _ := ListUserSessions(store, user, nil)
+	if len(sessions) != 0 {
+		t.Errorf("Error reusing the replaced refresh token past the grace period: expected the session revoked, got %d sessions", len(sessions))
+	}
+}
+
+func TestSignedAccessTokens(t *testing.T) {
+	store, admin, user := createAuditTestUsers(t)
+	client := &ClientContext{IP: "192.0.2.1", UserAgent: "curl/8.0"}
+	ring, err := jwtutils.LoadKeyRing(t.TempDir())
+	if err == nil {
+		_, err = ring.Rotate(time.Now())
+	}
+	if err != nil {
+		t.Fatalf("Error creating the signing keys: %v", err)
+	}
+	middlewares.SetupSignedAccessTokens(ring)
+	t.Cleanup(func() { middlewares.SetupSignedAccessTokens(nil) })
+
+	// The access bearer is a signed token of the stored access token of the session
+	_, _, access_bearer, refresh_bearer, err := LoginUserFromPassword(store, client, user.Username, "password")
+	if err != nil {
+		t.Fatalf("Error logging in: %v", err)
+	}
+	claims := &middlewares.AccessClaims{}
+	err = ring.Verify(access_bearer, claims)
+	if err != nil || claims.Subject != strconv.Itoa(user.ID) || claims.SessionID == 0 || claims.Role != user.Role || !claims.VerifiedEmail {
+		t.Fatalf("Error logging in: expected a signed access token, got %+v (%v)", claims, err)
+	}
+	access_token, err := middlewares.MatchAccessBearer(store, access_bearer)
+	if err != nil || access_token.ID != claims.TokenID {
+		t.Errorf("Error matching the signed access token: %v", err)
+	}
+
+	// A refresh replaces the signed token, the replaced one is denied
+	time.Sleep(2 * time.Millisecond)
+	_, _, new_access_bearer, _, err := RefreshTokens(store, nil, client, refresh_bearer)
+	if err != nil {
+		t.Fatalf("Error refreshing tokens: %v", err)
+	}
+	_, err = middlewares.MatchAccessBearer(store, access_bearer)
+	if err == nil {
+		t.Errorf("Error refreshing tokens: replaced signed token still valid")
+	}
+	_, err = middlewares.MatchAccessBearer(store, new_access_bearer)
+	if err != nil {
+		t.Errorf("Error refreshing tokens: new signed token refused: %v", err)
+	}
+
+	// A ban denies the signed tokens issued before it, the next ones carry it
+	time.Sleep(2 * time.Millisecond)
+	_, err = BanUsers(store, &AuditContext{Actor: admin}, &db_model.BansPostRequestParams{Issuer: admin, Target: []*db_model.User{user}, Type: constants.BAN_TYPE, Duration: 60, Reason: "Spam"})
+	if err != nil {
+		t.Fatalf("Error banning user: %v", err)
+	}
+	_, err = middlewares.MatchAccessBearer(store, new_access_bearer)
+	if err == nil {
+		t.Errorf("Error banning user: signed token issued before the ban still valid")
+	}
+	new_access_bearer, _, err = GenerateUserAuthTokens(store, client, user)
+	if err != nil {
+		t.Fatalf("Error generating tokens: %v", err)
+	}
+	claims = &middlewares.AccessClaims{}
+	err = ring.Verify(new_access_bearer, claims)
+	if err != nil || claims.BannedUntil <= time.Now().Unix() || claims.BanReason != "Spam" {
+		t.Errorf("Error issuing the signed token of a banned user: got %+v (%v)", claims, err)
+	}
+
+	// Logging out denies the signed token of the session
+	access_token, err = middlewares.MatchAccessBearer(store, new_access_bearer)
+	if err != nil {
+		t.Fatalf("Error matching the signed access token: %v", err)
+	}
+	err = DeleteToken(store, access_token)
+	if err != nil {
+		t.Fatalf("Error logging out: %v", err)
+	}
+	_, err = middlewares.MatchAccessBearer(store, new_access_bearer)
+	if err == nil {
+		t.Errorf("Error logging out: signed token still valid")
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	store := db_model.NewMemoryStore()
+	mailer := &recordingMailer{}
+	user, err := CreateUser(store, &db_model.UsersPostRequestParams{Username: "test_user", Email: "test_user@test.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	// Unverified users can not post
+	_, err = CreateMessage(store, &db_model.MessagesPostRequestParams{Sender: user, Message: "Hello"})
+	if err == nil {
+		t.Errorf("Error creating message: unverified user allowed to post")
+	}
+
+	err = SendEmailVerification(store, mailer, user)
+	if err != nil || len(mailer.mails) != 1 || mailer.mails[0].To != user.Email {
+		t.Fatalf("Error sending email verification: %v", err)
+	}
+	token := tokenFromMail(t, mailer.mails[0], constants.EMAIL_VERIFICATION_PATH)
+	verified_user, err := ConfirmEmailVerification(store, token)
+	if err != nil || !verified_user.VerifiedEmail {
+		t.Fatalf("Error confirming email verification: %v", err)
+	}
+	_, err = ConfirmEmailVerification(store, token)
+	if err == nil {
+		t.Errorf("Error confirming email verification: token used twice")
+	}
+	_, err = CreateMessage(store, &db_model.MessagesPostRequestParams{Sender: verified_user, Message: "Hello"})
+	if err != nil {
+		t.Errorf("Error creating message: %v", err)
+	}
+
+	// A new email has to be verified again, the links sent to the previous one are invalidated
+	err = SendEmailVerification(store, mailer, verified_user)
+	if err == nil {
+		t.Errorf("Error sending email verification: verified email accepted")
+	}
+	verified_user.VerifiedEmail = false
+	err = SendEmailVerification(store, mailer, verified_user)
+	if err != nil {
+		t.Fatalf("Error sending email verification: %v", err)
+	}
+	updated_user, err := UpdateUser(store, verified_user, &db_model.UsersRawPatchRequestParams{Email: "new_email@test.com"})
+	if err != nil || updated_user.VerifiedEmail {
+		t.Fatalf("Error updating user: expected the new email to be unverified (%v)", err)
+	}
+	_, err = ConfirmEmailVerification(store, tokenFromMail(t, mailer.mails[1], constants.EMAIL_VERIFICATION_PATH))
+	if err == nil {
+		t.Errorf("Error confirming email verification: link of the previous email accepted")
+	}
+}
+
+func TestVerifyUserEmailIsAudited(t *testing.T) {
+	store, admin, _ := createAuditTestUsers(t)
+	user, err := CreateUser(store, &db_model.UsersPostRequestParams{Username: "other_user", Email: "other_user@test.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	err = VerifyUserEmail(store, &AuditContext{Actor: admin, Reason: "Known user"}, user)
+	if err != nil {
+		t.Fatalf("Error verifying user email: %v", err)
+	}
+	stored_user, err := store.Users.GetByID(user.ID)
+	if err != nil || !stored_user.VerifiedEmail {
+		t.Errorf("Error verifying user email: email not verified (%v)", err)
+	}
+	events, err := GetAuditEvents(store, &db_model.AuditGetRequestParams{Action: []string{constants.AUDIT_USER_VERIFY}})
+	if err != nil || len(events) != 1 || events[0].TargetID != user.ID || events[0].ActorID != admin.ID {
+		t.Errorf("Error auditing email verification: expected one event, got %d (%v)", len(events), err)
+	}
+}
@@ -0,0 +1,325 @@
+package db_controller
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
+	"github.com/boxboxjason/jukebox/pkg/utils/fileutils"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+	"gorm.io/gorm"
+)
+
+const (
+	// Prefix of the backup archives names
+	BACKUP_PREFIX = "jukebox-backup-"
+	// Extension of the backup archives
+	BACKUP_EXTENSION = ".zip"
+	// Time layout of the backup archives names (always UTC)
+	BACKUP_TIME_FORMAT = "20060102T150405.000Z"
+	// Name of the database snapshot inside a backup archive
+	BACKUP_DATABASE_FILE = "jukebox.db"
+)
+
+// Backup is an archive of the database and of the avatars, stored in the backup directory
+type Backup struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BackupRetentionPolicy describes which backups are kept when old backups are pruned
+// A backup is kept if it matches any of the rules
+type BackupRetentionPolicy struct {
+	// Number of most recent backups to keep
+	KeepLast int
+	// Number of days (with at least one backup) for which the most recent backup of the day is kept
+	KeepDaily int
+	// Number of weeks (with at least one backup) for which the most recent backup of the week is kept
+	KeepWeekly int
+}
+
+// backup_mutex serializes the backups and the restores, a restore must never run while a snapshot is taken
+var backup_mutex sync.Mutex
+
+// DefaultBackupRetentionPolicy returns the retention policy built from the constants
+func DefaultBackupRetentionPolicy() *BackupRetentionPolicy {
+	return &BackupRetentionPolicy{
+		KeepLast:   constants.DB_BACKUP_KEEP_LAST,
+		KeepDaily:  constants.DB_BACKUP_KEEP_DAILY,
+		KeepWeekly: constants.DB_BACKUP_KEEP_WEEKLY,
+	}
+}
+
+// ================ Create ================
+
+// CreateBackup takes a consistent snapshot of the live database and archives it together with the avatars
+func CreateBackup(db *gorm.DB) (*Backup, error) {
+	backup_mutex.Lock()
+	defer backup_mutex.Unlock()
+
+	return createBackup(db)
+}
+
+// createBackup creates a backup, the caller must hold backup_mutex
+func createBackup(db *gorm.DB) (*Backup, error) {
+	err := os.MkdirAll(constants.DB_BACKUP_DIR, os.ModePerm)
+	if err != nil {
+		logger.Error("Unable to create the backup directory", err)
+		return nil, httputils.NewInternalServerError("unable to create the backup directory")
+	}
+
+	// Build the archive in a temporary directory, it only appears in the backup directory once complete
+	work_dir, err := os.MkdirTemp(constants.DB_BACKUP_DIR, ".tmp-")
+	if err != nil {
+		logger.Error("Unable to create the backup working directory", err)
+		return nil, httputils.NewInternalServerError("unable to create the backup working directory")
+	}
+	defer os.RemoveAll(work_dir)
+
+	// Snapshot the database
+	snapshot_path := filepath.Join(work_dir, BACKUP_DATABASE_FILE)
+	err = db_model.SnapshotDatabase(db, snapshot_path)
+	if err != nil {
+		if _, ok := err.(httputils.HTTPError); ok {
+			return nil, err
+		}
+		logger.Error("Unable to snapshot the database", err)
+		return nil, httputils.NewDatabaseError("unable to snapshot the database")
+	}
+
+	// Archive the snapshot together with the avatars
+	created_at := time.Now().UTC()
+	name := BACKUP_PREFIX + created_at.Format(BACKUP_TIME_FORMAT) + BACKUP_EXTENSION
+	archive_path := filepath.Join(work_dir, name)
+	err = fileutils.CompressFilesAndDirectories(archive_path, []string{snapshot_path}, []string{constants.AVATARS_DIR})
+	if err != nil {
+		logger.Error("Unable to create the backup archive", err)
+		return nil, httputils.NewInternalServerError("unable to create the backup archive")
+	}
+
+	// Move the complete archive to the backup directory
+	backup_path := filepath.Join(constants.DB_BACKUP_DIR, name)
+	err = os.Rename(archive_path, backup_path)
+	if err != nil {
+		logger.Error("Unable to move the backup archive", err)
+		return nil, httputils.NewInternalServerError("unable to move the backup archive")
+	}
+
+	info, err := os.Stat(backup_path)
+	if err != nil {
+		return nil, httputils.NewInternalServerError("unable to read the backup archive")
+	}
+
+	logger.Info("Created backup", name)
+	return &Backup{Name: name, Size: info.Size(), CreatedAt: created_at}, nil
+}
+
+// ================ Read ================
+
+// ListBackups returns the backups of the backup directory, most recent first
+func ListBackups() ([]*Backup, error) {
+	entries, err := os.ReadDir(constants.DB_BACKUP_DIR)
+	if os.IsNotExist(err) {
+		return []*Backup{}, nil
+	} else if err != nil {
+		logger.Error("Unable to read the backup directory", err)
+		return nil, httputils.NewInternalServerError("unable to read the backup directory")
+	}
+
+	backups := []*Backup{}
+	for _, entry := range entries {
+		created_at, ok := parseBackupName(entry.Name())
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, &Backup{Name: entry.Name(), Size: info.Size(), CreatedAt: created_at})
+	}
+
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+// GetBackupPath returns the path of the backup archive with the given name
+func GetBackupPath(name string) (string, error) {
+	// Only accept names built by createBackup, so that the path cannot escape the backup directory
+	if _, ok := parseBackupName(name); !ok {
+		return "", httputils.NewBadRequestError("invalid backup name")
+	}
+
+	backup_path := filepath.Join(constants.DB_BACKUP_DIR, name)
+	if _, err := os.Stat(backup_path); err != nil {
+		return "", httputils.NewNotFoundError("backup not found")
+	}
+	return backup_path, nil
+}
+
+// parseBackupName returns the creation time encoded in the name of a backup archive
+func parseBackupName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, BACKUP_PREFIX) || !strings.HasSuffix(name, BACKUP_EXTENSION) {
+		return time.Time{}, false
+	}
+	created_at, err := time.Parse(BACKUP_TIME_FORMAT, strings.TrimSuffix(strings.TrimPrefix(name, BACKUP_PREFIX), BACKUP_EXTENSION))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return created_at, true
+}
+
+// ================ Restore ================
+
+// RestoreBackup replaces the live database and the avatars with the content of a backup
+// A backup of the current state is taken first, it is returned so that the restore can be undone
+func RestoreBackup(db *gorm.DB, name string) (*Backup, error) {
+	backup_mutex.Lock()
+	defer backup_mutex.Unlock()
+
+	backup_path, err := GetBackupPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the current state
+	safety_backup, err := createBackup(db)
+	if err != nil {
+		return nil, err
+	}
+
+	// Extract the archive next to the avatars directory, so that it can be swapped with a rename
+	err = os.MkdirAll(constants.IMAGES_DIR, os.ModePerm)
+	if err != nil {
+		return nil, httputils.NewInternalServerError("unable to create the images directory")
+	}
+	work_dir, err := os.MkdirTemp(constants.IMAGES_DIR, ".restore-")
+	if err != nil {
+		logger.Error("Unable to create the restore working directory", err)
+		return nil, httputils.NewInternalServerError("unable to create the restore working directory")
+	}
+	defer os.RemoveAll(work_dir)
+
+	err = fileutils.ExtractArchive(backup_path, work_dir)
+	if err != nil {
+		logger.Error("Unable to extract the backup", name, err)
+		return nil, httputils.NewBadRequestError("unable to extract the backup archive")
+	}
+
+	// Restore the database, then bring it to the schema of this build
+	err = db_model.RestoreDatabase(db, filepath.Join(work_dir, BACKUP_DATABASE_FILE))
+	if err != nil {
+		if _, ok := err.(httputils.HTTPError); ok {
+			return nil, err
+		}
+		logger.Error("Unable to restore the database from", name, err)
+		return nil, httputils.NewDatabaseError("unable to restore the database")
+	}
+	_, err = db_model.MigrateUp(db, 0)
+	if err != nil {
+		logger.Error("Unable to migrate the restored database", err)
+		return nil, httputils.NewDatabaseError("unable to migrate the restored database")
+	}
+
+	// Swap the avatars directory
+	err = swapAvatarsDirectory(filepath.Join(work_dir, filepath.Base(constants.AVATARS_DIR)))
+	if err != nil {
+		logger.Error("Unable to restore the avatars from", name, err)
+		return nil, httputils.NewInternalServerError("the database was restored but the avatars could not be")
+	}
+
+	logger.Info("Restored backup", name, "(previous state saved as", safety_backup.Name+")")
+	return safety_backup, nil
+}
+
+// swapAvatarsDirectory replaces the avatars directory with the restored one (or with an empty directory if there is none)
+func swapAvatarsDirectory(restored_dir string) error {
+	previous_dir := constants.AVATARS_DIR + ".previous"
+	err := os.RemoveAll(previous_dir)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(constants.AVATARS_DIR, previous_dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if _, err = os.Stat(restored_dir); os.IsNotExist(err) {
+		err = os.MkdirAll(constants.AVATARS_DIR, os.ModePerm)
+	} else {
+		err = os.Rename(restored_dir, constants.AVATARS_DIR)
+	}
+	if err != nil {
+		// Put the previous avatars back
+		os.Rename(previous_dir, constants.AVATARS_DIR)
+		return err
+	}
+
+	return os.RemoveAll(previous_dir)
+}
+
+// ================ Delete ================
+
+// ApplyBackupRetention deletes the backups that are not kept by the retention policy
+// Returns the deleted backups
+func ApplyBackupRetention(policy *BackupRetentionPolicy) ([]*Backup, error) {
+	backup_mutex.Lock()
+	defer backup_mutex.Unlock()
+
+	backups, err := ListBackups()
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := []*Backup{}
+	for _, backup := range SelectExpiredBackups(backups, policy) {
+		err = fileutils.DeleteFile(filepath.Join(constants.DB_BACKUP_DIR, backup.Name))
+		if err != nil {
+			logger.Error("Unable to delete the expired backup", backup.Name, err)
+			continue
+		}
+		deleted = append(deleted, backup)
+	}
+	return deleted, nil
+}
+
+// SelectExpiredBackups returns the backups that no rule of the retention policy keeps
+func SelectExpiredBackups(backups []*Backup, policy *BackupRetentionPolicy) []*Backup {
+	sorted := make([]*Backup, len(backups))
+	copy(sorted, backups)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].CreatedAt.After(sorted[j].CreatedAt) })
+
+	seen_days := map[string]bool{}
+	seen_weeks := map[string]bool{}
+	expired := []*Backup{}
+	for i, backup := range sorted {
+		keep := i < policy.KeepLast
+
+		// The first backup met for a day / week is the most recent one of that period
+		day := backup.CreatedAt.UTC().Format("2006-01-02")
+		if !seen_days[day] {
+			seen_days[day] = true
+			keep = keep || len(seen_days) <= policy.KeepDaily
+		}
+		year, week := backup.CreatedAt.UTC().ISOWeek()
+		week_key := strconv.Itoa(year) + "-" + strconv.Itoa(week)
+		if !seen_weeks[week_key] {
+			seen_weeks[week_key] = true
+			keep = keep || len(seen_weeks) <= policy.KeepWeekly
+		}
+
+		if !keep {
+			expired = append(expired, backup)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,63 @@
+package db_controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelectExpiredBackups(t *testing.T) {
+	// One backup every 12 hours over 6 weeks, most recent first
+	now := time.Date(2024, 10, 18, 12, 0, 0, 0, time.UTC)
+	backups := []*Backup{}
+	for i := 0; i < 6*7*2; i++ {
+		backups = append(backups, &Backup{Name: "backup-" + now.Format(time.RFC3339), CreatedAt: now.Add(-time.Duration(i) * 12 * time.Hour)})
+	}
+
+	policy := &BackupRetentionPolicy{KeepLast: 3, KeepDaily: 5, KeepWeekly: 3}
+	expired := SelectExpiredBackups(backups, policy)
+
+	expired_set := map[*Backup]bool{}
+	for _, backup := range expired {
+		expired_set[backup] = true
+	}
+
+	// The 3 most recent backups are kept
+	for _, backup := range backups[:3] {
+		if expired_set[backup] {
+			t.Errorf("Expected backup from %v to be kept (last)", backup.CreatedAt)
+		}
+	}
+
+	// The most recent backup of each of the last 5 days is kept
+	for day := 0; day < 5; day++ {
+		if expired_set[backups[day*2]] {
+			t.Errorf("Expected backup from %v to be kept (daily)", backups[day*2].CreatedAt)
+		}
+	}
+	// The oldest backup of a recent day is not kept by the daily rule
+	if !expired_set[backups[5]] {
+		t.Errorf("Expected backup from %v to be expired", backups[5].CreatedAt)
+	}
+
+	// 3 (last, over 2 days) + 3 more days (daily) + the most recent backups of the 2 previous weeks (weekly)
+	kept := len(backups) - len(expired)
+	if kept != 8 {
+		t.Errorf("Expected 8 kept backups, got %d", kept)
+	}
+}
+
+func TestParseBackupName(t *testing.T) {
+	created_at := time.Date(2024, 10, 18, 12, 30, 15, 123000000, time.UTC)
+	name := BACKUP_PREFIX + created_at.Format(BACKUP_TIME_FORMAT) + BACKUP_EXTENSION
+
+	parsed, ok := parseBackupName(name)
+	if !ok || !parsed.Equal(created_at) {
+		t.Errorf("Expected %v, got %v (%v)", created_at, parsed, ok)
+	}
+
+	for _, invalid_name := range []string{"../jukebox.db", BACKUP_PREFIX + "latest" + BACKUP_EXTENSION, "backup.zip", ""} {
+		if _, ok := parseBackupName(invalid_name); ok {
+			t.Errorf("Expected %q to be rejected", invalid_name)
+		}
+	}
+}
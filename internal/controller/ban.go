@@ -1,16 +1,31 @@
 package db_controller
 
 import (
+	"errors"
 	"time"
 
+	"github.com/boxboxjason/jukebox/internal/constants"
+	"github.com/boxboxjason/jukebox/internal/middlewares"
 	db_model "github.com/boxboxjason/jukebox/internal/model"
-	"gorm.io/gorm"
 )
 
 // ================= CRUD Operations =================
 
 // ================= Create =================
-func BanUsers(db *gorm.DB, query_params *db_model.BansPostRequestParams) ([]*db_model.Ban, error) {
+
+// BanUsers bans (or mutes) the target users, the issuer needs the ban.create permission and a higher role than the targets
+func BanUsers(store *db_model.Store, audit *AuditContext, query_params *db_model.BansPostRequestParams) ([]*db_model.Ban, error) {
+	err := checkPermission(audit, constants.PERMISSION_BAN_CREATE)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range query_params.Target {
+		err = checkOutranks(audit, target)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	bans := make([]*db_model.Ban, len(query_params.Target))
 	for i, target := range query_params.Target {
 		bans[i] = &db_model.Ban{
@@ -21,80 +36,95 @@ func BanUsers(db *gorm.DB, query_params *db_model.BansPostRequestParams) ([]*db_
 			Reason:   query_params.Reason,
 		}
 	}
-	err := db_model.CreateBans(db, bans)
-	return bans, err
-}
+	err = store.Bans.CreateMany(bans)
+	if err != nil {
+		return bans, err
+	}
 
-func GetBans(db *gorm.DB, query_params *db_model.BansGetRequestParams) ([]*db_model.Ban, error) {
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return nil, err
-		}
-		defer db_model.CloseConnection(db)
+	// Record the bans in the audit log, against the banned users
+	events := make([]*db_model.AuditEvent, len(bans))
+	for i, ban := range bans {
+		events[i] = newAuditEvent(audit, banAuditAction(ban, constants.AUDIT_BAN_CREATE, constants.AUDIT_MUTE_CREATE), constants.AUDIT_TARGET_USER, ban.TargetID, nil, ban, ban.Reason)
+		middlewares.DenyUserAccessTokens(ban.TargetID)
 	}
-	return db_model.GetBansByFilters(db, query_params)
+	recordAuditEvents(store, events...)
+	return bans, nil
 }
 
-func GetBanByID(db *gorm.DB, id int) (*db_model.Ban, error) {
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return nil, err
-		}
-		defer db_model.CloseConnection(db)
-	}
-	return db_model.GetBanByID(db, id)
+func GetBans(store *db_model.Store, query_params *db_model.BansGetRequestParams) ([]*db_model.Ban, error) {
+	return store.Bans.List(query_params)
+}
+
+func GetBanByID(store *db_model.Store, id int) (*db_model.Ban, error) {
+	return store.Bans.GetByID(id)
 }
 
 // ================= Update =================
-func UpdateBan(db *gorm.DB, query_params *db_model.BansPatchRequestParams) (*db_model.Ban, error) {
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return nil, err
-		}
-		defer db_model.CloseConnection(db)
+func UpdateBan(store *db_model.Store, audit *AuditContext, query_params *db_model.BansPatchRequestParams) (*db_model.Ban, error) {
+	err := checkPermission(audit, constants.PERMISSION_BAN_UPDATE)
+	if err != nil {
+		return nil, err
 	}
 
-	ban, err := db_model.GetBanByID(db, query_params.ID)
+	ban, err := store.Bans.GetByID(query_params.ID)
 	if err != nil {
 		return nil, err
 	}
+	err = checkOutranksBanTargets(store, audit, []*db_model.Ban{ban})
+	if err != nil {
+		return nil, err
+	}
+	before := *ban
 
 	ban.EndsAt = time.Now().Add(time.Duration(query_params.Duration) * time.Second)
 	ban.Reason = query_params.Reason
 
-	return ban, ban.UpdateBan(db)
+	err = store.Bans.Update(ban)
+	if err != nil {
+		return ban, err
+	}
+	middlewares.DenyUserAccessTokens(ban.TargetID)
+
+	recordAuditEvents(store, newAuditEvent(audit, banAuditAction(ban, constants.AUDIT_BAN_UPDATE, constants.AUDIT_MUTE_UPDATE), constants.AUDIT_TARGET_USER, ban.TargetID, &before, ban, ban.Reason))
+	return ban, nil
 }
 
 // ================= Delete =================
-func DeleteBan(db *gorm.DB, ban_id int) error {
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return err
-		}
-		defer db_model.CloseConnection(db)
+func DeleteBan(store *db_model.Store, audit *AuditContext, ban_id int) error {
+	err := checkPermission(audit, constants.PERMISSION_BAN_DELETE)
+	if err != nil {
+		return err
+	}
+
+	// Deleting a missing ban is not an error, but there is nothing to audit
+	ban, err := store.Bans.GetByID(ban_id)
+	if errors.Is(err, db_model.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = checkOutranksBanTargets(store, audit, []*db_model.Ban{ban})
+	if err != nil {
+		return err
 	}
-	return db_model.DeleteBanById(db, ban_id)
+
+	err = store.Bans.Delete(ban)
+	if err != nil {
+		return err
+	}
+	middlewares.DenyUserAccessTokens(ban.TargetID)
+
+	recordAuditEvents(store, newAuditEvent(audit, banAuditAction(ban, constants.AUDIT_BAN_DELETE, constants.AUDIT_MUTE_DELETE), constants.AUDIT_TARGET_USER, ban.TargetID, ban, nil, audit.Reason))
+	return nil
 }
 
-func DeleteBans(db *gorm.DB, query_params *db_model.BansDeleteRequestParams) error {
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return err
-		}
-		defer db_model.CloseConnection(db)
+func DeleteBans(store *db_model.Store, audit *AuditContext, query_params *db_model.BansDeleteRequestParams) error {
+	err := checkPermission(audit, constants.PERMISSION_BAN_DELETE)
+	if err != nil {
+		return err
 	}
 
-	bans, err := db_model.GetBansByFilters(db, &db_model.BansGetRequestParams{
+	bans, err := store.Bans.List(&db_model.BansGetRequestParams{
 		ID:       query_params.ID,
 		TargetID: query_params.TargetID,
 		IssuerID: query_params.IssuerID,
@@ -104,10 +134,49 @@ func DeleteBans(db *gorm.DB, query_params *db_model.BansDeleteRequestParams) err
 		Page:     query_params.Page,
 		Offset:   query_params.Offset,
 	})
+	if err != nil {
+		return err
+	}
+	err = checkOutranksBanTargets(store, audit, bans)
+	if err != nil {
+		return err
+	}
 
+	err = store.Bans.DeleteMany(bans)
 	if err != nil {
 		return err
 	}
 
-	return db_model.DeleteBans(db, bans)
+	events := make([]*db_model.AuditEvent, len(bans))
+	for i, ban := range bans {
+		events[i] = newAuditEvent(audit, banAuditAction(ban, constants.AUDIT_BAN_DELETE, constants.AUDIT_MUTE_DELETE), constants.AUDIT_TARGET_USER, ban.TargetID, ban, nil, audit.Reason)
+		middlewares.DenyUserAccessTokens(ban.TargetID)
+	}
+	recordAuditEvents(store, events...)
+	return nil
+}
+
+// checkOutranksBanTargets checks that the actor of the audit context is above the targets of the bans in the roles hierarchy,
+// like for issuing them, so that the moderators can not lift the bans of the admins for instance
+func checkOutranksBanTargets(store *db_model.Store, audit *AuditContext, bans []*db_model.Ban) error {
+	if audit == nil || audit.Actor == nil {
+		return nil
+	}
+	targets := map[int]*db_model.User{}
+	for _, ban := range bans {
+		target, found := targets[ban.TargetID]
+		if !found {
+			var err error
+			target, err = store.Users.GetByID(ban.TargetID)
+			if err != nil {
+				return err
+			}
+			targets[ban.TargetID] = target
+		}
+		err := checkOutranks(audit, target)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,588 @@
+package db_controller
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
+	"github.com/boxboxjason/jukebox/pkg/utils/fileutils"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+)
+
+const (
+	// Status of an export being built in the background
+	EXPORT_PENDING = "pending"
+	// Status of an export that can be downloaded
+	EXPORT_READY = "ready"
+	// Status of an export that could not be built
+	EXPORT_FAILED = "failed"
+	// Prefix of the export archives names, as sent to the client
+	EXPORT_PREFIX = "jukebox-export-"
+	// Extension of the export archives
+	EXPORT_EXTENSION = ".zip"
+	// Files of an export archive
+	EXPORT_INDEX_FILE    = "index.txt"
+	EXPORT_PROFILE_FILE  = "profile.json"
+	EXPORT_MESSAGES_FILE = "messages.json"
+	EXPORT_BANS_FILE     = "bans.json"
+	EXPORT_SESSIONS_FILE = "sessions.json"
+	EXPORT_AVATAR_FILE   = "avatar"
+)
+
+// UserExport is an archive of the data of a user, built on request and kept until it expires
+// The exports are not persisted, they are lost (and their archives deleted) when the server restarts
+type UserExport struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"user_id"`
+	Status    string    `json:"status"`
+	FileName  string    `json:"file_name"`
+	Size      int64     `json:"size,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Token is the secret of the download link, only sent to the user who requested the export
+	Token string `json:"-"`
+}
+
+// exportProfile is the profile of a user as written in an export, including the private fields
+type exportProfile struct {
+	ID                 int       `json:"id"`
+	Username           string    `json:"username"`
+	Email              string    `json:"email"`
+	VerifiedEmail      bool      `json:"verified_email"`
+	TwoFactorEnabled   bool      `json:"two_factor_enabled"`
+	Avatar             string    `json:"avatar"`
+	Role               string    `json:"role"`
+	Banned             bool      `json:"banned"`
+	TotalContributions int       `json:"total_contributions"`
+	MinutesListened    int       `json:"minutes_listened"`
+	SubscriberTier     int       `json:"subscriber_tier"`
+	CreatedAt          time.Time `json:"created_at"`
+	ModifiedAt         time.Time `json:"modified_at"`
+}
+
+// exportMessage is a message as written in an export, without its sender
+type exportMessage struct {
+	ID         int       `json:"id"`
+	Content    string    `json:"content"`
+	Flagged    bool      `json:"flagged"`
+	Removed    bool      `json:"removed"`
+	Censored   bool      `json:"censored"`
+	CreatedAt  time.Time `json:"created_at"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+// exportSession is an active session as written in an export, without its token hash
+type exportSession struct {
+	ID         int        `json:"id"`
+	Type       string     `json:"type"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+}
+
+var (
+	// exports holds the known exports by ID, guarded by export_mutex
+	exports      = map[string]*UserExport{}
+	export_mutex sync.Mutex
+	// export_sync_max_messages is the number of messages above which the export is built in the background (overridden by the tests)
+	export_sync_max_messages = constants.EXPORT_SYNC_MAX_MESSAGES
+)
+
+// ================= Create =================
+
+// ExportUser starts an export of the data of a user, requested by the actor of the audit context
+// The users export themselves, the actors with the user.read permission the users below them in the roles hierarchy
+// Small accounts are exported right away, larger ones in the background: the returned export is then pending
+// A pending export of the user is returned instead of starting a new one
+func ExportUser(store *db_model.Store, audit *AuditContext, user_id int) (*UserExport, error) {
+	// Check if the actor has permission to export the user
+	requester := audit.Actor
+	if requester == nil || (requester.ID != user_id && !requester.HasPermission(constants.PERMISSION_USER_READ)) {
+		return nil, httputils.NewForbiddenError("user does not have permission to export user")
+	}
+
+	user, err := GetUser(store, user_id)
+	if err != nil {
+		return nil, err
+	}
+	err = checkSelfOrOutranks(audit, user)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only count the messages up to the threshold to choose between a synchronous and a background export
+	messages, err := store.Messages.List(&db_model.MessagesGetRequestParams{SenderID: []int{user.ID}, Limit: export_sync_max_messages + 1})
+	if err != nil {
+		logger.Error("Unable to count the messages of user", user.ID, err)
+		return nil, httputils.NewDatabaseError("unable to export user")
+	}
+	background := len(messages) > export_sync_max_messages
+
+	export, created, err := registerUserExport(user)
+	if err != nil {
+		return nil, err
+	} else if !created {
+		// An export of the user is already being built
+		return export, nil
+	}
+
+	// Exporting the data of another user is a privileged action
+	if requester.ID != user.ID {
+		recordAuditEvents(store, newAuditEvent(audit, constants.AUDIT_USER_EXPORT, constants.AUDIT_TARGET_USER, user.ID, nil, export, audit.Reason))
+	}
+
+	if background {
+		go buildUserExport(store, export.ID, user)
+		return export, nil
+	}
+	buildUserExport(store, export.ID, user)
+	return GetUserExport(requester, user.ID, export.ID)
+}
+
+// registerUserExport registers a new pending export of the user, or returns the export of the user that is already pending
+// The returned boolean is true if the export was created
+func registerUserExport(user *db_model.User) (*UserExport, bool, error) {
+	export_mutex.Lock()
+	defer export_mutex.Unlock()
+
+	for _, export := range exports {
+		if export.UserID == user.ID && export.Status == EXPORT_PENDING {
+			return copyUserExport(export), false, nil
+		}
+	}
+
+	id, err := generateExportSecret(16)
+	if err != nil {
+		return nil, false, err
+	}
+	token, err := generateExportSecret(32)
+	if err != nil {
+		return nil, false, err
+	}
+
+	created_at := time.Now().UTC()
+	export := &UserExport{
+		ID:        id,
+		UserID:    user.ID,
+		Status:    EXPORT_PENDING,
+		FileName:  EXPORT_PREFIX + user.Username + "-" + created_at.Format(BACKUP_TIME_FORMAT) + EXPORT_EXTENSION,
+		CreatedAt: created_at,
+		ExpiresAt: created_at.Add(constants.EXPORT_EXPIRATION),
+		Token:     token,
+	}
+	exports[export.ID] = export
+	return copyUserExport(export), true, nil
+}
+
+// generateExportSecret generates a random hexadecimal string of the given number of bytes
+func generateExportSecret(size int) (string, error) {
+	secret := make([]byte, size)
+	_, err := rand.Read(secret)
+	if err != nil {
+		logger.Error("Unable to generate the export secret", err)
+		return "", httputils.NewInternalServerError("unable to export user")
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// buildUserExport builds the archive of a registered export and updates its status
+// The download link expires EXPORT_EXPIRATION after the archive is ready
+func buildUserExport(store *db_model.Store, export_id string, user *db_model.User) {
+	archive_path := exportArchivePath(export_id)
+	err := writeUserExport(store, user, archive_path)
+
+	var size int64
+	if err == nil {
+		var info os.FileInfo
+		info, err = os.Stat(archive_path)
+		if err == nil {
+			size = info.Size()
+		}
+	}
+
+	export_mutex.Lock()
+	defer export_mutex.Unlock()
+
+	export, ok := exports[export_id]
+	if !ok {
+		// The export was cleaned up while it was built
+		os.Remove(archive_path)
+		return
+	}
+	if err != nil {
+		logger.Error("Unable to export user", user.ID, err)
+		os.Remove(archive_path)
+		export.Status = EXPORT_FAILED
+		return
+	}
+	export.Status = EXPORT_READY
+	export.Size = size
+	export.ExpiresAt = time.Now().UTC().Add(constants.EXPORT_EXPIRATION)
+	logger.Info("Exported user", user.ID, "to", archive_path)
+}
+
+// writeUserExport writes the data of the user and its human readable index, then compresses them into the archive
+func writeUserExport(store *db_model.Store, user *db_model.User, archive_path string) error {
+	err := os.MkdirAll(constants.EXPORTS_DIR, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	work_dir, err := os.MkdirTemp(constants.EXPORTS_DIR, "work-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(work_dir)
+
+	// Profile
+	profile := &exportProfile{
+		ID:                 user.ID,
+		Username:           user.Username,
+		Email:              user.Email,
+		VerifiedEmail:      user.VerifiedEmail,
+		TwoFactorEnabled:   user.TOTPEnabled,
+		Avatar:             user.Avatar,
+		Role:               user.Role,
+		Banned:             user.Banned,
+		TotalContributions: user.TotalContributions,
+		MinutesListened:    user.MinutesListened,
+		SubscriberTier:     user.Subscriber_Tier,
+		CreatedAt:          user.CreatedAt,
+		ModifiedAt:         user.ModifiedAt,
+	}
+	err = writeExportJSON(filepath.Join(work_dir, EXPORT_PROFILE_FILE), profile)
+	if err != nil {
+		return err
+	}
+
+	// Messages, read by batches as they are the bulk of large accounts
+	messages_count, err := writeExportMessages(store, user.ID, filepath.Join(work_dir, EXPORT_MESSAGES_FILE))
+	if err != nil {
+		return err
+	}
+
+	// Bans and mutes received, including the ones that ended
+	bans, err := store.Bans.List(&db_model.BansGetRequestParams{TargetID: []int{user.ID}, Order: "created_at asc, id asc"})
+	if err != nil {
+		return err
+	}
+	err = writeExportJSON(filepath.Join(work_dir, EXPORT_BANS_FILE), bans)
+	if err != nil {
+		return err
+	}
+
+	// Active sessions
+	tokens, err := store.Tokens.ListUserTokens(user.ID)
+	if err != nil {
+		return err
+	}
+	sessions := []*exportSession{}
+	for _, token := range tokens {
+		if token.IsExpired() || !isSessionToken(token) {
+			continue
+		}
+		sessions = append(sessions, &exportSession{
+			ID:         token.ID,
+			Type:       token.Type,
+			CreatedAt:  token.CreatedAt,
+			LastUsedAt: token.LastUsedAt,
+			ExpiresAt:  time.Unix(token.Expiration, 0).UTC(),
+		})
+	}
+	err = writeExportJSON(filepath.Join(work_dir, EXPORT_SESSIONS_FILE), sessions)
+	if err != nil {
+		return err
+	}
+
+	files := []string{
+		filepath.Join(work_dir, EXPORT_INDEX_FILE),
+		filepath.Join(work_dir, EXPORT_PROFILE_FILE),
+		filepath.Join(work_dir, EXPORT_MESSAGES_FILE),
+		filepath.Join(work_dir, EXPORT_BANS_FILE),
+		filepath.Join(work_dir, EXPORT_SESSIONS_FILE),
+	}
+
+	// Avatar, only if the user uploaded one
+	avatar_file, err := copyExportAvatar(user, work_dir)
+	if err != nil {
+		return err
+	}
+	if avatar_file != "" {
+		files = append(files, avatar_file)
+	}
+
+	// Human readable index
+	index := buildExportIndex(profile, messages_count, bans, sessions, filepath.Base(avatar_file))
+	err = os.WriteFile(filepath.Join(work_dir, EXPORT_INDEX_FILE), []byte(index), 0600)
+	if err != nil {
+		return err
+	}
+
+	return fileutils.CompressFiles(archive_path, files)
+}
+
+// writeExportJSON writes the record as indented JSON
+func writeExportJSON(file_path string, record any) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file_path, append(data, '\n'), 0600)
+}
+
+// writeExportMessages streams the messages sent by the user as a JSON array, oldest first, and returns their number
+func writeExportMessages(store *db_model.Store, user_id int, file_path string) (int, error) {
+	file, err := os.Create(file_path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	writer.WriteString("[")
+	count := 0
+	for {
+		messages, err := store.Messages.List(&db_model.MessagesGetRequestParams{
+			SenderID: []int{user_id},
+			Order:    "id asc",
+			Limit:    constants.EXPORT_BATCH_SIZE,
+			Offset:   count,
+		})
+		if err != nil {
+			return count, err
+		}
+
+		for _, message := range messages {
+			data, err := json.MarshalIndent(&exportMessage{
+				ID:         message.ID,
+				Content:    message.Content,
+				Flagged:    message.Flagged,
+				Removed:    message.Removed,
+				Censored:   message.Censored,
+				CreatedAt:  message.CreatedAt,
+				ModifiedAt: message.ModifiedAt,
+			}, "  ", "  ")
+			if err != nil {
+				return count, err
+			}
+			if count > 0 {
+				writer.WriteString(",")
+			}
+			writer.WriteString("\n  ")
+			writer.Write(data)
+			count++
+		}
+
+		if len(messages) < constants.EXPORT_BATCH_SIZE {
+			break
+		}
+	}
+	if count > 0 {
+		writer.WriteString("\n")
+	}
+	writer.WriteString("]\n")
+
+	err = writer.Flush()
+	if err != nil {
+		return count, err
+	}
+	return count, file.Close()
+}
+
+// copyExportAvatar copies the uploaded avatar of the user to the work directory, with an extension matching its content
+// It returns the path of the copy, or an empty string if the user has the default avatar
+func copyExportAvatar(user *db_model.User, work_dir string) (string, error) {
+	if user.Avatar != strconv.Itoa(user.ID) {
+		return "", nil
+	}
+
+	avatar, err := os.ReadFile(filepath.Join(constants.AVATARS_DIR, user.Avatar))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	extension := ".img"
+	switch http.DetectContentType(avatar) {
+	case "image/png":
+		extension = ".png"
+	case "image/jpeg":
+		extension = ".jpg"
+	case "image/gif":
+		extension = ".gif"
+	case "image/webp":
+		extension = ".webp"
+	}
+
+	avatar_path := filepath.Join(work_dir, EXPORT_AVATAR_FILE+extension)
+	return avatar_path, os.WriteFile(avatar_path, avatar, 0600)
+}
+
+// buildExportIndex describes the content of an export in plain text, for the humans opening the archive
+func buildExportIndex(profile *exportProfile, messages_count int, bans []*db_model.Ban, sessions []*exportSession, avatar_file string) string {
+	index := &strings.Builder{}
+	yes_no := map[bool]string{true: "yes", false: "no"}
+
+	fmt.Fprintf(index, "JukeBox data export\n")
+	fmt.Fprintf(index, "===================\n\n")
+	fmt.Fprintf(index, "User:         %s (#%d)\n", profile.Username, profile.ID)
+	fmt.Fprintf(index, "Generated at: %s\n\n", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(index, "This archive contains the data JukeBox holds about this account.\n")
+	fmt.Fprintf(index, "The JSON files are meant to be read by programs, this file summarizes them.\n\n")
+
+	fmt.Fprintf(index, "Files\n-----\n")
+	fmt.Fprintf(index, "%-15s %s\n", EXPORT_INDEX_FILE, "This summary")
+	fmt.Fprintf(index, "%-15s %s\n", EXPORT_PROFILE_FILE, "The profile, including the email address")
+	fmt.Fprintf(index, "%-15s %d messages sent, oldest first\n", EXPORT_MESSAGES_FILE, messages_count)
+	fmt.Fprintf(index, "%-15s %d bans and mutes received\n", EXPORT_BANS_FILE, len(bans))
+	fmt.Fprintf(index, "%-15s %d active sessions\n", EXPORT_SESSIONS_FILE, len(sessions))
+	if avatar_file != "" && avatar_file != "." {
+		fmt.Fprintf(index, "%-15s %s\n", avatar_file, "The uploaded avatar")
+	}
+
+	fmt.Fprintf(index, "\nProfile\n-------\n")
+	fmt.Fprintf(index, "Username:            %s\n", profile.Username)
+	fmt.Fprintf(index, "Email:               %s\n", profile.Email)
+	fmt.Fprintf(index, "Email verified:      %s\n", yes_no[profile.VerifiedEmail])
+	fmt.Fprintf(index, "Two-factor auth:     %s\n", yes_no[profile.TwoFactorEnabled])
+	fmt.Fprintf(index, "Role:                %s\n", profile.Role)
+	fmt.Fprintf(index, "Banned:              %s\n", yes_no[profile.Banned])
+	fmt.Fprintf(index, "Subscriber tier:     %d\n", profile.SubscriberTier)
+	fmt.Fprintf(index, "Total contributions: %d\n", profile.TotalContributions)
+	fmt.Fprintf(index, "Minutes listened:    %d\n", profile.MinutesListened)
+	fmt.Fprintf(index, "Member since:        %s\n", profile.CreatedAt.UTC().Format(time.RFC3339))
+
+	if len(bans) > 0 {
+		fmt.Fprintf(index, "\nBans and mutes\n--------------\n")
+		for _, ban := range bans {
+			fmt.Fprintf(index, "- %s from %s until %s: %s\n", ban.Type, ban.CreatedAt.UTC().Format(time.RFC3339), ban.EndsAt.UTC().Format(time.RFC3339), ban.Reason)
+		}
+	}
+
+	if len(sessions) > 0 {
+		fmt.Fprintf(index, "\nActive sessions\n---------------\n")
+		for _, session := range sessions {
+			last_used := "never"
+			if session.LastUsedAt != nil {
+				last_used = session.LastUsedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(index, "- %s token created %s, last used %s, expires %s\n", session.Type, session.CreatedAt.UTC().Format(time.RFC3339), last_used, session.ExpiresAt.Format(time.RFC3339))
+		}
+	}
+	return index.String()
+}
+
+// ================= Read =================
+
+// GetUserExport retrieves an export of a user, only the user and the admins can see it
+func GetUserExport(requester *db_model.User, user_id int, export_id string) (*UserExport, error) {
+	if requester == nil || (requester.ID != user_id && !requester.HasPermission(constants.PERMISSION_USER_READ)) {
+		return nil, httputils.NewForbiddenError("user does not have permission to access the exports of user")
+	}
+
+	export_mutex.Lock()
+	defer export_mutex.Unlock()
+
+	export, ok := exports[export_id]
+	if !ok || export.UserID != user_id || export.isExpired() {
+		return nil, httputils.NewNotFoundError("export not found")
+	}
+	return copyUserExport(export), nil
+}
+
+// GetUserExportArchive retrieves the archive of a ready export, the download token is the only credential required
+// It returns the path of the archive and its name for the client
+func GetUserExportArchive(user_id int, export_id string, token string) (string, string, error) {
+	export_mutex.Lock()
+	defer export_mutex.Unlock()
+
+	// Every mismatch looks the same, not to disclose which exports exist
+	export, ok := exports[export_id]
+	if !ok || export.UserID != user_id || export.isExpired() || subtle.ConstantTimeCompare([]byte(export.Token), []byte(token)) != 1 {
+		return "", "", httputils.NewNotFoundError("export not found")
+	}
+	if export.Status != EXPORT_READY {
+		return "", "", httputils.NewConflictError("export is " + export.Status)
+	}
+	return exportArchivePath(export.ID), export.FileName, nil
+}
+
+// exportArchivePath returns the path of the archive of an export
+func exportArchivePath(export_id string) string {
+	return filepath.Join(constants.EXPORTS_DIR, export_id+EXPORT_EXTENSION)
+}
+
+// copyUserExport returns a copy of the export, the registered exports are only modified under export_mutex
+func copyUserExport(export *UserExport) *UserExport {
+	export_copy := *export
+	return &export_copy
+}
+
+// isExpired returns true if the export can not be downloaded anymore, pending exports never expire
+func (export *UserExport) isExpired() bool {
+	return export.Status != EXPORT_PENDING && time.Now().After(export.ExpiresAt)
+}
+
+// ================= Delete =================
+
+// DeleteExpiredExports forgets the expired exports and deletes every archive that does not belong to a known export
+// (the exports of a previous run and the leftovers of interrupted builds)
+func DeleteExpiredExports() (int, error) {
+	export_mutex.Lock()
+	defer export_mutex.Unlock()
+
+	deleted := 0
+	for id, export := range exports {
+		if export.isExpired() {
+			delete(exports, id)
+			deleted++
+		}
+	}
+
+	entries, err := os.ReadDir(constants.EXPORTS_DIR)
+	if os.IsNotExist(err) {
+		return deleted, nil
+	} else if err != nil {
+		return deleted, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if export, ok := exports[strings.TrimSuffix(name, EXPORT_EXTENSION)]; ok && strings.HasSuffix(name, EXPORT_EXTENSION) {
+			if export.Status != EXPORT_FAILED {
+				continue
+			}
+		} else if strings.HasPrefix(name, "work-") && hasPendingExport() {
+			// The work directory may belong to an export being built
+			continue
+		}
+
+		err = os.RemoveAll(filepath.Join(constants.EXPORTS_DIR, name))
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// hasPendingExport returns true if an export is being built, the caller must hold export_mutex
+func hasPendingExport() bool {
+	for _, export := range exports {
+		if export.Status == EXPORT_PENDING {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,283 @@
+package db_controller
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+)
+
+// setupExportTest builds the exports in a temporary directory and forgets the exports of the previous tests
+func setupExportTest(t *testing.T, sync_max_messages int) {
+	previous_dir, previous_max := constants.EXPORTS_DIR, export_sync_max_messages
+	constants.EXPORTS_DIR = t.TempDir()
+	export_sync_max_messages = sync_max_messages
+	t.Cleanup(func() {
+		constants.EXPORTS_DIR, export_sync_max_messages = previous_dir, previous_max
+		export_mutex.Lock()
+		exports = map[string]*UserExport{}
+		export_mutex.Unlock()
+	})
+}
+
+// readExportArchive returns the content of the files of an export archive by name
+func readExportArchive(t *testing.T, archive_path string) map[string]string {
+	reader, err := zip.OpenReader(archive_path)
+	if err != nil {
+		t.Fatalf("Error opening export archive: %v", err)
+	}
+	defer reader.Close()
+
+	files := map[string]string{}
+	for _, file := range reader.File {
+		content, err := file.Open()
+		if err != nil {
+			t.Fatalf("Error opening %s: %v", file.Name, err)
+		}
+		data, err := io.ReadAll(content)
+		content.Close()
+		if err != nil {
+			t.Fatalf("Error reading %s: %v", file.Name, err)
+		}
+		files[file.Name] = string(data)
+	}
+	return files
+}
+
+func TestExportUser(t *testing.T) {
+	setupExportTest(t, constants.EXPORT_SYNC_MAX_MESSAGES)
+	store, admin, user := createAuditTestUsers(t)
+
+	for _, content := range []string{"Hello", "World"} {
+		_, err := CreateMessage(store, &db_model.MessagesPostRequestParams{Sender: user, Message: content})
+		if err != nil {
+			t.Fatalf("Error creating message: %v", err)
+		}
+	}
+	_, err := BanUsers(store, &AuditContext{Actor: admin}, &db_model.BansPostRequestParams{Issuer: admin, Target: []*db_model.User{user}, Type: constants.MUTE_TYPE, Duration: 60, Reason: "Spam"})
+	if err != nil {
+		t.Fatalf("Error banning user: %v", err)
+	}
+
+	_, _, err = GenerateUserAuthTokens(store, nil, user)
+	if err != nil {
+		t.Fatalf("Error generating tokens: %v", err)
+	}
+	tokens, err := store.Tokens.ListUserTokens(user.ID)
+	if err != nil {
+		t.Fatalf("Error listing tokens: %v", err)
+	}
+	used_at := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	for _, token := range tokens {
+		if token.Type == constants.ACCESS_TOKEN {
+			err = store.Tokens.Touch(token, used_at, "203.0.113.7", "test")
+			if err != nil {
+				t.Fatalf("Error touching token: %v", err)
+			}
+		}
+	}
+
+	// Small accounts are exported right away
+	export, err := ExportUser(store, &AuditContext{Actor: user}, user.ID)
+	if err != nil {
+		t.Fatalf("Error exporting user: %v", err)
+	}
+	if export.Status != EXPORT_READY || export.Size == 0 || export.Token == "" {
+		t.Fatalf("Error exporting user: expected a ready export, got %+v", export)
+	}
+
+	archive_path, file_name, err := GetUserExportArchive(user.ID, export.ID, export.Token)
+	if err != nil {
+		t.Fatalf("Error retrieving export archive: %v", err)
+	}
+	if !strings.HasPrefix(file_name, EXPORT_PREFIX+user.Username) {
+		t.Errorf("Error retrieving export archive: unexpected file name %s", file_name)
+	}
+
+	files := readExportArchive(t, archive_path)
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	expected_names := []string{EXPORT_BANS_FILE, EXPORT_INDEX_FILE, EXPORT_MESSAGES_FILE, EXPORT_PROFILE_FILE, EXPORT_SESSIONS_FILE}
+	if strings.Join(names, ",") != strings.Join(expected_names, ",") {
+		t.Errorf("Error exporting user: expected files %v, got %v", expected_names, names)
+	}
+
+	profile := &exportProfile{}
+	if json.Unmarshal([]byte(files[EXPORT_PROFILE_FILE]), profile) != nil || profile.Email != user.Email {
+		t.Errorf("Error exporting user: profile without email: %s", files[EXPORT_PROFILE_FILE])
+	}
+	messages := []*exportMessage{}
+	if json.Unmarshal([]byte(files[EXPORT_MESSAGES_FILE]), &messages) != nil || len(messages) != 2 || messages[0].Content != "Hello" {
+		t.Errorf("Error exporting user: expected both messages, got %s", files[EXPORT_MESSAGES_FILE])
+	}
+	bans := []*db_model.Ban{}
+	if json.Unmarshal([]byte(files[EXPORT_BANS_FILE]), &bans) != nil || len(bans) != 1 || bans[0].Reason != "Spam" {
+		t.Errorf("Error exporting user: expected the mute, got %s", files[EXPORT_BANS_FILE])
+	}
+	sessions := []*exportSession{}
+	if json.Unmarshal([]byte(files[EXPORT_SESSIONS_FILE]), &sessions) != nil || len(sessions) != 2 {
+		t.Fatalf("Error exporting user: expected both session tokens, got %s", files[EXPORT_SESSIONS_FILE])
+	}
+	for _, session := range sessions {
+		if session.Type == constants.ACCESS_TOKEN && (session.LastUsedAt == nil || !session.LastUsedAt.Equal(used_at)) {
+			t.Errorf("Error exporting user: expected the access token last used at %s, got %v", used_at, session.LastUsedAt)
+		} else if session.Type == constants.REFRESH_TOKEN && session.LastUsedAt != nil {
+			t.Errorf("Error exporting user: expected the refresh token never used, got %v", session.LastUsedAt)
+		}
+	}
+	if !strings.Contains(files[EXPORT_INDEX_FILE], "2 messages sent") || !strings.Contains(files[EXPORT_INDEX_FILE], user.Email) {
+		t.Errorf("Error exporting user: incomplete index:\n%s", files[EXPORT_INDEX_FILE])
+	}
+}
+
+func TestExportUserPermissions(t *testing.T) {
+	setupExportTest(t, constants.EXPORT_SYNC_MAX_MESSAGES)
+	store, admin, user := createAuditTestUsers(t)
+
+	// A user can only export itself
+	_, err := ExportUser(store, &AuditContext{Actor: user}, admin.ID)
+	if err == nil {
+		t.Errorf("Error exporting user: user allowed to export another user")
+	}
+
+	// An admin can export anyone, which is audited
+	export, err := ExportUser(store, &AuditContext{Actor: admin, Reason: "Legal request"}, user.ID)
+	if err != nil {
+		t.Fatalf("Error exporting user: %v", err)
+	}
+	events, err := GetAuditEvents(store, &db_model.AuditGetRequestParams{Action: []string{constants.AUDIT_USER_EXPORT}})
+	if err != nil || len(events) != 1 || events[0].TargetID != user.ID || events[0].Reason != "Legal request" {
+		t.Errorf("Error auditing user export: expected one event, got %d (%v)", len(events), err)
+	}
+
+	// Not the users at or above their role
+	owner := createRoleTestUser(t, store, "owner", constants.ROLE_OWNER)
+	other_admin := createRoleTestUser(t, store, "other_admin", constants.ROLE_ADMIN)
+	for _, target := range []*db_model.User{owner, other_admin} {
+		_, err = ExportUser(store, &AuditContext{Actor: admin}, target.ID)
+		expectForbidden(t, err, "exporting a "+target.Role+" as an admin")
+	}
+	_, err = ExportUser(store, &AuditContext{Actor: owner}, owner.ID)
+	if err != nil {
+		t.Errorf("Error exporting user: owner not allowed to export itself: %v", err)
+	}
+
+	// Only the user and the admins can see the export
+	_, err = GetUserExport(user, user.ID, export.ID)
+	if err != nil {
+		t.Errorf("Error retrieving export: %v", err)
+	}
+	other_user, err := CreateUser(store, &db_model.UsersPostRequestParams{Username: "other_user", Email: "other_user@test.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	_, err = GetUserExport(other_user, user.ID, export.ID)
+	if err == nil {
+		t.Errorf("Error retrieving export: user allowed to see the export of another user")
+	}
+
+	// The download link requires the right token, for the right user
+	_, _, err = GetUserExportArchive(user.ID, export.ID, "invalid")
+	if err == nil {
+		t.Errorf("Error retrieving export archive: invalid token accepted")
+	}
+	_, _, err = GetUserExportArchive(admin.ID, export.ID, export.Token)
+	if err == nil {
+		t.Errorf("Error retrieving export archive: export of another user accepted")
+	}
+}
+
+func TestExportUserInBackground(t *testing.T) {
+	setupExportTest(t, 1)
+	store, _, user := createAuditTestUsers(t)
+
+	for _, content := range []string{"One", "Two", "Three"} {
+		_, err := CreateMessage(store, &db_model.MessagesPostRequestParams{Sender: user, Message: content})
+		if err != nil {
+			t.Fatalf("Error creating message: %v", err)
+		}
+	}
+
+	export, err := ExportUser(store, &AuditContext{Actor: user}, user.ID)
+	if err != nil {
+		t.Fatalf("Error exporting user: %v", err)
+	}
+
+	// Wait for the export to be built
+	deadline := time.Now().Add(5 * time.Second)
+	for export.Status == EXPORT_PENDING && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		export, err = GetUserExport(user, user.ID, export.ID)
+		if err != nil {
+			t.Fatalf("Error retrieving export: %v", err)
+		}
+	}
+	if export.Status != EXPORT_READY {
+		t.Fatalf("Error exporting user in background: expected a ready export, got %s", export.Status)
+	}
+
+	archive_path, _, err := GetUserExportArchive(user.ID, export.ID, export.Token)
+	if err != nil {
+		t.Fatalf("Error retrieving export archive: %v", err)
+	}
+	messages := []*exportMessage{}
+	files := readExportArchive(t, archive_path)
+	if json.Unmarshal([]byte(files[EXPORT_MESSAGES_FILE]), &messages) != nil || len(messages) != 3 {
+		t.Errorf("Error exporting user in background: expected 3 messages, got %s", files[EXPORT_MESSAGES_FILE])
+	}
+}
+
+func TestDeleteExpiredExports(t *testing.T) {
+	setupExportTest(t, constants.EXPORT_SYNC_MAX_MESSAGES)
+	store, _, user := createAuditTestUsers(t)
+
+	export, err := ExportUser(store, &AuditContext{Actor: user}, user.ID)
+	if err != nil {
+		t.Fatalf("Error exporting user: %v", err)
+	}
+	// An archive left by a previous run
+	orphan_path := filepath.Join(constants.EXPORTS_DIR, "orphan"+EXPORT_EXTENSION)
+	err = os.WriteFile(orphan_path, []byte("orphan"), 0600)
+	if err != nil {
+		t.Fatalf("Error writing orphan archive: %v", err)
+	}
+
+	deleted, err := DeleteExpiredExports()
+	if err != nil || deleted != 0 {
+		t.Errorf("Error deleting expired exports: expected none, got %d (%v)", deleted, err)
+	}
+	if _, err := os.Stat(orphan_path); !os.IsNotExist(err) {
+		t.Errorf("Error deleting expired exports: orphan archive kept")
+	}
+	if _, err := os.Stat(exportArchivePath(export.ID)); err != nil {
+		t.Errorf("Error deleting expired exports: valid archive deleted: %v", err)
+	}
+
+	// Expire the export
+	export_mutex.Lock()
+	exports[export.ID].ExpiresAt = time.Now().Add(-time.Minute)
+	export_mutex.Unlock()
+
+	deleted, err = DeleteExpiredExports()
+	if err != nil || deleted != 1 {
+		t.Errorf("Error deleting expired exports: expected 1, got %d (%v)", deleted, err)
+	}
+	if _, err := os.Stat(exportArchivePath(export.ID)); !os.IsNotExist(err) {
+		t.Errorf("Error deleting expired exports: expired archive kept")
+	}
+	_, _, err = GetUserExportArchive(user.ID, export.ID, export.Token)
+	if err == nil {
+		t.Errorf("Error retrieving export archive: expired export accepted")
+	}
+}
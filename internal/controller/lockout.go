@@ -0,0 +1,215 @@
+package db_controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+)
+
+// UserLockout is the state of the failed logins of an account, the account is locked out until LockedUntil
+type UserLockout struct {
+	FailedLogins int        `json:"failed_logins"`
+	LockedUntil  *time.Time `json:"locked_until"`
+}
+
+// ipLoginFailures is the state of the failed logins from an IP address, the address is locked out until locked_until
+type ipLoginFailures struct {
+	failures     int
+	locked_until time.Time
+}
+
+var (
+	// ip_login_failures holds the failed logins by IP address, they are kept in memory and forgotten on restart
+	ip_login_failures       = map[string]*ipLoginFailures{}
+	ip_login_failures_mutex sync.Mutex
+)
+
+// MAX_LOGIN_DELAY_SHIFT keeps the progressive delay from overflowing, it is capped by the lockout duration anyway
+const MAX_LOGIN_DELAY_SHIFT = 20
+
+// ================= Throttling =================
+
+// checkLoginThrottling refuses the login attempts from an IP address, or on an account, that failed too recently or are locked out
+// The account is not checked when it is not known (nil user), the address is not checked without a client
+func checkLoginThrottling(client *ClientContext, user *db_model.User, now time.Time) error {
+	if client != nil {
+		locked_until := time.Time{}
+		ip_login_failures_mutex.Lock()
+		if ip_failures, ok := ip_login_failures[client.IP]; ok {
+			locked_until = ip_failures.locked_until
+		}
+		ip_login_failures_mutex.Unlock()
+		if now.Before(locked_until) {
+			return httputils.NewTooManyRequestsError("Too many failed logins from this address, try again later", locked_until.Sub(now))
+		}
+	}
+	if user != nil && user.LockedUntil != nil && now.Before(*user.LockedUntil) {
+		return httputils.NewTooManyRequestsError("Too many failed logins on this account, try again later", user.LockedUntil.Sub(now))
+	}
+	return nil
+}
+
+// recordLoginFailure records a failed login on the account of the user (nil if not known) and from the IP address of the client,
+// and locks them out once they reach their threshold
+// The next attempts on the account are delayed, not the ones from the address which may be shared by many users (NAT, proxies)
+func recordLoginFailure(store *db_model.Store, client *ClientContext, user *db_model.User, now time.Time) {
+	ip := ""
+	if client != nil {
+		ip = client.IP
+		ip_login_failures_mutex.Lock()
+		ip_failures, ok := ip_login_failures[ip]
+		if !ok {
+			ip_failures = &ipLoginFailures{}
+			ip_login_failures[ip] = ip_failures
+		}
+		var locked bool
+		ip_failures.failures, ip_failures.locked_until, locked = nextLoginFailure(ip_failures.failures, ip_failures.locked_until, constants.LOGIN_IP_LOCKOUT_THRESHOLD, 0, now)
+		failures := ip_failures.failures
+		ip_login_failures_mutex.Unlock()
+		if locked {
+			logger.Info("IP address", ip, "locked out after", failures, "failed logins")
+		}
+	}
+
+	if user == nil {
+		return
+	}
+	// The failures are counted by the database, the concurrent failed logins would overwrite each other's count otherwise
+	before := newUserLockout(user)
+	err := store.Users.RecordLoginFailure(user, constants.LOGIN_LOCKOUT_THRESHOLD, constants.LOGIN_LOCKOUT, now)
+	if err != nil {
+		logger.Error("Unable to save the failed logins of user", user.ID, err)
+		return
+	}
+	if constants.LOGIN_LOCKOUT_THRESHOLD > 0 && user.FailedLogins >= constants.LOGIN_LOCKOUT_THRESHOLD {
+		// Only the failure reaching the threshold locks out, the ones in flight meanwhile extend the lockout
+		if user.FailedLogins == constants.LOGIN_LOCKOUT_THRESHOLD {
+			logger.Info("Account of user", user.Username, "locked out after", user.FailedLogins, "failed logins")
+			recordAuditEvents(store, newAuditEvent(&AuditContext{IP: ip}, constants.AUDIT_USER_LOCK, constants.AUDIT_TARGET_USER, user.ID, before, newUserLockout(user), "too many failed logins"))
+		}
+		return
+	}
+	err = store.Users.DelayLogins(user, now.Add(loginFailureDelay(user.FailedLogins, constants.LOGIN_DELAY)))
+	if err != nil {
+		logger.Error("Unable to delay the logins of user", user.ID, err)
+	}
+}
+
+// recordLoginSuccess forgets the failed logins of the account of the user, once it is logged in
+func recordLoginSuccess(store *db_model.Store, user *db_model.User) {
+	if user.FailedLogins == 0 && user.LockedUntil == nil {
+		return
+	}
+	err := store.Users.ResetLoginFailures(user)
+	if err != nil {
+		logger.Error("Unable to reset the failed logins of user", user.ID, err)
+	}
+}
+
+// nextLoginFailure returns the failures count after a new failed login, the end of the delay it imposes and whether it locks out
+// The previous failures are forgotten once they stayed unlocked for the lockout duration
+// The first failure is not delayed, so that a typo does not slow down the user, the delay then doubles with every failure
+func nextLoginFailure(failures int, locked_until time.Time, threshold int, delay time.Duration, now time.Time) (int, time.Time, bool) {
+	if now.After(locked_until.Add(constants.LOGIN_LOCKOUT)) {
+		failures = 0
+	}
+	failures++
+
+	if threshold > 0 && failures >= threshold {
+		return failures, now.Add(constants.LOGIN_LOCKOUT), true
+	}
+	return failures, now.Add(loginFailureDelay(failures, delay)), false
+}
+
+// loginFailureDelay returns the delay imposed by the failures count, none for the first failure then doubling with every failure
+// The delay is capped by the lockout duration
+func loginFailureDelay(failures int, delay time.Duration) time.Duration {
+	if failures < 2 {
+		return 0
+	}
+	delay = delay << min(failures-2, MAX_LOGIN_DELAY_SHIFT)
+	return min(delay, constants.LOGIN_LOCKOUT)
+}
+
+// newUserLockout returns the state of the failed logins of a user
+func newUserLockout(user *db_model.User) *UserLockout {
+	return &UserLockout{FailedLogins: user.FailedLogins, LockedUntil: user.LockedUntil}
+}
+
+// ================= Read =================
+
+// GetUserLockout retrieves the failed logins of a user and the end of its lockout (in the past if it is not locked out)
+func GetUserLockout(audit *AuditContext, user *db_model.User) (*UserLockout, error) {
+	err := checkPermission(audit, constants.PERMISSION_USER_READ)
+	if err != nil {
+		return nil, err
+	}
+	return newUserLockout(user), nil
+}
+
+// ================= Unlock =================
+
+// UnlockUser forgets the failed logins of a user, which can log in again right away
+func UnlockUser(store *db_model.Store, audit *AuditContext, user *db_model.User) error {
+	err := checkPermission(audit, constants.PERMISSION_USER_UPDATE)
+	if err == nil {
+		err = checkSelfOrOutranks(audit, user)
+	}
+	if err != nil {
+		return err
+	}
+	if user.FailedLogins == 0 && user.LockedUntil == nil {
+		return nil
+	}
+
+	before := newUserLockout(user)
+	err = store.Users.ResetLoginFailures(user)
+	if err != nil {
+		logger.Error("Unable to unlock user", user.ID, err)
+		return httputils.NewDatabaseError("unable to unlock the user")
+	}
+
+	logger.Info("Account of user", user.Username, "unlocked")
+	recordAuditEvents(store, newAuditEvent(audit, constants.AUDIT_USER_UNLOCK, constants.AUDIT_TARGET_USER, user.ID, before, newUserLockout(user), audit.Reason))
+	return nil
+}
+
+// UnlockIP forgets the failed logins from an IP address, which can log in again right away
+func UnlockIP(store *db_model.Store, audit *AuditContext, ip string) error {
+	err := checkPermission(audit, constants.PERMISSION_USER_UPDATE)
+	if err != nil {
+		return err
+	}
+
+	ip_login_failures_mutex.Lock()
+	ip_failures, ok := ip_login_failures[ip]
+	delete(ip_login_failures, ip)
+	ip_login_failures_mutex.Unlock()
+	if !ok {
+		return httputils.NewNotFoundError("No failed login from this address")
+	}
+
+	logger.Info("IP address", ip, "unlocked")
+	before := map[string]any{"ip": ip, "failed_logins": ip_failures.failures, "locked_until": ip_failures.locked_until}
+	recordAuditEvents(store, newAuditEvent(audit, constants.AUDIT_IP_UNLOCK, constants.AUDIT_TARGET_IP, 0, before, nil, audit.Reason))
+	return nil
+}
+
+// PruneLoginFailures forgets the failed logins of the IP addresses that stayed unlocked for the lockout duration
+func PruneLoginFailures(now time.Time) int {
+	ip_login_failures_mutex.Lock()
+	defer ip_login_failures_mutex.Unlock()
+
+	pruned := 0
+	for ip, ip_failures := range ip_login_failures {
+		if now.After(ip_failures.locked_until.Add(constants.LOGIN_LOCKOUT)) {
+			delete(ip_login_failures, ip)
+			pruned++
+		}
+	}
+	return pruned
+}
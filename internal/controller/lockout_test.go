@@ -0,0 +1,200 @@
+package db_controller
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+)
+
+// setupLockoutTest sets the login throttling for the test and forgets the failed logins by IP address once it is done
+func setupLockoutTest(t *testing.T, max_failures int, max_failures_per_ip int, delay time.Duration) {
+	constants.SetLoginThrottling(max_failures, max_failures_per_ip, delay, time.Hour)
+	t.Cleanup(func() {
+		constants.SetLoginThrottling(constants.LOGIN_MAX_FAILURES, constants.LOGIN_MAX_FAILURES_PER_IP, constants.LOGIN_FAILURE_DELAY, constants.LOGIN_LOCKOUT_DURATION)
+		ip_login_failures_mutex.Lock()
+		ip_login_failures = map[string]*ipLoginFailures{}
+		ip_login_failures_mutex.Unlock()
+	})
+}
+
+// expectThrottled fails the test unless the error is a 429 telling the client to retry later
+func expectThrottled(t *testing.T, err error, action string) {
+	var throttled *httputils.TooManyRequestsError
+	if !errors.As(err, &throttled) || throttled.RetryAfter <= 0 {
+		t.Errorf("Error %s: expected to be throttled, got %v", action, err)
+	}
+}
+
+func TestNextLoginFailure(t *testing.T) {
+	setupLockoutTest(t, 4, 0, time.Second)
+	now := time.Now()
+
+	// The first failure is free, the delay then doubles until the lockout
+	failures, locked_until, locked := nextLoginFailure(0, time.Time{}, 4, time.Second, now)
+	if failures != 1 || !locked_until.Equal(now) || locked {
+		t.Errorf("Error delaying the first failure: got %d failures until %v (locked: %v)", failures, locked_until, locked)
+	}
+	failures, locked_until, _ = nextLoginFailure(failures, locked_until, 4, time.Second, now)
+	if failures != 2 || !locked_until.Equal(now.Add(time.Second)) {
+		t.Errorf("Error delaying the second failure: got %d failures until %v", failures, locked_until)
+	}
+	failures, locked_until, _ = nextLoginFailure(failures, locked_until, 4, time.Second, now)
+	if failures != 3 || !locked_until.Equal(now.Add(2*time.Second)) {
+		t.Errorf("Error delaying the third failure: got %d failures until %v", failures, locked_until)
+	}
+	failures, locked_until, locked = nextLoginFailure(failures, locked_until, 4, time.Second, now)
+	if failures != 4 || !locked_until.Equal(now.Add(time.Hour)) || !locked {
+		t.Errorf("Error locking out: got %d failures until %v (locked: %v)", failures, locked_until, locked)
+	}
+
+	// Without threshold, the delay is capped by the lockout duration
+	_, locked_until, locked = nextLoginFailure(100, now, 0, time.Second, now)
+	if !locked_until.Equal(now.Add(time.Hour)) || locked {
+		t.Errorf("Error capping the delay: got %v (locked: %v)", locked_until, locked)
+	}
+
+	// The failures from the IP addresses are not delayed
+	_, locked_until, _ = nextLoginFailure(2, now, 4, 0, now)
+	if !locked_until.Equal(now) {
+		t.Errorf("Error delaying without delay: got %v", locked_until)
+	}
+
+	// The failures are forgotten once they stayed unlocked for the lockout duration
+	failures, _, _ = nextLoginFailure(3, now.Add(-2*time.Hour), 4, time.Second, now)
+	if failures != 1 {
+		t.Errorf("Error forgetting the old failures: got %d failures", failures)
+	}
+}
+
+func TestAccountLockout(t *testing.T) {
+	setupLockoutTest(t, 3, 0, 0)
+	store, admin, user := createAuditTestUsers(t)
+	client := &ClientContext{IP: "192.0.2.1"}
+
+	// A successful login forgets the failed logins
+	_, _, _, _, err := LoginUserFromPassword(store, client, user.Username, "wrong_password")
+	if err == nil {
+		t.Fatalf("Error logging in: wrong password accepted")
+	}
+	_, _, _, _, err = LoginUserFromPassword(store, client, user.Username, "password")
+	if err != nil {
+		t.Fatalf("Error logging in: %v", err)
+	}
+	stored, _ := store.Users.GetByID(user.ID)
+	if stored.FailedLogins != 0 || stored.LockedUntil != nil {
+		t.Errorf("Error logging in: failed logins not forgotten: %+v", newUserLockout(stored))
+	}
+
+	// The account is locked out after the threshold, even for the right password
+	for range 3 {
+		_, _, _, _, err = LoginUserFromPassword(store, client, user.Username, "wrong_password")
+		if err == nil {
+			t.Fatalf("Error logging in: wrong password accepted")
+		}
+	}
+	_, _, _, _, err = LoginUserFromPassword(store, client, user.Username, "password")
+	expectThrottled(t, err, "logging in to a locked out account")
+
+	events, err := store.Audit.List(&db_model.AuditGetRequestParams{Action: []string{constants.AUDIT_USER_LOCK}})
+	if err != nil || len(events) != 1 || events[0].TargetID != user.ID || events[0].IP != client.IP {
+		t.Errorf("Error auditing the lockout: got %+v (%v)", events, err)
+	}
+
+	// Only the users with the user.update permission unlock the accounts
+	stored, _ = store.Users.GetByID(user.ID)
+	expectForbidden(t, UnlockUser(store, &AuditContext{Actor: user}, stored), "unlocking as a user")
+	err = UnlockUser(store, &AuditContext{Actor: admin}, stored)
+	if err != nil {
+		t.Fatalf("Error unlocking user: %v", err)
+	}
+	_, _, _, _, err = LoginUserFromPassword(store, client, user.Username, "password")
+	if err != nil {
+		t.Errorf("Error logging in: unlocked account refused: %v", err)
+	}
+	events, err = store.Audit.List(&db_model.AuditGetRequestParams{Action: []string{constants.AUDIT_USER_UNLOCK}})
+	if err != nil || len(events) != 1 || events[0].ActorID != admin.ID {
+		t.Errorf("Error auditing the unlock: got %+v (%v)", events, err)
+	}
+}
+
+func TestConcurrentLoginFailures(t *testing.T) {
+	setupLockoutTest(t, 10, 0, 0)
+	store, _, user := createAuditTestUsers(t)
+
+	// The concurrent failures are all counted and lock the account out once
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := &ClientContext{IP: fmt.Sprintf("192.0.2.%d", i+1)}
+			_, _, _, _, err := LoginUserFromPassword(store, client, user.Username, "wrong_password")
+			if err == nil {
+				t.Errorf("Error logging in: wrong password accepted")
+			}
+		}()
+	}
+	wg.Wait()
+
+	stored, _ := store.Users.GetByID(user.ID)
+	if stored.FailedLogins != 10 {
+		t.Errorf("Error counting the concurrent failures: got %d failed logins", stored.FailedLogins)
+	}
+	events, err := store.Audit.List(&db_model.AuditGetRequestParams{Action: []string{constants.AUDIT_USER_LOCK}})
+	if err != nil || len(events) != 1 {
+		t.Errorf("Error auditing the lockout: got %+v (%v)", events, err)
+	}
+	_, _, _, _, err = LoginUserFromPassword(store, &ClientContext{IP: "192.0.2.100"}, user.Username, "password")
+	expectThrottled(t, err, "logging in to an account locked out by concurrent failures")
+}
+
+func TestIPLockout(t *testing.T) {
+	setupLockoutTest(t, 0, 3, 0)
+	store, admin, user := createAuditTestUsers(t)
+	client := &ClientContext{IP: "192.0.2.1"}
+
+	// The failures on unknown accounts count for the address
+	for _, username := range []string{"unknown", "missing", user.Username} {
+		_, _, _, _, err := LoginUserFromPassword(store, client, username, "wrong_password")
+		if err == nil {
+			t.Fatalf("Error logging in: wrong password accepted")
+		}
+	}
+	_, _, _, _, err := LoginUserFromPassword(store, client, admin.Username, "password")
+	expectThrottled(t, err, "logging in from a locked out address")
+
+	// The other addresses are not locked out
+	_, _, _, _, err = LoginUserFromPassword(store, &ClientContext{IP: "192.0.2.2"}, admin.Username, "password")
+	if err != nil {
+		t.Errorf("Error logging in from another address: %v", err)
+	}
+
+	expectForbidden(t, UnlockIP(store, &AuditContext{Actor: user}, client.IP), "unlocking an address as a user")
+	err = UnlockIP(store, &AuditContext{Actor: admin}, client.IP)
+	if err != nil {
+		t.Fatalf("Error unlocking address: %v", err)
+	}
+	_, _, _, _, err = LoginUserFromPassword(store, client, admin.Username, "password")
+	if err != nil {
+		t.Errorf("Error logging in: unlocked address refused: %v", err)
+	}
+	err = UnlockIP(store, &AuditContext{Actor: admin}, client.IP)
+	if err == nil {
+		t.Errorf("Error unlocking address: address without failed logins unlocked")
+	}
+
+	// The addresses are forgotten once they stayed unlocked for the lockout duration
+	recordLoginFailure(store, client, nil, time.Now())
+	if PruneLoginFailures(time.Now()) != 0 {
+		t.Errorf("Error pruning the failed logins: recent failure forgotten")
+	}
+	if PruneLoginFailures(time.Now().Add(2*time.Hour)) != 1 {
+		t.Errorf("Error pruning the failed logins: old failure kept")
+	}
+}
@@ -1,11 +1,14 @@
 package db_controller
 
 import (
+	"fmt"
 	"strings"
+	"time"
 
+	"github.com/boxboxjason/jukebox/internal/constants"
 	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
 	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
-	"gorm.io/gorm"
 )
 
 // ================= CRUD Operations =================
@@ -13,44 +16,52 @@ import (
 // ================= Create =================
 
 // CreateMessage creates a new message in the database
-func CreateMessage(db *gorm.DB, query_params *db_model.MessagesPostRequestParams) (*db_model.Message, error) {
+// Users must have verified their email and not be muted to post, the others can only read the chat
+func CreateMessage(store *db_model.Store, query_params *db_model.MessagesPostRequestParams) (*db_model.Message, error) {
+	if !query_params.Sender.VerifiedEmail {
+		return &db_model.Message{}, httputils.NewForbiddenError("verify your email address to post messages")
+	}
+	err := checkUserNotMuted(store, query_params.Sender)
+	if err != nil {
+		return &db_model.Message{}, err
+	}
+
 	db_message := db_model.Message{
 		Sender:  query_params.Sender,
 		Content: strings.TrimSpace(query_params.Message),
 	}
 
-	// Open db connection
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return &db_message, err
-		}
-		defer db_model.CloseConnection(db)
-	}
-
-	err := db_message.CreateMessage(db)
+	err = store.Messages.Create(&db_message)
 	if err != nil {
 		return &db_message, err
 	}
 
-	err = query_params.Sender.IncreaseContributionsCount(db)
+	err = store.Users.IncreaseContributionsCount(query_params.Sender)
 
 	return &db_message, err
 }
 
-// ================= Read =================
-func GetMessages(db *gorm.DB, query_params *db_model.MessagesGetRequestParams) ([]*db_model.Message, error) {
-	// Open db connection
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return nil, err
+// checkUserNotMuted checks that the user is not under a current mute, the latest ending one is reported
+func checkUserNotMuted(store *db_model.Store, user *db_model.User) error {
+	mutes, err := store.Bans.List(&db_model.BansGetRequestParams{TargetID: []int{user.ID}, Type: []string{constants.MUTE_TYPE}, EndsAfter: time.Now()})
+	if err != nil {
+		logger.Error("Unable to retrieve the mutes of user", user.ID, err)
+		return httputils.NewDatabaseError("unable to check the mutes of the user")
+	}
+	var mute *db_model.Ban
+	for _, active_mute := range mutes {
+		if mute == nil || active_mute.EndsAt.After(mute.EndsAt) {
+			mute = active_mute
 		}
-		defer db_model.CloseConnection(db)
 	}
+	if mute != nil {
+		return httputils.NewForbiddenError(fmt.Sprintf("User is muted until %s for reason: %s", mute.EndsAt, mute.Reason))
+	}
+	return nil
+}
 
+// ================= Read =================
+func GetMessages(store *db_model.Store, query_params *db_model.MessagesGetRequestParams) ([]*db_model.Message, error) {
 	for _, id := range query_params.ID {
 		if id < 0 {
 			return nil, httputils.NewBadRequestError("id must be a positive integer")
@@ -63,37 +74,53 @@ func GetMessages(db *gorm.DB, query_params *db_model.MessagesGetRequestParams) (
 		}
 	}
 
-	return db_model.GetMessages(db.Preload("Sender"), query_params)
+	return store.Messages.List(query_params)
 }
 
-func GetMessage(id int) (*db_model.Message, error) {
-	// Open db connection
-	db, err := db_model.OpenConnection()
+// SearchMessages retrieves the messages matching the search query, most relevant first
+func SearchMessages(store *db_model.Store, query_params *db_model.MessagesSearchRequestParams) ([]*db_model.MessageSearchResult, error) {
+	query_params.Query = strings.TrimSpace(query_params.Query)
+	if query_params.Query == "" {
+		return nil, httputils.NewBadRequestError("search query must not be empty")
+	}
+
+	for _, sender_id := range query_params.SenderID {
+		if sender_id < 0 {
+			return nil, httputils.NewBadRequestError("sender_id must be a positive integer")
+		}
+	}
+
+	// Search results are always paginated
+	if query_params.Limit <= 0 || query_params.Limit > constants.SEARCH_MAX_LIMIT {
+		query_params.Limit = constants.SEARCH_MAX_LIMIT
+	}
+
+	results, err := store.Messages.Search(query_params)
 	if err != nil {
-		return nil, err
+		logger.Error("Unable to search the messages", err)
+		return nil, httputils.NewDatabaseError("unable to search the messages")
 	}
-	defer db_model.CloseConnection(db)
-	return db_model.GetMessageByID(db.Preload("Sender"), id)
+	return results, nil
+}
+
+func GetMessage(store *db_model.Store, id int) (*db_model.Message, error) {
+	return store.Messages.GetByID(id)
 }
 
 // ================= Update =================
 
 // UpdateMessage updates a message in the database
-func UpdateMessage(db *gorm.DB, query_params *db_model.MessagesPatchRequestParams) (*db_model.Message, error) {
-	// Open db connection
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return nil, err
-		}
-		defer db_model.CloseConnection(db)
+func UpdateMessage(store *db_model.Store, audit *AuditContext, query_params *db_model.MessagesPatchRequestParams) (*db_model.Message, error) {
+	err := checkMessageModeration(audit, query_params)
+	if err != nil {
+		return nil, err
 	}
 
-	db_message, err := db_model.GetMessageByID(db.Preload("Sender"), query_params.ID)
+	db_message, err := store.Messages.GetByID(query_params.ID)
 	if err != nil {
 		return nil, err
 	}
+	before := *db_message
 
 	if len(query_params.Message) > 0 {
 		db_message.Content = query_params.Message
@@ -112,21 +139,22 @@ func UpdateMessage(db *gorm.DB, query_params *db_model.MessagesPatchRequestParam
 	}
 
 	// Update the message
-	err = db_message.UpdateMessage(db)
-	return db_message, err
+	err = store.Messages.Update(db_message)
+	if err != nil {
+		return db_message, err
+	}
+
+	auditMessageUpdate(store, audit, &before, db_message, query_params)
+	return db_message, nil
 }
 
 // UpdateExistingMessage updates an existing message in the database
-func UpdateExistingMessage(db *gorm.DB, message *db_model.Message, query_params *db_model.MessagesPatchRequestParams) error {
-	// Open db connection
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return err
-		}
-		defer db_model.CloseConnection(db)
+func UpdateExistingMessage(store *db_model.Store, audit *AuditContext, message *db_model.Message, query_params *db_model.MessagesPatchRequestParams) error {
+	err := checkMessageModeration(audit, query_params)
+	if err != nil {
+		return err
 	}
+	before := *message
 
 	if len(query_params.Message) > 0 {
 		message.Content = query_params.Message
@@ -145,43 +173,85 @@ func UpdateExistingMessage(db *gorm.DB, message *db_model.Message, query_params
 	}
 
 	// Update the message
-	return message.UpdateMessage(db)
-}
+	err = store.Messages.Update(message)
+	if err != nil {
+		return err
+	}
 
-// ================= Delete =================
+	auditMessageUpdate(store, audit, &before, message, query_params)
+	return nil
+}
 
-// DeleteMessage deletes a message from the database
-func DeleteMessage(db *gorm.DB, id int) error {
-	// Open db connection
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
+// checkMessageModeration checks that the actor may change the moderation status of a message:
+// flagging and censoring need the message.moderate permission, removing needs the message.remove permission
+func checkMessageModeration(audit *AuditContext, query_params *db_model.MessagesPatchRequestParams) error {
+	if len(query_params.Flagged) > 0 || len(query_params.Censored) > 0 {
+		err := checkPermission(audit, constants.PERMISSION_MESSAGE_MODERATE)
 		if err != nil {
 			return err
 		}
-		defer db_model.CloseConnection(db)
 	}
+	if len(query_params.Removed) > 0 {
+		return checkPermission(audit, constants.PERMISSION_MESSAGE_REMOVE)
+	}
+	return nil
+}
 
-	return db_model.DeleteMessage(db, id)
+// auditMessageUpdate records the update of a message when it is a moderation:
+// a change of the flagged, censored or removed status, or an update of someone else's message
+func auditMessageUpdate(store *db_model.Store, audit *AuditContext, before *db_model.Message, after *db_model.Message, query_params *db_model.MessagesPatchRequestParams) {
+	moderation := len(query_params.Flagged) > 0 || len(query_params.Censored) > 0 || len(query_params.Removed) > 0
+	if !moderation && audit.Actor != nil && audit.Actor.ID == after.SenderID {
+		return
+	}
+	recordAuditEvents(store, newAuditEvent(audit, constants.AUDIT_MESSAGE_UPDATE, constants.AUDIT_TARGET_MESSAGE, after.ID, before, after, audit.Reason))
 }
 
-func DeleteMessages(db *gorm.DB, query_params *db_model.MessagesDeleteRequestParams) error {
-	// Open db connection
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return err
-		}
-		defer db_model.CloseConnection(db)
+// ================= Delete =================
+
+// DeleteMessage deletes a message from the database
+func DeleteMessage(store *db_model.Store, audit *AuditContext, id int) error {
+	err := checkPermission(audit, constants.PERMISSION_MESSAGE_REMOVE)
+	if err != nil {
+		return err
+	}
+
+	message, err := store.Messages.GetByID(id)
+	if err != nil {
+		return err
+	}
+
+	err = store.Messages.Delete(message)
+	if err != nil {
+		return err
+	}
+
+	recordAuditEvents(store, newAuditEvent(audit, constants.AUDIT_MESSAGE_DELETE, constants.AUDIT_TARGET_MESSAGE, message.ID, message, nil, audit.Reason))
+	return nil
+}
+
+func DeleteMessages(store *db_model.Store, audit *AuditContext, query_params *db_model.MessagesDeleteRequestParams) error {
+	err := checkPermission(audit, constants.PERMISSION_MESSAGE_REMOVE)
+	if err != nil {
+		return err
 	}
 
 	// Retrieve all messages
-	messages, err := db_model.GetMessages(db, (*db_model.MessagesGetRequestParams)(query_params))
+	messages, err := store.Messages.List((*db_model.MessagesGetRequestParams)(query_params))
 	if err != nil {
 		return err
 	}
 
 	// Delete all messages
-	return db_model.DeleteMessages(db, messages)
+	err = store.Messages.DeleteMany(messages)
+	if err != nil {
+		return err
+	}
+
+	events := make([]*db_model.AuditEvent, len(messages))
+	for i, message := range messages {
+		events[i] = newAuditEvent(audit, constants.AUDIT_MESSAGE_DELETE, constants.AUDIT_TARGET_MESSAGE, message.ID, message, nil, audit.Reason)
+	}
+	recordAuditEvents(store, events...)
+	return nil
 }
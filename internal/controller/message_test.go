@@ -0,0 +1,39 @@
+package db_controller
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+)
+
+func TestMutedUserCannotPost(t *testing.T) {
+	store, admin, user := createAuditTestUsers(t)
+	audit := &AuditContext{Actor: admin}
+
+	// The muted users can not post until the end of their mute
+	bans, err := BanUsers(store, audit, &db_model.BansPostRequestParams{Issuer: admin, Target: []*db_model.User{user}, Type: constants.MUTE_TYPE, Duration: 60, Reason: "Spam"})
+	if err != nil {
+		t.Fatalf("Error muting user: %v", err)
+	}
+	_, err = CreateMessage(store, &db_model.MessagesPostRequestParams{Sender: user, Message: "Hello"})
+	var forbidden *httputils.ForbiddenError
+	if !errors.As(err, &forbidden) {
+		t.Errorf("Error creating message: expected the muted user to be refused, got %v", err)
+	}
+	_, err = CreateMessage(store, &db_model.MessagesPostRequestParams{Sender: admin, Message: "Hello"})
+	if err != nil {
+		t.Errorf("Error creating message as another user: %v", err)
+	}
+
+	err = DeleteBan(store, audit, bans[0].ID)
+	if err != nil {
+		t.Fatalf("Error deleting mute: %v", err)
+	}
+	_, err = CreateMessage(store, &db_model.MessagesPostRequestParams{Sender: user, Message: "Hello"})
+	if err != nil {
+		t.Errorf("Error creating message once the mute ended: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package db_controller
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+	"github.com/boxboxjason/jukebox/pkg/utils/oidcutils"
+)
+
+const (
+	// Length limits of the usernames, see VALID_USERNAME
+	USERNAME_MIN_LENGTH = 3
+	USERNAME_MAX_LENGTH = 20
+	// Number of numbered variants of a username tried before giving up
+	USERNAME_MAX_ATTEMPTS = 100
+	// Username of the users whose claims do not give a usable one
+	OIDC_DEFAULT_USERNAME = "user"
+)
+
+// GetOrCreateUserFromOIDC returns the user linked to the subject of the verified ID token at the provider
+// On first login, a user is created with a unique username derived from the claims and linked to the subject
+// Returns whether the user was created
+func GetOrCreateUserFromOIDC(store *db_model.Store, provider string, claims *oidcutils.Claims) (*db_model.User, bool, error) {
+	// Retrieve the user linked to the subject
+	identity, err := store.Identities.GetBySubject(provider, claims.Subject)
+	if err == nil {
+		if identity.Email != claims.Email {
+			identity.Email = claims.Email
+			err = store.Identities.Update(identity)
+			if err != nil {
+				logger.Error("Unable to update the identity of user", identity.UserID, err)
+			}
+		}
+		return identity.User, false, nil
+	}
+
+	// An account with the same email is not linked automatically, it could be taken over by whoever controls the email at the provider
+	if claims.Email == "" {
+		return nil, false, httputils.NewBadRequestError("The provider did not share the email of the account")
+	}
+	_, err = store.Users.GetByEmail(claims.Email)
+	if err == nil {
+		return nil, false, httputils.NewConflictError("An account already uses this email, sign in with its password")
+	}
+
+	// Create the user, with a random password that can be replaced with a password reset
+	username, err := generateUniqueUsername(store, claims)
+	if err != nil {
+		return nil, false, err
+	}
+	password, err := generateRandomPassword()
+	if err != nil {
+		return nil, false, err
+	}
+	user, err := CreateUser(store, &db_model.UsersPostRequestParams{
+		Username: username,
+		Email:    claims.Email,
+		Password: password,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if claims.EmailVerified {
+		err = setUserEmailVerified(store, user)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	// Link the subject to the user
+	identity = &db_model.UserIdentity{
+		UserID:   user.ID,
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}
+	err = store.Identities.Create(identity)
+	if err != nil {
+		logger.Error("Unable to link user", user.ID, "to its identity at", provider, err)
+		delete_err := store.Users.Delete(user)
+		if delete_err != nil {
+			logger.Error("Unable to delete the unlinked user", user.ID, delete_err)
+		}
+		return nil, false, httputils.NewDatabaseError("unable to link the account to the provider")
+	}
+	logger.Info("User", user.Username, "created from its identity at", provider)
+	return user, true, nil
+}
+
+// generateUniqueUsername returns the first free username derived from the preferred username, the email or the name of the claims
+// Numbers are appended to the username until it is unique
+func generateUniqueUsername(store *db_model.Store, claims *oidcutils.Claims) (string, error) {
+	username := OIDC_DEFAULT_USERNAME
+	email_name, _, _ := strings.Cut(claims.Email, "@")
+	for _, candidate := range []string{claims.PreferredUsername, email_name, claims.Name} {
+		candidate = sanitizeUsername(candidate)
+		if len(candidate) >= USERNAME_MIN_LENGTH {
+			username = candidate
+			break
+		}
+	}
+
+	for attempt := 1; attempt <= USERNAME_MAX_ATTEMPTS; attempt++ {
+		candidate := username
+		if attempt > 1 {
+			suffix := strconv.Itoa(attempt)
+			candidate = username[:min(len(username), USERNAME_MAX_LENGTH-len(suffix))] + suffix
+		}
+		_, err := store.Users.GetByUsername(candidate)
+		if err != nil {
+			return candidate, nil
+		}
+	}
+	return "", httputils.NewConflictError("Unable to find a free username for the account")
+}
+
+// sanitizeUsername replaces the characters refused in the usernames by underscores, and truncates it to the maximum length
+func sanitizeUsername(name string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.TrimSpace(name))
+	sanitized = strings.Trim(sanitized, "_")
+	return sanitized[:min(len(sanitized), USERNAME_MAX_LENGTH)]
+}
+
+// generateRandomPassword returns a password nobody knows, for the users created from an identity
+func generateRandomPassword() (string, error) {
+	random := make([]byte, 48)
+	_, err := rand.Read(random)
+	if err != nil {
+		logger.Error("Unable to generate a random password", err)
+		return "", httputils.NewInternalServerError("unable to create the user")
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
@@ -0,0 +1,87 @@
+package db_controller
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+	"github.com/boxboxjason/jukebox/pkg/utils/oidcutils"
+)
+
+const TEST_PROVIDER = "https://accounts.example.com"
+
+func TestGetOrCreateUserFromOIDC(t *testing.T) {
+	store, _, user := createAuditTestUsers(t)
+
+	// The first login creates a user with a username derived from the claims
+	claims := &oidcutils.Claims{Subject: "subject-1", Email: "jane.doe@example.com", EmailVerified: true, PreferredUsername: "test_user"}
+	created_user, created, err := GetOrCreateUserFromOIDC(store, TEST_PROVIDER, claims)
+	if err != nil {
+		t.Fatalf("Error creating user from identity: %v", err)
+	}
+	if !created || created_user.Username != "test_user2" || !created_user.VerifiedEmail {
+		t.Errorf("Error creating user from identity: unexpected user %+v (created %v)", created_user, created)
+	}
+
+	// The next logins return the linked user
+	claims.Email = "jane@example.com"
+	linked_user, created, err := GetOrCreateUserFromOIDC(store, TEST_PROVIDER, claims)
+	if err != nil || created || linked_user.ID != created_user.ID {
+		t.Errorf("Error retrieving linked user: expected user %d, got %+v (created %v, %v)", created_user.ID, linked_user, created, err)
+	}
+	identity, err := store.Identities.GetBySubject(TEST_PROVIDER, claims.Subject)
+	if err != nil || identity.Email != claims.Email {
+		t.Errorf("Error updating identity email: %+v (%v)", identity, err)
+	}
+
+	// The same subject at another provider is another user
+	other_user, created, err := GetOrCreateUserFromOIDC(store, "https://other.example.com", &oidcutils.Claims{Subject: "subject-1", Email: "jd@example.com", Name: "Jane Doe"})
+	if err != nil || !created || other_user.ID == created_user.ID || other_user.Username != "Jane_Doe" || other_user.VerifiedEmail {
+		t.Errorf("Error creating user from another provider: unexpected user %+v (created %v, %v)", other_user, created, err)
+	}
+
+	// An existing account is not taken over through its email
+	_, _, err = GetOrCreateUserFromOIDC(store, TEST_PROVIDER, &oidcutils.Claims{Subject: "subject-2", Email: user.Email})
+	var http_error httputils.HTTPError
+	if !errors.As(err, &http_error) || http_error.StatusCode() != http.StatusConflict {
+		t.Errorf("Error creating user from identity: expected a conflict, got %v", err)
+	}
+	_, _, err = GetOrCreateUserFromOIDC(store, TEST_PROVIDER, &oidcutils.Claims{Subject: "subject-3"})
+	if err == nil {
+		t.Errorf("Error creating user from identity: missing email accepted")
+	}
+}
+
+func TestGenerateUniqueUsername(t *testing.T) {
+	store := db_model.NewMemoryStore()
+	tests := []struct {
+		claims   *oidcutils.Claims
+		expected string
+	}{
+		{&oidcutils.Claims{PreferredUsername: "jane.doe", Email: "jane@example.com"}, "jane_doe"},
+		{&oidcutils.Claims{PreferredUsername: "jd", Email: "jane@example.com"}, "jane"},
+		{&oidcutils.Claims{Email: "a@example.com", Name: "  Élodie  "}, "lodie"},
+		{&oidcutils.Claims{Email: "a@example.com"}, OIDC_DEFAULT_USERNAME},
+		{&oidcutils.Claims{PreferredUsername: "a_very_long_username_indeed"}, "a_very_long_username"},
+	}
+	for _, test := range tests {
+		username, err := generateUniqueUsername(store, test.claims)
+		if err != nil || username != test.expected {
+			t.Errorf("Error generating username from %+v: expected %s, got %s (%v)", test.claims, test.expected, username, err)
+		}
+	}
+
+	// The numbered variants keep the maximum length
+	for _, username := range []string{"a_very_long_username", "a_very_long_usernam2"} {
+		_, err := CreateUser(store, &db_model.UsersPostRequestParams{Username: username, Email: username + "@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("Error creating user: %v", err)
+		}
+	}
+	username, err := generateUniqueUsername(store, &oidcutils.Claims{PreferredUsername: "a_very_long_username_indeed"})
+	if err != nil || username != "a_very_long_usernam3" || !VALID_USERNAME.MatchString(username) {
+		t.Errorf("Error generating username: expected a_very_long_usernam3, got %s (%v)", username, err)
+	}
+}
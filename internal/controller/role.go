@@ -0,0 +1,89 @@
+package db_controller
+
+import (
+	"github.com/boxboxjason/jukebox/internal/constants"
+	"github.com/boxboxjason/jukebox/internal/middlewares"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+)
+
+// ================= Permissions =================
+
+// checkPermission checks that the actor of the audit context has the permission
+// The actions without an actor are run by the operator of the instance (e.g. the administrative commands) and always allowed
+func checkPermission(audit *AuditContext, permission string) error {
+	if audit == nil || audit.Actor == nil || audit.Actor.HasPermission(permission) {
+		return nil
+	}
+	return httputils.NewForbiddenError("user does not have the " + permission + " permission")
+}
+
+// checkOutranks checks that the actor of the audit context is above the user in the roles hierarchy,
+// so that the moderators can not act against the admins for instance
+func checkOutranks(audit *AuditContext, user *db_model.User) error {
+	if audit == nil || audit.Actor == nil || audit.Actor.Outranks(user) {
+		return nil
+	}
+	return httputils.NewForbiddenError("user does not have permission to act against user: " + user.Username)
+}
+
+// checkSelfOrOutranks checks that the actor of the audit context acts on itself or on a user below it in the roles hierarchy,
+// so that the admins can not update the owners for instance
+func checkSelfOrOutranks(audit *AuditContext, user *db_model.User) error {
+	if audit != nil && audit.Actor != nil && audit.Actor.ID == user.ID {
+		return nil
+	}
+	return checkOutranks(audit, user)
+}
+
+// ================= Update =================
+
+// SetUserRole assigns a role to a user, the last owner of the instance can not be demoted
+// The actors can only grant the roles below theirs to the users below them, only the owners appoint the other owners
+func SetUserRole(store *db_model.Store, audit *AuditContext, user *db_model.User, role string) error {
+	if db_model.RoleRank(role) < 0 {
+		return httputils.NewBadRequestError("Invalid fields: role")
+	}
+	if user.Role == role {
+		return nil
+	}
+	if IsDeletedUser(user) {
+		return httputils.NewForbiddenError("the deleted user can not be given a role")
+	}
+	err := checkPermission(audit, constants.PERMISSION_ROLE_ASSIGN)
+	if err != nil {
+		return err
+	}
+	if audit != nil && audit.Actor != nil && audit.Actor.Role != constants.ROLE_OWNER {
+		if !audit.Actor.Outranks(user) || db_model.RoleRank(role) >= db_model.RoleRank(audit.Actor.Role) {
+			return httputils.NewForbiddenError("user does not have permission to assign the " + role + " role to user: " + user.Username)
+		}
+	}
+	if user.Role == constants.ROLE_OWNER {
+		owners, err := store.Users.List(&db_model.UsersGetRequestParams{Role: []string{constants.ROLE_OWNER}})
+		if err != nil {
+			return httputils.NewDatabaseError("unable to count the owners")
+		}
+		if len(owners) <= 1 {
+			return httputils.NewConflictError("the last owner can not be demoted")
+		}
+	}
+
+	before := *user
+	user.Role = role
+	err = store.Users.Update(user)
+	if err != nil {
+		logger.Error("Unable to update the role of user", user.ID, err)
+		return httputils.NewDatabaseError("unable to update the role of user")
+	}
+	middlewares.DenyUserAccessTokens(user.ID)
+
+	action := constants.AUDIT_USER_DEMOTE
+	if db_model.RoleRank(role) > db_model.RoleRank(before.Role) {
+		action = constants.AUDIT_USER_PROMOTE
+	}
+	logger.Info("Role of user", user.Username, "set to", role)
+	recordAuditEvents(store, newAuditEvent(audit, action, constants.AUDIT_TARGET_USER, user.ID, &before, user, audit.Reason))
+	return nil
+}
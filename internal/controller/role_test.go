@@ -0,0 +1,188 @@
+package db_controller
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+)
+
+// createRoleTestUser creates a user with a role in the store
+func createRoleTestUser(t *testing.T, store *db_model.Store, username string, role string) *db_model.User {
+	user, err := CreateUser(store, &db_model.UsersPostRequestParams{Username: username, Email: username + "@test.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	user.Role = role
+	err = store.Users.Update(user)
+	if err != nil {
+		t.Fatalf("Error saving user: %v", err)
+	}
+	return user
+}
+
+// expectForbidden fails the test unless the error is a 403
+func expectForbidden(t *testing.T, err error, action string) {
+	var http_error httputils.HTTPError
+	if !errors.As(err, &http_error) || http_error.StatusCode() != http.StatusForbidden {
+		t.Errorf("Error %s: expected to be forbidden, got %v", action, err)
+	}
+}
+
+func TestSetUserRolePermissions(t *testing.T) {
+	store := db_model.NewMemoryStore()
+	owner := createRoleTestUser(t, store, "owner", constants.ROLE_OWNER)
+	admin := createRoleTestUser(t, store, "admin", constants.ROLE_ADMIN)
+	moderator := createRoleTestUser(t, store, "moderator", constants.ROLE_MODERATOR)
+	user := createRoleTestUser(t, store, "user", constants.ROLE_USER)
+
+	err := SetUserRole(store, &AuditContext{Actor: owner}, user, "superuser")
+	if err == nil {
+		t.Errorf("Error assigning role: unknown role accepted")
+	}
+
+	// The admins only grant the roles below theirs, to the users below them
+	err = SetUserRole(store, &AuditContext{Actor: admin}, user, constants.ROLE_MODERATOR)
+	if err != nil || user.Role != constants.ROLE_MODERATOR {
+		t.Errorf("Error assigning role: admin unable to appoint a moderator (%v)", err)
+	}
+	expectForbidden(t, SetUserRole(store, &AuditContext{Actor: admin}, user, constants.ROLE_ADMIN), "appointing an admin as an admin")
+	expectForbidden(t, SetUserRole(store, &AuditContext{Actor: admin}, owner, constants.ROLE_USER), "demoting the owner as an admin")
+	expectForbidden(t, SetUserRole(store, &AuditContext{Actor: moderator}, user, constants.ROLE_USER), "assigning a role as a moderator")
+
+	// The owners appoint the admins and the other owners
+	err = SetUserRole(store, &AuditContext{Actor: owner}, admin, constants.ROLE_OWNER)
+	if err != nil {
+		t.Errorf("Error assigning role: owner unable to appoint an owner (%v)", err)
+	}
+	err = SetUserRole(store, &AuditContext{Actor: owner}, owner, constants.ROLE_ADMIN)
+	if err != nil {
+		t.Errorf("Error assigning role: owner unable to step down with another owner left (%v)", err)
+	}
+}
+
+func TestModerationPermissions(t *testing.T) {
+	store := db_model.NewMemoryStore()
+	admin := createRoleTestUser(t, store, "admin", constants.ROLE_ADMIN)
+	moderator := createRoleTestUser(t, store, "moderator", constants.ROLE_MODERATOR)
+	user := createRoleTestUser(t, store, "user", constants.ROLE_USER)
+	message := &db_model.Message{Content: "spam", SenderID: user.ID}
+	err := store.Messages.Create(message)
+	if err != nil {
+		t.Fatalf("Error creating message: %v", err)
+	}
+
+	// The moderators ban the users, but not the admins
+	_, err = BanUsers(store, &AuditContext{Actor: moderator}, &db_model.BansPostRequestParams{Issuer: moderator, Target: []*db_model.User{user}, Type: constants.MUTE_TYPE, Duration: 60})
+	if err != nil {
+		t.Errorf("Error muting user: %v", err)
+	}
+	_, err = BanUsers(store, &AuditContext{Actor: moderator}, &db_model.BansPostRequestParams{Issuer: moderator, Target: []*db_model.User{admin}, Type: constants.MUTE_TYPE, Duration: 60})
+	expectForbidden(t, err, "muting an admin as a moderator")
+	_, err = BanUsers(store, &AuditContext{Actor: user}, &db_model.BansPostRequestParams{Issuer: user, Target: []*db_model.User{moderator}, Type: constants.MUTE_TYPE, Duration: 60})
+	expectForbidden(t, err, "muting as a user")
+
+	// The moderators moderate and remove the messages, the users can not
+	flagged := &db_model.MessagesPatchRequestParams{ID: message.ID, Flagged: []bool{true}}
+	expectForbidden(t, UpdateExistingMessage(store, &AuditContext{Actor: user}, message, flagged), "flagging a message as a user")
+	err = UpdateExistingMessage(store, &AuditContext{Actor: moderator}, message, flagged)
+	if err != nil || !message.Flagged {
+		t.Errorf("Error flagging message: %v", err)
+	}
+	expectForbidden(t, DeleteMessage(store, &AuditContext{Actor: user}, message.ID), "deleting a message as a user")
+	err = DeleteMessage(store, &AuditContext{Actor: moderator}, message.ID)
+	if err != nil {
+		t.Errorf("Error deleting message: %v", err)
+	}
+
+	// Deleting the users is left to the admins, above the users they delete
+	if UserHasPermissionToDeleteUser(moderator, user) {
+		t.Errorf("Error checking deletion permission: moderator allowed to delete a user")
+	}
+	if !UserHasPermissionToDeleteUser(admin, moderator) {
+		t.Errorf("Error checking deletion permission: admin unable to delete a moderator")
+	}
+}
+
+func TestBanUpdatePermissions(t *testing.T) {
+	store := db_model.NewMemoryStore()
+	owner := createRoleTestUser(t, store, "owner", constants.ROLE_OWNER)
+	admin := createRoleTestUser(t, store, "admin", constants.ROLE_ADMIN)
+	moderator := createRoleTestUser(t, store, "moderator", constants.ROLE_MODERATOR)
+	user := createRoleTestUser(t, store, "user", constants.ROLE_USER)
+	owner_audit := &AuditContext{Actor: owner}
+	moderator_audit := &AuditContext{Actor: moderator}
+	bans, err := BanUsers(store, owner_audit, &db_model.BansPostRequestParams{Issuer: owner, Target: []*db_model.User{admin, user}, Type: constants.MUTE_TYPE, Duration: 60, Reason: "Spam"})
+	if err != nil {
+		t.Fatalf("Error muting users: %v", err)
+	}
+	admin_ban, user_ban := bans[0], bans[1]
+
+	// The moderators can not extend, shorten nor lift the bans of the users above them
+	_, err = UpdateBan(store, moderator_audit, &db_model.BansPatchRequestParams{ID: admin_ban.ID, Duration: 3600, Reason: "More spam"})
+	expectForbidden(t, err, "updating the ban of an admin as a moderator")
+	expectForbidden(t, DeleteBan(store, moderator_audit, admin_ban.ID), "lifting the ban of an admin as a moderator")
+	expectForbidden(t, DeleteBans(store, moderator_audit, &db_model.BansDeleteRequestParams{ID: []int{user_ban.ID, admin_ban.ID}}), "lifting the bans of an admin and a user as a moderator")
+	stored_bans, err := GetBans(store, &db_model.BansGetRequestParams{})
+	if err != nil || len(stored_bans) != 2 {
+		t.Fatalf("Error lifting the bans as a moderator: expected the 2 bans kept, got %d (%v)", len(stored_bans), err)
+	}
+	stored_ban, _ := GetBanByID(store, admin_ban.ID)
+	if stored_ban.Reason != "Spam" || !stored_ban.EndsAt.Equal(admin_ban.EndsAt) {
+		t.Errorf("Error updating the ban of an admin as a moderator: ban updated to %+v", stored_ban)
+	}
+
+	// But they still change the bans of the users below them, whoever issued them
+	_, err = UpdateBan(store, moderator_audit, &db_model.BansPatchRequestParams{ID: user_ban.ID, Duration: 3600, Reason: "More spam"})
+	if err != nil {
+		t.Errorf("Error updating the ban of a user as a moderator: %v", err)
+	}
+	err = DeleteBans(store, moderator_audit, &db_model.BansDeleteRequestParams{TargetID: []int{user.ID}})
+	if err != nil {
+		t.Errorf("Error lifting the ban of a user as a moderator: %v", err)
+	}
+	err = DeleteBan(store, owner_audit, admin_ban.ID)
+	if err != nil {
+		t.Errorf("Error lifting the ban of an admin as the owner: %v", err)
+	}
+}
+
+func TestUpdateUserPermissions(t *testing.T) {
+	store := db_model.NewMemoryStore()
+	owner := createRoleTestUser(t, store, "owner", constants.ROLE_OWNER)
+	admin := createRoleTestUser(t, store, "admin", constants.ROLE_ADMIN)
+	other_admin := createRoleTestUser(t, store, "other_admin", constants.ROLE_ADMIN)
+	user := createRoleTestUser(t, store, "user", constants.ROLE_USER)
+
+	// The admins update the users below them, not the owners nor the other admins
+	if !UserHasPermissionToUpdateUser(admin, user) || !UserHasPermissionToUpdateUser(owner, admin) {
+		t.Errorf("Error checking update permission: admin unable to update a user below it")
+	}
+	if UserHasPermissionToUpdateUser(admin, owner) {
+		t.Errorf("Error checking update permission: admin allowed to update the owner")
+	}
+	if UserHasPermissionToUpdateUser(admin, other_admin) {
+		t.Errorf("Error checking update permission: admin allowed to update another admin")
+	}
+	if UserHasPermissionToUpdateUser(user, admin) || !UserHasPermissionToUpdateUser(user, user) {
+		t.Errorf("Error checking update permission: users only update themselves")
+	}
+
+	// Nor reset the two-factor authentication, the lockout or the email of the owners
+	owner.TOTPEnabled = true
+	owner.TOTPSecret = "secret"
+	owner.FailedLogins = 3
+	expectForbidden(t, ResetTwoFactor(store, &AuditContext{Actor: admin}, owner), "resetting the two-factor authentication of the owner as an admin")
+	expectForbidden(t, UnlockUser(store, &AuditContext{Actor: admin}, owner), "unlocking the owner as an admin")
+	expectForbidden(t, VerifyUserEmail(store, &AuditContext{Actor: admin}, owner), "verifying the email of the owner as an admin")
+	if !owner.TOTPEnabled || owner.FailedLogins != 3 {
+		t.Errorf("Error resetting the owner as an admin: the owner was updated")
+	}
+	err := ResetTwoFactor(store, &AuditContext{Actor: owner}, owner)
+	if err != nil {
+		t.Errorf("Error resetting two-factor authentication: owner unable to reset its own (%v)", err)
+	}
+}
@@ -0,0 +1,227 @@
+package db_controller
+
+import (
+	"sort"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	"github.com/boxboxjason/jukebox/internal/middlewares"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+)
+
+// ClientContext describes the client a session is opened or used from
+type ClientContext struct {
+	IP        string
+	UserAgent string
+}
+
+// Session is a login of a user, made of an access token and of the refresh token linked to it
+// Its ID is its family, the ID of its first refresh token, or the ID of the access token when it has none
+type Session struct {
+	ID         int        `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current"`
+}
+
+// sessionsRevokedHandler is called with the access tokens of the revoked sessions, to close what they opened
+var sessionsRevokedHandler func(access_token_ids []int)
+
+// SetSessionsRevokedHandler registers the function called with the IDs of the access tokens deleted by a revocation,
+// so that the connections opened with them (e.g. the websockets) are closed
+func SetSessionsRevokedHandler(handler func(access_token_ids []int)) {
+	sessionsRevokedHandler = handler
+}
+
+// ================= Read =================
+
+// ListUserSessions lists the active sessions of the user, the one of the current token (if any) is flagged
+func ListUserSessions(store *db_model.Store, user *db_model.User, current *db_model.AuthToken) ([]*Session, error) {
+	groups, err := listUserSessionTokens(store, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*Session, 0, len(groups))
+	for session_id, tokens := range groups {
+		session := &Session{ID: session_id}
+		var last_token *db_model.AuthToken
+		for _, token := range tokens {
+			if session.CreatedAt.IsZero() || token.CreatedAt.Before(session.CreatedAt) {
+				session.CreatedAt = token.CreatedAt
+			}
+			expires_at := time.Unix(token.Expiration, 0)
+			if expires_at.After(session.ExpiresAt) {
+				session.ExpiresAt = expires_at
+			}
+			if token.LastUsedAt != nil && (session.LastUsedAt == nil || token.LastUsedAt.After(*session.LastUsedAt)) {
+				session.LastUsedAt = token.LastUsedAt
+				last_token = token
+			}
+			if current != nil && token.ID == current.ID {
+				session.Current = true
+			}
+		}
+		// The client of the last use, or the one the session was opened from
+		if last_token == nil {
+			last_token = tokens[0]
+		}
+		session.IP = last_token.IP
+		session.UserAgent = last_token.UserAgent
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions, nil
+}
+
+// listUserSessionTokens returns the access and refresh tokens of the user, grouped by session ID
+// The sessions whose tokens are all expired or rotated can no longer be used and are left out
+func listUserSessionTokens(store *db_model.Store, user_id int) (map[int][]*db_model.AuthToken, error) {
+	tokens, err := store.Tokens.ListUserTokens(user_id)
+	if err != nil {
+		logger.Error("Unable to list the tokens of user", user_id, err)
+		return nil, httputils.NewDatabaseError("unable to list the sessions of user")
+	}
+
+	// A session is identified by its family, or by its refresh token which the access token points to
+	refresh_tokens := make(map[int]bool)
+	for _, token := range tokens {
+		if token.Type == constants.REFRESH_TOKEN {
+			refresh_tokens[token.ID] = true
+		}
+	}
+
+	groups := make(map[int][]*db_model.AuthToken)
+	for _, token := range tokens {
+		if !isSessionToken(token) {
+			continue
+		}
+		session_id := token.ID
+		if token.FamilyID != nil {
+			session_id = *token.FamilyID
+		} else if token.Type == constants.ACCESS_TOKEN && token.LinkedTokenID != nil && refresh_tokens[*token.LinkedTokenID] {
+			session_id = *token.LinkedTokenID
+		}
+		groups[session_id] = append(groups[session_id], token)
+	}
+
+	// Drop the sessions that can no longer be used
+	for session_id, session_tokens := range groups {
+		expired := true
+		for _, token := range session_tokens {
+			expired = expired && (token.IsExpired() || token.IsRotated())
+		}
+		if expired {
+			delete(groups, session_id)
+		}
+	}
+	return groups, nil
+}
+
+// ================= Delete =================
+
+// RevokeSession logs the user out of one of its sessions
+func RevokeSession(store *db_model.Store, audit *AuditContext, user *db_model.User, session_id int) error {
+	groups, err := listUserSessionTokens(store, user.ID)
+	if err != nil {
+		return err
+	}
+	tokens, ok := groups[session_id]
+	if !ok {
+		return httputils.NewNotFoundError("Session not found")
+	}
+
+	err = deleteSessionTokens(store, tokens)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Session", session_id, "of user", user.Username, "revoked")
+	recordAuditEvents(store, newAuditEvent(audit, constants.AUDIT_USER_SESSION, constants.AUDIT_TARGET_USER, user.ID, nil, map[string]int{"session_id": session_id}, audit.Reason))
+	return nil
+}
+
+// RevokeOtherSessions logs the user out of every session but the one of the current token
+// Without a current token (e.g. when an admin forces the logout of a user), every session is revoked
+// Returns the number of revoked sessions
+func RevokeOtherSessions(store *db_model.Store, audit *AuditContext, user *db_model.User, current *db_model.AuthToken) (int, error) {
+	groups, err := listUserSessionTokens(store, user.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	var tokens []*db_model.AuthToken
+	revoked := 0
+	for _, session_tokens := range groups {
+		is_current := false
+		for _, token := range session_tokens {
+			is_current = is_current || (current != nil && token.ID == current.ID)
+		}
+		if !is_current {
+			tokens = append(tokens, session_tokens...)
+			revoked++
+		}
+	}
+
+	err = deleteSessionTokens(store, tokens)
+	if err != nil {
+		return 0, err
+	}
+
+	logger.Info(revoked, "sessions of user", user.Username, "revoked")
+	recordAuditEvents(store, newAuditEvent(audit, constants.AUDIT_USER_LOGOUT, constants.AUDIT_TARGET_USER, user.ID, nil, map[string]int{"sessions": revoked}, audit.Reason))
+	return revoked, nil
+}
+
+// deleteSessionTokens deletes the tokens of revoked sessions and closes what their access tokens opened
+func deleteSessionTokens(store *db_model.Store, tokens []*db_model.AuthToken) error {
+	for _, token := range tokens {
+		err := store.Tokens.Delete(token)
+		if err != nil {
+			logger.Error("Unable to delete token", token.ID, err)
+			return httputils.NewDatabaseError("unable to revoke the session")
+		}
+	}
+	notifySessionsRevoked(tokens)
+	return nil
+}
+
+// deleteUserTokens deletes every token of the user and closes what its access tokens opened
+func deleteUserTokens(store *db_model.Store, user_id int) error {
+	tokens, err := store.Tokens.ListUserTokens(user_id)
+	if err != nil {
+		return err
+	}
+	err = store.Tokens.DeleteUserTokens(user_id)
+	if err != nil {
+		return err
+	}
+	notifySessionsRevoked(tokens)
+	return nil
+}
+
+// notifySessionsRevoked passes the access tokens among the deleted tokens to the registered handler,
+// and denies the signed access tokens issued for them which are not checked against the database
+func notifySessionsRevoked(tokens []*db_model.AuthToken) {
+	var access_token_ids []int
+	for _, token := range tokens {
+		if token.Type == constants.ACCESS_TOKEN {
+			access_token_ids = append(access_token_ids, token.ID)
+		}
+	}
+	if len(access_token_ids) == 0 {
+		return
+	}
+	middlewares.DenyAccessTokens(access_token_ids)
+	if sessionsRevokedHandler != nil {
+		sessionsRevokedHandler(access_token_ids)
+	}
+}
@@ -0,0 +1,101 @@
+package db_controller
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+)
+
+func TestUserSessions(t *testing.T) {
+	store, admin, user := createAuditTestUsers(t)
+	var revoked_ids []int
+	SetSessionsRevokedHandler(func(access_token_ids []int) {
+		revoked_ids = append(revoked_ids, access_token_ids...)
+	})
+	defer SetSessionsRevokedHandler(nil)
+
+	// Every login opens a session recording its client
+	clients := []*ClientContext{{IP: "192.0.2.1", UserAgent: "Firefox"}, {IP: "192.0.2.2", UserAgent: "curl"}, {IP: "192.0.2.3", UserAgent: "Chrome"}}
+	for _, client := range clients {
+		_, _, err := GenerateUserAuthTokens(store, client, user)
+		if err != nil {
+			t.Fatalf("Error generating tokens: %v", err)
+		}
+	}
+	tokens, err := store.Tokens.ListUserTokens(user.ID)
+	if err != nil || len(tokens) != 6 {
+		t.Fatalf("Error listing tokens: expected 6 tokens, got %d (%v)", len(tokens), err)
+	}
+	current := tokens[0]
+
+	sessions, err := ListUserSessions(store, user, current)
+	if err != nil || len(sessions) != 3 {
+		t.Fatalf("Error listing sessions: expected 3 sessions, got %d (%v)", len(sessions), err)
+	}
+	for i, session := range sessions {
+		if session.IP != clients[i].IP || session.UserAgent != clients[i].UserAgent || session.Current != (i == 0) {
+			t.Errorf("Error listing sessions: unexpected session %+v", session)
+		}
+	}
+
+	// A session is revoked with both of its tokens
+	audit := &AuditContext{Actor: user, IP: "192.0.2.1"}
+	err = RevokeSession(store, audit, user, sessions[1].ID)
+	if err != nil {
+		t.Fatalf("Error revoking session: %v", err)
+	}
+	if len(revoked_ids) != 1 {
+		t.Errorf("Error revoking session: expected 1 closed access token, got %v", revoked_ids)
+	}
+	err = RevokeSession(store, audit, user, sessions[1].ID)
+	var http_error httputils.HTTPError
+	if !errors.As(err, &http_error) || http_error.StatusCode() != http.StatusNotFound {
+		t.Errorf("Error revoking session: expected the revoked session to be not found, got %v", err)
+	}
+	_, admin_refresh, err := GenerateUserAuthTokens(store, nil, admin)
+	if err != nil || admin_refresh == "" {
+		t.Fatalf("Error generating tokens: %v", err)
+	}
+	admin_tokens, _ := store.Tokens.ListUserTokens(admin.ID)
+	err = RevokeSession(store, audit, user, admin_tokens[1].ID)
+	if err == nil {
+		t.Errorf("Error revoking session: the session of another user was revoked")
+	}
+
+	// The other sessions are revoked, the current one is kept
+	revoked, err := RevokeOtherSessions(store, audit, user, current)
+	if err != nil || revoked != 1 {
+		t.Errorf("Error revoking other sessions: expected 1 revoked session, got %d (%v)", revoked, err)
+	}
+	sessions, err = ListUserSessions(store, user, current)
+	if err != nil || len(sessions) != 1 || !sessions[0].Current {
+		t.Errorf("Error listing sessions: expected the current session only, got %+v (%v)", sessions, err)
+	}
+
+	// An admin logs the user out of every session
+	revoked, err = RevokeOtherSessions(store, &AuditContext{Actor: admin}, user, nil)
+	if err != nil || revoked != 1 || len(revoked_ids) != 3 {
+		t.Errorf("Error forcing logout: expected 1 revoked session and 3 closed access tokens, got %d and %v (%v)", revoked, revoked_ids, err)
+	}
+	tokens, _ = store.Tokens.ListUserTokens(user.ID)
+	if len(tokens) != 0 {
+		t.Errorf("Error forcing logout: %d tokens left", len(tokens))
+	}
+
+	// The revocations are audited
+	events, err := GetAuditEvents(store, &db_model.AuditGetRequestParams{TargetType: []string{constants.AUDIT_TARGET_USER}, TargetID: []int{user.ID}})
+	if err != nil {
+		t.Fatalf("Error listing audit events: %v", err)
+	}
+	actions := map[string]int{}
+	for _, event := range events {
+		actions[event.Action]++
+	}
+	if actions[constants.AUDIT_USER_SESSION] != 1 || actions[constants.AUDIT_USER_LOGOUT] != 2 {
+		t.Errorf("Error auditing revocations: unexpected actions %v", actions)
+	}
+}
@@ -0,0 +1,74 @@
+package db_controller
+
+import (
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+)
+
+// InstanceStats summarizes the content of a JukeBox instance
+type InstanceStats struct {
+	Users            int `json:"users"`
+	Admins           int `json:"admins"`
+	Moderators       int `json:"moderators"`
+	PendingDeletions int `json:"pending_deletions"`
+	Messages         int `json:"messages"`
+	FlaggedMessages  int `json:"flagged_messages"`
+	RemovedMessages  int `json:"removed_messages"`
+	ActiveBans       int `json:"active_bans"`
+	ActiveMutes      int `json:"active_mutes"`
+}
+
+// GetInstanceStats counts the users, the messages and the active bans and mutes of the instance
+func GetInstanceStats(store *db_model.Store) (*InstanceStats, error) {
+	stats := &InstanceStats{}
+
+	users, err := store.Users.List(&db_model.UsersGetRequestParams{})
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if IsDeletedUser(user) {
+			continue
+		}
+		stats.Users++
+		switch user.Role {
+		case constants.ROLE_OWNER, constants.ROLE_ADMIN:
+			stats.Admins++
+		case constants.ROLE_MODERATOR:
+			stats.Moderators++
+		}
+		if user.DeletionDueAt != nil {
+			stats.PendingDeletions++
+		}
+	}
+
+	messages, err := store.Messages.List(&db_model.MessagesGetRequestParams{})
+	if err != nil {
+		return nil, err
+	}
+	stats.Messages = len(messages)
+	for _, message := range messages {
+		if message.Flagged {
+			stats.FlaggedMessages++
+		}
+		if message.Removed {
+			stats.RemovedMessages++
+		}
+	}
+
+	bans, err := store.Bans.List(&db_model.BansGetRequestParams{EndsAfter: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	for _, ban := range bans {
+		if ban.Type == constants.MUTE_TYPE {
+			stats.ActiveMutes++
+		} else {
+			stats.ActiveBans++
+		}
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,35 @@
+package db_controller
+
+import (
+	"testing"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+)
+
+func TestGetInstanceStats(t *testing.T) {
+	store, admin, user := createAuditTestUsers(t)
+	err := store.Users.Update(admin)
+	if err != nil {
+		t.Fatalf("Error saving admin: %v", err)
+	}
+	for _, message := range []*db_model.Message{{Content: "hello", SenderID: user.ID}, {Content: "spam", SenderID: user.ID, Flagged: true}} {
+		err = store.Messages.Create(message)
+		if err != nil {
+			t.Fatalf("Error creating message: %v", err)
+		}
+	}
+	_, err = BanUsers(store, &AuditContext{Actor: admin}, &db_model.BansPostRequestParams{Issuer: admin, Target: []*db_model.User{user}, Type: constants.MUTE_TYPE, Duration: 60})
+	if err != nil {
+		t.Fatalf("Error muting user: %v", err)
+	}
+
+	stats, err := GetInstanceStats(store)
+	if err != nil {
+		t.Fatalf("Error retrieving stats: %v", err)
+	}
+	expected := InstanceStats{Users: 2, Admins: 1, Messages: 2, FlaggedMessages: 1, ActiveMutes: 1}
+	if *stats != expected {
+		t.Errorf("Error retrieving stats: expected %+v, got %+v", expected, *stats)
+	}
+}
@@ -1,6 +1,8 @@
 package db_controller
 
 import (
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/boxboxjason/jukebox/internal/constants"
@@ -9,71 +11,84 @@ import (
 	"github.com/boxboxjason/jukebox/pkg/logger"
 	"github.com/boxboxjason/jukebox/pkg/utils/cryptutils"
 	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
-	"gorm.io/gorm"
+	"github.com/boxboxjason/jukebox/pkg/utils/mailutils"
+)
+
+// rotatedSession holds the bearers that replaced a refresh token, handed out again to the concurrent refreshes with the same token
+type rotatedSession struct {
+	user_id        int
+	username       string
+	access_bearer  string
+	refresh_bearer string
+	expires_at     time.Time
+}
+
+var (
+	// The sessions that replaced a refresh token during the reuse grace period, by hash of the replaced token
+	rotated_sessions       = map[string]*rotatedSession{}
+	rotated_sessions_mutex sync.Mutex
 )
 
 // ================= CRUD Operations =================
 
 // ================= Create =================
 
-// GenerateUserAuthTokens generates an access token and a refresh token for the user
-func GenerateUserAuthTokens(db *gorm.DB, user *db_model.User) (string, string, error) {
-	// Open db connection
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return "", "", err
-		}
-		defer db_model.CloseConnection(db)
-	}
-
+// GenerateUserAuthTokens generates an access token and a refresh token for the user, opening a session from the client
+func GenerateUserAuthTokens(store *db_model.Store, client *ClientContext, user *db_model.User) (string, string, error) {
 	// Generate the access token for the user
-	access_token, access_string, err := createUserToken(db, user, constants.ACCESS_TOKEN)
+	access_token, access_string, err := newUserToken(store, client, user, constants.ACCESS_TOKEN)
 	if err != nil {
 		return "", "", err
 	}
 
 	// Generate refresh token for the user
-	refresh_token, refresh_string, err := createUserToken(db, user, constants.REFRESH_TOKEN)
+	refresh_token, refresh_string, err := newUserToken(store, client, user, constants.REFRESH_TOKEN)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Link the tokens of the session
+	err = linkSessionTokens(store, access_token, refresh_token)
 	if err != nil {
 		return "", "", err
 	}
 
+	access_string, err = issueAccessBearer(store, access_token, user, access_string)
+	if err != nil {
+		return "", "", err
+	}
+	return access_string, refresh_string, nil
+}
+
+// linkSessionTokens links the access token and the refresh token of a session to each other, in the family of the refresh token
+func linkSessionTokens(store *db_model.Store, access_token *db_model.AuthToken, refresh_token *db_model.AuthToken) error {
+	family_id := sessionFamilyID(refresh_token)
+	access_token.FamilyID = &family_id
+	refresh_token.FamilyID = &family_id
+
 	// Link the refresh token to the access token
 	refresh_token.LinkedToken = access_token
-	err = refresh_token.UpdateAuthToken(db)
+	err := store.Tokens.Update(refresh_token)
 	if err != nil {
-		logger.Error("Unable to link the refresh token to the access token for user", user.Username)
-		return "", "", httputils.NewInternalServerError("Unable to link the refresh token to the access token")
+		logger.Error("Unable to link the refresh token to the access token for user", refresh_token.User.Username)
+		return httputils.NewInternalServerError("Unable to link the refresh token to the access token")
 	}
 
 	// Link the access token to the refresh token
 	access_token.LinkedToken = refresh_token
-	err = access_token.UpdateAuthToken(db)
+	err = store.Tokens.Update(access_token)
 	if err != nil {
-		logger.Error("Unable to link the access token to the refresh token for user", user.Username)
-		return "", "", httputils.NewInternalServerError("Unable to link the access token to the refresh token")
+		logger.Error("Unable to link the access token to the refresh token for user", access_token.User.Username)
+		return httputils.NewInternalServerError("Unable to link the access token to the refresh token")
 	}
-
-	return access_string, refresh_string, nil
+	return nil
 }
 
-// createUserToken creates a token for the user depending on the token type
-func createUserToken(db *gorm.DB, user *db_model.User, token_type string) (*db_model.AuthToken, string, error) {
-	// Open db connection
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return &db_model.AuthToken{}, "", err
-		}
-		defer db_model.CloseConnection(db)
-	}
-
+// newUserToken creates a token of the given type for the user, and returns it with its identity bearer
+// The client the token is issued to is recorded on it when known
+func newUserToken(store *db_model.Store, client *ClientContext, user *db_model.User, token_type string) (*db_model.AuthToken, string, error) {
 	// Generate an auth token for the user
-
-	string_token, hashed_string_token, err := cryptutils.GenerateHashedToken()
+	selector, verifier, hashed_verifier, err := cryptutils.GenerateSplitToken()
 	if err != nil {
 		logger.Error(err)
 		return &db_model.AuthToken{}, "", err
@@ -81,102 +96,256 @@ func createUserToken(db *gorm.DB, user *db_model.User, token_type string) (*db_m
 
 	token := db_model.AuthToken{
 		User:         user,
-		Hashed_Token: hashed_string_token,
+		Selector:     &selector,
+		Hashed_Token: hashed_verifier,
 		Type:         token_type,
 		Expiration:   calculateExpirationTime(token_type),
 	}
+	if client != nil {
+		token.IP = client.IP
+		token.UserAgent = client.UserAgent
+	}
 
 	// Create the token in the database
-	err = token.CreateAuthToken(db)
+	err = store.Tokens.Create(&token)
 	if err != nil {
 		logger.Error("Unable to create", token_type, "token for user", user.Username)
 		return &db_model.AuthToken{}, "", err
 	}
 
-	return &token, middlewares.EncodeUserAndTokenToIdentityBearer(user.ID, string_token), nil
+	return &token, middlewares.EncodeIdentityBearer(selector, verifier), nil
+}
+
+// issueAccessBearer returns the bearer the client authenticates with, the identity bearer of the access token
+// or, when they are enabled, a signed access token carrying the user, its role and its current ban
+// The access token must be linked to its session first, the signed token carries the session ID
+// The signed tokens issued before for the same access token are denied, like its previous identity bearer
+func issueAccessBearer(store *db_model.Store, access_token *db_model.AuthToken, user *db_model.User, identity_bearer string) (string, error) {
+	if !middlewares.SignedAccessTokensEnabled() {
+		return identity_bearer, nil
+	}
+	middlewares.DenyAccessTokens([]int{access_token.ID})
+
+	now := time.Now()
+	bans, err := store.Bans.ListActiveBans(user.ID)
+	if err != nil {
+		logger.Error("Unable to retrieve the bans of user", user.ID, err)
+		return "", httputils.NewDatabaseError("unable to issue the access token")
+	}
+	var ban *db_model.Ban
+	if len(bans) > 0 {
+		ban = bans[0]
+	}
+
+	signed_token, err := middlewares.SignAccessToken(middlewares.NewAccessClaims(user, access_token, ban, now))
+	if err != nil {
+		logger.Error("Unable to sign the access token of user", user.ID, err)
+		return "", httputils.NewInternalServerError("Unable to sign the access token")
+	}
+	return signed_token, nil
+}
+
+// sessionFamilyID returns the family of a session token, the ID of the first refresh token of the session
+// The tokens issued before the families start their own
+func sessionFamilyID(token *db_model.AuthToken) int {
+	if token.FamilyID != nil {
+		return *token.FamilyID
+	}
+	return token.ID
+}
+
+// isSessionToken checks if the token is an access or a refresh token, the other tokens are single-use links
+func isSessionToken(token *db_model.AuthToken) bool {
+	return token.Type == constants.ACCESS_TOKEN || token.Type == constants.REFRESH_TOKEN
 }
 
 // calculateExpirationTime calculates the expiration time of the token
 func calculateExpirationTime(token_type string) int64 {
-	return time.Now().Add(time.Duration(constants.TOKEN_EXPIRATION_MAP[token_type]) * time.Hour).Unix()
+	return time.Now().Add(constants.TOKEN_EXPIRATION_MAP[token_type]).Unix()
 }
 
 // ================= Read =================
 
 // ================= Update =================
 
-// RefreshToken refreshes a token with a new hash value
-func RefreshToken(db *gorm.DB, token *db_model.AuthToken) (string, error) {
-	// Open db connection
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return "", err
-		}
-		defer db_model.CloseConnection(db)
-	}
-
-	// Generate new token and hash
-	new_token_string, new_token_string_hash, err := cryptutils.GenerateHashedToken()
+// RefreshToken refreshes a token with a new selector and a new verifier
+// The tokens issued before the selectors are migrated to them on the way
+func RefreshToken(store *db_model.Store, token *db_model.AuthToken) (string, error) {
+	// Generate new selector and verifier
+	selector, verifier, hashed_verifier, err := cryptutils.GenerateSplitToken()
 	if err != nil {
 		logger.Error("Unable to generate new token", err)
 		return "", err
 	}
 
 	// Update the token with the new hash
-	token.Hashed_Token = new_token_string_hash
+	token.Selector = &selector
+	token.Hashed_Token = hashed_verifier
 	token.Expiration = calculateExpirationTime(token.Type)
-	err = token.UpdateAuthToken(db)
+	err = store.Tokens.Update(token)
 	if err != nil {
 		logger.Error("Unable to update token", err)
 		return "", err
 	}
 
-	return middlewares.EncodeUserAndTokenToIdentityBearer(token.User.ID, new_token_string), nil
+	return middlewares.EncodeIdentityBearer(selector, verifier), nil
+}
+
+// rotateRefreshToken replaces a refresh token by a new one of its family, returned with its identity bearer
+// The replaced token is unlinked from the session and kept as rotated until it expires, so that its reuse is detected
+// Returns no token if a concurrent refresh rotated the token first
+// The caller links the access token of the session to the new refresh token
+func rotateRefreshToken(store *db_model.Store, client *ClientContext, refresh_token *db_model.AuthToken) (*db_model.AuthToken, string, error) {
+	new_refresh_token, refresh_token_string, err := newUserToken(store, client, refresh_token.User, constants.REFRESH_TOKEN)
+	if err != nil {
+		return nil, "", err
+	}
+	family_id := sessionFamilyID(refresh_token)
+	new_refresh_token.FamilyID = &family_id
+
+	// Rotate the replaced token, the token replacing it is dropped if a concurrent refresh rotated it first
+	rotated, err := store.Tokens.Rotate(refresh_token, family_id, time.Now())
+	if err == nil && !rotated {
+		err = store.Tokens.Delete(new_refresh_token)
+		if err == nil {
+			return nil, "", nil
+		}
+	}
+	if err != nil {
+		logger.Error("Unable to rotate the refresh token", refresh_token.ID, err)
+		return nil, "", httputils.NewDatabaseError("unable to rotate the refresh token")
+	}
+	return new_refresh_token, refresh_token_string, nil
+}
+
+// rememberRotatedSession keeps the bearers that replaced a refresh token for the reuse grace period, and forgets the older ones
+func rememberRotatedSession(rotated_token *db_model.AuthToken, session *rotatedSession) {
+	rotated_sessions_mutex.Lock()
+	defer rotated_sessions_mutex.Unlock()
+
+	now := time.Now()
+	for hashed_token, rotated_session := range rotated_sessions {
+		if !now.Before(rotated_session.expires_at) {
+			delete(rotated_sessions, hashed_token)
+		}
+	}
+	session.expires_at = now.Add(constants.REFRESH_TOKEN_REUSE_GRACE)
+	rotated_sessions[rotated_token.Hashed_Token] = session
+}
+
+// getRotatedSession returns the bearers that replaced a refresh token, until the reuse grace period is over
+func getRotatedSession(rotated_token *db_model.AuthToken) (*rotatedSession, bool) {
+	rotated_sessions_mutex.Lock()
+	defer rotated_sessions_mutex.Unlock()
+
+	session, found := rotated_sessions[rotated_token.Hashed_Token]
+	if !found || !time.Now().Before(session.expires_at) {
+		return nil, false
+	}
+	return session, true
+}
+
+// touchSessionToken records the use of a session token by the client, a failure does not prevent the use
+func touchSessionToken(store *db_model.Store, client *ClientContext, token *db_model.AuthToken) {
+	if client == nil {
+		return
+	}
+	err := store.Tokens.Touch(token, time.Now(), client.IP, client.UserAgent)
+	if err != nil {
+		logger.Error("Unable to record the use of token", token.ID, err)
+	}
 }
 
 // ================= Delete =================
 
-func DeleteToken(db *gorm.DB, token *db_model.AuthToken) error {
-	// Open db connection
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
+// DeleteToken deletes a token and the token linked to it, or every token of its session family if it has one
+func DeleteToken(store *db_model.Store, token *db_model.AuthToken) error {
+	if token.FamilyID != nil {
+		tokens, err := store.Tokens.ListFamilyTokens(*token.FamilyID)
 		if err != nil {
+			logger.Error("Unable to list the tokens of session", *token.FamilyID, err)
 			return err
 		}
-		defer db_model.CloseConnection(db)
+		return deleteSessionTokens(store, tokens)
 	}
 
-	linked_token, err := token.GetLinkedToken(db)
+	linked_token, err := store.Tokens.GetLinkedToken(token)
 	if err == nil {
-		err = linked_token.DeleteAuthToken(db)
+		err = store.Tokens.Delete(linked_token)
 		if err != nil {
 			logger.Error("Unable to delete linked token")
 			return err
 		}
+		notifySessionsRevoked([]*db_model.AuthToken{linked_token})
 	}
 
-	err = token.DeleteAuthToken(db)
+	err = store.Tokens.Delete(token)
 	if err != nil {
 		logger.Error("Unable to delete token")
 		return err
 	}
+	notifySessionsRevoked([]*db_model.AuthToken{token})
 
 	return nil
 }
 
-// DeleteExpiredTokens deletes all expired tokens from the database
-func DeleteExpiredTokens(db *gorm.DB) error {
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return err
-		}
-		defer db_model.CloseConnection(db)
+// revokeReusedSession revokes the session family of a rotated refresh token that was used again
+// Either the token or the session was stolen, and the legitimate client can not be told from the thief, so both are logged out
+// The reuse is audited and, unless disabled, the user is warned by mail
+func revokeReusedSession(store *db_model.Store, mailer mailutils.Mailer, client *ClientContext, refresh_token *db_model.AuthToken) {
+	family_id := sessionFamilyID(refresh_token)
+	tokens, err := store.Tokens.ListFamilyTokens(family_id)
+	if err == nil {
+		err = deleteSessionTokens(store, tokens)
+	}
+	if err != nil {
+		logger.Error("Unable to revoke the session", family_id, "of user", refresh_token.UserID, err)
+	}
+
+	ip := ""
+	if client != nil {
+		ip = client.IP
 	}
+	logger.Error("Rotated refresh token of user", refresh_token.UserID, "used again from", ip, "- session", family_id, "revoked")
+	recordAuditEvents(store, newAuditEvent(&AuditContext{IP: ip}, constants.AUDIT_USER_REUSE, constants.AUDIT_TARGET_USER, refresh_token.UserID,
+		nil, map[string]int{"session_id": family_id, "revoked_tokens": len(tokens)}, "refresh token reused"))
 
-	return db_model.DeleteExpiredTokens(db)
+	user := refresh_token.User
+	if !constants.NOTIFY_REFRESH_REUSE || mailer == nil || user == nil || IsDeletedUser(user) {
+		return
+	}
+	user_agent := ""
+	if client != nil {
+		user_agent = client.UserAgent
+	}
+	err = mailer.Send(&mailutils.Mail{
+		To:      user.Email,
+		Subject: "A JukeBox session was signed out",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"An old sign-in token of your JukeBox account was used again, from the address %s (%s).\n"+
+			"It may have been stolen, so the session it belonged to was signed out on every device.\n\n"+
+			"If you just signed in again, ignore this mail. Otherwise, change your password and review your sessions.\n",
+			user.Username, ip, user_agent),
+	})
+	if err != nil {
+		logger.Error("Unable to send the refresh token reuse mail to user", user.ID, err)
+	}
+}
+
+// RevokeUserTokens deletes every token of a user, logging it out of every session
+func RevokeUserTokens(store *db_model.Store, audit *AuditContext, user *db_model.User) error {
+	err := deleteUserTokens(store, user.ID)
+	if err != nil {
+		logger.Error("Unable to revoke the tokens of user", user.ID, err)
+		return err
+	}
+
+	logger.Info("Tokens of user", user.Username, "revoked")
+	recordAuditEvents(store, newAuditEvent(audit, constants.AUDIT_USER_LOGOUT, constants.AUDIT_TARGET_USER, user.ID, nil, nil, audit.Reason))
+	return nil
+}
+
+// DeleteExpiredTokens deletes all expired tokens from the database
+func DeleteExpiredTokens(store *db_model.Store) error {
+	return store.Tokens.DeleteExpired()
 }
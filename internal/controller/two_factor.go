@@ -0,0 +1,261 @@
+package db_controller
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	"github.com/boxboxjason/jukebox/internal/middlewares"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
+	"github.com/boxboxjason/jukebox/pkg/utils/cryptutils"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+	"github.com/boxboxjason/jukebox/pkg/utils/totputils"
+)
+
+const (
+	// Number of characters of a recovery code, without the separator
+	RECOVERY_CODE_LENGTH = 10
+)
+
+// recoveryCodeEncoding is the alphabet of the recovery codes, lowercase base32 is easy to read and to type
+var recoveryCodeEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// TwoFactorRequiredError is returned by LoginUserFromPassword when the password is correct but the user
+// enabled two-factor authentication, the challenge has to be sent back along with a code to receive the tokens
+type TwoFactorRequiredError struct {
+	Challenge string
+}
+
+func (e *TwoFactorRequiredError) Error() string {
+	return "two-factor authentication code required"
+}
+
+// TwoFactorSetup is the secret of a pending two-factor authentication enrollment
+type TwoFactorSetup struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+// ================= Enrollment =================
+
+// SetupTwoFactor generates a new TOTP secret for the user, that is only enabled once a code generated from it is confirmed
+// Calling it again replaces the pending secret
+func SetupTwoFactor(store *db_model.Store, user *db_model.User) (*TwoFactorSetup, error) {
+	if user.TOTPEnabled {
+		return nil, httputils.NewConflictError("two-factor authentication is already enabled")
+	}
+	if IsDeletedUser(user) {
+		return nil, httputils.NewForbiddenError("the deleted user can not enable two-factor authentication")
+	}
+
+	secret, err := totputils.GenerateSecret()
+	if err != nil {
+		logger.Error("Unable to generate the TOTP secret of user", user.ID, err)
+		return nil, httputils.NewInternalServerError("unable to generate the two-factor secret")
+	}
+
+	user.TOTPSecret = secret
+	user.TOTPLastStep = 0
+	err = store.Users.Update(user)
+	if err != nil {
+		logger.Error("Unable to save the TOTP secret of user", user.ID, err)
+		return nil, httputils.NewDatabaseError("unable to save the two-factor secret")
+	}
+
+	return &TwoFactorSetup{
+		Secret:          secret,
+		ProvisioningURI: totputils.ProvisioningURI(constants.TOTP_ISSUER, user.Username, secret),
+	}, nil
+}
+
+// EnableTwoFactor enables two-factor authentication once the user proves its authenticator generates the codes of the pending secret
+// Returns the one-time recovery codes, only their hashes are stored so they can not be shown again
+func EnableTwoFactor(store *db_model.Store, audit *AuditContext, user *db_model.User, code string) ([]string, error) {
+	if user.TOTPEnabled {
+		return nil, httputils.NewConflictError("two-factor authentication is already enabled")
+	}
+	if user.TOTPSecret == "" {
+		return nil, httputils.NewBadRequestError("set up two-factor authentication before enabling it")
+	}
+
+	step, ok := totputils.ValidateCode(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return nil, httputils.NewBadRequestError("Invalid two-factor code")
+	}
+
+	recovery_codes, hashed_recovery_codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+	user.RecoveryCodes = strings.Join(hashed_recovery_codes, "\n")
+	err = store.Users.Update(user)
+	if err != nil {
+		logger.Error("Unable to enable the two-factor authentication of user", user.ID, err)
+		return nil, httputils.NewDatabaseError("unable to enable two-factor authentication")
+	}
+	middlewares.DenyUserAccessTokens(user.ID)
+
+	logger.Info("Two-factor authentication enabled for user", user.Username)
+	recordAuditEvents(store, newAuditEvent(audit, constants.AUDIT_USER_2FA_ON, constants.AUDIT_TARGET_USER, user.ID, nil, nil, audit.Reason))
+	return recovery_codes, nil
+}
+
+// DisableTwoFactor disables the two-factor authentication of the user, with a code of its authenticator or a recovery code
+func DisableTwoFactor(store *db_model.Store, audit *AuditContext, user *db_model.User, code string) error {
+	if !user.TOTPEnabled {
+		return httputils.NewConflictError("two-factor authentication is not enabled")
+	}
+	ok, err := verifyTwoFactorCode(store, user, code)
+	if err != nil {
+		return err
+	} else if !ok {
+		return httputils.NewBadRequestError("Invalid two-factor code")
+	}
+
+	err = clearTwoFactor(store, user)
+	if err != nil {
+		return err
+	}
+	logger.Info("Two-factor authentication disabled for user", user.Username)
+	recordAuditEvents(store, newAuditEvent(audit, constants.AUDIT_USER_2FA_OFF, constants.AUDIT_TARGET_USER, user.ID, nil, nil, audit.Reason))
+	return nil
+}
+
+// ResetTwoFactor disables the two-factor authentication of a user that lost its authenticator and its recovery codes, for the admins
+func ResetTwoFactor(store *db_model.Store, audit *AuditContext, user *db_model.User) error {
+	if !user.TOTPEnabled && user.TOTPSecret == "" {
+		return nil
+	}
+	err := checkSelfOrOutranks(audit, user)
+	if err != nil {
+		return err
+	}
+
+	err = clearTwoFactor(store, user)
+	if err != nil {
+		return err
+	}
+	logger.Info("Two-factor authentication of user", user.Username, "reset by an admin")
+	recordAuditEvents(store, newAuditEvent(audit, constants.AUDIT_USER_2FA_OFF, constants.AUDIT_TARGET_USER, user.ID, nil, nil, audit.Reason))
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user, with a code of its authenticator or a recovery code
+func RegenerateRecoveryCodes(store *db_model.Store, user *db_model.User, code string) ([]string, error) {
+	if !user.TOTPEnabled {
+		return nil, httputils.NewConflictError("two-factor authentication is not enabled")
+	}
+	ok, err := verifyTwoFactorCode(store, user, code)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, httputils.NewBadRequestError("Invalid two-factor code")
+	}
+
+	recovery_codes, hashed_recovery_codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	user.RecoveryCodes = strings.Join(hashed_recovery_codes, "\n")
+	err = store.Users.Update(user)
+	if err != nil {
+		logger.Error("Unable to save the recovery codes of user", user.ID, err)
+		return nil, httputils.NewDatabaseError("unable to save the recovery codes")
+	}
+
+	logger.Info("Recovery codes of user", user.Username, "regenerated")
+	return recovery_codes, nil
+}
+
+// ================= Verification =================
+
+// verifyTwoFactorCode checks a code of the authenticator of the user or one of its recovery codes
+// A TOTP code is accepted once, and a recovery code is consumed when it matches
+func verifyTwoFactorCode(store *db_model.Store, user *db_model.User, code string) (bool, error) {
+	step, ok := totputils.ValidateCode(user.TOTPSecret, code, time.Now())
+	if ok {
+		// Refuse the replay of a code that was already accepted
+		if step <= user.TOTPLastStep {
+			return false, nil
+		}
+		user.TOTPLastStep = step
+		err := store.Users.Update(user)
+		if err != nil {
+			logger.Error("Unable to save the last TOTP step of user", user.ID, err)
+			return false, httputils.NewDatabaseError("unable to verify the two-factor code")
+		}
+		return true, nil
+	}
+
+	recovery_code := normalizeRecoveryCode(code)
+	if len(recovery_code) != RECOVERY_CODE_LENGTH || user.RecoveryCodes == "" {
+		return false, nil
+	}
+	hashed_recovery_codes := strings.Split(user.RecoveryCodes, "\n")
+	for i, hashed_recovery_code := range hashed_recovery_codes {
+		if !cryptutils.CompareHashAndString(hashed_recovery_code, recovery_code) {
+			continue
+		}
+		user.RecoveryCodes = strings.Join(append(hashed_recovery_codes[:i:i], hashed_recovery_codes[i+1:]...), "\n")
+		err := store.Users.Update(user)
+		if err != nil {
+			logger.Error("Unable to consume the recovery code of user", user.ID, err)
+			return false, httputils.NewDatabaseError("unable to verify the two-factor code")
+		}
+		logger.Info("Recovery code used by user", user.Username+",", len(hashed_recovery_codes)-1, "left")
+		return true, nil
+	}
+	return false, nil
+}
+
+// clearTwoFactor removes the secret and the recovery codes of the user, and its pending login challenges
+func clearTwoFactor(store *db_model.Store, user *db_model.User) error {
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = ""
+	err := store.Users.Update(user)
+	if err != nil {
+		logger.Error("Unable to disable the two-factor authentication of user", user.ID, err)
+		return httputils.NewDatabaseError("unable to disable two-factor authentication")
+	}
+	middlewares.DenyUserAccessTokens(user.ID)
+	return deleteUserTokensOfType(store, user.ID, constants.TWO_FACTOR_TOKEN)
+}
+
+// generateRecoveryCodes returns new recovery codes, formatted for the user, and their hashes
+func generateRecoveryCodes() ([]string, []string, error) {
+	recovery_codes := make([]string, 0, constants.RECOVERY_CODES_COUNT)
+	hashed_recovery_codes := make([]string, 0, constants.RECOVERY_CODES_COUNT)
+	for range constants.RECOVERY_CODES_COUNT {
+		random := make([]byte, RECOVERY_CODE_LENGTH*5/8)
+		_, err := rand.Read(random)
+		if err != nil {
+			logger.Error("Unable to generate a recovery code", err)
+			return nil, nil, httputils.NewInternalServerError("unable to generate the recovery codes")
+		}
+		recovery_code := recoveryCodeEncoding.EncodeToString(random)
+		hashed_recovery_code, err := cryptutils.HashString(recovery_code)
+		if err != nil {
+			logger.Error("Unable to hash a recovery code", err)
+			return nil, nil, httputils.NewInternalServerError("unable to generate the recovery codes")
+		}
+		half := RECOVERY_CODE_LENGTH / 2
+		recovery_codes = append(recovery_codes, recovery_code[:half]+"-"+recovery_code[half:])
+		hashed_recovery_codes = append(hashed_recovery_codes, hashed_recovery_code)
+	}
+	return recovery_codes, hashed_recovery_codes, nil
+}
+
+// normalizeRecoveryCode removes the separators and the spaces of a recovery code typed by the user
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
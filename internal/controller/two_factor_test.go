@@ -0,0 +1,147 @@
+package db_controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/utils/totputils"
+)
+
+// generateTestCode generates the code of the secret at the given offset from now
+func generateTestCode(t *testing.T, secret string, offset time.Duration) string {
+	code, err := totputils.GenerateCode(secret, time.Now().Add(offset))
+	if err != nil {
+		t.Fatalf("Error generating code: %v", err)
+	}
+	return code
+}
+
+// loginWithTwoFactor logs in with the password, then with the code, and returns the error of the second step
+func loginWithTwoFactor(t *testing.T, store *db_model.Store, user *db_model.User, code string) error {
+	_, _, _, _, err := LoginUserFromPassword(store, nil, user.Username, "password")
+	var two_factor_required *TwoFactorRequiredError
+	if !errors.As(err, &two_factor_required) {
+		t.Fatalf("Error logging in: expected a two-factor challenge, got %v", err)
+	}
+	_, _, access_token, _, err := LoginUserFromTwoFactor(store, nil, two_factor_required.Challenge, code)
+	if err == nil && access_token == "" {
+		t.Errorf("Error logging in: empty access token")
+	}
+	return err
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	store, _, user := createAuditTestUsers(t)
+	audit := &AuditContext{Actor: user}
+
+	// The secret is only enabled once a code is confirmed
+	setup, err := SetupTwoFactor(store, user)
+	if err != nil {
+		t.Fatalf("Error setting up two-factor authentication: %v", err)
+	}
+	_, err = EnableTwoFactor(store, audit, user, "abcdef")
+	if err == nil {
+		t.Errorf("Error enabling two-factor authentication: invalid code accepted")
+	}
+	recovery_codes, err := EnableTwoFactor(store, audit, user, generateTestCode(t, setup.Secret, 0))
+	if err != nil {
+		t.Fatalf("Error enabling two-factor authentication: %v", err)
+	}
+	if len(recovery_codes) != constants.RECOVERY_CODES_COUNT {
+		t.Errorf("Error enabling two-factor authentication: expected %d recovery codes, got %d", constants.RECOVERY_CODES_COUNT, len(recovery_codes))
+	}
+
+	// The password alone is not enough anymore, and a challenge can only be used once
+	_, _, _, _, err = LoginUserFromPassword(store, nil, user.Username, "password")
+	var two_factor_required *TwoFactorRequiredError
+	if !errors.As(err, &two_factor_required) {
+		t.Fatalf("Error logging in: expected a two-factor challenge, got %v", err)
+	}
+	_, _, _, _, err = LoginUserFromTwoFactor(store, nil, two_factor_required.Challenge, "not a code")
+	if err == nil {
+		t.Errorf("Error logging in: invalid code accepted")
+	}
+	next_code := generateTestCode(t, setup.Secret, totputils.PERIOD)
+	_, _, _, _, err = LoginUserFromTwoFactor(store, nil, two_factor_required.Challenge, next_code)
+	if err == nil {
+		t.Errorf("Error logging in: challenge used twice")
+	}
+
+	// A code is accepted once
+	err = loginWithTwoFactor(t, store, user, next_code)
+	if err != nil {
+		t.Fatalf("Error logging in with a code: %v", err)
+	}
+	err = loginWithTwoFactor(t, store, user, next_code)
+	if err == nil {
+		t.Errorf("Error logging in: code replayed")
+	}
+
+	// A recovery code is accepted once
+	err = loginWithTwoFactor(t, store, user, recovery_codes[0])
+	if err != nil {
+		t.Fatalf("Error logging in with a recovery code: %v", err)
+	}
+	err = loginWithTwoFactor(t, store, user, recovery_codes[0])
+	if err == nil {
+		t.Errorf("Error logging in: recovery code used twice")
+	}
+
+	// Disabling requires a code
+	user, err = store.Users.GetByID(user.ID)
+	if err != nil {
+		t.Fatalf("Error retrieving user: %v", err)
+	}
+	err = DisableTwoFactor(store, audit, user, recovery_codes[0])
+	if err == nil {
+		t.Errorf("Error disabling two-factor authentication: used recovery code accepted")
+	}
+	err = DisableTwoFactor(store, audit, user, recovery_codes[1])
+	if err != nil {
+		t.Fatalf("Error disabling two-factor authentication: %v", err)
+	}
+	_, _, _, _, err = LoginUserFromPassword(store, nil, user.Username, "password")
+	if err != nil {
+		t.Errorf("Error logging in without two-factor authentication: %v", err)
+	}
+
+	events, err := GetAuditEvents(store, &db_model.AuditGetRequestParams{Action: []string{constants.AUDIT_USER_2FA_ON, constants.AUDIT_USER_2FA_OFF}})
+	if err != nil || len(events) != 2 {
+		t.Errorf("Error auditing two-factor authentication: expected 2 events, got %d (%v)", len(events), err)
+	}
+}
+
+func TestRequireAdminTwoFactor(t *testing.T) {
+	store, admin, _ := createAuditTestUsers(t)
+	defer func() { constants.REQUIRE_ADMIN_TWO_FACTOR = false }()
+
+	constants.REQUIRE_ADMIN_TWO_FACTOR = true
+	if admin.HasPermission(constants.PERMISSION_USER_UPDATE) {
+		t.Errorf("Error checking admin rights: admin without two-factor authentication allowed")
+	}
+
+	setup, err := SetupTwoFactor(store, admin)
+	if err != nil {
+		t.Fatalf("Error setting up two-factor authentication: %v", err)
+	}
+	_, err = EnableTwoFactor(store, &AuditContext{Actor: admin}, admin, generateTestCode(t, setup.Secret, 0))
+	if err != nil {
+		t.Fatalf("Error enabling two-factor authentication: %v", err)
+	}
+	if !admin.HasPermission(constants.PERMISSION_USER_UPDATE) {
+		t.Errorf("Error checking admin rights: admin with two-factor authentication refused")
+	}
+
+	// The admins can reset the two-factor authentication of a user that lost its authenticator
+	err = ResetTwoFactor(store, &AuditContext{Actor: admin, Reason: "Lost phone"}, admin)
+	if err != nil {
+		t.Fatalf("Error resetting two-factor authentication: %v", err)
+	}
+	stored_admin, err := store.Users.GetByID(admin.ID)
+	if err != nil || stored_admin.TOTPEnabled || stored_admin.TOTPSecret != "" || stored_admin.RecoveryCodes != "" {
+		t.Errorf("Error resetting two-factor authentication: two-factor authentication still set (%v)", err)
+	}
+}
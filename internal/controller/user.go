@@ -1,18 +1,22 @@
 package db_controller
 
 import (
+	"errors"
 	"mime/multipart"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/boxboxjason/jukebox/internal/constants"
+	"github.com/boxboxjason/jukebox/internal/middlewares"
 	db_model "github.com/boxboxjason/jukebox/internal/model"
 	"github.com/boxboxjason/jukebox/pkg/logger"
 	"github.com/boxboxjason/jukebox/pkg/utils/cryptutils"
 	"github.com/boxboxjason/jukebox/pkg/utils/fileutils"
 	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
-	"gorm.io/gorm"
 )
 
 var (
@@ -27,7 +31,7 @@ var (
 
 // CreateUser creates a new user in the database after checking the validity of the input fields
 // And the uniqueness of the username and email
-func CreateUser(db *gorm.DB, query_params *db_model.UsersPostRequestParams) (*db_model.User, error) {
+func CreateUser(store *db_model.Store, query_params *db_model.UsersPostRequestParams) (*db_model.User, error) {
 	// Validate user input
 	valid_username := VALID_USERNAME.MatchString(query_params.Username)
 	valid_email := VALID_EMAIL.MatchString(query_params.Email)
@@ -59,27 +63,18 @@ func CreateUser(db *gorm.DB, query_params *db_model.UsersPostRequestParams) (*db
 		Hashed_Password: hashed_password,
 	}
 
-	// Open db connection
-	if db == nil {
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return &db_model.User{}, err
-		}
-		defer db_model.CloseConnection(db)
-	}
-
 	// Check if user already exists
-	_, err = db_model.GetUserByUsername(db, query_params.Username)
+	_, err = store.Users.GetByUsername(query_params.Username)
 	if err == nil {
 		return &db_model.User{}, httputils.NewConflictError("Username already exists")
 	}
-	_, err = db_model.GetUserByEmail(db, query_params.Email)
+	_, err = store.Users.GetByEmail(query_params.Email)
 	if err == nil {
 		return &db_model.User{}, httputils.NewConflictError("Email already exists")
 	}
 
 	// Create user
-	err = user.CreateUser(db)
+	err = store.Users.Create(&user)
 	if err != nil {
 		logger.Error("Unable to create the user in the database")
 	} else {
@@ -91,18 +86,8 @@ func CreateUser(db *gorm.DB, query_params *db_model.UsersPostRequestParams) (*db
 // ================= Read =================
 
 // GetUser retrieves a user from the database by ID
-func GetUser(db *gorm.DB, id int) (*db_model.User, error) {
-	// Open db connection
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return nil, err
-		}
-		defer db_model.CloseConnection(db)
-	}
-
-	user, err := db_model.GetUserByID(db, id)
+func GetUser(store *db_model.Store, id int) (*db_model.User, error) {
+	user, err := store.Users.GetByID(id)
 	if err != nil {
 		return nil, httputils.NewNotFoundError("User not found")
 	}
@@ -110,27 +95,20 @@ func GetUser(db *gorm.DB, id int) (*db_model.User, error) {
 	return user, nil
 }
 
-// GetUserByPartialUsername retrieves a user from the database by partial username
-func GetUsersByPartialUsername(db *gorm.DB, partial_username string) ([]*db_model.User, error) {
-	// Open db connection
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return nil, err
-		}
-		defer db_model.CloseConnection(db)
-	}
-
-	return db_model.GetUsersByUsername(db, partial_username)
+// GetUsersByPartialUsername retrieves the users whose username contains the partial username
+func GetUsersByPartialUsername(store *db_model.Store, partial_username string) ([]*db_model.User, error) {
+	return store.Users.List(&db_model.UsersGetRequestParams{PartialUsername: []string{partial_username}})
 }
 
 // GetUsers retrieves all users from the database, applies filters if provided
-func GetUsers(db *gorm.DB, query_params *db_model.UsersGetRequestParams) ([]*db_model.User, error) {
+func GetUsers(store *db_model.Store, query_params *db_model.UsersGetRequestParams) ([]*db_model.User, error) {
 	// Sanity checks
-	if len(query_params.Admin) > 1 {
-		return nil, httputils.NewBadRequestError("Only one value is allowed for the admin parameter")
-	} else if query_params.SubscriberTier < 0 || query_params.SubscriberTier > 3 {
+	for _, role := range query_params.Role {
+		if db_model.RoleRank(role) < 0 {
+			return nil, httputils.NewBadRequestError("Invalid role: " + role)
+		}
+	}
+	if query_params.SubscriberTier < 0 || query_params.SubscriberTier > 3 {
 		return nil, httputils.NewBadRequestError("Invalid subscriber tier, must be between 0 and 3")
 	}
 	for _, id := range query_params.ID {
@@ -138,23 +116,13 @@ func GetUsers(db *gorm.DB, query_params *db_model.UsersGetRequestParams) ([]*db_
 			return nil, httputils.NewBadRequestError("Invalid user ID, must be a positive integer")
 		}
 	}
-	// Open db connection
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return nil, err
-		}
-		defer db_model.CloseConnection(db)
-	}
-
-	return db_model.GetUsersByFilters(db, query_params)
+	return store.Users.List(query_params)
 }
 
 // ================= Update =================
 
 // UpdateUser updates a user in the database after checking the validity of the input fields
-func UpdateUser(db *gorm.DB, user *db_model.User, query_params *db_model.UsersRawPatchRequestParams) (*db_model.User, error) {
+func UpdateUser(store *db_model.Store, user *db_model.User, query_params *db_model.UsersRawPatchRequestParams) (*db_model.User, error) {
 	// Validate user input
 	valid_username := VALID_USERNAME.MatchString(query_params.Username)
 	valid_email := VALID_EMAIL.MatchString(query_params.Email)
@@ -189,25 +157,15 @@ func UpdateUser(db *gorm.DB, user *db_model.User, query_params *db_model.UsersRa
 		hashed_password = new_hashed_password
 	}
 
-	// Open db connection
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return &db_model.User{}, err
-		}
-		defer db_model.CloseConnection(db)
-	}
-
 	// Check if user already exists
 	if query_params.Username != user.Username {
-		_, err := db_model.GetUserByUsername(db, query_params.Username)
+		_, err := store.Users.GetByUsername(query_params.Username)
 		if err == nil {
 			return &db_model.User{}, httputils.NewConflictError("Username already exists")
 		}
 	}
 	if query_params.Email != user.Email {
-		_, err := db_model.GetUserByEmail(db, query_params.Email)
+		_, err := store.Users.GetByEmail(query_params.Email)
 		if err == nil {
 			return &db_model.User{}, httputils.NewConflictError("Email already exists")
 		}
@@ -217,8 +175,11 @@ func UpdateUser(db *gorm.DB, user *db_model.User, query_params *db_model.UsersRa
 	if len(query_params.Username) > 0 {
 		user.Username = query_params.Username
 	}
-	if len(query_params.Email) > 0 {
+	email_changed := len(query_params.Email) > 0 && query_params.Email != user.Email
+	if email_changed {
+		// The new email has to be verified again
 		user.Email = query_params.Email
+		user.VerifiedEmail = false
 	}
 	if query_params.Avatar != nil {
 		user.Avatar = strconv.Itoa(user.ID)
@@ -227,47 +188,206 @@ func UpdateUser(db *gorm.DB, user *db_model.User, query_params *db_model.UsersRa
 		user.Hashed_Password = hashed_password
 	}
 
-	err := user.UpdateUser(db)
+	err := store.Users.Update(user)
 	if err != nil {
 		logger.Error("Unable to update the user in the database")
-	} else {
-		logger.Info("User", user.Username, "updated successfully")
+		return user, err
+	}
+	middlewares.DenyUserAccessTokens(user.ID)
+	logger.Info("User", user.Username, "updated successfully")
+
+	// The links mailed to the previous email are no longer valid
+	if email_changed {
+		for _, token_type := range []string{constants.EMAIL_VERIFICATION_TOKEN, constants.PASSWORD_RESET_TOKEN} {
+			err = deleteUserTokensOfType(store, user.ID, token_type)
+			if err != nil {
+				return user, err
+			}
+		}
+	}
+	return user, nil
+}
+
+// ResetUserPassword replaces the password of a user and revokes its tokens, so that every session has to log in again
+func ResetUserPassword(store *db_model.Store, audit *AuditContext, user *db_model.User, password string) error {
+	err := setUserPassword(store, user, password)
+	if err != nil {
+		return err
+	}
+
+	recordAuditEvents(store, newAuditEvent(audit, constants.AUDIT_USER_PASSWORD, constants.AUDIT_TARGET_USER, user.ID, nil, nil, audit.Reason))
+	return nil
+}
+
+// setUserPassword replaces the password of a user and revokes all of its tokens
+func setUserPassword(store *db_model.Store, user *db_model.User, password string) error {
+	if !VALID_PASSWORD.MatchString(password) {
+		return httputils.NewBadRequestError("Invalid fields: password")
+	}
+	hashed_password, err := cryptutils.HashString(password)
+	if err != nil {
+		logger.Error("Unable to hash the password during password reset", err)
+		return httputils.NewInternalServerError("Unable to hash the password")
+	}
+
+	user.Hashed_Password = hashed_password
+	err = store.Users.Update(user)
+	if err != nil {
+		logger.Error("Unable to reset the password of user", user.ID, err)
+		return httputils.NewDatabaseError("unable to reset the password of user")
+	}
+	err = deleteUserTokens(store, user.ID)
+	if err != nil {
+		logger.Error("Unable to revoke the tokens of user", user.ID, err)
+		return httputils.NewDatabaseError("unable to revoke the tokens of user")
 	}
-	return user, err
+
+	logger.Info("Password of user", user.Username, "reset")
+	return nil
 }
 
 // ================= Delete =================
 
+// UserHasPermissionToUpdateUser checks if a user has permission to update another user
+// The users update themselves, the user.update permission only reaches the users below in the roles hierarchy
+func UserHasPermissionToUpdateUser(user *db_model.User, user_to_update *db_model.User) bool {
+	return user.ID == user_to_update.ID || user.HasPermission(constants.PERMISSION_USER_UPDATE) && user.Outranks(user_to_update)
+}
+
 // UserHasPermissionToDeleteUser checks if a user has permission to delete another user
+// The users can delete themselves unless banned, the others need the user.delete permission and a higher role
 func UserHasPermissionToDeleteUser(user *db_model.User, user_to_delete *db_model.User) bool {
-	return user.Admin || user.ID == user_to_delete.ID && !user_to_delete.Banned
+	return user.HasPermission(constants.PERMISSION_USER_DELETE) && user.Outranks(user_to_delete) || user.ID == user_to_delete.ID && !user_to_delete.Banned
 }
 
-func DeleteUser(db *gorm.DB, user *db_model.User) error {
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return err
-		}
-		defer db_model.CloseConnection(db)
+// UserDeletion is the requested deletion of a user, finalized once it is due unless the user cancels it
+type UserDeletion struct {
+	UserID int       `json:"user_id"`
+	Mode   string    `json:"mode"`
+	DueAt  time.Time `json:"due_at"`
+}
+
+// newUserDeletion returns the requested deletion of the user, or nil if none was requested
+func newUserDeletion(user *db_model.User) *UserDeletion {
+	if user.DeletionDueAt == nil {
+		return nil
 	}
-	return user.DeleteUser(db)
+	return &UserDeletion{UserID: user.ID, Mode: user.DeletionMode, DueAt: user.DeletionDueAt.UTC()}
 }
 
-func DeleteUsers(db *gorm.DB, requester *db_model.User, query_params *db_model.UsersDeleteRequestParams) error {
-	// Open db connection
-	if db == nil {
-		var err error
-		db, err = db_model.OpenConnection()
-		if err != nil {
-			return err
-		}
-		defer db_model.CloseConnection(db)
+// validateDeletionMode returns the deletion mode to use, anonymizing the user unless asked otherwise
+func validateDeletionMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return constants.USER_DELETION_ANONYMIZE, nil
+	case constants.USER_DELETION_ANONYMIZE, constants.USER_DELETION_DELETE:
+		return mode, nil
+	default:
+		return "", httputils.NewBadRequestError("mode must be " + constants.USER_DELETION_ANONYMIZE + " or " + constants.USER_DELETION_DELETE)
+	}
+}
+
+// IsDeletedUser returns true if the user is the tombstone owning the messages and the bans of the anonymized users
+func IsDeletedUser(user *db_model.User) bool {
+	return user.Username == constants.DELETED_USER_USERNAME
+}
+
+// GetUserDeletion retrieves the requested deletion of a user, only the user and the admins can see it
+func GetUserDeletion(requester *db_model.User, user *db_model.User) (*UserDeletion, error) {
+	if requester.ID != user.ID && !requester.HasPermission(constants.PERMISSION_USER_READ) {
+		return nil, httputils.NewForbiddenError("user does not have permission to see the deletion of user")
+	}
+
+	deletion := newUserDeletion(user)
+	if deletion == nil {
+		return nil, httputils.NewNotFoundError("no deletion requested")
+	}
+	return deletion, nil
+}
+
+// RequestUserDeletion schedules the deletion of a user at the end of the grace period, during which it can be cancelled
+// Requesting the deletion again changes its mode but not its due date
+func RequestUserDeletion(store *db_model.Store, audit *AuditContext, user *db_model.User, mode string) (*UserDeletion, error) {
+	mode, err := validateDeletionMode(mode)
+	if err != nil {
+		return nil, err
+	}
+	if IsDeletedUser(user) {
+		return nil, httputils.NewForbiddenError("the deleted user can not be deleted")
+	}
+
+	if user.DeletionDueAt == nil {
+		due_at := time.Now().UTC().Add(constants.USER_DELETION_GRACE_PERIOD)
+		user.DeletionDueAt = &due_at
+	}
+	user.DeletionMode = mode
+	err = store.Users.Update(user)
+	if err != nil {
+		logger.Error("Unable to request the deletion of user", user.ID, err)
+		return nil, httputils.NewDatabaseError("unable to request the deletion of user")
+	}
+
+	deletion := newUserDeletion(user)
+	logger.Info("Deletion of user", user.Username, "requested, due at", deletion.DueAt)
+	if audit.Actor == nil || audit.Actor.ID != user.ID {
+		recordAuditEvents(store, newAuditEvent(audit, constants.AUDIT_USER_SCHEDULE, constants.AUDIT_TARGET_USER, user.ID, nil, deletion, audit.Reason))
+	}
+	return deletion, nil
+}
+
+// CancelUserDeletion cancels the requested deletion of a user
+func CancelUserDeletion(store *db_model.Store, audit *AuditContext, user *db_model.User) error {
+	deletion := newUserDeletion(user)
+	if deletion == nil {
+		return httputils.NewNotFoundError("no deletion requested")
+	}
+
+	user.DeletionDueAt = nil
+	user.DeletionMode = ""
+	err := store.Users.Update(user)
+	if err != nil {
+		logger.Error("Unable to cancel the deletion of user", user.ID, err)
+		return httputils.NewDatabaseError("unable to cancel the deletion of user")
+	}
+
+	logger.Info("Deletion of user", user.Username, "cancelled")
+	if audit.Actor == nil || audit.Actor.ID != user.ID {
+		recordAuditEvents(store, newAuditEvent(audit, constants.AUDIT_USER_CANCEL, constants.AUDIT_TARGET_USER, user.ID, deletion, nil, audit.Reason))
+	}
+	return nil
+}
+
+// DeleteUser deletes a user right away, the deletion is audited when the user is deleted by someone else
+func DeleteUser(store *db_model.Store, audit *AuditContext, user *db_model.User, mode string) error {
+	mode, err := validateDeletionMode(mode)
+	if err != nil {
+		return err
+	}
+	if IsDeletedUser(user) {
+		return httputils.NewForbiddenError("the deleted user can not be deleted")
+	}
+
+	err = deleteUserData(store, user, mode)
+	if err != nil {
+		return err
+	}
+
+	if audit.Actor == nil || audit.Actor.ID != user.ID {
+		recordAuditEvents(store, newAuditEvent(audit, userDeletionAuditAction(mode), constants.AUDIT_TARGET_USER, user.ID, user, nil, audit.Reason))
+	}
+	return nil
+}
+
+// DeleteUsers deletes the users matching the filters right away, the actor must have permission to delete every one of them
+func DeleteUsers(store *db_model.Store, audit *AuditContext, query_params *db_model.UsersDeleteRequestParams) error {
+	requester := audit.Actor
+	mode, err := validateDeletionMode(query_params.Mode)
+	if err != nil {
+		return err
 	}
 
 	// Retrieve users
-	users, err := db_model.GetUsersByFilters(db, &db_model.UsersGetRequestParams{
+	users, err := store.Users.List(&db_model.UsersGetRequestParams{
 		ID:       query_params.ID,
 		Username: query_params.Username,
 		Email:    query_params.Email,
@@ -283,7 +403,7 @@ func DeleteUsers(db *gorm.DB, requester *db_model.User, query_params *db_model.U
 	// Check if requester has permission to delete users
 	usernames_to_delete := make([]string, len(users))
 	for i, user := range users {
-		if !UserHasPermissionToDeleteUser(requester, user) {
+		if !UserHasPermissionToDeleteUser(requester, user) || IsDeletedUser(user) {
 			return httputils.NewForbiddenError("User does not have permission to delete user: " + user.Username)
 		} else {
 			usernames_to_delete[i] = user.Username
@@ -293,8 +413,180 @@ func DeleteUsers(db *gorm.DB, requester *db_model.User, query_params *db_model.U
 	// Log the deletion
 	logger.Info("User", requester.Username, "is deleting users", usernames_to_delete, "for reason:", query_params.Reason)
 
-	// Delete users
-	return db_model.DeleteUsers(db, users)
+	// Delete users, the users deleted before a failure stay deleted and are audited
+	events := []*db_model.AuditEvent{}
+	for _, user := range users {
+		err = deleteUserData(store, user, mode)
+		if err != nil {
+			break
+		}
+		events = append(events, newAuditEvent(audit, userDeletionAuditAction(mode), constants.AUDIT_TARGET_USER, user.ID, user, nil, query_params.Reason))
+	}
+	recordAuditEvents(store, events...)
+	return err
+}
+
+// FinalizeUserDeletions deletes the users whose requested deletion is due, in the mode they requested
+// It returns the number of deleted users, a user that can not be deleted is retried on the next run
+func FinalizeUserDeletions(store *db_model.Store) (int, error) {
+	users, err := store.Users.ListDeletionsDue(time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	audit := &AuditContext{Reason: "requested deletion"}
+	for _, user := range users {
+		err = DeleteUser(store, audit, user, user.DeletionMode)
+		if err != nil {
+			logger.Error("Unable to finalize the deletion of user", user.ID, err)
+			continue
+		}
+		logger.Info("Deletion of user", user.Username, "finalized")
+		deleted++
+	}
+	return deleted, nil
+}
+
+// deleteUserData deletes the user, its tokens, its API tokens and its identities, then either deletes its messages and bans or gives them to the deleted user
+// The user is deleted last, so that a failure leaves it in place to be deleted again
+func deleteUserData(store *db_model.Store, user *db_model.User, mode string) error {
+	if mode == constants.USER_DELETION_ANONYMIZE {
+		err := anonymizeUserMessagesAndBans(store, user)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := deleteUserMessagesAndBans(store, user)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := deleteUserTokens(store, user.ID)
+	if err != nil {
+		logger.Error("Unable to delete the tokens of user", user.ID, err)
+		return httputils.NewDatabaseError("unable to delete the tokens of user")
+	}
+	err = store.APITokens.DeleteUserAPITokens(user.ID)
+	if err != nil {
+		logger.Error("Unable to delete the API tokens of user", user.ID, err)
+		return httputils.NewDatabaseError("unable to delete the API tokens of user")
+	}
+	err = store.Identities.DeleteUserIdentities(user.ID)
+	if err != nil {
+		logger.Error("Unable to delete the identities of user", user.ID, err)
+		return httputils.NewDatabaseError("unable to delete the identities of user")
+	}
+	err = store.Users.Delete(user)
+	if err != nil {
+		logger.Error("Unable to delete user", user.ID, err)
+		return httputils.NewDatabaseError("unable to delete user")
+	}
+
+	// The uploaded avatar is not referenced anymore
+	if user.Avatar == strconv.Itoa(user.ID) {
+		err = fileutils.DeleteFile(filepath.Join(constants.AVATARS_DIR, user.Avatar))
+		if err != nil && !os.IsNotExist(err) {
+			logger.Error("Unable to delete the avatar of user", user.ID, err)
+		}
+	}
+	return nil
+}
+
+// anonymizeUserMessagesAndBans gives the messages of the user and the bans it issued or received to the deleted user
+// The deleted user is only created when there is something to give it
+func anonymizeUserMessagesAndBans(store *db_model.Store, user *db_model.User) error {
+	messages, err := store.Messages.List(&db_model.MessagesGetRequestParams{SenderID: []int{user.ID}, Limit: 1})
+	if err != nil {
+		logger.Error("Unable to retrieve the messages of user", user.ID, err)
+		return httputils.NewDatabaseError("unable to anonymize the messages of user")
+	}
+	has_records := len(messages) > 0
+	for _, query_params := range []*db_model.BansGetRequestParams{{TargetID: []int{user.ID}, Limit: 1}, {IssuerID: []int{user.ID}, Limit: 1}} {
+		bans, err := store.Bans.List(query_params)
+		if err != nil {
+			logger.Error("Unable to retrieve the bans of user", user.ID, err)
+			return httputils.NewDatabaseError("unable to anonymize the bans of user")
+		}
+		has_records = has_records || len(bans) > 0
+	}
+	if !has_records {
+		return nil
+	}
+
+	deleted_user, err := getDeletedUser(store)
+	if err != nil {
+		return err
+	}
+	err = store.Messages.ReassignSender(user.ID, deleted_user.ID)
+	if err != nil {
+		logger.Error("Unable to anonymize the messages of user", user.ID, err)
+		return httputils.NewDatabaseError("unable to anonymize the messages of user")
+	}
+	err = store.Bans.ReassignUser(user.ID, deleted_user.ID)
+	if err != nil {
+		logger.Error("Unable to anonymize the bans of user", user.ID, err)
+		return httputils.NewDatabaseError("unable to anonymize the bans of user")
+	}
+	return nil
+}
+
+// deleteUserMessagesAndBans deletes the messages of the user and the bans it issued or received
+// The database cascades are not relied upon, they are disabled on SQLite
+func deleteUserMessagesAndBans(store *db_model.Store, user *db_model.User) error {
+	messages, err := store.Messages.List(&db_model.MessagesGetRequestParams{SenderID: []int{user.ID}})
+	if err == nil && len(messages) > 0 {
+		err = store.Messages.DeleteMany(messages)
+	}
+	if err != nil {
+		logger.Error("Unable to delete the messages of user", user.ID, err)
+		return httputils.NewDatabaseError("unable to delete the messages of user")
+	}
+
+	for _, query_params := range []*db_model.BansGetRequestParams{{TargetID: []int{user.ID}}, {IssuerID: []int{user.ID}}} {
+		bans, err := store.Bans.List(query_params)
+		if err == nil && len(bans) > 0 {
+			err = store.Bans.DeleteMany(bans)
+		}
+		if err != nil {
+			logger.Error("Unable to delete the bans of user", user.ID, err)
+			return httputils.NewDatabaseError("unable to delete the bans of user")
+		}
+	}
+	return nil
+}
+
+// getDeletedUser retrieves the deleted user, creating it the first time a user is anonymized
+// It has no password, so no one can log in as the deleted user
+func getDeletedUser(store *db_model.Store) (*db_model.User, error) {
+	deleted_user, err := store.Users.GetByUsername(constants.DELETED_USER_USERNAME)
+	if err == nil {
+		return deleted_user, nil
+	} else if !errors.Is(err, db_model.ErrRecordNotFound) {
+		logger.Error("Unable to retrieve the deleted user", err)
+		return nil, httputils.NewDatabaseError("unable to retrieve the deleted user")
+	}
+
+	deleted_user = &db_model.User{Username: constants.DELETED_USER_USERNAME, Email: constants.DELETED_USER_EMAIL}
+	err = store.Users.Create(deleted_user)
+	if err != nil {
+		// Another deletion may have created it in the meantime
+		deleted_user, err = store.Users.GetByUsername(constants.DELETED_USER_USERNAME)
+		if err != nil {
+			logger.Error("Unable to create the deleted user", err)
+			return nil, httputils.NewDatabaseError("unable to create the deleted user")
+		}
+	}
+	return deleted_user, nil
+}
+
+// userDeletionAuditAction returns the audited action of a deletion depending on its mode
+func userDeletionAuditAction(mode string) string {
+	if mode == constants.USER_DELETION_ANONYMIZE {
+		return constants.AUDIT_USER_ANONYMIZE
+	}
+	return constants.AUDIT_USER_DELETE
 }
 
 // UploadUserAvatar uploads a user avatar to the server
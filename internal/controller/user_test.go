@@ -0,0 +1,277 @@
+package db_controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+)
+
+func TestCreateUserConflicts(t *testing.T) {
+	store := db_model.NewMemoryStore()
+
+	_, err := CreateUser(store, &db_model.UsersPostRequestParams{Username: "test_user", Email: "test_user@test.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	_, err = CreateUser(store, &db_model.UsersPostRequestParams{Username: "test_user", Email: "other@test.com", Password: "password"})
+	if err == nil {
+		t.Errorf("Error creating user: duplicate username accepted")
+	}
+	_, err = CreateUser(store, &db_model.UsersPostRequestParams{Username: "other_user", Email: "test_user@test.com", Password: "password"})
+	if err == nil {
+		t.Errorf("Error creating user: duplicate email accepted")
+	}
+	_, err = CreateUser(store, &db_model.UsersPostRequestParams{Username: "x", Email: "invalid", Password: "short"})
+	if err == nil {
+		t.Errorf("Error creating user: invalid fields accepted")
+	}
+}
+
+func TestLoginUserFromPassword(t *testing.T) {
+	store := db_model.NewMemoryStore()
+
+	user, err := CreateUser(store, &db_model.UsersPostRequestParams{Username: "test_user", Email: "test_user@test.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	user_id, _, access_token, refresh_token, err := LoginUserFromPassword(store, nil, "test_user@test.com", "password")
+	if err != nil {
+		t.Fatalf("Error logging in: %v", err)
+	}
+	if user_id != user.ID || access_token == "" || refresh_token == "" {
+		t.Errorf("Error logging in: unexpected user %d or empty tokens", user_id)
+	}
+
+	_, _, _, _, err = LoginUserFromPassword(store, nil, "test_user", "wrong_password")
+	if err == nil {
+		t.Errorf("Error logging in: wrong password accepted")
+	}
+}
+
+func TestDeleteUsersPermission(t *testing.T) {
+	store := db_model.NewMemoryStore()
+
+	users := []*db_model.User{}
+	for _, username := range []string{"test_admin", "test_user_a", "test_user_b"} {
+		user, err := CreateUser(store, &db_model.UsersPostRequestParams{Username: username, Email: username + "@test.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("Error creating user: %v", err)
+		}
+		users = append(users, user)
+	}
+	users[0].Role = constants.ROLE_ADMIN
+
+	// A user can only delete itself
+	err := DeleteUsers(store, &AuditContext{Actor: users[1]}, &db_model.UsersDeleteRequestParams{ID: []int{users[1].ID, users[2].ID}})
+	if err == nil {
+		t.Errorf("Error deleting users: user allowed to delete another user")
+	}
+	remaining, _ := store.Users.List(&db_model.UsersGetRequestParams{})
+	if len(remaining) != 3 {
+		t.Errorf("Error deleting users: users deleted despite the missing permission")
+	}
+
+	// An admin can delete anyone
+	err = DeleteUsers(store, &AuditContext{Actor: users[0], Reason: "cleanup"}, &db_model.UsersDeleteRequestParams{ID: []int{users[1].ID, users[2].ID}})
+	if err != nil {
+		t.Errorf("Error deleting users: %v", err)
+	}
+	remaining, _ = store.Users.List(&db_model.UsersGetRequestParams{})
+	if len(remaining) != 1 || remaining[0].ID != users[0].ID {
+		t.Errorf("Error deleting users: expected only the admin to remain, got %d users", len(remaining))
+	}
+}
+
+func TestRequestAndCancelUserDeletion(t *testing.T) {
+	store, _, user := createAuditTestUsers(t)
+
+	deletion, err := RequestUserDeletion(store, &AuditContext{Actor: user}, user, "")
+	if err != nil {
+		t.Fatalf("Error requesting user deletion: %v", err)
+	}
+	if deletion.Mode != constants.USER_DELETION_ANONYMIZE || deletion.DueAt.Before(time.Now().Add(constants.USER_DELETION_GRACE_PERIOD-time.Minute)) {
+		t.Errorf("Error requesting user deletion: expected an anonymization at the end of the grace period, got %+v", deletion)
+	}
+	_, err = RequestUserDeletion(store, &AuditContext{Actor: user}, user, "invalid")
+	if err == nil {
+		t.Errorf("Error requesting user deletion: invalid mode accepted")
+	}
+
+	// Nothing is deleted during the grace period
+	deleted, err := FinalizeUserDeletions(store)
+	if err != nil || deleted != 0 {
+		t.Errorf("Error finalizing user deletions: expected none, got %d (%v)", deleted, err)
+	}
+
+	err = CancelUserDeletion(store, &AuditContext{Actor: user}, user)
+	if err != nil {
+		t.Fatalf("Error cancelling user deletion: %v", err)
+	}
+	stored_user, err := GetUser(store, user.ID)
+	if err != nil || stored_user.DeletionDueAt != nil {
+		t.Errorf("Error cancelling user deletion: deletion still requested (%v)", err)
+	}
+	err = CancelUserDeletion(store, &AuditContext{Actor: user}, stored_user)
+	if err == nil {
+		t.Errorf("Error cancelling user deletion: cancelled a deletion that was not requested")
+	}
+}
+
+func TestFinalizeUserDeletionAnonymizes(t *testing.T) {
+	store, admin, user := createAuditTestUsers(t)
+
+	message, err := CreateMessage(store, &db_model.MessagesPostRequestParams{Sender: user, Message: "Hello"})
+	if err != nil {
+		t.Fatalf("Error creating message: %v", err)
+	}
+	bans, err := BanUsers(store, &AuditContext{Actor: admin}, &db_model.BansPostRequestParams{Issuer: admin, Target: []*db_model.User{user}, Type: constants.MUTE_TYPE, Duration: 60, Reason: "Spam"})
+	if err != nil {
+		t.Fatalf("Error banning user: %v", err)
+	}
+	_, _, _, _, err = LoginUserFromPassword(store, nil, user.Username, "password")
+	if err != nil {
+		t.Fatalf("Error logging in: %v", err)
+	}
+
+	_, err = RequestUserDeletion(store, &AuditContext{Actor: user}, user, constants.USER_DELETION_ANONYMIZE)
+	if err != nil {
+		t.Fatalf("Error requesting user deletion: %v", err)
+	}
+	// The grace period is over
+	due_at := time.Now().Add(-time.Minute)
+	user.DeletionDueAt = &due_at
+	err = store.Users.Update(user)
+	if err != nil {
+		t.Fatalf("Error updating user: %v", err)
+	}
+
+	deleted, err := FinalizeUserDeletions(store)
+	if err != nil || deleted != 1 {
+		t.Fatalf("Error finalizing user deletions: expected 1, got %d (%v)", deleted, err)
+	}
+	_, err = GetUser(store, user.ID)
+	if err == nil {
+		t.Errorf("Error finalizing user deletion: user still exists")
+	}
+
+	// The message and the mute are kept, and given to the deleted user
+	anonymized_message, err := GetMessage(store, message.ID)
+	if err != nil || anonymized_message.Sender == nil || !IsDeletedUser(anonymized_message.Sender) {
+		t.Errorf("Error anonymizing user: message not given to the deleted user (%v)", err)
+	}
+	anonymized_ban, err := GetBanByID(store, bans[0].ID)
+	if err != nil || anonymized_ban.TargetID != anonymized_message.Sender.ID || anonymized_ban.IssuerID != admin.ID {
+		t.Errorf("Error anonymizing user: mute not given to the deleted user (%v)", err)
+	}
+	tokens, err := store.Tokens.ListUserTokens(user.ID)
+	if err != nil || len(tokens) != 0 {
+		t.Errorf("Error anonymizing user: expected the tokens to be deleted, got %d (%v)", len(tokens), err)
+	}
+
+	// The deleted user can not be deleted nor logged in as
+	err = DeleteUser(store, &AuditContext{Actor: admin}, anonymized_message.Sender, constants.USER_DELETION_DELETE)
+	if err == nil {
+		t.Errorf("Error deleting user: deleted user deleted")
+	}
+	_, _, _, _, err = LoginUserFromPassword(store, nil, constants.DELETED_USER_USERNAME, "")
+	if err == nil {
+		t.Errorf("Error logging in: logged in as the deleted user")
+	}
+
+	events, err := GetAuditEvents(store, &db_model.AuditGetRequestParams{Action: []string{constants.AUDIT_USER_ANONYMIZE}})
+	if err != nil || len(events) != 1 || events[0].TargetID != user.ID || events[0].ActorID != 0 {
+		t.Errorf("Error auditing user anonymization: expected one event without actor, got %d (%v)", len(events), err)
+	}
+}
+
+func TestDeleteUserDeletesMessagesAndBans(t *testing.T) {
+	store, admin, user := createAuditTestUsers(t)
+
+	message, err := CreateMessage(store, &db_model.MessagesPostRequestParams{Sender: user, Message: "Hello"})
+	if err != nil {
+		t.Fatalf("Error creating message: %v", err)
+	}
+	bans, err := BanUsers(store, &AuditContext{Actor: admin}, &db_model.BansPostRequestParams{Issuer: admin, Target: []*db_model.User{user}, Type: constants.MUTE_TYPE, Duration: 60, Reason: "Spam"})
+	if err != nil {
+		t.Fatalf("Error banning user: %v", err)
+	}
+
+	err = DeleteUser(store, &AuditContext{Actor: admin}, user, constants.USER_DELETION_DELETE)
+	if err != nil {
+		t.Fatalf("Error deleting user: %v", err)
+	}
+	_, err = GetMessage(store, message.ID)
+	if err == nil {
+		t.Errorf("Error deleting user: message kept")
+	}
+	_, err = GetBanByID(store, bans[0].ID)
+	if err == nil {
+		t.Errorf("Error deleting user: mute kept")
+	}
+	_, err = store.Users.GetByUsername(constants.DELETED_USER_USERNAME)
+	if err == nil {
+		t.Errorf("Error deleting user: deleted user created without anything to anonymize")
+	}
+}
+
+func TestSetUserRoleKeepsAnOwner(t *testing.T) {
+	store, _, user := createAuditTestUsers(t)
+	audit := &AuditContext{Reason: "New owner"}
+
+	err := SetUserRole(store, audit, user, constants.ROLE_OWNER)
+	if err != nil {
+		t.Fatalf("Error promoting user: %v", err)
+	}
+	saved_user, err := store.Users.GetByID(user.ID)
+	if err != nil || saved_user.Role != constants.ROLE_OWNER {
+		t.Errorf("Error promoting user: role not saved (%v)", err)
+	}
+
+	// The only owner of the instance can not be demoted
+	err = SetUserRole(store, audit, user, constants.ROLE_ADMIN)
+	if err == nil {
+		t.Errorf("Error demoting user: last owner demoted")
+	}
+
+	events, err := GetAuditEvents(store, &db_model.AuditGetRequestParams{TargetID: []int{user.ID}})
+	if err != nil {
+		t.Fatalf("Error retrieving audit events: %v", err)
+	}
+	if len(events) != 1 || events[0].Action != constants.AUDIT_USER_PROMOTE || events[0].Reason != "New owner" {
+		t.Errorf("Error auditing promotion: expected a single %s event, got %+v", constants.AUDIT_USER_PROMOTE, events)
+	}
+}
+
+func TestResetUserPasswordRevokesTokens(t *testing.T) {
+	store, _, user := createAuditTestUsers(t)
+	_, _, err := GenerateUserAuthTokens(store, nil, user)
+	if err != nil {
+		t.Fatalf("Error generating tokens: %v", err)
+	}
+
+	err = ResetUserPassword(store, &AuditContext{}, user, "short")
+	if err == nil {
+		t.Errorf("Error resetting password: invalid password accepted")
+	}
+	err = ResetUserPassword(store, &AuditContext{}, user, "new_password")
+	if err != nil {
+		t.Fatalf("Error resetting password: %v", err)
+	}
+
+	tokens, err := store.Tokens.ListUserTokens(user.ID)
+	if err != nil || len(tokens) != 0 {
+		t.Errorf("Error resetting password: expected the tokens to be revoked, got %d (%v)", len(tokens), err)
+	}
+	_, _, _, _, err = LoginUserFromPassword(store, nil, user.Username, "password")
+	if err == nil {
+		t.Errorf("Error resetting password: old password still accepted")
+	}
+	_, _, _, _, err = LoginUserFromPassword(store, nil, user.Username, "new_password")
+	if err != nil {
+		t.Errorf("Error resetting password: new password refused: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package jobs
+
+import (
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_controller "github.com/boxboxjason/jukebox/internal/controller"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
+	"gorm.io/gorm"
+)
+
+// DatabaseBackup starts a background job that backs up the database and the avatars every DB_BACKUP_INTERVAL,
+// then prunes the backups that the retention policy does not keep
+func DatabaseBackup(db *gorm.DB) {
+	if db.Dialector.Name() != db_model.SQLITE_DRIVER {
+		logger.Info("Scheduled backups are only supported with SQLite, use the tooling of your database instead")
+		return
+	}
+
+	runEvery(constants.DB_BACKUP_INTERVAL, func() {
+		runDatabaseBackup(db)
+	})
+}
+
+// runDatabaseBackup creates a backup and applies the retention policy
+func runDatabaseBackup(db *gorm.DB) {
+	_, err := db_controller.CreateBackup(db)
+	if err != nil {
+		logger.Error("Error backing up the database", err)
+		return
+	}
+
+	deleted, err := db_controller.ApplyBackupRetention(db_controller.DefaultBackupRetentionPolicy())
+	if err != nil {
+		logger.Error("Error pruning the old backups", err)
+		return
+	}
+	for _, backup := range deleted {
+		logger.Info("Deleted expired backup", backup.Name)
+	}
+}
@@ -3,32 +3,58 @@ package jobs
 import (
 	"time"
 
+	"github.com/boxboxjason/jukebox/internal/constants"
 	db_controller "github.com/boxboxjason/jukebox/internal/controller"
+	"github.com/boxboxjason/jukebox/internal/middlewares"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
 	"github.com/boxboxjason/jukebox/pkg/logger"
 )
 
 // TokenCleanup starts a background job that deletes expired tokens every hour
-func TokenCleanup() {
-	token_cleanup_ticker := time.NewTicker(1 * time.Hour)
-	defer token_cleanup_ticker.Stop()
+func TokenCleanup(store *db_model.Store) {
+	runTokenCleanup(store)
 
-	err := db_controller.DeleteExpiredTokens(nil)
+	runEvery(1*time.Hour, func() {
+		runTokenCleanup(store)
+	})
+}
+
+// runTokenCleanup deletes the expired tokens
+func runTokenCleanup(store *db_model.Store) {
+	err := db_controller.DeleteExpiredTokens(store)
 	if err != nil {
 		logger.Error("Error deleting expired tokens", err)
 	} else {
 		logger.Info("Deleted expired tokens")
 	}
+}
+
+// LoginFailuresCleanup starts a background job that forgets the failed logins of the IP addresses every hour,
+// once they stayed unlocked for the lockout duration
+func LoginFailuresCleanup() {
+	runEvery(1*time.Hour, func() {
+		pruned := db_controller.PruneLoginFailures(time.Now())
+		if pruned > 0 {
+			logger.Info("Forgot the failed logins of", pruned, "IP addresses")
+		}
+	})
+}
 
-	go func() {
-		for {
-			select {
-			case <-token_cleanup_ticker.C:
-				if err := db_controller.DeleteExpiredTokens(nil); err != nil {
-					logger.Error("Error deleting expired tokens", err)
-				} else {
-					logger.Info("Deleted expired tokens")
-				}
-			}
+// SigningKeysRotation starts a background job that rotates the keys signing the access tokens and forgets the denied
+// access tokens once they expired, when the access tokens are signed
+func SigningKeysRotation() {
+	if !middlewares.SignedAccessTokensEnabled() {
+		return
+	}
+	runEvery(constants.SIGNING_KEYS_CHECK_INTERVAL, func() {
+		now := time.Now()
+		err := middlewares.RotateSigningKeys(now)
+		if err != nil {
+			logger.Error("Error rotating the signing keys", err)
+		}
+		pruned := middlewares.PruneDeniedAccessTokens(now)
+		if pruned > 0 {
+			logger.Info("Forgot", pruned, "denied access tokens")
 		}
-	}()
+	})
 }
@@ -0,0 +1,27 @@
+package jobs
+
+import (
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_controller "github.com/boxboxjason/jukebox/internal/controller"
+	"github.com/boxboxjason/jukebox/pkg/logger"
+)
+
+// ExportCleanup starts a background job that deletes the expired user exports every EXPORT_CLEANUP_INTERVAL
+// The archives left by a previous run are deleted right away, their exports are not known anymore
+func ExportCleanup() {
+	runExportCleanup()
+
+	runEvery(constants.EXPORT_CLEANUP_INTERVAL, runExportCleanup)
+}
+
+// runExportCleanup deletes the expired user exports
+func runExportCleanup() {
+	deleted, err := db_controller.DeleteExpiredExports()
+	if err != nil {
+		logger.Error("Error deleting the expired user exports", err)
+		return
+	}
+	if deleted > 0 {
+		logger.Info("Deleted", deleted, "expired user exports")
+	}
+}
@@ -1,6 +1,73 @@
 package jobs
 
-func SetupJobs() {
+import (
+	"context"
+	"sync"
+	"time"
+
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"gorm.io/gorm"
+)
+
+var (
+	// jobs_context is done once the jobs are stopped, running holds the jobs until their goroutine returned
+	jobs_context, stop_jobs = context.WithCancel(context.Background())
+	running                 sync.WaitGroup
+)
+
+func SetupJobs(db *gorm.DB, store *db_model.Store) {
 	// Start the token cleanup job
-	TokenCleanup()
+	TokenCleanup(store)
+
+	// Start the failed logins cleanup job
+	LoginFailuresCleanup()
+
+	// Start the signing keys rotation job
+	SigningKeysRotation()
+
+	// Start the database backup job
+	DatabaseBackup(db)
+
+	// Start the user exports cleanup job
+	ExportCleanup()
+
+	// Start the user deletions job
+	UserDeletionFinalizer(store)
+}
+
+// StopJobs stops the tickers of the jobs, then waits for the running ones to finish until the context is done
+func StopJobs(ctx context.Context) error {
+	stop_jobs()
+
+	stopped := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runEvery runs the job in the background every interval, until the jobs are stopped
+func runEvery(interval time.Duration, job func()) {
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-jobs_context.Done():
+				return
+			case <-ticker.C:
+				job()
+			}
+		}
+	}()
 }
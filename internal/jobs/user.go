@@ -0,0 +1,30 @@
+package jobs
+
+import (
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_controller "github.com/boxboxjason/jukebox/internal/controller"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
+)
+
+// UserDeletionFinalizer starts a background job that finalizes the due user deletions every USER_DELETION_CHECK_INTERVAL
+// The deletions that became due while the server was down are finalized right away
+func UserDeletionFinalizer(store *db_model.Store) {
+	runUserDeletionFinalizer(store)
+
+	runEvery(constants.USER_DELETION_CHECK_INTERVAL, func() {
+		runUserDeletionFinalizer(store)
+	})
+}
+
+// runUserDeletionFinalizer finalizes the due user deletions
+func runUserDeletionFinalizer(store *db_model.Store) {
+	deleted, err := db_controller.FinalizeUserDeletions(store)
+	if err != nil {
+		logger.Error("Error finalizing the user deletions", err)
+		return
+	}
+	if deleted > 0 {
+		logger.Info("Finalized", deleted, "user deletions")
+	}
+}
@@ -7,144 +7,210 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/boxboxjason/jukebox/internal/constants"
 	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
 	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
 )
 
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve the user ID and access token from the request
-		user_id, access_token, err := getUserIDAndAccessToken(r)
-		if err != nil {
-			httputils.SendErrorToClient(w, err)
-			return
-		}
-		// Open a connection to the database
-		db, err := db_model.OpenConnection()
-		if err != nil {
-			httputils.SendErrorToClient(w, err)
-			return
-		}
-		defer db_model.CloseConnection(db)
-
-		// Check if the user exists and the access token is valid
-		user, err := db_model.GetUserByID(db.Preload("Tokens").Preload("Bans"), user_id)
-		if err != nil {
-			httputils.SendErrorToClient(w, err)
+		// API tokens are only accepted on the routes that require a scope
+		if raw_api_token, ok := retrieveAPIToken(r); ok {
+			ctx, err := authenticateAPIToken(r, raw_api_token)
+			if err != nil {
+				httputils.SendErrorToClient(w, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		}
 
-		// Check if the user is under a current ban
-		bans, err := user.GetActiveBans(db)
+		// Retrieve the access token from the request
+		identity_bearer, err := retrieveAccessBearer(r)
 		if err != nil {
 			httputils.SendErrorToClient(w, err)
 			return
-		} else if len(bans) > 0 {
-			httputils.SendErrorToClient(w, httputils.NewForbiddenError(fmt.Sprintf("User is banned until %s for reason: %s", bans[0].EndsAt, bans[0].Reason)))
-			return
 		}
 
-		// Check if the access token matches the one stored in the database
-		db_access_token, err := user.CheckAuthTokenMatchesByType(db, access_token, constants.ACCESS_TOKEN)
-		if err == nil {
-			// Attach the user to the request context
-			ctx := context.WithValue(r.Context(), constants.USER_CONTEXT_KEY, user)
-			// Attach the access token to the request context
-			ctx = context.WithValue(ctx, constants.ACCESS_TOKEN_CONTEXT_KEY, db_access_token)
+		// Signed access tokens are checked without the database, the identity bearers issued before they were enabled still work
+		if SignedAccessTokensEnabled() && isSignedBearer(identity_bearer) {
+			ctx, err := authenticateSignedAccessToken(r, identity_bearer)
+			if err != nil {
+				httputils.SendErrorToClient(w, err)
+				return
+			}
 			next.ServeHTTP(w, r.WithContext(ctx))
-		} else {
-			httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("Invalid access token"))
-			return
-		}
-	})
-}
-
-func AdminAuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve the user ID and access token from the request
-		user_id, access_token, err := getUserIDAndAccessToken(r)
-		if err != nil {
-			httputils.SendErrorToClient(w, err)
 			return
 		}
 
-		// Open a connection to the database
-		db, err := db_model.OpenConnection()
+		// Retrieve the data stores
+		store, err := RetrieveStore(r)
 		if err != nil {
 			httputils.SendErrorToClient(w, err)
 			return
 		}
-		defer db_model.CloseConnection(db)
 
-		// Check if the user exists and the access token is valid
-		user, err := db_model.GetUserByID(db.Preload("Tokens").Preload("Bans"), user_id)
-		if err != nil {
-			httputils.SendErrorToClient(w, err)
+		// Check if the access token matches the one stored in the database and did not expire
+		db_access_token, err := MatchIdentityBearer(store, identity_bearer, constants.ACCESS_TOKEN)
+		if err != nil || db_access_token.User == nil {
+			httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("Invalid access token"))
 			return
 		}
 
 		// Check if the user is under a current ban
-		bans, err := user.GetActiveBans(db)
+		user := db_access_token.User
+		err = checkUserNotBanned(store, user)
 		if err != nil {
 			httputils.SendErrorToClient(w, err)
 			return
-		} else if len(bans) > 0 {
-			httputils.SendErrorToClient(w, httputils.NewForbiddenError(fmt.Sprintf("User is banned until %s for reason: %s", bans[0].EndsAt, bans[0].Reason)))
-			return
 		}
 
-		// Check if the access token matches the one stored in the database
-		db_access_token, err := user.CheckAuthTokenMatchesByType(db, access_token, constants.ACCESS_TOKEN)
-		if err == nil {
-			if user.Admin {
-				// Attach the user to the request context
-				ctx := context.WithValue(r.Context(), constants.USER_CONTEXT_KEY, user)
-				// Attach the access token to the request context
-				ctx = context.WithValue(ctx, constants.ACCESS_TOKEN_CONTEXT_KEY, db_access_token)
-				next.ServeHTTP(w, r.WithContext(ctx))
-			} else {
+		touchAccessToken(store, db_access_token, r)
+		// Attach the user to the request context
+		ctx := context.WithValue(r.Context(), constants.USER_CONTEXT_KEY, user)
+		// Attach the access token to the request context
+		ctx = context.WithValue(ctx, constants.ACCESS_TOKEN_CONTEXT_KEY, db_access_token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequirePermission guards the routes with a permission of the role of the user, it must run after the auth middlewares
+// The privileged users may be required to protect their account with two-factor authentication first
+func RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Retrieve the user from the context
+			user, ok := r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
+			if !ok {
+				httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("user not found"))
+				return
+			}
+
+			// Check if the role of the user grants the permission
+			if !db_model.RoleHasPermission(user.Role, permission) {
 				httputils.SendErrorToClient(w, httputils.NewForbiddenError("User not authorized"))
 				return
+			} else if !user.HasPermission(permission) {
+				httputils.SendErrorToClient(w, httputils.NewForbiddenError("Enable two-factor authentication to use the "+permission+" permission"))
+				return
 			}
-		} else {
-			httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("Invalid access token"))
-			return
-		}
-	})
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
-func getUserIDAndAccessToken(r *http.Request) (int, string, error) {
-	identity_bearer, err := readAccessCookie(r)
+// RequireScope declares the scope an API token needs to use the routes, it must run before the auth middlewares
+// The routes without a scope refuse the API tokens, the sessions are not limited by the scopes
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), constants.SCOPE_CONTEXT_KEY, scope)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// authenticateAPIToken checks the API token of the request and its scope for the route
+// Returns the context of the request with the user and the API token attached
+func authenticateAPIToken(r *http.Request, raw_api_token string) (context.Context, error) {
+	// Retrieve the data stores
+	store, err := RetrieveStore(r)
 	if err != nil {
-		identity_bearer, err = httputils.RetrieveAuthorizationToken(r, constants.AUTH_SCHEME)
-		if err != nil {
-			return -1, "", err
-		}
+		return nil, err
 	}
 
-	user_id, access_token, err := DecodeIdentityBearerToUserAndToken(identity_bearer)
+	// Check if the API token matches the one stored in the database and did not expire
+	// The tokens created before the selectors carry their ID instead, they are checked once with bcrypt and then given a selector
+	selector, verifier, err := DecodeAPIToken(raw_api_token)
 	if err != nil {
-		return -1, "", err
+		return nil, err
+	}
+	api_token, err := store.APITokens.MatchToken(selector, verifier)
+	if err != nil {
+		if api_token_id, legacy_err := strconv.Atoi(selector); legacy_err == nil {
+			api_token, err = store.APITokens.MatchLegacyToken(api_token_id, verifier)
+		}
+	}
+	if err != nil || api_token.User == nil {
+		return nil, httputils.NewUnauthorizedError("Invalid API token")
+	}
+	if api_token.IsExpired() {
+		return nil, httputils.NewUnauthorizedError("API token expired")
 	}
-	return user_id, access_token, nil
-}
 
-func GetUserIDAndRefreshToken(r *http.Request) (int, string, error) {
-	identity_bearer, err := readRefreshCookie(r)
+	// Check if the user is under a current ban
+	user := api_token.User
+	err = checkUserNotBanned(store, user)
 	if err != nil {
-		identity_bearer, err = httputils.RetrieveAuthorizationToken(r, constants.AUTH_SCHEME+" ")
+		return nil, err
+	}
+
+	// Check if the API token carries the scope of the route
+	scope, ok := r.Context().Value(constants.SCOPE_CONTEXT_KEY).(string)
+	if !ok {
+		return nil, httputils.NewForbiddenError("API tokens can not be used on this route")
+	} else if !api_token.HasScope(scope) {
+		return nil, httputils.NewForbiddenError("The API token lacks the " + scope + " scope")
+	}
+
+	if api_token.LastUsedAt == nil || time.Since(*api_token.LastUsedAt) >= constants.SESSION_TOUCH_INTERVAL {
+		err = store.APITokens.Touch(api_token, time.Now())
 		if err != nil {
-			return -1, "", err
+			logger.Error("Unable to record the use of API token", api_token.ID, err)
 		}
 	}
 
-	user_id, refresh_token, err := DecodeIdentityBearerToUserAndToken(identity_bearer)
+	// Attach the user and the API token to the request context
+	ctx := context.WithValue(r.Context(), constants.USER_CONTEXT_KEY, user)
+	ctx = context.WithValue(ctx, constants.API_TOKEN_CONTEXT_KEY, api_token)
+	return ctx, nil
+}
+
+// checkUserNotBanned checks that the user is not under a current ban
+func checkUserNotBanned(store *db_model.Store, user *db_model.User) error {
+	bans, err := store.Bans.ListActiveBans(user.ID)
+	if err != nil {
+		return err
+	} else if len(bans) > 0 {
+		return httputils.NewForbiddenError(fmt.Sprintf("User is banned until %s for reason: %s", bans[0].EndsAt, bans[0].Reason))
+	}
+	return nil
+}
+
+// touchAccessToken records the use of the access token by the client of the request, listed with the sessions of the user
+// The record is only written once per interval, unless the client changed
+func touchAccessToken(store *db_model.Store, token *db_model.AuthToken, r *http.Request) {
+	now := time.Now()
+	ip := httputils.RetrieveClientIP(r)
+	user_agent := r.UserAgent()
+	if token.LastUsedAt != nil && now.Sub(*token.LastUsedAt) < constants.SESSION_TOUCH_INTERVAL && token.IP == ip && token.UserAgent == user_agent {
+		return
+	}
+	err := store.Tokens.Touch(token, now, ip, user_agent)
 	if err != nil {
-		return -1, "", err
+		logger.Error("Unable to record the use of access token", token.ID, err)
 	}
-	return user_id, refresh_token, nil
+}
+
+// retrieveAPIToken retrieves the API token sent with the Bearer scheme, if the request carries one
+func retrieveAPIToken(r *http.Request) (string, bool) {
+	bearer, err := httputils.RetrieveAuthorizationToken(r, constants.AUTH_SCHEME)
+	if err != nil || !strings.HasPrefix(bearer, constants.API_TOKEN_PREFIX) {
+		return "", false
+	}
+	return bearer, true
+}
+
+// retrieveAccessBearer retrieves the identity bearer of the access token, with the Bearer scheme or from its cookie
+// The Authorization header comes first, the requests authenticated with the cookie are checked by the CSRF middleware
+func retrieveAccessBearer(r *http.Request) (string, error) {
+	if r.Header.Get("Authorization") != "" {
+		return httputils.RetrieveAuthorizationToken(r, constants.AUTH_SCHEME)
+	}
+	return readAccessCookie(r)
 }
 
 func readAccessCookie(r *http.Request) (string, error) {
@@ -155,35 +221,86 @@ func readAccessCookie(r *http.Request) (string, error) {
 	return cookie, nil
 }
 
-func readRefreshCookie(r *http.Request) (string, error) {
-	cookie, err := httputils.ReadCookie(r, constants.REFRESH_TOKEN_COOKIE_NAME)
+// ================= Identity bearers =================
+
+// MatchIdentityBearer retrieves the unexpired token of the given type the identity bearer was issued for
+// The selector of the bearer locates the token, whose hash is checked against the verifier in constant time
+// The bearers issued before the selectors are matched once against the newest legacy tokens of their user, which gives
+// the matched token a selector taken from its raw token, it is then located and checked like the newer ones
+// Only the newest LEGACY_TOKENS_SCAN_LIMIT legacy tokens of a type are checked: the older ones are refused until the newer
+// ones were used, and all of them expire at the latest once the refresh token lifetime has passed since the upgrade
+func MatchIdentityBearer(store *db_model.Store, identity_bearer string, token_type string) (*db_model.AuthToken, error) {
+	var token *db_model.AuthToken
+	selector, verifier, err := DecodeIdentityBearer(identity_bearer)
+	if err == nil {
+		token, err = store.Tokens.MatchToken(selector, verifier, token_type)
+	} else if user_id, raw_token, legacy_err := decodeLegacyIdentityBearer(identity_bearer); legacy_err == nil {
+		token, err = store.Tokens.MatchToken(db_model.LegacyTokenSelector(raw_token), raw_token, token_type)
+		if err != nil || token.UserID != user_id {
+			token, err = store.Tokens.MatchLegacyUserToken(user_id, raw_token, token_type)
+		}
+	}
 	if err != nil {
-		return "", httputils.NewUnauthorizedError("refresh token not found")
+		return nil, err
 	}
-	return cookie, nil
+
+	if token.IsExpired() {
+		return nil, httputils.NewUnauthorizedError("Token expired")
+	}
+	return token, nil
+}
+
+// EncodeIdentityBearer encodes the selector and the verifier of a token, the result is safe in a URL and in a cookie
+func EncodeIdentityBearer(selector string, verifier string) string {
+	return selector + "." + verifier
 }
 
-func DecodeIdentityBearerToUserAndToken(identity_bearer string) (int, string, error) {
-	// Decode the base64 encoded identity bearer
-	decoded_bearer, err := base64.RawStdEncoding.DecodeString(identity_bearer)
+// DecodeIdentityBearer returns the selector and the verifier of an identity bearer
+func DecodeIdentityBearer(identity_bearer string) (string, string, error) {
+	selector, verifier, found := strings.Cut(identity_bearer, ".")
+	if !found || len(selector) == 0 || len(verifier) == 0 {
+		return "", "", httputils.NewUnauthorizedError("Invalid identity bearer")
+	}
+	return selector, verifier, nil
+}
 
+// decodeLegacyIdentityBearer returns the user ID and the raw token of a bearer issued before the selectors,
+// the base64 encoding of "<user ID>:<raw token>"
+func decodeLegacyIdentityBearer(identity_bearer string) (int, string, error) {
+	// The bearers were encoded with padding, accept them without it too
+	decoded_bearer, err := base64.StdEncoding.DecodeString(identity_bearer)
 	if err != nil {
-		return -1, "", httputils.NewUnauthorizedError("Invalid identity bearer")
+		decoded_bearer, err = base64.RawStdEncoding.DecodeString(identity_bearer)
+		if err != nil {
+			return -1, "", httputils.NewUnauthorizedError("Invalid identity bearer")
+		}
 	}
 
-	parts := strings.Split(string(decoded_bearer), ":")
-	if len(parts) != 2 {
+	// The raw token is random and may contain the separator, the user ID may not
+	encoded_id, raw_token, found := strings.Cut(string(decoded_bearer), ":")
+	if !found {
 		return -1, "", httputils.NewUnauthorizedError("Invalid identity format")
 	}
 
-	user_id, err := strconv.Atoi(parts[0])
+	user_id, err := strconv.Atoi(encoded_id)
 	if err != nil || user_id < 0 {
 		return -1, "", httputils.NewUnauthorizedError("Invalid user ID")
 	}
-	return user_id, parts[1], nil
+	return user_id, raw_token, nil
 }
 
-func EncodeUserAndTokenToIdentityBearer(user_id int, access_token string) string {
-	// Encode the user ID and access token to base64
-	return base64.StdEncoding.EncodeToString([]byte(strconv.Itoa(user_id) + ":" + access_token))
+// EncodeAPIToken encodes the selector and the verifier of an API token, the selector locates the token and the verifier
+// is checked against its hash
+func EncodeAPIToken(selector string, verifier string) string {
+	return constants.API_TOKEN_PREFIX + selector + "." + verifier
+}
+
+// DecodeAPIToken returns the selector and the verifier of an API token
+// The tokens created before the selectors decode to their ID and their raw value encoded in base64url
+func DecodeAPIToken(api_token string) (string, string, error) {
+	selector, verifier, found := strings.Cut(strings.TrimPrefix(api_token, constants.API_TOKEN_PREFIX), ".")
+	if !found || len(selector) == 0 || len(verifier) == 0 {
+		return "", "", httputils.NewUnauthorizedError("Invalid API token format")
+	}
+	return selector, verifier, nil
 }
@@ -1,31 +1,291 @@
 package middlewares
 
 import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/utils/cryptutils"
 )
 
 func TestTokenEncodeDecode(t *testing.T) {
-	token := "test_token"
-	user_id := 2205
-	encoded_token := EncodeUserAndTokenToIdentityBearer(user_id, token)
-	decoded_user_id, decoded_token, err := DecodeIdentityBearerToUserAndToken(encoded_token)
+	selector, verifier, _, err := cryptutils.GenerateSplitToken()
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	encoded_token := EncodeIdentityBearer(selector, verifier)
+	decoded_selector, decoded_verifier, err := DecodeIdentityBearer(encoded_token)
 	if err != nil {
 		t.Errorf("Error decoding token: %v", err)
 	}
 
-	if decoded_user_id != user_id {
-		t.Errorf("Expected user_id %d, got %d", user_id, decoded_user_id)
+	if decoded_selector != selector {
+		t.Errorf("Expected selector %s, got %s", selector, decoded_selector)
 	}
 
-	if decoded_token != token {
-		t.Errorf("Expected token %s, got %s", token, decoded_token)
+	if decoded_verifier != verifier {
+		t.Errorf("Expected verifier %s, got %s", verifier, decoded_verifier)
 	}
 }
 
 func TestTokenEncodeDecodeInvalidToken(t *testing.T) {
-	encoded_token := "thiswontwork"
-	_, _, err := DecodeIdentityBearerToUserAndToken(encoded_token)
+	for _, encoded_token := range []string{"thiswontwork", ".verifier", "selector."} {
+		_, _, err := DecodeIdentityBearer(encoded_token)
+		if err == nil {
+			t.Errorf("Expected error decoding token %q", encoded_token)
+		}
+	}
+}
+
+func TestLegacyTokenDecode(t *testing.T) {
+	// The legacy bearers were padded, and their raw token may contain the separator
+	raw_token := "raw:token"
+	for _, encoded_token := range []string{
+		base64.StdEncoding.EncodeToString([]byte("2205:" + raw_token)),
+		base64.RawStdEncoding.EncodeToString([]byte("2205:" + raw_token)),
+	} {
+		user_id, decoded_token, err := decodeLegacyIdentityBearer(encoded_token)
+		if err != nil || user_id != 2205 || decoded_token != raw_token {
+			t.Errorf("Error decoding legacy token %q: got %d %q (%v)", encoded_token, user_id, decoded_token, err)
+		}
+	}
+
+	_, _, err := decodeLegacyIdentityBearer("thiswontwork")
+	if err == nil {
+		t.Errorf("Expected error decoding legacy token")
+	}
+}
+
+func TestMatchIdentityBearer(t *testing.T) {
+	store := db_model.NewMemoryStore()
+	user := &db_model.User{Username: "alice", Email: "alice@test.com", Hashed_Password: "hash"}
+	err := store.Users.Create(user)
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	selector, verifier, hashed_verifier, err := cryptutils.GenerateSplitToken()
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	token := &db_model.AuthToken{User: user, Selector: &selector, Hashed_Token: hashed_verifier, Expiration: time.Now().Add(time.Hour).Unix()}
+	raw_legacy_token, hashed_legacy_token, err := cryptutils.GenerateHashedToken()
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	legacy_token := &db_model.AuthToken{User: user, Hashed_Token: hashed_legacy_token, Expiration: time.Now().Add(time.Hour).Unix()}
+	for _, auth_token := range []*db_model.AuthToken{token, legacy_token} {
+		err = store.Tokens.Create(auth_token)
+		if err != nil {
+			t.Fatalf("Error creating token: %v", err)
+		}
+	}
+
+	// The bearers with a selector and the legacy ones both match their token
+	matched_token, err := MatchIdentityBearer(store, EncodeIdentityBearer(selector, verifier), constants.ACCESS_TOKEN)
+	if err != nil || matched_token.ID != token.ID || matched_token.User == nil {
+		t.Errorf("Error matching identity bearer: %v", err)
+	}
+	legacy_bearer := base64.StdEncoding.EncodeToString([]byte(strconv.Itoa(user.ID) + ":" + raw_legacy_token))
+	matched_token, err = MatchIdentityBearer(store, legacy_bearer, constants.ACCESS_TOKEN)
+	if err != nil || matched_token.ID != legacy_token.ID {
+		t.Errorf("Error matching legacy identity bearer: %v", err)
+	}
+
+	// The legacy bearer of another user does not match the upgraded token
+	other_user_bearer := base64.StdEncoding.EncodeToString([]byte(strconv.Itoa(user.ID+1) + ":" + raw_legacy_token))
+	_, err = MatchIdentityBearer(store, other_user_bearer, constants.ACCESS_TOKEN)
+	if err == nil {
+		t.Errorf("Error matching legacy identity bearer: bearer of another user matched")
+	}
+
+	// The wrong verifiers, the other types and the expired tokens do not match
+	_, err = MatchIdentityBearer(store, EncodeIdentityBearer(selector, "wrong"), constants.ACCESS_TOKEN)
+	if err == nil {
+		t.Errorf("Error matching identity bearer: wrong verifier matched")
+	}
+	_, err = MatchIdentityBearer(store, EncodeIdentityBearer(selector, verifier), constants.REFRESH_TOKEN)
+	if err == nil {
+		t.Errorf("Error matching identity bearer: token of another type matched")
+	}
+	token.Expiration = time.Now().Add(-time.Hour).Unix()
+	err = store.Tokens.Update(token)
+	if err != nil {
+		t.Fatalf("Error updating token: %v", err)
+	}
+	_, err = MatchIdentityBearer(store, EncodeIdentityBearer(selector, verifier), constants.ACCESS_TOKEN)
+	if err == nil {
+		t.Errorf("Error matching identity bearer: expired token matched")
+	}
+}
+
+func TestMatchManyLegacyIdentityBearers(t *testing.T) {
+	store := db_model.NewMemoryStore()
+	user := &db_model.User{Username: "alice", Email: "alice@test.com", Hashed_Password: "hash"}
+	err := store.Users.Create(user)
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	// The user opened more sessions before the selectors than the scan checks, oldest first
+	legacy_bearers := []string{}
+	for range constants.LEGACY_TOKENS_SCAN_LIMIT + 2 {
+		raw_legacy_token, hashed_legacy_token, err := cryptutils.GenerateHashedToken()
+		if err == nil {
+			err = store.Tokens.Create(&db_model.AuthToken{User: user, Hashed_Token: hashed_legacy_token, Expiration: time.Now().Add(time.Hour).Unix()})
+		}
+		if err != nil {
+			t.Fatalf("Error creating token: %v", err)
+		}
+		legacy_bearers = append(legacy_bearers, base64.StdEncoding.EncodeToString([]byte(strconv.Itoa(user.ID)+":"+raw_legacy_token)))
+	}
+
+	// The oldest sessions are past the scan until the newer ones were used
+	_, err = MatchIdentityBearer(store, legacy_bearers[0], constants.ACCESS_TOKEN)
 	if err == nil {
-		t.Errorf("Expected error decoding token")
+		t.Errorf("Error matching legacy identity bearer: bearer past the scan limit matched")
+	}
+	for i := len(legacy_bearers) - 1; i >= 0; i-- {
+		_, err = MatchIdentityBearer(store, legacy_bearers[i], constants.ACCESS_TOKEN)
+		if err != nil {
+			t.Errorf("Error matching legacy identity bearer %d: %v", i, err)
+		}
+	}
+
+	// Every session was then given a selector, and keeps matching
+	tokens, err := store.Tokens.ListUserTokens(user.ID)
+	if err != nil {
+		t.Fatalf("Error listing tokens: %v", err)
+	}
+	for _, token := range tokens {
+		if token.Selector == nil {
+			t.Errorf("Error upgrading legacy token %d: no selector", token.ID)
+		}
+	}
+	for i, legacy_bearer := range legacy_bearers {
+		_, err = MatchIdentityBearer(store, legacy_bearer, constants.ACCESS_TOKEN)
+		if err != nil {
+			t.Errorf("Error matching upgraded legacy identity bearer %d: %v", i, err)
+		}
+	}
+}
+
+func TestAPITokenEncodeDecode(t *testing.T) {
+	encoded_token := EncodeAPIToken("selector", "verifier")
+	selector, verifier, err := DecodeAPIToken(encoded_token)
+	if err != nil || selector != "selector" || verifier != "verifier" {
+		t.Errorf("Error decoding API token: got %q %q (%v)", selector, verifier, err)
+	}
+
+	for _, invalid_token := range []string{"jbpat_42", "jbpat_.dG9rZW4", "jbpat_42."} {
+		_, _, err = DecodeAPIToken(invalid_token)
+		if err == nil {
+			t.Errorf("Expected error decoding API token %q", invalid_token)
+		}
+	}
+}
+
+func TestAuthenticateAPIToken(t *testing.T) {
+	store := db_model.NewMemoryStore()
+	user := &db_model.User{Username: "alice", Email: "alice@test.com", Hashed_Password: "hash"}
+	err := store.Users.Create(user)
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	selector, verifier, hashed_verifier, err := cryptutils.GenerateSplitToken()
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	api_token := &db_model.APIToken{UserID: user.ID, Name: "bot", Selector: &selector, Hashed_Token: hashed_verifier, Scopes: []string{constants.SCOPE_MESSAGES_READ}}
+	raw_legacy_token, hashed_legacy_token, err := cryptutils.GenerateHashedToken()
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	legacy_api_token := &db_model.APIToken{UserID: user.ID, Name: "legacy", Hashed_Token: hashed_legacy_token, Scopes: []string{constants.SCOPE_MESSAGES_READ}}
+	for _, token := range []*db_model.APIToken{api_token, legacy_api_token} {
+		err = store.APITokens.Create(token)
+		if err != nil {
+			t.Fatalf("Error creating API token: %v", err)
+		}
+	}
+
+	authenticate := func(raw_api_token string) (*db_model.APIToken, error) {
+		r := httptest.NewRequest(http.MethodGet, "/api/messages", nil)
+		ctx := context.WithValue(r.Context(), constants.STORE_CONTEXT_KEY, store)
+		ctx = context.WithValue(ctx, constants.SCOPE_CONTEXT_KEY, constants.SCOPE_MESSAGES_READ)
+		ctx, err := authenticateAPIToken(r.WithContext(ctx), raw_api_token)
+		if err != nil {
+			return nil, err
+		}
+		return ctx.Value(constants.API_TOKEN_CONTEXT_KEY).(*db_model.APIToken), nil
+	}
+
+	// The tokens are located by their selector and checked against the hash of their verifier
+	authenticated_token, err := authenticate(EncodeAPIToken(selector, verifier))
+	if err != nil || authenticated_token.ID != api_token.ID {
+		t.Errorf("Error authenticating API token: %v", err)
+	}
+	_, err = authenticate(EncodeAPIToken(selector, "wrong_verifier"))
+	if err == nil {
+		t.Errorf("Error authenticating API token: wrong verifier accepted")
+	}
+
+	// The tokens created before the selectors are checked with bcrypt once, and then given their ID as selector
+	legacy_verifier := base64.RawURLEncoding.EncodeToString([]byte(raw_legacy_token))
+	legacy_bearer := EncodeAPIToken(strconv.Itoa(legacy_api_token.ID), legacy_verifier)
+	_, err = authenticate(EncodeAPIToken(strconv.Itoa(legacy_api_token.ID), "d3Jvbmc"))
+	if err == nil {
+		t.Errorf("Error authenticating legacy API token: wrong raw token accepted")
+	}
+	for range 2 {
+		authenticated_token, err = authenticate(legacy_bearer)
+		if err != nil || authenticated_token.ID != legacy_api_token.ID {
+			t.Errorf("Error authenticating legacy API token: %v", err)
+		}
+	}
+	upgraded_token, err := store.APITokens.GetByID(legacy_api_token.ID)
+	if err != nil || upgraded_token.Selector == nil || *upgraded_token.Selector != strconv.Itoa(legacy_api_token.ID) || !upgraded_token.MatchesVerifier(legacy_verifier) {
+		t.Errorf("Error upgrading legacy API token: got %+v (%v)", upgraded_token, err)
+	}
+
+	// The ID of the other tokens is not a selector
+	_, err = authenticate(EncodeAPIToken(strconv.Itoa(api_token.ID), verifier))
+	if err == nil {
+		t.Errorf("Error authenticating API token: ID accepted as selector")
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	guarded := RequirePermission(constants.PERMISSION_BAN_CREATE)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	test_cases := []struct {
+		name     string
+		user     *db_model.User
+		expected int
+	}{
+		{"no user", nil, http.StatusUnauthorized},
+		{"user", &db_model.User{Role: constants.ROLE_USER}, http.StatusForbidden},
+		{"moderator", &db_model.User{Role: constants.ROLE_MODERATOR}, http.StatusNoContent},
+		{"owner", &db_model.User{Role: constants.ROLE_OWNER}, http.StatusNoContent},
+	}
+	for _, test_case := range test_cases {
+		request := httptest.NewRequest(http.MethodPost, "/api/bans", nil)
+		if test_case.user != nil {
+			request = request.WithContext(context.WithValue(request.Context(), constants.USER_CONTEXT_KEY, test_case.user))
+		}
+		recorder := httptest.NewRecorder()
+		guarded.ServeHTTP(recorder, request)
+		if recorder.Code != test_case.expected {
+			t.Errorf("Error guarding route for %s: expected status %d, got %d", test_case.name, test_case.expected, recorder.Code)
+		}
 	}
 }
@@ -0,0 +1,62 @@
+package middlewares
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+)
+
+// CSRFMiddleware refuses the state-changing requests authenticated with the auth cookies, unless they carry the CSRF token
+// in a header matching its cookie (double-submit): a cross-site page makes the browser send the cookies, but can not read them
+// The clients authenticated with the Authorization header are exempt, a cross-site page can not set it
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSafeMethod(r.Method) || r.Header.Get("Authorization") != "" || !hasAuthCookie(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		err := checkCSRFToken(r)
+		if err != nil {
+			httputils.SendErrorToClient(w, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isSafeMethod tells whether the HTTP method is not meant to change the state of the server
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// hasAuthCookie tells whether the request carries the access or the refresh token cookie
+func hasAuthCookie(r *http.Request) bool {
+	for _, cookie_name := range []string{constants.ACCESS_TOKEN_COOKIE_NAME, constants.REFRESH_TOKEN_COOKIE_NAME} {
+		if _, err := r.Cookie(cookie_name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCSRFToken checks that the CSRF header of the request matches its CSRF cookie, in constant time
+func checkCSRFToken(r *http.Request) error {
+	cookie, err := httputils.ReadCookie(r, constants.CSRF_TOKEN_COOKIE_NAME)
+	if err != nil || cookie == "" {
+		return httputils.NewForbiddenError("CSRF token not found, retrieve one from " + constants.CSRF_TOKEN_ROUTE)
+	}
+	header := r.Header.Get(constants.CSRF_TOKEN_HEADER)
+	if header == "" {
+		return httputils.NewForbiddenError("Missing " + constants.CSRF_TOKEN_HEADER + " header")
+	} else if subtle.ConstantTimeCompare([]byte(header), []byte(cookie)) != 1 {
+		return httputils.NewForbiddenError("Invalid CSRF token")
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	handler := CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	access_cookie := &http.Cookie{Name: constants.ACCESS_TOKEN_COOKIE_NAME, Value: "selector.verifier"}
+	refresh_cookie := &http.Cookie{Name: constants.REFRESH_TOKEN_COOKIE_NAME, Value: "selector.verifier"}
+	csrf_cookie := &http.Cookie{Name: constants.CSRF_TOKEN_COOKIE_NAME, Value: "csrf_token"}
+
+	tests := []struct {
+		name          string
+		method        string
+		cookies       []*http.Cookie
+		authorization string
+		csrf_header   string
+		status        int
+	}{
+		{"safe method with the cookie", http.MethodGet, []*http.Cookie{access_cookie}, "", "", http.StatusOK},
+		{"no auth cookie", http.MethodPost, nil, "", "", http.StatusOK},
+		{"bearer client", http.MethodDelete, []*http.Cookie{access_cookie}, "Bearer selector.verifier", "", http.StatusOK},
+		{"access cookie without CSRF token", http.MethodPost, []*http.Cookie{access_cookie}, "", "", http.StatusForbidden},
+		{"refresh cookie without CSRF token", http.MethodPost, []*http.Cookie{refresh_cookie}, "", "", http.StatusForbidden},
+		{"CSRF header without cookie", http.MethodPut, []*http.Cookie{access_cookie}, "", "csrf_token", http.StatusForbidden},
+		{"CSRF cookie without header", http.MethodPatch, []*http.Cookie{access_cookie, csrf_cookie}, "", "", http.StatusForbidden},
+		{"CSRF header not matching the cookie", http.MethodPost, []*http.Cookie{access_cookie, csrf_cookie}, "", "other_token", http.StatusForbidden},
+		{"CSRF header matching the cookie", http.MethodPost, []*http.Cookie{access_cookie, csrf_cookie}, "", "csrf_token", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/api/messages", nil)
+		for _, cookie := range test.cookies {
+			r.AddCookie(cookie)
+		}
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		if test.csrf_header != "" {
+			r.Header.Set(constants.CSRF_TOKEN_HEADER, test.csrf_header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("Error checking the CSRF token (%s): expected status %d, got %d", test.name, test.status, w.Code)
+		}
+	}
+}
+
+func TestRetrieveAccessBearerPrefersAuthorization(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/messages", nil)
+	r.AddCookie(&http.Cookie{Name: constants.ACCESS_TOKEN_COOKIE_NAME, Value: "cookie.bearer"})
+	identity_bearer, err := retrieveAccessBearer(r)
+	if err != nil || identity_bearer != "cookie.bearer" {
+		t.Errorf("Error retrieving the bearer from the cookie: got %q (%v)", identity_bearer, err)
+	}
+
+	// The CSRF middleware lets the requests with an Authorization header through, so the cookie must not be used then
+	r.Header.Set("Authorization", "Bearer header.bearer")
+	identity_bearer, err = retrieveAccessBearer(r)
+	if err != nil || identity_bearer != "header.bearer" {
+		t.Errorf("Error retrieving the bearer from the Authorization header: got %q (%v)", identity_bearer, err)
+	}
+	r.Header.Set("Authorization", "Basic credentials")
+	_, err = retrieveAccessBearer(r)
+	if err == nil {
+		t.Errorf("Error retrieving the bearer: the cookie was used despite the Authorization header")
+	}
+}
@@ -0,0 +1,49 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+	"gorm.io/gorm"
+)
+
+// DatabaseMiddleware attaches the shared database handle to the request context
+func DatabaseMiddleware(db *gorm.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), constants.DATABASE_CONTEXT_KEY, db)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RetrieveDatabase retrieves the shared database handle from the request context
+func RetrieveDatabase(r *http.Request) (*gorm.DB, error) {
+	db, ok := r.Context().Value(constants.DATABASE_CONTEXT_KEY).(*gorm.DB)
+	if !ok || db == nil {
+		return nil, httputils.NewDatabaseError("database connection not found")
+	}
+	return db, nil
+}
+
+// StoreMiddleware attaches the data stores to the request context
+func StoreMiddleware(store *db_model.Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), constants.STORE_CONTEXT_KEY, store)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RetrieveStore retrieves the data stores from the request context
+func RetrieveStore(r *http.Request) (*db_model.Store, error) {
+	store, ok := r.Context().Value(constants.STORE_CONTEXT_KEY).(*db_model.Store)
+	if !ok || store == nil {
+		return nil, httputils.NewDatabaseError("data store not found")
+	}
+	return store, nil
+}
@@ -0,0 +1,29 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+	"github.com/boxboxjason/jukebox/pkg/utils/mailutils"
+)
+
+// MailerMiddleware attaches the mailer of the server to the request context
+func MailerMiddleware(mailer mailutils.Mailer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), constants.MAILER_CONTEXT_KEY, mailer)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RetrieveMailer retrieves the mailer of the server from the request context
+func RetrieveMailer(r *http.Request) (mailutils.Mailer, error) {
+	mailer, ok := r.Context().Value(constants.MAILER_CONTEXT_KEY).(mailutils.Mailer)
+	if !ok || mailer == nil {
+		return nil, httputils.NewInternalServerError("mailer not found")
+	}
+	return mailer, nil
+}
@@ -0,0 +1,298 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/logger"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+	"github.com/boxboxjason/jukebox/pkg/utils/jwtutils"
+)
+
+// AccessClaims are the claims of a signed access token, enough to authenticate and authorize the user without the database
+// The access tokens are still stored, so that the sessions are listed and refreshed as usual
+type AccessClaims struct {
+	Subject        string  `json:"sub"`
+	SessionID      int     `json:"sid"`
+	TokenID        int     `json:"tid"`
+	IssuedAt       float64 `json:"iat"`
+	ExpiresAt      int64   `json:"exp"`
+	Username       string  `json:"name"`
+	Role           string  `json:"role"`
+	TwoFactor      bool    `json:"2fa"`
+	VerifiedEmail  bool    `json:"email_verified"`
+	Avatar         string  `json:"avatar"`
+	SubscriberTier int     `json:"tier"`
+	BannedUntil    int64   `json:"banned_until,omitempty"`
+	BanReason      string  `json:"ban_reason,omitempty"`
+	user_id        int
+	issued_at_ms   int64
+}
+
+var (
+	// signing_key_ring signs and verifies the access tokens, nil unless the access tokens are signed
+	signing_key_ring *jwtutils.KeyRing
+
+	// The deny-list refuses the signed access tokens revoked before they expire, it is kept in memory by each instance
+	// denied_access_tokens holds the time before which the signed tokens of a stored access token were revoked or refreshed
+	// denied_users holds the time before which the signed tokens of a user were issued with a stale state (role, ban...)
+	// The entries are kept as long as the access tokens live
+	denied_access_tokens = map[int]time.Time{}
+	denied_users         = map[int]time.Time{}
+	deny_list_mutex      sync.Mutex
+)
+
+// ================= Setup =================
+
+// SetupSignedAccessTokens makes the access tokens signed tokens, with the keys of the ring
+func SetupSignedAccessTokens(ring *jwtutils.KeyRing) {
+	signing_key_ring = ring
+}
+
+// SignedAccessTokensEnabled tells whether the access tokens are signed tokens
+func SignedAccessTokensEnabled() bool {
+	return signing_key_ring != nil
+}
+
+// RotateSigningKeys picks up the keys rotated by the other instances, replaces the signing key once it is old enough
+// and deletes the keys replaced for longer than the access tokens live
+func RotateSigningKeys(now time.Time) error {
+	if signing_key_ring == nil {
+		return nil
+	}
+	err := signing_key_ring.Reload()
+	if err != nil {
+		return err
+	}
+	key, err := signing_key_ring.RotateIfOlder(constants.SIGNING_KEY_ROTATION, now)
+	if err != nil {
+		return err
+	} else if key != nil {
+		logger.Info("Access tokens now signed with key", key.ID)
+	}
+	pruned, err := signing_key_ring.Prune(constants.TOKEN_EXPIRATION_MAP[constants.ACCESS_TOKEN], now)
+	if len(pruned) > 0 {
+		logger.Info("Deleted the retired signing keys", pruned)
+	}
+	return err
+}
+
+// ================= Claims =================
+
+// NewAccessClaims returns the claims of the access token of the user, with its current ban (nil if none)
+func NewAccessClaims(user *db_model.User, token *db_model.AuthToken, ban *db_model.Ban, now time.Time) *AccessClaims {
+	claims := &AccessClaims{
+		Subject:        strconv.Itoa(user.ID),
+		TokenID:        token.ID,
+		IssuedAt:       float64(now.UnixMilli()) / 1000,
+		ExpiresAt:      token.Expiration,
+		Username:       user.Username,
+		Role:           user.Role,
+		TwoFactor:      user.TOTPEnabled,
+		VerifiedEmail:  user.VerifiedEmail,
+		Avatar:         user.Avatar,
+		SubscriberTier: user.Subscriber_Tier,
+	}
+	if token.FamilyID != nil {
+		claims.SessionID = *token.FamilyID
+	}
+	if ban != nil {
+		claims.BannedUntil = ban.EndsAt.Unix()
+		claims.BanReason = ban.Reason
+	}
+	return claims
+}
+
+// SignAccessToken returns the signed access token of the claims
+func SignAccessToken(claims *AccessClaims) (string, error) {
+	if signing_key_ring == nil {
+		return "", httputils.NewInternalServerError("The access tokens are not signed")
+	}
+	return signing_key_ring.Sign(claims)
+}
+
+// User returns the user described by the claims, it lacks the fields the claims do not carry and must not be saved
+func (claims *AccessClaims) User() *db_model.User {
+	return &db_model.User{
+		ID:              claims.user_id,
+		Username:        claims.Username,
+		Role:            claims.Role,
+		TOTPEnabled:     claims.TwoFactor,
+		VerifiedEmail:   claims.VerifiedEmail,
+		Avatar:          claims.Avatar,
+		Subscriber_Tier: claims.SubscriberTier,
+	}
+}
+
+// Token returns the stored access token the claims were issued for, without its secret
+func (claims *AccessClaims) Token() *db_model.AuthToken {
+	token := &db_model.AuthToken{
+		ID:         claims.TokenID,
+		UserID:     claims.user_id,
+		Type:       constants.ACCESS_TOKEN,
+		Expiration: claims.ExpiresAt,
+	}
+	if claims.SessionID != 0 {
+		session_id := claims.SessionID
+		token.FamilyID = &session_id
+	}
+	return token
+}
+
+// isSignedBearer tells whether the bearer is a signed token (header.payload.signature) rather than an identity bearer
+func isSignedBearer(bearer string) bool {
+	return strings.Count(bearer, ".") == 2
+}
+
+// verifySignedAccessBearer checks the signature and the expiration of a signed access token, and that it was not revoked
+func verifySignedAccessBearer(bearer string, now time.Time) (*AccessClaims, error) {
+	if signing_key_ring == nil {
+		return nil, httputils.NewUnauthorizedError("Invalid access token")
+	}
+	claims := &AccessClaims{}
+	err := signing_key_ring.Verify(bearer, claims)
+	if err != nil {
+		return nil, httputils.NewUnauthorizedError("Invalid access token")
+	}
+	claims.user_id, err = strconv.Atoi(claims.Subject)
+	if err != nil || claims.TokenID <= 0 {
+		return nil, httputils.NewUnauthorizedError("Invalid access token")
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, httputils.NewUnauthorizedError("Token expired")
+	}
+	claims.issued_at_ms = int64(math.Round(claims.IssuedAt * 1000))
+	if isAccessTokenDenied(claims) {
+		return nil, httputils.NewUnauthorizedError("Access token revoked")
+	}
+	return claims, nil
+}
+
+// authenticateSignedAccessToken checks the signed access token of the request and the ban it carries
+// Returns the context of the request with the user, the access token and the claims attached
+func authenticateSignedAccessToken(r *http.Request, bearer string) (context.Context, error) {
+	now := time.Now()
+	claims, err := verifySignedAccessBearer(bearer, now)
+	if err != nil {
+		return nil, err
+	}
+	if claims.BannedUntil > now.Unix() {
+		return nil, httputils.NewForbiddenError(fmt.Sprintf("User is banned until %s for reason: %s", time.Unix(claims.BannedUntil, 0).UTC(), claims.BanReason))
+	}
+
+	ctx := context.WithValue(r.Context(), constants.USER_CONTEXT_KEY, claims.User())
+	ctx = context.WithValue(ctx, constants.ACCESS_TOKEN_CONTEXT_KEY, claims.Token())
+	ctx = context.WithValue(ctx, constants.ACCESS_CLAIMS_CONTEXT_KEY, claims)
+	return ctx, nil
+}
+
+// MatchAccessBearer retrieves the stored access token of a signed access token, or of an identity bearer
+// The signed access tokens must still be valid, their stored token is the one they were issued for
+func MatchAccessBearer(store *db_model.Store, bearer string) (*db_model.AuthToken, error) {
+	if !SignedAccessTokensEnabled() || !isSignedBearer(bearer) {
+		return MatchIdentityBearer(store, bearer, constants.ACCESS_TOKEN)
+	}
+	claims, err := verifySignedAccessBearer(bearer, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	token, err := store.Tokens.GetByID(claims.TokenID)
+	if err != nil || token.Type != constants.ACCESS_TOKEN || token.UserID != claims.user_id {
+		return nil, httputils.NewUnauthorizedError("Invalid access token")
+	} else if token.IsExpired() {
+		return nil, httputils.NewUnauthorizedError("Token expired")
+	}
+	return token, nil
+}
+
+// LoadStoredUser replaces the user described by a signed access token with the stored user, it must run after the auth middlewares
+// The routes updating the authenticated user need every field of the user, the claims only carry a few
+func LoadStoredUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(constants.ACCESS_CLAIMS_CONTEXT_KEY).(*AccessClaims)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Retrieve the data stores
+		store, err := RetrieveStore(r)
+		if err != nil {
+			httputils.SendErrorToClient(w, err)
+			return
+		}
+		user, err := store.Users.GetByID(claims.user_id)
+		if err != nil {
+			httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("Invalid access token"))
+			return
+		}
+		ctx := context.WithValue(r.Context(), constants.USER_CONTEXT_KEY, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ================= Deny-list =================
+
+// DenyAccessTokens refuses the signed access tokens issued until now for the given stored access tokens,
+// once their session is revoked or they are refreshed
+func DenyAccessTokens(access_token_ids []int) {
+	if !SignedAccessTokensEnabled() {
+		return
+	}
+	now := time.Now()
+	deny_list_mutex.Lock()
+	defer deny_list_mutex.Unlock()
+	for _, access_token_id := range access_token_ids {
+		denied_access_tokens[access_token_id] = now
+	}
+}
+
+// DenyUserAccessTokens refuses the signed access tokens issued to the user until now, once the state they carry is stale
+// The clients refresh their access token, which carries the new state
+func DenyUserAccessTokens(user_id int) {
+	if !SignedAccessTokensEnabled() {
+		return
+	}
+	deny_list_mutex.Lock()
+	defer deny_list_mutex.Unlock()
+	denied_users[user_id] = time.Now()
+}
+
+// PruneDeniedAccessTokens forgets the denied access tokens that expired anyway
+func PruneDeniedAccessTokens(now time.Time) int {
+	access_expiration := constants.TOKEN_EXPIRATION_MAP[constants.ACCESS_TOKEN]
+	deny_list_mutex.Lock()
+	defer deny_list_mutex.Unlock()
+
+	pruned := 0
+	for _, denied := range []map[int]time.Time{denied_access_tokens, denied_users} {
+		for id, denied_at := range denied {
+			if now.After(denied_at.Add(access_expiration)) {
+				delete(denied, id)
+				pruned++
+			}
+		}
+	}
+	return pruned
+}
+
+// isAccessTokenDenied checks if the signed access token was issued before its stored token was revoked or refreshed,
+// or before the state of its user changed
+// The tokens issued within the same millisecond are let through, so that the one replacing a denied token is not refused
+func isAccessTokenDenied(claims *AccessClaims) bool {
+	deny_list_mutex.Lock()
+	defer deny_list_mutex.Unlock()
+	if denied_at, ok := denied_access_tokens[claims.TokenID]; ok && claims.issued_at_ms < denied_at.UnixMilli() {
+		return true
+	}
+	denied_at, ok := denied_users[claims.user_id]
+	return ok && claims.issued_at_ms < denied_at.UnixMilli()
+}
@@ -0,0 +1,216 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/boxboxjason/jukebox/pkg/utils/jwtutils"
+)
+
+// setupSignedAccessTokensTest signs the access tokens with a new key ring for the test, and forgets it and the deny-list once it is done
+func setupSignedAccessTokensTest(t *testing.T) *jwtutils.KeyRing {
+	ring, err := jwtutils.LoadKeyRing(t.TempDir())
+	if err == nil {
+		_, err = ring.Rotate(time.Now())
+	}
+	if err != nil {
+		t.Fatalf("Error creating the signing keys: %v", err)
+	}
+	SetupSignedAccessTokens(ring)
+	t.Cleanup(func() {
+		SetupSignedAccessTokens(nil)
+		deny_list_mutex.Lock()
+		denied_access_tokens = map[int]time.Time{}
+		denied_users = map[int]time.Time{}
+		deny_list_mutex.Unlock()
+	})
+	return ring
+}
+
+// signTestAccessToken signs an access token of the user for the stored token, with the ban (nil if none)
+func signTestAccessToken(t *testing.T, user *db_model.User, token *db_model.AuthToken, ban *db_model.Ban) string {
+	signed_token, err := SignAccessToken(NewAccessClaims(user, token, ban, time.Now()))
+	if err != nil {
+		t.Fatalf("Error signing access token: %v", err)
+	}
+	return signed_token
+}
+
+// serveSignedAccessToken serves a request authenticated with the signed token through the auth middleware, without any store,
+// and returns the status and the user the route was given
+func serveSignedAccessToken(signed_token string) (int, *db_model.User) {
+	var user *db_model.User
+	handler := AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ = r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	r.Header.Set("Authorization", constants.AUTH_SCHEME+" "+signed_token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code, user
+}
+
+func TestSignedAccessTokens(t *testing.T) {
+	setupSignedAccessTokensTest(t)
+	family_id := 7
+	user := &db_model.User{ID: 3, Username: "alice", Role: constants.ROLE_MODERATOR, TOTPEnabled: true, VerifiedEmail: true}
+	token := &db_model.AuthToken{ID: 12, FamilyID: &family_id, Expiration: time.Now().Add(time.Hour).Unix()}
+
+	// The token is checked without the database, the route gets the user it describes
+	status, authenticated := serveSignedAccessToken(signTestAccessToken(t, user, token, nil))
+	if status != http.StatusNoContent || authenticated == nil {
+		t.Fatalf("Error authenticating with a signed access token: got status %d", status)
+	}
+	if authenticated.ID != user.ID || authenticated.Role != user.Role || !authenticated.TOTPEnabled || !authenticated.VerifiedEmail {
+		t.Errorf("Error authenticating with a signed access token: got user %+v", authenticated)
+	}
+
+	// The banned users are refused until the end of their ban
+	ban := &db_model.Ban{EndsAt: time.Now().Add(time.Hour), Reason: "spam"}
+	if status, _ = serveSignedAccessToken(signTestAccessToken(t, user, token, ban)); status != http.StatusForbidden {
+		t.Errorf("Error authenticating a banned user: expected status 403, got %d", status)
+	}
+	ban.EndsAt = time.Now().Add(-time.Hour)
+	if status, _ = serveSignedAccessToken(signTestAccessToken(t, user, token, ban)); status != http.StatusNoContent {
+		t.Errorf("Error authenticating a user whose ban ended: expected status 204, got %d", status)
+	}
+
+	// The expired tokens and the tokens signed with another key are refused
+	expired_token := *token
+	expired_token.Expiration = time.Now().Add(-time.Minute).Unix()
+	if status, _ = serveSignedAccessToken(signTestAccessToken(t, user, &expired_token, nil)); status != http.StatusUnauthorized {
+		t.Errorf("Error authenticating with an expired token: expected status 401, got %d", status)
+	}
+	other_ring, _ := jwtutils.LoadKeyRing(t.TempDir())
+	other_ring.Rotate(time.Now())
+	forged_token, _ := other_ring.Sign(NewAccessClaims(user, token, nil, time.Now()))
+	if status, _ = serveSignedAccessToken(forged_token); status != http.StatusUnauthorized {
+		t.Errorf("Error authenticating with a token of another key: expected status 401, got %d", status)
+	}
+}
+
+func TestSignedAccessTokensDenyList(t *testing.T) {
+	setupSignedAccessTokensTest(t)
+	user := &db_model.User{ID: 3, Username: "alice", Role: constants.ROLE_USER}
+	token := &db_model.AuthToken{ID: 12, Expiration: time.Now().Add(time.Hour).Unix()}
+	other_token := &db_model.AuthToken{ID: 13, Expiration: token.Expiration}
+	signed_token := signTestAccessToken(t, user, token, nil)
+	other_signed_token := signTestAccessToken(t, user, other_token, nil)
+	time.Sleep(2 * time.Millisecond)
+
+	// The revoked or refreshed tokens are refused, not the ones issued for them afterwards
+	DenyAccessTokens([]int{token.ID})
+	if status, _ := serveSignedAccessToken(signed_token); status != http.StatusUnauthorized {
+		t.Errorf("Error authenticating with a denied token: expected status 401, got %d", status)
+	}
+	if status, _ := serveSignedAccessToken(other_signed_token); status != http.StatusNoContent {
+		t.Errorf("Error authenticating with another token: expected status 204, got %d", status)
+	}
+	if status, _ := serveSignedAccessToken(signTestAccessToken(t, user, token, nil)); status != http.StatusNoContent {
+		t.Errorf("Error authenticating with the refreshed token: expected status 204, got %d", status)
+	}
+
+	// Every token issued to the user before its state changed is refused
+	time.Sleep(2 * time.Millisecond)
+	DenyUserAccessTokens(user.ID)
+	if status, _ := serveSignedAccessToken(other_signed_token); status != http.StatusUnauthorized {
+		t.Errorf("Error authenticating with a stale token: expected status 401, got %d", status)
+	}
+	if status, _ := serveSignedAccessToken(signTestAccessToken(t, user, other_token, nil)); status != http.StatusNoContent {
+		t.Errorf("Error authenticating with a token issued after the change: expected status 204, got %d", status)
+	}
+
+	// The entries are forgotten once the tokens they deny expired anyway
+	if PruneDeniedAccessTokens(time.Now()) != 0 {
+		t.Errorf("Error pruning the deny-list: recent entries forgotten")
+	}
+	pruned := PruneDeniedAccessTokens(time.Now().Add(constants.TOKEN_EXPIRATION_MAP[constants.ACCESS_TOKEN] + time.Minute))
+	if pruned != 2 {
+		t.Errorf("Error pruning the deny-list: expected 2 entries forgotten, got %d", pruned)
+	}
+}
+
+func TestMatchAccessBearer(t *testing.T) {
+	setupSignedAccessTokensTest(t)
+	store := db_model.NewMemoryStore()
+	user := &db_model.User{Username: "alice", Email: "alice@test.com", Hashed_Password: "hash"}
+	err := store.Users.Create(user)
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	token := &db_model.AuthToken{User: user, Type: constants.ACCESS_TOKEN, Expiration: time.Now().Add(time.Hour).Unix()}
+	err = store.Tokens.Create(token)
+	if err != nil {
+		t.Fatalf("Error creating token: %v", err)
+	}
+
+	// The signed token leads to the stored token it was issued for
+	matched_token, err := MatchAccessBearer(store, signTestAccessToken(t, user, token, nil))
+	if err != nil || matched_token.ID != token.ID || matched_token.User == nil {
+		t.Errorf("Error matching signed access token: got %+v (%v)", matched_token, err)
+	}
+
+	// Not once the stored token is deleted, nor for another user
+	other_user := &db_model.User{ID: user.ID + 1}
+	_, err = MatchAccessBearer(store, signTestAccessToken(t, other_user, token, nil))
+	if err == nil {
+		t.Errorf("Error matching signed access token: token of another user matched")
+	}
+	err = store.Tokens.Delete(token)
+	if err != nil {
+		t.Fatalf("Error deleting token: %v", err)
+	}
+	_, err = MatchAccessBearer(store, signTestAccessToken(t, user, token, nil))
+	if err == nil {
+		t.Errorf("Error matching signed access token: deleted token matched")
+	}
+}
+
+func TestLoadStoredUser(t *testing.T) {
+	setupSignedAccessTokensTest(t)
+	store := db_model.NewMemoryStore()
+	user := &db_model.User{Username: "alice", Email: "alice@test.com", Hashed_Password: "hash"}
+	err := store.Users.Create(user)
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	token := &db_model.AuthToken{User: user, Type: constants.ACCESS_TOKEN, Expiration: time.Now().Add(time.Hour).Unix()}
+	err = store.Tokens.Create(token)
+	if err != nil {
+		t.Fatalf("Error creating token: %v", err)
+	}
+
+	// The routes writing the users get the stored user, with the fields the claims do not carry
+	serve := func(signed_token string) (int, *db_model.User) {
+		var loaded_user *db_model.User
+		handler := AuthMiddleware(LoadStoredUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			loaded_user, _ = r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
+			w.WriteHeader(http.StatusNoContent)
+		})))
+		r := httptest.NewRequest(http.MethodPatch, "/api/users/1", nil)
+		r = r.WithContext(context.WithValue(r.Context(), constants.STORE_CONTEXT_KEY, store))
+		r.Header.Set("Authorization", constants.AUTH_SCHEME+" "+signed_token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code, loaded_user
+	}
+	status, loaded_user := serve(signTestAccessToken(t, user, token, nil))
+	if status != http.StatusNoContent || loaded_user == nil || loaded_user.ID != user.ID || loaded_user.Email != user.Email || loaded_user.Hashed_Password != user.Hashed_Password {
+		t.Errorf("Error loading the stored user: got status %d and user %+v", status, loaded_user)
+	}
+
+	// Not once the user is gone
+	err = store.Users.Delete(user)
+	if err != nil {
+		t.Fatalf("Error deleting user: %v", err)
+	}
+	if status, _ = serve(signTestAccessToken(t, user, token, nil)); status != http.StatusUnauthorized {
+		t.Errorf("Error loading a deleted user: expected status 401, got %d", status)
+	}
+}
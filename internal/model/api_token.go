@@ -0,0 +1,124 @@
+package db_model
+
+import (
+	"encoding/base64"
+	"strconv"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	"github.com/boxboxjason/jukebox/pkg/utils/cryptutils"
+	"gorm.io/gorm"
+)
+
+// APIToken is a named, long-lived token a user creates for its bots and integrations
+// It is limited to its scopes, and expires at ExpiresAt if set. It is located by its public selector and checked against
+// the hash of its verifier. The tokens created before the selectors have none until their first use, see MatchesLegacyToken
+type APIToken struct {
+	ID           int        `gorm:"primaryKey;autoIncrement" json:"id"`
+	Selector     *string    `gorm:"type:TEXT;uniqueIndex;default:null" json:"-"`
+	UserID       int        `gorm:"type:INTEGER;not null;index" json:"user_id"`
+	User         *User      `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+	Name         string     `gorm:"type:TEXT;not null" json:"name"`
+	Hashed_Token string     `gorm:"type:TEXT;not null" json:"-"`
+	Scopes       []string   `gorm:"type:TEXT;not null;serializer:json" json:"scopes"`
+	ExpiresAt    *time.Time `gorm:"default:null" json:"expires_at"`
+	LastUsedAt   *time.Time `gorm:"default:null" json:"last_used_at"`
+	CreatedAt    time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	ModifiedAt   time.Time  `gorm:"autoUpdateTime:milli" json:"modified_at"`
+}
+
+// HasScope checks if the API token carries the scope
+// The bans:write scope covers bans:read, which the tokens created before the read scope existed relied on
+func (api_token *APIToken) HasScope(scope string) bool {
+	for _, token_scope := range api_token.Scopes {
+		if token_scope == scope || (scope == constants.SCOPE_BANS_READ && token_scope == constants.SCOPE_BANS_WRITE) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsExpired checks if the API token expired, the tokens without expiry never expire
+func (api_token *APIToken) IsExpired() bool {
+	return api_token.ExpiresAt != nil && api_token.ExpiresAt.Before(time.Now())
+}
+
+// MatchesVerifier checks in constant time if the verifier matches the hash of the API token
+// The tokens created before the selectors never match, they are checked with MatchesLegacyToken
+func (api_token *APIToken) MatchesVerifier(verifier string) bool {
+	return api_token.Selector != nil && cryptutils.CompareHashAndVerifier(api_token.Hashed_Token, verifier)
+}
+
+// MatchesLegacyToken checks if the verifier matches the bcrypt hash of an API token created before the selectors
+// Those tokens were sent as their ID and their raw value encoded in base64url, which act as their selector and verifier
+func (api_token *APIToken) MatchesLegacyToken(verifier string) bool {
+	raw_token, err := base64.RawURLEncoding.DecodeString(verifier)
+	return err == nil && api_token.Selector == nil && cryptutils.CompareHashAndString(api_token.Hashed_Token, string(raw_token))
+}
+
+// ================ CRUD Operations ================
+// ================ Create ================
+// CreateAPIToken creates a new API token in the database
+func (api_token *APIToken) CreateAPIToken(db *gorm.DB) error {
+	return db.Create(api_token).Error
+}
+
+// ================ Read ================
+// GetAPITokenByID retrieves an API token from the database by ID
+func GetAPITokenByID(db *gorm.DB, id int) (*APIToken, error) {
+	api_token := &APIToken{}
+	err := db.First(api_token, id).Error
+	return api_token, err
+}
+
+// GetAPITokenBySelector retrieves an API token from the database by selector
+func GetAPITokenBySelector(db *gorm.DB, selector string) (*APIToken, error) {
+	api_token := &APIToken{}
+	err := db.Where("selector = ?", selector).First(api_token).Error
+	return api_token, err
+}
+
+// GetUserAPITokens retrieves all the API tokens of a user from the database, oldest first
+func (user *User) GetUserAPITokens(db *gorm.DB) ([]*APIToken, error) {
+	var api_tokens []*APIToken
+	err := db.Where("user_id = ?", user.ID).Order("id asc").Find(&api_tokens).Error
+	return api_tokens, err
+}
+
+// ================ Update ================
+// UpdateAPIToken updates an API token in the database
+func (api_token *APIToken) UpdateAPIToken(db *gorm.DB) error {
+	return db.Save(api_token).Error
+}
+
+// TouchAPIToken records the last use of an API token, without touching its other fields
+func (api_token *APIToken) TouchAPIToken(db *gorm.DB, used_at time.Time) error {
+	api_token.LastUsedAt = &used_at
+	return db.Model(api_token).UpdateColumn("last_used_at", used_at).Error
+}
+
+// UpgradeLegacyAPIToken gives an API token created before the selectors its ID as selector, and replaces its bcrypt hash
+// by the hash of its verifier, so that it is not checked with bcrypt anymore
+func (api_token *APIToken) UpgradeLegacyAPIToken(db *gorm.DB, verifier string) error {
+	api_token.upgradeLegacyToken(verifier)
+	return db.Model(&APIToken{}).Where("id = ? AND selector IS NULL", api_token.ID).
+		UpdateColumns(map[string]any{"selector": *api_token.Selector, "hashed_token": api_token.Hashed_Token}).Error
+}
+
+// upgradeLegacyToken sets the selector and the hash of an API token created before the selectors, without saving them
+func (api_token *APIToken) upgradeLegacyToken(verifier string) {
+	selector := strconv.Itoa(api_token.ID)
+	api_token.Selector = &selector
+	api_token.Hashed_Token = cryptutils.HashVerifier(verifier)
+}
+
+// ================ Delete ================
+// DeleteAPIToken deletes an API token from the database
+func (api_token *APIToken) DeleteAPIToken(db *gorm.DB) error {
+	return db.Delete(api_token).Error
+}
+
+// DeleteUserAPITokens deletes all the API tokens of a user from the database
+func (user *User) DeleteUserAPITokens(db *gorm.DB) error {
+	return db.Where("user_id = ?", user.ID).Delete(APIToken{}).Error
+}
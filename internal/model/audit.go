@@ -0,0 +1,123 @@
+package db_model
+
+import (
+	"encoding/json"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AuditEvent records a privileged action, the table is append only
+// The actor is kept by ID and username so that the event stays readable once the actor is deleted
+type AuditEvent struct {
+	ID            int           `gorm:"primaryKey;autoIncrement" json:"id"`
+	ActorID       int           `gorm:"type:INTEGER;not null;index" json:"actor_id"`
+	ActorUsername string        `gorm:"type:TEXT;not null" json:"actor_username"`
+	Action        string        `gorm:"type:TEXT;not null;index" json:"action"`
+	TargetType    string        `gorm:"type:TEXT;not null;index:idx_audit_events_target" json:"target_type"`
+	TargetID      int           `gorm:"type:INTEGER;not null;index:idx_audit_events_target" json:"target_id"`
+	Before        AuditSnapshot `gorm:"type:TEXT" json:"before"`
+	After         AuditSnapshot `gorm:"type:TEXT" json:"after"`
+	Reason        string        `gorm:"type:TEXT" json:"reason"`
+	IP            string        `gorm:"type:TEXT" json:"ip"`
+	RequestID     string        `gorm:"type:TEXT;index" json:"request_id"`
+	CreatedAt     time.Time     `gorm:"autoCreateTime;index" json:"created_at"`
+}
+
+// AuditSnapshot is the JSON representation of a record before or after a privileged action
+// It is stored as text and sent to the clients as a JSON value (null when empty)
+type AuditSnapshot string
+
+// NewAuditSnapshot returns the snapshot of the record, an empty snapshot for nil
+func NewAuditSnapshot(record any) (AuditSnapshot, error) {
+	if record == nil {
+		return "", nil
+	}
+	snapshot, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	return AuditSnapshot(snapshot), nil
+}
+
+// MarshalJSON sends the snapshot as a JSON value instead of a string
+func (snapshot AuditSnapshot) MarshalJSON() ([]byte, error) {
+	if snapshot == "" {
+		return []byte("null"), nil
+	}
+	return []byte(snapshot), nil
+}
+
+// UnmarshalJSON reads the snapshot from a JSON value
+func (snapshot *AuditSnapshot) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*snapshot = ""
+		return nil
+	}
+	*snapshot = AuditSnapshot(data)
+	return nil
+}
+
+// ==================== Request parameters ====================
+
+// AuditGetRequestParams is the struct for the request body of the GET audit endpoint
+type AuditGetRequestParams struct {
+	Order      string    `json:"order"`
+	Limit      int       `json:"limit"`
+	Page       int       `json:"page"`
+	Offset     int       `json:"offset"`
+	ActorID    []int     `json:"actor_id"`
+	Action     []string  `json:"action"`
+	TargetType []string  `json:"target_type"`
+	TargetID   []int     `json:"target_id"`
+	RequestID  string    `json:"request_id"`
+	Since      time.Time `json:"since"`
+	Until      time.Time `json:"until"`
+}
+
+// ================ CRUD Operations ================
+// ================ Create ================
+// CreateAuditEvent creates a new audit event in the database
+func (event *AuditEvent) CreateAuditEvent(db *gorm.DB) error {
+	return db.Create(event).Error
+}
+
+// CreateAuditEvents creates multiple audit events in the database
+func CreateAuditEvents(db *gorm.DB, events []*AuditEvent) error {
+	return db.Create(&events).Error
+}
+
+// ================ Read ================
+// GetAuditEvents retrieves the audit events matching all of the filters
+// Since and Until bound the creation date (inclusive) when they are set
+func GetAuditEvents(db *gorm.DB, query_params *AuditGetRequestParams) ([]*AuditEvent, error) {
+	query := db.Model(&AuditEvent{})
+	if len(query_params.ActorID) > 0 {
+		query = query.Where("actor_id IN ?", query_params.ActorID)
+	}
+	if len(query_params.Action) > 0 {
+		query = query.Where("action IN ?", query_params.Action)
+	}
+	if len(query_params.TargetType) > 0 {
+		query = query.Where("target_type IN ?", query_params.TargetType)
+	}
+	if len(query_params.TargetID) > 0 {
+		query = query.Where("target_id IN ?", query_params.TargetID)
+	}
+	if query_params.RequestID != "" {
+		query = query.Where("request_id = ?", query_params.RequestID)
+	}
+	if !query_params.Since.IsZero() {
+		query = query.Where("created_at >= ?", query_params.Since.UTC())
+	}
+	if !query_params.Until.IsZero() {
+		query = query.Where("created_at <= ?", query_params.Until.UTC())
+	}
+
+	// Apply order, limit, page, and offset
+	query = AddQueryParamsToDB(query, query_params.Order, query_params.Limit, query_params.Page, query_params.Offset)
+
+	events := []*AuditEvent{}
+	err := query.Find(&events).Error
+	return events, err
+}
@@ -0,0 +1,112 @@
+package db_model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+	"github.com/mattn/go-sqlite3"
+	"gorm.io/gorm"
+)
+
+// SnapshotDatabase writes a consistent copy of the live database to destination_path
+// VACUUM INTO reads the database in a single transaction, so the server keeps serving requests meanwhile
+func SnapshotDatabase(db *gorm.DB, destination_path string) error {
+	if db.Dialector.Name() != SQLITE_DRIVER {
+		return httputils.NewNotImplementedError("database snapshots are only supported with SQLite")
+	}
+
+	// VACUUM INTO refuses to overwrite an existing file
+	err := os.Remove(destination_path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return db.Exec("VACUUM INTO ?", destination_path).Error
+}
+
+// RestoreDatabase replaces the content of the live database with the snapshot at source_path
+// The pages are copied with the SQLite online backup API through one of the pooled connections,
+// so every other connection of the pool sees the restored content without reopening the database
+func RestoreDatabase(db *gorm.DB, source_path string) error {
+	if db.Dialector.Name() != SQLITE_DRIVER {
+		return httputils.NewNotImplementedError("database restores are only supported with SQLite")
+	}
+
+	// Make sure the snapshot can be used by this build before touching the live database
+	err := checkSnapshotSchema(source_path)
+	if err != nil {
+		return err
+	}
+
+	source_db, err := sql.Open("sqlite3", "file:"+source_path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer source_db.Close()
+
+	sql_db, err := db.DB()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	destination_conn, err := sql_db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destination_conn.Close()
+
+	source_conn, err := source_db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer source_conn.Close()
+
+	return destination_conn.Raw(func(destination_driver_conn any) error {
+		destination, ok := destination_driver_conn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unexpected database driver connection %T", destination_driver_conn)
+		}
+		return source_conn.Raw(func(source_driver_conn any) error {
+			source, ok := source_driver_conn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("unexpected database driver connection %T", source_driver_conn)
+			}
+
+			backup, err := destination.Backup("main", source, "main")
+			if err != nil {
+				return err
+			}
+			_, err = backup.Step(-1)
+			if err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// checkSnapshotSchema checks that the schema of the snapshot at path is clean and known to this build
+func checkSnapshotSchema(path string) error {
+	options := DefaultDatabaseOptions()
+	options.DSN = SQLITE_DRIVER + "://" + path
+	options.MaxOpenConns = 1
+	snapshot_db, err := OpenDatabase(options)
+	if err != nil {
+		return err
+	}
+	defer CloseDatabase(snapshot_db)
+
+	if !snapshot_db.Migrator().HasTable(&SchemaMigration{}) {
+		return httputils.NewBadRequestError("the snapshot does not contain a JukeBox database")
+	}
+	err = CheckSchema(snapshot_db)
+	if err != nil {
+		return httputils.NewBadRequestError(err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package db_model
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotAndRestoreDatabase(t *testing.T) {
+	db := openEmptyTestDatabase(t)
+	_, err := MigrateUp(db, 0)
+	if err != nil {
+		t.Fatalf("Error migrating up: %v", err)
+	}
+
+	user := &User{Username: "snapshot_user", Email: "snapshot@example.com", Hashed_Password: "hash"}
+	err = user.CreateUser(db)
+	if err != nil {
+		t.Fatalf("Error creating the user: %v", err)
+	}
+
+	snapshot_path := filepath.Join(t.TempDir(), "snapshot.db")
+	err = SnapshotDatabase(db, snapshot_path)
+	if err != nil {
+		t.Fatalf("Error taking the snapshot: %v", err)
+	}
+
+	// Changes made after the snapshot are lost by the restore
+	err = user.DeleteUser(db)
+	if err != nil {
+		t.Fatalf("Error deleting the user: %v", err)
+	}
+
+	err = RestoreDatabase(db, snapshot_path)
+	if err != nil {
+		t.Fatalf("Error restoring the snapshot: %v", err)
+	}
+
+	restored_user, err := GetUserByUsername(db, "snapshot_user")
+	if err != nil || restored_user.Email != "snapshot@example.com" {
+		t.Errorf("Expected the user to be restored, got %v (%v)", restored_user, err)
+	}
+}
+
+func TestRestoreDatabaseRejectsForeignFile(t *testing.T) {
+	db := openEmptyTestDatabase(t)
+	_, err := MigrateUp(db, 0)
+	if err != nil {
+		t.Fatalf("Error migrating up: %v", err)
+	}
+
+	// An empty database is not a JukeBox snapshot
+	foreign_path := filepath.Join(t.TempDir(), "foreign.db")
+	foreign_db := openEmptyTestDatabase(t)
+	err = SnapshotDatabase(foreign_db, foreign_path)
+	if err != nil {
+		t.Fatalf("Error taking the snapshot: %v", err)
+	}
+
+	err = RestoreDatabase(db, foreign_path)
+	if err == nil {
+		t.Errorf("Expected the restore of a foreign database to fail")
+	}
+	if !db.Migrator().HasTable(&User{}) {
+		t.Errorf("Expected the live database to be left untouched")
+	}
+}
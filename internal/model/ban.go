@@ -20,6 +20,12 @@ type Ban struct {
 	ModifiedAt time.Time `gorm:"autoUpdateTime:milli" json:"modified_at"`
 }
 
+// BeforeSave stores the end of the ban in UTC, so that it compares the same way on every driver
+func (ban *Ban) BeforeSave(tx *gorm.DB) (err error) {
+	ban.EndsAt = ban.EndsAt.UTC()
+	return nil
+}
+
 // ==================== Request parameters ====================
 
 // BansPostRequestParams is the struct for the request body of the POST bans endpoint
@@ -100,7 +106,7 @@ func GetAllBans(db *gorm.DB) ([]*Ban, error) {
 
 // GetActiveBans retrieves all active bans from the database
 func GetActiveBans(db *gorm.DB) ([]*Ban, error) {
-	current_time := time.Now()
+	current_time := currentTime()
 	bans := []*Ban{}
 	err := db.Where("ends_at > ?", current_time).Find(&bans).Error
 	return bans, err
@@ -123,7 +129,7 @@ func (user *User) GetMutes(db *gorm.DB) ([]*Ban, error) {
 // GetActiveBans retrieves all active bans targeting a user from the database
 // The current bans are sorted by the end date
 func (user *User) GetActiveBans(db *gorm.DB) ([]*Ban, error) {
-	current_time := time.Now()
+	current_time := currentTime()
 	bans := []*Ban{}
 	var err error
 	if len(user.Bans) > 0 {
@@ -141,7 +147,7 @@ func (user *User) GetActiveBans(db *gorm.DB) ([]*Ban, error) {
 // GetActiveMutes retrieves all active mutes targeting a user from the database
 // The current mutes are sorted by the end date
 func (user *User) GetActiveMutes(db *gorm.DB) ([]*Ban, error) {
-	current_time := time.Now()
+	current_time := currentTime()
 	bans := []*Ban{}
 	err := db.Where("target_id = ? AND ends_at > ? AND type = ?", user.ID, current_time, constants.MUTE_TYPE).Order("ends_at desc").Find(&bans).Error
 	return bans, err
@@ -156,14 +162,15 @@ func (user *User) GetIssuedBans(db *gorm.DB) ([]*Ban, error) {
 
 // GetActiveIssuedBans retrieves all active bans issued by a user from the database
 func (user *User) GetActiveIssuedBans(db *gorm.DB) ([]*Ban, error) {
-	current_time := time.Now()
+	current_time := currentTime()
 	bans := []*Ban{}
 	err := db.Where("issuer_id = ? AND ends_at > ?", user.ID, current_time).Find(&bans).Error
 	return bans, err
 }
 
+// GetBansByFilters retrieves the bans ending after EndsAfter and matching all of the other filters
 func GetBansByFilters(db *gorm.DB, query_params *BansGetRequestParams) ([]*Ban, error) {
-	query := db.Where("ends_at > ?", query_params.EndsAfter)
+	query := db.Where("ends_at > ?", query_params.EndsAfter.UTC())
 	if len(query_params.TargetID) > 0 {
 		query = query.Where("target_id IN ?", query_params.TargetID)
 	}
@@ -175,10 +182,11 @@ func GetBansByFilters(db *gorm.DB, query_params *BansGetRequestParams) ([]*Ban,
 	}
 
 	if query_params.Reason != "" {
-		query = query.Where("reason LIKE ?", "%"+query_params.Reason+"%")
+		query = query.Where(containsCondition("reason"), containsPattern(query_params.Reason))
+	}
+	if len(query_params.ID) > 0 {
+		query = query.Where("id IN ?", query_params.ID)
 	}
-
-	query.Or("id IN ?", query_params.ID)
 
 	// Apply order, limit, page, and offset
 	query = AddQueryParamsToDB(query, query_params.Order, query_params.Limit, query_params.Page, query_params.Offset)
@@ -194,6 +202,17 @@ func (ban *Ban) UpdateBan(db *gorm.DB) error {
 	return db.Save(ban).Error
 }
 
+// ReassignUserBans gives the bans issued and received by a user to another user, without touching their modification date
+func ReassignUserBans(db *gorm.DB, from_user_id int, to_user_id int) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Ban{}).Where("issuer_id = ?", from_user_id).UpdateColumn("issuer_id", to_user_id).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&Ban{}).Where("target_id = ?", from_user_id).UpdateColumn("target_id", to_user_id).Error
+	})
+}
+
 // ================ Delete ================
 // DeleteBan deletes a ban from the database
 func (ban *Ban) DeleteBan(db *gorm.DB) error {
@@ -209,6 +228,7 @@ func DeleteBans(db *gorm.DB, bans []*Ban) error {
 	return db.Delete(&bans).Error
 }
 
+// DeleteBansByFilters deletes the bans matching all of the filters
 func DeleteBansByFilters(db *gorm.DB, query_params *BansDeleteRequestParams) error {
 	query := db
 	if len(query_params.TargetID) > 0 {
@@ -220,8 +240,9 @@ func DeleteBansByFilters(db *gorm.DB, query_params *BansDeleteRequestParams) err
 	if len(query_params.Type) > 0 {
 		query = query.Where("type IN ?", query_params.Type)
 	}
-
-	query.Or("id IN ?", query_params.ID)
+	if len(query_params.ID) > 0 {
+		query = query.Where("id IN ?", query_params.ID)
+	}
 
 	// Apply order, limit, page, and offset
 	query = AddQueryParamsToDB(query, query_params.Order, query_params.Limit, query_params.Page, query_params.Offset)
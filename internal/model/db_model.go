@@ -1,79 +1,178 @@
 package db_model
 
 import (
+	"database/sql"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/boxboxjason/jukebox/internal/constants"
 	"github.com/boxboxjason/jukebox/pkg/logger"
 	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-// Initialize the database connection and create the tables
-func CreateTables() {
-	db, err := OpenConnection()
+const (
+	// SQLite storage driver (name of the gorm dialector)
+	SQLITE_DRIVER = "sqlite"
+	// PostgreSQL storage driver (name of the gorm dialector)
+	POSTGRES_DRIVER = "postgres"
+)
+
+// DatabaseOptions holds the settings of the shared database handle and its connection pool
+// The DSN selects the storage driver:
+//   - sqlite://<path>, file:<path> or a bare path for SQLite
+//   - postgres://... or postgresql://... for PostgreSQL
+type DatabaseOptions struct {
+	DSN             string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	BusyTimeout     time.Duration
+}
+
+// DefaultDatabaseOptions returns the database options built from the constants
+func DefaultDatabaseOptions() *DatabaseOptions {
+	return &DatabaseOptions{
+		DSN:             SQLITE_DRIVER + "://" + constants.DB_FILE,
+		MaxOpenConns:    constants.DB_MAX_OPEN_CONNECTIONS,
+		MaxIdleConns:    constants.DB_MAX_IDLE_CONNECTIONS,
+		ConnMaxLifetime: constants.DB_CONNECTION_MAX_LIFETIME,
+		ConnMaxIdleTime: constants.DB_CONNECTION_MAX_IDLE_TIME,
+		BusyTimeout:     constants.DB_BUSY_TIMEOUT,
+	}
+}
+
+// OpenDatabase opens the shared database handle with the driver selected by the DSN and configures its connection pool
+// The returned handle is safe for concurrent use and must be closed with CloseDatabase
+func OpenDatabase(options *DatabaseOptions) (*gorm.DB, error) {
+	driver, source, err := ParseDatabaseDSN(options.DSN)
 	if err != nil {
-		logger.Fatal("Failed to open the database connection")
+		logger.Critical("Invalid database DSN", err)
+		return nil, err
 	}
-	defer CloseConnection(db)
-	logger.Info("Creating tables")
-	if !db.Migrator().HasTable(&User{}) || !db.Migrator().HasTable(&AuthToken{}) || !db.Migrator().HasTable(&Message{}) || !db.Migrator().HasTable(&Ban{}) {
-		err = db.AutoMigrate(&User{}, &AuthToken{}, &Message{}, &Ban{})
+
+	var dialector gorm.Dialector
+	switch driver {
+	case SQLITE_DRIVER:
+		err = os.MkdirAll(filepath.Dir(source), os.ModePerm)
 		if err != nil {
-			logger.Fatal("Failed to create tables:", err)
-		} else {
-			logger.Info("Tables created successfully")
+			logger.Critical("Failed to create the database directory", err)
+			return nil, httputils.NewDatabaseError("Failed to create the database directory")
 		}
+		dialector = sqlite.Open(sqliteDSN(source, options))
+	case POSTGRES_DRIVER:
+		dialector = postgres.Open(source)
 	}
-}
 
-// OpenConnection opens a connection to the SQLite database
-func OpenConnection() (*gorm.DB, error) {
-	err := os.MkdirAll(constants.DB_DIR, os.ModePerm)
+	db, err := gorm.Open(dialector, &gorm.Config{
+		// Timestamps are always stored in UTC so that they compare the same way on every driver
+		NowFunc: currentTime,
+	})
 	if err != nil {
-		logger.Critical("Failed to create the database directory", err)
-		return nil, httputils.NewDatabaseError("Failed to create the database directory")
+		logger.Critical("Failed to open the database connection", err)
+		return nil, err
 	}
 
-	db, err := gorm.Open(sqlite.Open(constants.DB_FILE), &gorm.Config{})
+	sql_db, err := db.DB()
 	if err != nil {
-		logger.Critical("Failed to open the database connection", err)
+		logger.Critical("Failed to retrieve the database connection pool", err)
 		return nil, err
 	}
+	sql_db.SetMaxOpenConns(options.MaxOpenConns)
+	sql_db.SetMaxIdleConns(options.MaxIdleConns)
+	sql_db.SetConnMaxLifetime(options.ConnMaxLifetime)
+	sql_db.SetConnMaxIdleTime(options.ConnMaxIdleTime)
 
+	// Make sure the database is reachable before handing it out
+	err = sql_db.Ping()
+	if err != nil {
+		logger.Critical("Failed to reach the database", err)
+		sql_db.Close()
+		return nil, err
+	}
+
+	logger.Info("Connected to the", driver, "database")
 	return db, nil
 }
 
-// CloseConnection closes the connection to the SQLite database
-func CloseConnection(db *gorm.DB) error {
-	sqlDB, err := db.DB()
+// ParseDatabaseDSN returns the storage driver selected by the DSN and the data source to hand to that driver
+func ParseDatabaseDSN(dsn string) (string, string, error) {
+	dsn = strings.TrimSpace(dsn)
+	switch {
+	case dsn == "":
+		return "", "", httputils.NewDatabaseError("empty database DSN")
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return POSTGRES_DRIVER, dsn, nil
+	case strings.HasPrefix(dsn, SQLITE_DRIVER+"://"):
+		return SQLITE_DRIVER, strings.TrimPrefix(dsn, SQLITE_DRIVER+"://"), nil
+	case strings.HasPrefix(dsn, "file:"):
+		return SQLITE_DRIVER, strings.TrimPrefix(dsn, "file:"), nil
+	case strings.Contains(dsn, "://"):
+		return "", "", httputils.NewDatabaseError("unsupported database driver in DSN, use sqlite:// or postgres://")
+	default:
+		return SQLITE_DRIVER, dsn, nil
+	}
+}
+
+// sqliteDSN builds the SQLite DSN, every pooled connection is opened in WAL mode
+// with a busy timeout so that concurrent writers wait instead of failing
+func sqliteDSN(path string, options *DatabaseOptions) string {
+	params := url.Values{}
+	params.Set("_journal_mode", "WAL")
+	params.Set("_synchronous", "NORMAL")
+	params.Set("_busy_timeout", strconv.FormatInt(options.BusyTimeout.Milliseconds(), 10))
+	params.Set("_txlock", "immediate")
+	return "file:" + path + "?" + params.Encode()
+}
+
+// CloseDatabase closes the shared database handle and all of its pooled connections
+func CloseDatabase(db *gorm.DB) error {
+	sql_db, err := db.DB()
 	if err != nil {
 		return err
 	}
 
-	return sqlDB.Close()
+	return sql_db.Close()
 }
 
-// CheckDatabase checks if the database is accessible
-func CheckDatabase() error {
-	db, err := OpenConnection()
+// DatabaseStats returns the statistics of the database connection pool
+func DatabaseStats(db *gorm.DB) (sql.DBStats, error) {
+	sql_db, err := db.DB()
 	if err != nil {
-		return err
+		return sql.DBStats{}, err
 	}
-	defer CloseConnection(db)
+	return sql_db.Stats(), nil
+}
 
+// CheckDatabase checks if the database is accessible
+func CheckDatabase(db *gorm.DB) error {
 	return db.Exec("SELECT 1").Error
 }
 
-func DatabaseVersion() string {
+// DatabaseVersion returns the name and version of the database engine behind the handle
+func DatabaseVersion(db *gorm.DB) string {
 	var version string
-	db, err := OpenConnection()
+	var err error
+	switch db.Dialector.Name() {
+	case SQLITE_DRIVER:
+		err = db.Raw("SELECT sqlite_version()").Scan(&version).Error
+		version = "SQLite " + version
+	case POSTGRES_DRIVER:
+		err = db.Raw("SHOW server_version").Scan(&version).Error
+		version = "PostgreSQL " + version
+	default:
+		return fmt.Sprintf("unknown (%s)", db.Dialector.Name())
+	}
 	if err != nil {
 		return "error"
 	}
-	defer CloseConnection(db)
-	db.Raw("SELECT sqlite_version()").Scan(&version)
-	return fmt.Sprintf("SQLite %s", version)
+	return version
 }
@@ -0,0 +1,354 @@
+package db_model
+
+import (
+	"errors"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+	"gorm.io/gorm"
+)
+
+// NewGormStore returns the stores backed by the database handle
+func NewGormStore(db *gorm.DB) *Store {
+	return &Store{
+		Users:      &gormUserStore{db: db},
+		Messages:   &gormMessageStore{db: db},
+		Bans:       &gormBanStore{db: db},
+		Tokens:     &gormTokenStore{db: db},
+		Audit:      &gormAuditStore{db: db},
+		Identities: &gormIdentityStore{db: db},
+		APITokens:  &gormAPITokenStore{db: db},
+	}
+}
+
+// ================ Users ================
+
+type gormUserStore struct{ db *gorm.DB }
+
+func (store *gormUserStore) Create(user *User) error {
+	return user.CreateUser(store.db)
+}
+
+func (store *gormUserStore) GetByID(id int) (*User, error) {
+	return nilOnError(GetUserByID(store.db, id))
+}
+
+func (store *gormUserStore) GetByUsername(username string) (*User, error) {
+	return nilOnError(GetUserByUsername(store.db, username))
+}
+
+func (store *gormUserStore) GetByEmail(email string) (*User, error) {
+	return nilOnError(GetUserByEmail(store.db, email))
+}
+
+func (store *gormUserStore) GetByUsernameOrEmail(username_or_email string) (*User, error) {
+	return nilOnError(GetUserByUsernameOREmail(store.db, username_or_email))
+}
+
+func (store *gormUserStore) List(query_params *UsersGetRequestParams) ([]*User, error) {
+	return GetUsersByFilters(store.db, query_params)
+}
+
+func (store *gormUserStore) ListDeletionsDue(due_at time.Time) ([]*User, error) {
+	return GetUsersWithDeletionDue(store.db, due_at)
+}
+
+func (store *gormUserStore) Update(user *User) error {
+	return user.UpdateUser(store.db)
+}
+
+func (store *gormUserStore) IncreaseContributionsCount(user *User) error {
+	return user.IncreaseContributionsCount(store.db)
+}
+
+func (store *gormUserStore) RecordLoginFailure(user *User, threshold int, lockout time.Duration, now time.Time) error {
+	return user.RecordLoginFailure(store.db, threshold, lockout, now)
+}
+
+func (store *gormUserStore) DelayLogins(user *User, until time.Time) error {
+	return user.DelayLogins(store.db, until)
+}
+
+func (store *gormUserStore) ResetLoginFailures(user *User) error {
+	return user.ResetLoginFailures(store.db)
+}
+
+func (store *gormUserStore) Delete(user *User) error {
+	return user.DeleteUser(store.db)
+}
+
+func (store *gormUserStore) DeleteMany(users []*User) error {
+	if len(users) == 0 {
+		return nil
+	}
+	return DeleteUsers(store.db, users)
+}
+
+// ================ Messages ================
+
+type gormMessageStore struct{ db *gorm.DB }
+
+func (store *gormMessageStore) Create(message *Message) error {
+	return message.CreateMessage(store.db)
+}
+
+func (store *gormMessageStore) GetByID(id int) (*Message, error) {
+	return nilOnError(GetMessageByID(store.db, id))
+}
+
+func (store *gormMessageStore) List(query_params *MessagesGetRequestParams) ([]*Message, error) {
+	return GetMessages(store.db.Preload("Sender"), query_params)
+}
+
+func (store *gormMessageStore) Search(query_params *MessagesSearchRequestParams) ([]*MessageSearchResult, error) {
+	return SearchMessages(store.db, query_params)
+}
+
+func (store *gormMessageStore) Update(message *Message) error {
+	return message.UpdateMessage(store.db)
+}
+
+func (store *gormMessageStore) ReassignSender(from_user_id int, to_user_id int) error {
+	return ReassignUserMessages(store.db, from_user_id, to_user_id)
+}
+
+func (store *gormMessageStore) Delete(message *Message) error {
+	return message.DeleteMessage(store.db)
+}
+
+func (store *gormMessageStore) DeleteMany(messages []*Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	return DeleteMessages(store.db, messages)
+}
+
+// ================ Bans ================
+
+type gormBanStore struct{ db *gorm.DB }
+
+func (store *gormBanStore) CreateMany(bans []*Ban) error {
+	if len(bans) == 0 {
+		return nil
+	}
+	return CreateBans(store.db, bans)
+}
+
+func (store *gormBanStore) GetByID(id int) (*Ban, error) {
+	return nilOnError(GetBanByID(store.db, id))
+}
+
+func (store *gormBanStore) List(query_params *BansGetRequestParams) ([]*Ban, error) {
+	return GetBansByFilters(store.db, query_params)
+}
+
+func (store *gormBanStore) ListActiveBans(target_id int) ([]*Ban, error) {
+	return (&User{ID: target_id}).GetActiveBans(store.db)
+}
+
+func (store *gormBanStore) Update(ban *Ban) error {
+	return ban.UpdateBan(store.db)
+}
+
+func (store *gormBanStore) ReassignUser(from_user_id int, to_user_id int) error {
+	return ReassignUserBans(store.db, from_user_id, to_user_id)
+}
+
+func (store *gormBanStore) Delete(ban *Ban) error {
+	return ban.DeleteBan(store.db)
+}
+
+func (store *gormBanStore) DeleteMany(bans []*Ban) error {
+	if len(bans) == 0 {
+		return nil
+	}
+	return DeleteBans(store.db, bans)
+}
+
+// ================ Tokens ================
+
+type gormTokenStore struct{ db *gorm.DB }
+
+func (store *gormTokenStore) Create(token *AuthToken) error {
+	return token.CreateAuthToken(store.db)
+}
+
+func (store *gormTokenStore) GetByID(id int) (*AuthToken, error) {
+	return nilOnError(GetAuthTokenByID(store.db.Preload("User"), id))
+}
+
+func (store *gormTokenStore) GetLinkedToken(token *AuthToken) (*AuthToken, error) {
+	return nilOnError(token.GetLinkedToken(store.db.Preload("User")))
+}
+
+func (store *gormTokenStore) ListUserTokens(user_id int) ([]*AuthToken, error) {
+	return (&User{ID: user_id}).GetUserTokens(store.db.Preload("User"))
+}
+
+func (store *gormTokenStore) ListFamilyTokens(family_id int) ([]*AuthToken, error) {
+	return GetFamilyTokens(store.db.Preload("User"), family_id)
+}
+
+func (store *gormTokenStore) MatchToken(selector string, verifier string, token_type string) (*AuthToken, error) {
+	token, err := GetAuthTokenBySelector(store.db.Preload("User"), selector)
+	if errors.Is(err, ErrRecordNotFound) {
+		return nil, httputils.NewUnauthorizedError("Invalid token")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if token.Type != token_type || !token.MatchesVerifier(verifier) {
+		return nil, httputils.NewUnauthorizedError("Invalid token")
+	}
+	return token, nil
+}
+
+func (store *gormTokenStore) MatchLegacyUserToken(user_id int, raw_token string, token_type string) (*AuthToken, error) {
+	tokens, err := (&User{ID: user_id}).GetUserLegacyTokensByType(store.db.Preload("User"), token_type, time.Now(), constants.LEGACY_TOKENS_SCAN_LIMIT)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, token := range tokens {
+		if token.MatchesLegacyToken(raw_token) {
+			return token, token.UpgradeLegacyAuthToken(store.db, raw_token)
+		}
+	}
+	return nil, httputils.NewUnauthorizedError("Invalid token")
+}
+
+func (store *gormTokenStore) Update(token *AuthToken) error {
+	return token.UpdateAuthToken(store.db)
+}
+
+func (store *gormTokenStore) Rotate(token *AuthToken, family_id int, rotated_at time.Time) (bool, error) {
+	return token.RotateAuthToken(store.db, family_id, rotated_at)
+}
+
+func (store *gormTokenStore) Touch(token *AuthToken, used_at time.Time, ip string, user_agent string) error {
+	return token.TouchAuthToken(store.db, used_at, ip, user_agent)
+}
+
+func (store *gormTokenStore) Delete(token *AuthToken) error {
+	return token.DeleteAuthToken(store.db)
+}
+
+func (store *gormTokenStore) DeleteUserTokens(user_id int) error {
+	return (&User{ID: user_id}).DeleteUserTokens(store.db)
+}
+
+func (store *gormTokenStore) DeleteExpired() error {
+	return DeleteExpiredTokens(store.db)
+}
+
+// ================ Audit ================
+
+type gormAuditStore struct{ db *gorm.DB }
+
+func (store *gormAuditStore) Create(event *AuditEvent) error {
+	return event.CreateAuditEvent(store.db)
+}
+
+func (store *gormAuditStore) CreateMany(events []*AuditEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return CreateAuditEvents(store.db, events)
+}
+
+func (store *gormAuditStore) List(query_params *AuditGetRequestParams) ([]*AuditEvent, error) {
+	return GetAuditEvents(store.db, query_params)
+}
+
+// ================ Identities ================
+
+type gormIdentityStore struct{ db *gorm.DB }
+
+func (store *gormIdentityStore) Create(identity *UserIdentity) error {
+	return identity.CreateUserIdentity(store.db)
+}
+
+func (store *gormIdentityStore) GetBySubject(provider string, subject string) (*UserIdentity, error) {
+	return nilOnError(GetUserIdentityBySubject(store.db.Preload("User"), provider, subject))
+}
+
+func (store *gormIdentityStore) ListUserIdentities(user_id int) ([]*UserIdentity, error) {
+	return (&User{ID: user_id}).GetUserIdentities(store.db.Preload("User"))
+}
+
+func (store *gormIdentityStore) Update(identity *UserIdentity) error {
+	return identity.UpdateUserIdentity(store.db)
+}
+
+func (store *gormIdentityStore) Delete(identity *UserIdentity) error {
+	return identity.DeleteUserIdentity(store.db)
+}
+
+func (store *gormIdentityStore) DeleteUserIdentities(user_id int) error {
+	return (&User{ID: user_id}).DeleteUserIdentities(store.db)
+}
+
+// ================ API tokens ================
+
+type gormAPITokenStore struct{ db *gorm.DB }
+
+func (store *gormAPITokenStore) Create(api_token *APIToken) error {
+	return api_token.CreateAPIToken(store.db)
+}
+
+func (store *gormAPITokenStore) GetByID(id int) (*APIToken, error) {
+	return nilOnError(GetAPITokenByID(store.db.Preload("User"), id))
+}
+
+func (store *gormAPITokenStore) MatchToken(selector string, verifier string) (*APIToken, error) {
+	api_token, err := GetAPITokenBySelector(store.db.Preload("User"), selector)
+	if errors.Is(err, ErrRecordNotFound) {
+		return nil, httputils.NewUnauthorizedError("Invalid API token")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !api_token.MatchesVerifier(verifier) {
+		return nil, httputils.NewUnauthorizedError("Invalid API token")
+	}
+	return api_token, nil
+}
+
+func (store *gormAPITokenStore) MatchLegacyToken(id int, verifier string) (*APIToken, error) {
+	api_token, err := GetAPITokenByID(store.db.Preload("User"), id)
+	if errors.Is(err, ErrRecordNotFound) {
+		return nil, httputils.NewUnauthorizedError("Invalid API token")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !api_token.MatchesLegacyToken(verifier) {
+		return nil, httputils.NewUnauthorizedError("Invalid API token")
+	}
+	return api_token, api_token.UpgradeLegacyAPIToken(store.db, verifier)
+}
+
+func (store *gormAPITokenStore) ListUserAPITokens(user_id int) ([]*APIToken, error) {
+	return (&User{ID: user_id}).GetUserAPITokens(store.db.Preload("User"))
+}
+
+func (store *gormAPITokenStore) Touch(api_token *APIToken, used_at time.Time) error {
+	return api_token.TouchAPIToken(store.db, used_at)
+}
+
+func (store *gormAPITokenStore) Delete(api_token *APIToken) error {
+	return api_token.DeleteAPIToken(store.db)
+}
+
+func (store *gormAPITokenStore) DeleteUserAPITokens(user_id int) error {
+	return (&User{ID: user_id}).DeleteUserAPITokens(store.db)
+}
+
+// nilOnError drops the placeholder record the model functions return along with an error
+func nilOnError[T any](record *T, err error) (*T, error) {
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
@@ -0,0 +1,58 @@
+package db_model
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UserIdentity links a user to its subject at an external OpenID Connect provider, a user may have one per provider
+type UserIdentity struct {
+	ID         int       `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID     int       `gorm:"type:INTEGER;not null;index" json:"user_id"`
+	User       *User     `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+	Provider   string    `gorm:"type:TEXT;not null;uniqueIndex:idx_user_identities_subject" json:"provider"`
+	Subject    string    `gorm:"type:TEXT;not null;uniqueIndex:idx_user_identities_subject" json:"subject"`
+	Email      string    `gorm:"type:TEXT;not null;default:''" json:"email"`
+	CreatedAt  time.Time `gorm:"autoCreateTime" json:"created_at"`
+	ModifiedAt time.Time `gorm:"autoUpdateTime:milli" json:"modified_at"`
+}
+
+// ================ CRUD Operations ================
+// ================ Create ================
+// CreateUserIdentity creates a new user identity in the database
+func (identity *UserIdentity) CreateUserIdentity(db *gorm.DB) error {
+	return db.Create(identity).Error
+}
+
+// ================ Read ================
+// GetUserIdentityBySubject retrieves the identity of a subject at a provider from the database
+func GetUserIdentityBySubject(db *gorm.DB, provider string, subject string) (*UserIdentity, error) {
+	identity := &UserIdentity{}
+	err := db.Where("provider = ? AND subject = ?", provider, subject).First(identity).Error
+	return identity, err
+}
+
+// GetUserIdentities retrieves all the identities of a user from the database, oldest first
+func (user *User) GetUserIdentities(db *gorm.DB) ([]*UserIdentity, error) {
+	var identities []*UserIdentity
+	err := db.Where("user_id = ?", user.ID).Order("id asc").Find(&identities).Error
+	return identities, err
+}
+
+// ================ Update ================
+// UpdateUserIdentity updates a user identity in the database
+func (identity *UserIdentity) UpdateUserIdentity(db *gorm.DB) error {
+	return db.Save(identity).Error
+}
+
+// ================ Delete ================
+// DeleteUserIdentity deletes a user identity from the database
+func (identity *UserIdentity) DeleteUserIdentity(db *gorm.DB) error {
+	return db.Delete(identity).Error
+}
+
+// DeleteUserIdentities deletes all the identities of a user from the database
+func (user *User) DeleteUserIdentities(db *gorm.DB) error {
+	return db.Where("user_id = ?", user.ID).Delete(UserIdentity{}).Error
+}
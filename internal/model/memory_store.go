@@ -0,0 +1,1368 @@
+package db_model
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
+)
+
+// NewMemoryStore returns stores keeping the records in memory, with the same semantics as the database backed stores
+// It is meant for the tests, nothing is persisted
+func NewMemoryStore() *Store {
+	data := &memoryData{
+		users:      map[int]*User{},
+		messages:   map[int]*Message{},
+		bans:       map[int]*Ban{},
+		tokens:     map[int]*AuthToken{},
+		audit:      map[int]*AuditEvent{},
+		identities: map[int]*UserIdentity{},
+		api_tokens: map[int]*APIToken{},
+	}
+	return &Store{
+		Users:      &memoryUserStore{data: data},
+		Messages:   &memoryMessageStore{data: data},
+		Bans:       &memoryBanStore{data: data},
+		Tokens:     &memoryTokenStore{data: data},
+		Audit:      &memoryAuditStore{data: data},
+		Identities: &memoryIdentityStore{data: data},
+		APITokens:  &memoryAPITokenStore{data: data},
+	}
+}
+
+// memoryData holds the records shared by the in-memory stores
+// Records are stored as copies without their associations, which are attached again when they are read
+type memoryData struct {
+	mutex             sync.RWMutex
+	users             map[int]*User
+	messages          map[int]*Message
+	bans              map[int]*Ban
+	tokens            map[int]*AuthToken
+	audit             map[int]*AuditEvent
+	identities        map[int]*UserIdentity
+	api_tokens        map[int]*APIToken
+	last_user_id      int
+	last_message_id   int
+	last_ban_id       int
+	last_token_id     int
+	last_audit_id     int
+	last_identity_id  int
+	last_api_token_id int
+}
+
+// ================ Users ================
+
+type memoryUserStore struct{ data *memoryData }
+
+func (store *memoryUserStore) Create(user *User) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	return store.data.createUser(user)
+}
+
+func (store *memoryUserStore) GetByID(id int) (*User, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+	return store.data.findUser(func(user *User) bool { return user.ID == id })
+}
+
+func (store *memoryUserStore) GetByUsername(username string) (*User, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+	return store.data.findUser(func(user *User) bool { return user.Username == username })
+}
+
+func (store *memoryUserStore) GetByEmail(email string) (*User, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+	return store.data.findUser(func(user *User) bool { return user.Email == email })
+}
+
+func (store *memoryUserStore) GetByUsernameOrEmail(username_or_email string) (*User, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+	return store.data.findUser(func(user *User) bool {
+		return user.Username == username_or_email || user.Email == username_or_email
+	})
+}
+
+func (store *memoryUserStore) List(query_params *UsersGetRequestParams) ([]*User, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	users := []*User{}
+	for _, user := range store.data.users {
+		// "OR" conditions, every user matches when there is none
+		matches := len(query_params.ID) == 0 && len(query_params.Username) == 0 && len(query_params.Email) == 0 && len(query_params.PartialUsername) == 0
+		matches = matches || containsValue(query_params.ID, user.ID) || containsValue(query_params.Username, user.Username) || containsValue(query_params.Email, user.Email)
+		for _, partial_username := range query_params.PartialUsername {
+			matches = matches || containsText(user.Username, partial_username)
+		}
+
+		// "AND" filters
+		if len(query_params.Role) > 0 && !slices.Contains(query_params.Role, user.Role) {
+			matches = false
+		}
+		if query_params.SubscriberTier > 0 && user.Subscriber_Tier < query_params.SubscriberTier {
+			matches = false
+		}
+
+		if matches {
+			users = append(users, copyUser(user))
+		}
+	}
+
+	return paginateRecords(users, userColumns, query_params.Order, query_params.Limit, query_params.Page, query_params.Offset)
+}
+
+func (store *memoryUserStore) ListDeletionsDue(due_at time.Time) ([]*User, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	users := []*User{}
+	for _, user := range store.data.users {
+		if user.DeletionDueAt != nil && !user.DeletionDueAt.After(due_at) {
+			users = append(users, copyUser(user))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if !users[i].DeletionDueAt.Equal(*users[j].DeletionDueAt) {
+			return users[i].DeletionDueAt.Before(*users[j].DeletionDueAt)
+		}
+		return users[i].ID < users[j].ID
+	})
+	return users, nil
+}
+
+func (store *memoryUserStore) Update(user *User) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	return store.data.saveUser(user)
+}
+
+func (store *memoryUserStore) IncreaseContributionsCount(user *User) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	stored_user, ok := store.data.users[user.ID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	stored_user.TotalContributions++
+	user.TotalContributions++
+	return nil
+}
+
+func (store *memoryUserStore) RecordLoginFailure(user *User, threshold int, lockout time.Duration, now time.Time) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	stored_user, ok := store.data.users[user.ID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	if stored_user.LockedUntil == nil || stored_user.LockedUntil.Before(now.Add(-lockout)) {
+		stored_user.FailedLogins = 0
+	}
+	stored_user.FailedLogins++
+	if threshold > 0 && stored_user.FailedLogins >= threshold {
+		locked_until := now.Add(lockout)
+		stored_user.LockedUntil = &locked_until
+	} else if stored_user.LockedUntil == nil || stored_user.LockedUntil.Before(now) {
+		stored_user.LockedUntil = &now
+	}
+	user.FailedLogins, user.LockedUntil = stored_user.FailedLogins, stored_user.LockedUntil
+	return nil
+}
+
+func (store *memoryUserStore) DelayLogins(user *User, until time.Time) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	stored_user, ok := store.data.users[user.ID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	if stored_user.LockedUntil == nil || stored_user.LockedUntil.Before(until) {
+		stored_user.LockedUntil = &until
+	}
+	user.FailedLogins, user.LockedUntil = stored_user.FailedLogins, stored_user.LockedUntil
+	return nil
+}
+
+func (store *memoryUserStore) ResetLoginFailures(user *User) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	stored_user, ok := store.data.users[user.ID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	stored_user.FailedLogins, stored_user.LockedUntil = 0, nil
+	user.FailedLogins, user.LockedUntil = 0, nil
+	return nil
+}
+
+func (store *memoryUserStore) Delete(user *User) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	delete(store.data.users, user.ID)
+	return nil
+}
+
+func (store *memoryUserStore) DeleteMany(users []*User) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	for _, user := range users {
+		delete(store.data.users, user.ID)
+	}
+	return nil
+}
+
+// createUser stores a new user, the caller must hold the lock
+func (data *memoryData) createUser(user *User) error {
+	if user.ID == 0 {
+		data.last_user_id++
+		user.ID = data.last_user_id
+	} else if _, exists := data.users[user.ID]; exists {
+		return fmt.Errorf("user %d already exists", user.ID)
+	} else if user.ID > data.last_user_id {
+		data.last_user_id = user.ID
+	}
+
+	if user.Avatar == "" {
+		user.Avatar = "default_avatar.png"
+	}
+	if user.Role == "" {
+		user.Role = constants.ROLE_USER
+	}
+	now := currentTime()
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = now
+	}
+	return data.saveUser(user)
+}
+
+// saveUser stores every field of the user (creating it if it has no ID yet), the caller must hold the lock
+func (data *memoryData) saveUser(user *User) error {
+	if user.ID == 0 {
+		return data.createUser(user)
+	}
+	for _, existing_user := range data.users {
+		if existing_user.ID == user.ID {
+			continue
+		}
+		if existing_user.Username == user.Username {
+			return errors.New("UNIQUE constraint failed: users.username")
+		}
+		if existing_user.Email == user.Email {
+			return errors.New("UNIQUE constraint failed: users.email")
+		}
+	}
+
+	user.ModifiedAt = currentTime()
+	stored_user := *user
+	stored_user.Messages, stored_user.Tokens, stored_user.Bans = nil, nil, nil
+	data.users[user.ID] = &stored_user
+	return nil
+}
+
+// findUser returns a copy of the first user (by ID) matching the predicate, the caller must hold the lock
+func (data *memoryData) findUser(predicate func(user *User) bool) (*User, error) {
+	var found *User
+	for _, user := range data.users {
+		if predicate(user) && (found == nil || user.ID < found.ID) {
+			found = user
+		}
+	}
+	if found == nil {
+		return nil, ErrRecordNotFound
+	}
+	return copyUser(found), nil
+}
+
+// copyUser returns a copy of the stored user
+func copyUser(user *User) *User {
+	if user == nil {
+		return nil
+	}
+	copied_user := *user
+	return &copied_user
+}
+
+var userColumns = map[string]func(user *User) any{
+	"id":                  func(user *User) any { return user.ID },
+	"username":            func(user *User) any { return user.Username },
+	"email":               func(user *User) any { return user.Email },
+	"role":                func(user *User) any { return user.Role },
+	"total_contributions": func(user *User) any { return user.TotalContributions },
+	"minutes_listened":    func(user *User) any { return user.MinutesListened },
+	"subscriber_tier":     func(user *User) any { return user.Subscriber_Tier },
+	"created_at":          func(user *User) any { return user.CreatedAt },
+	"modified_at":         func(user *User) any { return user.ModifiedAt },
+}
+
+// ================ Messages ================
+
+type memoryMessageStore struct{ data *memoryData }
+
+func (store *memoryMessageStore) Create(message *Message) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+
+	if message.ID == 0 {
+		store.data.last_message_id++
+		message.ID = store.data.last_message_id
+	} else if _, exists := store.data.messages[message.ID]; exists {
+		return fmt.Errorf("message %d already exists", message.ID)
+	} else if message.ID > store.data.last_message_id {
+		store.data.last_message_id = message.ID
+	}
+
+	if message.CreatedAt.IsZero() {
+		message.CreatedAt = currentTime()
+	}
+	return store.data.saveMessage(message)
+}
+
+func (store *memoryMessageStore) GetByID(id int) (*Message, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	message, ok := store.data.messages[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return store.data.loadMessage(message), nil
+}
+
+func (store *memoryMessageStore) List(query_params *MessagesGetRequestParams) ([]*Message, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	messages := []*Message{}
+	for _, message := range store.data.messages {
+		// "OR" conditions, every message matches when there is none
+		matches := len(query_params.ID) == 0 && len(query_params.Contains) == 0
+		matches = matches || containsValue(query_params.ID, message.ID)
+		for _, content := range query_params.Contains {
+			matches = matches || containsText(message.Content, content)
+		}
+
+		// "AND" filters
+		if len(query_params.SenderID) > 0 && !containsValue(query_params.SenderID, message.SenderID) {
+			matches = false
+		}
+		if len(query_params.Flagged) > 0 && message.Flagged != query_params.Flagged[0] {
+			matches = false
+		}
+		if len(query_params.Censored) > 0 && message.Censored != query_params.Censored[0] {
+			matches = false
+		}
+		if len(query_params.Removed) > 0 && message.Removed != query_params.Removed[0] {
+			matches = false
+		}
+
+		if matches {
+			messages = append(messages, store.data.loadMessage(message))
+		}
+	}
+
+	return paginateRecords(messages, messageColumns, query_params.Order, query_params.Limit, query_params.Page, query_params.Offset)
+}
+
+func (store *memoryMessageStore) Search(query_params *MessagesSearchRequestParams) ([]*MessageSearchResult, error) {
+	terms := parseSearchQuery(query_params.Query)
+	if len(terms) == 0 {
+		return []*MessageSearchResult{}, nil
+	}
+
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	// Same semantics as the search without the FTS5 index: every term is contained, most recent first
+	messages := []*Message{}
+	for _, message := range store.data.messages {
+		matches := true
+		for _, term := range terms {
+			matches = matches && containsText(message.Content, term.Text)
+		}
+		if len(query_params.SenderID) > 0 && !containsValue(query_params.SenderID, message.SenderID) {
+			matches = false
+		}
+		if len(query_params.Flagged) > 0 && message.Flagged != query_params.Flagged[0] {
+			matches = false
+		}
+		if len(query_params.Removed) > 0 && message.Removed != query_params.Removed[0] {
+			matches = false
+		}
+
+		if matches {
+			messages = append(messages, store.data.loadMessage(message))
+		}
+	}
+
+	messages, err := paginateRecords(messages, messageColumns, "created_at desc, id desc", query_params.Limit, query_params.Page, query_params.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*MessageSearchResult, 0, len(messages))
+	for _, message := range messages {
+		results = append(results, &MessageSearchResult{
+			Message: message,
+			Snippet: highlightSnippet(buildSnippet(message.Content, terms)),
+		})
+	}
+	return results, nil
+}
+
+func (store *memoryMessageStore) Update(message *Message) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+
+	if message.ID == 0 {
+		store.data.last_message_id++
+		message.ID = store.data.last_message_id
+	}
+	return store.data.saveMessage(message)
+}
+
+func (store *memoryMessageStore) ReassignSender(from_user_id int, to_user_id int) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	for _, message := range store.data.messages {
+		if message.SenderID == from_user_id {
+			message.SenderID = to_user_id
+		}
+	}
+	return nil
+}
+
+func (store *memoryMessageStore) Delete(message *Message) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	delete(store.data.messages, message.ID)
+	return nil
+}
+
+func (store *memoryMessageStore) DeleteMany(messages []*Message) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	for _, message := range messages {
+		delete(store.data.messages, message.ID)
+	}
+	return nil
+}
+
+// saveMessage stores every field of the message, the caller must hold the lock
+func (data *memoryData) saveMessage(message *Message) error {
+	// The sender association wins over the foreign key, it is created if it does not exist yet
+	if message.Sender != nil {
+		if message.Sender.ID == 0 {
+			err := data.createUser(message.Sender)
+			if err != nil {
+				return err
+			}
+		}
+		message.SenderID = message.Sender.ID
+	}
+
+	message.ModifiedAt = currentTime()
+	stored_message := *message
+	stored_message.Sender = nil
+	data.messages[message.ID] = &stored_message
+	return nil
+}
+
+// loadMessage returns a copy of the stored message with its sender, the caller must hold the lock
+func (data *memoryData) loadMessage(message *Message) *Message {
+	loaded_message := *message
+	loaded_message.Sender = copyUser(data.users[message.SenderID])
+	return &loaded_message
+}
+
+var messageColumns = map[string]func(message *Message) any{
+	"id":          func(message *Message) any { return message.ID },
+	"sender_id":   func(message *Message) any { return message.SenderID },
+	"content":     func(message *Message) any { return message.Content },
+	"flagged":     func(message *Message) any { return message.Flagged },
+	"removed":     func(message *Message) any { return message.Removed },
+	"censored":    func(message *Message) any { return message.Censored },
+	"created_at":  func(message *Message) any { return message.CreatedAt },
+	"modified_at": func(message *Message) any { return message.ModifiedAt },
+}
+
+// ================ Bans ================
+
+type memoryBanStore struct{ data *memoryData }
+
+func (store *memoryBanStore) CreateMany(bans []*Ban) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+
+	for _, ban := range bans {
+		if ban.ID == 0 {
+			store.data.last_ban_id++
+			ban.ID = store.data.last_ban_id
+		} else if _, exists := store.data.bans[ban.ID]; exists {
+			return fmt.Errorf("ban %d already exists", ban.ID)
+		} else if ban.ID > store.data.last_ban_id {
+			store.data.last_ban_id = ban.ID
+		}
+		if ban.CreatedAt.IsZero() {
+			ban.CreatedAt = currentTime()
+		}
+		err := store.data.saveBan(ban)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *memoryBanStore) GetByID(id int) (*Ban, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	ban, ok := store.data.bans[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return copyBan(ban), nil
+}
+
+func (store *memoryBanStore) List(query_params *BansGetRequestParams) ([]*Ban, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	ends_after := query_params.EndsAfter.UTC()
+	bans := []*Ban{}
+	for _, ban := range store.data.bans {
+		matches := ban.EndsAt.After(ends_after)
+		if len(query_params.TargetID) > 0 && !containsValue(query_params.TargetID, ban.TargetID) {
+			matches = false
+		}
+		if len(query_params.IssuerID) > 0 && !containsValue(query_params.IssuerID, ban.IssuerID) {
+			matches = false
+		}
+		if len(query_params.Type) > 0 && !containsValue(query_params.Type, ban.Type) {
+			matches = false
+		}
+		if query_params.Reason != "" && !containsText(ban.Reason, query_params.Reason) {
+			matches = false
+		}
+		if len(query_params.ID) > 0 && !containsValue(query_params.ID, ban.ID) {
+			matches = false
+		}
+
+		if matches {
+			bans = append(bans, copyBan(ban))
+		}
+	}
+
+	return paginateRecords(bans, banColumns, query_params.Order, query_params.Limit, query_params.Page, query_params.Offset)
+}
+
+func (store *memoryBanStore) ListActiveBans(target_id int) ([]*Ban, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	current_time := currentTime()
+	bans := []*Ban{}
+	for _, ban := range store.data.bans {
+		if ban.TargetID == target_id && ban.Type == constants.BAN_TYPE && ban.EndsAt.After(current_time) {
+			bans = append(bans, copyBan(ban))
+		}
+	}
+	return paginateRecords(bans, banColumns, "ends_at desc", 0, 0, 0)
+}
+
+func (store *memoryBanStore) Update(ban *Ban) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+
+	if ban.ID == 0 {
+		store.data.last_ban_id++
+		ban.ID = store.data.last_ban_id
+	}
+	return store.data.saveBan(ban)
+}
+
+func (store *memoryBanStore) ReassignUser(from_user_id int, to_user_id int) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	for _, ban := range store.data.bans {
+		if ban.IssuerID == from_user_id {
+			ban.IssuerID = to_user_id
+		}
+		if ban.TargetID == from_user_id {
+			ban.TargetID = to_user_id
+		}
+	}
+	return nil
+}
+
+func (store *memoryBanStore) Delete(ban *Ban) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	delete(store.data.bans, ban.ID)
+	return nil
+}
+
+func (store *memoryBanStore) DeleteMany(bans []*Ban) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	for _, ban := range bans {
+		delete(store.data.bans, ban.ID)
+	}
+	return nil
+}
+
+// saveBan stores every field of the ban, the caller must hold the lock
+func (data *memoryData) saveBan(ban *Ban) error {
+	// Run the same hook as gorm
+	err := ban.BeforeSave(nil)
+	if err != nil {
+		return err
+	}
+	if ban.Target != nil {
+		ban.TargetID = ban.Target.ID
+	}
+	if ban.Issuer != nil {
+		ban.IssuerID = ban.Issuer.ID
+	}
+
+	ban.ModifiedAt = currentTime()
+	data.bans[ban.ID] = copyBan(ban)
+	return nil
+}
+
+// copyBan returns a copy of the ban without its associations
+func copyBan(ban *Ban) *Ban {
+	copied_ban := *ban
+	copied_ban.Target, copied_ban.Issuer = nil, nil
+	return &copied_ban
+}
+
+var banColumns = map[string]func(ban *Ban) any{
+	"id":          func(ban *Ban) any { return ban.ID },
+	"target_id":   func(ban *Ban) any { return ban.TargetID },
+	"issuer_id":   func(ban *Ban) any { return ban.IssuerID },
+	"reason":      func(ban *Ban) any { return ban.Reason },
+	"type":        func(ban *Ban) any { return ban.Type },
+	"ends_at":     func(ban *Ban) any { return ban.EndsAt },
+	"created_at":  func(ban *Ban) any { return ban.CreatedAt },
+	"modified_at": func(ban *Ban) any { return ban.ModifiedAt },
+}
+
+// ================ Tokens ================
+
+type memoryTokenStore struct{ data *memoryData }
+
+func (store *memoryTokenStore) Create(token *AuthToken) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+
+	if token.ID == 0 {
+		store.data.last_token_id++
+		token.ID = store.data.last_token_id
+	} else if _, exists := store.data.tokens[token.ID]; exists {
+		return fmt.Errorf("token %d already exists", token.ID)
+	} else if token.ID > store.data.last_token_id {
+		store.data.last_token_id = token.ID
+	}
+
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = currentTime()
+	}
+	return store.data.saveToken(token)
+}
+
+func (store *memoryTokenStore) GetByID(id int) (*AuthToken, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	token, ok := store.data.tokens[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return store.data.loadToken(token), nil
+}
+
+func (store *memoryTokenStore) GetLinkedToken(token *AuthToken) (*AuthToken, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	linked_token_id := token.LinkedTokenID
+	if linked_token_id == nil && token.LinkedToken != nil {
+		linked_token_id = &token.LinkedToken.ID
+	}
+	if linked_token_id == nil {
+		return nil, ErrRecordNotFound
+	}
+
+	linked_token, ok := store.data.tokens[*linked_token_id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return store.data.loadToken(linked_token), nil
+}
+
+func (store *memoryTokenStore) ListUserTokens(user_id int) ([]*AuthToken, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	tokens := []*AuthToken{}
+	for _, token := range store.data.tokens {
+		if token.UserID == user_id {
+			tokens = append(tokens, store.data.loadToken(token))
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+	return tokens, nil
+}
+
+func (store *memoryTokenStore) ListFamilyTokens(family_id int) ([]*AuthToken, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	tokens := []*AuthToken{}
+	for _, token := range store.data.tokens {
+		if token.FamilyID != nil && *token.FamilyID == family_id {
+			tokens = append(tokens, store.data.loadToken(token))
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+	return tokens, nil
+}
+
+func (store *memoryTokenStore) MatchToken(selector string, verifier string, token_type string) (*AuthToken, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	for _, token := range store.data.tokens {
+		if token.Selector != nil && *token.Selector == selector {
+			if token.Type == token_type && token.MatchesVerifier(verifier) {
+				return store.data.loadToken(token), nil
+			}
+			break
+		}
+	}
+	return nil, httputils.NewUnauthorizedError("Invalid token")
+}
+
+func (store *memoryTokenStore) MatchLegacyUserToken(user_id int, raw_token string, token_type string) (*AuthToken, error) {
+	store.data.mutex.RLock()
+	now := time.Now().Unix()
+	tokens := []*AuthToken{}
+	for _, token := range store.data.tokens {
+		if token.UserID == user_id && token.Type == token_type && token.Selector == nil && token.Expiration > now {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID > tokens[j].ID })
+	if len(tokens) > constants.LEGACY_TOKENS_SCAN_LIMIT {
+		tokens = tokens[:constants.LEGACY_TOKENS_SCAN_LIMIT]
+	}
+
+	matched_id := 0
+	for _, token := range tokens {
+		if token.MatchesLegacyToken(raw_token) {
+			matched_id = token.ID
+			break
+		}
+	}
+	store.data.mutex.RUnlock()
+	if matched_id == 0 {
+		return nil, httputils.NewUnauthorizedError("Invalid token")
+	}
+
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+
+	// The token may have been deleted or upgraded while its hash was checked
+	token, ok := store.data.tokens[matched_id]
+	if !ok {
+		return nil, httputils.NewUnauthorizedError("Invalid token")
+	}
+	if token.Selector == nil {
+		token.upgradeLegacyToken(raw_token)
+	}
+	return store.data.loadToken(token), nil
+}
+
+func (store *memoryTokenStore) Update(token *AuthToken) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+
+	if token.ID == 0 {
+		store.data.last_token_id++
+		token.ID = store.data.last_token_id
+	}
+	return store.data.saveToken(token)
+}
+
+func (store *memoryTokenStore) Rotate(token *AuthToken, family_id int, rotated_at time.Time) (bool, error) {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+
+	stored_token, ok := store.data.tokens[token.ID]
+	if !ok || stored_token.RotatedAt != nil {
+		return false, nil
+	}
+	stored_token.FamilyID = &family_id
+	stored_token.RotatedAt = &rotated_at
+	stored_token.LinkedTokenID, stored_token.LinkedToken = nil, nil
+	token.FamilyID = &family_id
+	token.RotatedAt = &rotated_at
+	token.LinkedTokenID, token.LinkedToken = nil, nil
+	return true, nil
+}
+
+func (store *memoryTokenStore) Touch(token *AuthToken, used_at time.Time, ip string, user_agent string) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+
+	token.LastUsedAt = &used_at
+	token.IP = ip
+	token.UserAgent = user_agent
+	stored_token, ok := store.data.tokens[token.ID]
+	if !ok {
+		return nil
+	}
+	stored_token.LastUsedAt = &used_at
+	stored_token.IP = ip
+	stored_token.UserAgent = user_agent
+	return nil
+}
+
+func (store *memoryTokenStore) Delete(token *AuthToken) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	store.data.deleteToken(token.ID)
+	return nil
+}
+
+func (store *memoryTokenStore) DeleteUserTokens(user_id int) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	for id, token := range store.data.tokens {
+		if token.UserID == user_id {
+			store.data.deleteToken(id)
+		}
+	}
+	return nil
+}
+
+func (store *memoryTokenStore) DeleteExpired() error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+
+	now := time.Now().Unix()
+	for id, token := range store.data.tokens {
+		if token.Expiration < now {
+			store.data.deleteToken(id)
+		}
+	}
+	return nil
+}
+
+// saveToken stores every field of the token, the caller must hold the lock
+func (data *memoryData) saveToken(token *AuthToken) error {
+	// Run the same hook as gorm
+	err := token.BeforeSave(nil)
+	if err != nil {
+		return err
+	}
+
+	// The associations win over the foreign keys, the user is created if it does not exist yet
+	if token.User != nil {
+		if token.User.ID == 0 {
+			err = data.createUser(token.User)
+			if err != nil {
+				return err
+			}
+		}
+		token.UserID = token.User.ID
+	}
+	if token.LinkedToken != nil && token.LinkedToken.ID != 0 {
+		token.LinkedTokenID = &token.LinkedToken.ID
+	}
+
+	for _, existing_token := range data.tokens {
+		if existing_token.ID != token.ID && existing_token.Hashed_Token == token.Hashed_Token {
+			return errors.New("UNIQUE constraint failed: auth_tokens.hashed_token")
+		} else if existing_token.ID != token.ID && existing_token.Selector != nil && token.Selector != nil && *existing_token.Selector == *token.Selector {
+			return errors.New("UNIQUE constraint failed: auth_tokens.selector")
+		}
+	}
+
+	token.ModifiedAt = currentTime()
+	stored_token := *token
+	stored_token.User, stored_token.LinkedToken = nil, nil
+	if token.LinkedTokenID != nil {
+		linked_token_id := *token.LinkedTokenID
+		stored_token.LinkedTokenID = &linked_token_id
+	}
+	if token.Selector != nil {
+		selector := *token.Selector
+		stored_token.Selector = &selector
+	}
+	if token.FamilyID != nil {
+		family_id := *token.FamilyID
+		stored_token.FamilyID = &family_id
+	}
+	data.tokens[token.ID] = &stored_token
+	return nil
+}
+
+// deleteToken deletes a token and unlinks the tokens linked to it (ON DELETE SET NULL), the caller must hold the lock
+func (data *memoryData) deleteToken(id int) {
+	delete(data.tokens, id)
+	for _, token := range data.tokens {
+		if token.LinkedTokenID != nil && *token.LinkedTokenID == id {
+			token.LinkedTokenID = nil
+		}
+	}
+}
+
+// loadToken returns a copy of the stored token with its user, the caller must hold the lock
+func (data *memoryData) loadToken(token *AuthToken) *AuthToken {
+	loaded_token := *token
+	loaded_token.User = copyUser(data.users[token.UserID])
+	return &loaded_token
+}
+
+// ================ Audit ================
+
+type memoryAuditStore struct{ data *memoryData }
+
+func (store *memoryAuditStore) Create(event *AuditEvent) error {
+	return store.CreateMany([]*AuditEvent{event})
+}
+
+func (store *memoryAuditStore) CreateMany(events []*AuditEvent) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+
+	for _, event := range events {
+		if event.ID == 0 {
+			store.data.last_audit_id++
+			event.ID = store.data.last_audit_id
+		} else if _, exists := store.data.audit[event.ID]; exists {
+			return fmt.Errorf("audit event %d already exists", event.ID)
+		} else if event.ID > store.data.last_audit_id {
+			store.data.last_audit_id = event.ID
+		}
+		if event.CreatedAt.IsZero() {
+			event.CreatedAt = currentTime()
+		}
+		stored_event := *event
+		store.data.audit[event.ID] = &stored_event
+	}
+	return nil
+}
+
+func (store *memoryAuditStore) List(query_params *AuditGetRequestParams) ([]*AuditEvent, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	events := []*AuditEvent{}
+	for _, event := range store.data.audit {
+		matches := true
+		if len(query_params.ActorID) > 0 && !containsValue(query_params.ActorID, event.ActorID) {
+			matches = false
+		}
+		if len(query_params.Action) > 0 && !containsValue(query_params.Action, event.Action) {
+			matches = false
+		}
+		if len(query_params.TargetType) > 0 && !containsValue(query_params.TargetType, event.TargetType) {
+			matches = false
+		}
+		if len(query_params.TargetID) > 0 && !containsValue(query_params.TargetID, event.TargetID) {
+			matches = false
+		}
+		if query_params.RequestID != "" && event.RequestID != query_params.RequestID {
+			matches = false
+		}
+		if !query_params.Since.IsZero() && event.CreatedAt.Before(query_params.Since) {
+			matches = false
+		}
+		if !query_params.Until.IsZero() && event.CreatedAt.After(query_params.Until) {
+			matches = false
+		}
+
+		if matches {
+			copied_event := *event
+			events = append(events, &copied_event)
+		}
+	}
+
+	return paginateRecords(events, auditColumns, query_params.Order, query_params.Limit, query_params.Page, query_params.Offset)
+}
+
+var auditColumns = map[string]func(event *AuditEvent) any{
+	"id":          func(event *AuditEvent) any { return event.ID },
+	"actor_id":    func(event *AuditEvent) any { return event.ActorID },
+	"action":      func(event *AuditEvent) any { return event.Action },
+	"target_type": func(event *AuditEvent) any { return event.TargetType },
+	"target_id":   func(event *AuditEvent) any { return event.TargetID },
+	"created_at":  func(event *AuditEvent) any { return event.CreatedAt },
+}
+
+// ================ Identities ================
+
+type memoryIdentityStore struct{ data *memoryData }
+
+func (store *memoryIdentityStore) Create(identity *UserIdentity) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+
+	if identity.ID == 0 {
+		store.data.last_identity_id++
+		identity.ID = store.data.last_identity_id
+	} else if _, exists := store.data.identities[identity.ID]; exists {
+		return fmt.Errorf("identity %d already exists", identity.ID)
+	} else if identity.ID > store.data.last_identity_id {
+		store.data.last_identity_id = identity.ID
+	}
+
+	if identity.CreatedAt.IsZero() {
+		identity.CreatedAt = currentTime()
+	}
+	return store.data.saveIdentity(identity)
+}
+
+func (store *memoryIdentityStore) GetBySubject(provider string, subject string) (*UserIdentity, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	for _, identity := range store.data.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return store.data.loadIdentity(identity), nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (store *memoryIdentityStore) ListUserIdentities(user_id int) ([]*UserIdentity, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	identities := []*UserIdentity{}
+	for _, identity := range store.data.identities {
+		if identity.UserID == user_id {
+			identities = append(identities, store.data.loadIdentity(identity))
+		}
+	}
+	sort.Slice(identities, func(i, j int) bool { return identities[i].ID < identities[j].ID })
+	return identities, nil
+}
+
+func (store *memoryIdentityStore) Update(identity *UserIdentity) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+
+	if identity.ID == 0 {
+		store.data.last_identity_id++
+		identity.ID = store.data.last_identity_id
+	}
+	return store.data.saveIdentity(identity)
+}
+
+func (store *memoryIdentityStore) Delete(identity *UserIdentity) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	delete(store.data.identities, identity.ID)
+	return nil
+}
+
+func (store *memoryIdentityStore) DeleteUserIdentities(user_id int) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	for id, identity := range store.data.identities {
+		if identity.UserID == user_id {
+			delete(store.data.identities, id)
+		}
+	}
+	return nil
+}
+
+// saveIdentity stores every field of the identity, the caller must hold the lock
+func (data *memoryData) saveIdentity(identity *UserIdentity) error {
+	if identity.User != nil {
+		identity.UserID = identity.User.ID
+	}
+	for _, existing_identity := range data.identities {
+		if existing_identity.ID != identity.ID && existing_identity.Provider == identity.Provider && existing_identity.Subject == identity.Subject {
+			return errors.New("UNIQUE constraint failed: user_identities.provider, user_identities.subject")
+		}
+	}
+
+	identity.ModifiedAt = currentTime()
+	stored_identity := *identity
+	stored_identity.User = nil
+	data.identities[identity.ID] = &stored_identity
+	return nil
+}
+
+// loadIdentity returns a copy of the stored identity with its user, the caller must hold the lock
+func (data *memoryData) loadIdentity(identity *UserIdentity) *UserIdentity {
+	loaded_identity := *identity
+	loaded_identity.User = copyUser(data.users[identity.UserID])
+	return &loaded_identity
+}
+
+// ================ API tokens ================
+
+type memoryAPITokenStore struct{ data *memoryData }
+
+func (store *memoryAPITokenStore) Create(api_token *APIToken) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+
+	if api_token.ID == 0 {
+		store.data.last_api_token_id++
+		api_token.ID = store.data.last_api_token_id
+	} else if _, exists := store.data.api_tokens[api_token.ID]; exists {
+		return fmt.Errorf("API token %d already exists", api_token.ID)
+	} else if api_token.ID > store.data.last_api_token_id {
+		store.data.last_api_token_id = api_token.ID
+	}
+
+	if api_token.Selector != nil {
+		for _, existing_api_token := range store.data.api_tokens {
+			if existing_api_token.Selector != nil && *existing_api_token.Selector == *api_token.Selector {
+				return errors.New("UNIQUE constraint failed: api_tokens.selector")
+			}
+		}
+	}
+
+	if api_token.CreatedAt.IsZero() {
+		api_token.CreatedAt = currentTime()
+	}
+	if api_token.User != nil {
+		api_token.UserID = api_token.User.ID
+	}
+	api_token.ModifiedAt = currentTime()
+	store.data.api_tokens[api_token.ID] = copyAPIToken(api_token)
+	return nil
+}
+
+func (store *memoryAPITokenStore) GetByID(id int) (*APIToken, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	api_token, ok := store.data.api_tokens[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return store.data.loadAPIToken(api_token), nil
+}
+
+func (store *memoryAPITokenStore) MatchToken(selector string, verifier string) (*APIToken, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	for _, api_token := range store.data.api_tokens {
+		if api_token.Selector != nil && *api_token.Selector == selector {
+			if api_token.MatchesVerifier(verifier) {
+				return store.data.loadAPIToken(api_token), nil
+			}
+			break
+		}
+	}
+	return nil, httputils.NewUnauthorizedError("Invalid API token")
+}
+
+func (store *memoryAPITokenStore) MatchLegacyToken(id int, verifier string) (*APIToken, error) {
+	store.data.mutex.RLock()
+	api_token, ok := store.data.api_tokens[id]
+	matches := ok && api_token.MatchesLegacyToken(verifier)
+	store.data.mutex.RUnlock()
+	if !matches {
+		return nil, httputils.NewUnauthorizedError("Invalid API token")
+	}
+
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+
+	// The token may have been deleted or upgraded while its hash was checked
+	api_token, ok = store.data.api_tokens[id]
+	if !ok {
+		return nil, httputils.NewUnauthorizedError("Invalid API token")
+	}
+	if api_token.Selector == nil {
+		api_token.upgradeLegacyToken(verifier)
+	}
+	return store.data.loadAPIToken(api_token), nil
+}
+
+func (store *memoryAPITokenStore) ListUserAPITokens(user_id int) ([]*APIToken, error) {
+	store.data.mutex.RLock()
+	defer store.data.mutex.RUnlock()
+
+	api_tokens := []*APIToken{}
+	for _, api_token := range store.data.api_tokens {
+		if api_token.UserID == user_id {
+			api_tokens = append(api_tokens, store.data.loadAPIToken(api_token))
+		}
+	}
+	sort.Slice(api_tokens, func(i, j int) bool { return api_tokens[i].ID < api_tokens[j].ID })
+	return api_tokens, nil
+}
+
+func (store *memoryAPITokenStore) Touch(api_token *APIToken, used_at time.Time) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+
+	api_token.LastUsedAt = &used_at
+	if stored_api_token, ok := store.data.api_tokens[api_token.ID]; ok {
+		stored_api_token.LastUsedAt = &used_at
+	}
+	return nil
+}
+
+func (store *memoryAPITokenStore) Delete(api_token *APIToken) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	delete(store.data.api_tokens, api_token.ID)
+	return nil
+}
+
+func (store *memoryAPITokenStore) DeleteUserAPITokens(user_id int) error {
+	store.data.mutex.Lock()
+	defer store.data.mutex.Unlock()
+	for id, api_token := range store.data.api_tokens {
+		if api_token.UserID == user_id {
+			delete(store.data.api_tokens, id)
+		}
+	}
+	return nil
+}
+
+// loadAPIToken returns a copy of the stored API token with its user, the caller must hold the lock
+func (data *memoryData) loadAPIToken(api_token *APIToken) *APIToken {
+	loaded_api_token := copyAPIToken(api_token)
+	loaded_api_token.User = copyUser(data.users[api_token.UserID])
+	return loaded_api_token
+}
+
+// copyAPIToken returns a copy of the API token without its user, sharing none of its scopes
+func copyAPIToken(api_token *APIToken) *APIToken {
+	copied_api_token := *api_token
+	copied_api_token.User = nil
+	copied_api_token.Scopes = append([]string{}, api_token.Scopes...)
+	if api_token.Selector != nil {
+		selector := *api_token.Selector
+		copied_api_token.Selector = &selector
+	}
+	return &copied_api_token
+}
+
+// ================ Helpers ================
+
+// containsValue returns true if the value is in the list
+func containsValue[T comparable](values []T, value T) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// containsText returns true if the text contains the value, ignoring the case (same as containsCondition)
+func containsText(text string, value string) bool {
+	return strings.Contains(strings.ToLower(text), strings.ToLower(value))
+}
+
+// paginateRecords sorts the records by the order clause ("column [asc|desc], ...", by ID when empty)
+// then applies the limit, page and offset the same way as AddQueryParamsToDB
+func paginateRecords[T any](records []*T, columns map[string]func(record *T) any, order string, limit, page, offset int) ([]*T, error) {
+	type sortKey struct {
+		value      func(record *T) any
+		descending bool
+	}
+
+	keys := []sortKey{}
+	if strings.TrimSpace(order) != "" {
+		for _, clause := range strings.Split(order, ",") {
+			fields := strings.Fields(strings.ToLower(clause))
+			if len(fields) == 0 || len(fields) > 2 {
+				return nil, httputils.NewBadRequestError("invalid order: " + order)
+			}
+			value, ok := columns[fields[0]]
+			if !ok {
+				return nil, httputils.NewBadRequestError("invalid order column: " + fields[0])
+			}
+			descending := len(fields) == 2 && fields[1] == "desc"
+			if len(fields) == 2 && fields[1] != "asc" && fields[1] != "desc" {
+				return nil, httputils.NewBadRequestError("invalid order direction: " + fields[1])
+			}
+			keys = append(keys, sortKey{value: value, descending: descending})
+		}
+	}
+	// Ties are broken by ID, like the rowid order of the database
+	keys = append(keys, sortKey{value: columns["id"]})
+
+	sort.SliceStable(records, func(i, j int) bool {
+		for _, key := range keys {
+			comparison := compareValues(key.value(records[i]), key.value(records[j]))
+			if comparison != 0 {
+				return (comparison < 0) != key.descending
+			}
+		}
+		return false
+	})
+
+	if page > 0 && offset == 0 {
+		offset = (page - 1) * limit
+	}
+	if offset > 0 {
+		if offset >= len(records) {
+			return []*T{}, nil
+		}
+		records = records[offset:]
+	}
+	if limit > 0 && limit < len(records) {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+// compareValues compares two column values of the same type, returns -1, 0 or 1
+func compareValues(a any, b any) int {
+	switch a := a.(type) {
+	case int:
+		return compareOrdered(a, b.(int))
+	case string:
+		return strings.Compare(a, b.(string))
+	case bool:
+		return compareOrdered(boolToInt(a), boolToInt(b.(bool)))
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	}
+	return 0
+}
+
+// compareOrdered compares two ordered values, returns -1, 0 or 1
+func compareOrdered[T int | int64](a T, b T) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// boolToInt converts a boolean to the integer it is stored as
+func boolToInt(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -109,14 +109,14 @@ func (user *User) GetAllMessages(db *gorm.DB) ([]*Message, error) {
 // Does not retrieve the removed and censored messages
 func GetMessagesByContent(db *gorm.DB, content string) ([]*Message, error) {
 	var messages []*Message
-	err := db.Preload("Sender").Where("content LIKE ? AND removed = ? AND censored = ?", "%"+content+"%", false, false).Find(&messages).Error
+	err := db.Preload("Sender").Where(containsCondition("content")+" AND removed = ? AND censored = ?", containsPattern(content), false, false).Find(&messages).Error
 	return messages, err
 }
 
 // GetAllMessagesByContent retrieves all messages containing a specific content from the database, including the removed and censored messages
 func GetAllMessagesByContent(db *gorm.DB, content string) ([]*Message, error) {
 	var messages []*Message
-	err := db.Preload("Sender").Where("content LIKE ?", "%"+content+"%").Find(&messages).Error
+	err := db.Preload("Sender").Where(containsCondition("content"), containsPattern(content)).Find(&messages).Error
 	return messages, err
 }
 
@@ -178,12 +178,24 @@ func (user *User) GetCensoredMessages(db *gorm.DB) ([]*Message, error) {
 	return messages, err
 }
 
+// GetMessages retrieves the messages matching any of the ID / Contains filters (every message if none is set)
+// and all of the SenderID / Flagged / Censored / Removed filters
 func GetMessages(db *gorm.DB, query_params *MessagesGetRequestParams) ([]*Message, error) {
 	query := db
-	for _, s := range query_params.Contains {
-		query = query.Or("content LIKE ?", "%"+s+"%")
+
+	// Build the "OR" conditions for ids and contents
+	if len(query_params.ID) > 0 || len(query_params.Contains) > 0 {
+		or_conditions := db.Session(&gorm.Session{NewDB: true})
+		if len(query_params.ID) > 0 {
+			or_conditions = or_conditions.Or("id IN ?", query_params.ID)
+		}
+		for _, s := range query_params.Contains {
+			or_conditions = or_conditions.Or(containsCondition("content"), containsPattern(s))
+		}
+		query = query.Where(or_conditions)
 	}
 
+	// Apply the remaining "AND" filters
 	if len(query_params.SenderID) > 0 {
 		query = query.Where("sender_id IN ?", query_params.SenderID)
 	}
@@ -197,10 +209,6 @@ func GetMessages(db *gorm.DB, query_params *MessagesGetRequestParams) ([]*Messag
 		query = query.Where("removed = ?", query_params.Removed[0])
 	}
 
-	if len(query_params.ID) > 0 {
-		query = query.Or("id IN ?", query_params.ID)
-	}
-
 	// Apply order, limit, page, and offset
 	query = AddQueryParamsToDB(query, query_params.Order, query_params.Limit, query_params.Page, query_params.Offset)
 
@@ -216,6 +224,11 @@ func (message *Message) UpdateMessage(db *gorm.DB) error {
 	return db.Save(message).Error
 }
 
+// ReassignUserMessages gives the messages sent by a user to another user, without touching their modification date
+func ReassignUserMessages(db *gorm.DB, from_user_id int, to_user_id int) error {
+	return db.Model(&Message{}).Where("sender_id = ?", from_user_id).UpdateColumn("sender_id", to_user_id).Error
+}
+
 // ================ Delete ================
 
 // DeleteMessage deletes a message from the database
@@ -248,5 +261,5 @@ func (user *User) DeleteUserMessages(db *gorm.DB) error {
 
 // DeleteMessagesByContent deletes all messages containing a specific content from the database
 func DeleteMessagesByContent(db *gorm.DB, content string) error {
-	return db.Where("content LIKE ?", "%"+content+"%").Delete(Message{}).Error
+	return db.Where(containsCondition("content"), containsPattern(content)).Delete(Message{}).Error
 }
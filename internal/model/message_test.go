@@ -4,11 +4,8 @@ import "testing"
 
 func TestCreateMessage(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the message
 	user := &User{
@@ -36,11 +33,8 @@ func TestCreateMessage(t *testing.T) {
 
 func TestCreateMessages(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the messages
 	user := &User{
@@ -74,11 +68,8 @@ func TestCreateMessages(t *testing.T) {
 
 func TestGetMessageByID(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the message
 	user := &User{
@@ -112,11 +103,8 @@ func TestGetMessageByID(t *testing.T) {
 
 func TestGetMessagesBySender(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the messages
 	user := &User{
@@ -159,11 +147,8 @@ func TestGetMessagesBySender(t *testing.T) {
 
 func TestGetAllMessagesBySender(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the messages
 	user := &User{
@@ -208,11 +193,8 @@ func TestGetAllMessagesBySender(t *testing.T) {
 
 func TestGetMessagesByContent(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the messages
 	user := &User{
@@ -255,11 +237,8 @@ func TestGetMessagesByContent(t *testing.T) {
 
 func TestGetAllMessagesByContent(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the messages
 	user := &User{
@@ -304,11 +283,8 @@ func TestGetAllMessagesByContent(t *testing.T) {
 
 func TestGetAllVisibleMessages(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the messages
 	user := &User{
@@ -351,11 +327,8 @@ func TestGetAllVisibleMessages(t *testing.T) {
 
 func TestGetAllMessages(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the messages
 	user := &User{
@@ -398,11 +371,8 @@ func TestGetAllMessages(t *testing.T) {
 
 func TestGetFlaggedMessages(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the messages
 	user := &User{
@@ -447,11 +417,8 @@ func TestGetFlaggedMessages(t *testing.T) {
 
 func TestGetFlaggedMessagesBySender(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the messages
 	user := &User{
@@ -496,11 +463,8 @@ func TestGetFlaggedMessagesBySender(t *testing.T) {
 
 func TestGetRemovedMessages(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the messages
 	user := &User{
@@ -545,11 +509,8 @@ func TestGetRemovedMessages(t *testing.T) {
 
 func TestGetRemovedMessagesBySender(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the messages
 	user := &User{
@@ -594,11 +555,8 @@ func TestGetRemovedMessagesBySender(t *testing.T) {
 
 func TestGetCensoredMessages(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the messages
 	user := &User{
@@ -642,11 +600,8 @@ func TestGetCensoredMessages(t *testing.T) {
 }
 
 func TestGetCensoredMessagesBySender(t *testing.T) {
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the messages
 	user := &User{
@@ -690,11 +645,8 @@ func TestGetCensoredMessagesBySender(t *testing.T) {
 }
 
 func TestUpdateMessage(t *testing.T) {
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the message
 	user := &User{
@@ -739,11 +691,8 @@ func TestUpdateMessage(t *testing.T) {
 }
 
 func TestDeleteMessage(t *testing.T) {
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the message
 	user := &User{
@@ -782,11 +731,8 @@ func TestDeleteMessage(t *testing.T) {
 }
 
 func TestDeleteMessages(t *testing.T) {
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the messages
 	user := &User{
@@ -0,0 +1,284 @@
+package db_model
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boxboxjason/jukebox/pkg/logger"
+	"gorm.io/gorm"
+)
+
+// Migration is a versioned and reversible change of the database schema
+// Up and Down run inside a transaction, they must only use their own snapshot of the models
+// so that replaying old migrations does not depend on the current structs
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration is the record of an applied (or half applied, when dirty) migration
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false" json:"version"`
+	Name      string    `gorm:"type:TEXT;not null" json:"name"`
+	Dirty     bool      `gorm:"type:BOOLEAN;not null;default:false" json:"dirty"`
+	AppliedAt time.Time `gorm:"autoCreateTime" json:"applied_at"`
+}
+
+// MigrationStatus is the state of a migration in the database
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	Dirty     bool       `json:"dirty"`
+	Known     bool       `json:"known"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// TableName overrides the default gorm table name
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// ================ Registry ================
+
+// Migrations returns the registered migrations sorted by version
+func Migrations() []*Migration {
+	sorted := make([]*Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return sorted
+}
+
+// LatestMigrationVersion returns the version of the most recent registered migration
+func LatestMigrationVersion() int {
+	sorted := Migrations()
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[len(sorted)-1].Version
+}
+
+// ================ Runner ================
+
+// ensureMigrationsTable creates the schema_migrations table if it does not exist
+func ensureMigrationsTable(db *gorm.DB) error {
+	return db.AutoMigrate(&SchemaMigration{})
+}
+
+// getAppliedMigrations retrieves the migration records, indexed by version
+func getAppliedMigrations(db *gorm.DB) (map[int]*SchemaMigration, error) {
+	err := ensureMigrationsTable(db)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*SchemaMigration{}
+	err = db.Order("version").Find(&records).Error
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]*SchemaMigration, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// CheckSchema checks that the database schema can be used by this build
+// It fails when a migration was interrupted (dirty schema) or when the database
+// contains migrations this build does not know about (schema newer than the binary)
+func CheckSchema(db *gorm.DB) error {
+	applied, err := getAppliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[int]bool, len(migrations))
+	for _, migration := range migrations {
+		known[migration.Version] = true
+	}
+
+	for _, record := range applied {
+		if record.Dirty {
+			return fmt.Errorf("database schema is dirty at version %d (%s), fix the schema manually then run 'migrate force %d'", record.Version, record.Name, record.Version)
+		}
+		if !known[record.Version] {
+			return fmt.Errorf("database schema contains unknown migration %d (%s), it was migrated by a newer version of JukeBox", record.Version, record.Name)
+		}
+	}
+	return nil
+}
+
+// MigrateUp applies the pending migrations up to the target version (all of them if target is 0)
+// Returns the migrations that were applied
+func MigrateUp(db *gorm.DB, target int) ([]*Migration, error) {
+	err := CheckSchema(db)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := getAppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	done := []*Migration{}
+	for _, migration := range Migrations() {
+		if target > 0 && migration.Version > target {
+			break
+		}
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		logger.Info("Applying migration", migration.Version, migration.Name)
+		err = runMigrationStep(db, migration, migration.Up)
+		if err != nil {
+			return done, fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Name, err)
+		}
+
+		err = db.Model(&SchemaMigration{}).Where("version = ?", migration.Version).Update("dirty", false).Error
+		if err != nil {
+			return done, err
+		}
+		done = append(done, migration)
+	}
+
+	// The search index depends on the build, which may have changed since the migration created it
+	applied, err = getAppliedMigrations(db)
+	if err != nil {
+		return done, err
+	}
+	if _, ok := applied[MESSAGES_SEARCH_MIGRATION]; ok {
+		err = syncMessagesSearchIndex(db)
+	}
+	return done, err
+}
+
+// MigrateDown rolls back the given number of most recently applied migrations
+// Returns the migrations that were rolled back
+func MigrateDown(db *gorm.DB, steps int) ([]*Migration, error) {
+	err := CheckSchema(db)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := getAppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := Migrations()
+	done := []*Migration{}
+	for i := len(sorted) - 1; i >= 0 && len(done) < steps; i-- {
+		migration := sorted[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+
+		logger.Info("Rolling back migration", migration.Version, migration.Name)
+		err = runMigrationStep(db, migration, migration.Down)
+		if err != nil {
+			return done, fmt.Errorf("rollback of migration %d (%s) failed: %w", migration.Version, migration.Name, err)
+		}
+
+		err = db.Delete(&SchemaMigration{}, migration.Version).Error
+		if err != nil {
+			return done, err
+		}
+		done = append(done, migration)
+	}
+
+	return done, nil
+}
+
+// runMigrationStep marks the migration as dirty then runs the step in a transaction
+// The dirty mark is only cleared by the caller once the step succeeded, so an interrupted
+// or failed step leaves a trace that CheckSchema refuses to boot on
+func runMigrationStep(db *gorm.DB, migration *Migration, step func(tx *gorm.DB) error) error {
+	err := db.Save(&SchemaMigration{
+		Version:   migration.Version,
+		Name:      migration.Name,
+		Dirty:     true,
+		AppliedAt: currentTime(),
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	if step == nil {
+		return fmt.Errorf("migration has no step to run")
+	}
+	return db.Transaction(step)
+}
+
+// ForceMigrationVersion records the schema as being exactly at the given version, without running any migration
+// It is meant to recover from a dirty schema once it was fixed manually
+func ForceMigrationVersion(db *gorm.DB, version int) error {
+	err := ensureMigrationsTable(db)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("version > ?", version).Delete(&SchemaMigration{}).Error
+		if err != nil {
+			return err
+		}
+		for _, migration := range Migrations() {
+			if migration.Version > version {
+				break
+			}
+			err = tx.Save(&SchemaMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				Dirty:     false,
+				AppliedAt: currentTime(),
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetMigrationsStatus returns the status of every registered migration,
+// followed by the applied migrations this build does not know about
+func GetMigrationsStatus(db *gorm.DB) ([]*MigrationStatus, error) {
+	applied, err := getAppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []*MigrationStatus{}
+	for _, migration := range Migrations() {
+		status := &MigrationStatus{Version: migration.Version, Name: migration.Name, Known: true}
+		if record, ok := applied[migration.Version]; ok {
+			status.Applied = !record.Dirty
+			status.Dirty = record.Dirty
+			status.AppliedAt = &record.AppliedAt
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+
+	unknown := []*MigrationStatus{}
+	for _, record := range applied {
+		applied_at := record.AppliedAt
+		unknown = append(unknown, &MigrationStatus{
+			Version:   record.Version,
+			Name:      record.Name,
+			Applied:   !record.Dirty,
+			Dirty:     record.Dirty,
+			AppliedAt: &applied_at,
+		})
+	}
+	sort.Slice(unknown, func(i, j int) bool { return unknown[i].Version < unknown[j].Version })
+
+	return append(statuses, unknown...), nil
+}
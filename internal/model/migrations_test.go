@@ -0,0 +1,335 @@
+package db_model
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// openEmptyTestDatabase opens an empty SQLite database, the tests that rebuild or replace the schema
+// run against it instead of the shared test database so that they do not break the other tests
+func openEmptyTestDatabase(t *testing.T) *gorm.DB {
+	options := DefaultDatabaseOptions()
+	options.DSN = filepath.Join(t.TempDir(), "empty.db")
+	db, err := OpenDatabase(options)
+	if err != nil {
+		t.Fatalf("Error opening the empty test database: %v", err)
+	}
+	t.Cleanup(func() { CloseDatabase(db) })
+	return db
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	db := openEmptyTestDatabase(t)
+
+	applied, err := MigrateUp(db, 0)
+	if err != nil {
+		t.Fatalf("Error migrating up: %v", err)
+	}
+	if len(applied) != len(Migrations()) {
+		t.Errorf("Expected %d applied migrations, got %d", len(Migrations()), len(applied))
+	}
+	if !db.Migrator().HasTable(&User{}) {
+		t.Errorf("Expected the users table to exist after migrating up")
+	}
+
+	// A second run has nothing left to apply
+	applied, err = MigrateUp(db, 0)
+	if err != nil {
+		t.Errorf("Error migrating up twice: %v", err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("Expected no migration to be applied twice, got %d", len(applied))
+	}
+
+	statuses, err := GetMigrationsStatus(db)
+	if err != nil {
+		t.Errorf("Error retrieving the migrations status: %v", err)
+	}
+	for _, status := range statuses {
+		if !status.Applied || status.Dirty || !status.Known {
+			t.Errorf("Expected migration %d to be applied, got %+v", status.Version, status)
+		}
+	}
+
+	rolled_back, err := MigrateDown(db, len(Migrations()))
+	if err != nil {
+		t.Fatalf("Error migrating down: %v", err)
+	}
+	if len(rolled_back) != len(Migrations()) {
+		t.Errorf("Expected %d rolled back migrations, got %d", len(Migrations()), len(rolled_back))
+	}
+	if db.Migrator().HasTable(&User{}) {
+		t.Errorf("Expected the users table to be dropped after migrating down")
+	}
+}
+
+func TestMigrateUpAdoptsExistingTables(t *testing.T) {
+	db := openEmptyTestDatabase(t)
+
+	// Databases created before the migrations only have the tables
+	err := db.AutoMigrate(&User{}, &AuthToken{}, &Message{}, &Ban{})
+	if err != nil {
+		t.Fatalf("Error creating the legacy tables: %v", err)
+	}
+
+	_, err = MigrateUp(db, 0)
+	if err != nil {
+		t.Errorf("Error migrating a legacy database: %v", err)
+	}
+}
+
+func TestMigrateUpVerifiesExistingUsers(t *testing.T) {
+	db := openEmptyTestDatabase(t)
+
+	_, err := MigrateUp(db, 4)
+	if err != nil {
+		t.Fatalf("Error migrating up to version 4: %v", err)
+	}
+	err = db.Create(&userV1{Username: "legacy", Email: "legacy@test.com", Hashed_Password: "hash"}).Error
+	if err != nil {
+		t.Fatalf("Error creating the legacy user: %v", err)
+	}
+
+	// The users created before the email verification keep posting
+	_, err = MigrateUp(db, 0)
+	if err != nil {
+		t.Fatalf("Error migrating up: %v", err)
+	}
+	user := &User{}
+	err = db.Where("username = ?", "legacy").First(user).Error
+	if err != nil || !user.VerifiedEmail {
+		t.Errorf("Expected the legacy user to be verified, got %+v (%v)", user, err)
+	}
+}
+
+func TestMigrateUpAssignsRoles(t *testing.T) {
+	db := openEmptyTestDatabase(t)
+
+	_, err := MigrateUp(db, 9)
+	if err != nil {
+		t.Fatalf("Error migrating up to version 9: %v", err)
+	}
+	legacy_users := []*userV1{
+		{Username: "member", Email: "member@test.com", Hashed_Password: "hash"},
+		{Username: "first", Email: "first@test.com", Hashed_Password: "hash", Admin: true},
+		{Username: "second", Email: "second@test.com", Hashed_Password: "hash", Admin: true},
+	}
+	err = db.Create(&legacy_users).Error
+	if err != nil {
+		t.Fatalf("Error creating the legacy users: %v", err)
+	}
+
+	// The oldest admin owns the instance, the other admins keep their rights
+	_, err = MigrateUp(db, 0)
+	if err != nil {
+		t.Fatalf("Error migrating up: %v", err)
+	}
+	expected_roles := map[string]string{"member": "user", "first": "owner", "second": "admin"}
+	for username, role := range expected_roles {
+		user := &User{}
+		err = db.Where("username = ?", username).First(user).Error
+		if err != nil || user.Role != role {
+			t.Errorf("Expected the legacy user %s to be %s, got %+v (%v)", username, role, user, err)
+		}
+	}
+	if db.Migrator().HasColumn(&userV1{}, "Admin") {
+		t.Errorf("Expected the admin column to be dropped")
+	}
+}
+
+func TestMigrateUpKeepsLegacySessions(t *testing.T) {
+	db := openEmptyTestDatabase(t)
+
+	_, err := MigrateUp(db, 11)
+	if err != nil {
+		t.Fatalf("Error migrating up to version 11: %v", err)
+	}
+	legacy_user := &User{Username: "legacy", Email: "legacy@test.com", Hashed_Password: "hash"}
+	err = db.Create(legacy_user).Error
+	if err != nil {
+		t.Fatalf("Error creating the legacy user: %v", err)
+	}
+	legacy_tokens := []*authTokenV1{
+		{UserID: legacy_user.ID, Hashed_Token: "access_hash", Type: "access"},
+		{UserID: legacy_user.ID, Hashed_Token: "reset_hash", Type: "password_reset"},
+	}
+	err = db.Create(&legacy_tokens).Error
+	if err != nil {
+		t.Fatalf("Error creating the legacy tokens: %v", err)
+	}
+
+	// The sessions keep their tokens until they are refreshed, the pending links are deleted
+	_, err = MigrateUp(db, 0)
+	if err != nil {
+		t.Fatalf("Error migrating up: %v", err)
+	}
+	var tokens []*AuthToken
+	err = db.Order("id asc").Find(&tokens).Error
+	if err != nil || len(tokens) != 1 || tokens[0].Type != "access" || tokens[0].Selector != nil {
+		t.Errorf("Expected only the legacy access token to be kept, got %+v (%v)", tokens, err)
+	}
+}
+
+func TestMigrateUpStartsSessionFamilies(t *testing.T) {
+	db := openEmptyTestDatabase(t)
+
+	_, err := MigrateUp(db, 12)
+	if err != nil {
+		t.Fatalf("Error migrating up to version 12: %v", err)
+	}
+	legacy_user := &User{Username: "legacy", Email: "legacy@test.com", Hashed_Password: "hash"}
+	err = db.Create(legacy_user).Error
+	if err != nil {
+		t.Fatalf("Error creating the legacy user: %v", err)
+	}
+	refresh_token := &authTokenV1{UserID: legacy_user.ID, Hashed_Token: "refresh_hash", Type: "refresh"}
+	err = db.Create(refresh_token).Error
+	if err != nil {
+		t.Fatalf("Error creating the legacy refresh token: %v", err)
+	}
+	access_token := &authTokenV1{UserID: legacy_user.ID, Hashed_Token: "access_hash", Type: "access", LinkedTokenID: &refresh_token.ID}
+	err = db.Create(access_token).Error
+	if err != nil {
+		t.Fatalf("Error creating the legacy access token: %v", err)
+	}
+
+	// The existing sessions start their family with their refresh token
+	_, err = MigrateUp(db, 0)
+	if err != nil {
+		t.Fatalf("Error migrating up: %v", err)
+	}
+	var tokens []*AuthToken
+	err = db.Order("id asc").Find(&tokens).Error
+	if err != nil || len(tokens) != 2 {
+		t.Fatalf("Expected the 2 legacy tokens to be kept, got %d (%v)", len(tokens), err)
+	}
+	for _, token := range tokens {
+		if token.FamilyID == nil || *token.FamilyID != refresh_token.ID {
+			t.Errorf("Expected the %s token in the family %d, got %v", token.Type, refresh_token.ID, token.FamilyID)
+		}
+	}
+
+	// The rotated refresh tokens would be usable again without their rotation
+	now := time.Now()
+	err = db.Model(tokens[0]).Update("rotated_at", now).Error
+	if err != nil {
+		t.Fatalf("Error rotating the refresh token: %v", err)
+	}
+	_, err = MigrateDown(db, len(Migrations())-12)
+	if err != nil {
+		t.Fatalf("Error migrating down: %v", err)
+	}
+	var count int64
+	db.Table("auth_tokens").Count(&count)
+	if count != 1 {
+		t.Errorf("Expected the rotated refresh token to be deleted, got %d tokens", count)
+	}
+	if !db.Migrator().HasIndex(&authTokenV12{}, "Selector") {
+		t.Errorf("Expected the index of the selectors to be kept")
+	}
+}
+
+func TestMigrateUpKeepsLegacyAPITokens(t *testing.T) {
+	db := openEmptyTestDatabase(t)
+
+	_, err := MigrateUp(db, 13)
+	if err != nil {
+		t.Fatalf("Error migrating up to version 13: %v", err)
+	}
+	legacy_user := &User{Username: "legacy", Email: "legacy@test.com", Hashed_Password: "hash"}
+	err = db.Create(legacy_user).Error
+	if err != nil {
+		t.Fatalf("Error creating the legacy user: %v", err)
+	}
+	err = db.Create(&apiTokenV9{UserID: legacy_user.ID, Name: "bot", Hashed_Token: "bcrypt_hash", Scopes: "[]"}).Error
+	if err != nil {
+		t.Fatalf("Error creating the legacy API token: %v", err)
+	}
+
+	// The existing tokens are kept without selector until their first use
+	_, err = MigrateUp(db, 0)
+	if err != nil {
+		t.Fatalf("Error migrating up: %v", err)
+	}
+	var api_tokens []*APIToken
+	err = db.Find(&api_tokens).Error
+	if err != nil || len(api_tokens) != 1 || api_tokens[0].Selector != nil || api_tokens[0].Hashed_Token != "bcrypt_hash" {
+		t.Fatalf("Expected the legacy API token to be kept, got %+v (%v)", api_tokens, err)
+	}
+
+	// The tokens with a selector can not be checked once it is dropped
+	selector := "selector"
+	err = db.Create(&APIToken{UserID: legacy_user.ID, Name: "split", Selector: &selector, Hashed_Token: "sha256_hash", Scopes: []string{}}).Error
+	if err != nil {
+		t.Fatalf("Error creating the API token: %v", err)
+	}
+	_, err = MigrateDown(db, len(Migrations())-13)
+	if err != nil {
+		t.Fatalf("Error migrating down: %v", err)
+	}
+	var count int64
+	db.Table("api_tokens").Count(&count)
+	if count != 1 {
+		t.Errorf("Expected the API token with a selector to be deleted, got %d tokens", count)
+	}
+	if !db.Migrator().HasIndex(&apiTokenV9{}, "UserID") {
+		t.Errorf("Expected the index of the users to be kept")
+	}
+}
+
+func TestCheckSchemaDirty(t *testing.T) {
+	db := openEmptyTestDatabase(t)
+
+	_, err := MigrateUp(db, 0)
+	if err != nil {
+		t.Fatalf("Error migrating up: %v", err)
+	}
+
+	// Simulate an interrupted migration
+	latest := LatestMigrationVersion()
+	err = db.Model(&SchemaMigration{}).Where("version = ?", latest).Update("dirty", true).Error
+	if err != nil {
+		t.Fatalf("Error marking the schema as dirty: %v", err)
+	}
+
+	err = CheckSchema(db)
+	if err == nil {
+		t.Errorf("Expected a dirty schema to be rejected")
+	}
+	_, err = MigrateUp(db, 0)
+	if err == nil {
+		t.Errorf("Expected migrating a dirty schema to fail")
+	}
+
+	err = ForceMigrationVersion(db, latest)
+	if err != nil {
+		t.Errorf("Error forcing the schema version: %v", err)
+	}
+	err = CheckSchema(db)
+	if err != nil {
+		t.Errorf("Expected the forced schema to be clean, got %v", err)
+	}
+}
+
+func TestCheckSchemaUnknownVersion(t *testing.T) {
+	db := openEmptyTestDatabase(t)
+
+	_, err := MigrateUp(db, 0)
+	if err != nil {
+		t.Fatalf("Error migrating up: %v", err)
+	}
+
+	// Simulate a database migrated by a newer build
+	err = db.Create(&SchemaMigration{Version: LatestMigrationVersion() + 1, Name: "from_the_future"}).Error
+	if err != nil {
+		t.Fatalf("Error recording the unknown migration: %v", err)
+	}
+
+	err = CheckSchema(db)
+	if err == nil {
+		t.Errorf("Expected an unknown migration to be rejected")
+	}
+}
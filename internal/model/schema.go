@@ -0,0 +1,693 @@
+package db_model
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// migrations is the ordered list of the schema migrations
+// Never edit a released migration, add a new one with the next version instead
+var migrations = []*Migration{
+	{
+		Version: 1,
+		Name:    "create_initial_tables",
+		Up:      createInitialTables,
+		Down:    dropInitialTables,
+	},
+	{
+		Version: MESSAGES_SEARCH_MIGRATION,
+		Name:    "create_messages_search_index",
+		Up:      createMessagesSearchIndex,
+		Down:    dropMessagesSearchIndex,
+	},
+	{
+		Version: 3,
+		Name:    "create_audit_events",
+		Up:      createAuditEvents,
+		Down:    dropAuditEvents,
+	},
+	{
+		Version: 4,
+		Name:    "add_users_deletion",
+		Up:      addUsersDeletion,
+		Down:    dropUsersDeletion,
+	},
+	{
+		Version: 5,
+		Name:    "add_users_verified_email",
+		Up:      addUsersVerifiedEmail,
+		Down:    dropUsersVerifiedEmail,
+	},
+	{
+		Version: 6,
+		Name:    "add_users_two_factor",
+		Up:      addUsersTwoFactor,
+		Down:    dropUsersTwoFactor,
+	},
+	{
+		Version: 7,
+		Name:    "create_user_identities",
+		Up:      createUserIdentities,
+		Down:    dropUserIdentities,
+	},
+	{
+		Version: 8,
+		Name:    "add_auth_tokens_sessions",
+		Up:      addAuthTokensSessions,
+		Down:    dropAuthTokensSessions,
+	},
+	{
+		Version: 9,
+		Name:    "create_api_tokens",
+		Up:      createAPITokens,
+		Down:    dropAPITokens,
+	},
+	{
+		Version: 10,
+		Name:    "add_users_roles",
+		Up:      addUsersRoles,
+		Down:    dropUsersRoles,
+	},
+	{
+		Version: 11,
+		Name:    "add_users_lockout",
+		Up:      addUsersLockout,
+		Down:    dropUsersLockout,
+	},
+	{
+		Version: 12,
+		Name:    "add_auth_tokens_selectors",
+		Up:      addAuthTokensSelectors,
+		Down:    dropAuthTokensSelectors,
+	},
+	{
+		Version: 13,
+		Name:    "add_auth_tokens_families",
+		Up:      addAuthTokensFamilies,
+		Down:    dropAuthTokensFamilies,
+	},
+	{
+		Version: 14,
+		Name:    "add_api_tokens_selectors",
+		Up:      addAPITokensSelectors,
+		Down:    dropAPITokensSelectors,
+	},
+}
+
+// ================ 1: create_initial_tables ================
+
+type userV1 struct {
+	ID                 int       `gorm:"primaryKey;autoIncrement"`
+	Username           string    `gorm:"type:TEXT;unique;not null"`
+	Hashed_Password    string    `gorm:"type:TEXT;not null"`
+	Email              string    `gorm:"type:TEXT;unique;not null"`
+	Avatar             string    `gorm:"type:TEXT;default:'default_avatar.png'"`
+	Admin              bool      `gorm:"type:BOOLEAN;not null;default:false"`
+	Banned             bool      `gorm:"type:BOOLEAN;not null;default:false"`
+	TotalContributions int       `gorm:"type:INTEGER;not null;default:0"`
+	MinutesListened    int       `gorm:"type:INTEGER;not null;default:0"`
+	Subscriber_Tier    int       `gorm:"type:INTEGER;not null;default:0"`
+	CreatedAt          time.Time `gorm:"autoCreateTime"`
+	ModifiedAt         time.Time `gorm:"autoUpdateTime:milli"`
+}
+
+func (userV1) TableName() string { return "users" }
+
+type authTokenV1 struct {
+	ID            int          `gorm:"primaryKey;autoIncrement"`
+	UserID        int          `gorm:"type:INTEGER;not null"`
+	User          *userV1      `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	Hashed_Token  string       `gorm:"type:TEXT;unique;not null"`
+	Expiration    int64        `gorm:"type:BIGINT;not null"`
+	Type          string       `gorm:"type:TEXT;not null"`
+	LinkedTokenID *int         `gorm:"type:INTEGER;default:null"`
+	LinkedToken   *authTokenV1 `gorm:"foreignKey:LinkedTokenID;constraint:OnDelete:SET NULL"`
+	CreatedAt     time.Time    `gorm:"autoCreateTime"`
+	ModifiedAt    time.Time    `gorm:"autoUpdateTime:milli"`
+}
+
+func (authTokenV1) TableName() string { return "auth_tokens" }
+
+type messageV1 struct {
+	ID         int       `gorm:"primaryKey;autoIncrement"`
+	Sender     *userV1   `gorm:"foreignKey:SenderID;constraint:OnDelete:CASCADE"`
+	SenderID   int       `gorm:"type:INTEGER;not null"`
+	Content    string    `gorm:"type:TEXT;not null"`
+	Flagged    bool      `gorm:"type:BOOLEAN;default:false"`
+	Removed    bool      `gorm:"type:BOOLEAN;default:false"`
+	Censored   bool      `gorm:"type:BOOLEAN;default:false"`
+	CreatedAt  time.Time `gorm:"autoCreateTime"`
+	ModifiedAt time.Time `gorm:"autoUpdateTime:milli"`
+}
+
+func (messageV1) TableName() string { return "messages" }
+
+type banV1 struct {
+	ID         int     `gorm:"primaryKey;autoIncrement"`
+	Target     *userV1 `gorm:"foreignKey:TargetID;constraint:OnDelete:CASCADE"`
+	TargetID   int
+	Issuer     *userV1 `gorm:"foreignKey:IssuerID;constraint:OnDelete:CASCADE"`
+	IssuerID   int
+	Reason     string
+	EndsAt     time.Time
+	Type       string
+	CreatedAt  time.Time `gorm:"autoCreateTime"`
+	ModifiedAt time.Time `gorm:"autoUpdateTime:milli"`
+}
+
+func (banV1) TableName() string { return "bans" }
+
+// createInitialTables creates the original tables
+// Databases created before the migrations existed already have them, so existing tables are kept as is
+func createInitialTables(tx *gorm.DB) error {
+	for _, table := range []interface{}{&userV1{}, &authTokenV1{}, &messageV1{}, &banV1{}} {
+		if tx.Migrator().HasTable(table) {
+			continue
+		}
+		err := tx.Migrator().CreateTable(table)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropInitialTables drops the original tables, children first
+func dropInitialTables(tx *gorm.DB) error {
+	return tx.Migrator().DropTable(&banV1{}, &messageV1{}, &authTokenV1{}, &userV1{})
+}
+
+// ================ 2: create_messages_search_index ================
+
+// createMessagesSearchIndex creates the FTS5 index of the messages content, kept in sync by triggers,
+// and indexes the existing messages
+// The index depends on the build more than on the schema, so it is matched to the running build after every migration run
+func createMessagesSearchIndex(tx *gorm.DB) error {
+	return syncMessagesSearchIndex(tx)
+}
+
+// dropMessagesSearchIndex drops the FTS5 index of the messages content and its triggers
+// Without FTS5 the index can not be dropped, it is left to the next build with FTS5
+func dropMessagesSearchIndex(tx *gorm.DB) error {
+	if tx.Dialector.Name() != SQLITE_DRIVER {
+		return nil
+	}
+	err := dropMessagesSearchTriggers(tx)
+	if err != nil || !fts5Available(tx) {
+		return err
+	}
+	return tx.Exec(`DROP TABLE IF EXISTS ` + MESSAGES_SEARCH_TABLE).Error
+}
+
+// ================ 3: create_audit_events ================
+
+type auditEventV3 struct {
+	ID            int       `gorm:"primaryKey;autoIncrement"`
+	ActorID       int       `gorm:"type:INTEGER;not null;index"`
+	ActorUsername string    `gorm:"type:TEXT;not null"`
+	Action        string    `gorm:"type:TEXT;not null;index"`
+	TargetType    string    `gorm:"type:TEXT;not null;index:idx_audit_events_target"`
+	TargetID      int       `gorm:"type:INTEGER;not null;index:idx_audit_events_target"`
+	Before        string    `gorm:"type:TEXT"`
+	After         string    `gorm:"type:TEXT"`
+	Reason        string    `gorm:"type:TEXT"`
+	IP            string    `gorm:"type:TEXT"`
+	RequestID     string    `gorm:"type:TEXT;index"`
+	CreatedAt     time.Time `gorm:"autoCreateTime;index"`
+}
+
+func (auditEventV3) TableName() string { return "audit_events" }
+
+// createAuditEvents creates the audit log table
+func createAuditEvents(tx *gorm.DB) error {
+	return tx.Migrator().CreateTable(&auditEventV3{})
+}
+
+// dropAuditEvents drops the audit log table
+func dropAuditEvents(tx *gorm.DB) error {
+	return tx.Migrator().DropTable(&auditEventV3{})
+}
+
+// ================ 4: add_users_deletion ================
+
+type userV4 struct {
+	ID            int        `gorm:"primaryKey;autoIncrement"`
+	DeletionDueAt *time.Time `gorm:"index;default:null"`
+	DeletionMode  string     `gorm:"type:TEXT;not null;default:''"`
+}
+
+func (userV4) TableName() string { return "users" }
+
+// addUsersDeletion adds the scheduled deletion of the users, the columns may already exist on databases created before the migrations
+func addUsersDeletion(tx *gorm.DB) error {
+	for _, field := range []string{"DeletionDueAt", "DeletionMode"} {
+		if tx.Migrator().HasColumn(&userV4{}, field) {
+			continue
+		}
+		err := tx.Migrator().AddColumn(&userV4{}, field)
+		if err != nil {
+			return err
+		}
+	}
+	if tx.Migrator().HasIndex(&userV4{}, "DeletionDueAt") {
+		return nil
+	}
+	return tx.Migrator().CreateIndex(&userV4{}, "DeletionDueAt")
+}
+
+// dropUsersDeletion drops the scheduled deletion of the users
+func dropUsersDeletion(tx *gorm.DB) error {
+	err := tx.Migrator().DropIndex(&userV4{}, "DeletionDueAt")
+	if err != nil {
+		return err
+	}
+	for _, field := range []string{"DeletionMode", "DeletionDueAt"} {
+		err = tx.Migrator().DropColumn(&userV4{}, field)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ================ 5: add_users_verified_email ================
+
+type userV5 struct {
+	ID            int  `gorm:"primaryKey;autoIncrement"`
+	VerifiedEmail bool `gorm:"type:BOOLEAN;not null;default:false"`
+}
+
+func (userV5) TableName() string { return "users" }
+
+// addUsersVerifiedEmail adds the email verification state of the users
+// The users created before the verification existed are trusted, so that they can keep posting
+func addUsersVerifiedEmail(tx *gorm.DB) error {
+	if !tx.Migrator().HasColumn(&userV5{}, "VerifiedEmail") {
+		err := tx.Migrator().AddColumn(&userV5{}, "VerifiedEmail")
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Model(&userV5{}).Where("1 = 1").Update("verified_email", true).Error
+}
+
+// dropUsersVerifiedEmail drops the email verification state of the users
+// SQLite drops a column by rebuilding the table, which loses the index of the scheduled deletions
+func dropUsersVerifiedEmail(tx *gorm.DB) error {
+	err := tx.Migrator().DropColumn(&userV5{}, "VerifiedEmail")
+	if err != nil || tx.Migrator().HasIndex(&userV4{}, "DeletionDueAt") {
+		return err
+	}
+	return tx.Migrator().CreateIndex(&userV4{}, "DeletionDueAt")
+}
+
+// ================ 6: add_users_two_factor ================
+
+type userV6 struct {
+	ID            int    `gorm:"primaryKey;autoIncrement"`
+	TOTPSecret    string `gorm:"type:TEXT;not null;default:''"`
+	TOTPEnabled   bool   `gorm:"type:BOOLEAN;not null;default:false"`
+	TOTPLastStep  int64  `gorm:"type:BIGINT;not null;default:0"`
+	RecoveryCodes string `gorm:"type:TEXT;not null;default:''"`
+}
+
+func (userV6) TableName() string { return "users" }
+
+// addUsersTwoFactor adds the TOTP secret, the last used time step and the hashed recovery codes of the users
+func addUsersTwoFactor(tx *gorm.DB) error {
+	for _, field := range []string{"TOTPSecret", "TOTPEnabled", "TOTPLastStep", "RecoveryCodes"} {
+		if tx.Migrator().HasColumn(&userV6{}, field) {
+			continue
+		}
+		err := tx.Migrator().AddColumn(&userV6{}, field)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropUsersTwoFactor drops the two-factor authentication of the users
+// SQLite drops a column by rebuilding the table, which loses the index of the scheduled deletions
+func dropUsersTwoFactor(tx *gorm.DB) error {
+	for _, field := range []string{"RecoveryCodes", "TOTPLastStep", "TOTPEnabled", "TOTPSecret"} {
+		err := tx.Migrator().DropColumn(&userV6{}, field)
+		if err != nil {
+			return err
+		}
+	}
+	if tx.Migrator().HasIndex(&userV4{}, "DeletionDueAt") {
+		return nil
+	}
+	return tx.Migrator().CreateIndex(&userV4{}, "DeletionDueAt")
+}
+
+// ================ 7: create_user_identities ================
+
+type userIdentityV7 struct {
+	ID         int       `gorm:"primaryKey;autoIncrement"`
+	UserID     int       `gorm:"type:INTEGER;not null;index"`
+	User       *userV1   `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	Provider   string    `gorm:"type:TEXT;not null;uniqueIndex:idx_user_identities_subject"`
+	Subject    string    `gorm:"type:TEXT;not null;uniqueIndex:idx_user_identities_subject"`
+	Email      string    `gorm:"type:TEXT;not null;default:''"`
+	CreatedAt  time.Time `gorm:"autoCreateTime"`
+	ModifiedAt time.Time `gorm:"autoUpdateTime:milli"`
+}
+
+func (userIdentityV7) TableName() string { return "user_identities" }
+
+// createUserIdentities creates the table linking the users to their OpenID Connect subjects
+func createUserIdentities(tx *gorm.DB) error {
+	return tx.Migrator().CreateTable(&userIdentityV7{})
+}
+
+// dropUserIdentities drops the table linking the users to their OpenID Connect subjects
+func dropUserIdentities(tx *gorm.DB) error {
+	return tx.Migrator().DropTable(&userIdentityV7{})
+}
+
+// ================ 8: add_auth_tokens_sessions ================
+
+type authTokenV8 struct {
+	ID         int        `gorm:"primaryKey;autoIncrement"`
+	LastUsedAt *time.Time `gorm:"default:null"`
+	IP         string     `gorm:"type:TEXT;not null;default:''"`
+	UserAgent  string     `gorm:"type:TEXT;not null;default:''"`
+}
+
+func (authTokenV8) TableName() string { return "auth_tokens" }
+
+// addAuthTokensSessions adds the last use and the client of the tokens, shown in the sessions of the users
+func addAuthTokensSessions(tx *gorm.DB) error {
+	for _, field := range []string{"LastUsedAt", "IP", "UserAgent"} {
+		if tx.Migrator().HasColumn(&authTokenV8{}, field) {
+			continue
+		}
+		err := tx.Migrator().AddColumn(&authTokenV8{}, field)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropAuthTokensSessions drops the last use and the client of the tokens
+func dropAuthTokensSessions(tx *gorm.DB) error {
+	for _, field := range []string{"UserAgent", "IP", "LastUsedAt"} {
+		err := tx.Migrator().DropColumn(&authTokenV8{}, field)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ================ 9: create_api_tokens ================
+
+type apiTokenV9 struct {
+	ID           int        `gorm:"primaryKey;autoIncrement"`
+	UserID       int        `gorm:"type:INTEGER;not null;index"`
+	User         *userV1    `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	Name         string     `gorm:"type:TEXT;not null"`
+	Hashed_Token string     `gorm:"type:TEXT;not null"`
+	Scopes       string     `gorm:"type:TEXT;not null"`
+	ExpiresAt    *time.Time `gorm:"default:null"`
+	LastUsedAt   *time.Time `gorm:"default:null"`
+	CreatedAt    time.Time  `gorm:"autoCreateTime"`
+	ModifiedAt   time.Time  `gorm:"autoUpdateTime:milli"`
+}
+
+func (apiTokenV9) TableName() string { return "api_tokens" }
+
+// createAPITokens creates the table of the API tokens the users create for their bots and integrations
+func createAPITokens(tx *gorm.DB) error {
+	return tx.Migrator().CreateTable(&apiTokenV9{})
+}
+
+// dropAPITokens drops the table of the API tokens
+func dropAPITokens(tx *gorm.DB) error {
+	return tx.Migrator().DropTable(&apiTokenV9{})
+}
+
+// ================ 10: add_users_roles ================
+
+type userV10 struct {
+	ID   int    `gorm:"primaryKey;autoIncrement"`
+	Role string `gorm:"type:TEXT;not null;default:'user'"`
+}
+
+func (userV10) TableName() string { return "users" }
+
+// addUsersRoles replaces the admin status of the users by their role
+// The oldest admin becomes the owner of the instance, the other admins keep their rights as admins
+// SQLite drops a column by rebuilding the table, which loses the index of the scheduled deletions
+func addUsersRoles(tx *gorm.DB) error {
+	if !tx.Migrator().HasColumn(&userV10{}, "Role") {
+		err := tx.Migrator().AddColumn(&userV10{}, "Role")
+		if err != nil {
+			return err
+		}
+	}
+	if !tx.Migrator().HasColumn(&userV1{}, "Admin") {
+		return nil
+	}
+
+	err := tx.Model(&userV10{}).Where("admin = ?", true).Update("role", "admin").Error
+	if err != nil {
+		return err
+	}
+	owner := &userV10{}
+	err = tx.Where("role = ?", "admin").Order("id asc").Limit(1).Find(owner).Error
+	if err != nil {
+		return err
+	}
+	if owner.ID != 0 {
+		err = tx.Model(owner).Update("role", "owner").Error
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Migrator().DropColumn(&userV1{}, "Admin")
+	if err != nil || tx.Migrator().HasIndex(&userV4{}, "DeletionDueAt") {
+		return err
+	}
+	return tx.Migrator().CreateIndex(&userV4{}, "DeletionDueAt")
+}
+
+// dropUsersRoles restores the admin status of the users, granted to the owners and the admins
+func dropUsersRoles(tx *gorm.DB) error {
+	if !tx.Migrator().HasColumn(&userV1{}, "Admin") {
+		err := tx.Migrator().AddColumn(&userV1{}, "Admin")
+		if err != nil {
+			return err
+		}
+	}
+	err := tx.Model(&userV10{}).Where("role IN ?", []string{"owner", "admin"}).Update("admin", true).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Migrator().DropColumn(&userV10{}, "Role")
+	if err != nil || tx.Migrator().HasIndex(&userV4{}, "DeletionDueAt") {
+		return err
+	}
+	return tx.Migrator().CreateIndex(&userV4{}, "DeletionDueAt")
+}
+
+// ================ 11: add_users_lockout ================
+
+type userV11 struct {
+	ID           int        `gorm:"primaryKey;autoIncrement"`
+	FailedLogins int        `gorm:"type:INTEGER;not null;default:0"`
+	LockedUntil  *time.Time `gorm:"default:null"`
+}
+
+func (userV11) TableName() string { return "users" }
+
+// addUsersLockout adds the failed logins count of the users and the time their account is locked out until
+func addUsersLockout(tx *gorm.DB) error {
+	for _, field := range []string{"FailedLogins", "LockedUntil"} {
+		if tx.Migrator().HasColumn(&userV11{}, field) {
+			continue
+		}
+		err := tx.Migrator().AddColumn(&userV11{}, field)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropUsersLockout drops the failed logins count and the lockout of the users
+// SQLite drops a column by rebuilding the table, which loses the index of the scheduled deletions
+func dropUsersLockout(tx *gorm.DB) error {
+	for _, field := range []string{"LockedUntil", "FailedLogins"} {
+		err := tx.Migrator().DropColumn(&userV11{}, field)
+		if err != nil {
+			return err
+		}
+	}
+	if tx.Migrator().HasIndex(&userV4{}, "DeletionDueAt") {
+		return nil
+	}
+	return tx.Migrator().CreateIndex(&userV4{}, "DeletionDueAt")
+}
+
+// ================ 12: add_auth_tokens_selectors ================
+
+type authTokenV12 struct {
+	ID       int     `gorm:"primaryKey;autoIncrement"`
+	Selector *string `gorm:"type:TEXT;uniqueIndex;default:null"`
+	Type     string  `gorm:"type:TEXT;not null"`
+}
+
+func (authTokenV12) TableName() string { return "auth_tokens" }
+
+// linkTokenTypes are the types of the single-use tokens sent in the mail links and the two-factor challenges
+var linkTokenTypes = []string{"password_reset", "email_verification", "two_factor"}
+
+// addAuthTokensSelectors adds the selectors locating the tokens, whose hash is then checked against a verifier
+// The sessions opened before keep their tokens without selector until they are refreshed, the pending links and
+// two-factor challenges are deleted instead and have to be asked again
+func addAuthTokensSelectors(tx *gorm.DB) error {
+	if !tx.Migrator().HasColumn(&authTokenV12{}, "Selector") {
+		err := tx.Migrator().AddColumn(&authTokenV12{}, "Selector")
+		if err != nil {
+			return err
+		}
+	}
+	if !tx.Migrator().HasIndex(&authTokenV12{}, "Selector") {
+		err := tx.Migrator().CreateIndex(&authTokenV12{}, "Selector")
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Where("selector IS NULL AND type IN ?", linkTokenTypes).Delete(&authTokenV12{}).Error
+}
+
+// dropAuthTokensSelectors drops the selectors of the tokens, along with the tokens issued with one
+// The hash of their verifier can not be checked without it, so their sessions have to log in again
+func dropAuthTokensSelectors(tx *gorm.DB) error {
+	err := tx.Where("selector IS NOT NULL").Delete(&authTokenV12{}).Error
+	if err != nil {
+		return err
+	}
+	if tx.Migrator().HasIndex(&authTokenV12{}, "Selector") {
+		err = tx.Migrator().DropIndex(&authTokenV12{}, "Selector")
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Migrator().DropColumn(&authTokenV12{}, "Selector")
+}
+
+// ================ 13: add_auth_tokens_families ================
+
+type authTokenV13 struct {
+	ID        int        `gorm:"primaryKey;autoIncrement"`
+	FamilyID  *int       `gorm:"type:INTEGER;index;default:null"`
+	RotatedAt *time.Time `gorm:"default:null"`
+}
+
+func (authTokenV13) TableName() string { return "auth_tokens" }
+
+// addAuthTokensFamilies adds the family of the session tokens and the rotation of the replaced refresh tokens
+// The existing sessions start their family with their refresh token
+func addAuthTokensFamilies(tx *gorm.DB) error {
+	for _, field := range []string{"FamilyID", "RotatedAt"} {
+		if tx.Migrator().HasColumn(&authTokenV13{}, field) {
+			continue
+		}
+		err := tx.Migrator().AddColumn(&authTokenV13{}, field)
+		if err != nil {
+			return err
+		}
+	}
+	if !tx.Migrator().HasIndex(&authTokenV13{}, "FamilyID") {
+		err := tx.Migrator().CreateIndex(&authTokenV13{}, "FamilyID")
+		if err != nil {
+			return err
+		}
+	}
+
+	err := tx.Exec("UPDATE auth_tokens SET family_id = id WHERE type = ? AND family_id IS NULL", "refresh").Error
+	if err != nil {
+		return err
+	}
+	return tx.Exec("UPDATE auth_tokens SET family_id = linked_token_id WHERE type = ? AND family_id IS NULL "+
+		"AND linked_token_id IN (SELECT id FROM auth_tokens WHERE type = ?)", "access", "refresh").Error
+}
+
+// dropAuthTokensFamilies drops the families of the tokens, along with the rotated refresh tokens which would be usable again
+// SQLite drops a column by rebuilding the table, which loses the index of the selectors
+func dropAuthTokensFamilies(tx *gorm.DB) error {
+	err := tx.Where("rotated_at IS NOT NULL").Delete(&authTokenV13{}).Error
+	if err != nil {
+		return err
+	}
+	if tx.Migrator().HasIndex(&authTokenV13{}, "FamilyID") {
+		err = tx.Migrator().DropIndex(&authTokenV13{}, "FamilyID")
+		if err != nil {
+			return err
+		}
+	}
+	for _, field := range []string{"RotatedAt", "FamilyID"} {
+		err = tx.Migrator().DropColumn(&authTokenV13{}, field)
+		if err != nil {
+			return err
+		}
+	}
+	if tx.Migrator().HasIndex(&authTokenV12{}, "Selector") {
+		return nil
+	}
+	return tx.Migrator().CreateIndex(&authTokenV12{}, "Selector")
+}
+
+// ================ 14: add_api_tokens_selectors ================
+
+type apiTokenV14 struct {
+	ID       int     `gorm:"primaryKey;autoIncrement"`
+	Selector *string `gorm:"type:TEXT;uniqueIndex;default:null"`
+}
+
+func (apiTokenV14) TableName() string { return "api_tokens" }
+
+// addAPITokensSelectors adds the selectors locating the API tokens, whose hash is then checked against a verifier
+// The raw values of the existing tokens are unknown, so they keep their bcrypt hash without selector until their first use,
+// which gives them their ID as selector and the hash of their verifier
+func addAPITokensSelectors(tx *gorm.DB) error {
+	if !tx.Migrator().HasColumn(&apiTokenV14{}, "Selector") {
+		err := tx.Migrator().AddColumn(&apiTokenV14{}, "Selector")
+		if err != nil {
+			return err
+		}
+	}
+	if tx.Migrator().HasIndex(&apiTokenV14{}, "Selector") {
+		return nil
+	}
+	return tx.Migrator().CreateIndex(&apiTokenV14{}, "Selector")
+}
+
+// dropAPITokensSelectors drops the selectors of the API tokens, along with the tokens that have one
+// The hash of their verifier can not be checked without it, so their owners have to create them again
+// SQLite drops a column by rebuilding the table, which loses the index of the users
+func dropAPITokensSelectors(tx *gorm.DB) error {
+	err := tx.Where("selector IS NOT NULL").Delete(&apiTokenV14{}).Error
+	if err != nil {
+		return err
+	}
+	if tx.Migrator().HasIndex(&apiTokenV14{}, "Selector") {
+		err = tx.Migrator().DropIndex(&apiTokenV14{}, "Selector")
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Migrator().DropColumn(&apiTokenV14{}, "Selector")
+	if err != nil || tx.Migrator().HasIndex(&apiTokenV9{}, "UserID") {
+		return err
+	}
+	return tx.Migrator().CreateIndex(&apiTokenV9{}, "UserID")
+}
@@ -0,0 +1,376 @@
+package db_model
+
+import (
+	"html"
+	"strings"
+	"unicode"
+
+	"github.com/boxboxjason/jukebox/pkg/logger"
+	"gorm.io/gorm"
+)
+
+const (
+	// Name of the FTS5 index of the messages content
+	MESSAGES_SEARCH_TABLE = "messages_fts"
+	// Version of the migration creating the FTS5 index of the messages content
+	MESSAGES_SEARCH_MIGRATION = 2
+	// Markers delimiting the matches in the raw snippets, they cannot appear in HTML text
+	snippetMatchStart = "\x02"
+	snippetMatchEnd   = "\x03"
+	// Number of tokens around the matches kept in the snippets
+	snippetTokens = 16
+	// Number of characters around the first match kept in the snippets built without the index
+	snippetRadius = 60
+	// Ellipsis marking the text cut from the snippets
+	snippetEllipsis = "…"
+)
+
+// MessageSearchResult is a message matching a search query
+type MessageSearchResult struct {
+	Message *Message `json:"message"`
+	// Relevance of the message, the higher the better (0 when the search index is not available)
+	Rank float64 `json:"rank"`
+	// Escaped HTML excerpt of the content, matches are wrapped in <mark></mark>
+	Snippet string `json:"snippet"`
+}
+
+// MessagesSearchRequestParams is the struct for the request parameters of the search messages endpoint
+type MessagesSearchRequestParams struct {
+	Query    string `json:"q"`
+	Limit    int    `json:"limit"`
+	Page     int    `json:"page"`
+	Offset   int    `json:"offset"`
+	SenderID []int  `json:"sender_id"`
+	Flagged  []bool `json:"flagged"`
+	Removed  []bool `json:"removed"`
+}
+
+// searchTerm is a single term of a search query, a message must match every term
+type searchTerm struct {
+	Text   string
+	Phrase bool
+	Prefix bool
+}
+
+// ================ Query parsing ================
+
+// parseSearchQuery splits a search query into terms
+// "quoted words" are matched as a phrase and a trailing * turns a word into a prefix query
+func parseSearchQuery(query string) []searchTerm {
+	terms := []searchTerm{}
+	add_term := func(text string, phrase bool) {
+		prefix := !phrase && strings.HasSuffix(text, "*")
+		text = strings.Join(strings.Fields(strings.TrimRight(text, "*")), " ")
+		// Terms without any letter or digit cannot match a token
+		if strings.IndexFunc(text, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) >= 0 {
+			terms = append(terms, searchTerm{Text: text, Phrase: phrase || strings.Contains(text, " "), Prefix: prefix})
+		}
+	}
+
+	for len(query) > 0 {
+		query = strings.TrimLeftFunc(query, unicode.IsSpace)
+		if query == "" {
+			break
+		}
+
+		if query[0] == '"' {
+			end := strings.IndexByte(query[1:], '"')
+			if end < 0 {
+				// Unterminated phrase, it runs to the end of the query
+				add_term(query[1:], true)
+				break
+			}
+			add_term(query[1:end+1], true)
+			query = query[end+2:]
+			continue
+		}
+
+		end := strings.IndexFunc(query, func(r rune) bool { return unicode.IsSpace(r) || r == '"' })
+		if end < 0 {
+			end = len(query)
+		}
+		add_term(query[:end], false)
+		query = query[end:]
+	}
+
+	return terms
+}
+
+// ftsMatchExpression builds the FTS5 MATCH expression of the terms
+// Every term is quoted, so no user input is ever interpreted as FTS5 syntax
+func ftsMatchExpression(terms []searchTerm) string {
+	expressions := make([]string, 0, len(terms))
+	for _, term := range terms {
+		expression := `"` + strings.ReplaceAll(term.Text, `"`, `""`) + `"`
+		if term.Prefix {
+			expression += "*"
+		}
+		expressions = append(expressions, expression)
+	}
+	return strings.Join(expressions, " AND ")
+}
+
+// ================ Index ================
+
+// fts5Available returns true if the SQLite library was built with FTS5 (go build -tags sqlite_fts5)
+func fts5Available(db *gorm.DB) bool {
+	if db.Dialector.Name() != SQLITE_DRIVER {
+		return false
+	}
+	var enabled bool
+	err := db.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&enabled).Error
+	return err == nil && enabled
+}
+
+// HasMessageSearchIndex returns true if the messages are indexed for full text search
+// Without the index, SearchMessages falls back to a LIKE scan of the messages
+func HasMessageSearchIndex(db *gorm.DB) bool {
+	return fts5Available(db) && db.Migrator().HasTable(MESSAGES_SEARCH_TABLE)
+}
+
+// messagesSearchTriggers keep the FTS5 index in sync with the messages
+var messagesSearchTriggers = map[string]string{
+	"messages_fts_insert": `CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts(rowid, content) VALUES (new.id, new.content);
+	END`,
+	"messages_fts_delete": `CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+	END`,
+	"messages_fts_update": `CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+		INSERT INTO messages_fts(rowid, content) VALUES (new.id, new.content);
+	END`,
+}
+
+// syncMessagesSearchIndex matches the FTS5 index of the messages to the running build, the same database may be used by builds with and without FTS5
+// With FTS5, the index and its triggers are created, and the index is rebuilt when the messages changed without the triggers
+// Without FTS5, the triggers would make every message insert fail, so they are dropped and the search falls back to LIKE
+func syncMessagesSearchIndex(db *gorm.DB) error {
+	if db.Dialector.Name() != SQLITE_DRIVER {
+		return nil
+	}
+	trigger_names := make([]string, 0, len(messagesSearchTriggers))
+	for name := range messagesSearchTriggers {
+		trigger_names = append(trigger_names, name)
+	}
+	var triggers int64
+	err := db.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name IN ?", trigger_names).Scan(&triggers).Error
+	if err != nil {
+		return err
+	}
+
+	if !fts5Available(db) {
+		if triggers == 0 {
+			return nil
+		}
+		logger.Info("FTS5 is not available, the messages search will scan the messages table until a build with FTS5 runs")
+		return dropMessagesSearchTriggers(db)
+	}
+	if int(triggers) == len(messagesSearchTriggers) && db.Migrator().HasTable(MESSAGES_SEARCH_TABLE) {
+		return nil
+	}
+
+	logger.Info("Building the messages search index")
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS ` + MESSAGES_SEARCH_TABLE + ` USING fts5(
+			content, content='messages', content_rowid='id', tokenize='unicode61 remove_diacritics 2')`).Error
+		if err != nil {
+			return err
+		}
+		for _, statement := range messagesSearchTriggers {
+			err = tx.Exec(statement).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Exec(`INSERT INTO ` + MESSAGES_SEARCH_TABLE + `(` + MESSAGES_SEARCH_TABLE + `) VALUES ('rebuild')`).Error
+	})
+}
+
+// dropMessagesSearchTriggers drops the triggers keeping the FTS5 index in sync with the messages
+func dropMessagesSearchTriggers(db *gorm.DB) error {
+	for name := range messagesSearchTriggers {
+		err := db.Exec(`DROP TRIGGER IF EXISTS ` + name).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ================ Search ================
+
+// SearchMessages retrieves the messages matching every term of the query, most relevant first
+func SearchMessages(db *gorm.DB, query_params *MessagesSearchRequestParams) ([]*MessageSearchResult, error) {
+	terms := parseSearchQuery(query_params.Query)
+	if len(terms) == 0 {
+		return []*MessageSearchResult{}, nil
+	}
+
+	if HasMessageSearchIndex(db) {
+		return searchMessagesIndex(db, terms, query_params)
+	}
+	return searchMessagesContent(db, terms, query_params)
+}
+
+// addSearchFilters adds the sender / flagged / removed filters to a search query
+func addSearchFilters(query *gorm.DB, query_params *MessagesSearchRequestParams) *gorm.DB {
+	if len(query_params.SenderID) > 0 {
+		query = query.Where("messages.sender_id IN ?", query_params.SenderID)
+	}
+	if len(query_params.Flagged) > 0 {
+		query = query.Where("messages.flagged = ?", query_params.Flagged[0])
+	}
+	if len(query_params.Removed) > 0 {
+		query = query.Where("messages.removed = ?", query_params.Removed[0])
+	}
+	return AddQueryParamsToDB(query, "", query_params.Limit, query_params.Page, query_params.Offset)
+}
+
+// searchMessagesIndex searches the messages with the FTS5 index, ranked with bm25
+func searchMessagesIndex(db *gorm.DB, terms []searchTerm, query_params *MessagesSearchRequestParams) ([]*MessageSearchResult, error) {
+	type indexMatch struct {
+		ID      int
+		Score   float64
+		Snippet string
+	}
+
+	// bm25 scores are negative, the best matches have the lowest score
+	matches := []*indexMatch{}
+	query := db.Table(MESSAGES_SEARCH_TABLE).
+		Select("messages.id AS id, bm25("+MESSAGES_SEARCH_TABLE+") AS score, snippet("+MESSAGES_SEARCH_TABLE+", 0, ?, ?, ?, ?) AS snippet",
+			snippetMatchStart, snippetMatchEnd, snippetEllipsis, snippetTokens).
+		Joins("JOIN messages ON messages.id = "+MESSAGES_SEARCH_TABLE+".rowid").
+		Where(MESSAGES_SEARCH_TABLE+" MATCH ?", ftsMatchExpression(terms)).
+		Order("score, messages.id DESC")
+	err := addSearchFilters(query, query_params).Scan(&matches).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// Load the matching messages, then put them back in the order of relevance
+	ids := make([]int, len(matches))
+	for i, match := range matches {
+		ids[i] = match.ID
+	}
+	messages, err := getMessagesByIDs(db, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*MessageSearchResult, 0, len(matches))
+	for _, match := range matches {
+		if message, ok := messages[match.ID]; ok {
+			results = append(results, &MessageSearchResult{
+				Message: message,
+				Rank:    -match.Score,
+				Snippet: highlightSnippet(match.Snippet),
+			})
+		}
+	}
+	return results, nil
+}
+
+// searchMessagesContent searches the messages with a LIKE scan, most recent first
+// It is used when the FTS5 index is not available (PostgreSQL, or SQLite built without FTS5)
+func searchMessagesContent(db *gorm.DB, terms []searchTerm, query_params *MessagesSearchRequestParams) ([]*MessageSearchResult, error) {
+	query := db.Preload("Sender").Model(&Message{}).Order("messages.created_at DESC, messages.id DESC")
+	for _, term := range terms {
+		query = query.Where(containsCondition("messages.content"), containsPattern(term.Text))
+	}
+
+	messages := []*Message{}
+	err := addSearchFilters(query, query_params).Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*MessageSearchResult, 0, len(messages))
+	for _, message := range messages {
+		results = append(results, &MessageSearchResult{
+			Message: message,
+			Snippet: highlightSnippet(buildSnippet(message.Content, terms)),
+		})
+	}
+	return results, nil
+}
+
+// getMessagesByIDs retrieves the messages with the given IDs, indexed by ID
+func getMessagesByIDs(db *gorm.DB, ids []int) (map[int]*Message, error) {
+	messages := []*Message{}
+	if len(ids) > 0 {
+		err := db.Preload("Sender").Where("id IN ?", ids).Find(&messages).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	indexed := make(map[int]*Message, len(messages))
+	for _, message := range messages {
+		indexed[message.ID] = message
+	}
+	return indexed, nil
+}
+
+// ================ Snippets ================
+
+// highlightSnippet escapes a raw snippet and turns its match markers into <mark> tags
+func highlightSnippet(raw string) string {
+	escaped := html.EscapeString(raw)
+	return strings.NewReplacer(snippetMatchStart, "<mark>", snippetMatchEnd, "</mark>").Replace(escaped)
+}
+
+// buildSnippet builds a raw snippet around the first match of the terms in the content, with the matches marked
+func buildSnippet(content string, terms []searchTerm) string {
+	runes := []rune(content)
+	// Lowercase rune by rune so that the indexes of both slices match
+	lower_runes := make([]rune, len(runes))
+	for i, r := range runes {
+		lower_runes[i] = unicode.ToLower(r)
+	}
+
+	// Mark every occurrence of every term
+	marked := make([]bool, len(runes))
+	first_match := -1
+	for _, term := range terms {
+		needle := []rune(strings.ToLower(term.Text))
+		for i := 0; i+len(needle) <= len(lower_runes); i++ {
+			if string(lower_runes[i:i+len(needle)]) != string(needle) {
+				continue
+			}
+			for j := i; j < i+len(needle); j++ {
+				marked[j] = true
+			}
+			if first_match < 0 || i < first_match {
+				first_match = i
+			}
+		}
+	}
+
+	// Keep a window around the first match
+	start, end := 0, len(runes)
+	if first_match > snippetRadius {
+		start = first_match - snippetRadius
+	}
+	if end-start > 3*snippetRadius {
+		end = start + 3*snippetRadius
+	}
+
+	var builder strings.Builder
+	if start > 0 {
+		builder.WriteString(snippetEllipsis)
+	}
+	for i := start; i < end; i++ {
+		if marked[i] && (i == start || !marked[i-1]) {
+			builder.WriteString(snippetMatchStart)
+		}
+		builder.WriteRune(runes[i])
+		if marked[i] && (i == end-1 || !marked[i+1]) {
+			builder.WriteString(snippetMatchEnd)
+		}
+	}
+	if end < len(runes) {
+		builder.WriteString(snippetEllipsis)
+	}
+	return builder.String()
+}
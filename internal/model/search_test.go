@@ -0,0 +1,220 @@
+package db_model
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected []searchTerm
+	}{
+		{"jazz", []searchTerm{{Text: "jazz"}}},
+		{"  jazz  piano ", []searchTerm{{Text: "jazz"}, {Text: "piano"}}},
+		{`"smooth jazz" pia*`, []searchTerm{{Text: "smooth jazz", Phrase: true}, {Text: "pia", Prefix: true}}},
+		{`"unterminated phrase`, []searchTerm{{Text: "unterminated phrase", Phrase: true}}},
+		{`say"hello"`, []searchTerm{{Text: "say"}, {Text: "hello", Phrase: true}}},
+		{`*** "" !!`, []searchTerm{}},
+	}
+
+	for _, test := range tests {
+		terms := parseSearchQuery(test.query)
+		if !reflect.DeepEqual(terms, test.expected) {
+			t.Errorf("Expected %+v for %q, got %+v", test.expected, test.query, terms)
+		}
+	}
+}
+
+func TestFtsMatchExpression(t *testing.T) {
+	expression := ftsMatchExpression([]searchTerm{{Text: `say "hi"`, Phrase: true}, {Text: "pia", Prefix: true}, {Text: "OR"}})
+	expected := `"say ""hi""" AND "pia"* AND "OR"`
+	if expression != expected {
+		t.Errorf("Expected %s, got %s", expected, expression)
+	}
+}
+
+func TestBuildSnippet(t *testing.T) {
+	snippet := highlightSnippet(buildSnippet("I <3 Smooth Jazz and jazz piano", []searchTerm{{Text: "jazz"}}))
+	expected := "I &lt;3 Smooth <mark>Jazz</mark> and <mark>jazz</mark> piano"
+	if snippet != expected {
+		t.Errorf("Expected %s, got %s", expected, snippet)
+	}
+
+	long_content := strings.Repeat("lorem ", 50) + "needle" + strings.Repeat(" ipsum", 50)
+	snippet = buildSnippet(long_content, []searchTerm{{Text: "needle"}})
+	if !strings.HasPrefix(snippet, snippetEllipsis) || !strings.HasSuffix(snippet, snippetEllipsis) {
+		t.Errorf("Expected the long snippet to be cut on both sides, got %s", snippet)
+	}
+	if !strings.Contains(snippet, snippetMatchStart+"needle"+snippetMatchEnd) {
+		t.Errorf("Expected the match to be marked, got %s", snippet)
+	}
+}
+
+// createSearchTestMessages creates the messages used by the search tests
+func createSearchTestMessages(t *testing.T, username string) (*User, []*Message) {
+	user := &User{
+		Email:           username + "@gmail.com",
+		Hashed_Password: "hashed_password",
+		Username:        username,
+	}
+	err := user.CreateUser(test_db)
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	messages := []*Message{
+		{Content: "zanzibar quokka zanzibar quokka", Sender: user},
+		{Content: "a quokka visited zanzibar once", Sender: user},
+		{Content: "zanzibarian marmalade", Sender: user, Flagged: true},
+		{Content: "nothing to see here", Sender: user},
+	}
+	err = CreateMessages(test_db, messages)
+	if err != nil {
+		t.Fatalf("Error creating messages: %v", err)
+	}
+	return user, messages
+}
+
+// searchResultIDs returns the IDs of the messages of the search results
+func searchResultIDs(results []*MessageSearchResult) []int {
+	ids := []int{}
+	for _, result := range results {
+		ids = append(ids, result.Message.ID)
+	}
+	return ids
+}
+
+func TestSearchMessages(t *testing.T) {
+	user, messages := createSearchTestMessages(t, "test_user_300")
+
+	// Every term must match, the filters narrow the results
+	results, err := SearchMessages(test_db, &MessagesSearchRequestParams{Query: "zanzibar quokka", SenderID: []int{user.ID}})
+	if err != nil {
+		t.Fatalf("Error searching messages: %v", err)
+	}
+	ids := searchResultIDs(results)
+	if len(ids) != 2 {
+		t.Errorf("Expected 2 results, got %v", ids)
+	}
+	if HasMessageSearchIndex(test_db) && (ids[0] != messages[0].ID || results[0].Rank <= results[1].Rank) {
+		t.Errorf("Expected the message with the most occurrences to rank first, got %v", ids)
+	}
+	for _, result := range results {
+		if !strings.Contains(result.Snippet, "<mark>zanzibar</mark>") || result.Message.Sender == nil {
+			t.Errorf("Expected a highlighted snippet and a sender, got %+v", result)
+		}
+	}
+
+	// Phrase query
+	results, err = SearchMessages(test_db, &MessagesSearchRequestParams{Query: `"visited zanzibar"`, SenderID: []int{user.ID}})
+	if err != nil || !reflect.DeepEqual(searchResultIDs(results), []int{messages[1].ID}) {
+		t.Errorf("Expected the phrase to match message %d, got %v (%v)", messages[1].ID, searchResultIDs(results), err)
+	}
+
+	// Prefix query and flagged filter
+	results, err = SearchMessages(test_db, &MessagesSearchRequestParams{Query: "zanzibari*", SenderID: []int{user.ID}, Flagged: []bool{true}})
+	if err != nil || !reflect.DeepEqual(searchResultIDs(results), []int{messages[2].ID}) {
+		t.Errorf("Expected the prefix to match message %d, got %v (%v)", messages[2].ID, searchResultIDs(results), err)
+	}
+}
+
+func TestSearchMessagesIndexSync(t *testing.T) {
+	if !HasMessageSearchIndex(test_db) {
+		t.Skip("the search index requires SQLite built with FTS5 (-tags sqlite_fts5)")
+	}
+	user, messages := createSearchTestMessages(t, "test_user_301")
+	search := func(query string) []int {
+		results, err := SearchMessages(test_db, &MessagesSearchRequestParams{Query: query, SenderID: []int{user.ID}})
+		if err != nil {
+			t.Fatalf("Error searching messages: %v", err)
+		}
+		return searchResultIDs(results)
+	}
+
+	// Updated content is reindexed
+	messages[3].Content = "wombat sighting"
+	err := messages[3].UpdateMessage(test_db)
+	if err != nil {
+		t.Fatalf("Error updating message: %v", err)
+	}
+	if ids := search("wombat"); !reflect.DeepEqual(ids, []int{messages[3].ID}) {
+		t.Errorf("Expected the updated message to match, got %v", ids)
+	}
+	if ids := search("nothing"); len(ids) != 0 {
+		t.Errorf("Expected the previous content not to match anymore, got %v", ids)
+	}
+
+	// Deleted messages are removed from the index
+	err = messages[3].DeleteMessage(test_db)
+	if err != nil {
+		t.Fatalf("Error deleting message: %v", err)
+	}
+	if ids := search("wombat"); len(ids) != 0 {
+		t.Errorf("Expected the deleted message not to match, got %v", ids)
+	}
+}
+
+func TestSearchMessagesContentFallback(t *testing.T) {
+	user, messages := createSearchTestMessages(t, "test_user_302")
+
+	// The LIKE fallback matches the same messages, most recent first
+	results, err := searchMessagesContent(test_db, parseSearchQuery("zanzibar quokka"), &MessagesSearchRequestParams{SenderID: []int{user.ID}})
+	if err != nil {
+		t.Fatalf("Error searching messages: %v", err)
+	}
+	if ids := searchResultIDs(results); !reflect.DeepEqual(ids, []int{messages[1].ID, messages[0].ID}) {
+		t.Errorf("Expected messages %d and %d, got %v", messages[1].ID, messages[0].ID, ids)
+	}
+}
+
+func TestSyncMessagesSearchIndex(t *testing.T) {
+	db := openEmptyTestDatabase(t)
+	_, err := MigrateUp(db, 0)
+	if err != nil {
+		t.Fatalf("Error migrating up: %v", err)
+	}
+	user := &User{Email: "test_user_303@gmail.com", Hashed_Password: "hashed_password", Username: "test_user_303"}
+	err = user.CreateUser(db)
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	message := &Message{Content: "wombat sighting", Sender: user}
+
+	if fts5Available(db) {
+		// The database was used by a build without FTS5, the messages posted meanwhile were not indexed
+		err = dropMessagesSearchTriggers(db)
+		if err == nil {
+			err = CreateMessages(db, []*Message{message})
+		}
+	} else {
+		// The database was migrated by a build with FTS5, its triggers would make every insert fail
+		err = db.Exec(messagesSearchTriggers["messages_fts_insert"]).Error
+	}
+	if err != nil {
+		t.Fatalf("Error simulating another build: %v", err)
+	}
+
+	// Every migration run matches the index to the running build
+	_, err = MigrateUp(db, 0)
+	if err != nil {
+		t.Fatalf("Error migrating up: %v", err)
+	}
+	if HasMessageSearchIndex(db) != fts5Available(db) {
+		t.Errorf("Expected the search index to match the build")
+	}
+	if message.ID == 0 {
+		err = CreateMessages(db, []*Message{message})
+		if err != nil {
+			t.Fatalf("Error creating message: %v", err)
+		}
+	}
+	results, err := SearchMessages(db, &MessagesSearchRequestParams{Query: "wombat"})
+	if err != nil {
+		t.Fatalf("Error searching messages: %v", err)
+	}
+	if ids := searchResultIDs(results); !reflect.DeepEqual(ids, []int{message.ID}) {
+		t.Errorf("Expected message %d to match, got %v", message.ID, ids)
+	}
+}
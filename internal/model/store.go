@@ -0,0 +1,181 @@
+package db_model
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrRecordNotFound is returned by every store when the requested record does not exist
+var ErrRecordNotFound = gorm.ErrRecordNotFound
+
+// Store groups the data stores the controllers depend on
+// Use NewGormStore for the database backed stores and NewMemoryStore for the in-memory ones,
+// both implementations have the same semantics (checked by the conformance tests)
+type Store struct {
+	Users      UserStore
+	Messages   MessageStore
+	Bans       BanStore
+	Tokens     TokenStore
+	Audit      AuditStore
+	Identities IdentityStore
+	APITokens  APITokenStore
+}
+
+// UserStore persists the users
+type UserStore interface {
+	// Create creates the user, the username and the email must be unique
+	Create(user *User) error
+	// GetByID retrieves a user by ID
+	GetByID(id int) (*User, error)
+	// GetByUsername retrieves a user by exact username
+	GetByUsername(username string) (*User, error)
+	// GetByEmail retrieves a user by exact email
+	GetByEmail(email string) (*User, error)
+	// GetByUsernameOrEmail retrieves the user whose username or email is exactly username_or_email
+	GetByUsernameOrEmail(username_or_email string) (*User, error)
+	// List retrieves the users matching any of the ID / Username / Email / PartialUsername filters
+	// (every user if none is set) and all of the Role / SubscriberTier filters
+	List(query_params *UsersGetRequestParams) ([]*User, error)
+	// ListDeletionsDue retrieves the users whose requested deletion is due at the given time, the most overdue first
+	ListDeletionsDue(due_at time.Time) ([]*User, error)
+	// Update saves every field of the user
+	Update(user *User) error
+	// IncreaseContributionsCount increments the contributions count of the user, without saving its other fields
+	IncreaseContributionsCount(user *User) error
+	// RecordLoginFailure counts a failed login of the user at once, and locks it out until now + lockout once the count
+	// reaches the threshold (never if 0), the lockout runs at least until the last failure
+	// The count starts over once the user stayed unlocked for the lockout duration
+	// The failed logins count and the lockout of the user are updated with the stored ones
+	RecordLoginFailure(user *User, threshold int, lockout time.Duration, now time.Time) error
+	// DelayLogins locks the user out until the given time, unless it is already locked out for longer
+	DelayLogins(user *User, until time.Time) error
+	// ResetLoginFailures forgets the failed logins and the lockout of the user, without saving its other fields
+	ResetLoginFailures(user *User) error
+	// Delete deletes the user, deleting a missing user is not an error
+	Delete(user *User) error
+	// DeleteMany deletes the users
+	DeleteMany(users []*User) error
+}
+
+// MessageStore persists the chat messages, the retrieved messages always come with their sender
+type MessageStore interface {
+	// Create creates the message, the sender is taken from Sender if it is set
+	Create(message *Message) error
+	// GetByID retrieves a message by ID
+	GetByID(id int) (*Message, error)
+	// List retrieves the messages matching any of the ID / Contains filters (every message if none is set)
+	// and all of the SenderID / Flagged / Censored / Removed filters
+	List(query_params *MessagesGetRequestParams) ([]*Message, error)
+	// Search retrieves the messages containing every term of the query and matching all of the filters, most relevant first
+	Search(query_params *MessagesSearchRequestParams) ([]*MessageSearchResult, error)
+	// Update saves every field of the message
+	Update(message *Message) error
+	// ReassignSender gives every message of a user to another user
+	ReassignSender(from_user_id int, to_user_id int) error
+	// Delete deletes the message, deleting a missing message is not an error
+	Delete(message *Message) error
+	// DeleteMany deletes the messages
+	DeleteMany(messages []*Message) error
+}
+
+// BanStore persists the bans and the mutes
+type BanStore interface {
+	// CreateMany creates the bans
+	CreateMany(bans []*Ban) error
+	// GetByID retrieves a ban by ID
+	GetByID(id int) (*Ban, error)
+	// List retrieves the bans ending after EndsAfter and matching all of the other filters
+	List(query_params *BansGetRequestParams) ([]*Ban, error)
+	// ListActiveBans retrieves the bans (not the mutes) currently targeting a user, the latest ending first
+	ListActiveBans(target_id int) ([]*Ban, error)
+	// Update saves every field of the ban
+	Update(ban *Ban) error
+	// ReassignUser gives every ban issued or received by a user to another user
+	ReassignUser(from_user_id int, to_user_id int) error
+	// Delete deletes the ban, deleting a missing ban is not an error
+	Delete(ban *Ban) error
+	// DeleteMany deletes the bans
+	DeleteMany(bans []*Ban) error
+}
+
+// TokenStore persists the authentication tokens, the retrieved tokens always come with their user
+type TokenStore interface {
+	// Create creates the token, the user and the linked token are taken from User and LinkedToken if they are set
+	Create(token *AuthToken) error
+	// GetByID retrieves a token by ID
+	GetByID(id int) (*AuthToken, error)
+	// GetLinkedToken retrieves the token linked to the given token
+	GetLinkedToken(token *AuthToken) (*AuthToken, error)
+	// ListUserTokens retrieves every token of the user, oldest first
+	ListUserTokens(user_id int) ([]*AuthToken, error)
+	// ListFamilyTokens retrieves every token of the session family, rotated or not, oldest first
+	ListFamilyTokens(family_id int) ([]*AuthToken, error)
+	// MatchToken retrieves the token with the given selector and type, whose hash matches the verifier
+	MatchToken(selector string, verifier string, token_type string) (*AuthToken, error)
+	// MatchLegacyUserToken retrieves the unexpired token of the user with the given type, issued before the selectors,
+	// whose hash matches the raw token. Only the newest LEGACY_TOKENS_SCAN_LIMIT of them are checked. The matched token is
+	// upgraded with the LegacyTokenSelector and the hash of the raw token, MatchToken checks it from then on
+	MatchLegacyUserToken(user_id int, raw_token string, token_type string) (*AuthToken, error)
+	// Update saves every field of the token
+	Update(token *AuthToken) error
+	// Rotate records the replacement of the refresh token by a newer one of its family and unlinks it from the session,
+	// without saving its other fields. Returns false if the token was already rotated, by a concurrent call or before
+	Rotate(token *AuthToken, family_id int, rotated_at time.Time) (bool, error)
+	// Touch records the last use of the token and the client that used it, without saving its other fields
+	Touch(token *AuthToken, used_at time.Time, ip string, user_agent string) error
+	// Delete deletes the token, deleting a missing token is not an error
+	Delete(token *AuthToken) error
+	// DeleteUserTokens deletes every token of the user
+	DeleteUserTokens(user_id int) error
+	// DeleteExpired deletes every expired token
+	DeleteExpired() error
+}
+
+// IdentityStore persists the links between the users and their subjects at the OpenID Connect providers,
+// the retrieved identities always come with their user
+type IdentityStore interface {
+	// Create creates the identity, the subject must be unique at the provider
+	Create(identity *UserIdentity) error
+	// GetBySubject retrieves the identity of a subject at a provider
+	GetBySubject(provider string, subject string) (*UserIdentity, error)
+	// ListUserIdentities retrieves every identity of the user, oldest first
+	ListUserIdentities(user_id int) ([]*UserIdentity, error)
+	// Update saves every field of the identity
+	Update(identity *UserIdentity) error
+	// Delete deletes the identity, deleting a missing identity is not an error
+	Delete(identity *UserIdentity) error
+	// DeleteUserIdentities deletes every identity of the user
+	DeleteUserIdentities(user_id int) error
+}
+
+// APITokenStore persists the API tokens of the users, the retrieved tokens always come with their user
+type APITokenStore interface {
+	// Create creates the API token
+	Create(api_token *APIToken) error
+	// GetByID retrieves an API token by ID
+	GetByID(id int) (*APIToken, error)
+	// MatchToken retrieves the API token with the given selector, whose hash matches the verifier
+	MatchToken(selector string, verifier string) (*APIToken, error)
+	// MatchLegacyToken retrieves the API token with the given ID, created before the selectors, whose bcrypt hash matches
+	// the verifier. The matched token is given its ID as selector and the hash of the verifier, MatchToken checks it from then on
+	MatchLegacyToken(id int, verifier string) (*APIToken, error)
+	// ListUserAPITokens retrieves every API token of the user, oldest first
+	ListUserAPITokens(user_id int) ([]*APIToken, error)
+	// Touch records the last use of the API token, without saving its other fields
+	Touch(api_token *APIToken, used_at time.Time) error
+	// Delete deletes the API token, deleting a missing token is not an error
+	Delete(api_token *APIToken) error
+	// DeleteUserAPITokens deletes every API token of the user
+	DeleteUserAPITokens(user_id int) error
+}
+
+// AuditStore persists the audit events, they can not be updated nor deleted
+type AuditStore interface {
+	// Create creates the audit event
+	Create(event *AuditEvent) error
+	// CreateMany creates the audit events
+	CreateMany(events []*AuditEvent) error
+	// List retrieves the audit events matching all of the filters
+	List(query_params *AuditGetRequestParams) ([]*AuditEvent, error)
+}
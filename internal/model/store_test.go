@@ -0,0 +1,1057 @@
+package db_model
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	"github.com/boxboxjason/jukebox/pkg/utils/cryptutils"
+)
+
+// The conformance tests run the same scenarios against every store implementation
+
+func TestGormStore(t *testing.T) {
+	runStoreConformanceTests(t, func(t *testing.T) *Store {
+		db := openEmptyTestDatabase(t)
+		_, err := MigrateUp(db, 0)
+		if err != nil {
+			t.Fatalf("Error migrating the test database: %v", err)
+		}
+		return NewGormStore(db)
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	runStoreConformanceTests(t, func(t *testing.T) *Store {
+		return NewMemoryStore()
+	})
+}
+
+// runStoreConformanceTests runs the conformance scenarios, every scenario gets a fresh store
+func runStoreConformanceTests(t *testing.T, new_store func(t *testing.T) *Store) {
+	t.Run("Users", func(t *testing.T) { testStoreUsers(t, new_store(t)) })
+	t.Run("UsersList", func(t *testing.T) { testStoreUsersList(t, new_store(t)) })
+	t.Run("LoginFailures", func(t *testing.T) { testStoreLoginFailures(t, new_store(t)) })
+	t.Run("Messages", func(t *testing.T) { testStoreMessages(t, new_store(t)) })
+	t.Run("MessagesSearch", func(t *testing.T) { testStoreMessagesSearch(t, new_store(t)) })
+	t.Run("Bans", func(t *testing.T) { testStoreBans(t, new_store(t)) })
+	t.Run("Tokens", func(t *testing.T) { testStoreTokens(t, new_store(t)) })
+	t.Run("UsersDeletion", func(t *testing.T) { testStoreUsersDeletion(t, new_store(t)) })
+	t.Run("Audit", func(t *testing.T) { testStoreAudit(t, new_store(t)) })
+	t.Run("Identities", func(t *testing.T) { testStoreIdentities(t, new_store(t)) })
+	t.Run("APITokens", func(t *testing.T) { testStoreAPITokens(t, new_store(t)) })
+}
+
+// createStoreUsers creates users named after the given usernames
+func createStoreUsers(t *testing.T, store *Store, usernames ...string) []*User {
+	users := []*User{}
+	for _, username := range usernames {
+		user := &User{Username: username, Email: username + "@test.com", Hashed_Password: "hashed_password"}
+		err := store.Users.Create(user)
+		if err != nil {
+			t.Fatalf("Error creating user %s: %v", username, err)
+		}
+		users = append(users, user)
+	}
+	return users
+}
+
+// recordIDs returns the IDs of the records, in order
+func recordIDs[T any](records []*T, id func(record *T) int) []int {
+	ids := []int{}
+	for _, record := range records {
+		ids = append(ids, id(record))
+	}
+	return ids
+}
+
+// equalIDs returns true if both lists hold the same IDs in the same order
+func equalIDs(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func userID(user *User) int          { return user.ID }
+func messageID(message *Message) int { return message.ID }
+func banID(ban *Ban) int             { return ban.ID }
+
+func testStoreUsers(t *testing.T, store *Store) {
+	users := createStoreUsers(t, store, "alice", "bob")
+	alice := users[0]
+	if alice.ID == 0 || alice.Avatar != "default_avatar.png" || alice.Role != constants.ROLE_USER || alice.CreatedAt.IsZero() {
+		t.Errorf("Error creating user: ID, avatar and creation date not set: %+v", alice)
+	}
+
+	// Unique username and email
+	err := store.Users.Create(&User{Username: "alice", Email: "other@test.com", Hashed_Password: "hashed_password"})
+	if err == nil {
+		t.Errorf("Error creating user: duplicate username accepted")
+	}
+	err = store.Users.Create(&User{Username: "other", Email: "alice@test.com", Hashed_Password: "hashed_password"})
+	if err == nil {
+		t.Errorf("Error creating user: duplicate email accepted")
+	}
+
+	// Lookups
+	user, err := store.Users.GetByID(alice.ID)
+	if err != nil || user.Username != "alice" {
+		t.Errorf("Error retrieving user by ID: %v", err)
+	}
+	user, err = store.Users.GetByUsername("bob")
+	if err != nil || user.ID != users[1].ID {
+		t.Errorf("Error retrieving user by username: %v", err)
+	}
+	user, err = store.Users.GetByEmail("bob@test.com")
+	if err != nil || user.ID != users[1].ID {
+		t.Errorf("Error retrieving user by email: %v", err)
+	}
+	user, err = store.Users.GetByUsernameOrEmail("alice@test.com")
+	if err != nil || user.ID != alice.ID {
+		t.Errorf("Error retrieving user by username or email: %v", err)
+	}
+	_, err = store.Users.GetByUsername("nobody")
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Error retrieving missing user: expected ErrRecordNotFound, got %v", err)
+	}
+
+	// Update and contributions
+	alice.Role = constants.ROLE_ADMIN
+	err = store.Users.Update(alice)
+	if err != nil {
+		t.Errorf("Error updating user: %v", err)
+	}
+	err = store.Users.IncreaseContributionsCount(alice)
+	if err != nil {
+		t.Errorf("Error increasing contributions count: %v", err)
+	}
+	user, _ = store.Users.GetByID(alice.ID)
+	if user == nil || user.Role != constants.ROLE_ADMIN || user.TotalContributions != 1 {
+		t.Errorf("Error updating user: changes not saved: %+v", user)
+	}
+	users[1].Username = "alice"
+	err = store.Users.Update(users[1])
+	if err == nil {
+		t.Errorf("Error updating user: duplicate username accepted")
+	}
+
+	// Returned users are copies
+	user.Username = "changed"
+	user, _ = store.Users.GetByID(alice.ID)
+	if user == nil || user.Username != "alice" {
+		t.Errorf("Error retrieving user: the stored user was modified through a returned copy")
+	}
+
+	// Deletion
+	err = store.Users.Delete(alice)
+	if err != nil {
+		t.Errorf("Error deleting user: %v", err)
+	}
+	_, err = store.Users.GetByID(alice.ID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Error deleting user: user still exists (%v)", err)
+	}
+	err = store.Users.Delete(alice)
+	if err != nil {
+		t.Errorf("Error deleting missing user: %v", err)
+	}
+	err = store.Users.DeleteMany([]*User{})
+	if err != nil {
+		t.Errorf("Error deleting no users: %v", err)
+	}
+}
+
+func testStoreUsersList(t *testing.T, store *Store) {
+	users := createStoreUsers(t, store, "carol", "dave", "caroline", "erin")
+	users[1].Role = constants.ROLE_MODERATOR
+	users[1].Subscriber_Tier = 2
+	users[3].Subscriber_Tier = 1
+	for _, user := range []*User{users[1], users[3]} {
+		err := store.Users.Update(user)
+		if err != nil {
+			t.Fatalf("Error updating user: %v", err)
+		}
+	}
+
+	test_cases := []struct {
+		name     string
+		params   *UsersGetRequestParams
+		expected []int
+	}{
+		{"all", &UsersGetRequestParams{}, []int{users[0].ID, users[1].ID, users[2].ID, users[3].ID}},
+		{"partial username", &UsersGetRequestParams{PartialUsername: []string{"CAROL"}}, []int{users[0].ID, users[2].ID}},
+		{"username or ID", &UsersGetRequestParams{Username: []string{"erin"}, ID: []int{users[1].ID}}, []int{users[1].ID, users[3].ID}},
+		{"role", &UsersGetRequestParams{Role: []string{constants.ROLE_MODERATOR, constants.ROLE_ADMIN}}, []int{users[1].ID}},
+		{"tier", &UsersGetRequestParams{SubscriberTier: 1}, []int{users[1].ID, users[3].ID}},
+		{"OR group and AND filter", &UsersGetRequestParams{Email: []string{"dave@test.com", "carol@test.com"}, Role: []string{constants.ROLE_USER}}, []int{users[0].ID}},
+		{"order", &UsersGetRequestParams{Order: "username desc"}, []int{users[3].ID, users[1].ID, users[2].ID, users[0].ID}},
+		{"limit and page", &UsersGetRequestParams{Order: "username", Limit: 2, Page: 2}, []int{users[1].ID, users[3].ID}},
+		{"offset", &UsersGetRequestParams{Offset: 3}, []int{users[3].ID}},
+	}
+	for _, test_case := range test_cases {
+		listed, err := store.Users.List(test_case.params)
+		if err != nil {
+			t.Errorf("Error listing users (%s): %v", test_case.name, err)
+			continue
+		}
+		ids := recordIDs(listed, userID)
+		if test_case.params.Order == "" {
+			sort.Ints(ids)
+		}
+		if !equalIDs(ids, test_case.expected) {
+			t.Errorf("Error listing users (%s): expected %v, got %v", test_case.name, test_case.expected, ids)
+		}
+	}
+}
+
+func testStoreLoginFailures(t *testing.T, store *Store) {
+	user := createStoreUsers(t, store, "mallory")[0]
+	now := time.Now().UTC().Truncate(time.Second)
+
+	// The concurrent failures are all counted, each from its own copy of the user, the threshold locks the user out
+	var wait_group sync.WaitGroup
+	errs := make(chan error, 20)
+	for range 20 {
+		wait_group.Add(1)
+		go func(user User) {
+			defer wait_group.Done()
+			errs <- store.Users.RecordLoginFailure(&user, 10, time.Hour, now)
+		}(*user)
+	}
+	wait_group.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Error recording login failure: %v", err)
+		}
+	}
+	stored_user, _ := store.Users.GetByID(user.ID)
+	if stored_user == nil || stored_user.FailedLogins != 20 || stored_user.LockedUntil == nil || !stored_user.LockedUntil.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Error recording login failures: expected 20 failures locked out until %v, got %+v", now.Add(time.Hour), stored_user)
+	}
+
+	// A delay does not shorten the lockout, and the stored state is read back
+	err := store.Users.DelayLogins(user, now.Add(time.Minute))
+	if err != nil || user.FailedLogins != 20 || user.LockedUntil == nil || !user.LockedUntil.Equal(now.Add(time.Hour)) {
+		t.Errorf("Error delaying logins: got %d failures until %v (%v)", user.FailedLogins, user.LockedUntil, err)
+	}
+
+	// The count starts over once the user stayed unlocked for the lockout duration, the lockout runs until the last failure
+	err = store.Users.RecordLoginFailure(user, 10, time.Hour, now.Add(3*time.Hour))
+	if err != nil || user.FailedLogins != 1 || user.LockedUntil == nil || !user.LockedUntil.Equal(now.Add(3*time.Hour)) {
+		t.Errorf("Error recording login failure: expected the count to start over, got %d failures until %v (%v)", user.FailedLogins, user.LockedUntil, err)
+	}
+	err = store.Users.DelayLogins(user, now.Add(3*time.Hour+time.Minute))
+	if err != nil || !user.LockedUntil.Equal(now.Add(3*time.Hour+time.Minute)) {
+		t.Errorf("Error delaying logins: got %v (%v)", user.LockedUntil, err)
+	}
+
+	// Resetting the failures keeps the other fields of the stored user
+	stored_user.Role = constants.ROLE_MODERATOR
+	err = store.Users.Update(stored_user)
+	if err != nil {
+		t.Fatalf("Error updating user: %v", err)
+	}
+	err = store.Users.ResetLoginFailures(user)
+	if err != nil || user.FailedLogins != 0 || user.LockedUntil != nil {
+		t.Errorf("Error resetting login failures: got %d failures until %v (%v)", user.FailedLogins, user.LockedUntil, err)
+	}
+	stored_user, _ = store.Users.GetByID(user.ID)
+	if stored_user == nil || stored_user.FailedLogins != 0 || stored_user.LockedUntil != nil || stored_user.Role != constants.ROLE_MODERATOR {
+		t.Errorf("Error resetting login failures: got %+v", stored_user)
+	}
+}
+
+func testStoreMessages(t *testing.T, store *Store) {
+	users := createStoreUsers(t, store, "frank", "grace")
+
+	// The sender is taken from the association
+	messages := []*Message{}
+	for i, content := range []string{"Hello there", "General Kenobi", "hello again"} {
+		message := &Message{Content: content, Sender: users[i%2]}
+		err := store.Messages.Create(message)
+		if err != nil {
+			t.Fatalf("Error creating message: %v", err)
+		}
+		messages = append(messages, message)
+	}
+	if messages[1].SenderID != users[1].ID {
+		t.Errorf("Error creating message: sender ID not set from the sender")
+	}
+
+	message, err := store.Messages.GetByID(messages[1].ID)
+	if err != nil || message.Sender == nil || message.Sender.Username != "grace" {
+		t.Errorf("Error retrieving message with its sender: %v", err)
+	}
+	_, err = store.Messages.GetByID(messages[2].ID + 100)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Error retrieving missing message: expected ErrRecordNotFound, got %v", err)
+	}
+
+	messages[2].Flagged = true
+	err = store.Messages.Update(messages[2])
+	if err != nil {
+		t.Errorf("Error updating message: %v", err)
+	}
+
+	test_cases := []struct {
+		name     string
+		params   *MessagesGetRequestParams
+		expected []int
+	}{
+		{"all", &MessagesGetRequestParams{}, []int{messages[0].ID, messages[1].ID, messages[2].ID}},
+		{"contains", &MessagesGetRequestParams{Contains: []string{"HELLO"}}, []int{messages[0].ID, messages[2].ID}},
+		{"contains or ID", &MessagesGetRequestParams{Contains: []string{"kenobi"}, ID: []int{messages[0].ID}}, []int{messages[0].ID, messages[1].ID}},
+		{"OR group and sender", &MessagesGetRequestParams{Contains: []string{"hello"}, SenderID: []int{users[0].ID}}, []int{messages[0].ID, messages[2].ID}},
+		{"OR group and flagged", &MessagesGetRequestParams{Contains: []string{"hello"}, Flagged: []bool{false}}, []int{messages[0].ID}},
+		{"ID and sender", &MessagesGetRequestParams{ID: []int{messages[1].ID}, SenderID: []int{users[0].ID}}, []int{}},
+		{"order and limit", &MessagesGetRequestParams{Order: "id desc", Limit: 2}, []int{messages[2].ID, messages[1].ID}},
+	}
+	for _, test_case := range test_cases {
+		listed, err := store.Messages.List(test_case.params)
+		if err != nil {
+			t.Errorf("Error listing messages (%s): %v", test_case.name, err)
+			continue
+		}
+		ids := recordIDs(listed, messageID)
+		if test_case.params.Order == "" {
+			sort.Ints(ids)
+		}
+		if !equalIDs(ids, test_case.expected) {
+			t.Errorf("Error listing messages (%s): expected %v, got %v", test_case.name, test_case.expected, ids)
+		}
+		for _, listed_message := range listed {
+			if listed_message.Sender == nil {
+				t.Errorf("Error listing messages (%s): sender not loaded", test_case.name)
+			}
+		}
+	}
+
+	err = store.Messages.DeleteMany([]*Message{messages[0], messages[1]})
+	if err != nil {
+		t.Errorf("Error deleting messages: %v", err)
+	}
+	err = store.Messages.Delete(messages[2])
+	if err != nil {
+		t.Errorf("Error deleting message: %v", err)
+	}
+	listed, err := store.Messages.List(&MessagesGetRequestParams{})
+	if err != nil || len(listed) != 0 {
+		t.Errorf("Error deleting messages: %d messages left (%v)", len(listed), err)
+	}
+}
+
+func testStoreMessagesSearch(t *testing.T, store *Store) {
+	users := createStoreUsers(t, store, "heidi", "ivan")
+	messages := []*Message{}
+	for i, content := range []string{"the quick brown fox", "a lazy dog", "quick <b>dog</b> jumps"} {
+		message := &Message{Content: content, Sender: users[i%2]}
+		err := store.Messages.Create(message)
+		if err != nil {
+			t.Fatalf("Error creating message: %v", err)
+		}
+		messages = append(messages, message)
+	}
+
+	test_cases := []struct {
+		name     string
+		params   *MessagesSearchRequestParams
+		expected []int
+	}{
+		{"single term", &MessagesSearchRequestParams{Query: "quick"}, []int{messages[0].ID, messages[2].ID}},
+		{"every term", &MessagesSearchRequestParams{Query: "quick dog"}, []int{messages[2].ID}},
+		{"sender", &MessagesSearchRequestParams{Query: "dog", SenderID: []int{users[1].ID}}, []int{messages[1].ID}},
+		{"no match", &MessagesSearchRequestParams{Query: "cat"}, []int{}},
+		{"empty", &MessagesSearchRequestParams{Query: "  "}, []int{}},
+	}
+	for _, test_case := range test_cases {
+		results, err := store.Messages.Search(test_case.params)
+		if err != nil {
+			t.Errorf("Error searching messages (%s): %v", test_case.name, err)
+			continue
+		}
+		ids := []int{}
+		for _, result := range results {
+			ids = append(ids, result.Message.ID)
+			if result.Message.Sender == nil || result.Snippet == "" {
+				t.Errorf("Error searching messages (%s): sender or snippet missing", test_case.name)
+			}
+		}
+		// The ranking differs between the index and the fallback, only the matches are compared
+		sort.Ints(ids)
+		if !equalIDs(ids, test_case.expected) {
+			t.Errorf("Error searching messages (%s): expected %v, got %v", test_case.name, test_case.expected, ids)
+		}
+	}
+}
+
+func testStoreBans(t *testing.T, store *Store) {
+	users := createStoreUsers(t, store, "judy", "mallory", "oscar")
+	now := time.Now()
+	bans := []*Ban{
+		{Target: users[1], Issuer: users[0], Reason: "Spam", Type: constants.BAN_TYPE, EndsAt: now.Add(time.Hour)},
+		{Target: users[1], Issuer: users[0], Reason: "Spam again", Type: constants.BAN_TYPE, EndsAt: now.Add(2 * time.Hour)},
+		{Target: users[2], Issuer: users[0], Reason: "Rude", Type: constants.MUTE_TYPE, EndsAt: now.Add(time.Hour)},
+		{Target: users[2], Issuer: users[0], Reason: "Expired", Type: constants.BAN_TYPE, EndsAt: now.Add(-time.Hour)},
+	}
+	err := store.Bans.CreateMany(bans)
+	if err != nil {
+		t.Fatalf("Error creating bans: %v", err)
+	}
+	if bans[0].ID == 0 || bans[0].TargetID != users[1].ID || bans[0].IssuerID != users[0].ID {
+		t.Errorf("Error creating ban: ID or user IDs not set: %+v", bans[0])
+	}
+
+	ban, err := store.Bans.GetByID(bans[2].ID)
+	if err != nil || ban.Reason != "Rude" {
+		t.Errorf("Error retrieving ban by ID: %v", err)
+	}
+
+	active_bans, err := store.Bans.ListActiveBans(users[1].ID)
+	if err != nil || !equalIDs(recordIDs(active_bans, banID), []int{bans[1].ID, bans[0].ID}) {
+		t.Errorf("Error listing active bans: expected latest ending first, got %v (%v)", recordIDs(active_bans, banID), err)
+	}
+	active_bans, err = store.Bans.ListActiveBans(users[2].ID)
+	if err != nil || len(active_bans) != 0 {
+		t.Errorf("Error listing active bans: mutes and expired bans must be ignored, got %v (%v)", recordIDs(active_bans, banID), err)
+	}
+
+	test_cases := []struct {
+		name     string
+		params   *BansGetRequestParams
+		expected []int
+	}{
+		{"ends after", &BansGetRequestParams{EndsAfter: now}, []int{bans[0].ID, bans[1].ID, bans[2].ID}},
+		{"every ban", &BansGetRequestParams{EndsAfter: now.Add(-24 * time.Hour)}, []int{bans[0].ID, bans[1].ID, bans[2].ID, bans[3].ID}},
+		{"target and type", &BansGetRequestParams{EndsAfter: now.Add(-24 * time.Hour), TargetID: []int{users[2].ID}, Type: []string{constants.BAN_TYPE}}, []int{bans[3].ID}},
+		{"reason", &BansGetRequestParams{EndsAfter: now, Reason: "spam"}, []int{bans[0].ID, bans[1].ID}},
+		{"ID is a filter", &BansGetRequestParams{EndsAfter: now, ID: []int{bans[0].ID, bans[3].ID}}, []int{bans[0].ID}},
+		{"order", &BansGetRequestParams{EndsAfter: now, Order: "ends_at desc", Limit: 1}, []int{bans[1].ID}},
+	}
+	for _, test_case := range test_cases {
+		listed, err := store.Bans.List(test_case.params)
+		if err != nil {
+			t.Errorf("Error listing bans (%s): %v", test_case.name, err)
+			continue
+		}
+		ids := recordIDs(listed, banID)
+		if test_case.params.Order == "" {
+			sort.Ints(ids)
+		}
+		if !equalIDs(ids, test_case.expected) {
+			t.Errorf("Error listing bans (%s): expected %v, got %v", test_case.name, test_case.expected, ids)
+		}
+	}
+
+	bans[0].Reason = "Updated"
+	err = store.Bans.Update(bans[0])
+	if err != nil {
+		t.Errorf("Error updating ban: %v", err)
+	}
+	ban, _ = store.Bans.GetByID(bans[0].ID)
+	if ban == nil || ban.Reason != "Updated" {
+		t.Errorf("Error updating ban: reason not saved")
+	}
+
+	err = store.Bans.DeleteMany([]*Ban{bans[0], bans[1]})
+	if err != nil {
+		t.Errorf("Error deleting bans: %v", err)
+	}
+	err = store.Bans.Delete(bans[2])
+	if err != nil {
+		t.Errorf("Error deleting ban: %v", err)
+	}
+	_, err = store.Bans.GetByID(bans[2].ID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Error deleting ban: ban still exists (%v)", err)
+	}
+}
+
+func testStoreUsersDeletion(t *testing.T, store *Store) {
+	users := createStoreUsers(t, store, "ivan", "sybil", "walter")
+	ivan, sybil, walter := users[0], users[1], users[2]
+
+	// Requested deletions
+	now := time.Now()
+	overdue, due := now.Add(-time.Hour), now.Add(-time.Minute)
+	later := now.Add(time.Hour)
+	for user, due_at := range map[*User]time.Time{ivan: due, sybil: overdue, walter: later} {
+		user.DeletionDueAt = &due_at
+		user.DeletionMode = "anonymize"
+		err := store.Users.Update(user)
+		if err != nil {
+			t.Fatalf("Error scheduling the deletion of %s: %v", user.Username, err)
+		}
+	}
+	due_users, err := store.Users.ListDeletionsDue(now)
+	if err != nil || !equalIDs(recordIDs(due_users, userID), []int{sybil.ID, ivan.ID}) {
+		t.Errorf("Error listing due deletions: expected the most overdue first, got %v (%v)", recordIDs(due_users, userID), err)
+	}
+	if len(due_users) > 0 && due_users[0].DeletionMode != "anonymize" {
+		t.Errorf("Error listing due deletions: deletion mode not saved")
+	}
+
+	// Reassigning the messages
+	message := &Message{Sender: ivan, Content: "Hello"}
+	err = store.Messages.Create(message)
+	if err != nil {
+		t.Fatalf("Error creating message: %v", err)
+	}
+	err = store.Messages.ReassignSender(ivan.ID, walter.ID)
+	if err != nil {
+		t.Fatalf("Error reassigning messages: %v", err)
+	}
+	reassigned_message, err := store.Messages.GetByID(message.ID)
+	if err != nil || reassigned_message.SenderID != walter.ID || reassigned_message.Sender == nil || reassigned_message.Sender.Username != "walter" {
+		t.Errorf("Error reassigning messages: expected walter as sender (%v)", err)
+	}
+
+	// Reassigning the bans, issued and received
+	bans := []*Ban{
+		{Target: sybil, Issuer: ivan, Reason: "Issued", Type: constants.BAN_TYPE, EndsAt: later},
+		{Target: ivan, Issuer: sybil, Reason: "Received", Type: constants.MUTE_TYPE, EndsAt: later},
+	}
+	err = store.Bans.CreateMany(bans)
+	if err != nil {
+		t.Fatalf("Error creating bans: %v", err)
+	}
+	err = store.Bans.ReassignUser(ivan.ID, walter.ID)
+	if err != nil {
+		t.Fatalf("Error reassigning bans: %v", err)
+	}
+	issued_ban, _ := store.Bans.GetByID(bans[0].ID)
+	received_ban, _ := store.Bans.GetByID(bans[1].ID)
+	if issued_ban == nil || issued_ban.IssuerID != walter.ID || issued_ban.TargetID != sybil.ID {
+		t.Errorf("Error reassigning bans: expected walter as issuer, got %+v", issued_ban)
+	}
+	if received_ban == nil || received_ban.TargetID != walter.ID || received_ban.IssuerID != sybil.ID {
+		t.Errorf("Error reassigning bans: expected walter as target, got %+v", received_ban)
+	}
+
+	// Deleting the tokens
+	for _, user := range []*User{ivan, sybil} {
+		_, hashed_token, err := cryptutils.GenerateHashedToken()
+		if err != nil {
+			t.Fatalf("Error generating token: %v", err)
+		}
+		err = store.Tokens.Create(&AuthToken{User: user, Hashed_Token: hashed_token, Expiration: later.Unix()})
+		if err != nil {
+			t.Fatalf("Error creating token: %v", err)
+		}
+	}
+	err = store.Tokens.DeleteUserTokens(ivan.ID)
+	if err != nil {
+		t.Fatalf("Error deleting user tokens: %v", err)
+	}
+	ivan_tokens, _ := store.Tokens.ListUserTokens(ivan.ID)
+	sybil_tokens, _ := store.Tokens.ListUserTokens(sybil.ID)
+	if len(ivan_tokens) != 0 || len(sybil_tokens) != 1 {
+		t.Errorf("Error deleting user tokens: expected 0 and 1 remaining tokens, got %d and %d", len(ivan_tokens), len(sybil_tokens))
+	}
+}
+
+func testStoreTokens(t *testing.T, store *Store) {
+	users := createStoreUsers(t, store, "peggy", "trent")
+
+	refresh_selector, refresh_verifier, hashed_refresh_verifier, err := cryptutils.GenerateSplitToken()
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	access_selector, access_verifier, hashed_access_verifier, err := cryptutils.GenerateSplitToken()
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+
+	refresh_token := &AuthToken{User: users[0], Selector: &refresh_selector, Hashed_Token: hashed_refresh_verifier, Type: constants.REFRESH_TOKEN, Expiration: time.Now().Add(time.Hour).Unix()}
+	err = store.Tokens.Create(refresh_token)
+	if err != nil {
+		t.Fatalf("Error creating token: %v", err)
+	}
+	access_token := &AuthToken{User: users[0], Selector: &access_selector, Hashed_Token: hashed_access_verifier, Expiration: time.Now().Add(time.Hour).Unix(), LinkedToken: refresh_token}
+	err = store.Tokens.Create(access_token)
+	if err != nil {
+		t.Fatalf("Error creating token: %v", err)
+	}
+	if access_token.Type != constants.ACCESS_TOKEN || access_token.UserID != users[0].ID {
+		t.Errorf("Error creating token: type or user ID not set: %+v", access_token)
+	}
+
+	// Unique hash and selector, valid type
+	err = store.Tokens.Create(&AuthToken{User: users[1], Hashed_Token: hashed_access_verifier, Expiration: time.Now().Unix()})
+	if err == nil {
+		t.Errorf("Error creating token: duplicate hash accepted")
+	}
+	err = store.Tokens.Create(&AuthToken{User: users[1], Selector: &access_selector, Hashed_Token: "other_hash", Expiration: time.Now().Unix()})
+	if err == nil {
+		t.Errorf("Error creating token: duplicate selector accepted")
+	}
+	err = store.Tokens.Create(&AuthToken{User: users[1], Hashed_Token: "other_hash", Type: "invalid", Expiration: time.Now().Unix()})
+	if err == nil {
+		t.Errorf("Error creating token: invalid type accepted")
+	}
+
+	// Linked token
+	linked_token, err := store.Tokens.GetLinkedToken(access_token)
+	if err != nil || linked_token.ID != refresh_token.ID || linked_token.User == nil {
+		t.Errorf("Error retrieving linked token: %v", err)
+	}
+	_, err = store.Tokens.GetLinkedToken(refresh_token)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Error retrieving missing linked token: expected ErrRecordNotFound, got %v", err)
+	}
+
+	// Listing
+	tokens, err := store.Tokens.ListUserTokens(users[0].ID)
+	if err != nil || len(tokens) != 2 || tokens[0].ID != refresh_token.ID || tokens[1].ID != access_token.ID || tokens[0].User == nil {
+		t.Errorf("Error listing user tokens: expected both tokens of the user, got %d (%v)", len(tokens), err)
+	}
+	tokens, err = store.Tokens.ListUserTokens(users[1].ID)
+	if err != nil || len(tokens) != 0 {
+		t.Errorf("Error listing user tokens: expected no token, got %d (%v)", len(tokens), err)
+	}
+
+	// Family
+	for _, family_token := range []*AuthToken{refresh_token, access_token} {
+		family_token.FamilyID = &refresh_token.ID
+		err = store.Tokens.Update(family_token)
+		if err != nil {
+			t.Fatalf("Error updating token: %v", err)
+		}
+	}
+	tokens, err = store.Tokens.ListFamilyTokens(refresh_token.ID)
+	if err != nil || len(tokens) != 2 || tokens[0].ID != refresh_token.ID || tokens[1].ID != access_token.ID || tokens[0].User == nil {
+		t.Errorf("Error listing family tokens: expected both tokens of the session, got %d (%v)", len(tokens), err)
+	}
+	tokens, err = store.Tokens.ListFamilyTokens(access_token.ID)
+	if err != nil || len(tokens) != 0 {
+		t.Errorf("Error listing family tokens: expected no token, got %d (%v)", len(tokens), err)
+	}
+
+	// Matching
+	token, err := store.Tokens.MatchToken(access_selector, access_verifier, constants.ACCESS_TOKEN)
+	if err != nil || token.ID != access_token.ID || token.User == nil || token.User.Username != "peggy" {
+		t.Errorf("Error matching token: %v", err)
+	}
+	_, err = store.Tokens.MatchToken(refresh_selector, refresh_verifier, constants.ACCESS_TOKEN)
+	if err == nil {
+		t.Errorf("Error matching token: token of another type matched")
+	}
+	_, err = store.Tokens.MatchToken(access_selector, refresh_verifier, constants.ACCESS_TOKEN)
+	if err == nil {
+		t.Errorf("Error matching token: verifier of another token matched")
+	}
+	_, err = store.Tokens.MatchToken("missing", access_verifier, constants.ACCESS_TOKEN)
+	if err == nil {
+		t.Errorf("Error matching token: missing selector matched")
+	}
+
+	// Matching the tokens issued before the selectors
+	createLegacyToken := func() (*AuthToken, string) {
+		raw_legacy_token, hashed_legacy_token, err := cryptutils.GenerateHashedToken()
+		legacy_token := &AuthToken{User: users[0], Hashed_Token: hashed_legacy_token, Expiration: time.Now().Add(time.Hour).Unix()}
+		if err == nil {
+			err = store.Tokens.Create(legacy_token)
+		}
+		if err != nil {
+			t.Fatalf("Error creating token: %v", err)
+		}
+		return legacy_token, raw_legacy_token
+	}
+	legacy_token, raw_legacy_token := createLegacyToken()
+	_, err = store.Tokens.MatchLegacyUserToken(users[0].ID, raw_legacy_token, constants.REFRESH_TOKEN)
+	if err == nil {
+		t.Errorf("Error matching legacy token: token of another type matched")
+	}
+	_, err = store.Tokens.MatchLegacyUserToken(users[1].ID, raw_legacy_token, constants.ACCESS_TOKEN)
+	if err == nil {
+		t.Errorf("Error matching legacy token: token of another user matched")
+	}
+	token, err = store.Tokens.MatchLegacyUserToken(users[0].ID, raw_legacy_token, constants.ACCESS_TOKEN)
+	if err != nil || token.ID != legacy_token.ID || token.User == nil {
+		t.Errorf("Error matching legacy token: %v", err)
+	}
+
+	// The matched legacy token is given a selector, and is not checked with bcrypt anymore
+	_, err = store.Tokens.MatchLegacyUserToken(users[0].ID, raw_legacy_token, constants.ACCESS_TOKEN)
+	if err == nil {
+		t.Errorf("Error matching legacy token: upgraded token scanned again")
+	}
+	token, err = store.Tokens.MatchToken(LegacyTokenSelector(raw_legacy_token), raw_legacy_token, constants.ACCESS_TOKEN)
+	if err != nil || token.ID != legacy_token.ID || token.Selector == nil {
+		t.Errorf("Error matching upgraded legacy token: %v", err)
+	}
+	legacy_tokens := []*AuthToken{legacy_token}
+
+	// The expired legacy tokens are never checked
+	legacy_token, raw_legacy_token = createLegacyToken()
+	legacy_tokens = append(legacy_tokens, legacy_token)
+	legacy_token.Expiration = time.Now().Add(-time.Hour).Unix()
+	err = store.Tokens.Update(legacy_token)
+	if err != nil {
+		t.Fatalf("Error updating token: %v", err)
+	}
+	_, err = store.Tokens.MatchLegacyUserToken(users[0].ID, raw_legacy_token, constants.ACCESS_TOKEN)
+	if err == nil {
+		t.Errorf("Error matching legacy token: expired token matched")
+	}
+
+	// Only the newest ones are checked, the older ones are reached once the newer ones were upgraded
+	old_legacy_token, raw_old_legacy_token := createLegacyToken()
+	legacy_tokens = append(legacy_tokens, old_legacy_token)
+	raw_newer_legacy_tokens := []string{}
+	for range constants.LEGACY_TOKENS_SCAN_LIMIT {
+		newer_legacy_token, raw_newer_legacy_token := createLegacyToken()
+		legacy_tokens = append(legacy_tokens, newer_legacy_token)
+		raw_newer_legacy_tokens = append(raw_newer_legacy_tokens, raw_newer_legacy_token)
+	}
+	_, err = store.Tokens.MatchLegacyUserToken(users[0].ID, raw_old_legacy_token, constants.ACCESS_TOKEN)
+	if err == nil {
+		t.Errorf("Error matching legacy token: token past the scan limit matched")
+	}
+	_, err = store.Tokens.MatchLegacyUserToken(users[0].ID, raw_newer_legacy_tokens[0], constants.ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Error matching legacy token: %v", err)
+	}
+	token, err = store.Tokens.MatchLegacyUserToken(users[0].ID, raw_old_legacy_token, constants.ACCESS_TOKEN)
+	if err != nil || token.ID != old_legacy_token.ID {
+		t.Errorf("Error matching legacy token: token back in the scan limit refused (%v)", err)
+	}
+	for _, token := range legacy_tokens {
+		err = store.Tokens.Delete(token)
+		if err != nil {
+			t.Errorf("Error deleting token: %v", err)
+		}
+	}
+
+	// Last use, the other fields are not saved
+	used_at := time.Now().Truncate(time.Second)
+	stale_token := *access_token
+	stale_token.Expiration = 0
+	err = store.Tokens.Touch(&stale_token, used_at, "192.0.2.1", "curl/8.0")
+	if err != nil {
+		t.Errorf("Error touching token: %v", err)
+	}
+	token, err = store.Tokens.GetByID(access_token.ID)
+	if err != nil || token.User == nil || token.LastUsedAt == nil || !token.LastUsedAt.Equal(used_at) || token.IP != "192.0.2.1" || token.UserAgent != "curl/8.0" {
+		t.Errorf("Error retrieving touched token: %+v (%v)", token, err)
+	} else if token.Expiration != access_token.Expiration {
+		t.Errorf("Error touching token: other fields saved")
+	}
+	_, err = store.Tokens.GetByID(-1)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Error retrieving missing token: expected ErrRecordNotFound, got %v", err)
+	}
+
+	// Rotation, the concurrent rotations of a token all but one fail
+	rotated_token := *refresh_token
+	rotated_at := time.Now().UTC().Truncate(time.Second)
+	var wg sync.WaitGroup
+	var rotations atomic.Int32
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			concurrent_token := rotated_token
+			rotated, err := store.Tokens.Rotate(&concurrent_token, refresh_token.ID, rotated_at)
+			if err != nil {
+				t.Errorf("Error rotating token: %v", err)
+			} else if rotated {
+				rotations.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if rotations.Load() != 1 {
+		t.Errorf("Error rotating token concurrently: expected 1 rotation, got %d", rotations.Load())
+	}
+	token, err = store.Tokens.GetByID(refresh_token.ID)
+	if err != nil || !token.IsRotated() || !token.RotatedAt.Equal(rotated_at) || token.FamilyID == nil || *token.FamilyID != refresh_token.ID || token.LinkedTokenID != nil {
+		t.Errorf("Error retrieving rotated token: %+v (%v)", token, err)
+	}
+
+	// Expiration
+	access_token.Expiration = time.Now().Add(-time.Hour).Unix()
+	err = store.Tokens.Update(access_token)
+	if err != nil {
+		t.Errorf("Error updating token: %v", err)
+	}
+	err = store.Tokens.DeleteExpired()
+	if err != nil {
+		t.Errorf("Error deleting expired tokens: %v", err)
+	}
+	_, err = store.Tokens.MatchToken(access_selector, access_verifier, constants.ACCESS_TOKEN)
+	if err == nil {
+		t.Errorf("Error deleting expired tokens: expired token still matches")
+	}
+	_, err = store.Tokens.MatchToken(refresh_selector, refresh_verifier, constants.REFRESH_TOKEN)
+	if err != nil {
+		t.Errorf("Error deleting expired tokens: valid token deleted (%v)", err)
+	}
+
+	err = store.Tokens.Delete(refresh_token)
+	if err != nil {
+		t.Errorf("Error deleting token: %v", err)
+	}
+	_, err = store.Tokens.MatchToken(refresh_selector, refresh_verifier, constants.REFRESH_TOKEN)
+	if err == nil {
+		t.Errorf("Error deleting token: token still matches")
+	}
+}
+
+func auditEventID(event *AuditEvent) int { return event.ID }
+
+func testStoreAudit(t *testing.T, store *Store) {
+	snapshot, err := NewAuditSnapshot(&Ban{ID: 4, Reason: "Spam"})
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+	start := time.Now().UTC()
+	events := []*AuditEvent{
+		{ActorID: 1, ActorUsername: "admin", Action: "ban.create", TargetType: "user", TargetID: 2, After: snapshot, RequestID: "request-1"},
+		{ActorID: 1, ActorUsername: "admin", Action: "message.delete", TargetType: "message", TargetID: 7, Before: snapshot, RequestID: "request-2"},
+		{ActorID: 3, ActorUsername: "moderator", Action: "ban.delete", TargetType: "user", TargetID: 2, Before: snapshot, RequestID: "request-3"},
+	}
+	err = store.Audit.CreateMany(events[:2])
+	if err != nil {
+		t.Fatalf("Error creating audit events: %v", err)
+	}
+	err = store.Audit.Create(events[2])
+	if err != nil {
+		t.Fatalf("Error creating audit event: %v", err)
+	}
+	if events[2].ID == 0 || events[2].CreatedAt.IsZero() {
+		t.Errorf("Error creating audit event: ID and creation date not set")
+	}
+
+	test_cases := []struct {
+		name     string
+		params   *AuditGetRequestParams
+		expected []int
+	}{
+		{"all", &AuditGetRequestParams{}, []int{events[0].ID, events[1].ID, events[2].ID}},
+		{"actor", &AuditGetRequestParams{ActorID: []int{1}}, []int{events[0].ID, events[1].ID}},
+		{"action", &AuditGetRequestParams{Action: []string{"ban.create", "ban.delete"}}, []int{events[0].ID, events[2].ID}},
+		{"target", &AuditGetRequestParams{TargetType: []string{"user"}, TargetID: []int{2}, ActorID: []int{3}}, []int{events[2].ID}},
+		{"request", &AuditGetRequestParams{RequestID: "request-2"}, []int{events[1].ID}},
+		{"since", &AuditGetRequestParams{Since: start.Add(-time.Minute)}, []int{events[0].ID, events[1].ID, events[2].ID}},
+		{"until", &AuditGetRequestParams{Until: start.Add(-time.Minute)}, []int{}},
+		{"order and page", &AuditGetRequestParams{Order: "id desc", Limit: 2, Page: 2}, []int{events[0].ID}},
+	}
+	for _, test_case := range test_cases {
+		listed, err := store.Audit.List(test_case.params)
+		if err != nil {
+			t.Errorf("Error listing audit events (%s): %v", test_case.name, err)
+			continue
+		}
+		ids := recordIDs(listed, auditEventID)
+		if test_case.params.Order == "" {
+			sort.Ints(ids)
+		}
+		if !equalIDs(ids, test_case.expected) {
+			t.Errorf("Error listing audit events (%s): expected %v, got %v", test_case.name, test_case.expected, ids)
+		}
+	}
+
+	// Snapshots are stored as is
+	listed, err := store.Audit.List(&AuditGetRequestParams{RequestID: "request-1"})
+	if err != nil || len(listed) != 1 || listed[0].After != snapshot || listed[0].Before != "" {
+		t.Errorf("Error listing audit events: snapshots not stored as is (%v)", err)
+	}
+}
+
+func testStoreIdentities(t *testing.T, store *Store) {
+	users := createStoreUsers(t, store, "victor", "walter")
+
+	identity := &UserIdentity{UserID: users[0].ID, Provider: "idp", Subject: "subject-1", Email: "victor@idp.test"}
+	err := store.Identities.Create(identity)
+	if err != nil {
+		t.Fatalf("Error creating identity: %v", err)
+	}
+	err = store.Identities.Create(&UserIdentity{UserID: users[0].ID, Provider: "other_idp", Subject: "subject-1"})
+	if err != nil {
+		t.Fatalf("Error creating identity: %v", err)
+	}
+
+	// The subject is unique at a provider
+	err = store.Identities.Create(&UserIdentity{UserID: users[1].ID, Provider: "idp", Subject: "subject-1"})
+	if err == nil {
+		t.Errorf("Error creating identity: duplicate subject accepted")
+	}
+
+	found_identity, err := store.Identities.GetBySubject("idp", "subject-1")
+	if err != nil || found_identity.ID != identity.ID || found_identity.User == nil || found_identity.User.Username != "victor" {
+		t.Errorf("Error retrieving identity: %v", err)
+	}
+	_, err = store.Identities.GetBySubject("idp", "subject-2")
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Error retrieving missing identity: expected ErrRecordNotFound, got %v", err)
+	}
+	identities, err := store.Identities.ListUserIdentities(users[0].ID)
+	if err != nil || len(identities) != 2 || identities[0].ID != identity.ID {
+		t.Errorf("Error listing user identities: expected both identities of the user, got %d (%v)", len(identities), err)
+	}
+
+	identity.Email = "victor@other.test"
+	err = store.Identities.Update(identity)
+	if err != nil {
+		t.Errorf("Error updating identity: %v", err)
+	}
+	found_identity, err = store.Identities.GetBySubject("idp", "subject-1")
+	if err != nil || found_identity.Email != "victor@other.test" {
+		t.Errorf("Error updating identity: email not saved (%v)", err)
+	}
+
+	err = store.Identities.Delete(identity)
+	if err != nil {
+		t.Errorf("Error deleting identity: %v", err)
+	}
+	_, err = store.Identities.GetBySubject("idp", "subject-1")
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Error deleting identity: expected ErrRecordNotFound, got %v", err)
+	}
+
+	err = store.Identities.DeleteUserIdentities(users[0].ID)
+	if err != nil {
+		t.Errorf("Error deleting user identities: %v", err)
+	}
+	identities, err = store.Identities.ListUserIdentities(users[0].ID)
+	if err != nil || len(identities) != 0 {
+		t.Errorf("Error deleting user identities: expected no identity, got %d (%v)", len(identities), err)
+	}
+}
+
+func testStoreAPITokens(t *testing.T, store *Store) {
+	users := createStoreUsers(t, store, "xavier", "yvonne")
+
+	expires_at := time.Now().Add(time.Hour).Truncate(time.Second)
+	api_token := &APIToken{UserID: users[0].ID, Name: "overlay", Hashed_Token: "hashed_token", Scopes: []string{"messages:read"}, ExpiresAt: &expires_at}
+	err := store.APITokens.Create(api_token)
+	if err != nil {
+		t.Fatalf("Error creating API token: %v", err)
+	}
+	err = store.APITokens.Create(&APIToken{UserID: users[0].ID, Name: "bot", Hashed_Token: "other_hashed_token", Scopes: []string{"messages:read", "messages:write"}})
+	if err != nil {
+		t.Fatalf("Error creating API token: %v", err)
+	}
+	err = store.APITokens.Create(&APIToken{UserID: users[1].ID, Name: "bot", Hashed_Token: "hashed_token", Scopes: []string{"bans:write"}})
+	if err != nil {
+		t.Fatalf("Error creating API token: %v", err)
+	}
+
+	// The scopes and the expiry are kept
+	found_api_token, err := store.APITokens.GetByID(api_token.ID)
+	if err != nil || found_api_token.User == nil || found_api_token.User.Username != "xavier" || found_api_token.Name != "overlay" {
+		t.Fatalf("Error retrieving API token: %+v (%v)", found_api_token, err)
+	}
+	if !found_api_token.HasScope("messages:read") || found_api_token.HasScope("messages:write") || found_api_token.ExpiresAt == nil || !found_api_token.ExpiresAt.Equal(expires_at) {
+		t.Errorf("Error retrieving API token: unexpected scopes %v or expiry %v", found_api_token.Scopes, found_api_token.ExpiresAt)
+	}
+	_, err = store.APITokens.GetByID(api_token.ID + 100)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Error retrieving missing API token: expected ErrRecordNotFound, got %v", err)
+	}
+	api_tokens, err := store.APITokens.ListUserAPITokens(users[0].ID)
+	if err != nil || len(api_tokens) != 2 || api_tokens[0].ID != api_token.ID || len(api_tokens[1].Scopes) != 2 {
+		t.Errorf("Error listing user API tokens: expected both tokens of the user, got %d (%v)", len(api_tokens), err)
+	}
+
+	// Matching by selector, and the tokens created before the selectors by ID once
+	selector, verifier, hashed_verifier, err := cryptutils.GenerateSplitToken()
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	split_api_token := &APIToken{UserID: users[1].ID, Name: "split", Selector: &selector, Hashed_Token: hashed_verifier}
+	err = store.APITokens.Create(split_api_token)
+	if err != nil {
+		t.Fatalf("Error creating API token: %v", err)
+	}
+	err = store.APITokens.Create(&APIToken{UserID: users[1].ID, Name: "duplicate", Selector: &selector, Hashed_Token: "duplicate_hashed_token"})
+	if err == nil {
+		t.Errorf("Error creating API token: duplicate selector accepted")
+	}
+	matched_api_token, err := store.APITokens.MatchToken(selector, verifier)
+	if err != nil || matched_api_token.ID != split_api_token.ID || matched_api_token.User == nil || matched_api_token.User.Username != "yvonne" {
+		t.Errorf("Error matching API token: %v", err)
+	}
+	_, err = store.APITokens.MatchToken(selector, "wrong_verifier")
+	if err == nil {
+		t.Errorf("Error matching API token: wrong verifier matched")
+	}
+	_, err = store.APITokens.MatchLegacyToken(split_api_token.ID, verifier)
+	if err == nil {
+		t.Errorf("Error matching legacy API token: token with a selector matched")
+	}
+
+	raw_legacy_token, hashed_legacy_token, err := cryptutils.GenerateHashedToken()
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	legacy_api_token := &APIToken{UserID: users[1].ID, Name: "legacy", Hashed_Token: hashed_legacy_token}
+	err = store.APITokens.Create(legacy_api_token)
+	if err != nil {
+		t.Fatalf("Error creating API token: %v", err)
+	}
+	legacy_verifier := base64.RawURLEncoding.EncodeToString([]byte(raw_legacy_token))
+	_, err = store.APITokens.MatchLegacyToken(legacy_api_token.ID, base64.RawURLEncoding.EncodeToString([]byte("wrong_token")))
+	if err == nil {
+		t.Errorf("Error matching legacy API token: wrong raw token matched")
+	}
+	matched_api_token, err = store.APITokens.MatchLegacyToken(legacy_api_token.ID, legacy_verifier)
+	if err != nil || matched_api_token.ID != legacy_api_token.ID || matched_api_token.User == nil {
+		t.Errorf("Error matching legacy API token: %v", err)
+	}
+	_, err = store.APITokens.MatchLegacyToken(legacy_api_token.ID, legacy_verifier)
+	if err == nil {
+		t.Errorf("Error matching legacy API token: upgraded token checked with bcrypt again")
+	}
+	matched_api_token, err = store.APITokens.MatchToken(strconv.Itoa(legacy_api_token.ID), legacy_verifier)
+	if err != nil || matched_api_token.ID != legacy_api_token.ID {
+		t.Errorf("Error matching upgraded legacy API token: %v", err)
+	}
+
+	// Touch only records the last use
+	used_at := time.Now().Truncate(time.Second)
+	found_api_token.Name = "unsaved"
+	err = store.APITokens.Touch(found_api_token, used_at)
+	if err != nil {
+		t.Errorf("Error touching API token: %v", err)
+	}
+	found_api_token, err = store.APITokens.GetByID(api_token.ID)
+	if err != nil || found_api_token.LastUsedAt == nil || !found_api_token.LastUsedAt.Equal(used_at) || found_api_token.Name != "overlay" {
+		t.Errorf("Error touching API token: %+v (%v)", found_api_token, err)
+	}
+
+	err = store.APITokens.Delete(api_token)
+	if err != nil {
+		t.Errorf("Error deleting API token: %v", err)
+	}
+	_, err = store.APITokens.GetByID(api_token.ID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Error deleting API token: expected ErrRecordNotFound, got %v", err)
+	}
+
+	err = store.APITokens.DeleteUserAPITokens(users[0].ID)
+	if err != nil {
+		t.Errorf("Error deleting user API tokens: %v", err)
+	}
+	api_tokens, err = store.APITokens.ListUserAPITokens(users[0].ID)
+	if err != nil || len(api_tokens) != 0 {
+		t.Errorf("Error deleting user API tokens: expected no token, got %d (%v)", len(api_tokens), err)
+	}
+	api_tokens, err = store.APITokens.ListUserAPITokens(users[1].ID)
+	if err != nil || len(api_tokens) != 3 {
+		t.Errorf("Error deleting user API tokens: expected the tokens of the other user, got %d (%v)", len(api_tokens), err)
+	}
+}
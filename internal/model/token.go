@@ -1,24 +1,34 @@
 package db_model
 
 import (
+	"encoding/base64"
 	"fmt"
 	"time"
 
 	"github.com/boxboxjason/jukebox/internal/constants"
 	"github.com/boxboxjason/jukebox/pkg/utils/cryptutils"
-	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
 	"gorm.io/gorm"
 )
 
+// AuthToken is a token issued to a user, located by its public selector and checked against the hash of its verifier
+// The tokens issued before the selectors have none, their hash is a bcrypt hash of the raw token
+// The tokens of a session share its family, the ID of its first refresh token: every refresh replaces the refresh token
+// by a new one, and keeps the replaced one as rotated until it expires
 type AuthToken struct {
 	ID            int        `gorm:"primaryKey;autoIncrement" json:"id"`
+	Selector      *string    `gorm:"type:TEXT;uniqueIndex;default:null" json:"-"`
 	UserID        int        `gorm:"type:INTEGER;not null" json:"-"`
 	User          *User      `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"user"`
 	Hashed_Token  string     `gorm:"type:TEXT;unique;not null" json:"hashed_token"`
-	Expiration    int64      `gorm:"type:INTEGER;not null" json:"expiration"`
+	Expiration    int64      `gorm:"type:BIGINT;not null" json:"expiration"`
 	Type          string     `gorm:"type:TEXT;not null" json:"type"`
 	LinkedTokenID *int       `gorm:"type:INTEGER;default:null" json:"linked_token"`
 	LinkedToken   *AuthToken `gorm:"foreignKey:LinkedTokenID;constraint:OnDelete:SET NULL" json:"-"`
+	FamilyID      *int       `gorm:"type:INTEGER;index;default:null" json:"family_id"`
+	RotatedAt     *time.Time `gorm:"default:null" json:"rotated_at"`
+	LastUsedAt    *time.Time `gorm:"default:null" json:"last_used_at"`
+	IP            string     `gorm:"type:TEXT;not null;default:''" json:"ip"`
+	UserAgent     string     `gorm:"type:TEXT;not null;default:''" json:"user_agent"`
 	CreatedAt     time.Time  `gorm:"autoCreateTime" json:"created_at"`
 	ModifiedAt    time.Time  `gorm:"autoUpdateTime:milli" json:"modified_at"`
 }
@@ -27,9 +37,9 @@ func (token *AuthToken) BeforeSave(tx *gorm.DB) (err error) {
 	if len(token.Type) == 0 {
 		token.Type = constants.ACCESS_TOKEN
 	}
-	validTypes := map[string]bool{constants.ACCESS_TOKEN: true, constants.REFRESH_TOKEN: true}
+	validTypes := map[string]bool{constants.ACCESS_TOKEN: true, constants.REFRESH_TOKEN: true, constants.PASSWORD_RESET_TOKEN: true, constants.EMAIL_VERIFICATION_TOKEN: true, constants.TWO_FACTOR_TOKEN: true}
 	if !validTypes[token.Type] {
-		return fmt.Errorf("invalid type; must be either 'access' or 'refresh'")
+		return fmt.Errorf("invalid type; must be either 'access', 'refresh', 'password_reset', 'email_verification' or 'two_factor'")
 	}
 	return nil
 }
@@ -54,36 +64,71 @@ func GetAuthTokenByID(db *gorm.DB, id int) (*AuthToken, error) {
 	return auth_token, err
 }
 
-// GetUserTokens retrieves all auth tokens for a user from the database
+// GetUserTokens retrieves all auth tokens for a user from the database, oldest first
+func (user *User) GetUserTokens(db *gorm.DB) ([]*AuthToken, error) {
+	var tokens []*AuthToken
+	err := db.Where("user_id = ?", user.ID).Order("id asc").Find(&tokens).Error
+	return tokens, err
+}
+
+// GetUserTokensByType retrieves all auth tokens of a type for a user from the database
 func (user *User) GetUserTokensByType(db *gorm.DB, token_type string) ([]*AuthToken, error) {
 	var tokens []*AuthToken
 	err := db.Where("user_id = ? AND type = ?", user.ID, token_type).Find(&tokens).Error
 	return tokens, err
 }
 
+// GetAuthTokenBySelector retrieves an auth token from the database by its selector
+func GetAuthTokenBySelector(db *gorm.DB, selector string) (*AuthToken, error) {
+	auth_token := &AuthToken{}
+	err := db.Where("selector = ?", selector).First(auth_token).Error
+	return auth_token, err
+}
+
+// GetUserLegacyTokensByType retrieves the unexpired auth tokens of a type for a user that were issued before the selectors,
+// newest first and at most limit of them
+func (user *User) GetUserLegacyTokensByType(db *gorm.DB, token_type string, now time.Time, limit int) ([]*AuthToken, error) {
+	var tokens []*AuthToken
+	err := db.Where("user_id = ? AND type = ? AND selector IS NULL AND expiration > ?", user.ID, token_type, now.Unix()).Order("id desc").Limit(limit).Find(&tokens).Error
+	return tokens, err
+}
+
+// GetFamilyTokens retrieves all auth tokens of a session family from the database, oldest first
+func GetFamilyTokens(db *gorm.DB, family_id int) ([]*AuthToken, error) {
+	var tokens []*AuthToken
+	err := db.Where("family_id = ?", family_id).Order("id asc").Find(&tokens).Error
+	return tokens, err
+}
+
 // GetLinkedToken retrieves the linked token for an auth token
 func (auth_token *AuthToken) GetLinkedToken(db *gorm.DB) (*AuthToken, error) {
 	linked_token := &AuthToken{}
-	err := db.First(&linked_token, auth_token.LinkedToken).Error
+	linked_token_id := auth_token.LinkedTokenID
+	if linked_token_id == nil && auth_token.LinkedToken != nil {
+		linked_token_id = &auth_token.LinkedToken.ID
+	}
+	if linked_token_id == nil {
+		return linked_token, gorm.ErrRecordNotFound
+	}
+	err := db.First(linked_token, *linked_token_id).Error
 	return linked_token, err
 }
 
-// CheckAuthTokenMatchesByType checks if an auth token matches a raw token for a user by type
-func (user *User) CheckAuthTokenMatchesByType(db *gorm.DB, raw_token string, token_type string) (*AuthToken, error) {
-	if len(user.Tokens) == 0 {
-		var err error
-		user, err = GetUserByID(db.Preload("Tokens"), user.ID)
-		if err != nil {
-			return &AuthToken{}, err
-		}
-	}
+// MatchesVerifier checks in constant time if the verifier matches the hash of the auth token
+// The tokens issued before the selectors never match, they are checked with MatchesLegacyToken
+func (auth_token *AuthToken) MatchesVerifier(verifier string) bool {
+	return auth_token.Selector != nil && cryptutils.CompareHashAndVerifier(auth_token.Hashed_Token, verifier)
+}
 
-	for _, token := range user.Tokens {
-		if token.Type == token_type && cryptutils.CompareHashAndString(token.Hashed_Token, raw_token) {
-			return token, nil
-		}
-	}
-	return &AuthToken{}, httputils.NewUnauthorizedError("Invalid token")
+// MatchesLegacyToken checks if the raw token matches the bcrypt hash of an auth token issued before the selectors
+func (auth_token *AuthToken) MatchesLegacyToken(raw_token string) bool {
+	return auth_token.Selector == nil && cryptutils.CompareHashAndString(auth_token.Hashed_Token, raw_token)
+}
+
+// LegacyTokenSelector returns the selector given to an auth token issued before the selectors once its raw token matched,
+// the start of the raw token encoded in base64url. The rest of the raw token keeps the verifier secret
+func LegacyTokenSelector(raw_token string) string {
+	return "legacy_" + base64.RawURLEncoding.EncodeToString([]byte(raw_token[:min(len(raw_token), cryptutils.SELECTOR_SIZE)]))
 }
 
 func GetExpiredTokens(db *gorm.DB) ([]*AuthToken, error) {
@@ -98,6 +143,42 @@ func (auth_token *AuthToken) UpdateAuthToken(db *gorm.DB) error {
 	return db.Save(auth_token).Error
 }
 
+// TouchAuthToken records the last use of an auth token, without touching its other fields
+func (auth_token *AuthToken) TouchAuthToken(db *gorm.DB, used_at time.Time, ip string, user_agent string) error {
+	auth_token.LastUsedAt = &used_at
+	auth_token.IP = ip
+	auth_token.UserAgent = user_agent
+	return db.Model(auth_token).UpdateColumns(map[string]any{"last_used_at": used_at, "ip": ip, "user_agent": user_agent}).Error
+}
+
+// RotateAuthToken records the replacement of the refresh token by a newer one of its family, unless it was already replaced
+// Returns whether this call rotated the token: of the concurrent rotations of a token, only one does
+func (auth_token *AuthToken) RotateAuthToken(db *gorm.DB, family_id int, rotated_at time.Time) (bool, error) {
+	result := db.Model(&AuthToken{}).Where("id = ? AND rotated_at IS NULL", auth_token.ID).UpdateColumns(map[string]any{"family_id": family_id, "rotated_at": rotated_at, "linked_token_id": nil})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	auth_token.FamilyID = &family_id
+	auth_token.RotatedAt = &rotated_at
+	auth_token.LinkedTokenID, auth_token.LinkedToken = nil, nil
+	return true, nil
+}
+
+// UpgradeLegacyAuthToken gives an auth token issued before the selectors the selector of its raw token, and replaces its
+// bcrypt hash by the hash of the raw token, so that its legacy bearer is located and checked like the newer ones
+func (auth_token *AuthToken) UpgradeLegacyAuthToken(db *gorm.DB, raw_token string) error {
+	auth_token.upgradeLegacyToken(raw_token)
+	return db.Model(&AuthToken{}).Where("id = ? AND selector IS NULL", auth_token.ID).
+		UpdateColumns(map[string]any{"selector": *auth_token.Selector, "hashed_token": auth_token.Hashed_Token}).Error
+}
+
+// upgradeLegacyToken sets the selector and the hash of an auth token issued before the selectors, without saving them
+func (auth_token *AuthToken) upgradeLegacyToken(raw_token string) {
+	selector := LegacyTokenSelector(raw_token)
+	auth_token.Selector = &selector
+	auth_token.Hashed_Token = cryptutils.HashVerifier(raw_token)
+}
+
 // ================ Delete ================
 // DeleteAuthToken deletes an auth token from the database
 func (auth_token *AuthToken) DeleteAuthToken(db *gorm.DB) error {
@@ -122,3 +203,8 @@ func DeleteExpiredTokens(db *gorm.DB) error {
 func (token *AuthToken) IsExpired() bool {
 	return token.Expiration < time.Now().Unix()
 }
+
+// IsRotated checks if the refresh token was replaced by a newer one of its family
+func (token *AuthToken) IsRotated() bool {
+	return token.RotatedAt != nil
+}
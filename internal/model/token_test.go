@@ -2,6 +2,7 @@ package db_model
 
 import (
 	"testing"
+	"time"
 
 	"github.com/boxboxjason/jukebox/internal/constants"
 	"github.com/boxboxjason/jukebox/pkg/utils/cryptutils"
@@ -9,11 +10,8 @@ import (
 
 func TestCreateAuthToken(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the auth token
 	user := &User{
@@ -41,11 +39,8 @@ func TestCreateAuthToken(t *testing.T) {
 
 func TestCreateAuthTokens(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the auth token
 	user := &User{
@@ -79,11 +74,8 @@ func TestCreateAuthTokens(t *testing.T) {
 
 func TestGetAuthTokenByID(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the auth token
 	user := &User{
@@ -121,11 +113,8 @@ func TestGetAuthTokenByID(t *testing.T) {
 
 func TestGetUserTokensByType(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the auth tokens
 	user := &User{
@@ -186,11 +175,8 @@ func TestGetUserTokensByType(t *testing.T) {
 
 func TestGetLinkedToken(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the auth tokens
 	user := &User{
@@ -240,12 +226,10 @@ func TestGetLinkedToken(t *testing.T) {
 	}
 }
 
-func TestCheckAuthTokenMatchesByType(t *testing.T) {
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+func TestGetAuthTokenBySelector(t *testing.T) {
+
+	db := test_db
+	var err error
 
 	// Create a user for the auth tokens
 	user := &User{
@@ -259,14 +243,15 @@ func TestCheckAuthTokenMatchesByType(t *testing.T) {
 		t.Errorf("Error creating user: %v", err)
 	}
 
-	raw_token, hashed_token, err := cryptutils.GenerateHashedToken()
+	selector, verifier, hashed_verifier, err := cryptutils.GenerateSplitToken()
 	if err != nil {
-		t.Errorf("Error generating hashed token: %v", err)
+		t.Errorf("Error generating split token: %v", err)
 	}
 
 	// Create an access auth token
 	access_auth_token := &AuthToken{
-		Hashed_Token: hashed_token,
+		Selector:     &selector,
+		Hashed_Token: hashed_verifier,
 		User:         user,
 		Type:         constants.ACCESS_TOKEN,
 	}
@@ -276,20 +261,94 @@ func TestCheckAuthTokenMatchesByType(t *testing.T) {
 		t.Errorf("Error creating access auth token: %v", err)
 	}
 
-	// Check if the access token matches
-	_, err = user.CheckAuthTokenMatchesByType(db.Preload("Tokens"), raw_token, constants.ACCESS_TOKEN)
-	if err != nil {
-		t.Errorf("Error checking if access token matches: %v", err)
+	// Check if the access token is found by its selector and matches its verifier
+	auth_token, err := GetAuthTokenBySelector(db, selector)
+	if err != nil || auth_token.ID != access_auth_token.ID {
+		t.Errorf("Error retrieving access auth token by selector: %v", err)
+	}
+	if !auth_token.MatchesVerifier(verifier) || auth_token.MatchesVerifier(selector) {
+		t.Errorf("Error checking if access token matches its verifier")
 	}
 }
 
-func TestUpdateAuthToken(t *testing.T) {
+func TestGetUserLegacyTokensByType(t *testing.T) {
+
+	db := test_db
+	var err error
+
+	// Create a user for the auth tokens
+	user := &User{
+		Email:           "test_email_110@test.com",
+		Hashed_Password: "hashed_password",
+		Username:        "test_user_110",
+	}
+
+	err = user.CreateUser(db)
+	if err != nil {
+		t.Errorf("Error creating user: %v", err)
+	}
+
+	raw_token, hashed_token, err := cryptutils.GenerateHashedToken()
+	if err != nil {
+		t.Errorf("Error generating hashed token: %v", err)
+	}
+	_, hashed_expired_token, err := cryptutils.GenerateHashedToken()
+	if err != nil {
+		t.Errorf("Error generating hashed token: %v", err)
+	}
+	raw_newer_token, hashed_newer_token, err := cryptutils.GenerateHashedToken()
+	if err != nil {
+		t.Errorf("Error generating hashed token: %v", err)
+	}
+	selector, _, hashed_verifier, err := cryptutils.GenerateSplitToken()
+	if err != nil {
+		t.Errorf("Error generating split token: %v", err)
+	}
+
+	// Create access auth tokens issued before the selectors, one of them expired, and one with a selector
+	now := time.Now()
+	expiration := now.Add(time.Hour).Unix()
+	for _, auth_token := range []*AuthToken{
+		{Hashed_Token: hashed_token, User: user, Type: constants.ACCESS_TOKEN, Expiration: expiration},
+		{Hashed_Token: hashed_expired_token, User: user, Type: constants.ACCESS_TOKEN, Expiration: now.Add(-time.Hour).Unix()},
+		{Selector: &selector, Hashed_Token: hashed_verifier, User: user, Type: constants.ACCESS_TOKEN, Expiration: expiration},
+	} {
+		err = auth_token.CreateAuthToken(db)
+		if err != nil {
+			t.Errorf("Error creating access auth token: %v", err)
+		}
+	}
 
-	db, err := OpenConnection()
+	// Only the unexpired token without selector is a legacy token, and it matches its raw value
+	tokens, err := user.GetUserLegacyTokensByType(db, constants.ACCESS_TOKEN, now, constants.LEGACY_TOKENS_SCAN_LIMIT)
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("Error retrieving legacy tokens: got %d tokens (%v)", len(tokens), err)
+	}
+	if !tokens[0].MatchesLegacyToken(raw_token) || tokens[0].MatchesVerifier(raw_token) {
+		t.Errorf("Error checking if legacy token matches its raw value")
+	}
+
+	// The newest legacy tokens are retrieved first, up to the limit
+	err = (&AuthToken{Hashed_Token: hashed_newer_token, User: user, Type: constants.ACCESS_TOKEN, Expiration: expiration}).CreateAuthToken(db)
 	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
+		t.Errorf("Error creating access auth token: %v", err)
 	}
-	defer CloseConnection(db)
+	tokens, err = user.GetUserLegacyTokensByType(db, constants.ACCESS_TOKEN, now, 1)
+	if err != nil || len(tokens) != 1 || !tokens[0].MatchesLegacyToken(raw_newer_token) {
+		t.Errorf("Error retrieving the newest legacy token: got %d tokens (%v)", len(tokens), err)
+	}
+
+	// None is left once they all expired
+	tokens, err = user.GetUserLegacyTokensByType(db, constants.ACCESS_TOKEN, now.Add(2*time.Hour), constants.LEGACY_TOKENS_SCAN_LIMIT)
+	if err != nil || len(tokens) != 0 {
+		t.Errorf("Error retrieving expired legacy tokens: got %d tokens (%v)", len(tokens), err)
+	}
+}
+
+func TestUpdateAuthToken(t *testing.T) {
+
+	db := test_db
+	var err error
 
 	// Create a user for the auth token
 	user := &User{
@@ -335,11 +394,8 @@ func TestUpdateAuthToken(t *testing.T) {
 
 func TestDeleteAuthToken(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the auth token
 	user := &User{
@@ -379,11 +435,8 @@ func TestDeleteAuthToken(t *testing.T) {
 
 func TestDeleteAuthTokens(t *testing.T) {
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection to the database: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	// Create a user for the auth tokens
 	user := &User{
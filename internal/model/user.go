@@ -2,8 +2,10 @@ package db_model
 
 import (
 	"mime/multipart"
+	"slices"
 	"time"
 
+	"github.com/boxboxjason/jukebox/internal/constants"
 	"github.com/boxboxjason/jukebox/pkg/utils/cryptutils"
 	"gorm.io/gorm"
 )
@@ -13,12 +15,21 @@ type User struct {
 	Username           string       `gorm:"type:TEXT;unique;not null" json:"username"`
 	Hashed_Password    string       `gorm:"type:TEXT;not null" json:"-"`
 	Email              string       `gorm:"type:TEXT;unique;not null" json:"-"`
+	VerifiedEmail      bool         `gorm:"type:BOOLEAN;not null;default:false" json:"verified_email"`
 	Avatar             string       `gorm:"type:TEXT;default:'default_avatar.png'" json:"avatar"`
-	Admin              bool         `gorm:"type:BOOLEAN;not null;default:false" json:"admin"`
+	Role               string       `gorm:"type:TEXT;not null;default:'user'" json:"role"`
 	Banned             bool         `gorm:"type:BOOLEAN;not null;default:false" json:"banned"`
 	TotalContributions int          `gorm:"type:INTEGER;not null;default:0" json:"total_contributions"`
 	MinutesListened    int          `gorm:"type:INTEGER;not null;default:0" json:"minutes_listened"`
 	Subscriber_Tier    int          `gorm:"type:INTEGER;not null;default:0" json:"subscriber_tier"`
+	DeletionDueAt      *time.Time   `gorm:"index;default:null" json:"-"`
+	DeletionMode       string       `gorm:"type:TEXT;not null;default:''" json:"-"`
+	TOTPSecret         string       `gorm:"type:TEXT;not null;default:''" json:"-"`
+	TOTPEnabled        bool         `gorm:"type:BOOLEAN;not null;default:false" json:"two_factor_enabled"`
+	TOTPLastStep       int64        `gorm:"type:BIGINT;not null;default:0" json:"-"`
+	RecoveryCodes      string       `gorm:"type:TEXT;not null;default:''" json:"-"`
+	FailedLogins       int          `gorm:"type:INTEGER;not null;default:0" json:"-"`
+	LockedUntil        *time.Time   `gorm:"default:null" json:"-"`
 	Messages           []*Message   `gorm:"foreignKey:SenderID" json:"-"`
 	Tokens             []*AuthToken `gorm:"foreignKey:UserID" json:"-"`
 	Bans               []*Ban       `gorm:"foreignKey:TargetID" json:"-"`
@@ -45,12 +56,13 @@ type UsersGetRequestParams struct {
 	PartialUsername []string `json:"partial_username"`
 	ID              []int    `json:"id"`
 	SubscriberTier  int      `json:"subscriber_tier"`
-	Admin           []bool   `json:"admin"`
+	Role            []string `json:"role"`
 	Email           []string `json:"email"`
 }
 
 // UsersDeleteRequestParams is the struct for the request body of the DELETE users endpoint
 type UsersDeleteRequestParams struct {
+	Mode     string   `json:"mode"`
 	Order    string   `json:"order"`
 	Limit    int      `json:"limit"`
 	Page     int      `json:"page"`
@@ -68,7 +80,6 @@ type UsersPatchRequestParams struct {
 	Email          string `json:"email"`
 	Password       string `json:"password"`
 	SubscriberTier int    `json:"subscriber_tier"`
-	Admin          []bool `json:"admin"`
 	Avatar         string `json:"avatar"`
 }
 
@@ -79,7 +90,6 @@ type UsersRawPatchRequestParams struct {
 	Email          string         `json:"email"`
 	Password       string         `json:"password"`
 	SubscriberTier int            `json:"subscriber_tier"`
-	Admin          []bool         `json:"admin"`
 	Avatar         multipart.File `json:"avatar"`
 }
 
@@ -129,7 +139,7 @@ func GetUserByUsernameOREmail(db *gorm.DB, username_or_email string) (*User, err
 // GetUsersByUsername retrieves all users which username partially matches the given username
 func GetUsersByUsername(db *gorm.DB, username string) ([]*User, error) {
 	users := []*User{}
-	err := db.Where("username LIKE ?", "%"+username+"%").Find(&users).Error
+	err := db.Where(containsCondition("username"), containsPattern(username)).Find(&users).Error
 	return users, err
 }
 
@@ -165,7 +175,7 @@ func GetUsersByFilters(db *gorm.DB, query_params *UsersGetRequestParams) ([]*Use
 	// Partial usernames
 	if len(query_params.PartialUsername) > 0 {
 		for _, partial_username := range query_params.PartialUsername {
-			orConditions = orConditions.Or("username LIKE ?", "%"+partial_username+"%")
+			orConditions = orConditions.Or(containsCondition("username"), containsPattern(partial_username))
 		}
 	}
 
@@ -173,8 +183,8 @@ func GetUsersByFilters(db *gorm.DB, query_params *UsersGetRequestParams) ([]*Use
 	query = query.Where(orConditions)
 
 	// Apply the remaining "AND" filters
-	if len(query_params.Admin) == 1 {
-		query = query.Where("admin = ?", query_params.Admin[0])
+	if len(query_params.Role) > 0 {
+		query = query.Where("role IN ?", query_params.Role)
 	}
 	if query_params.SubscriberTier > 0 {
 		query = query.Where("subscriber_tier >= ?", query_params.SubscriberTier)
@@ -192,6 +202,26 @@ func (user *User) IsSubscriber() bool {
 	return user.Subscriber_Tier > 0
 }
 
+// HasPermission checks if a user can use a permission of its role, the privileged users may be required to enable two-factor authentication first
+func (user *User) HasPermission(permission string) bool {
+	return RoleHasPermission(user.Role, permission) && (user.TOTPEnabled || !constants.REQUIRE_ADMIN_TWO_FACTOR)
+}
+
+// Outranks checks if the role of a user is above the role of another user
+func (user *User) Outranks(other *User) bool {
+	return RoleRank(user.Role) > RoleRank(other.Role)
+}
+
+// RoleHasPermission checks if a role grants a permission
+func RoleHasPermission(role string, permission string) bool {
+	return slices.Contains(constants.ROLE_PERMISSIONS[role], permission)
+}
+
+// RoleRank returns the rank of a role, the higher the more privileged, or -1 for an unknown role
+func RoleRank(role string) int {
+	return slices.Index(constants.ROLES, role)
+}
+
 func (user *User) CheckPasswordMatches(password string) bool {
 	return cryptutils.CompareHashAndString(user.Hashed_Password, password)
 }
@@ -203,9 +233,65 @@ func (user *User) UpdateUser(db *gorm.DB) error {
 	return db.Save(user).Error
 }
 
+// IncreaseContributionsCount increments the contributions count of the user in place, without saving its other fields
 func (user *User) IncreaseContributionsCount(db *gorm.DB) error {
+	err := db.Model(&User{}).Where("id = ?", user.ID).UpdateColumn("total_contributions", gorm.Expr("total_contributions + 1")).Error
+	if err != nil {
+		return err
+	}
 	user.TotalContributions++
-	return db.Save(user).Error
+	return nil
+}
+
+// RecordLoginFailure counts a failed login of the user in a single update, so that the concurrent failures are all counted,
+// and locks the user out until now + lockout once the count reaches the threshold (never if 0)
+// The lockout runs at least until the last failure, the count starts over once the user stayed unlocked for the lockout duration
+// The count and the lockout are then read back
+func (user *User) RecordLoginFailure(db *gorm.DB, threshold int, lockout time.Duration, now time.Time) error {
+	now = now.UTC()
+	failures := gorm.Expr("CASE WHEN locked_until IS NOT NULL AND locked_until >= ? THEN failed_logins + 1 ELSE 1 END", now.Add(-lockout))
+	locked_until := gorm.Expr("CASE WHEN locked_until IS NULL OR locked_until < ? THEN ? ELSE locked_until END", now, now)
+	if threshold > 0 {
+		locked_until = gorm.Expr("CASE WHEN ? >= ? THEN ? ELSE ? END", failures, threshold, now.Add(lockout), locked_until)
+	}
+	err := db.Model(&User{}).Where("id = ?", user.ID).UpdateColumns(map[string]interface{}{"failed_logins": failures, "locked_until": locked_until}).Error
+	if err != nil {
+		return err
+	}
+	return user.reloadLoginFailures(db)
+}
+
+// DelayLogins refuses the logins of the user until the given time, unless it is already locked out for longer
+func (user *User) DelayLogins(db *gorm.DB, until time.Time) error {
+	until = until.UTC()
+	err := db.Model(&User{}).Where("id = ? AND (locked_until IS NULL OR locked_until < ?)", user.ID, until).UpdateColumn("locked_until", until).Error
+	if err != nil {
+		return err
+	}
+	return user.reloadLoginFailures(db)
+}
+
+// ResetLoginFailures forgets the failed logins and the lockout of the user, without saving its other fields
+func (user *User) ResetLoginFailures(db *gorm.DB) error {
+	err := db.Model(&User{}).Where("id = ?", user.ID).UpdateColumns(map[string]interface{}{"failed_logins": 0, "locked_until": nil}).Error
+	if err != nil {
+		return err
+	}
+	user.FailedLogins = 0
+	user.LockedUntil = nil
+	return nil
+}
+
+// reloadLoginFailures reads the failed logins count and the lockout of the user back from the database
+func (user *User) reloadLoginFailures(db *gorm.DB) error {
+	stored_user := &User{}
+	err := db.Select("id", "failed_logins", "locked_until").Where("id = ?", user.ID).First(stored_user).Error
+	if err != nil {
+		return err
+	}
+	user.FailedLogins = stored_user.FailedLogins
+	user.LockedUntil = stored_user.LockedUntil
+	return nil
 }
 
 // UpdateUsers updates multiple users in the database
@@ -220,6 +306,13 @@ func (user *User) DeleteUser(db *gorm.DB) error {
 	return db.Delete(user).Error
 }
 
+// GetUsersWithDeletionDue retrieves the users whose requested deletion is due at the given time, the most overdue first
+func GetUsersWithDeletionDue(db *gorm.DB, due_at time.Time) ([]*User, error) {
+	var users []*User
+	err := db.Where("deletion_due_at IS NOT NULL AND deletion_due_at <= ?", due_at.UTC()).Order("deletion_due_at asc, id asc").Find(&users).Error
+	return users, err
+}
+
 // DeleteUsers deletes multiple users from the database
 func DeleteUsers(db *gorm.DB, users []*User) error {
 	return db.Delete(users).Error
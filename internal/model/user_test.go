@@ -13,11 +13,8 @@ func TestUserCreate(t *testing.T) {
 		Email:           "test_email_1@test.com",
 		Hashed_Password: "hashed_password",
 	}
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	err = user.CreateUser(db)
 	if err != nil {
@@ -38,11 +35,8 @@ func TestUsersCreate(t *testing.T) {
 		Hashed_Password: "hashed_password",
 	}
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	err = CreateUsers(db, []*User{user1, user2})
 	if err != nil {
@@ -57,11 +51,8 @@ func TestGetUserById(t *testing.T) {
 		Email:           "test_email_4@test.com",
 		Hashed_Password: "hashed_password",
 	}
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	err = user.CreateUser(db)
 	if err != nil {
@@ -94,11 +85,8 @@ func TestGetUserByUsername(t *testing.T) {
 		Email:           "test_email_5@test.com",
 		Hashed_Password: "hashed_password",
 	}
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	err = user.CreateUser(db)
 	if err != nil {
@@ -131,11 +119,8 @@ func TestGetUserByEmail(t *testing.T) {
 		Email:           "test_email_6@test.com",
 		Hashed_Password: "hashed_password",
 	}
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	err = user.CreateUser(db)
 	if err != nil {
@@ -168,11 +153,8 @@ func TestGetUserByUsernameOREmail(t *testing.T) {
 		Email:           "test_email_7@test.com",
 		Hashed_Password: "hashed_password",
 	}
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	err = user.CreateUser(db)
 	if err != nil {
@@ -229,11 +211,8 @@ func TestGetUsersByUsername(t *testing.T) {
 		Hashed_Password: "hashed_password",
 	}
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	err = CreateUsers(db, []*User{user1, user2})
 	if err != nil {
@@ -251,6 +230,44 @@ func TestGetUsersByUsername(t *testing.T) {
 	}
 }
 
+func TestGetUsersByUsernameMatching(t *testing.T) {
+	// Create users whose usernames only differ by case and wildcard characters
+	user1 := &User{
+		Username:        "Percent%User",
+		Email:           "test_email_17@test.com",
+		Hashed_Password: "hashed_password",
+	}
+	user2 := &User{
+		Username:        "PercentXUser",
+		Email:           "test_email_18@test.com",
+		Hashed_Password: "hashed_password",
+	}
+
+	db := test_db
+	err := CreateUsers(db, []*User{user1, user2})
+	if err != nil {
+		t.Errorf("Error creating users: %v", err)
+	}
+
+	// The search is case insensitive
+	retrieved_users, err := GetUsersByUsername(db, "percentxuser")
+	if err != nil {
+		t.Errorf("Error retrieving users: %v", err)
+	}
+	if len(retrieved_users) != 1 || retrieved_users[0].ID != user2.ID {
+		t.Errorf("Expected only user %s, got %d users", user2.Username, len(retrieved_users))
+	}
+
+	// The wildcards are matched literally
+	retrieved_users, err = GetUsersByUsername(db, "t%u")
+	if err != nil {
+		t.Errorf("Error retrieving users: %v", err)
+	}
+	if len(retrieved_users) != 1 || retrieved_users[0].ID != user1.ID {
+		t.Errorf("Expected only user %s, got %d users", user1.Username, len(retrieved_users))
+	}
+}
+
 func TestGetAllUsers(t *testing.T) {
 	// Create a new user
 	user1 := &User{
@@ -264,11 +281,8 @@ func TestGetAllUsers(t *testing.T) {
 		Hashed_Password: "hashed_password",
 	}
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	err = CreateUsers(db, []*User{user1, user2})
 	if err != nil {
@@ -293,11 +307,8 @@ func TestUserUpdate(t *testing.T) {
 		Email:           "test_user_12@gmail.com",
 		Hashed_Password: "hashed_password",
 	}
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	err = user.CreateUser(db)
 	if err != nil {
@@ -329,11 +340,8 @@ func TestUserDelete(t *testing.T) {
 		Email:           "test_user_13@gmail.com",
 		Hashed_Password: "hashed_password",
 	}
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	err = user.CreateUser(db)
 	if err != nil {
@@ -366,11 +374,8 @@ func TestUsersDelete(t *testing.T) {
 		Hashed_Password: "hashed_password",
 	}
 
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
+	var err error
 
 	err = CreateUsers(db, []*User{user1, user2})
 	if err != nil {
@@ -410,11 +415,7 @@ func TestCheckPasswordMatches(t *testing.T) {
 		Email:           "test_user_16@gmail.com",
 		Hashed_Password: hashed_password,
 	}
-	db, err := OpenConnection()
-	if err != nil {
-		t.Errorf("Error opening connection: %v", err)
-	}
-	defer CloseConnection(db)
+	db := test_db
 
 	err = user.CreateUser(db)
 	if err != nil {
@@ -1,6 +1,30 @@
 package db_model
 
-import "gorm.io/gorm"
+import (
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// likeEscaper escapes the LIKE wildcards so that user input is matched literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// currentTime returns the current time in UTC, the timezone every timestamp is stored in
+func currentTime() time.Time {
+	return time.Now().UTC()
+}
+
+// containsCondition returns a case insensitive "column contains value" condition
+// that behaves the same on every supported driver, to be used with containsPattern
+func containsCondition(column string) string {
+	return "LOWER(" + column + ") LIKE ? ESCAPE '\\'"
+}
+
+// containsPattern returns the LIKE pattern matching the columns containing the value
+func containsPattern(value string) string {
+	return "%" + likeEscaper.Replace(strings.ToLower(value)) + "%"
+}
 
 // AddQueryParamsToDB adds ordering, pagination, and other common query parameters to a GORM query.
 func AddQueryParamsToDB(query *gorm.DB, order string, limit, page, offset int) *gorm.DB {
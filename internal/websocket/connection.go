@@ -2,22 +2,46 @@ package websocket
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/boxboxjason/jukebox/internal/constants"
+	"github.com/boxboxjason/jukebox/internal/middlewares"
 	db_model "github.com/boxboxjason/jukebox/internal/model"
 	"github.com/boxboxjason/jukebox/pkg/logger"
 	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
 	"github.com/coder/websocket"
+	"gorm.io/gorm"
 )
 
 const (
 	PING_INTERVAL       = 10 * time.Minute
 	PONG_TIMEOUT        = 10 * time.Second
 	AUTH_CHECK_INTERVAL = 5 * time.Minute
+	SHUTDOWN_NOTICE     = "server restarting"
+	REVOKED_NOTICE      = "session revoked"
 )
 
+// origin_patterns are the hosts of the other origins whose pages may open a websocket, the pages of the server itself always may
+var origin_patterns []string
+
+// SetupAllowedOrigins lets the pages of the allowed origins open a websocket, besides the pages served by the server itself
+// The websocket is authenticated with the auth cookie and outside of the CSRF protection of the API, so the wildcard origin
+// allowing any site to call the API is ignored: a page of any site could otherwise post messages as its visitors
+func SetupAllowedOrigins(allowed_origins []string) {
+	patterns := []string{}
+	for _, origin := range allowed_origins {
+		parsed_origin, err := url.Parse(origin)
+		if origin == "*" || err != nil || len(parsed_origin.Host) == 0 {
+			continue
+		}
+		patterns = append(patterns, parsed_origin.Host)
+	}
+	origin_patterns = patterns
+}
+
 // EstablishConnection establishes a websocket connection with the client and listens for incoming messages
 func EstablishConnection(w http.ResponseWriter, r *http.Request) {
 	user, ok := r.Context().Value(constants.USER_CONTEXT_KEY).(*db_model.User)
@@ -26,21 +50,33 @@ func EstablishConnection(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, ok = r.Context().Value(constants.ACCESS_TOKEN_CONTEXT_KEY).(*db_model.AuthToken)
-	if !ok {
+	// The connection is opened with an access token, or with an API token which may only be allowed to read
+	access_token_id := 0
+	can_write := true
+	if api_token, ok := r.Context().Value(constants.API_TOKEN_CONTEXT_KEY).(*db_model.APIToken); ok {
+		can_write = api_token.HasScope(constants.SCOPE_MESSAGES_WRITE)
+	} else if access_token, ok := r.Context().Value(constants.ACCESS_TOKEN_CONTEXT_KEY).(*db_model.AuthToken); ok {
+		access_token_id = access_token.ID
+	} else {
 		httputils.SendErrorToClient(w, httputils.NewUnauthorizedError("access token not found"))
 		return
 	}
 
-	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+	store, err := middlewares.RetrieveStore(r)
+	if err != nil {
+		httputils.SendErrorToClient(w, err)
+		return
+	}
+
+	// The upgrade is refused to the pages of the other origins, Accept answers the client itself
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: origin_patterns})
 	if err != nil {
 		logger.Error("failed to upgrade connection to websocket", err)
-		httputils.SendErrorToClient(w, httputils.NewInternalServerError("websocket connection upgrade failed"))
 		return
 	}
 	defer conn.Close(websocket.StatusNormalClosure, "websocket connection closed")
 
-	connectionPool.Add(conn, user)
+	connectionPool.Add(conn, user, access_token_id)
 	defer connectionPool.Remove(conn)
 
 	ctx, cancel := context.WithCancel(r.Context())
@@ -49,20 +85,20 @@ func EstablishConnection(w http.ResponseWriter, r *http.Request) {
 	pongReceived := make(chan bool, 1)
 
 	// Start authentication check goroutine
-	go monitorAuthToken(ctx, cancel, conn, r)
+	go monitorAuthToken(ctx, cancel, conn, r, store)
 
 	// Start ping-pong mechanism goroutine
 	go managePingPong(ctx, cancel, conn, pongReceived)
 
 	// Start listening for messages in a separate goroutine
-	go listenForMessages(ctx, conn, user)
+	go listenForMessages(ctx, cancel, conn, user, store, can_write)
 
 	// Block until context is canceled
 	<-ctx.Done()
 }
 
-// monitorAuthToken checks the validity of the access token periodically
-func monitorAuthToken(ctx context.Context, cancel context.CancelFunc, conn *websocket.Conn, r *http.Request) {
+// monitorAuthToken checks the validity of the access (or API) token periodically, it may have expired or been revoked
+func monitorAuthToken(ctx context.Context, cancel context.CancelFunc, conn *websocket.Conn, r *http.Request, store *db_model.Store) {
 	ticker := time.NewTicker(AUTH_CHECK_INTERVAL)
 	defer ticker.Stop()
 
@@ -71,13 +107,36 @@ func monitorAuthToken(ctx context.Context, cancel context.CancelFunc, conn *webs
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
+			if apiToken, ok := r.Context().Value(constants.API_TOKEN_CONTEXT_KEY).(*db_model.APIToken); ok {
+				_, err := store.APITokens.GetByID(apiToken.ID)
+				if apiToken.IsExpired() || errors.Is(err, gorm.ErrRecordNotFound) {
+					logger.Info("API token expired or revoked, closing connection")
+					conn.Close(websocket.StatusPolicyViolation, REVOKED_NOTICE)
+					cancel()
+					return
+				}
+				continue
+			}
 			accessToken, ok := r.Context().Value(constants.ACCESS_TOKEN_CONTEXT_KEY).(*db_model.AuthToken)
-			if !ok || accessToken.IsExpired() {
-				logger.Error("Access token expired or not found, closing connection")
+			if !ok {
+				logger.Error("Access token not found, closing connection")
 				conn.Close(websocket.StatusPolicyViolation, "access token expired or not found")
 				cancel() // Cancel all goroutines
 				return
 			}
+			// The stored token is refreshed in place, the connection lives as long as its session is refreshed
+			stored_token, err := store.Tokens.GetByID(accessToken.ID)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				logger.Info("Access token revoked, closing connection")
+				conn.Close(websocket.StatusPolicyViolation, REVOKED_NOTICE)
+				cancel()
+				return
+			} else if err == nil && stored_token.IsExpired() {
+				logger.Error("Access token expired, closing connection")
+				conn.Close(websocket.StatusPolicyViolation, "access token expired or not found")
+				cancel()
+				return
+			}
 		}
 	}
 }
@@ -112,8 +171,9 @@ func managePingPong(ctx context.Context, cancel context.CancelFunc, conn *websoc
 	}
 }
 
-// listenForMessages handles incoming messages from the websocket
-func listenForMessages(ctx context.Context, conn *websocket.Conn, user *db_model.User) {
+// listenForMessages handles incoming messages from the websocket, until the connection is closed
+// The messages are refused when the connection may only read the chat (API token without the messages:write scope)
+func listenForMessages(ctx context.Context, cancel context.CancelFunc, conn *websocket.Conn, user *db_model.User, store *db_model.Store, can_write bool) {
 	for {
 		select {
 		case <-ctx.Done():
@@ -121,12 +181,41 @@ func listenForMessages(ctx context.Context, conn *websocket.Conn, user *db_model
 		default:
 			typ, msg, err := conn.Read(ctx)
 			if err != nil {
-				continue // continue the loop to keep the connection alive
+				// A failed read closes the connection, cancel all goroutines
+				cancel()
+				return
+			}
+			var processedMessage []byte
+			if can_write {
+				processedMessage, err = processWebsocketMessage(store, typ, msg, user)
+			} else {
+				err = httputils.NewForbiddenError("The API token lacks the " + constants.SCOPE_MESSAGES_WRITE + " scope")
 			}
-			processedMessage, err := processWebsocketMessage(typ, msg, user)
 			if err == nil {
 				connectionPool.Broadcast(ctx, processedMessage)
+			} else if http_error, ok := err.(httputils.HTTPError); ok {
+				// Tell the sender why its message was refused
+				notice, err := newNoticeMessage(http_error.Error())
+				if err == nil {
+					conn.Write(ctx, websocket.MessageText, notice)
+				}
 			}
 		}
 	}
 }
+
+// CloseSessions closes the connections opened with the access tokens of revoked sessions
+func CloseSessions(access_token_ids []int) {
+	connectionPool.CloseSessions(access_token_ids, websocket.StatusPolicyViolation, REVOKED_NOTICE)
+}
+
+// Shutdown warns every client that the server is restarting, then closes their connection until the context is done
+func Shutdown(ctx context.Context) error {
+	notice, err := newNoticeMessage(SHUTDOWN_NOTICE)
+	if err != nil {
+		return err
+	}
+	connectionPool.Broadcast(ctx, notice)
+
+	return connectionPool.CloseAll(ctx, websocket.StatusServiceRestart, SHUTDOWN_NOTICE)
+}
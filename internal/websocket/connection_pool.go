@@ -13,21 +13,27 @@ var connectionPool = NewConnectionPool()
 // ConnectionPool struct to manage connections thread-safely
 type ConnectionPool struct {
 	mu          sync.RWMutex
-	connections map[*websocket.Conn]*db_model.User
+	connections map[*websocket.Conn]*poolEntry
+}
+
+// poolEntry is the user of a connection and the ID of the access token it was opened with
+type poolEntry struct {
+	user            *db_model.User
+	access_token_id int
 }
 
 // NewConnectionPool creates a new ConnectionPool
 func NewConnectionPool() *ConnectionPool {
 	return &ConnectionPool{
-		connections: make(map[*websocket.Conn]*db_model.User),
+		connections: make(map[*websocket.Conn]*poolEntry),
 	}
 }
 
-// Add adds a connection to the ConnectionPool
-func (cp *ConnectionPool) Add(conn *websocket.Conn, user *db_model.User) {
+// Add adds a connection opened with the access token to the ConnectionPool
+func (cp *ConnectionPool) Add(conn *websocket.Conn, user *db_model.User, access_token_id int) {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
-	cp.connections[conn] = user
+	cp.connections[conn] = &poolEntry{user: user, access_token_id: access_token_id}
 }
 
 // Remove removes a connection from the ConnectionPool
@@ -41,7 +47,11 @@ func (cp *ConnectionPool) Remove(conn *websocket.Conn) {
 func (cp *ConnectionPool) GetUser(conn *websocket.Conn) *db_model.User {
 	cp.mu.RLock()
 	defer cp.mu.RUnlock()
-	return cp.connections[conn]
+	entry, ok := cp.connections[conn]
+	if !ok {
+		return nil
+	}
+	return entry.user
 }
 
 // Broadcast sends a message to all connections in the ConnectionPool
@@ -64,3 +74,57 @@ func (cp *ConnectionPool) CheckAlive(ctx context.Context) {
 		}
 	}
 }
+
+// CloseAll closes every connection with the status and the reason, waiting for the clients to acknowledge until the context is done
+func (cp *ConnectionPool) CloseAll(ctx context.Context, status websocket.StatusCode, reason string) error {
+	cp.mu.Lock()
+	connections := cp.connections
+	cp.connections = make(map[*websocket.Conn]*poolEntry)
+	cp.mu.Unlock()
+
+	return closeConnections(ctx, connections, status, reason)
+}
+
+// CloseSessions closes the connections opened with the access tokens, without waiting for the clients
+func (cp *ConnectionPool) CloseSessions(access_token_ids []int, status websocket.StatusCode, reason string) {
+	revoked := make(map[int]bool, len(access_token_ids))
+	for _, id := range access_token_ids {
+		revoked[id] = true
+	}
+
+	cp.mu.Lock()
+	connections := make(map[*websocket.Conn]*poolEntry)
+	for conn, entry := range cp.connections {
+		if revoked[entry.access_token_id] {
+			connections[conn] = entry
+			delete(cp.connections, conn)
+		}
+	}
+	cp.mu.Unlock()
+
+	go closeConnections(context.Background(), connections, status, reason)
+}
+
+// closeConnections closes the connections with the status and the reason, waiting for the clients to acknowledge until the context is done
+func closeConnections(ctx context.Context, connections map[*websocket.Conn]*poolEntry, status websocket.StatusCode, reason string) error {
+	closed := sync.WaitGroup{}
+	for conn := range connections {
+		closed.Add(1)
+		go func(conn *websocket.Conn) {
+			defer closed.Done()
+			conn.Close(status, reason)
+		}(conn)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		closed.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,55 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/coder/websocket"
+)
+
+func TestEstablishConnectionChecksOrigin(t *testing.T) {
+	SetupAllowedOrigins([]string{"*", "https://app.example"})
+	t.Cleanup(func() { SetupAllowedOrigins(nil) })
+
+	// Serve the websocket as an authenticated user, like behind the auth middleware
+	store := db_model.NewMemoryStore()
+	user := &db_model.User{Username: "test_user", Email: "test_user@test.com", Hashed_Password: "hash"}
+	err := store.Users.Create(user)
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), constants.USER_CONTEXT_KEY, user)
+		ctx = context.WithValue(ctx, constants.ACCESS_TOKEN_CONTEXT_KEY, &db_model.AuthToken{ID: 1, UserID: user.ID})
+		ctx = context.WithValue(ctx, constants.STORE_CONTEXT_KEY, store)
+		EstablishConnection(w, r.WithContext(ctx))
+	}))
+	t.Cleanup(server.Close)
+	dial := func(origin string) (*websocket.Conn, *http.Response, error) {
+		header := http.Header{}
+		if len(origin) > 0 {
+			header.Set("Origin", origin)
+		}
+		return websocket.Dial(context.Background(), "ws"+server.URL[len("http"):], &websocket.DialOptions{HTTPHeader: header})
+	}
+
+	// The pages of the other sites are refused, even if the API allows any origin
+	_, response, err := dial("https://evil.example")
+	if err == nil || response == nil || response.StatusCode != http.StatusForbidden {
+		t.Errorf("Error opening a websocket from another origin: expected status 403, got %v (%v)", response, err)
+	}
+
+	// Not the server itself, the allowed origins and the clients without origin
+	for _, origin := range []string{server.URL, "https://app.example", ""} {
+		conn, _, err := dial(origin)
+		if err != nil {
+			t.Errorf("Error opening a websocket from %q: %v", origin, err)
+			continue
+		}
+		conn.Close(websocket.StatusNormalClosure, "")
+	}
+}
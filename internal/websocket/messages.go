@@ -12,6 +12,7 @@ import (
 
 const (
 	MESSAGE_TYPE_DISPLAY = "display"
+	MESSAGE_TYPE_NOTICE  = "notice"
 	RAW_INCOMING_MESSAGE = "raw_incoming_message"
 )
 
@@ -20,7 +21,7 @@ type SenderWebSocket struct {
 	Username       string `json:"username"`
 	Avatar         string `json:"avatar"`
 	SubscriberTier int    `json:"subscriber_tier"`
-	Admin          bool   `json:"admin"`
+	Role           string `json:"role"`
 }
 
 type WebSocketMessage struct {
@@ -37,7 +38,7 @@ type WebsocketRawIncomingMessage struct {
 	Content string `json:"content"`
 }
 
-func processWebsocketMessage(message_type websocket.MessageType, message []byte, sender *db_model.User) ([]byte, error) {
+func processWebsocketMessage(store *db_model.Store, message_type websocket.MessageType, message []byte, sender *db_model.User) ([]byte, error) {
 	var processed_message []byte
 	if message_type == websocket.MessageText {
 		var incoming_message WebsocketRawIncomingMessage
@@ -47,7 +48,11 @@ func processWebsocketMessage(message_type websocket.MessageType, message []byte,
 			return nil, err
 		}
 		if incoming_message.Type == RAW_INCOMING_MESSAGE {
-			db_message, err := db_controller.CreateMessage(nil, &db_model.MessagesPostRequestParams{
+			// The email may have been verified since the connection was established
+			if !sender.VerifiedEmail {
+				refreshSender(store, sender)
+			}
+			db_message, err := db_controller.CreateMessage(store, &db_model.MessagesPostRequestParams{
 				Sender:  sender,
 				Message: incoming_message.Content,
 			})
@@ -67,7 +72,7 @@ func processWebsocketMessage(message_type websocket.MessageType, message []byte,
 					Username:       sender.Username,
 					Avatar:         sender.Avatar,
 					SubscriberTier: sender.Subscriber_Tier,
-					Admin:          sender.Admin,
+					Role:           sender.Role,
 				},
 				CreatedAt:  db_message.CreatedAt,
 				ModifiedAt: db_message.ModifiedAt,
@@ -82,3 +87,21 @@ func processWebsocketMessage(message_type websocket.MessageType, message []byte,
 	}
 	return processed_message, nil
 }
+
+// refreshSender reloads the verification state of the sender of a connection from the database
+func refreshSender(store *db_model.Store, sender *db_model.User) {
+	user, err := store.Users.GetByID(sender.ID)
+	if err != nil {
+		return
+	}
+	sender.VerifiedEmail = user.VerifiedEmail
+}
+
+// newNoticeMessage returns a notice message, displayed by the clients as is
+func newNoticeMessage(content string) ([]byte, error) {
+	return json.Marshal(WebSocketMessage{
+		Type:      MESSAGE_TYPE_NOTICE,
+		Content:   content,
+		CreatedAt: time.Now().UTC(),
+	})
+}
@@ -0,0 +1,61 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	db_model "github.com/boxboxjason/jukebox/internal/model"
+	"github.com/coder/websocket"
+)
+
+func TestProcessWebsocketMessageRequiresVerifiedEmail(t *testing.T) {
+	previous_threshold := prompt_threshold
+	prompt_threshold = 100
+	t.Cleanup(func() {
+		prompt_threshold = previous_threshold
+		emptyMessageStack()
+	})
+
+	store := db_model.NewMemoryStore()
+	sender := &db_model.User{Username: "test_user", Email: "test_user@test.com", Hashed_Password: "hash"}
+	err := store.Users.Create(sender)
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	message, _ := json.Marshal(WebsocketRawIncomingMessage{Type: RAW_INCOMING_MESSAGE, Content: "more drums"})
+
+	// Unverified users can only read the chat
+	_, err = processWebsocketMessage(store, websocket.MessageText, message, sender)
+	if err == nil {
+		t.Fatalf("Error processing message: unverified sender allowed to post")
+	}
+
+	// The verification is picked up without reconnecting
+	stored_sender, _ := store.Users.GetByID(sender.ID)
+	stored_sender.VerifiedEmail = true
+	err = store.Users.Update(stored_sender)
+	if err != nil {
+		t.Fatalf("Error verifying user: %v", err)
+	}
+	processed_message, err := processWebsocketMessage(store, websocket.MessageText, message, sender)
+	if err != nil {
+		t.Fatalf("Error processing message: %v", err)
+	}
+	// The message is queued for the music generator in the background
+	queued := 0
+	for deadline := time.Now().Add(time.Second); queued == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		mu_message_stack.Lock()
+		queued = len(current_message_stack)
+		mu_message_stack.Unlock()
+	}
+	if queued != 1 {
+		t.Errorf("Error processing message: expected the message to be queued, got %d queued messages", queued)
+	}
+
+	display_message := WebSocketMessage{}
+	err = json.Unmarshal(processed_message, &display_message)
+	if err != nil || display_message.Type != MESSAGE_TYPE_DISPLAY || display_message.Content != "more drums" {
+		t.Errorf("Error processing message: unexpected display message %s (%v)", processed_message, err)
+	}
+}
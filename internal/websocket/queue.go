@@ -1,6 +1,7 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
 	"math/rand"
 	"os"
@@ -8,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/boxboxjason/jukebox/internal/constants"
 	"github.com/boxboxjason/jukebox/pkg/logger"
 	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
 )
@@ -18,14 +20,20 @@ const (
 	MINIMUM_SEPARATOR_LENGTH  = 5
 	MAXIMUM_SEPARATOR_LENGTH  = 15
 	RETRY_DELAY               = 5 * time.Second
-	PROMPT_INTERVAL           = 30 * time.Second
 )
 
 var (
 	current_message_stack = []string{}
 	mu_message_stack      = sync.RWMutex{}
-	MUSIC_GENERATOR_URL   = os.Getenv("MUSIC_GENERATOR_URL")
 	prompt_lock           = sync.Mutex{}
+	// Prompt queue settings, set by SetupPromptQueue
+	music_generator_url = ""
+	prompt_interval     = constants.PROMPT_INTERVAL
+	prompt_threshold    = constants.PROMPT_THRESHOLD
+	// stop_prompts stops watching the prompts on shutdown, prompt_watcher holds the watcher until it returned
+	stop_prompts   = make(chan struct{})
+	stop_once      sync.Once
+	prompt_watcher sync.WaitGroup
 )
 
 type MusicGeneratorRequest struct {
@@ -33,16 +41,94 @@ type MusicGeneratorRequest struct {
 	Duration int    `json:"duration,omitempty"`
 }
 
-func init() {
+// SetupPromptQueue sets where and how often the chat messages are sent, then starts watching the prompts
+// The pending messages are sent once there are threshold of them, or every interval
+// The messages persisted by the last shutdown are queued again
+func SetupPromptQueue(generator_url string, interval time.Duration, threshold int) {
+	music_generator_url = generator_url
+	prompt_interval = interval
+	prompt_threshold = threshold
+
+	err := restorePrompts()
+	if err != nil {
+		logger.Error("Failed to restore the chat messages of the last shutdown", err)
+	}
+
+	prompt_watcher.Add(1)
 	go watchPrompts()
 }
 
+// FlushPrompts stops watching the prompts, then sends the pending messages to the music generator
+// The messages that cannot be sent before the context is done are persisted, to be sent after the next start
+func FlushPrompts(ctx context.Context) error {
+	stop_once.Do(func() { close(stop_prompts) })
+	prompt_watcher.Wait()
+
+	mu_message_stack.RLock()
+	pending := append([]string{}, current_message_stack...)
+	mu_message_stack.RUnlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- sendPrompt()
+	}()
+	select {
+	case err := <-sent:
+		if err == nil {
+			return nil
+		}
+		logger.Error("Failed to flush the chat messages to the music generator", err)
+	case <-ctx.Done():
+	}
+	return persistPrompts(pending)
+}
+
+// persistPrompts writes the messages to the prompts file
+func persistPrompts(messages []string) error {
+	content, err := json.Marshal(messages)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(constants.PROMPTS_FILE, content, 0600)
+	if err != nil {
+		return err
+	}
+	logger.Info("Persisted", len(messages), "chat messages to", constants.PROMPTS_FILE)
+	return nil
+}
+
+// restorePrompts queues the messages of the prompts file, then deletes it
+func restorePrompts() error {
+	content, err := os.ReadFile(constants.PROMPTS_FILE)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	messages := []string{}
+	err = json.Unmarshal(content, &messages)
+	if err != nil {
+		return err
+	}
+	mu_message_stack.Lock()
+	current_message_stack = append(messages, current_message_stack...)
+	mu_message_stack.Unlock()
+	logger.Info("Restored", len(messages), "chat messages of the last shutdown")
+
+	return os.Remove(constants.PROMPTS_FILE)
+}
+
 // addMessage adds a message to the current message stack
 func addMessage(message string) {
 	mu_message_stack.Lock()
 	current_message_stack = append(current_message_stack, message)
+	threshold_reached := len(current_message_stack) >= prompt_threshold
 	mu_message_stack.Unlock()
-	if len(current_message_stack) >= 10 {
+	if threshold_reached {
 		sendPrompt()
 	}
 }
@@ -76,7 +162,7 @@ func sendPrompt() error {
 		return err
 	}
 	logger.Debug("Sending prompt to music generator")
-	err = httputils.RetryRequest(MUSIC_GENERATOR_URL, jsonData, 5, 3)
+	err = httputils.RetryRequest(music_generator_url, jsonData, 5, 3)
 	if err != nil {
 		return err
 	}
@@ -86,11 +172,18 @@ func sendPrompt() error {
 }
 
 // watchPrompts watches the current message stack and sends prompts to the music generator
-// when either the stack reaches 10 messages OR the interval is reached
+// when either the stack reaches the threshold OR the interval is reached
 func watchPrompts() {
-	ticker := time.NewTicker(PROMPT_INTERVAL)
+	defer prompt_watcher.Done()
+	ticker := time.NewTicker(prompt_interval)
 	defer ticker.Stop()
-	for range ticker.C {
+	for {
+		select {
+		case <-stop_prompts:
+			return
+		case <-ticker.C:
+		}
+
 		mu_message_stack.RLock()
 		if len(current_message_stack) > 0 {
 			mu_message_stack.RUnlock()
@@ -0,0 +1,45 @@
+package websocket
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boxboxjason/jukebox/internal/constants"
+)
+
+func TestFlushPromptsPersistsUnsentMessages(t *testing.T) {
+	previous_file := constants.PROMPTS_FILE
+	constants.PROMPTS_FILE = filepath.Join(t.TempDir(), "prompts.json")
+	t.Cleanup(func() {
+		constants.PROMPTS_FILE = previous_file
+		emptyMessageStack()
+	})
+
+	// The music generator is not configured, so the messages cannot be sent
+	music_generator_url = ""
+	current_message_stack = []string{"more drums", "slower"}
+	err := FlushPrompts(context.Background())
+	if err != nil {
+		t.Fatalf("Error flushing prompts: %v", err)
+	}
+	content, err := os.ReadFile(constants.PROMPTS_FILE)
+	if err != nil || !strings.Contains(string(content), "more drums") {
+		t.Fatalf("Error flushing prompts: messages not persisted (%v)", err)
+	}
+
+	// The persisted messages are queued again at the next start
+	emptyMessageStack()
+	err = restorePrompts()
+	if err != nil {
+		t.Fatalf("Error restoring prompts: %v", err)
+	}
+	if strings.Join(current_message_stack, ",") != "more drums,slower" {
+		t.Errorf("Error restoring prompts: expected the persisted messages, got %v", current_message_stack)
+	}
+	if _, err := os.Stat(constants.PROMPTS_FILE); !os.IsNotExist(err) {
+		t.Errorf("Error restoring prompts: prompts file kept")
+	}
+}
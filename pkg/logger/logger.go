@@ -24,6 +24,7 @@ var (
 	logLevel    int = 1 // Default log level: INFO
 	logFilePath string
 	loggerReady sync.WaitGroup
+	console     io.Writer = os.Stdout
 )
 
 // Log levels
@@ -35,18 +36,29 @@ const (
 	FATAL
 )
 
+// Map of log levels
+var logLevels = map[string]int{
+	"DEBUG":    DEBUG,
+	"INFO":     INFO,
+	"ERROR":    ERROR,
+	"CRITICAL": CRITICAL,
+	"FATAL":    FATAL,
+}
+
+// IsValidLevel checks if level is one of the log levels
+func IsValidLevel(level string) bool {
+	_, ok := logLevels[level]
+	return ok
+}
+
+// SetConsole sets where the logs are copied besides the log file (stdout by default), it must be called before SetupLogger
+func SetConsole(w io.Writer) {
+	console = w
+}
+
 func SetupLogger(logDir string, level string) {
 	var err error
 
-	// Map of log levels
-	logLevels := map[string]int{
-		"DEBUG":    DEBUG,
-		"INFO":     INFO,
-		"ERROR":    ERROR,
-		"CRITICAL": CRITICAL,
-		"FATAL":    FATAL,
-	}
-
 	if l, ok := logLevels[level]; ok {
 		logLevel = l
 	} else {
@@ -84,7 +96,7 @@ func asyncLogger() {
 	defer logWg.Done()
 	logWg.Add(1)
 
-	logger := log.New(io.MultiWriter(logFile, os.Stdout), "", log.Ldate|log.Ltime)
+	logger := log.New(io.MultiWriter(logFile, console), "", log.Ldate|log.Ltime)
 
 	// Signal that the logger is ready
 	loggerReady.Done()
@@ -1,6 +1,9 @@
 package cryptutils
 
-import "testing"
+import (
+	"encoding/base64"
+	"testing"
+)
 
 func TestHashString(t *testing.T) {
 	// Test the HashString function
@@ -52,3 +55,40 @@ func TestGenerateHashedToken(t *testing.T) {
 		t.Error("Hashed token does not match original token")
 	}
 }
+
+func TestGenerateSplitToken(t *testing.T) {
+	selector, verifier, hashed_verifier, err := GenerateSplitToken()
+	if err != nil {
+		t.Errorf("Error generating split token: %v", err)
+	}
+	if len(selector) == 0 || len(verifier) == 0 {
+		t.Error("Selector or verifier is empty")
+	}
+
+	if !CompareHashAndVerifier(hashed_verifier, verifier) {
+		t.Error("Hashed verifier does not match original verifier")
+	}
+	if CompareHashAndVerifier(hashed_verifier, selector) || CompareHashAndVerifier(hashed_verifier, "") {
+		t.Error("Hashed verifier matches another string")
+	}
+
+	other_selector, _, _, err := GenerateSplitToken()
+	if err != nil || other_selector == selector {
+		t.Errorf("Error generating another split token: got the same selector (%v)", err)
+	}
+}
+
+func TestGenerateURLSafeToken(t *testing.T) {
+	token, err := GenerateURLSafeToken(32)
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(decoded) != 32 {
+		t.Errorf("Error decoding token %q: got %d bytes (%v)", token, len(decoded), err)
+	}
+	other, _ := GenerateURLSafeToken(32)
+	if other == token {
+		t.Error("Two tokens are identical")
+	}
+}
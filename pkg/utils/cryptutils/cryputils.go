@@ -2,6 +2,10 @@ package cryptutils
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 
 	"github.com/boxboxjason/jukebox/pkg/logger"
 	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
@@ -45,3 +49,47 @@ func GenerateHashedToken() (string, string, error) {
 	}
 	return string(token), hashed_token, nil
 }
+
+// GenerateURLSafeToken generates a cryptographically secure token of the given size in bytes, encoded in base64url
+func GenerateURLSafeToken(size int) (string, error) {
+	token := make([]byte, size)
+	_, err := rand.Read(token)
+	if err != nil {
+		logger.Error("Unable to generate token", err)
+		return "", httputils.NewInternalServerError("Unable to generate token")
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// SELECTOR_SIZE and VERIFIER_SIZE are the sizes in bytes of the selector and of the verifier of the split tokens
+const (
+	SELECTOR_SIZE = 16
+	VERIFIER_SIZE = 32
+)
+
+// GenerateSplitToken generates a token made of a public selector, which locates the token, and of a secret verifier
+// Both are encoded in base64url, only the hash of the verifier is meant to be stored
+// Returns the selector, the verifier and the hash of the verifier
+func GenerateSplitToken() (string, string, string, error) {
+	random := make([]byte, SELECTOR_SIZE+VERIFIER_SIZE)
+	_, err := rand.Read(random)
+	if err != nil {
+		logger.Error("Unable to generate token", err)
+		return "", "", "", httputils.NewInternalServerError("Unable to generate token")
+	}
+	selector := base64.RawURLEncoding.EncodeToString(random[:SELECTOR_SIZE])
+	verifier := base64.RawURLEncoding.EncodeToString(random[SELECTOR_SIZE:])
+	return selector, verifier, HashVerifier(verifier), nil
+}
+
+// HashVerifier returns the hex encoded SHA-256 hash of a verifier
+// The verifiers are random, so unlike the passwords they do not need a slow hash
+func HashVerifier(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return hex.EncodeToString(hash[:])
+}
+
+// CompareHashAndVerifier compares a verifier with a hash from HashVerifier, in constant time
+func CompareHashAndVerifier(hashed_verifier string, verifier string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashed_verifier), []byte(HashVerifier(verifier))) == 1
+}
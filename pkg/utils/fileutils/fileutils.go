@@ -2,18 +2,56 @@ package fileutils
 
 import (
 	"archive/zip"
+	"fmt"
 	"io"
+	"io/fs"
 	"mime/multipart"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/boxboxjason/jukebox/pkg/utils/httputils"
 )
 
 // CompressFiles compresses a list of files into a single archive file at the specified path.
-// The archive file will be created if it does not exist. If the archive file already exists,
-// The new files will be appended to the archive file.
+// The archive file will be created if it does not exist, or truncated if it already exists.
 func CompressFiles(archive_path string, files []string) error {
+	return CompressFilesAndDirectories(archive_path, files, nil)
+}
+
+// AddFileToZip adds a file to a zip.Writer.
+func AddFileToZip(zip_writer *zip.Writer, file_path string) error {
+	file, err := os.Open(file_path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+
+	header.Name = filepath.Base(file_path)
+
+	writer, err := zip_writer.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+// CompressFilesAndDirectories compresses a list of files and the content of a list of directories into a single archive file.
+// Files are stored at the root of the archive, directories keep their base name and their tree.
+// Directories that do not exist are skipped.
+func CompressFilesAndDirectories(archive_path string, files []string, directories []string) error {
 	archive, err := os.Create(archive_path)
 	if err != nil {
 		return err
@@ -21,43 +59,126 @@ func CompressFiles(archive_path string, files []string) error {
 	defer archive.Close()
 
 	zip_writer := zip.NewWriter(archive)
-	defer zip_writer.Close()
 
 	for _, file := range files {
 		if err := AddFileToZip(zip_writer, file); err != nil {
+			zip_writer.Close()
 			return err
 		}
 	}
 
-	return nil
+	for _, directory := range directories {
+		if err := AddDirectoryToZip(zip_writer, directory); err != nil {
+			zip_writer.Close()
+			return err
+		}
+	}
+
+	// Closing the writer flushes the central directory, its error must not be ignored
+	err = zip_writer.Close()
+	if err != nil {
+		return err
+	}
+	return archive.Sync()
 }
 
-// AddFileToZip adds a file to a zip.Writer.
-func AddFileToZip(zip_writer *zip.Writer, file_path string) error {
-	file, err := os.Open(file_path)
+// AddDirectoryToZip adds the regular files of a directory tree to a zip.Writer, under the base name of the directory.
+func AddDirectoryToZip(zip_writer *zip.Writer, directory_path string) error {
+	if _, err := os.Stat(directory_path); os.IsNotExist(err) {
+		return nil
+	}
+
+	base := filepath.Base(directory_path)
+	return filepath.WalkDir(directory_path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+
+		relative_path, err := filepath.Rel(directory_path, path)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(base, relative_path))
+		header.Method = zip.Deflate
+
+		writer, err := zip_writer.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(writer, file)
+		return err
+	})
+}
+
+// ExtractArchive extracts the regular files of an archive into the destination directory.
+// Entries that would be written outside of the destination directory are rejected.
+func ExtractArchive(archive_path string, destination_dir string) error {
+	reader, err := zip.OpenReader(archive_path)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer reader.Close()
 
-	info, err := file.Stat()
+	destination_dir, err = filepath.Abs(destination_dir)
 	if err != nil {
 		return err
 	}
 
-	header, err := zip.FileInfoHeader(info)
+	for _, entry := range reader.File {
+		target_path := filepath.Join(destination_dir, filepath.FromSlash(entry.Name))
+		if !strings.HasPrefix(target_path, destination_dir+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid file path in archive: %s", entry.Name)
+		}
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+
+		err = extractArchiveEntry(entry, target_path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractArchiveEntry writes a single archive entry to target_path
+func extractArchiveEntry(entry *zip.File, target_path string) error {
+	err := os.MkdirAll(filepath.Dir(target_path), os.ModePerm)
 	if err != nil {
 		return err
 	}
 
-	header.Name = filepath.Base(file_path)
+	source, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer source.Close()
 
-	writer, err := zip_writer.CreateHeader(header)
+	destination, err := os.OpenFile(target_path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
 	if err != nil {
 		return err
 	}
+	defer destination.Close()
 
-	_, err = io.Copy(writer, file)
+	_, err = io.Copy(destination, source)
 	return err
 }
 
@@ -2,7 +2,10 @@ package httputils
 
 import (
 	"encoding/json"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type HTTPError interface {
@@ -58,6 +61,18 @@ func NewConflictError(message string) *ConflictError { return &ConflictError{Mes
 func (e *ConflictError) Error() string               { return e.Message }
 func (e *ConflictError) StatusCode() int             { return http.StatusConflict }
 
+// TooManyRequestsError represents a 429 error, RetryAfter tells the client when to retry (Retry-After header)
+type TooManyRequestsError struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+func NewTooManyRequestsError(message string, retry_after time.Duration) *TooManyRequestsError {
+	return &TooManyRequestsError{Message: message, RetryAfter: retry_after}
+}
+func (e *TooManyRequestsError) Error() string   { return e.Message }
+func (e *TooManyRequestsError) StatusCode() int { return http.StatusTooManyRequests }
+
 // ========== 5xx Errors ==========
 
 // DatabaseError represents a 500 error, used for database errors (failed to connect, etc.)
@@ -108,6 +123,11 @@ func SendErrorToClient(w http.ResponseWriter, err error) {
 		errorMessage = "unexpected error, the issue was logged"
 	}
 
+	// Tell the throttled clients how many seconds to wait, rounded up
+	if throttled, ok := err.(*TooManyRequestsError); ok && throttled.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+	}
+
 	w.WriteHeader(statusCode)
 
 	response := map[string]string{
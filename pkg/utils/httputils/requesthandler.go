@@ -6,6 +6,7 @@ import (
 	"errors"
 	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -25,6 +26,16 @@ func RetrieveAuthorizationToken(r *http.Request, authorization_scheme string) (s
 	return strings.TrimSpace(strings.TrimPrefix(auth_header, authorization_scheme)), nil
 }
 
+// RetrieveClientIP retrieves the IP address of the client, without the port of the remote address.
+// Behind a proxy, the RealIP middleware must have replaced the remote address by the forwarded one.
+func RetrieveClientIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
 // RetrieveChiStringArgument retrieves a string argument from the URL parameters.
 func RetrieveChiStringArgument(r *http.Request, argument_name string) (string, error) {
 	argument := chi.URLParam(r, argument_name)
@@ -215,6 +226,7 @@ func RetrievePostFormIntParameter(r *http.Request, parameter_name string, missin
 		if !missing_ok {
 			return 0, NewBadRequestError("Missing parameter: " + parameter_name)
 		}
+		return 0, nil
 	}
 
 	return 0, NewBadRequestError("Unsupported Content-Type")
@@ -263,6 +275,7 @@ func RetrievePostFormStringParameter(r *http.Request, parameter_name string, mis
 		if !missing_ok {
 			return "", NewBadRequestError("Missing parameter: " + parameter_name)
 		}
+		return "", nil
 	}
 
 	return "", NewBadRequestError("Unsupported Content-Type")
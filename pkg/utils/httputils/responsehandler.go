@@ -3,11 +3,17 @@ package httputils
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 )
 
 func SendJSONResponse(w http.ResponseWriter, response interface{}) {
+	SendJSONResponseWithStatus(w, http.StatusOK, response)
+}
+
+// SendJSONResponseWithStatus sends the response as JSON with another status than 200 (201 Created, 202 Accepted...)
+func SendJSONResponseWithStatus(w http.ResponseWriter, status_code int, response interface{}) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status_code)
 	err := json.NewEncoder(w).Encode(response)
 	if err != nil {
 		SendErrorToClient(w, NewInternalServerError("Failed to encode response"))
@@ -24,20 +30,30 @@ func SendSuccessResponse(w http.ResponseWriter, message string) {
 	}
 }
 
-func SetSecureCookie(w http.ResponseWriter, name string, value string, cookie_path string, expires_hours int) {
+// SetSecureCookie sets a cookie only sent over HTTPS and hidden from the scripts of the page
+func SetSecureCookie(w http.ResponseWriter, name string, value string, cookie_path string, max_age time.Duration) {
+	http.SetCookie(w, newSecureCookie(name, value, cookie_path, max_age, true))
+}
+
+// SetReadableCookie sets a cookie only sent over HTTPS, which the scripts of the page can read
+func SetReadableCookie(w http.ResponseWriter, name string, value string, cookie_path string, max_age time.Duration) {
+	http.SetCookie(w, newSecureCookie(name, value, cookie_path, max_age, false))
+}
+
+// newSecureCookie returns a cookie only sent over HTTPS, deleted right away if max_age is negative
+func newSecureCookie(name string, value string, cookie_path string, max_age time.Duration, http_only bool) *http.Cookie {
 	cookie := http.Cookie{
 		Name:     name,
 		Value:    value,
-		HttpOnly: true,
+		HttpOnly: http_only,
 		Secure:   true,
 		Path:     cookie_path,
 		SameSite: http.SameSiteNoneMode,
 	}
-	if expires_hours > 0 {
-		cookie.MaxAge = expires_hours * 60 * 60
-	} else if expires_hours < 0 {
+	if max_age > 0 {
+		cookie.MaxAge = int(max_age.Seconds())
+	} else if max_age < 0 {
 		cookie.MaxAge = -1
 	}
-
-	http.SetCookie(w, &cookie)
+	return &cookie
 }
@@ -0,0 +1,297 @@
+package jwtutils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ALGORITHM is the JWS algorithm of the tokens, Ed25519 signatures (RFC 8037)
+	ALGORITHM = "EdDSA"
+	// KEY_FILE_EXTENSION is the extension of the PEM files of the keys, named after their key ID
+	KEY_FILE_EXTENSION = ".pem"
+	// KEY_ID_TIME_FORMAT is the format of the creation time starting the key IDs, so that they sort by age
+	KEY_ID_TIME_FORMAT = "20060102T150405Z"
+)
+
+// ErrInvalidToken is returned for the tokens that are malformed, signed with an unknown key or whose signature does not match
+var ErrInvalidToken = errors.New("invalid signed token")
+
+// SigningKey is an Ed25519 key signing tokens, identified by the kid header of the tokens it signs
+type SigningKey struct {
+	ID         string
+	CreatedAt  time.Time
+	PrivateKey ed25519.PrivateKey
+}
+
+// KeyRing holds the keys signing and verifying the tokens, stored in a directory shared by the instances
+// The newest key signs the new tokens, the older ones still verify the tokens they signed until they are pruned,
+// so that a rotation does not invalidate the tokens in use
+type KeyRing struct {
+	dir     string
+	mutex   sync.RWMutex
+	keys    map[string]*SigningKey
+	current *SigningKey
+}
+
+// jwtHeader is the header of the signed tokens (JWS compact serialization)
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// ================ Keys ================
+
+// LoadKeyRing loads the keys of the directory, which is created if missing
+// The ring has no current key until the first rotation if the directory is empty
+func LoadKeyRing(dir string) (*KeyRing, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	ring := &KeyRing{dir: dir, keys: map[string]*SigningKey{}}
+	return ring, ring.Reload()
+}
+
+// Reload reads the keys of the directory again, to pick up the keys rotated or pruned by the other instances
+func (ring *KeyRing) Reload() error {
+	entries, err := os.ReadDir(ring.dir)
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]*SigningKey{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), KEY_FILE_EXTENSION) {
+			continue
+		}
+		key, err := readSigningKey(filepath.Join(ring.dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("invalid signing key %s: %w", entry.Name(), err)
+		}
+		keys[key.ID] = key
+	}
+
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	ring.keys = keys
+	ring.current = newestKey(keys)
+	return nil
+}
+
+// Current returns the key signing the new tokens, nil if the ring has none
+func (ring *KeyRing) Current() *SigningKey {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	return ring.current
+}
+
+// KeyIDs returns the IDs of the keys of the ring, the oldest first
+func (ring *KeyRing) KeyIDs() []string {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	return sortedKeyIDs(ring.keys)
+}
+
+// Rotate generates a new key, which signs the new tokens from now on
+func (ring *KeyRing) Rotate(now time.Time) (*SigningKey, error) {
+	_, private_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return nil, err
+	}
+	created_at := now.UTC().Truncate(time.Second)
+	key := &SigningKey{
+		ID:         created_at.Format(KEY_ID_TIME_FORMAT) + "-" + hex.EncodeToString(suffix),
+		CreatedAt:  created_at,
+		PrivateKey: private_key,
+	}
+	err = writeSigningKey(filepath.Join(ring.dir, key.ID+KEY_FILE_EXTENSION), key)
+	if err != nil {
+		return nil, err
+	}
+
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	ring.keys[key.ID] = key
+	ring.current = newestKey(ring.keys)
+	return key, nil
+}
+
+// RotateIfOlder generates a new key when the ring has none, or when the current key is at least max_age old
+// Returns the new key, nil if the current one is kept
+func (ring *KeyRing) RotateIfOlder(max_age time.Duration, now time.Time) (*SigningKey, error) {
+	current := ring.Current()
+	if current != nil && now.Sub(current.CreatedAt) < max_age {
+		return nil, nil
+	}
+	return ring.Rotate(now)
+}
+
+// Prune deletes the keys replaced by a newer key for longer than retention, which must outlive the tokens they signed
+// Returns the IDs of the deleted keys
+func (ring *KeyRing) Prune(retention time.Duration, now time.Time) ([]string, error) {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+
+	key_ids := sortedKeyIDs(ring.keys)
+	pruned := []string{}
+	for i := 0; i < len(key_ids)-1; i++ {
+		// A key stopped signing when the next one was created
+		replaced_at := ring.keys[key_ids[i+1]].CreatedAt
+		if now.Sub(replaced_at) < retention {
+			break
+		}
+		err := os.Remove(filepath.Join(ring.dir, key_ids[i]+KEY_FILE_EXTENSION))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return pruned, err
+		}
+		delete(ring.keys, key_ids[i])
+		pruned = append(pruned, key_ids[i])
+	}
+	return pruned, nil
+}
+
+// newestKey returns the most recently created key, nil if there is none
+func newestKey(keys map[string]*SigningKey) *SigningKey {
+	key_ids := sortedKeyIDs(keys)
+	if len(key_ids) == 0 {
+		return nil
+	}
+	return keys[key_ids[len(key_ids)-1]]
+}
+
+// sortedKeyIDs returns the key IDs from the oldest to the newest key, they start with their creation time
+func sortedKeyIDs(keys map[string]*SigningKey) []string {
+	key_ids := make([]string, 0, len(keys))
+	for key_id := range keys {
+		key_ids = append(key_ids, key_id)
+	}
+	sort.Strings(key_ids)
+	return key_ids
+}
+
+// readSigningKey reads a PKCS #8 Ed25519 private key from a PEM file named after its key ID
+func readSigningKey(path string) (*SigningKey, error) {
+	key_id := strings.TrimSuffix(filepath.Base(path), KEY_FILE_EXTENSION)
+	created_at, err := time.Parse(KEY_ID_TIME_FORMAT, strings.SplitN(key_id, "-", 2)[0])
+	if err != nil {
+		return nil, errors.New("the file name does not start with the creation time of the key")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("no PEM private key found")
+	}
+	parsed_key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private_key, ok := parsed_key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 key")
+	}
+	return &SigningKey{ID: key_id, CreatedAt: created_at, PrivateKey: private_key}, nil
+}
+
+// writeSigningKey writes the private key to a new PEM file readable by its owner only
+func writeSigningKey(path string, key *SigningKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// ================ Tokens ================
+
+// Sign returns the JWT of the claims, signed with the current key
+func (ring *KeyRing) Sign(claims any) (string, error) {
+	key := ring.Current()
+	if key == nil {
+		return "", errors.New("no signing key, rotate the keys first")
+	}
+
+	header, err := json.Marshal(&jwtHeader{Algorithm: ALGORITHM, KeyID: key.ID, Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(key.PrivateKey, []byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature of the JWT with the key of its kid header, then decodes its claims
+// The claims themselves (expiration...) are left to the caller
+func (ring *KeyRing) Verify(token string, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+	decoded := make([][]byte, 3)
+	for i, part := range parts {
+		var err error
+		decoded[i], err = base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			return ErrInvalidToken
+		}
+	}
+
+	// Only the algorithm of the keys is accepted, whatever the header says
+	header := &jwtHeader{}
+	err := json.Unmarshal(decoded[0], header)
+	if err != nil || header.Algorithm != ALGORITHM {
+		return ErrInvalidToken
+	}
+	ring.mutex.RLock()
+	key, ok := ring.keys[header.KeyID]
+	ring.mutex.RUnlock()
+	if !ok {
+		return ErrInvalidToken
+	}
+	if !ed25519.Verify(key.PrivateKey.Public().(ed25519.PublicKey), []byte(parts[0]+"."+parts[1]), decoded[2]) {
+		return ErrInvalidToken
+	}
+
+	err = json.Unmarshal(decoded[1], claims)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
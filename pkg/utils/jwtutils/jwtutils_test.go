@@ -0,0 +1,139 @@
+package jwtutils
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClaims struct {
+	Subject string `json:"sub"`
+	Expires int64  `json:"exp"`
+}
+
+func TestSignAndVerify(t *testing.T) {
+	ring, err := LoadKeyRing(filepath.Join(t.TempDir(), "keys"))
+	if err != nil {
+		t.Fatalf("Error loading key ring: %v", err)
+	}
+	_, err = ring.Sign(&testClaims{Subject: "1"})
+	if err == nil {
+		t.Errorf("Error signing: signed without key")
+	}
+	_, err = ring.Rotate(time.Now())
+	if err != nil {
+		t.Fatalf("Error rotating keys: %v", err)
+	}
+
+	token, err := ring.Sign(&testClaims{Subject: "1", Expires: 42})
+	if err != nil {
+		t.Fatalf("Error signing: %v", err)
+	}
+	claims := &testClaims{}
+	err = ring.Verify(token, claims)
+	if err != nil || claims.Subject != "1" || claims.Expires != 42 {
+		t.Errorf("Error verifying: got %+v (%v)", claims, err)
+	}
+
+	// Any change of the payload breaks the signature
+	parts := strings.Split(token, ".")
+	forged_payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"2","exp":42}`))
+	forged := parts[0] + "." + forged_payload + "." + parts[2]
+	if err = ring.Verify(forged, &testClaims{}); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Error verifying: forged payload accepted (%v)", err)
+	}
+
+	// The tokens of other algorithms are refused, whatever their signature
+	none_header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"` + ring.Current().ID + `"}`))
+	if err = ring.Verify(none_header+"."+parts[1]+".", &testClaims{}); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Error verifying: unsigned token accepted (%v)", err)
+	}
+	for _, malformed := range []string{"", "selector.verifier", "a.b.c", token + "."} {
+		if err = ring.Verify(malformed, &testClaims{}); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Error verifying: malformed token %q accepted (%v)", malformed, err)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	ring, err := LoadKeyRing(dir)
+	if err != nil {
+		t.Fatalf("Error loading key ring: %v", err)
+	}
+	now := time.Now().UTC()
+
+	// A key is created when the ring has none, then kept until it is old enough
+	first, err := ring.RotateIfOlder(time.Hour, now.Add(-2*time.Hour))
+	if err != nil || first == nil {
+		t.Fatalf("Error creating the first key: got %v (%v)", first, err)
+	}
+	old_token, _ := ring.Sign(&testClaims{Subject: "old"})
+	kept, err := ring.RotateIfOlder(3*time.Hour, now)
+	if err != nil || kept != nil {
+		t.Errorf("Error keeping a recent key: got %v (%v)", kept, err)
+	}
+	second, err := ring.RotateIfOlder(time.Hour, now)
+	if err != nil || second == nil || ring.Current().ID != second.ID {
+		t.Fatalf("Error rotating an old key: got %v (%v)", second, err)
+	}
+	new_token, _ := ring.Sign(&testClaims{Subject: "new"})
+	if !strings.Contains(decodeHeader(t, new_token), second.ID) {
+		t.Errorf("Error signing: the kid header is not the current key")
+	}
+
+	// The other instances pick up the keys from the shared directory
+	other, err := LoadKeyRing(dir)
+	if err != nil || other.Current() == nil || other.Current().ID != second.ID {
+		t.Fatalf("Error loading the rotated keys: got %v (%v)", other.KeyIDs(), err)
+	}
+	for _, token := range []string{old_token, new_token} {
+		if err = other.Verify(token, &testClaims{}); err != nil {
+			t.Errorf("Error verifying with the loaded keys: %v", err)
+		}
+	}
+
+	// The replaced key is kept while the tokens it signed may still be valid
+	pruned, err := ring.Prune(time.Hour, now.Add(30*time.Minute))
+	if err != nil || len(pruned) != 0 {
+		t.Errorf("Error pruning: recently replaced key pruned: %v (%v)", pruned, err)
+	}
+	pruned, err = ring.Prune(time.Hour, now.Add(2*time.Hour))
+	if err != nil || len(pruned) != 1 || pruned[0] != first.ID {
+		t.Errorf("Error pruning: got %v (%v)", pruned, err)
+	}
+	if err = ring.Verify(old_token, &testClaims{}); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Error verifying: token of a pruned key accepted (%v)", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, first.ID+KEY_FILE_EXTENSION)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Error pruning: key file kept (%v)", err)
+	}
+	if err = other.Reload(); err != nil || len(other.KeyIDs()) != 1 {
+		t.Errorf("Error reloading the pruned keys: got %v (%v)", other.KeyIDs(), err)
+	}
+}
+
+func TestLoadKeyRingInvalidKey(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "20260101T000000Z-00000000.pem"), []byte("not a key"), 0600)
+	if err != nil {
+		t.Fatalf("Error writing key: %v", err)
+	}
+	_, err = LoadKeyRing(dir)
+	if err == nil {
+		t.Errorf("Error loading key ring: invalid key accepted")
+	}
+}
+
+// decodeHeader returns the decoded header of the token
+func decodeHeader(t *testing.T, token string) string {
+	header, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+	if err != nil {
+		t.Fatalf("Error decoding header: %v", err)
+	}
+	return string(header)
+}
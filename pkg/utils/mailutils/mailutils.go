@@ -0,0 +1,203 @@
+package mailutils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Port of the SMTP servers expecting TLS right away (SMTPS), the other ports use STARTTLS when it is offered
+	SMTPS_PORT = 465
+	// Maximum time given to an SMTP server to accept a mail
+	SMTP_TIMEOUT = 30 * time.Second
+)
+
+// Mail is a plain text mail
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends the mails of the server
+type Mailer interface {
+	// Send sends the mail, it returns once the mail is handed to the transport
+	Send(mail *Mail) error
+}
+
+// Message returns the mail formatted as an RFC 5322 message sent by from, with a quoted-printable UTF-8 body
+func (mail *Mail) Message(from string) ([]byte, error) {
+	for _, header := range []string{from, mail.To, mail.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, fmt.Errorf("invalid mail header %q", header)
+		}
+	}
+	message_id, err := newMessageID(from)
+	if err != nil {
+		return nil, err
+	}
+
+	message := &bytes.Buffer{}
+	fmt.Fprintf(message, "From: %s\r\n", from)
+	fmt.Fprintf(message, "To: %s\r\n", mail.To)
+	fmt.Fprintf(message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", mail.Subject))
+	fmt.Fprintf(message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(message, "Message-ID: %s\r\n", message_id)
+	fmt.Fprintf(message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(message, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(message, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	body := quotedprintable.NewWriter(message)
+	_, err = body.Write([]byte(strings.ReplaceAll(mail.Body, "\n", "\r\n")))
+	if err == nil {
+		err = body.Close()
+	}
+	return message.Bytes(), err
+}
+
+// newMessageID returns a unique message ID in the domain of the sender
+func newMessageID(from string) (string, error) {
+	random := make([]byte, 16)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	domain := "localhost"
+	if address, err := mail.ParseAddress(from); err == nil {
+		if at := strings.LastIndex(address.Address, "@"); at >= 0 {
+			domain = address.Address[at+1:]
+		}
+	}
+	return "<" + hex.EncodeToString(random) + "@" + domain + ">", nil
+}
+
+// ================ SMTP ================
+
+// SMTPMailer sends the mails through an SMTP server
+// TLS is used right away on the SMTPS port, and through STARTTLS on the other ports when the server offers it
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// Send sends the mail through the SMTP server
+func (mailer *SMTPMailer) Send(mail_to_send *Mail) error {
+	message, err := mail_to_send.Message(mailer.From)
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(mailer.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address: %w", err)
+	}
+	to, err := mail.ParseAddress(mail_to_send.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address: %w", err)
+	}
+
+	// Connect to the server
+	address := net.JoinHostPort(mailer.Host, strconv.Itoa(mailer.Port))
+	tls_config := &tls.Config{ServerName: mailer.Host, MinVersion: tls.VersionTLS12}
+	dialer := &net.Dialer{Timeout: SMTP_TIMEOUT}
+	var conn net.Conn
+	if mailer.Port == SMTPS_PORT {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tls_config)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	err = conn.SetDeadline(time.Now().Add(SMTP_TIMEOUT))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	client, err := smtp.NewClient(conn, mailer.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	// Upgrade the connection and authenticate
+	if ok, _ := client.Extension("STARTTLS"); ok && mailer.Port != SMTPS_PORT {
+		err = client.StartTLS(tls_config)
+		if err != nil {
+			return err
+		}
+	}
+	if mailer.Username != "" {
+		err = client.Auth(smtp.PlainAuth("", mailer.Username, mailer.Password, mailer.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Send the mail
+	err = client.Mail(from.Address)
+	if err != nil {
+		return err
+	}
+	err = client.Rcpt(to.Address)
+	if err != nil {
+		return err
+	}
+	data, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = data.Write(message)
+	if err != nil {
+		return err
+	}
+	err = data.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// ================ Outbox ================
+
+// OutboxMailer writes every mail to a file of a directory instead of sending it, for local testing
+type OutboxMailer struct {
+	Dir  string
+	From string
+}
+
+// Send writes the mail to a new .eml file of the outbox directory
+func (mailer *OutboxMailer) Send(mail *Mail) error {
+	message, err := mail.Message(mailer.From)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(mailer.Dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	random := make([]byte, 4)
+	_, err = rand.Read(random)
+	if err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format("20060102T150405.000000000Z") + "-" + hex.EncodeToString(random) + ".eml"
+	return os.WriteFile(filepath.Join(mailer.Dir, name), message, 0600)
+}
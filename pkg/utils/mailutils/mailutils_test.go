@@ -0,0 +1,130 @@
+package mailutils
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const TEST_FROM = "JukeBox <jukebox@example.com>"
+
+// readMessage parses a mail message and returns its decoded subject and body
+func readMessage(t *testing.T, reader io.Reader) (*mail.Message, string) {
+	message, err := mail.ReadMessage(reader)
+	if err != nil {
+		t.Fatalf("Error parsing message: %v", err)
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(message.Body))
+	if err != nil {
+		t.Fatalf("Error decoding body: %v", err)
+	}
+	return message, string(body)
+}
+
+func TestOutboxMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	mailer := &OutboxMailer{Dir: dir, From: TEST_FROM}
+
+	err := mailer.Send(&Mail{To: "user@example.com", Subject: "Réinitialisation", Body: "Hello,\nclick here"})
+	if err != nil {
+		t.Fatalf("Error sending mail: %v", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Error sending mail: expected a single mail in the outbox, got %d (%v)", len(files), err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatalf("Error opening mail: %v", err)
+	}
+	defer file.Close()
+	message, body := readMessage(t, file)
+	subject, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+	if err != nil || subject != "Réinitialisation" {
+		t.Errorf("Error sending mail: unexpected subject %q (%v)", subject, err)
+	}
+	if message.Header.Get("To") != "user@example.com" || body != "Hello,\r\nclick here" {
+		t.Errorf("Error sending mail: unexpected recipient or body %q", body)
+	}
+
+	// Header injection is refused
+	err = mailer.Send(&Mail{To: "user@example.com\r\nBcc: other@example.com", Subject: "Hello"})
+	if err == nil {
+		t.Errorf("Error sending mail: header injection accepted")
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer listener.Close()
+
+	// Minimal SMTP server, without STARTTLS nor authentication, recording the envelope and the data
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		lines := []string{}
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP")
+		in_data := false
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch {
+			case in_data && line == ".":
+				in_data = false
+				reply("250 queued")
+			case in_data:
+				lines = append(lines, line)
+			case strings.HasPrefix(line, "EHLO"):
+				reply("250 localhost")
+			case strings.HasPrefix(line, "MAIL FROM"), strings.HasPrefix(line, "RCPT TO"):
+				lines = append(lines, line)
+				reply("250 ok")
+			case line == "DATA":
+				in_data = true
+				reply("354 go ahead")
+			case line == "QUIT":
+				reply("221 bye")
+				received <- lines
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	mailer := &SMTPMailer{Host: "127.0.0.1", Port: port, From: TEST_FROM}
+	err = mailer.Send(&Mail{To: "User <user@example.com>", Subject: "Hello", Body: "Hello user"})
+	if err != nil {
+		t.Fatalf("Error sending mail: %v", err)
+	}
+
+	lines := <-received
+	if len(lines) < 2 || lines[0] != "MAIL FROM:<jukebox@example.com>" || lines[1] != "RCPT TO:<user@example.com>" {
+		t.Fatalf("Error sending mail: unexpected envelope %v", lines)
+	}
+	_, body := readMessage(t, strings.NewReader(strings.Join(lines[2:], "\r\n")))
+	if body != "Hello user" {
+		t.Errorf("Error sending mail: unexpected body %q", body)
+	}
+}
@@ -0,0 +1,261 @@
+package oidcutils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Claims are the claims of an ID token used by JukeBox
+type Claims struct {
+	Issuer            string    `json:"iss"`
+	Subject           string    `json:"sub"`
+	Audience          audience  `json:"aud"`
+	AuthorizedParty   string    `json:"azp"`
+	ExpiresAt         int64     `json:"exp"`
+	IssuedAt          int64     `json:"iat"`
+	Nonce             string    `json:"nonce"`
+	Email             string    `json:"email"`
+	EmailVerified     flexibool `json:"email_verified"`
+	PreferredUsername string    `json:"preferred_username"`
+	Name              string    `json:"name"`
+}
+
+// validate checks the claims of an ID token as required by OpenID Connect Core 1.0 (3.1.3.7)
+func (claims *Claims) validate(issuer string, client_id string, nonce string, now time.Time) error {
+	if strings.TrimSuffix(claims.Issuer, "/") != issuer {
+		return fmt.Errorf("the ID token is issued by %q instead of %q", claims.Issuer, issuer)
+	}
+	if claims.Subject == "" {
+		return errors.New("the ID token has no subject")
+	}
+	if !slices.Contains(claims.Audience, client_id) {
+		return errors.New("the ID token is not issued to this client")
+	}
+	if (len(claims.Audience) > 1 || claims.AuthorizedParty != "") && claims.AuthorizedParty != client_id {
+		return errors.New("the ID token is authorized for another client")
+	}
+	if claims.ExpiresAt == 0 || now.Add(-CLOCK_SKEW).Unix() >= claims.ExpiresAt {
+		return errors.New("the ID token is expired")
+	}
+	if claims.IssuedAt > now.Add(CLOCK_SKEW).Unix() {
+		return errors.New("the ID token is issued in the future")
+	}
+	if !CheckState(nonce, claims.Nonce) {
+		return errors.New("the ID token nonce does not match the request")
+	}
+	return nil
+}
+
+// audience is the aud claim, a string or an array of strings
+type audience []string
+
+func (aud *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*aud = audience{single}
+		return nil
+	}
+	var multiple []string
+	err := json.Unmarshal(data, &multiple)
+	*aud = multiple
+	return err
+}
+
+// flexibool is a boolean claim some providers send as a string
+type flexibool bool
+
+func (value *flexibool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true":
+		*value = true
+	case "false", "null":
+		*value = false
+	default:
+		return fmt.Errorf("invalid boolean claim %s", data)
+	}
+	return nil
+}
+
+// ================ JWT ================
+
+// jwtHeader is the header of a signed JWT (JWS compact serialization)
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// splitJWT decodes the header and the payload of a JWT, and returns the signed part with the signature
+func splitJWT(token string) (*jwtHeader, []byte, []byte, []byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, nil, nil, errors.New("the ID token is not a signed JWT")
+	}
+	decoded := make([][]byte, 3)
+	for i, part := range parts {
+		var err error
+		decoded[i], err = base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("invalid ID token encoding: %w", err)
+		}
+	}
+
+	header := &jwtHeader{}
+	err := json.Unmarshal(decoded[0], header)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("invalid ID token header: %w", err)
+	}
+	return header, decoded[1], []byte(parts[0] + "." + parts[1]), decoded[2], nil
+}
+
+// signatureHashes are the hashes of the supported signature algorithms, "none" and the HMAC algorithms are refused
+var signatureHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// verifySignature checks the JWS signature of the signed part with the key
+func verifySignature(algorithm string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	hash, ok := signatureHashes[algorithm]
+	if !ok {
+		return fmt.Errorf("unsupported ID token algorithm %q", algorithm)
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	invalid := errors.New("invalid ID token signature")
+	switch public_key := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		if algorithm[0] == 'P' {
+			err = rsa.VerifyPSS(public_key, hash, digest, signature, nil)
+		} else if algorithm[0] == 'R' {
+			err = rsa.VerifyPKCS1v15(public_key, hash, digest, signature)
+		} else {
+			return invalid
+		}
+		if err != nil {
+			return invalid
+		}
+	case *ecdsa.PublicKey:
+		// The signature is R || S, each of the size of the curve
+		size := (public_key.Curve.Params().BitSize + 7) / 8
+		if algorithm[0] != 'E' || len(signature) != 2*size {
+			return invalid
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(public_key, digest, r, s) {
+			return invalid
+		}
+	default:
+		return invalid
+	}
+	return nil
+}
+
+// ================ JWKS ================
+
+// keySet is the JSON Web Key Set of the provider
+type keySet struct {
+	Keys []*jsonWebKey `json:"keys"`
+}
+
+// jsonWebKey is a public key of the provider (RFC 7517)
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+}
+
+// find returns the signing key with the ID, or the only signing key usable with the algorithm when the token has no key ID
+func (keys *keySet) find(key_id string, algorithm string) (crypto.PublicKey, error) {
+	candidates := []*jsonWebKey{}
+	for _, key := range keys.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if key.Algorithm != "" && key.Algorithm != algorithm {
+			continue
+		}
+		if key_id != "" && key.KeyID != key_id {
+			continue
+		}
+		candidates = append(candidates, key)
+	}
+	if len(candidates) != 1 {
+		return nil, fmt.Errorf("no unique provider key matches the ID token key %q", key_id)
+	}
+	return candidates[0].publicKey()
+}
+
+// curves are the supported elliptic curves, by JWK name
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// publicKey decodes the RSA or EC public key
+func (key *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch key.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(key.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid exponent of the provider key %q", key.KeyID)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := curves[key.Curve]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q of the provider key %q", key.Curve, key.KeyID)
+		}
+		x, err := decodeBigInt(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		public_key := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		// The conversion checks that the point is on the curve
+		_, err = public_key.ECDH()
+		if err != nil {
+			return nil, fmt.Errorf("invalid provider key %q: %w", key.KeyID, err)
+		}
+		return public_key, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %q of the provider key %q", key.KeyType, key.KeyID)
+	}
+}
+
+// decodeBigInt decodes a base64url encoded big-endian integer
+func decodeBigInt(encoded string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(decoded) == 0 {
+		return nil, errors.New("invalid integer in a provider key")
+	}
+	return new(big.Int).SetBytes(decoded), nil
+}
@@ -0,0 +1,313 @@
+package oidcutils
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Path of the provider metadata, relative to the issuer (OpenID Connect Discovery 1.0)
+	DISCOVERY_PATH = "/.well-known/openid-configuration"
+	// Maximum time given to the provider to answer a request
+	HTTP_TIMEOUT = 10 * time.Second
+	// Tolerated clock difference with the provider when checking the times of the ID tokens
+	CLOCK_SKEW = time.Minute
+	// Minimum time between two downloads of the provider keys, when an ID token is signed by an unknown key
+	KEYS_REFRESH_INTERVAL = time.Minute
+	// Maximum size of the responses of the provider
+	MAX_RESPONSE_SIZE = 1 << 20
+)
+
+// Discovery is the part of the provider metadata used by the client
+type Discovery struct {
+	Issuer                        string   `json:"issuer"`
+	AuthorizationEndpoint         string   `json:"authorization_endpoint"`
+	TokenEndpoint                 string   `json:"token_endpoint"`
+	JWKSURI                       string   `json:"jwks_uri"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
+}
+
+// Client signs in the users with an OpenID Connect provider, with the authorization code flow and PKCE
+// The provider metadata and keys are downloaded on first use, so that the server starts when the provider is down
+type Client struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	HTTPClient   *http.Client
+
+	mutex           sync.Mutex
+	discovery       *Discovery
+	keys            *keySet
+	keys_fetched_at time.Time
+}
+
+// NewClient returns a client of the provider at issuer, openid is added to the scopes if missing
+func NewClient(issuer string, client_id string, client_secret string, redirect_url string, scopes []string) *Client {
+	if !slices.Contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	return &Client{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     client_id,
+		ClientSecret: client_secret,
+		RedirectURL:  redirect_url,
+		Scopes:       scopes,
+		HTTPClient:   &http.Client{Timeout: HTTP_TIMEOUT},
+	}
+}
+
+// AuthRequest is an authorization request, its secrets must be kept by the client until the callback
+type AuthRequest struct {
+	// URL of the provider the user is redirected to
+	URL string
+	// State is sent back to the callback, it ties the callback to the browser that started the request
+	State string
+	// Nonce is copied in the ID token, it ties the ID token to the request
+	Nonce string
+	// CodeVerifier proves to the token endpoint that the code is redeemed by the client that requested it (PKCE)
+	CodeVerifier string
+}
+
+// Tokens are the tokens returned by the token endpoint
+type Tokens struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// ================ Discovery ================
+
+// Discover returns the provider metadata, downloaded on first use
+func (client *Client) Discover(ctx context.Context) (*Discovery, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.discover(ctx)
+}
+
+// discover downloads the provider metadata if needed, the caller must hold the lock
+func (client *Client) discover(ctx context.Context) (*Discovery, error) {
+	if client.discovery != nil {
+		return client.discovery, nil
+	}
+
+	discovery := &Discovery{}
+	err := client.getJSON(ctx, client.Issuer+DISCOVERY_PATH, discovery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to discover the provider: %w", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != client.Issuer {
+		return nil, fmt.Errorf("the provider issuer %q does not match the configured issuer %q", discovery.Issuer, client.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("the provider metadata misses the authorization, token or keys endpoint")
+	}
+	if len(discovery.CodeChallengeMethodsSupported) > 0 && !slices.Contains(discovery.CodeChallengeMethodsSupported, "S256") {
+		return nil, errors.New("the provider does not support PKCE with S256")
+	}
+	client.discovery = discovery
+	return discovery, nil
+}
+
+// ================ Authorization ================
+
+// NewAuthRequest returns a new authorization request, with a random state, nonce and PKCE code verifier
+func (client *Client) NewAuthRequest(ctx context.Context) (*AuthRequest, error) {
+	discovery, err := client.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &AuthRequest{}
+	for _, secret := range []*string{&request.State, &request.Nonce, &request.CodeVerifier} {
+		*secret, err = randomString()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	auth_url, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authorization endpoint: %w", err)
+	}
+	query := auth_url.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", client.ClientID)
+	query.Set("redirect_uri", client.RedirectURL)
+	query.Set("scope", strings.Join(client.Scopes, " "))
+	query.Set("state", request.State)
+	query.Set("nonce", request.Nonce)
+	query.Set("code_challenge", CodeChallenge(request.CodeVerifier))
+	query.Set("code_challenge_method", "S256")
+	auth_url.RawQuery = query.Encode()
+	request.URL = auth_url.String()
+	return request, nil
+}
+
+// CodeChallenge returns the S256 PKCE challenge of the code verifier
+func CodeChallenge(code_verifier string) string {
+	digest := sha256.Sum256([]byte(code_verifier))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// CheckState compares the state sent back to the callback with the state of the request, in constant time
+func CheckState(expected string, received string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(received)) == 1
+}
+
+// ================ Token ================
+
+// Exchange redeems the authorization code received by the callback for the tokens
+func (client *Client) Exchange(ctx context.Context, code string, code_verifier string) (*Tokens, error) {
+	discovery, err := client.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {client.RedirectURL},
+		"client_id":     {client.ClientID},
+		"code_verifier": {code_verifier},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	// Confidential clients authenticate with client_secret_basic, the public clients only rely on PKCE
+	if client.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(client.ClientID), url.QueryEscape(client.ClientSecret))
+	}
+
+	tokens := &Tokens{}
+	err = client.doJSON(request, tokens)
+	if err != nil {
+		return nil, fmt.Errorf("unable to redeem the authorization code: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("the provider did not return an ID token")
+	}
+	return tokens, nil
+}
+
+// ================ ID token ================
+
+// VerifyIDToken checks the signature of the ID token with the provider keys, then its issuer, audience, times and nonce
+func (client *Client) VerifyIDToken(ctx context.Context, id_token string, nonce string) (*Claims, error) {
+	header, payload, signed, signature, err := splitJWT(id_token)
+	if err != nil {
+		return nil, err
+	}
+	key, err := client.findKey(ctx, header.KeyID, header.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	err = verifySignature(header.Algorithm, key, signed, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{}
+	err = json.Unmarshal(payload, claims)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token claims: %w", err)
+	}
+	err = claims.validate(client.Issuer, client.ClientID, nonce, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// findKey returns the provider key the ID token is signed with
+// The keys are downloaded again when the key is unknown, the provider may have rotated them
+func (client *Client) findKey(ctx context.Context, key_id string, algorithm string) (crypto.PublicKey, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.keys != nil {
+		key, err := client.keys.find(key_id, algorithm)
+		if err == nil || time.Since(client.keys_fetched_at) < KEYS_REFRESH_INTERVAL {
+			return key, err
+		}
+	}
+
+	discovery, err := client.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys := &keySet{}
+	err = client.getJSON(ctx, discovery.JWKSURI, keys)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download the provider keys: %w", err)
+	}
+	client.keys = keys
+	client.keys_fetched_at = time.Now()
+	return keys.find(key_id, algorithm)
+}
+
+// ================ HTTP ================
+
+// getJSON downloads the JSON document at document_url
+func (client *Client) getJSON(ctx context.Context, document_url string, document any) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, document_url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	return client.doJSON(request, document)
+}
+
+// doJSON sends the request and reads the JSON response, the error responses of the provider are returned as errors
+func (client *Client) doJSON(request *http.Request, document any) error {
+	response, err := client.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, MAX_RESPONSE_SIZE))
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		provider_error := struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}{}
+		if json.Unmarshal(body, &provider_error) == nil && provider_error.Error != "" {
+			return fmt.Errorf("%s: %s %s", response.Status, provider_error.Error, provider_error.ErrorDescription)
+		}
+		return errors.New(response.Status)
+	}
+	return json.Unmarshal(body, document)
+}
+
+// randomString returns 32 random bytes encoded for a URL
+func randomString() (string, error) {
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
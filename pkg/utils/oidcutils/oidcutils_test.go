@@ -0,0 +1,355 @@
+package oidcutils
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockProvider is a local OpenID Connect provider, that signs its ID tokens with a RSA key
+type mockProvider struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mutex     sync.Mutex
+	key       *rsa.PrivateKey
+	key_id    string
+	requests  map[string]url.Values
+	claims    map[string]any
+	keys_hits int
+}
+
+// newMockProvider starts a provider that authorizes every request for the subject "subject-1"
+func newMockProvider(t *testing.T) *mockProvider {
+	provider := &mockProvider{t: t, requests: map[string]url.Values{}, claims: map[string]any{}}
+	provider.rotateKey("key-1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(DISCOVERY_PATH, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                           provider.server.URL,
+			"authorization_endpoint":           provider.server.URL + "/authorize",
+			"token_endpoint":                   provider.server.URL + "/token",
+			"jwks_uri":                         provider.server.URL + "/keys",
+			"code_challenge_methods_supported": []string{"plain", "S256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		provider.mutex.Lock()
+		defer provider.mutex.Unlock()
+		provider.keys_hits++
+		public_key := provider.key.PublicKey
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": provider.key_id,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(public_key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public_key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", provider.token)
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+// rotateKey replaces the signing key of the provider
+func (provider *mockProvider) rotateKey(key_id string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		provider.t.Fatalf("Error generating key: %v", err)
+	}
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.key = key
+	provider.key_id = key_id
+}
+
+// setClaims overrides claims of the next ID tokens
+func (provider *mockProvider) setClaims(claims map[string]any) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.claims = claims
+}
+
+// keysHits returns the number of downloads of the keys
+func (provider *mockProvider) keysHits() int {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	return provider.keys_hits
+}
+
+// authorize simulates the user signing in at the provider, and returns the code sent to the callback
+func (provider *mockProvider) authorize(auth_url string) string {
+	parsed_url, err := url.Parse(auth_url)
+	if err != nil {
+		provider.t.Fatalf("Error parsing authorization URL: %v", err)
+	}
+	code, err := randomString()
+	if err != nil {
+		provider.t.Fatalf("Error generating code: %v", err)
+	}
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.requests[code] = parsed_url.Query()
+	return code
+}
+
+// token redeems a code for an ID token, once, if the PKCE verifier matches the challenge of the request
+func (provider *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	request, ok := provider.requests[r.PostFormValue("code")]
+	delete(provider.requests, r.PostFormValue("code"))
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != request.Get("redirect_uri") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	if request.Get("code_challenge_method") != "S256" || CodeChallenge(r.PostFormValue("code_verifier")) != request.Get("code_challenge") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	claims := map[string]any{
+		"iss":            provider.server.URL,
+		"sub":            "subject-1",
+		"aud":            request.Get("client_id"),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          request.Get("nonce"),
+		"email":          "user@example.com",
+		"email_verified": "true",
+	}
+	for name, value := range provider.claims {
+		claims[name] = value
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"id_token":     signRS256(provider.t, provider.key, provider.key_id, claims),
+	})
+}
+
+// signRS256 returns a JWT of the claims signed with the key
+func signRS256(t *testing.T, key *rsa.PrivateKey, key_id string, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": key_id, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("Error encoding claims: %v", err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("Error signing token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// login runs the authorization code flow and returns the verified claims
+func login(t *testing.T, client *Client, provider *mockProvider) (*Claims, error) {
+	ctx := context.Background()
+	request, err := client.NewAuthRequest(ctx)
+	if err != nil {
+		t.Fatalf("Error creating authorization request: %v", err)
+	}
+	code := provider.authorize(request.URL)
+	tokens, err := client.Exchange(ctx, code, request.CodeVerifier)
+	if err != nil {
+		t.Fatalf("Error exchanging code: %v", err)
+	}
+	return client.VerifyIDToken(ctx, tokens.IDToken, request.Nonce)
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	provider := newMockProvider(t)
+	client := NewClient(provider.server.URL+"/", "jukebox", "secret", "http://localhost/callback", []string{"email"})
+	ctx := context.Background()
+
+	claims, err := login(t, client, provider)
+	if err != nil {
+		t.Fatalf("Error verifying ID token: %v", err)
+	}
+	if claims.Subject != "subject-1" || claims.Email != "user@example.com" || !claims.EmailVerified {
+		t.Errorf("Error verifying ID token: unexpected claims %+v", claims)
+	}
+
+	// The authorization request carries the PKCE challenge, the state and the nonce
+	request, err := client.NewAuthRequest(ctx)
+	if err != nil {
+		t.Fatalf("Error creating authorization request: %v", err)
+	}
+	query := provider.requestQuery(request.URL)
+	if query.Get("state") != request.State || query.Get("nonce") != request.Nonce || query.Get("code_challenge") != CodeChallenge(request.CodeVerifier) {
+		t.Errorf("Error creating authorization request: unexpected query %v", query)
+	}
+	if query.Get("scope") != "openid email" {
+		t.Errorf("Error creating authorization request: expected scope %q, got %q", "openid email", query.Get("scope"))
+	}
+	if CheckState(request.State, "forged") || CheckState("", "") || !CheckState(request.State, request.State) {
+		t.Errorf("Error checking state")
+	}
+
+	// The code can only be redeemed with the verifier of its request, and only once
+	code := provider.authorize(request.URL)
+	_, err = client.Exchange(ctx, code, "wrong verifier")
+	if err == nil {
+		t.Errorf("Error exchanging code: wrong PKCE verifier accepted")
+	}
+	code = provider.authorize(request.URL)
+	tokens, err := client.Exchange(ctx, code, request.CodeVerifier)
+	if err != nil {
+		t.Fatalf("Error exchanging code: %v", err)
+	}
+	_, err = client.Exchange(ctx, code, request.CodeVerifier)
+	if err == nil {
+		t.Errorf("Error exchanging code: code redeemed twice")
+	}
+
+	// The ID token is tied to the nonce of its request and to its signature
+	_, err = client.VerifyIDToken(ctx, tokens.IDToken, "other nonce")
+	if err == nil {
+		t.Errorf("Error verifying ID token: wrong nonce accepted")
+	}
+	parts := strings.Split(tokens.IDToken, ".")
+	tampered_payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`))
+	_, err = client.VerifyIDToken(ctx, parts[0]+"."+tampered_payload+"."+parts[2], request.Nonce)
+	if err == nil {
+		t.Errorf("Error verifying ID token: tampered token accepted")
+	}
+	unsigned_header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"key-1"}`))
+	_, err = client.VerifyIDToken(ctx, unsigned_header+"."+parts[1]+".", request.Nonce)
+	if err == nil {
+		t.Errorf("Error verifying ID token: unsigned token accepted")
+	}
+}
+
+// requestQuery returns the query of an authorization URL
+func (provider *mockProvider) requestQuery(auth_url string) url.Values {
+	parsed_url, err := url.Parse(auth_url)
+	if err != nil {
+		provider.t.Fatalf("Error parsing authorization URL: %v", err)
+	}
+	return parsed_url.Query()
+}
+
+func TestVerifyIDTokenClaims(t *testing.T) {
+	provider := newMockProvider(t)
+	client := NewClient(provider.server.URL, "jukebox", "", "http://localhost/callback", nil)
+
+	invalid_claims := map[string]map[string]any{
+		"audience":         {"aud": "other"},
+		"authorized party": {"aud": []string{"jukebox", "other"}, "azp": "other"},
+		"issuer":           {"iss": "https://evil.example.com"},
+		"expired":          {"exp": time.Now().Add(-time.Hour).Unix()},
+		"issued later":     {"iat": time.Now().Add(time.Hour).Unix()},
+		"subject":          {"sub": ""},
+	}
+	for name, claims := range invalid_claims {
+		provider.setClaims(claims)
+		_, err := login(t, client, provider)
+		if err == nil {
+			t.Errorf("Error verifying ID token: invalid %s accepted", name)
+		}
+	}
+
+	// Several audiences are accepted with the client as authorized party
+	provider.setClaims(map[string]any{"aud": []string{"jukebox", "other"}, "azp": "jukebox"})
+	_, err := login(t, client, provider)
+	if err != nil {
+		t.Errorf("Error verifying ID token with several audiences: %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	provider := newMockProvider(t)
+	client := NewClient(provider.server.URL, "jukebox", "", "http://localhost/callback", nil)
+
+	_, err := login(t, client, provider)
+	if err != nil {
+		t.Fatalf("Error verifying ID token: %v", err)
+	}
+	_, err = login(t, client, provider)
+	if err != nil || provider.keysHits() != 1 {
+		t.Errorf("Error verifying ID token: expected the keys to be downloaded once, got %d (%v)", provider.keysHits(), err)
+	}
+
+	// A token signed by an unknown key triggers a new download of the keys
+	provider.rotateKey("key-2")
+	client.keys_fetched_at = time.Now().Add(-KEYS_REFRESH_INTERVAL)
+	_, err = login(t, client, provider)
+	if err != nil || provider.keysHits() != 2 {
+		t.Errorf("Error verifying ID token after key rotation: expected 2 key downloads, got %d (%v)", provider.keysHits(), err)
+	}
+
+	// The downloads are rate limited
+	provider.rotateKey("key-3")
+	_, err = login(t, client, provider)
+	if err == nil || provider.keysHits() != 2 {
+		t.Errorf("Error verifying ID token: expected the key downloads to be rate limited, got %d (%v)", provider.keysHits(), err)
+	}
+}
+
+func TestVerifyECSignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	keys := &keySet{Keys: []*jsonWebKey{{
+		KeyType: "EC",
+		KeyID:   "ec",
+		Curve:   "P-256",
+		X:       base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y:       base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}}}
+	public_key, err := keys.find("ec", "ES256")
+	if err != nil {
+		t.Fatalf("Error decoding key: %v", err)
+	}
+
+	signed := []byte("header.payload")
+	digest := sha256.Sum256(signed)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("Error signing: %v", err)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	err = verifySignature("ES256", public_key, signed, signature)
+	if err != nil {
+		t.Errorf("Error verifying signature: %v", err)
+	}
+	err = verifySignature("RS256", public_key, signed, signature)
+	if err == nil {
+		t.Errorf("Error verifying signature: algorithm confusion accepted")
+	}
+	signature[0] ^= 1
+	err = verifySignature("ES256", public_key, signed, signature)
+	if err == nil {
+		t.Errorf("Error verifying signature: tampered signature accepted")
+	}
+
+	// A point outside of the curve is refused
+	keys.Keys[0].Y = keys.Keys[0].X
+	_, err = keys.find("ec", "ES256")
+	if err == nil {
+		t.Errorf("Error decoding key: invalid point accepted")
+	}
+}
@@ -0,0 +1,153 @@
+package tlsutils
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLS versions accepted as minimum version
+var tls_versions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// DEFAULT_CIPHER_SUITES are the TLS 1.2 cipher suites offered by default: forward secrecy and AEAD only
+// The TLS 1.3 cipher suites are not configurable
+var DEFAULT_CIPHER_SUITES = []string{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+}
+
+// ParseTLSVersion returns the TLS version named "1.2" or "1.3"
+func ParseTLSVersion(version string) (uint16, error) {
+	tls_version, ok := tls_versions[version]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %q, use 1.2 or 1.3", version)
+	}
+	return tls_version, nil
+}
+
+// ParseCipherSuites returns the IDs of the named cipher suites, the insecure ones are refused
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	secure_suites := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		secure_suites[suite.Name] = suite.ID
+	}
+
+	ids := []uint16{}
+	for _, name := range names {
+		id, ok := secure_suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// CertificateReloader serves a certificate and its key from files, and reloads them when they change
+// The certificate is only used for the new handshakes: the open connections are never interrupted by a reload
+type CertificateReloader struct {
+	cert_file   string
+	key_file    string
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	cert_stat   os.FileInfo
+	key_stat    os.FileInfo
+}
+
+// NewCertificateReloader loads the certificate and its key
+func NewCertificateReloader(cert_file string, key_file string) (*CertificateReloader, error) {
+	reloader := &CertificateReloader{cert_file: cert_file, key_file: key_file}
+	err := reloader.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Reload loads the certificate and its key again, the current certificate is kept if they are invalid
+func (reloader *CertificateReloader) Reload() error {
+	cert_stat, key_stat, err := reloader.stat()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(reloader.cert_file, reloader.key_file)
+	if err != nil {
+		return err
+	}
+
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	reloader.certificate = &certificate
+	reloader.cert_stat = cert_stat
+	reloader.key_stat = key_stat
+	return nil
+}
+
+// Changed checks if the certificate or the key file was modified since they were loaded
+func (reloader *CertificateReloader) Changed() bool {
+	cert_stat, key_stat, err := reloader.stat()
+	if err != nil {
+		return false
+	}
+
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+	return !sameFile(cert_stat, reloader.cert_stat) || !sameFile(key_stat, reloader.key_stat)
+}
+
+// Watch reloads the certificate whenever its files change, checking every interval until the context is done
+// The errors of the reloads are sent to on_error, the current certificate is then kept
+func (reloader *CertificateReloader) Watch(ctx context.Context, interval time.Duration, on_error func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !reloader.Changed() {
+				continue
+			}
+			err := reloader.Reload()
+			if err != nil {
+				on_error(err)
+			}
+		}
+	}
+}
+
+// GetCertificate returns the current certificate, to be used as the GetCertificate of a tls.Config
+func (reloader *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+	return reloader.certificate, nil
+}
+
+// stat returns the information of the certificate and of the key files
+func (reloader *CertificateReloader) stat() (os.FileInfo, os.FileInfo, error) {
+	cert_stat, err := os.Stat(reloader.cert_file)
+	if err != nil {
+		return nil, nil, err
+	}
+	key_stat, err := os.Stat(reloader.key_file)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert_stat, key_stat, nil
+}
+
+// sameFile checks if the file was neither modified nor replaced
+func sameFile(current os.FileInfo, loaded os.FileInfo) bool {
+	return os.SameFile(current, loaded) && current.ModTime().Equal(loaded.ModTime()) && current.Size() == loaded.Size()
+}
@@ -0,0 +1,129 @@
+package tlsutils
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate for common_name and its key, and returns their paths
+func writeCertificate(t *testing.T, dir string, common_name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: common_name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshalling key: %v", err)
+	}
+
+	cert_file, key_file := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	err = os.WriteFile(cert_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err == nil {
+		err = os.WriteFile(key_file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600)
+	}
+	if err != nil {
+		t.Fatalf("Error writing certificate: %v", err)
+	}
+	return cert_file, key_file
+}
+
+// servedCommonName returns the common name of the certificate served by the reloader
+func servedCommonName(t *testing.T, reloader *CertificateReloader) string {
+	certificate, err := reloader.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("Error retrieving certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatalf("Error parsing certificate: %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	cert_file, key_file := writeCertificate(t, dir, "first")
+	reloader, err := NewCertificateReloader(cert_file, key_file)
+	if err != nil {
+		t.Fatalf("Error loading certificate: %v", err)
+	}
+	if reloader.Changed() || servedCommonName(t, reloader) != "first" {
+		t.Errorf("Error loading certificate: expected the first certificate, unchanged")
+	}
+
+	// A renewed certificate is picked up by the watcher
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Watch(ctx, 10*time.Millisecond, func(err error) {
+		t.Errorf("Error reloading certificate: %v", err)
+	})
+	writeCertificate(t, dir, "second")
+	deadline := time.Now().Add(5 * time.Second)
+	for servedCommonName(t, reloader) != "second" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if servedCommonName(t, reloader) != "second" {
+		t.Errorf("Error watching certificate: renewed certificate not served")
+	}
+	cancel()
+
+	// An invalid certificate is refused, the current one is kept
+	err = os.WriteFile(cert_file, []byte("invalid"), 0600)
+	if err != nil {
+		t.Fatalf("Error writing certificate: %v", err)
+	}
+	err = reloader.Reload()
+	if err == nil {
+		t.Errorf("Error reloading certificate: invalid certificate accepted")
+	}
+	if servedCommonName(t, reloader) != "second" {
+		t.Errorf("Error reloading certificate: current certificate dropped")
+	}
+
+	// Missing files are refused right away
+	_, err = NewCertificateReloader(filepath.Join(dir, "missing.pem"), key_file)
+	if err == nil {
+		t.Errorf("Error loading certificate: missing certificate accepted")
+	}
+}
+
+func TestParseTLSPolicy(t *testing.T) {
+	version, err := ParseTLSVersion("1.3")
+	if err != nil || version != tls.VersionTLS13 {
+		t.Errorf("Error parsing TLS version: expected 1.3, got %d (%v)", version, err)
+	}
+	_, err = ParseTLSVersion("1.0")
+	if err == nil {
+		t.Errorf("Error parsing TLS version: TLS 1.0 accepted")
+	}
+
+	ids, err := ParseCipherSuites(DEFAULT_CIPHER_SUITES)
+	if err != nil || len(ids) != len(DEFAULT_CIPHER_SUITES) {
+		t.Errorf("Error parsing cipher suites: default suites refused (%v)", err)
+	}
+	_, err = ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"})
+	if err == nil {
+		t.Errorf("Error parsing cipher suites: insecure suite accepted")
+	}
+}
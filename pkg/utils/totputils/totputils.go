@@ -0,0 +1,110 @@
+package totputils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Length of the generated secrets, the size of a SHA-1 digest as recommended by RFC 4226
+	SECRET_LENGTH = 20
+	// Number of digits of the codes
+	DIGITS = 6
+	// Lifetime of a code (time step)
+	PERIOD = 30 * time.Second
+	// Number of time steps accepted before and after the current one, to tolerate clock drifts
+	SKEW = 1
+)
+
+// secretEncoding is the encoding of the secrets, base32 without padding as expected by the authenticator apps
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret generates a random base32 encoded secret
+func GenerateSecret() (string, error) {
+	secret := make([]byte, SECRET_LENGTH)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return secretEncoding.EncodeToString(secret), nil
+}
+
+// ProvisioningURI returns the otpauth:// URI of the secret, shown as a QR code to the authenticator apps
+func ProvisioningURI(issuer string, account string, secret string) string {
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(DIGITS)},
+		"period":    {strconv.Itoa(int(PERIOD.Seconds()))},
+	}
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// TimeStep returns the time step of the instant
+func TimeStep(at time.Time) int64 {
+	return at.Unix() / int64(PERIOD.Seconds())
+}
+
+// GenerateCode returns the code of the secret at the instant
+func GenerateCode(secret string, at time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(TimeStep(at)), DIGITS), nil
+}
+
+// ValidateCode checks the code against the secret around the instant, and returns the time step it belongs to
+// Callers must refuse the codes of a time step already used, so that a code can not be replayed
+func ValidateCode(secret string, code string, at time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	key, err := decodeSecret(secret)
+	if err != nil || len(code) != DIGITS {
+		return 0, false
+	}
+	current := TimeStep(at)
+	for step := current - SKEW; step <= current+SKEW; step++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(step), DIGITS)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// decodeSecret decodes a base32 secret, whatever its case and padding
+func decodeSecret(secret string) ([]byte, error) {
+	key, err := secretEncoding.DecodeString(strings.TrimRight(strings.ToUpper(secret), "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TOTP secret: %w", err)
+	}
+	return key, nil
+}
+
+// hotp computes the HMAC-based one-time password of the counter (RFC 4226)
+func hotp(key []byte, counter uint64, digits int) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for range digits {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%modulo)
+}
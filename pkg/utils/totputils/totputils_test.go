@@ -0,0 +1,66 @@
+package totputils
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHOTP(t *testing.T) {
+	// Test vectors of RFC 6238 (SHA-1)
+	key := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	for unix, expected := range vectors {
+		code := hotp(key, uint64(TimeStep(time.Unix(unix, 0))), 8)
+		if code != expected {
+			t.Errorf("Error computing code at %d: expected %s, got %s", unix, expected, code)
+		}
+	}
+}
+
+func TestValidateCode(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("Error generating secret: %v", err)
+	}
+	now := time.Now()
+
+	// The codes of the adjacent time steps are accepted
+	previous_code, err := GenerateCode(secret, now.Add(-PERIOD))
+	if err != nil {
+		t.Fatalf("Error generating code: %v", err)
+	}
+	step, ok := ValidateCode(secret, previous_code, now)
+	if !ok || step != TimeStep(now)-1 {
+		t.Errorf("Error validating code: code of the previous time step refused")
+	}
+
+	// The older codes are refused
+	old_code, _ := GenerateCode(secret, now.Add(-3*PERIOD))
+	if _, ok := ValidateCode(secret, old_code, now); ok && old_code != previous_code {
+		t.Errorf("Error validating code: expired code accepted")
+	}
+	if _, ok := ValidateCode(secret, "abcdef", now); ok {
+		t.Errorf("Error validating code: invalid code accepted")
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri, err := url.Parse(ProvisioningURI("JukeBox", "user@example.com", "JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatalf("Error parsing URI: %v", err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/JukeBox:user@example.com" {
+		t.Errorf("Error building URI: unexpected label %s", uri.String())
+	}
+	if uri.Query().Get("secret") != "JBSWY3DPEHPK3PXP" || uri.Query().Get("issuer") != "JukeBox" {
+		t.Errorf("Error building URI: unexpected parameters %s", uri.RawQuery)
+	}
+}